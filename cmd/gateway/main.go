@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/joho/godotenv"
 	_ "github.com/zakirkun/isekai/docs" // swagger docs (bukan internal/docs)
 
 	"github.com/zakirkun/isekai/internal/core"
+	"github.com/zakirkun/isekai/pkg/config"
 	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/version"
 )
 
 // @title Isekai API Gateway
@@ -31,10 +38,25 @@ import (
 // @description Type "Bearer" followed by a space and JWT token.
 
 func main() {
+	dryRun := flag.Bool("dry-run", false, "Validate the configuration, print a JSON summary and exit, non-zero when it has problems (also VALIDATE_ONLY=true)")
+	checkDatabase := flag.Bool("check-database", false, "With --dry-run, also connect to the database read-only to check its schema and routes (also VALIDATE_DATABASE=true)")
+	showVersion := flag.Bool("version", false, "Print the build information and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("isekai %s\n", version.Get())
+		return
+	}
+
 	// Load .env file if it exists
 	_ = godotenv.Load()
 
+	if *dryRun || envBool("VALIDATE_ONLY") {
+		os.Exit(validate(*checkDatabase || envBool("VALIDATE_DATABASE")))
+	}
+
 	log := logger.Get()
+	log.Infof("Isekai API Gateway %s", version.Get())
 
 	// Create and start the enhanced engine
 	engine, err := core.NewV2()
@@ -48,3 +70,26 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// validate prints the summary of the configuration as JSON and returns the
+// exit code: 1 when it has problems
+func validate(checkDatabase bool) int {
+	summary := core.Validate(context.Background(), config.Load(), checkDatabase)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(summary); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print the summary: %v\n", err)
+		return 1
+	}
+	if !summary.Valid {
+		return 1
+	}
+	return 0
+}
+
+// envBool reports whether the environment variable is set to true
+func envBool(key string) bool {
+	value, _ := strconv.ParseBool(os.Getenv(key))
+	return value
+}
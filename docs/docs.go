@@ -343,6 +343,10 @@ const docTemplate = `{
         "github_com_zakirkun_isekai_pkg_response.Response": {
             "type": "object",
             "properties": {
+                "code": {
+                    "type": "string",
+                    "example": "ROUTE_NOT_FOUND"
+                },
                 "data": {},
                 "error": {
                     "type": "string"
@@ -350,6 +354,10 @@ const docTemplate = `{
                 "message": {
                     "type": "string"
                 },
+                "request_id": {
+                    "type": "string",
+                    "example": "4f1c2b7e9a0d3c65"
+                },
                 "success": {
                     "type": "boolean"
                 }
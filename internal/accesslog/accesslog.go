@@ -0,0 +1,315 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// Access log formats
+const (
+	FormatJSON     = "json"
+	FormatCombined = "combined"
+)
+
+// flushInterval bounds how long a written entry can sit in the buffer
+const flushInterval = time.Second
+
+// backupTimeFormat names rotated files; it sorts in rotation order
+const backupTimeFormat = "20060102T150405.000000000"
+
+// Entry is one request in the access log
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"request_id"`
+	ClientIP  string        `json:"client_ip"`
+	Method    string        `json:"method"`
+	URI       string        `json:"uri"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Latency   time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	RouteID   int           `json:"route_id,omitempty"` // Matched proxy route, 0 for none
+	Upstream  string        `json:"upstream,omitempty"` // Target the request was forwarded to
+	Fault     string        `json:"fault,omitempty"`    // Fault injected by chaos testing
+
+	// Recorded headers, with sensitive values masked. Only the JSON format has them.
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+}
+
+// MarshalJSON adds the latency in milliseconds
+func (e Entry) MarshalJSON() ([]byte, error) {
+	type entry Entry
+	return json.Marshal(struct {
+		entry
+		LatencyMS float64 `json:"latency_ms"`
+	}{entry(e), float64(e.Latency.Microseconds()) / 1000})
+}
+
+// Writer appends entries to an access log file from a background goroutine
+// so requests never wait on the disk. The file is rotated by size and age,
+// keeping a bounded number of rotated files.
+type Writer struct {
+	path       string
+	format     string
+	maxBytes   int64
+	maxAge     time.Duration
+	maxBackups int
+	metrics    *metrics.Metrics
+	log        *logger.Logger
+
+	mu      sync.RWMutex // Guards closed against sends on entries
+	closed  bool
+	entries chan Entry
+	reopen  chan chan error
+	done    chan struct{}
+
+	file   *os.File
+	buf    *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+// New opens the access log at cfg.Path and starts its writer
+func New(cfg *config.AccessLogConfig, m *metrics.Metrics, log *logger.Logger) (*Writer, error) {
+	format := strings.ToLower(cfg.Format)
+	if format != FormatJSON && format != FormatCombined {
+		return nil, fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+
+	w := &Writer{
+		path:       cfg.Path,
+		format:     format,
+		maxBytes:   cfg.MaxBytes,
+		maxAge:     cfg.MaxAge,
+		maxBackups: cfg.MaxBackups,
+		metrics:    m,
+		log:        log,
+		entries:    make(chan Entry, cfg.QueueSize),
+		reopen:     make(chan chan error),
+		done:       make(chan struct{}),
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Write queues e without blocking. The entry is dropped when the queue is full.
+func (w *Writer) Write(e Entry) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return
+	}
+
+	select {
+	case w.entries <- e:
+	default:
+		if w.metrics != nil {
+			w.metrics.AccessLogDropped.Inc()
+		}
+	}
+}
+
+// Reopen writes the queued entries and reopens the file at the configured
+// path, for use after an external tool such as logrotate has moved it
+func (w *Writer) Reopen() error {
+	errc := make(chan error)
+	select {
+	case w.reopen <- errc:
+		return <-errc
+	case <-w.done:
+		return nil
+	}
+}
+
+// Close writes the queued entries, flushes and closes the file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.entries)
+	w.mu.Unlock()
+
+	<-w.done
+	return nil
+}
+
+// run writes entries until the queue is closed, flushing whenever it runs dry
+func (w *Writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-w.entries:
+			if !ok {
+				w.flush()
+				if err := w.file.Close(); err != nil {
+					w.log.Errorf("Failed to close access log: %v", err)
+				}
+				return
+			}
+			w.write(e)
+			if len(w.entries) == 0 {
+				w.flush()
+			}
+		case <-ticker.C:
+			w.flush()
+			if w.maxAge > 0 && w.size > 0 && time.Since(w.opened) >= w.maxAge {
+				w.rotate()
+			}
+		case errc := <-w.reopen:
+			// Entries queued before the reopen belong in the old file
+			for n := len(w.entries); n > 0; n-- {
+				w.write(<-w.entries)
+			}
+			w.flush()
+			w.file.Close()
+			errc <- w.open()
+		}
+	}
+}
+
+// write formats e into the buffer, rotating first when it would overflow the file
+func (w *Writer) write(e Entry) {
+	var data []byte
+	if w.format == FormatJSON {
+		var err error
+		if data, err = json.Marshal(e); err != nil {
+			w.log.Errorf("Failed to encode access log entry: %v", err)
+			return
+		}
+		data = append(data, '\n')
+	} else {
+		data = []byte(combined(e))
+	}
+
+	if w.maxBytes > 0 && w.size > 0 && w.size+int64(len(data)) > w.maxBytes {
+		w.rotate()
+	}
+	n, _ := w.buf.Write(data)
+	w.size += int64(n)
+}
+
+// flush writes the buffer to the file
+func (w *Writer) flush() {
+	if err := w.buf.Flush(); err != nil {
+		w.log.Errorf("Failed to write access log: %v", err)
+	}
+}
+
+// open opens the log file for appending
+func (w *Writer) open() error {
+	if dir := filepath.Dir(w.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create access log directory: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+
+	w.file, w.size, w.opened = file, info.Size(), time.Now()
+	if w.buf == nil {
+		w.buf = bufio.NewWriterSize(file, 64<<10)
+	} else {
+		w.buf.Reset(file)
+	}
+	return nil
+}
+
+// rotate moves the current file aside, opens a new one and removes the
+// oldest rotated files beyond the retained count
+func (w *Writer) rotate() {
+	w.flush()
+	w.file.Close()
+
+	backup := w.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(w.path, backup); err != nil {
+		w.log.Errorf("Failed to rotate access log: %v", err)
+	}
+	if err := w.open(); err != nil {
+		// Keep writing somewhere rather than losing entries
+		w.log.Errorf("Failed to reopen access log after rotation: %v", err)
+		w.buf.Reset(os.Stderr)
+		return
+	}
+	w.prune()
+}
+
+// prune removes rotated files beyond the retained count
+func (w *Writer) prune() {
+	if w.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(w.path + ".*")
+	if err != nil || len(backups) <= w.maxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-w.maxBackups] {
+		if err := os.Remove(old); err != nil {
+			w.log.Warnf("Failed to remove rotated access log %s: %v", old, err)
+		}
+	}
+}
+
+// combined formats e in the Apache combined log format, followed by the
+// request ID, route ID, upstream and latency in milliseconds
+func combined(e Entry) string {
+	route := "-"
+	if e.RouteID != 0 {
+		route = strconv.Itoa(e.RouteID)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %d %s %s %s %s %s %.3f\n",
+		orDash(e.ClientIP),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		e.Bytes,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		strconv.Quote(orDash(e.RequestID)),
+		route,
+		strconv.Quote(orDash(e.Upstream)),
+		float64(e.Latency.Microseconds())/1000,
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+package accesslog
+
+import (
+	"context"
+	"sync"
+)
+
+type annotationsKey struct{}
+
+// annotations is a mutable holder so the proxy can report the route and
+// upstream it used back to the access log
+type annotations struct {
+	mu        sync.Mutex
+	routeID   int
+	upstream  string
+	fault     string
+	sensitive []string
+}
+
+// WithAnnotations returns a context that can carry the matched route and upstream
+func WithAnnotations(ctx context.Context) context.Context {
+	return context.WithValue(ctx, annotationsKey{}, &annotations{})
+}
+
+// SetRoute records the matched route ID for the current request. It is a
+// no-op when the context was not prepared with WithAnnotations.
+func SetRoute(ctx context.Context, id int) {
+	if a, ok := ctx.Value(annotationsKey{}).(*annotations); ok {
+		a.mu.Lock()
+		a.routeID = id
+		a.mu.Unlock()
+	}
+}
+
+// SetUpstream records the target the current request was forwarded to
+func SetUpstream(ctx context.Context, target string) {
+	if a, ok := ctx.Value(annotationsKey{}).(*annotations); ok {
+		a.mu.Lock()
+		a.upstream = target
+		a.mu.Unlock()
+	}
+}
+
+// SetFault records the fault injected into the current request
+func SetFault(ctx context.Context, fault string) {
+	if a, ok := ctx.Value(annotationsKey{}).(*annotations); ok {
+		a.mu.Lock()
+		a.fault = fault
+		a.mu.Unlock()
+	}
+}
+
+// SetSensitiveHeaders records headers the matched route masks on top of the
+// gateway's sensitive headers
+func SetSensitiveHeaders(ctx context.Context, names []string) {
+	if a, ok := ctx.Value(annotationsKey{}).(*annotations); ok {
+		a.mu.Lock()
+		a.sensitive = names
+		a.mu.Unlock()
+	}
+}
+
+// SensitiveHeaders returns the headers recorded with SetSensitiveHeaders
+func SensitiveHeaders(ctx context.Context) []string {
+	if a, ok := ctx.Value(annotationsKey{}).(*annotations); ok {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.sensitive
+	}
+	return nil
+}
+
+// Annotate copies the route, upstream and fault recorded in ctx into e
+func Annotate(ctx context.Context, e *Entry) {
+	if a, ok := ctx.Value(annotationsKey{}).(*annotations); ok {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		e.RouteID, e.Upstream, e.Fault = a.routeID, a.upstream, a.fault
+	}
+}
@@ -0,0 +1,125 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Reasons a client is blocked
+const (
+	ReasonDenied      = "denied"
+	ReasonNotAllowed  = "not_allowed"
+	ReasonInvalidIP   = "invalid_ip"
+	ReasonInvalidList = "invalid_list"
+)
+
+// List holds allow and deny CIDRs. Deny takes precedence over allow, and an
+// empty allow list allows every address that isn't denied.
+type List struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Parse builds a list from CIDR strings. Bare addresses match only themselves.
+func Parse(allow, deny []string) (*List, error) {
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow list: %w", err)
+	}
+	denyPrefixes, err := parsePrefixes(deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deny list: %w", err)
+	}
+
+	return &List{allow: allowPrefixes, deny: denyPrefixes}, nil
+}
+
+// Validate checks the CIDR syntax of allow and deny lists
+func Validate(allow, deny []string) error {
+	_, err := Parse(allow, deny)
+	return err
+}
+
+// Empty reports whether the list allows everything
+func (l *List) Empty() bool {
+	return len(l.allow) == 0 && len(l.deny) == 0
+}
+
+// Check reports whether addr may connect, and the reason when it may not
+func (l *List) Check(addr netip.Addr) (bool, string) {
+	addr = addr.Unmap()
+
+	for _, prefix := range l.deny {
+		if prefix.Contains(addr) {
+			return false, ReasonDenied
+		}
+	}
+
+	if len(l.allow) == 0 {
+		return true, ""
+	}
+	for _, prefix := range l.allow {
+		if prefix.Contains(addr) {
+			return true, ""
+		}
+	}
+	return false, ReasonNotAllowed
+}
+
+// CheckRequest checks the client address of a request
+func (l *List) CheckRequest(r *http.Request) (bool, string) {
+	if l.Empty() {
+		return true, ""
+	}
+
+	addr, ok := ClientIP(r)
+	if !ok {
+		return false, ReasonInvalidIP
+	}
+	return l.Check(addr)
+}
+
+// ClientIP returns the address of the client connected to the gateway
+func ClientIP(r *http.Request) (netip.Addr, bool) {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		host = h
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// parsePrefixes parses CIDRs and bare addresses
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", value)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid CIDR", value)
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
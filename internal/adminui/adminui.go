@@ -0,0 +1,221 @@
+package adminui
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+//go:embed dist
+var dist embed.FS
+
+// Prefix is the path the admin UI is served under
+const Prefix = "/admin"
+
+// TokenCookie holds the admin's token for page loads, which can't carry an
+// Authorization header. The login page sets it.
+const TokenCookie = "isekai_admin_token"
+
+// Cache-Control values for pages, which must pick up new asset versions, and
+// for assets requested with their content hash
+const (
+	cachePage      = "no-cache"
+	cacheAsset     = "public, max-age=3600"
+	cacheVersioned = "public, max-age=31536000, immutable"
+)
+
+// contentTypes fixes the types of the embedded files, which would otherwise
+// depend on the host's MIME tables
+var contentTypes = map[string]string{
+	".html":  "text/html; charset=utf-8",
+	".js":    "text/javascript; charset=utf-8",
+	".css":   "text/css; charset=utf-8",
+	".json":  "application/json",
+	".svg":   "image/svg+xml",
+	".png":   "image/png",
+	".ico":   "image/x-icon",
+	".woff2": "font/woff2",
+}
+
+// ClientConfig is handed to the UI by config.js
+type ClientConfig struct {
+	APIBase  string          `json:"apiBase"`
+	WSURL    string          `json:"wsURL"`
+	Version  string          `json:"version"`
+	Features map[string]bool `json:"features"`
+}
+
+// file is an embedded file ready to serve
+type file struct {
+	content []byte
+	etag    string
+	hash    string // Content hash assets are versioned with
+}
+
+// Handler serves the embedded admin UI as a single-page app. Paths without
+// a file extension are client-side routes and get index.html.
+type Handler struct {
+	files  map[string]*file // By path relative to dist
+	config func() ClientConfig
+	loaded time.Time
+}
+
+// New creates the handler, reading config for every config.js request so
+// the UI sees features enabled after startup
+func New(config func() ClientConfig) (*Handler, error) {
+	root, err := fs.Sub(dist, "dist")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handler{files: make(map[string]*file), config: config, loaded: time.Now()}
+	err = fs.WalkDir(root, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(root, name)
+		if err != nil {
+			return err
+		}
+		h.files[name] = newFile(content)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Pages link assets with their hash so browsers can keep them for good
+	for name, page := range h.files {
+		if path.Ext(name) != ".html" {
+			continue
+		}
+		content := page.content
+		for asset, f := range h.files {
+			if strings.HasPrefix(asset, "assets/") {
+				link := Prefix + "/" + asset
+				content = bytes.ReplaceAll(content, []byte(`"`+link+`"`), []byte(`"`+link+"?v="+f.hash+`"`))
+			}
+		}
+		h.files[name] = newFile(content)
+	}
+	return h, nil
+}
+
+func newFile(content []byte) *file {
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:8])
+	return &file{content: content, etag: `"` + hash + `"`, hash: hash}
+}
+
+// ServeHTTP serves the file at the request path, index.html for client-side
+// routes and 404 for missing files
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix), "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	if _, ok := h.files[name]; !ok {
+		if path.Ext(name) != "" {
+			response.ErrorFor(w, r, http.StatusNotFound, response.CodeNotFound, "File not found")
+			return
+		}
+		name = "index.html"
+	}
+	h.serveFile(w, r, name)
+}
+
+// Login serves the login page, which is public
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	h.serveFile(w, r, "login.html")
+}
+
+// ConfigJS serves the API base URL and enabled features as a script setting
+// window.ISEKAI_CONFIG
+func (h *Handler) ConfigJS(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(h.config())
+	if err != nil {
+		response.ErrorFor(w, r, http.StatusInternalServerError, response.CodeInternal, "Failed to encode configuration")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("window.ISEKAI_CONFIG = " + string(data) + ";\n"))
+}
+
+// serveFile writes an embedded file, answering conditional requests
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	f := h.files[name]
+
+	contentType, ok := contentTypes[path.Ext(name)]
+	if !ok {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	cacheControl := cachePage
+	if strings.HasPrefix(name, "assets/") {
+		cacheControl = cacheAsset
+		if r.URL.Query().Get("v") == f.hash {
+			cacheControl = cacheVersioned
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", f.etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, h.loaded, bytes.NewReader(f.content))
+}
+
+// Gate lets admins through and sends everyone else to the login page.
+// The token is read from the Authorization header or TokenCookie. Clients
+// that don't ask for HTML get a 401 or 403 error instead of a redirect.
+func Gate(authService *auth.AuthService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				if cookie, err := r.Cookie(TokenCookie); err == nil {
+					token = cookie.Value
+				}
+			}
+
+			var claims *auth.Claims
+			err := auth.ErrMissingToken
+			if token != "" {
+				claims, err = authService.ValidateToken(token)
+			}
+			if err != nil {
+				if response.Negotiate(r) == response.FormatHTML {
+					http.Redirect(w, r, Prefix+"/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+					return
+				}
+				response.ErrorFor(w, r, http.StatusUnauthorized, auth.ErrorCode(err), err.Error())
+				return
+			}
+
+			if !claims.HasRole("admin") {
+				response.ErrorFor(w, r, http.StatusForbidden, response.CodeForbidden, "Insufficient permissions")
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(auth.WithClaims(r.Context(), claims)))
+		})
+	}
+}
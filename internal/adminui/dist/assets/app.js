@@ -0,0 +1,144 @@
+(function () {
+  "use strict";
+
+  var config = window.ISEKAI_CONFIG || { apiBase: "/api", wsURL: "/ws", features: {} };
+  var view = document.getElementById("view");
+  var socket = null;
+
+  function token() {
+    var match = document.cookie.match(/(?:^|;\s*)isekai_admin_token=([^;]*)/);
+    return match ? decodeURIComponent(match[1]) : "";
+  }
+
+  function signOut() {
+    document.cookie = "isekai_admin_token=; Path=/admin; Max-Age=0; SameSite=Strict";
+    location.assign("/admin/login");
+  }
+
+  function api(path) {
+    var headers = { "Accept": "application/json" };
+    if (token()) {
+      headers.Authorization = "Bearer " + token();
+    }
+    return fetch(config.apiBase + path, { headers: headers }).then(function (res) {
+      if (res.status === 401) {
+        signOut();
+      }
+      return res.json();
+    }).then(function (body) {
+      if (!body.success) {
+        throw new Error(body.error || "Request failed");
+      }
+      return body.data;
+    });
+  }
+
+  function el(tag, text, className) {
+    var node = document.createElement(tag);
+    if (text !== undefined) {
+      node.textContent = text;
+    }
+    if (className) {
+      node.className = className;
+    }
+    return node;
+  }
+
+  function table(columns, rows) {
+    var t = el("table");
+    var head = t.appendChild(el("thead")).appendChild(el("tr"));
+    columns.forEach(function (column) { head.appendChild(el("th", column.title)); });
+    var body = t.appendChild(el("tbody"));
+    rows.forEach(function (row) {
+      var tr = body.appendChild(el("tr"));
+      columns.forEach(function (column) {
+        var value = column.value(row);
+        tr.appendChild(el("td", value === undefined || value === null ? "" : String(value), column.className && column.className(row)));
+      });
+    });
+    return t;
+  }
+
+  function failed(err) {
+    view.replaceChildren(el("p", err.message, "error"));
+  }
+
+  var pages = {
+    "/admin/routes": function () {
+      return api("/routes").then(function (routes) {
+        view.replaceChildren(el("h2", "Routes"), table([
+          { title: "ID", value: function (r) { return r.id; } },
+          { title: "Method", value: function (r) { return r.method; } },
+          { title: "Path", value: function (r) { return r.path; } },
+          { title: "Target", value: function (r) { return r.target_url; } },
+          { title: "Enabled", value: function (r) { return r.enabled ? "yes" : "no"; } }
+        ], routes || []));
+      });
+    },
+    "/admin/breakers": function () {
+      return api("/circuit-breaker/status").then(function (breakers) {
+        view.replaceChildren(el("h2", "Circuit breakers"), table([
+          { title: "Route", value: function (b) { return b.route || "(shared by host)"; } },
+          { title: "Backend", value: function (b) { return b.backend; } },
+          { title: "State", value: function (b) { return b.state; }, className: function (b) { return "state-" + b.state; } }
+        ], breakers || []));
+      });
+    },
+    "/admin/events": function () {
+      var list = el("ul");
+      list.id = "events";
+      view.replaceChildren(el("h2", "Live events"), list);
+      if (!config.features.websocket) {
+        list.appendChild(el("li", "WebSocket events are disabled"));
+        return Promise.resolve();
+      }
+      openSocket(function (message) {
+        var line = new Date().toLocaleTimeString() + "  " + message.type + "  " + JSON.stringify(message.payload);
+        list.insertBefore(el("li", line), list.firstChild);
+        while (list.childNodes.length > 200) {
+          list.removeChild(list.lastChild);
+        }
+      });
+      return Promise.resolve();
+    }
+  };
+
+  function openSocket(onMessage) {
+    var url = new URL(config.wsURL, location.href);
+    url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+    socket = token() ? new WebSocket(url, ["bearer", token()]) : new WebSocket(url);
+    socket.onmessage = function (event) { onMessage(JSON.parse(event.data)); };
+  }
+
+  function render() {
+    if (socket) {
+      socket.close();
+      socket = null;
+    }
+    var path = location.pathname.replace(/\/$/, "");
+    var page = pages[path];
+    if (!page) {
+      history.replaceState(null, "", "/admin/routes");
+      path = "/admin/routes";
+      page = pages[path];
+    }
+    document.querySelectorAll("[data-link]").forEach(function (link) {
+      link.classList.toggle("active", link.getAttribute("href") === path);
+    });
+    page().catch(failed);
+  }
+
+  document.addEventListener("click", function (event) {
+    var link = event.target.closest("[data-link]");
+    if (link) {
+      event.preventDefault();
+      history.pushState(null, "", link.getAttribute("href"));
+      render();
+    }
+  });
+  window.addEventListener("popstate", render);
+  document.getElementById("logout").addEventListener("click", signOut);
+  document.getElementById("version").textContent = config.version || "";
+
+  render();
+})();
@@ -0,0 +1,54 @@
+(function () {
+  "use strict";
+
+  var config = window.ISEKAI_CONFIG || { apiBase: "/api" };
+  var form = document.getElementById("login");
+  var error = document.getElementById("error");
+
+  // Only return to admin pages, so the login page can't be used to redirect elsewhere
+  function next() {
+    var target = new URLSearchParams(location.search).get("next") || "/admin";
+    return /^\/admin(\/|\?|$)/.test(target) ? target : "/admin";
+  }
+
+  // Single sign-on returns through the gateway, which sets the token cookie
+  var features = config.features || {};
+  if (features.oidc) {
+    var sso = document.getElementById("sso");
+    sso.href = config.apiBase + "/auth/oidc/login?next=" + encodeURIComponent(next());
+    sso.hidden = false;
+  }
+  if (features.password_login === false) {
+    Array.prototype.forEach.call(form.querySelectorAll("label, button"), function (el) {
+      el.hidden = true;
+    });
+    Array.prototype.forEach.call(form.querySelectorAll("input"), function (el) {
+      el.required = false;
+    });
+  }
+
+  form.addEventListener("submit", function (event) {
+    event.preventDefault();
+    error.textContent = "";
+
+    fetch(config.apiBase + "/auth/login", {
+      method: "POST",
+      headers: { "Content-Type": "application/json", "Accept": "application/json" },
+      body: JSON.stringify({ username: form.username.value, password: form.password.value })
+    })
+      .then(function (res) { return res.json(); })
+      .then(function (body) {
+        if (!body.success) {
+          error.textContent = body.error || "Sign in failed";
+          return;
+        }
+        var cookie = "isekai_admin_token=" + encodeURIComponent(body.data.token) + "; Path=/admin; SameSite=Strict";
+        if (location.protocol === "https:") {
+          cookie += "; Secure";
+        }
+        document.cookie = cookie;
+        location.assign(next());
+      })
+      .catch(function () { error.textContent = "Gateway unreachable"; });
+  });
+})();
@@ -0,0 +1,116 @@
+package audit
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/database"
+)
+
+// AnonymousActor is recorded when a change is made without authentication
+const AnonymousActor = "anonymous"
+
+// ignoredFields are bookkeeping fields that are not part of a route's configuration
+var ignoredFields = map[string]bool{
+	"id":         true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// FieldChange holds the before and after value of a single field
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Actor identifies who made a request: the JWT user when authenticated,
+// otherwise AnonymousActor. The client IP is always returned.
+func Actor(r *http.Request) (actor, clientIP string) {
+	clientIP = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = host
+	}
+
+	claims, err := auth.GetClaims(r)
+	if err != nil || claims.Username == "" {
+		return AnonymousActor, clientIP
+	}
+
+	return claims.Username, clientIP
+}
+
+// Diff returns the changed fields between two routes as JSON. A nil before
+// describes a creation and a nil after describes a deletion.
+func Diff(before, after *database.Route) (json.RawMessage, error) {
+	changes, err := changedFields(before, after)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(changes)
+}
+
+// UpdateAction classifies an update, distinguishing pure enable/disable toggles
+func UpdateAction(before, after *database.Route) string {
+	changes, err := changedFields(before, after)
+	if err != nil || len(changes) != 1 {
+		return database.AuditActionUpdate
+	}
+	if _, toggled := changes["enabled"]; !toggled {
+		return database.AuditActionUpdate
+	}
+
+	if after.Enabled {
+		return database.AuditActionEnable
+	}
+	return database.AuditActionDisable
+}
+
+// changedFields compares the configuration fields of two routes
+func changedFields(before, after *database.Route) (map[string]FieldChange, error) {
+	beforeFields, err := fields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := fields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]FieldChange)
+	for name, value := range afterFields {
+		if old, exists := beforeFields[name]; !exists || !reflect.DeepEqual(old, value) {
+			changes[name] = FieldChange{Before: beforeFields[name], After: value}
+		}
+	}
+	for name, value := range beforeFields {
+		if _, exists := afterFields[name]; !exists {
+			changes[name] = FieldChange{Before: value}
+		}
+	}
+
+	return changes, nil
+}
+
+// fields flattens a route into its JSON field values
+func fields(route *database.Route) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	if route == nil {
+		return result, nil
+	}
+
+	data, err := json.Marshal(route)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	for name := range ignoredFields {
+		delete(result, name)
+	}
+	return result, nil
+}
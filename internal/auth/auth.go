@@ -2,12 +2,16 @@ package auth
 
 import (
 	"context"
+	"crypto"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/zakirkun/isekai/internal/schedule"
+	"github.com/zakirkun/isekai/pkg/config"
 	"github.com/zakirkun/isekai/pkg/logger"
 	"github.com/zakirkun/isekai/pkg/response"
 )
@@ -17,6 +21,7 @@ var (
 	ErrInvalidToken  = errors.New("invalid authorization token")
 	ErrExpiredToken  = errors.New("token has expired")
 	ErrInvalidClaims = errors.New("invalid token claims")
+	ErrMissingClaims = errors.New("no claims in context")
 )
 
 // Claims represents JWT claims
@@ -24,114 +29,338 @@ type Claims struct {
 	UserID   string   `json:"user_id"`
 	Username string   `json:"username"`
 	Roles    []string `json:"roles"`
+	APIKeyID string   `json:"api_key_id,omitempty"` // Set on tokens issued to API clients
+	Tier     string   `json:"tier,omitempty"`       // Rate limit tier of the caller
+	TenantID string   `json:"tenant_id,omitempty"`  // Tenant the caller belongs to; admins without one cross tenants
 	jwt.RegisteredClaims
 }
 
 // AuthService handles authentication
 type AuthService struct {
-	secretKey []byte
-	log       *logger.Logger
+	method     jwt.SigningMethod
+	secretKey  []byte
+	keys       keySource
+	signingKey crypto.Signer
+	jwks       *JWKS
+	revoked    revocations
+	log        *logger.Logger
 }
 
-// NewAuthService creates a new auth service
+// NewAuthService creates a new auth service signing and verifying HS256 tokens
 func NewAuthService(secretKey string, log *logger.Logger) *AuthService {
 	return &AuthService{
+		method:    jwt.SigningMethodHS256,
 		secretKey: []byte(secretKey),
 		log:       log,
 	}
 }
 
+// NewAuthServiceFromConfig creates an auth service for the configured algorithm.
+// Asymmetric algorithms verify with a PEM public key, a JWKS URL, or the public
+// half of the private key, and can only sign tokens when a private key is set.
+func NewAuthServiceFromConfig(cfg *config.AuthConfig, log *logger.Logger) (*AuthService, error) {
+	method, err := signingMethod(cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	a := NewAuthService(cfg.JWTSecret, log)
+	a.method = method
+	if a.symmetric() {
+		return a, nil
+	}
+
+	if cfg.PrivateKeyFile != "" {
+		if a.signingKey, err = loadPrivateKey(method, cfg.PrivateKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case cfg.JWKSURL != "":
+		a.jwks = NewJWKS(cfg.JWKSURL, cfg.JWKSRefreshInterval, log)
+		a.jwks.Start()
+		a.keys = a.jwks
+	case cfg.PublicKeyFile != "":
+		key, err := loadPublicKey(method, cfg.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = staticKey{key: key}
+	case a.signingKey != nil:
+		a.keys = staticKey{key: a.signingKey.Public()}
+	default:
+		return nil, fmt.Errorf("%s requires a public key, private key or JWKS URL", method.Alg())
+	}
+
+	return a, nil
+}
+
+// Stop stops refreshing remote keys
+func (a *AuthService) Stop() {
+	if a.jwks != nil {
+		a.jwks.Stop()
+	}
+}
+
+// JWKSSchedule returns the schedule refreshing the JWKS, nil when keys
+// aren't fetched from a JWKS URL
+func (a *AuthService) JWKSSchedule() *schedule.Schedule {
+	if a.jwks == nil {
+		return nil
+	}
+	return a.jwks.Schedule()
+}
+
+// symmetric reports whether tokens are signed with the shared secret
+func (a *AuthService) symmetric() bool {
+	_, ok := a.method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
 // GenerateToken generates a JWT token
 func (a *AuthService) GenerateToken(userID, username string, roles []string, duration time.Duration) (string, error) {
-	claims := Claims{
-		UserID:   userID,
-		Username: username,
-		Roles:    roles,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-		},
+	return a.IssueToken(Claims{UserID: userID, Username: username, Roles: roles}, duration)
+}
+
+// IssueToken signs claims into a JWT token valid for duration, with a random
+// ID it can be revoked by
+func (a *AuthService) IssueToken(claims Claims, duration time.Duration) (string, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        id,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		NotBefore: jwt.NewNumericDate(time.Now()),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(a.secretKey)
+	token := jwt.NewWithClaims(a.method, claims)
+	if a.symmetric() {
+		return token.SignedString(a.secretKey)
+	}
+	if a.signingKey == nil {
+		return "", ErrSigningKeyMissing
+	}
+	return token.SignedString(a.signingKey)
 }
 
-// ValidateToken validates a JWT token
+// ValidateToken validates a JWT token. Only the configured algorithm is
+// accepted, so a token can't switch verification to a different key type.
+// Rejected tokens fail with a *ValidationError giving the reason.
 func (a *AuthService) ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, ErrInvalidToken
-		}
-		return a.secretKey, nil
-	})
-
+	claims, err := a.validate(tokenString)
 	if err != nil {
 		return nil, err
 	}
+	return claims, nil
+}
 
-	claims, ok := token.Claims.(*Claims)
-	if !ok || !token.Valid {
-		return nil, ErrInvalidClaims
+// validate validates a token, returning its claims even when it is rejected
+// as long as it parses
+func (a *AuthService) validate(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, a.verificationKey,
+		jwt.WithValidMethods([]string{a.method.Alg()}))
+	if err != nil {
+		invalid := a.validationError(token, err)
+		if invalid.Reason == ReasonMalformed {
+			return nil, invalid
+		}
+		return claims, invalid
 	}
 
+	if !token.Valid {
+		return claims, &ValidationError{Reason: ReasonInvalidClaims, Err: ErrInvalidClaims}
+	}
+	if a.isRevoked(claims.ID) {
+		return claims, &ValidationError{Reason: ReasonRevoked}
+	}
 	return claims, nil
 }
 
+// Identify returns the claims of a valid Bearer token on r without rejecting
+// requests that have none, for middleware that runs before authentication
+func (a *AuthService) Identify(r *http.Request) (*Claims, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+
+	claims, err := a.ValidateToken(token)
+	if err != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+// verificationKey selects the key for a token, by key ID for key sets
+func (a *AuthService) verificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != a.method.Alg() {
+		return nil, ErrInvalidToken
+	}
+	if a.symmetric() {
+		return a.secretKey, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	return a.keys.Key(kid)
+}
+
+// MiddlewareOption configures the authentication middleware
+type MiddlewareOption func(*middlewareOptions)
+
+type middlewareOptions struct {
+	optional bool
+}
+
+// Optional lets requests without an Authorization header through without
+// claims. Requests that do send a token must still present a valid one.
+func Optional() MiddlewareOption {
+	return func(o *middlewareOptions) {
+		o.optional = true
+	}
+}
+
 // Middleware provides JWT authentication middleware
-func (a *AuthService) Middleware() func(http.Handler) http.Handler {
+func (a *AuthService) Middleware(opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	var options middlewareOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Extract token from Authorization header
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
-				response.Unauthorized(w, ErrMissingToken.Error())
+				if options.optional {
+					next.ServeHTTP(w, r)
+					return
+				}
+				response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthMissing, ErrMissingToken.Error())
 				return
 			}
 
 			// Check Bearer prefix
 			parts := strings.Split(authHeader, " ")
 			if len(parts) != 2 || parts[0] != "Bearer" {
-				response.Unauthorized(w, ErrInvalidToken.Error())
+				response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthInvalid, ErrInvalidToken.Error())
 				return
 			}
 
 			// Validate token
 			claims, err := a.ValidateToken(parts[1])
 			if err != nil {
-				response.Unauthorized(w, err.Error())
+				response.ErrorCode(w, http.StatusUnauthorized, ErrorCode(err), err.Error())
 				return
 			}
 
 			// Add claims to context
-			ctx := context.WithValue(r.Context(), "claims", claims)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
 		})
 	}
 }
 
-// RequireRole middleware checks if user has required role
-func RequireRole(role string) func(http.Handler) http.Handler {
+// ErrorCode returns the response error code for an authentication error
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrMissingToken):
+		return response.CodeAuthMissing
+	case errors.Is(err, ErrExpiredToken), errors.Is(err, jwt.ErrTokenExpired):
+		return response.CodeAuthExpired
+	}
+	return response.CodeAuthInvalid
+}
+
+// WebSocketProtocol is the Sec-WebSocket-Protocol value that carries a token,
+// sent by browsers as "bearer, <token>" since they cannot set headers on upgrade
+const WebSocketProtocol = "bearer"
+
+// AuthenticateWebSocket validates the token of a WebSocket upgrade request. The
+// token is read from the Authorization header, the Sec-WebSocket-Protocol header
+// or the token query parameter, in that order.
+func (a *AuthService) AuthenticateWebSocket(r *http.Request) (*Claims, error) {
+	token := webSocketToken(r)
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+
+	claims, err := a.ValidateToken(token)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrExpiredToken
+		}
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// webSocketToken extracts a bearer token from an upgrade request
+func webSocketToken(r *http.Request) string {
+	if parts := strings.Split(r.Header.Get("Authorization"), " "); len(parts) == 2 && parts[0] == "Bearer" {
+		return parts[1]
+	}
+
+	protocols := strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",")
+	for i := 0; i+1 < len(protocols); i++ {
+		if strings.TrimSpace(protocols[i]) == WebSocketProtocol {
+			return strings.TrimSpace(protocols[i+1])
+		}
+	}
+
+	return r.URL.Query().Get("token")
+}
+
+// claimsKey is the context key for authenticated claims
+type claimsKey struct{}
+
+// WithClaims returns a copy of ctx carrying claims
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims attached by the authentication middleware
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok && claims != nil
+}
+
+// GetClaims retrieves claims from request context
+func GetClaims(r *http.Request) (*Claims, error) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		return nil, ErrMissingClaims
+	}
+	return claims, nil
+}
+
+// HasRole reports whether the claims include role
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireClaims middleware allows the request when allow accepts the caller's
+// claims. Unauthenticated requests are rejected with 401, denied ones with 403.
+func RequireClaims(allow func(*Claims) bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			claims, ok := r.Context().Value("claims").(*Claims)
+			claims, ok := ClaimsFromContext(r.Context())
 			if !ok {
-				response.Forbidden(w, "Invalid authentication context")
+				response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthMissing, ErrMissingToken.Error())
 				return
 			}
 
-			// Check if user has required role
-			hasRole := false
-			for _, r := range claims.Roles {
-				if r == role {
-					hasRole = true
-					break
-				}
-			}
-
-			if !hasRole {
-				response.Forbidden(w, "Insufficient permissions")
+			if !allow(claims) {
+				response.ErrorCode(w, http.StatusForbidden, response.CodeForbidden, "Insufficient permissions")
 				return
 			}
 
@@ -140,11 +369,31 @@ func RequireRole(role string) func(http.Handler) http.Handler {
 	}
 }
 
-// GetClaims retrieves claims from request context
-func GetClaims(r *http.Request) (*Claims, error) {
-	claims, ok := r.Context().Value("claims").(*Claims)
-	if !ok {
-		return nil, errors.New("no claims in context")
-	}
-	return claims, nil
+// RequireRole middleware checks if user has required role
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return RequireAnyRole(role)
+}
+
+// RequireAnyRole middleware checks if user has at least one of the roles
+func RequireAnyRole(roles ...string) func(http.Handler) http.Handler {
+	return RequireClaims(func(claims *Claims) bool {
+		for _, role := range roles {
+			if claims.HasRole(role) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RequireAllRoles middleware checks if user has every one of the roles
+func RequireAllRoles(roles ...string) func(http.Handler) http.Handler {
+	return RequireClaims(func(claims *Claims) bool {
+		for _, role := range roles {
+			if !claims.HasRole(role) {
+				return false
+			}
+		}
+		return true
+	})
 }
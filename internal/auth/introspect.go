@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrNotRevocable is returned when revoking a token issued without an ID
+var ErrNotRevocable = errors.New("token has no ID to revoke")
+
+// Reasons a token fails validation
+const (
+	ReasonMalformed     = "malformed"
+	ReasonBadSignature  = "bad_signature"
+	ReasonAlgorithm     = "unexpected_algorithm"
+	ReasonUnknownKey    = "unknown_key"
+	ReasonExpired       = "expired"
+	ReasonNotYetValid   = "not_yet_valid"
+	ReasonRevoked       = "revoked"
+	ReasonInvalidClaims = "invalid_claims"
+)
+
+// reasonMessages explain each reason without the details of the keys
+var reasonMessages = map[string]string{
+	ReasonMalformed:     "token is malformed",
+	ReasonBadSignature:  "token signature is invalid",
+	ReasonAlgorithm:     "token is signed with an unexpected algorithm",
+	ReasonUnknownKey:    "token is signed with an unknown key",
+	ReasonExpired:       ErrExpiredToken.Error(),
+	ReasonNotYetValid:   "token is not valid yet",
+	ReasonRevoked:       "token has been revoked",
+	ReasonInvalidClaims: ErrInvalidClaims.Error(),
+}
+
+// ValidationError is why a token was rejected. It matches ErrInvalidToken,
+// and ErrExpiredToken or ErrInvalidClaims for those reasons, and wraps the
+// JWT library's error.
+type ValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return reasonMessages[e.Reason]
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the sentinel errors callers check authentication failures with
+func (e *ValidationError) Is(target error) bool {
+	switch target {
+	case ErrInvalidToken:
+		return true
+	case ErrExpiredToken:
+		return e.Reason == ReasonExpired
+	case ErrInvalidClaims:
+		return e.Reason == ReasonInvalidClaims
+	}
+	return false
+}
+
+// Reason returns why err rejected a token, or empty when it isn't a
+// *ValidationError
+func Reason(err error) string {
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		return invalid.Reason
+	}
+	return ""
+}
+
+// validationError classifies an error from parsing token. The signature is
+// checked before the times, so an expired token with a bad signature is
+// reported for its signature.
+func (a *AuthService) validationError(token *jwt.Token, err error) *ValidationError {
+	reason := ReasonInvalidClaims
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		reason = ReasonMalformed
+	case token != nil && token.Method != nil && token.Method.Alg() != a.method.Alg():
+		reason = ReasonAlgorithm
+	case errors.Is(err, jwt.ErrTokenUnverifiable):
+		reason = ReasonUnknownKey
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		reason = ReasonBadSignature
+	case errors.Is(err, jwt.ErrTokenExpired):
+		reason = ReasonExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		reason = ReasonNotYetValid
+	}
+	return &ValidationError{Reason: reason, Err: err}
+}
+
+// newTokenID returns a random ID for a token, so it can be revoked
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// revocations holds the IDs of revoked tokens until the tokens expire
+type revocations struct {
+	mu  sync.Mutex
+	ids map[string]time.Time // Expiry of each revoked token, zero for none
+}
+
+// Revoke rejects the token claims were read from until it expires. Tokens
+// without an ID, such as those signed by an external issuer without one,
+// can't be revoked. Revocations are held in memory by this gateway.
+func (a *AuthService) Revoke(claims *Claims) error {
+	if claims.ID == "" {
+		return ErrNotRevocable
+	}
+
+	var expires time.Time
+	if claims.ExpiresAt != nil {
+		expires = claims.ExpiresAt.Time
+	}
+
+	a.revoked.mu.Lock()
+	defer a.revoked.mu.Unlock()
+	now := time.Now()
+	for id, until := range a.revoked.ids {
+		if !until.IsZero() && now.After(until) {
+			delete(a.revoked.ids, id)
+		}
+	}
+	if a.revoked.ids == nil {
+		a.revoked.ids = make(map[string]time.Time)
+	}
+	a.revoked.ids[claims.ID] = expires
+	return nil
+}
+
+// isRevoked reports whether the token ID was revoked
+func (a *AuthService) isRevoked(id string) bool {
+	if id == "" {
+		return false
+	}
+	a.revoked.mu.Lock()
+	defer a.revoked.mu.Unlock()
+	_, ok := a.revoked.ids[id]
+	return ok
+}
+
+// TokenInfo describes a token's claims
+type TokenInfo struct {
+	UserID    string     `json:"user_id"`
+	Username  string     `json:"username"`
+	Roles     []string   `json:"roles"`
+	TenantID  string     `json:"tenant_id,omitempty"`
+	APIKeyID  string     `json:"api_key_id,omitempty"`
+	Tier      string     `json:"tier,omitempty"`
+	TokenID   string     `json:"token_id,omitempty"`
+	Issuer    string     `json:"issuer,omitempty"`
+	IssuedAt  *time.Time `json:"issued_at,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	ExpiresIn int64      `json:"expires_in"` // Seconds of validity left, 0 once expired or without an expiry
+}
+
+// Describe returns the claims' details, with the validity left at now
+func Describe(claims *Claims, now time.Time) TokenInfo {
+	info := TokenInfo{
+		UserID:   claims.UserID,
+		Username: claims.Username,
+		Roles:    claims.Roles,
+		TenantID: claims.TenantID,
+		APIKeyID: claims.APIKeyID,
+		Tier:     claims.Tier,
+		TokenID:  claims.ID,
+		Issuer:   claims.Issuer,
+	}
+	if claims.IssuedAt != nil {
+		info.IssuedAt = &claims.IssuedAt.Time
+	}
+	if claims.NotBefore != nil {
+		info.NotBefore = &claims.NotBefore.Time
+	}
+	if claims.ExpiresAt != nil {
+		info.ExpiresAt = &claims.ExpiresAt.Time
+		if left := claims.ExpiresAt.Sub(now); left > 0 {
+			info.ExpiresIn = int64(left / time.Second)
+		}
+	}
+	return info
+}
+
+// Introspection is what validating a token found
+type Introspection struct {
+	Active bool       `json:"active"`
+	Reason string     `json:"reason,omitempty"` // Why an inactive token was rejected
+	Error  string     `json:"error,omitempty"`
+	Claims *TokenInfo `json:"claims,omitempty"` // Unverified when the token is inactive, absent when it is malformed
+}
+
+// Introspect validates token and reports whether it is accepted and, if not,
+// why. The claims of a rejected token are included whenever it parses, so
+// an expired token still shows who it was for.
+func (a *AuthService) Introspect(token string) Introspection {
+	claims, err := a.validate(token)
+	var result Introspection
+	if err == nil {
+		result.Active = true
+	} else {
+		result.Reason = Reason(err)
+		result.Error = err.Error()
+	}
+	if claims != nil {
+		info := Describe(claims, time.Now())
+		result.Claims = &info
+	}
+	return result
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/schedule"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"golang.org/x/sync/singleflight"
+)
+
+// minJWKSRefresh limits how often an unknown key ID can trigger a refetch
+const minJWKSRefresh = 1 * time.Minute
+
+// jwksRefetchTimeout bounds a refetch made while verifying a token, which the
+// request waits on
+const jwksRefetchTimeout = 3 * time.Second
+
+// JWKS fetches verification keys from a JSON Web Key Set URL and refreshes them periodically
+type JWKS struct {
+	url      string
+	client   *http.Client
+	schedule *schedule.Schedule // Nil when the key set isn't refreshed periodically
+	log      *logger.Logger
+
+	mu          sync.RWMutex
+	keys        map[string]interface{}
+	lastAttempt time.Time // When the key set was last fetched, successfully or not
+	refetch     singleflight.Group
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// jwk is a single JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewJWKS creates a key set backed by url, refreshed about every
+// refreshInterval once started. Refreshes are jittered so gateways started
+// together don't fetch in lockstep, and back off while they fail.
+func NewJWKS(url string, refreshInterval time.Duration, log *logger.Logger) *JWKS {
+	j := &JWKS{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		log:    log,
+		keys:   make(map[string]interface{}),
+		stop:   make(chan struct{}),
+	}
+	if refreshInterval > 0 {
+		j.schedule = schedule.New(schedule.Policy{
+			Interval:    refreshInterval,
+			Jitter:      0.1,
+			Multiplier:  2,
+			MaxInterval: 2 * refreshInterval,
+		}, nil)
+	}
+	return j
+}
+
+// Start fetches the key set and keeps refreshing it until Stop is called
+func (j *JWKS) Start() {
+	err := j.Refresh(context.Background())
+	if err != nil {
+		j.log.Warnf("Failed to fetch JWKS from %s: %v", j.url, err)
+	}
+
+	if j.schedule == nil {
+		return
+	}
+	j.schedule.Report(err)
+
+	go func() {
+		for {
+			select {
+			case <-j.schedule.After():
+				err := j.Refresh(context.Background())
+				if err != nil {
+					j.log.Warnf("Failed to refresh JWKS from %s: %v", j.url, err)
+				}
+				j.schedule.Report(err)
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Schedule returns the schedule of the periodic refresh, nil when the key
+// set isn't refreshed periodically
+func (j *JWKS) Schedule() *schedule.Schedule {
+	return j.schedule
+}
+
+// Stop stops the periodic refresh
+func (j *JWKS) Stop() {
+	j.stopOnce.Do(func() { close(j.stop) })
+}
+
+// Refresh replaces the cached keys with the current key set
+func (j *JWKS) Refresh(ctx context.Context) error {
+	// A failing fetch counts as an attempt, so an unreachable key set isn't
+	// refetched for every token with an unknown key ID
+	j.mu.Lock()
+	j.lastAttempt = time.Now()
+	j.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode key set: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			j.log.Warnf("Skipping JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+
+	return nil
+}
+
+// Key returns the key with the given ID, refetching the key set once if it is
+// unknown so rotated keys are picked up before the next scheduled refresh.
+// Tokens arriving while a refetch is running wait for it rather than starting
+// their own.
+func (j *JWKS) Key(kid string) (interface{}, error) {
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+
+	j.refetch.Do("refetch", func() (interface{}, error) {
+		j.mu.RLock()
+		stale := time.Since(j.lastAttempt) >= minJWKSRefresh
+		j.mu.RUnlock()
+		if !stale {
+			return nil, nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), jwksRefetchTimeout)
+		defer cancel()
+		if err := j.Refresh(ctx); err != nil {
+			j.log.Warnf("Failed to refresh JWKS from %s: %v", j.url, err)
+		}
+		return nil, nil
+	})
+
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookup finds a cached key. Tokens without a key ID match a single-key set.
+func (j *JWKS) lookup(kid string) (interface{}, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if key, ok := j.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// publicKey decodes the key material of an RSA or EC key
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key parameter: %w", err)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnknownKey        = errors.New("unknown signing key")
+	ErrSigningKeyMissing = errors.New("no private key configured for signing")
+)
+
+// keySource resolves the verification key for a token's key ID
+type keySource interface {
+	Key(kid string) (interface{}, error)
+}
+
+// staticKey is a single verification key used regardless of key ID
+type staticKey struct {
+	key interface{}
+}
+
+// Key returns the configured key
+func (s staticKey) Key(string) (interface{}, error) {
+	return s.key, nil
+}
+
+// signingMethod returns the JWT signing method for a configured algorithm
+func signingMethod(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case "", "HS256":
+		return jwt.SigningMethodHS256, nil
+	case "RS256":
+		return jwt.SigningMethodRS256, nil
+	case "ES256":
+		return jwt.SigningMethodES256, nil
+	default:
+		return nil, fmt.Errorf("unsupported auth algorithm %q", alg)
+	}
+}
+
+// loadPrivateKey reads a PEM encoded private key for an asymmetric algorithm
+func loadPrivateKey(method jwt.SigningMethod, path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	var key crypto.Signer
+	switch method.(type) {
+	case *jwt.SigningMethodRSA:
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(data)
+	case *jwt.SigningMethodECDSA:
+		key, err = jwt.ParseECPrivateKeyFromPEM(data)
+	default:
+		return nil, fmt.Errorf("%s does not use a private key", method.Alg())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	return key, nil
+}
+
+// loadPublicKey reads a PEM encoded public key for an asymmetric algorithm
+func loadPublicKey(method jwt.SigningMethod, path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	var key interface{}
+	switch method.(type) {
+	case *jwt.SigningMethodRSA:
+		key, err = jwt.ParseRSAPublicKeyFromPEM(data)
+	case *jwt.SigningMethodECDSA:
+		key, err = jwt.ParseECPublicKeyFromPEM(data)
+	default:
+		return nil, fmt.Errorf("%s does not use a public key", method.Alg())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	return key, nil
+}
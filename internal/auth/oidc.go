@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// ErrOIDCUnavailable is returned when the OIDC provider can't be reached or
+// answers with something other than what the code flow expects
+var ErrOIDCUnavailable = errors.New("identity provider unavailable")
+
+// oidcAlgorithms are the ID token signing algorithms accepted, all verified
+// with the provider's published keys
+var oidcAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// oidcSubjectPrefix keeps OIDC subjects apart from local user IDs
+const oidcSubjectPrefix = "oidc:"
+
+// OIDC signs users in with an OpenID Connect provider using the
+// authorization code flow. The provider's endpoints and keys are discovered
+// on first use, and again after a failed discovery.
+type OIDC struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	rolesClaim   string
+	roleMap      map[string][]string
+	client       *http.Client
+	log          *logger.Logger
+
+	mu       sync.Mutex
+	provider *oidcProvider
+}
+
+// oidcProvider is the part of the provider's discovery document the code
+// flow needs, with its key set
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	jwks *JWKS
+}
+
+// NewOIDC creates an OIDC client from the auth configuration
+func NewOIDC(cfg *config.AuthConfig, log *logger.Logger) *OIDC {
+	return &OIDC{
+		issuer:       strings.TrimSuffix(cfg.OIDCIssuerURL, "/"),
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		redirectURL:  cfg.OIDCRedirectURL,
+		scopes:       cfg.OIDCScopes,
+		rolesClaim:   cfg.OIDCRolesClaim,
+		roleMap:      cfg.OIDCRoleMap,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		log:          log,
+	}
+}
+
+// discover fetches the provider's discovery document and key set once
+func (o *OIDC) discover(ctx context.Context) (*oidcProvider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.provider != nil {
+		return o.provider, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: discovery returned status %d", ErrOIDCUnavailable, resp.StatusCode)
+	}
+
+	var provider oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode discovery document: %v", ErrOIDCUnavailable, err)
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != o.issuer {
+		return nil, fmt.Errorf("%w: discovery document is for issuer %q", ErrOIDCUnavailable, provider.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document lacks the authorization, token or JWKS endpoint", ErrOIDCUnavailable)
+	}
+
+	// Rotated keys are picked up by the key set's refetch on unknown key IDs
+	provider.jwks = NewJWKS(provider.JWKSURI, 0, o.log)
+	provider.jwks.client = o.client
+	if err := provider.jwks.Refresh(ctx); err != nil {
+		return nil, fmt.Errorf("%w: failed to fetch JWKS: %v", ErrOIDCUnavailable, err)
+	}
+
+	o.provider = &provider
+	return o.provider, nil
+}
+
+// AuthCodeURL returns the provider URL that starts a sign-in, carrying state
+// and nonce back to the redirect URL and in the ID token respectively
+func (o *OIDC) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	provider, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid authorization endpoint: %v", ErrOIDCUnavailable, err)
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", o.clientID)
+	query.Set("redirect_uri", o.redirectURL)
+	query.Set("scope", strings.Join(o.scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code at the token endpoint and returns
+// the claims of the verified ID token, mapped to the gateway's
+func (o *OIDC) Exchange(ctx context.Context, code, nonce string) (Claims, error) {
+	provider, err := o.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.redirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic, the method providers must support
+	req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrOIDCUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	// The provider refuses codes that are unknown, expired or already used
+	// with a 400, which is the caller's to retry rather than an outage
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		return Claims{}, fmt.Errorf("%w: token endpoint refused the code with status %d", ErrInvalidToken, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Claims{}, fmt.Errorf("%w: token endpoint returned status %d", ErrOIDCUnavailable, resp.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return Claims{}, fmt.Errorf("%w: failed to decode token response: %v", ErrOIDCUnavailable, err)
+	}
+	if tokens.IDToken == "" {
+		return Claims{}, fmt.Errorf("%w: token response has no ID token", ErrOIDCUnavailable)
+	}
+
+	return o.verify(provider, tokens.IDToken, nonce)
+}
+
+// verify checks the ID token's signature, issuer, audience, expiry and nonce
+// and maps its subject, name and roles claim to gateway claims
+func (o *OIDC) verify(provider *oidcProvider, idToken, nonce string) (Claims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return provider.jwks.Key(kid)
+	},
+		jwt.WithValidMethods(oidcAlgorithms),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(o.clientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return Claims{}, fmt.Errorf("%w: ID token nonce doesn't match the sign-in", ErrInvalidToken)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return Claims{}, fmt.Errorf("%w: ID token has no subject", ErrInvalidToken)
+	}
+
+	username := subject
+	for _, name := range []string{"preferred_username", "email", "name"} {
+		if value, _ := claims[name].(string); value != "" {
+			username = value
+			break
+		}
+	}
+
+	return Claims{
+		UserID:   oidcSubjectPrefix + subject,
+		Username: username,
+		Roles:    o.roles(claims),
+	}, nil
+}
+
+// roles maps the values of the roles claim to gateway roles. With a role map
+// only mapped values grant roles, so unrelated provider groups grant nothing.
+func (o *OIDC) roles(claims jwt.MapClaims) []string {
+	var value interface{} = map[string]interface{}(claims)
+	for _, part := range strings.Split(o.rolesClaim, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{}
+		}
+		value = object[part]
+	}
+
+	var values []string
+	switch v := value.(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	roles := []string{}
+	for _, v := range values {
+		mapped := []string{v}
+		if len(o.roleMap) > 0 {
+			mapped = o.roleMap[v]
+		}
+		for _, role := range mapped {
+			if !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
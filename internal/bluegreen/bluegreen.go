@@ -0,0 +1,75 @@
+package bluegreen
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Colors a route's traffic can be sent to
+const (
+	Blue  = "blue"
+	Green = "green"
+)
+
+// Deployment is a route's blue and green targets and the color receiving its
+// traffic. Requests carrying PreviewHeader go to the other color, so a new
+// release can be smoke tested before traffic is switched to it.
+type Deployment struct {
+	Blue          string `json:"blue"`   // Target URL of the blue color
+	Green         string `json:"green"`  // Target URL of the green color
+	Active        string `json:"active"` // blue or green
+	PreviewHeader string `json:"preview_header,omitempty"`
+}
+
+// Validate checks the targets, the active color and the preview header. An
+// empty active color means blue.
+func (d *Deployment) Validate() error {
+	for color, target := range map[string]string{Blue: d.Blue, Green: d.Green} {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("blue_green.%s must be an absolute http or https URL", color)
+		}
+	}
+	if d.Active != "" && !ValidColor(d.Active) {
+		return errors.New("blue_green.active must be blue or green")
+	}
+	if d.PreviewHeader != "" && !httpguts.ValidHeaderFieldName(d.PreviewHeader) {
+		return fmt.Errorf("invalid blue_green.preview_header %q", d.PreviewHeader)
+	}
+	return nil
+}
+
+// ValidColor reports whether color is blue or green
+func ValidColor(color string) bool {
+	return color == Blue || color == Green
+}
+
+// Other returns the color that isn't color
+func Other(color string) string {
+	if color == Blue {
+		return Green
+	}
+	return Blue
+}
+
+// Target returns the target URL of color
+func (d *Deployment) Target(color string) string {
+	if color == Green {
+		return d.Green
+	}
+	return d.Blue
+}
+
+// Choose returns the color a request is sent to and its target: the active
+// one, or the inactive one for requests carrying the preview header
+func (d *Deployment) Choose(r *http.Request) (color, target string) {
+	color = d.Active
+	if d.PreviewHeader != "" && r.Header.Get(d.PreviewHeader) != "" {
+		color = Other(color)
+	}
+	return color, d.Target(color)
+}
@@ -0,0 +1,231 @@
+package buffering
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zakirkun/isekai/internal/metrics"
+)
+
+// Features that buffer whole bodies
+const (
+	FeatureTransform = "transform"
+	FeatureCache     = "cache"
+	FeatureMirror    = "mirror"
+)
+
+// ErrTooLarge is returned for a body over the size bodies are buffered up to
+var ErrTooLarge = errors.New("body exceeds the buffering limit")
+
+// ErrWatermark is returned when buffering a body would take the memory held
+// by buffered bodies over the watermark
+var ErrWatermark = errors.New("buffered bodies exceed the memory watermark")
+
+// Pool reuses copy buffers of one size across requests. It implements
+// httputil.BufferPool, so the reverse proxy copies bodies with it instead of
+// allocating a buffer for each response.
+type Pool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewPool creates a pool of size byte buffers
+func NewPool(size int) *Pool {
+	p := &Pool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer from the pool
+func (p *Pool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer from Get to the pool. Buffers of another size are
+// left to the garbage collector.
+func (p *Pool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
+
+// Guard bounds the memory held by features buffering whole bodies. Each body
+// is limited to a size, and bodies aren't buffered while those already held
+// add up to the watermark; the features pass them through instead. A nil
+// Guard lets every body be buffered.
+type Guard struct {
+	maxBody   int64
+	watermark int64 // 0 for none
+	buffered  atomic.Int64
+	metrics   *metrics.Metrics
+}
+
+// NewGuard creates a guard buffering bodies of up to maxBody bytes while less
+// than watermark bytes are held, with no watermark when it is 0
+func NewGuard(maxBody, watermark int64, m *metrics.Metrics) *Guard {
+	return &Guard{maxBody: maxBody, watermark: watermark, metrics: m}
+}
+
+// Limit returns the most a feature capped at max bytes may buffer
+func (g *Guard) Limit(max int64) int64 {
+	if g == nil {
+		return max
+	}
+	return min(max, g.maxBody)
+}
+
+// Buffered returns the bytes of the bodies held
+func (g *Guard) Buffered() int64 {
+	if g == nil {
+		return 0
+	}
+	return g.buffered.Load()
+}
+
+// Acquire starts holding a body feature is about to buffer. size is its
+// length when known, -1 otherwise; a known length over the limit, or any
+// body while the watermark is exceeded, fails with ErrTooLarge or
+// ErrWatermark, counted as a skip. The bytes are counted as they are added
+// with Grow.
+func (g *Guard) Acquire(feature string, size int64) (*Hold, error) {
+	h := &Hold{guard: g, feature: feature}
+	if g == nil {
+		return h, nil
+	}
+	if size > g.maxBody {
+		return nil, g.skip(feature, ErrTooLarge)
+	}
+	if g.watermark > 0 && g.buffered.Load()+max(size, 0) > g.watermark {
+		return nil, g.skip(feature, ErrWatermark)
+	}
+	return h, nil
+}
+
+// skip counts a body passed through without feature buffering it
+func (g *Guard) skip(feature string, err error) error {
+	if g.metrics != nil {
+		reason := "too_large"
+		if err == ErrWatermark {
+			reason = "watermark"
+		}
+		g.metrics.BufferingSkipped.WithLabelValues(feature, reason).Inc()
+	}
+	return err
+}
+
+// add changes the bytes held by n
+func (g *Guard) add(n int64) {
+	buffered := g.buffered.Add(n)
+	if g.metrics != nil {
+		g.metrics.BufferedBytes.Set(float64(buffered))
+	}
+}
+
+// Hold is the memory one buffered body holds
+type Hold struct {
+	guard    *Guard
+	feature  string
+	mu       sync.Mutex
+	size     int64
+	released bool
+}
+
+// Grow counts n more bytes of the body. When they would take it over the
+// limit, or the bodies held over the watermark, it fails with ErrTooLarge or
+// ErrWatermark, counted as a skip, and releases the body: the feature is to
+// pass it through.
+func (h *Hold) Grow(n int64) error {
+	if h == nil || h.guard == nil {
+		return nil
+	}
+	g := h.guard
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released {
+		return nil
+	}
+	var err error
+	switch {
+	case h.size+n > g.maxBody:
+		err = ErrTooLarge
+	case g.watermark > 0 && g.buffered.Load()+n > g.watermark:
+		err = ErrWatermark
+	default:
+		h.size += n
+		g.add(n)
+		return nil
+	}
+	h.release()
+	return g.skip(h.feature, err)
+}
+
+// Release stops counting the body. It may be called more than once.
+func (h *Hold) Release() {
+	if h == nil || h.guard == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.release()
+}
+
+func (h *Hold) release() {
+	if !h.released {
+		h.released = true
+		h.guard.add(-h.size)
+	}
+}
+
+// Reader counts the bytes read from r against the hold until Stop is called.
+// A read taking it over a limit returns what it read with the error, and
+// later reads pass through uncounted.
+func (h *Hold) Reader(r io.ReadCloser) *Reader {
+	return &Reader{ReadCloser: r, hold: h}
+}
+
+// Body returns r releasing the hold when it is closed
+func (h *Hold) Body(r io.ReadCloser) io.ReadCloser {
+	return &body{ReadCloser: r, hold: h}
+}
+
+// Reader counts bytes read against a hold
+type Reader struct {
+	io.ReadCloser
+	hold    *Hold
+	stopped bool
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.stopped {
+		if growErr := r.hold.Grow(int64(n)); growErr != nil {
+			r.stopped = true
+			return n, growErr
+		}
+	}
+	return n, err
+}
+
+// Stop leaves later reads uncounted, once the body has been buffered
+func (r *Reader) Stop() {
+	r.stopped = true
+}
+
+// body releases a hold when closed
+type body struct {
+	io.ReadCloser
+	hold *Hold
+}
+
+func (b *body) Close() error {
+	b.hold.Release()
+	return b.ReadCloser.Close()
+}
@@ -2,9 +2,12 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/zakirkun/isekai/internal/events"
 	"github.com/zakirkun/isekai/pkg/config"
 	"github.com/zakirkun/isekai/pkg/logger"
 )
@@ -22,19 +25,68 @@ type Cache struct {
 	cleanupInterval time.Duration
 	defaultTTL      time.Duration
 	maxSize         int64
+	maxStale        time.Duration
 	log             *logger.Logger
+	bus             *events.Bus
 	stopCleanup     chan bool
+
+	loadsMu sync.Mutex
+	loads   map[string]*load // Loads in flight by key
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+	expired   atomic.Uint64
+	stale     atomic.Uint64
+}
+
+// Loader loads the value of a key missing from the cache
+type Loader func(ctx context.Context) (interface{}, error)
+
+// load is a loader call in flight, shared by the callers missing its key
+type load struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// errLoaderPanicked is returned to the callers sharing a load whose loader
+// panicked
+var errLoaderPanicked = errors.New("cache loader panicked")
+
+// refreshKey marks the context of background refreshes
+type refreshKey struct{}
+
+// Refreshing reports whether a loader was called to refresh a stale value in
+// the background, with no caller waiting for its result
+func Refreshing(ctx context.Context) bool {
+	refreshing, _ := ctx.Value(refreshKey{}).(bool)
+	return refreshing
+}
+
+// Stats counts the cache's lookups and removals since it was created
+type Stats struct {
+	Size      int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64         // Items removed to make room
+	Expired   uint64         // Items removed after their TTL
+	Stale     uint64         // Expired items served while they were refreshed
+	Patterns  map[string]int // Items by key pattern
 }
 
 // New creates a new cache instance
-func New(cfg *config.CacheConfig, log *logger.Logger) *Cache {
+func New(cfg *config.CacheConfig, log *logger.Logger, bus *events.Bus) *Cache {
 	c := &Cache{
 		items:           make(map[string]*Item),
 		cleanupInterval: cfg.CleanupInterval,
 		defaultTTL:      cfg.TTL,
 		maxSize:         cfg.MaxSize,
+		maxStale:        cfg.MaxStale,
 		log:             log,
+		bus:             bus,
 		stopCleanup:     make(chan bool),
+		loads:           make(map[string]*load),
 	}
 
 	if cfg.Enabled {
@@ -67,6 +119,11 @@ func (c *Cache) SetWithTTL(key string, value interface{}, ttl time.Duration) {
 	}
 }
 
+// DefaultTTL returns the TTL of items added with Set
+func (c *Cache) DefaultTTL() time.Duration {
+	return c.defaultTTL
+}
+
 // Get retrieves an item from the cache
 func (c *Cache) Get(key string) (interface{}, bool) {
 	c.mu.RLock()
@@ -74,19 +131,109 @@ func (c *Cache) Get(key string) (interface{}, bool) {
 
 	item, exists := c.items[key]
 	if !exists {
+		c.misses.Add(1)
 		return nil, false
 	}
 
 	// Check if item has expired
 	if time.Now().UnixNano() > item.Expiration {
+		c.misses.Add(1)
 		return nil, false
 	}
 
+	c.hits.Add(1)
 	return item.Value, true
 }
 
+// GetOrLoad returns the value cached for key, or loads it with loader and
+// caches it for ttl. Concurrent misses for a key share one loader call, made
+// by the first caller with its context. A value that expired less than the
+// max stale duration ago is returned as is while one loader call refreshes it
+// in the background. The boolean reports whether the value came from the
+// cache.
+func (c *Cache) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader Loader) (interface{}, bool, error) {
+	for {
+		c.mu.RLock()
+		item, exists := c.items[key]
+		c.mu.RUnlock()
+
+		now := time.Now().UnixNano()
+		if exists && now <= item.Expiration {
+			c.hits.Add(1)
+			return item.Value, true, nil
+		}
+		if exists && now <= item.Expiration+int64(c.maxStale) {
+			c.hits.Add(1)
+			c.stale.Add(1)
+			if l, started := c.startLoad(key); started {
+				refreshCtx := context.WithValue(context.WithoutCancel(ctx), refreshKey{}, true)
+				go c.runLoad(refreshCtx, l, key, ttl, loader)
+			}
+			return item.Value, true, nil
+		}
+
+		c.misses.Add(1)
+		l, started := c.startLoad(key)
+		if started {
+			c.runLoad(ctx, l, key, ttl, loader)
+			return l.value, false, l.err
+		}
+
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		// The caller making the load gave up on it, so load again
+		if errors.Is(l.err, context.Canceled) && ctx.Err() == nil {
+			continue
+		}
+		return l.value, false, l.err
+	}
+}
+
+// startLoad returns the load in flight for key, or starts one and reports it
+// is the caller's to run
+func (c *Cache) startLoad(key string) (*load, bool) {
+	c.loadsMu.Lock()
+	defer c.loadsMu.Unlock()
+
+	if l, exists := c.loads[key]; exists {
+		return l, false
+	}
+	l := &load{done: make(chan struct{})}
+	c.loads[key] = l
+	return l, true
+}
+
+// runLoad calls loader for a started load and caches its value, unless the key
+// was deleted meanwhile as the value may then be outdated
+func (c *Cache) runLoad(ctx context.Context, l *load, key string, ttl time.Duration, loader Loader) {
+	l.err = errLoaderPanicked
+	defer func() {
+		c.loadsMu.Lock()
+		if c.loads[key] == l {
+			delete(c.loads, key)
+			if l.err == nil {
+				c.SetWithTTL(key, l.value, ttl)
+			}
+		}
+		c.loadsMu.Unlock()
+		close(l.done)
+	}()
+
+	l.value, l.err = loader(ctx)
+	if l.err != nil && Refreshing(ctx) {
+		c.log.Warnf("Failed to refresh cache item %s: %v", key, l.err)
+	}
+}
+
 // Delete removes an item from the cache
 func (c *Cache) Delete(key string) {
+	c.loadsMu.Lock()
+	delete(c.loads, key)
+	c.loadsMu.Unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	delete(c.items, key)
@@ -94,10 +241,17 @@ func (c *Cache) Delete(key string) {
 
 // Clear removes all items from the cache
 func (c *Cache) Clear() {
+	c.loadsMu.Lock()
+	c.loads = make(map[string]*load)
+	c.loadsMu.Unlock()
+
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	cleared := len(c.items)
 	c.items = make(map[string]*Item)
+	c.mu.Unlock()
+
 	c.log.Info("Cache cleared")
+	c.bus.Publish(events.CacheCleared, map[string]int{"items": cleared})
 }
 
 // Size returns the number of items in the cache
@@ -107,6 +261,19 @@ func (c *Cache) Size() int {
 	return len(c.items)
 }
 
+// Stats returns the cache's size and counters
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Size:      c.Size(),
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Expired:   c.expired.Load(),
+		Stale:     c.stale.Load(),
+		Patterns:  c.patterns(),
+	}
+}
+
 // startCleanup starts the cleanup goroutine
 func (c *Cache) startCleanup() {
 	ticker := time.NewTicker(c.cleanupInterval)
@@ -122,7 +289,8 @@ func (c *Cache) startCleanup() {
 	}
 }
 
-// deleteExpired removes expired items from the cache
+// deleteExpired removes expired items from the cache, keeping those that may
+// still be served stale
 func (c *Cache) deleteExpired() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -131,13 +299,14 @@ func (c *Cache) deleteExpired() {
 	count := 0
 
 	for key, item := range c.items {
-		if now > item.Expiration {
+		if now > item.Expiration+int64(c.maxStale) {
 			delete(c.items, key)
 			count++
 		}
 	}
 
 	if count > 0 {
+		c.expired.Add(uint64(count))
 		c.log.Debugf("Cleaned up %d expired cache items", count)
 	}
 }
@@ -156,6 +325,7 @@ func (c *Cache) evictOldest() {
 
 	if oldestKey != "" {
 		delete(c.items, oldestKey)
+		c.evictions.Add(1)
 		c.log.Debugf("Evicted oldest cache item: %s", oldestKey)
 	}
 }
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyInfo describes a cached item
+type KeyInfo struct {
+	Key   string
+	TTL   time.Duration // Time left, negative once expired
+	Size  int           // Approximate size in bytes
+	Stale bool          // Expired but still served while it is refreshed
+}
+
+// Sizer is implemented by cached values that know their approximate size
+type Sizer interface {
+	Size() int
+}
+
+// Pattern returns the part of key before its first colon, which names the
+// kind of item, e.g. route for route:42
+func Pattern(key string) string {
+	pattern, _, _ := strings.Cut(key, ":")
+	return pattern
+}
+
+// Keys describes the items whose keys start with prefix, sorted by key.
+// Expired items are left out unless they may still be served stale.
+func (c *Cache) Keys(prefix string) []KeyInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	keys := make([]KeyInfo, 0)
+	for key, item := range c.items {
+		if !strings.HasPrefix(key, prefix) || now > item.Expiration+int64(c.maxStale) {
+			continue
+		}
+		keys = append(keys, KeyInfo{
+			Key:   key,
+			TTL:   time.Duration(item.Expiration - now),
+			Size:  SizeOf(item.Value),
+			Stale: now > item.Expiration,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys
+}
+
+// TTL returns the time left before key expires, negative for an item that
+// expired but may still be served stale
+func (c *Cache) TTL(key string) (time.Duration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	item, exists := c.items[key]
+	now := time.Now().UnixNano()
+	if !exists || now > item.Expiration+int64(c.maxStale) {
+		return 0, false
+	}
+	return time.Duration(item.Expiration - now), true
+}
+
+// Peek returns the value of key like Get, including stale values, without
+// counting a hit or miss
+func (c *Cache) Peek(key string) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	item, exists := c.items[key]
+	if !exists || time.Now().UnixNano() > item.Expiration+int64(c.maxStale) {
+		return nil, false
+	}
+	return item.Value, true
+}
+
+// patterns counts the items by key pattern
+func (c *Cache) patterns() map[string]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for key := range c.items {
+		counts[Pattern(key)]++
+	}
+	return counts
+}
+
+// SizeOf approximates the size of a cached value, by its JSON encoding when it
+// doesn't know its own
+func SizeOf(value interface{}) int {
+	switch v := value.(type) {
+	case Sizer:
+		return v.Size()
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return 0
+	}
+	return len(encoded)
+}
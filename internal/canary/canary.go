@@ -0,0 +1,46 @@
+package canary
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+)
+
+// Variants a request can be routed to
+const (
+	VariantStable = "stable"
+	VariantCanary = "canary"
+)
+
+// StickyHeader identifies a user so their requests stay on one variant
+const StickyHeader = "X-User-ID"
+
+// Choose picks the variant for a request given the share of traffic, in
+// percent, sent to the canary. Requests carrying StickyHeader are assigned by
+// hashing its value, so a user sees the same variant until the weight changes
+// past their bucket. Other requests are assigned at random.
+func Choose(r *http.Request, weight int) string {
+	if weight <= 0 {
+		return VariantStable
+	}
+	if weight >= 100 {
+		return VariantCanary
+	}
+
+	if bucket(r) < weight {
+		return VariantCanary
+	}
+	return VariantStable
+}
+
+// bucket returns the request's position in [0, 100) used for the split
+func bucket(r *http.Request) int {
+	key := r.Header.Get(StickyHeader)
+	if key == "" {
+		return rand.Intn(100)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % 100)
+}
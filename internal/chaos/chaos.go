@@ -0,0 +1,195 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fault kinds, used as metric and log labels
+const (
+	FaultAbort   = "abort"
+	FaultError   = "error"
+	FaultLatency = "latency"
+)
+
+// MaxDelay is the longest delay a fault may inject
+const MaxDelay = 60 * time.Second
+
+// Fault configures the faults injected into a route's requests. Each kind is
+// rolled independently for every request.
+type Fault struct {
+	ErrorPercent float64 `json:"error_percent"` // Share of requests answered with ErrorStatus
+	ErrorStatus  int     `json:"error_status"`  // 500-599, defaults to 503
+	DelayPercent float64 `json:"delay_percent"` // Share of requests held before forwarding
+	Delay        int     `json:"delay"`         // Milliseconds
+	Jitter       int     `json:"jitter"`        // Milliseconds added at random on top of Delay
+	AbortPercent float64 `json:"abort_percent"` // Share of requests whose connection is dropped
+}
+
+// Validate checks the percentages, error status and delay
+func (f *Fault) Validate() error {
+	for _, percent := range []float64{f.ErrorPercent, f.DelayPercent, f.AbortPercent} {
+		if percent < 0 || percent > 100 {
+			return errors.New("fault percentages must be between 0 and 100")
+		}
+	}
+	if f.ErrorStatus != 0 && (f.ErrorStatus < 500 || f.ErrorStatus > 599) {
+		return errors.New("error_status must be between 500 and 599")
+	}
+	if f.Delay < 0 || f.Jitter < 0 {
+		return errors.New("delay and jitter can't be negative")
+	}
+	if time.Duration(f.Delay+f.Jitter)*time.Millisecond > MaxDelay {
+		return errors.New("delay and jitter can't exceed " + MaxDelay.String())
+	}
+	if f.ErrorPercent == 0 && f.AbortPercent == 0 && (f.DelayPercent == 0 || f.Delay+f.Jitter == 0) {
+		return errors.New("the fault injects nothing")
+	}
+	return nil
+}
+
+// Decision is the faults chosen for one request
+type Decision struct {
+	Delay  time.Duration // Wait before anything else, 0 for none
+	Status int           // Error status to answer with, 0 for none
+	Abort  bool          // Drop the connection instead of answering
+}
+
+// Label returns the most severe fault in the decision, or empty for none
+func (d Decision) Label() string {
+	switch {
+	case d.Abort:
+		return FaultAbort
+	case d.Status != 0:
+		return FaultError
+	case d.Delay > 0:
+		return FaultLatency
+	}
+	return ""
+}
+
+// Registry holds the faults configured per route. Faults live in memory only
+// and are lost on restart.
+type Registry struct {
+	mu     sync.RWMutex
+	faults map[int]Fault
+	rnd    *rand.Rand
+	rndMu  sync.Mutex
+}
+
+// NewRegistry creates an empty fault registry
+func NewRegistry() *Registry {
+	return &Registry{
+		faults: make(map[int]Fault),
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Set replaces the fault injected into a route's requests
+func (r *Registry) Set(routeID int, fault Fault) {
+	if fault.ErrorStatus == 0 {
+		fault.ErrorStatus = http.StatusServiceUnavailable
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.faults[routeID] = fault
+}
+
+// Clear stops injecting faults into a route's requests and reports whether
+// it had any
+func (r *Registry) Clear(routeID int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.faults[routeID]
+	delete(r.faults, routeID)
+	return ok
+}
+
+// Reset clears every route's faults
+func (r *Registry) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.faults = make(map[int]Fault)
+}
+
+// Get returns the fault configured for a route
+func (r *Registry) Get(routeID int) (Fault, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fault, ok := r.faults[routeID]
+	return fault, ok
+}
+
+// RouteFault is a route's fault as listed by All
+type RouteFault struct {
+	RouteID int `json:"route_id"`
+	Fault
+}
+
+// All returns the configured faults ordered by route ID
+func (r *Registry) All() []RouteFault {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	faults := make([]RouteFault, 0, len(r.faults))
+	for id, fault := range r.faults {
+		faults = append(faults, RouteFault{RouteID: id, Fault: fault})
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i].RouteID < faults[j].RouteID })
+	return faults
+}
+
+// Decide rolls the faults for one request to a route. A nil registry
+// injects nothing.
+func (r *Registry) Decide(routeID int) Decision {
+	if r == nil {
+		return Decision{}
+	}
+	fault, ok := r.Get(routeID)
+	if !ok {
+		return Decision{}
+	}
+
+	r.rndMu.Lock()
+	defer r.rndMu.Unlock()
+
+	var d Decision
+	if r.roll(fault.DelayPercent) {
+		jitter := 0
+		if fault.Jitter > 0 {
+			jitter = r.rnd.Intn(fault.Jitter + 1)
+		}
+		d.Delay = time.Duration(fault.Delay+jitter) * time.Millisecond
+	}
+	if r.roll(fault.AbortPercent) {
+		d.Abort = true
+	} else if r.roll(fault.ErrorPercent) {
+		d.Status = fault.ErrorStatus
+	}
+	return d
+}
+
+// roll reports true for percent percent of calls. The caller holds rndMu.
+func (r *Registry) roll(percent float64) bool {
+	return percent > 0 && r.rnd.Float64()*100 < percent
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the label of the fault injected into
+// its request
+func NewContext(ctx context.Context, fault string) context.Context {
+	return context.WithValue(ctx, contextKey{}, fault)
+}
+
+// FromContext returns the label of the fault injected into the request, or
+// empty for none
+func FromContext(ctx context.Context) string {
+	fault, _ := ctx.Value(contextKey{}).(string)
+	return fault
+}
@@ -1,111 +1,413 @@
 package circuitbreaker
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/sony/gobreaker"
+	"github.com/zakirkun/isekai/internal/events"
 	"github.com/zakirkun/isekai/internal/metrics"
 	"github.com/zakirkun/isekai/pkg/logger"
 )
 
+// StatusError carries an upstream response status to IsSuccessful.
+// ExecuteStatus returns the status without it.
+type StatusError struct {
+	Status   int
+	Failures []int // 4xx statuses counted as failures on top of 5xx
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upstream responded %d", e.Status)
+}
+
+// ErrShortCircuit marks a request answered without reaching the target, such
+// as by a fallback. It isn't counted as a failure.
+var ErrShortCircuit = errors.New("request short-circuited")
+
+// IsSuccessful classifies a request's outcome for the breakers. Connect
+// errors, timeouts and 5xx responses are failures. Requests cancelled by the
+// client or a faster hedge, short-circuited requests and other responses say
+// nothing about the target, unless their status is one of the route's
+// failure statuses.
+func IsSuccessful(err error) bool {
+	var status *StatusError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &status):
+		return status.Status < 500 && !slices.Contains(status.Failures, status.Status)
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrShortCircuit):
+		return true
+	}
+	return false
+}
+
+// Defaults of breakers whose route doesn't set them
+const (
+	DefaultMinRequests      = 3
+	DefaultFailureRatio     = 0.6
+	DefaultOpenTimeout      = 60 // Seconds
+	DefaultHalfOpenRequests = 3
+)
+
+// Bounds of a route's breaker settings
+const (
+	MaxMinRequests      = 10000
+	MaxOpenTimeout      = 3600 // Seconds
+	MaxHalfOpenRequests = 100
+)
+
+// countInterval is how often a closed breaker's counts are reset
+const countInterval = 10 * time.Second
+
+// Scopes of a route's breakers
+const (
+	ScopeRoute = "route" // A breaker per route and backend, the default
+	ScopeHost  = "host"  // A breaker per backend host, shared by the routes to it with this scope
+)
+
+// Settings is a route's circuit breaker configuration. Zero fields take the
+// defaults.
+type Settings struct {
+	Disabled         bool    `json:"disabled,omitempty"`           // Never trip, forwarding every request
+	MinRequests      int     `json:"min_requests,omitempty"`       // Requests within the count interval before the breaker may trip
+	FailureRatio     float64 `json:"failure_ratio,omitempty"`      // Share of those requests failing that trips it
+	OpenTimeout      int     `json:"open_timeout,omitempty"`       // Seconds the breaker stays open before probing the target
+	HalfOpenRequests int     `json:"half_open_requests,omitempty"` // Probe requests let through while half-open
+	Scope            string  `json:"scope,omitempty"`              // ScopeRoute, or ScopeHost to share a breaker per backend host
+}
+
+// Validate checks that the settings are within bounds, and that a disabled
+// breaker or one shared per host sets no thresholds
+func (s *Settings) Validate() error {
+	switch s.Scope {
+	case "", ScopeRoute:
+	case ScopeHost:
+		// Routes sharing a host's breaker can't each bring their own
+		// thresholds, so it always has the defaults
+		if *s != (Settings{Scope: ScopeHost}) {
+			return errors.New("breaker can't set thresholds or be disabled with the host scope")
+		}
+		return nil
+	default:
+		return fmt.Errorf("breaker scope must be %q or %q", ScopeRoute, ScopeHost)
+	}
+	if s.Disabled {
+		if *s != (Settings{Disabled: true}) {
+			return errors.New("breaker can't set thresholds when disabled")
+		}
+		return nil
+	}
+	if s.MinRequests < 0 || s.MinRequests > MaxMinRequests {
+		return fmt.Errorf("breaker min_requests must be between 1 and %d", MaxMinRequests)
+	}
+	if !(s.FailureRatio >= 0 && s.FailureRatio <= 1) {
+		return errors.New("breaker failure_ratio must be above 0 and at most 1")
+	}
+	if s.OpenTimeout < 0 || s.OpenTimeout > MaxOpenTimeout {
+		return fmt.Errorf("breaker open_timeout must be between 1 and %d seconds", MaxOpenTimeout)
+	}
+	if s.HalfOpenRequests < 0 || s.HalfOpenRequests > MaxHalfOpenRequests {
+		return fmt.Errorf("breaker half_open_requests must be between 1 and %d", MaxHalfOpenRequests)
+	}
+	return nil
+}
+
+// withDefaults returns the settings with zero fields set to the defaults.
+// Nil settings are the defaults.
+func (s *Settings) withDefaults() Settings {
+	var filled Settings
+	if s != nil {
+		filled = *s
+	}
+	filled.Scope = ""
+	if filled.Disabled {
+		return filled
+	}
+	if filled.MinRequests == 0 {
+		filled.MinRequests = DefaultMinRequests
+	}
+	if filled.FailureRatio == 0 {
+		filled.FailureRatio = DefaultFailureRatio
+	}
+	if filled.OpenTimeout == 0 {
+		filled.OpenTimeout = DefaultOpenTimeout
+	}
+	if filled.HalfOpenRequests == 0 {
+		filled.HalfOpenRequests = DefaultHalfOpenRequests
+	}
+	return filled
+}
+
+// Key identifies a breaker: the route it guards and the backend it guards
+// the route from. Breakers shared per backend host have no route.
+type Key struct {
+	RouteID int    `json:"route_id,omitempty"`
+	Route   string `json:"route,omitempty"` // Path of the route
+	Backend string `json:"backend"`         // Origin of the backend, scheme://host:port
+}
+
+// String names the breaker in logs and events
+func (k Key) String() string {
+	if k.RouteID == 0 && k.Route == "" {
+		return k.Backend
+	}
+	return fmt.Sprintf("%s (route %d %s)", k.Backend, k.RouteID, k.Route)
+}
+
+// RouteKey returns the key of the breaker guarding a route's requests to
+// target. Every backend of every route gets its own breaker, so one team's
+// failing route doesn't open another's to the same backend and an unhealthy
+// instance doesn't open its healthy siblings', unless the route's settings
+// share a breaker per backend host.
+func RouteKey(routeID int, route, target string, settings *Settings) Key {
+	backend := Origin(target)
+	if settings != nil && settings.Scope == ScopeHost {
+		return Key{Backend: backend}
+	}
+	return Key{RouteID: routeID, Route: route, Backend: backend}
+}
+
+// Origin returns the scheme and host of target, so requests to every path of
+// a backend share its breaker. Targets that don't parse as URLs are returned
+// as is.
+func Origin(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return target
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// State is a breaker's state
+type State struct {
+	Key
+	State gobreaker.State `json:"-"`
+}
+
+// breaker is a breaker with the key and settings it was built with
+type breaker struct {
+	*gobreaker.CircuitBreaker
+	key      Key
+	settings Settings
+}
+
 // CircuitBreaker manages circuit breakers for different targets
 type CircuitBreaker struct {
-	breakers map[string]*gobreaker.CircuitBreaker
+	breakers map[string]*breaker
 	mu       sync.RWMutex
-	settings gobreaker.Settings
 	log      *logger.Logger
 	metrics  *metrics.Metrics
+	bus      *events.Bus
 }
 
 // New creates a new circuit breaker manager
-func New(log *logger.Logger, metrics *metrics.Metrics) *CircuitBreaker {
+func New(log *logger.Logger, metrics *metrics.Metrics, bus *events.Bus) *CircuitBreaker {
 	return &CircuitBreaker{
-		breakers: make(map[string]*gobreaker.CircuitBreaker),
-		settings: gobreaker.Settings{
-			Name:        "DefaultCircuitBreaker",
-			MaxRequests: 3,
-			Interval:    time.Second * 10,
-			Timeout:     time.Second * 60,
-			ReadyToTrip: func(counts gobreaker.Counts) bool {
-				failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
-				return counts.Requests >= 3 && failureRatio >= 0.6
-			},
-			OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
-				log.Infof("Circuit breaker '%s' state changed from %s to %s", name, from, to)
-			},
-		},
-		log:     log,
-		metrics: metrics,
+		breakers: make(map[string]*breaker),
+		log:      log,
+		metrics:  metrics,
+		bus:      bus,
 	}
 }
 
-// GetBreaker returns or creates a circuit breaker for the target
-func (cb *CircuitBreaker) GetBreaker(target string) *gobreaker.CircuitBreaker {
+// GetBreaker returns or creates the circuit breaker of key, as returned by
+// RouteKey, with settings, nil for the defaults. A breaker built with other
+// settings, such as before its route was updated, is replaced by a new,
+// closed one.
+func (cb *CircuitBreaker) GetBreaker(key Key, settings *Settings) *gobreaker.CircuitBreaker {
+	want := settings.withDefaults()
+	name := key.String()
+
 	cb.mu.RLock()
-	breaker, exists := cb.breakers[target]
+	existing, exists := cb.breakers[name]
 	cb.mu.RUnlock()
 
-	if exists {
-		return breaker
+	if exists && existing.settings == want {
+		return existing.CircuitBreaker
 	}
 
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 
 	// Double-check after acquiring write lock
-	if breaker, exists := cb.breakers[target]; exists {
-		return breaker
+	existing, exists = cb.breakers[name]
+	if exists && existing.settings == want {
+		return existing.CircuitBreaker
+	}
+	if exists {
+		cb.log.Infof("Circuit breaker '%s' settings changed, starting closed", name)
+	}
+	if cb.metrics != nil {
+		cb.metrics.CircuitBreakerState.WithLabelValues(key.Route, key.Backend).Set(0)
+	}
+
+	b := &breaker{CircuitBreaker: gobreaker.NewCircuitBreaker(cb.settings(key, want)), key: key, settings: want}
+	cb.breakers[name] = b
+
+	return b.CircuitBreaker
+}
+
+// RemoveRoute removes the breakers of a route, so a deleted route's are
+// forgotten and an updated one starts with closed breakers to its current
+// backends. Breakers shared per host are kept.
+func (cb *CircuitBreaker) RemoveRoute(routeID int) {
+	cb.remove(func(key Key) bool { return key.RouteID == routeID })
+}
+
+// RemoveRoutes removes the breakers of every route, such as once all routes
+// were replaced. Breakers shared per host are kept.
+func (cb *CircuitBreaker) RemoveRoutes() {
+	cb.remove(func(key Key) bool { return key.RouteID != 0 })
+}
+
+// RemoveBackend removes every breaker guarding requests to the backend at
+// target, as it has left the pool
+func (cb *CircuitBreaker) RemoveBackend(target string) {
+	backend := Origin(target)
+	cb.remove(func(key Key) bool { return key.Backend == backend })
+}
+
+// remove removes the breakers whose key matches, along with their state
+// metric unless a remaining breaker reports under the same labels
+func (cb *CircuitBreaker) remove(match func(Key) bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	var removed []Key
+	for name, b := range cb.breakers {
+		if match(b.key) {
+			delete(cb.breakers, name)
+			removed = append(removed, b.key)
+		}
+	}
+	if cb.metrics == nil {
+		return
+	}
+
+	labelled := make(map[[2]string]bool, len(cb.breakers))
+	for _, b := range cb.breakers {
+		labelled[[2]string{b.key.Route, b.key.Backend}] = true
+	}
+	for _, key := range removed {
+		if !labelled[[2]string{key.Route, key.Backend}] {
+			cb.metrics.CircuitBreakerState.DeleteLabelValues(key.Route, key.Backend)
+		}
 	}
+}
 
-	settings := cb.settings
-	settings.Name = target
+// settings builds the gobreaker settings of the breaker of key
+func (cb *CircuitBreaker) settings(key Key, s Settings) gobreaker.Settings {
+	settings := gobreaker.Settings{
+		Name:        key.String(),
+		MaxRequests: uint32(s.HalfOpenRequests),
+		Interval:    countInterval,
+		Timeout:     time.Duration(s.OpenTimeout) * time.Second,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			if s.Disabled {
+				return false
+			}
+			failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
+			return counts.Requests >= uint32(s.MinRequests) && failureRatio >= s.FailureRatio
+		},
+		IsSuccessful: IsSuccessful,
+	}
 	settings.OnStateChange = func(name string, from gobreaker.State, to gobreaker.State) {
 		cb.log.Infof("Circuit breaker '%s' state changed from %s to %s", name, from, to)
 
 		// Update metrics
 		var stateValue float64
+		var eventType events.Type
 		switch to {
 		case gobreaker.StateClosed:
 			stateValue = 0
+			eventType = events.CircuitBreakerClosed
 		case gobreaker.StateHalfOpen:
 			stateValue = 1
+			eventType = events.CircuitBreakerHalfOpen
 		case gobreaker.StateOpen:
 			stateValue = 2
+			eventType = events.CircuitBreakerOpen
 		}
 		if cb.metrics != nil {
-			cb.metrics.CircuitBreakerState.WithLabelValues(name).Set(stateValue)
+			cb.metrics.CircuitBreakerState.WithLabelValues(key.Route, key.Backend).Set(stateValue)
 		}
-	}
 
-	breaker = gobreaker.NewCircuitBreaker(settings)
-	cb.breakers[target] = breaker
+		cb.bus.Publish(eventType, map[string]string{
+			"name":    name,
+			"route":   key.Route,
+			"backend": key.Backend,
+			"from":    from.String(),
+			"to":      to.String(),
+		})
+	}
 
-	return breaker
+	return settings
 }
 
-// Execute executes a function with circuit breaker protection
+// Execute executes a function with circuit breaker protection, through the
+// breaker of target outside any route
 func (cb *CircuitBreaker) Execute(target string, fn func() (interface{}, error)) (interface{}, error) {
-	breaker := cb.GetBreaker(target)
+	return cb.execute(Key{Backend: target}, nil, fn)
+}
+
+// execute runs fn through the breaker of key with settings
+func (cb *CircuitBreaker) execute(key Key, settings *Settings, fn func() (interface{}, error)) (interface{}, error) {
+	breaker := cb.GetBreaker(key, settings)
 	result, err := breaker.Execute(fn)
 
 	if err != nil {
 		if err == gobreaker.ErrOpenState {
-			cb.log.Warnf("Circuit breaker '%s' is open", target)
+			cb.log.Warnf("Circuit breaker '%s' is open", key)
 		}
-		return nil, fmt.Errorf("circuit breaker error for %s: %w", target, err)
+		return nil, fmt.Errorf("circuit breaker error for %s: %w", key, err)
 	}
 
 	return result, nil
 }
 
-// GetState returns the current state of a circuit breaker
-func (cb *CircuitBreaker) GetState(target string) gobreaker.State {
+// ExecuteStatus runs fn, which returns the upstream response status, with
+// circuit breaker protection. The status is classified by IsSuccessful with
+// failures as the route's failure statuses, and returned without an error
+// whether or not it counts as a failure.
+func (cb *CircuitBreaker) ExecuteStatus(target string, failures []int, fn func() (int, error)) (int, error) {
+	return cb.ExecuteRoute(Key{Backend: target}, nil, failures, fn)
+}
+
+// ExecuteRoute is ExecuteStatus through the breaker of key with a route's
+// settings, nil for the defaults
+func (cb *CircuitBreaker) ExecuteRoute(key Key, settings *Settings, failures []int, fn func() (int, error)) (int, error) {
+	var status int
+	_, err := cb.execute(key, settings, func() (interface{}, error) {
+		var err error
+		status, err = fn()
+		if err == nil {
+			err = &StatusError{Status: status, Failures: failures}
+		}
+		return status, err
+	})
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return status, nil
+	}
+	return status, err
+}
+
+// GetState returns the current state of the circuit breaker named name, the
+// String of its key
+func (cb *CircuitBreaker) GetState(name string) gobreaker.State {
 	cb.mu.RLock()
 	defer cb.mu.RUnlock()
 
-	breaker, exists := cb.breakers[target]
+	breaker, exists := cb.breakers[name]
 	if !exists {
 		return gobreaker.StateClosed
 	}
@@ -113,15 +415,25 @@ func (cb *CircuitBreaker) GetState(target string) gobreaker.State {
 	return breaker.State()
 }
 
-// GetAllStates returns the states of all circuit breakers
-func (cb *CircuitBreaker) GetAllStates() map[string]gobreaker.State {
+// GetAllStates returns the states of all circuit breakers, ordered by backend
+// then route
+func (cb *CircuitBreaker) GetAllStates() []State {
 	cb.mu.RLock()
 	defer cb.mu.RUnlock()
 
-	states := make(map[string]gobreaker.State)
-	for name, breaker := range cb.breakers {
-		states[name] = breaker.State()
+	states := make([]State, 0, len(cb.breakers))
+	for _, breaker := range cb.breakers {
+		states = append(states, State{Key: breaker.key, State: breaker.State()})
 	}
+	slices.SortFunc(states, func(a, b State) int {
+		if a.Backend != b.Backend {
+			return strings.Compare(a.Backend, b.Backend)
+		}
+		if a.Route != b.Route {
+			return strings.Compare(a.Route, b.Route)
+		}
+		return a.RouteID - b.RouteID
+	})
 
 	return states
 }
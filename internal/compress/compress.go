@@ -0,0 +1,193 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings the gateway encodes and decodes
+const (
+	Brotli = "br"
+	Gzip   = "gzip"
+)
+
+// Encodings are the content codings supported, in the default order of
+// preference
+var Encodings = []string{Brotli, Gzip}
+
+// brotliLevel trades some of brotli's ratio for speed on the fly, still
+// compressing smaller than gzip's default level at a similar cost
+const brotliLevel = 4
+
+// ErrTooLarge is returned by Decode when the decoded body is over the limit
+var ErrTooLarge = errors.New("decoded body too large")
+
+// Supported reports whether encoding is one the gateway encodes and decodes
+func Supported(encoding string) bool {
+	return slices.Contains(Encodings, encoding)
+}
+
+// Normalize returns the content coding named by a Content-Encoding header,
+// lowercased, with x-gzip as gzip and empty for identity. Several codings
+// are returned as listed, which no supported coding matches.
+func Normalize(header string) string {
+	encoding := strings.ToLower(strings.TrimSpace(header))
+	switch encoding {
+	case "identity":
+		return ""
+	case "x-gzip":
+		return Gzip
+	}
+	return encoding
+}
+
+// Negotiate picks the encoding of preferred the Accept-Encoding header
+// accepts with the highest q-value, earlier ones in preferred winning ties.
+// A coding listed with q=0 is refused, and * stands for the codings the
+// header doesn't list. Empty means the body goes unencoded, as it does for
+// requests without the header.
+func Negotiate(header string, preferred []string) string {
+	if strings.TrimSpace(header) == "" {
+		return ""
+	}
+
+	listed := make(map[string]float64)
+	wildcard := -1.0
+	for _, item := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = Normalize(name)
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(key), "q") {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		// A coding listed twice keeps its best q-value
+		if current, ok := listed[name]; !ok || q > current {
+			listed[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range preferred {
+		q, ok := listed[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// Writer compresses what is written to it. Close finishes the stream
+// without closing the underlying writer.
+type Writer interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var (
+	gzipWriters   = sync.Pool{New: func() interface{} { w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression); return w }}
+	brotliWriters = sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, brotliLevel) }}
+)
+
+// pooled returns its encoder to the pool once closed
+type pooled struct {
+	Writer
+	pool *sync.Pool
+}
+
+func (p *pooled) Close() error {
+	if p.pool == nil {
+		return nil
+	}
+	err := p.Writer.Close()
+	p.pool.Put(p.Writer)
+	p.pool = nil
+	return err
+}
+
+// NewWriter returns a writer compressing to w with encoding, which must be
+// supported
+func NewWriter(encoding string, w io.Writer) (Writer, error) {
+	switch encoding {
+	case Gzip:
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(w)
+		return &pooled{Writer: gz, pool: &gzipWriters}, nil
+	case Brotli:
+		br := brotliWriters.Get().(*brotli.Writer)
+		br.Reset(w)
+		return &pooled{Writer: br, pool: &brotliWriters}, nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// NewReader returns a reader decompressing r, encoded with encoding
+func NewReader(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Brotli:
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// Encode compresses data with encoding
+func Encode(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewWriter(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decompresses data encoded with encoding, failing with ErrTooLarge
+// rather than decoding more than max bytes
+func Decode(encoding string, data []byte, max int64) ([]byte, error) {
+	r, err := NewReader(encoding, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s body: %w", encoding, err)
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s body: %w", encoding, err)
+	}
+	if int64(len(decoded)) > max {
+		return nil, ErrTooLarge
+	}
+	return decoded, nil
+}
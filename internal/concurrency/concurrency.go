@@ -0,0 +1,103 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a request is turned away
+var (
+	ErrQueueFull    = errors.New("concurrency limit reached")
+	ErrQueueTimeout = errors.New("timed out waiting for a concurrency slot")
+)
+
+// Limiter caps the requests in flight. Requests over the cap wait in a queue
+// of bounded size for up to the queue timeout before being turned away.
+type Limiter struct {
+	slots   chan struct{}
+	queue   int64
+	timeout time.Duration
+	queued  atomic.Int64
+	onQueue func(delta int) // Called as requests enter and leave the queue, may be nil
+}
+
+// New creates a limiter allowing max requests in flight and queue more
+// waiting up to timeout. onQueue may be nil.
+func New(max, queue int, timeout time.Duration, onQueue func(delta int)) *Limiter {
+	return &Limiter{
+		slots:   make(chan struct{}, max),
+		queue:   int64(queue),
+		timeout: timeout,
+		onQueue: onQueue,
+	}
+}
+
+// Max returns the number of requests allowed in flight
+func (l *Limiter) Max() int {
+	return cap(l.slots)
+}
+
+// InFlight returns the number of requests holding a slot
+func (l *Limiter) InFlight() int {
+	return len(l.slots)
+}
+
+// Queued returns the number of requests waiting for a slot
+func (l *Limiter) Queued() int {
+	return int(l.queued.Load())
+}
+
+// Acquire takes a slot, waiting in the queue if there is room. The returned
+// release must be called once the request is done.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	if l.queued.Add(1) > l.queue {
+		l.queued.Add(-1)
+		return nil, ErrQueueFull
+	}
+	l.changeQueue(1)
+	defer func() {
+		l.queued.Add(-1)
+		l.changeQueue(-1)
+	}()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-timer.C:
+		return nil, ErrQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Limiter) release() {
+	<-l.slots
+}
+
+func (l *Limiter) changeQueue(delta int) {
+	if l.onQueue != nil {
+		l.onQueue(delta)
+	}
+}
+
+// Reason returns a metric label for an error returned by Acquire
+func Reason(err error) string {
+	switch {
+	case errors.Is(err, ErrQueueFull):
+		return "queue_full"
+	case errors.Is(err, ErrQueueTimeout):
+		return "queue_timeout"
+	default:
+		return "canceled"
+	}
+}
@@ -40,8 +40,13 @@ func New() (*Engine, error) {
 	log := logger.Get()
 	log.Info("Starting Isekai API Gateway...")
 
+	// Refuse unreadable secret files and the placeholder JWT secret
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	// Initialize database
-	db, err := database.New(&cfg.Database, log)
+	db, err := database.New(&cfg.Database, log, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
@@ -54,10 +59,10 @@ func New() (*Engine, error) {
 	}
 
 	// Initialize cache
-	cacheInstance := cache.New(&cfg.Cache, log)
+	cacheInstance := cache.New(&cfg.Cache, log, nil)
 
 	// Initialize proxy
-	proxyInstance := proxy.New(cfg.Gateway.RequestTimeout, log)
+	proxyInstance := proxy.New(cfg.Gateway.RequestTimeout, &cfg.Proxy, log)
 
 	// Initialize router
 	routerInstance := router.New(db, cacheInstance, proxyInstance, cfg, log)
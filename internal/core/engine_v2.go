@@ -2,7 +2,9 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,17 +13,27 @@ import (
 	"time"
 
 	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/buffering"
 	"github.com/zakirkun/isekai/internal/cache"
 	"github.com/zakirkun/isekai/internal/circuitbreaker"
 	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/discovery"
+	"github.com/zakirkun/isekai/internal/drain"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/listener"
 	"github.com/zakirkun/isekai/internal/loadbalancer"
 	"github.com/zakirkun/isekai/internal/metrics"
 	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/resolver"
 	"github.com/zakirkun/isekai/internal/router"
+	"github.com/zakirkun/isekai/internal/schedule"
+	"github.com/zakirkun/isekai/internal/seal"
 	"github.com/zakirkun/isekai/internal/tracing"
 	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/internal/worker"
 	"github.com/zakirkun/isekai/pkg/config"
 	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
 )
 
 // EngineV2 represents the enhanced API gateway engine with all features
@@ -32,19 +44,54 @@ type EngineV2 struct {
 	cache       *cache.Cache
 	proxy       *proxy.Proxy
 	router      *router.RouterV2
-	server      *http.Server
+	listen      []listener.Address
+	servers     []*http.Server
 	authService *auth.AuthService
 	metrics     *metrics.Metrics
 	cb          *circuitbreaker.CircuitBreaker
 	lb          *loadbalancer.LoadBalancer
+	discovery   *discovery.Discovery
 	tracer      *tracing.TracerProvider
+	meter       *tracing.MeterProvider
 	wsHub       *websocket.Hub
 	wsContext   context.Context
 	wsCancel    context.CancelFunc
+	drainer     *drain.Drainer
+	dbContext   context.Context
+	dbCancel    context.CancelFunc
 	wg          sync.WaitGroup
 	shutdown    chan os.Signal
+	reopen      chan os.Signal
+	workers     *worker.Group
+
+	// Background worker schedules
+	statsSchedule  *schedule.Schedule
+	healthSchedule *schedule.Schedule
+	cbSchedule     *schedule.Schedule
+	rollupSchedule *schedule.Schedule
 }
 
+// Background worker scheduling policies. Jitter keeps a fleet restarted
+// together from probing upstreams and the database in lockstep.
+var (
+	statsPolicy = schedule.Policy{
+		Interval:    1 * time.Minute,
+		Jitter:      0.1,
+		MaxInterval: 2 * time.Minute,
+	}
+	healthPolicy = schedule.Policy{
+		Interval:    30 * time.Second,
+		Jitter:      0.2,
+		Multiplier:  2,
+		MaxInterval: 5 * time.Minute,
+	}
+	cbMonitorPolicy = schedule.Policy{
+		Interval:    10 * time.Second,
+		Jitter:      0.2,
+		MaxInterval: 30 * time.Second,
+	}
+)
+
 // NewV2 creates a new enhanced Engine instance with all features
 func NewV2() (*EngineV2, error) {
 	// Load configuration
@@ -56,52 +103,151 @@ func NewV2() (*EngineV2, error) {
 	log.Infof("Features enabled: Auth=%v, Tracing=%v, RateLimit=%v",
 		cfg.Auth.Enabled, cfg.Tracing.Enabled, cfg.Gateway.RateLimitEnabled)
 
-	// Initialize database
-	db, err := database.New(&cfg.Database, log)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	// Check the whole configuration before connecting to anything
+	settings, problems := checkConfig(cfg)
+	if len(problems) > 0 {
+		return nil, errors.Join(problems...)
 	}
 
-	// Initialize database schema
-	ctx := context.Background()
-	if err := db.InitSchema(ctx); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to initialize database schema: %w", err)
+	// Serve branded HTML error pages on the proxy path
+	if settings.errorPages != nil {
+		response.SetErrorPages(settings.errorPages)
 	}
 
+	// Inline upstream client keys and credentials are stored encrypted with
+	// this secret
+	seal.SetKey(cfg.Proxy.TLSSealKey)
+
+	// Initialize metrics, including the Go runtime and process metrics
+	metricsInstance := metrics.New()
+	metricsInstance.RegisterRuntimeCollectors()
+
+	// Initialize database. When it isn't required the gateway starts without
+	// it and connects in the background once started.
+	var db *database.Database
+	var err error
+	if cfg.Database.Required {
+		db, err = database.New(&cfg.Database, log, metricsInstance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize database: %w", err)
+		}
+
+		// Initialize database schema
+		ctx := context.Background()
+		if err := db.InitSchema(ctx); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to initialize database schema: %w", err)
+		}
+	} else {
+		db = database.NewDisconnected(&cfg.Database, log, metricsInstance)
+	}
+
+	// Initialize event bus shared by components that publish gateway events
+	bus := events.NewBus()
+
 	// Initialize cache
-	cacheInstance := cache.New(&cfg.Cache, log)
+	cacheInstance := cache.New(&cfg.Cache, log, bus)
 
 	// Initialize proxy
-	proxyInstance := proxy.New(cfg.Gateway.RequestTimeout, log)
-
-	// Initialize metrics
-	metricsInstance := metrics.New()
+	proxyInstance := proxy.New(cfg.Gateway.RequestTimeout, &cfg.Proxy, log)
+	proxyInstance.SetBuffers(buffering.NewGuard(cfg.Proxy.BufferMaxBody, cfg.Proxy.BufferWatermark, metricsInstance))
+	if cfg.Proxy.DNSCache || len(cfg.Proxy.DNSHosts) > 0 {
+		// Pinned addresses were checked by Validate
+		hosts, _ := resolver.ParseHosts(cfg.Proxy.DNSHosts)
+		opts := resolver.Options{Timeout: cfg.Proxy.DialTimeout, Hosts: hosts}
+		if cfg.Proxy.DNSCache {
+			opts.TTL = cfg.Proxy.DNSTTL
+			opts.NegativeTTL = cfg.Proxy.DNSNegativeTTL
+			opts.RefreshAhead = cfg.Proxy.DNSRefreshAhead
+			opts.MaxStale = cfg.Proxy.DNSMaxStale
+			log.Infof("Upstream DNS cache enabled - TTL %s, serving stale answers for up to %s", opts.TTL, opts.MaxStale)
+		}
+		proxyInstance.SetResolver(resolver.New(opts, nil, metricsInstance))
+	}
 
 	// Initialize auth service
-	authService := auth.NewAuthService(cfg.Auth.JWTSecret, log)
+	authService, err := auth.NewAuthServiceFromConfig(&cfg.Auth, log)
+	if err != nil {
+		cacheInstance.Stop()
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize auth: %w", err)
+	}
 
 	// Initialize circuit breaker
-	cb := circuitbreaker.New(log, metricsInstance)
+	cb := circuitbreaker.New(log, metricsInstance, bus)
 
 	// Initialize load balancer
-	lb := loadbalancer.New(loadbalancer.RoundRobin)
-	// TODO: Load backends from database/config
+	lb := loadbalancer.New(loadbalancer.RoundRobin, bus)
+	// Backends leaving the pool, by hand or through discovery, take their
+	// breakers with them
+	lb.SetRemoveHook(cb.RemoveBackend)
+	for _, backend := range cfg.LoadBalancer.Backends {
+		lb.AddBackend(backend)
+	}
+	for backend, priority := range cfg.LoadBalancer.Priorities {
+		if !lb.SetPriority(backend, priority) {
+			log.Warnf("LB_BACKEND_PRIORITIES names %s, which is not in LB_BACKENDS", backend)
+		}
+	}
+	var disc *discovery.Discovery
+	if cfg.LoadBalancer.Discovery.Type != "" {
+		provider, err := discovery.NewProvider(&cfg.LoadBalancer.Discovery, log)
+		if err != nil {
+			authService.Stop()
+			cacheInstance.Stop()
+			db.Close()
+			return nil, fmt.Errorf("failed to initialize service discovery: %w", err)
+		}
+		disc = discovery.New(provider, lb, cfg.LoadBalancer.Discovery.Interval, cfg.LoadBalancer.Discovery.DrainTimeout, log)
+		log.Infof("Service discovery enabled - resolving %s every %s", provider.Source(), cfg.LoadBalancer.Discovery.Interval)
+	}
+	if cfg.LoadBalancer.StickyCookie != "" {
+		lb.SetStickyCookie(&loadbalancer.StickyCookie{
+			Name: cfg.LoadBalancer.StickyCookie,
+			TTL:  cfg.LoadBalancer.StickyTTL,
+			Key:  []byte(cfg.LoadBalancer.StickyKey),
+		})
+	}
+	if cfg.LoadBalancer.OutlierConsecutiveFailures > 0 || cfg.LoadBalancer.OutlierFailurePercent > 0 {
+		lb.SetOutlierDetection(&loadbalancer.OutlierPolicy{
+			ConsecutiveFailures: cfg.LoadBalancer.OutlierConsecutiveFailures,
+			FailurePercent:      cfg.LoadBalancer.OutlierFailurePercent,
+			MinRequests:         cfg.LoadBalancer.OutlierMinRequests,
+			Window:              cfg.LoadBalancer.OutlierWindow,
+			BaseEjection:        cfg.LoadBalancer.OutlierBaseEjection,
+			MaxEjection:         cfg.LoadBalancer.OutlierMaxEjection,
+		}, metricsInstance)
+	}
 
 	// Initialize tracing (if enabled)
 	var tracer *tracing.TracerProvider
 	if cfg.Tracing.Enabled {
-		tracer, err = tracing.New(cfg.Tracing.ServiceName, cfg.Tracing.OTELEndpoint)
+		tracer, err = tracing.New(&cfg.Tracing)
 		if err != nil {
 			log.Warnf("Failed to initialize tracing: %v", err)
 		} else {
-			log.Infof("Distributed tracing enabled - sending to OTEL collector at %s", cfg.Tracing.OTELEndpoint)
+			log.Infof("Distributed tracing enabled - sending to OTEL collector at %s (sampler: %s)", cfg.Tracing.OTELEndpoint, cfg.Tracing.Sampler)
+		}
+	}
+
+	// Export the metrics over OTLP as well (if enabled)
+	var meter *tracing.MeterProvider
+	if cfg.Tracing.MetricsEnabled {
+		meter, err = tracing.NewMeterProvider(&cfg.Tracing, metricsInstance.Registry())
+		if err != nil {
+			log.Warnf("Failed to initialize OTLP metrics export: %v", err)
+		} else {
+			log.Infof("OTLP metrics export enabled - sending to OTEL collector at %s every %s", cfg.Tracing.OTELEndpoint, cfg.Tracing.MetricsInterval)
 		}
 	}
 
 	// Initialize WebSocket hub
 	wsContext, wsCancel := context.WithCancel(context.Background())
-	wsHub := websocket.NewHub(log)
+	wsHub := websocket.NewHub(&cfg.WebSocket, log, metricsInstance)
+	bus.Subscribe(wsHub.PublishEvent)
+
+	// Initialize drainer tracking in-flight requests
+	drainer := drain.New()
 
 	// Initialize router
 	routerInstance := router.NewV2(
@@ -115,20 +261,13 @@ func NewV2() (*EngineV2, error) {
 		cb,
 		lb,
 		wsHub,
+		bus,
+		drainer,
 	)
+	routerInstance.SetDiscovery(disc)
 
-	// Create HTTP server
-	server := &http.Server{
-		Addr:           ":" + cfg.Server.Port,
-		Handler:        routerInstance.Handler(),
-		ReadTimeout:    cfg.Server.ReadTimeout,
-		WriteTimeout:   cfg.Server.WriteTimeout,
-		MaxHeaderBytes: cfg.Server.MaxHeaderBytes,
-	}
-
-	// Setup shutdown signal channel
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	// Context for the background database connection
+	dbContext, dbCancel := context.WithCancel(context.Background())
 
 	engine := &EngineV2{
 		config:      cfg,
@@ -137,36 +276,60 @@ func NewV2() (*EngineV2, error) {
 		cache:       cacheInstance,
 		proxy:       proxyInstance,
 		router:      routerInstance,
-		server:      server,
+		listen:      settings.listen,
 		authService: authService,
 		metrics:     metricsInstance,
 		cb:          cb,
 		lb:          lb,
+		discovery:   disc,
 		tracer:      tracer,
+		meter:       meter,
 		wsHub:       wsHub,
 		wsContext:   wsContext,
 		wsCancel:    wsCancel,
-		shutdown:    shutdown,
+		drainer:     drainer,
+		dbContext:   dbContext,
+		dbCancel:    dbCancel,
+		shutdown:    make(chan os.Signal, 1),
+		reopen:      make(chan os.Signal, 1),
+		workers:     worker.NewGroup(),
+
+		statsSchedule:  schedule.New(statsPolicy, nil),
+		healthSchedule: schedule.New(healthPolicy, nil),
+		cbSchedule:     schedule.New(cbMonitorPolicy, nil),
+		rollupSchedule: schedule.New(schedule.Policy{
+			Interval:    cfg.Database.RollupInterval,
+			Jitter:      0.1,
+			Multiplier:  2,
+			MaxInterval: 2 * cfg.Database.RollupInterval,
+		}, nil),
 	}
 
 	return engine, nil
 }
 
-// Start starts the engine
+// Start starts the engine: it listens, starts the background workers and
+// serves until shut down. NewV2 has no such side effects.
 func (e *EngineV2) Start() error {
-	// Start server in a goroutine
-	e.wg.Add(1)
-	go func() {
-		defer e.wg.Done()
-		e.log.Infof("🚀 Server starting on port %s", e.config.Server.Port)
-		e.log.Infof("📊 Metrics available at http://localhost:%s/metrics", e.config.Server.Port)
-		e.log.Infof("📚 Swagger docs at http://localhost:%s/swagger/index.html", e.config.Server.Port)
-		e.log.Infof("🔌 WebSocket endpoint at ws://localhost:%s/ws", e.config.Server.Port)
+	// Shut down on SIGINT and SIGTERM, and reopen the access log on SIGHUP
+	// after logrotate moves it
+	signal.Notify(e.shutdown, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(e.reopen, syscall.SIGHUP)
+
+	// Warm up the route table, upstream connections and circuit breakers,
+	// failing readiness meanwhile when WARMUP_BLOCKING is set
+	if e.config.Warmup.Enabled {
+		e.workers.Go(e.warmup)
+	}
 
-		if err := e.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			e.log.Errorf("Server error: %v", err)
-		}
-	}()
+	// Open every listener before serving on any, so an address in use fails
+	// startup rather than leaving the gateway half reachable
+	if err := e.openListeners(); err != nil {
+		return err
+	}
+	e.log.Infof("📊 Metrics available at /metrics")
+	e.log.Infof("📚 Swagger docs at /swagger/index.html")
+	e.log.Infof("🔌 WebSocket endpoint at /ws")
 
 	// Start WebSocket hub
 	e.wg.Add(1)
@@ -175,39 +338,173 @@ func (e *EngineV2) Start() error {
 		e.wsHub.Run(e.wsContext)
 	}()
 
+	// Keep connecting to the database if it was unavailable at startup
+	if !e.db.Connected() {
+		e.log.Warn("⚠️  Starting without a database, readiness will fail until it connects")
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			e.db.ConnectInBackground(e.dbContext)
+		}()
+	}
+
 	// Start background workers
 	e.startBackgroundWorkers()
 
-	// Wait for shutdown signal
-	<-e.shutdown
-	e.log.Info("🛑 Shutdown signal received, gracefully shutting down...")
+	// Wait for a shutdown signal or a drain requested through the admin API,
+	// reopening the access log on SIGHUP meanwhile
+	for waiting := true; waiting; {
+		select {
+		case <-e.reopen:
+			e.router.ReopenAccessLog()
+		case <-e.shutdown:
+			e.log.Info("🛑 Shutdown signal received, gracefully shutting down...")
+			if e.config.Server.DrainOnSigterm > 0 {
+				e.drain(e.config.Server.DrainOnSigterm)
+			}
+			waiting = false
+		case <-e.drainer.Started():
+			e.drain(e.config.Server.DrainPeriod)
+			waiting = false
+		}
+	}
 
 	return e.Stop()
 }
 
+// drain fails readiness and stops accepting WebSocket connections, then
+// waits out period and for in-flight requests, bounded by the shutdown timeout
+func (e *EngineV2) drain(period time.Duration) {
+	e.drainer.Start()
+	e.wsHub.StopAccepting()
+	e.log.Infof("⏳ Draining for %s before shutdown...", period)
+
+	ctx, cancel := context.WithTimeout(context.Background(), period+e.config.Server.ShutdownTimeout)
+	defer cancel()
+
+	if err := e.drainer.Wait(ctx, period); err != nil {
+		e.log.Warnf("Drain ended with %d requests still in flight", e.drainer.InFlight())
+	}
+}
+
+// Handler returns the engine's HTTP handler, for serving it from an
+// embedding program or a test
+func (e *EngineV2) Handler() http.Handler {
+	return e.router.Handler()
+}
+
+// openListeners listens on every configured address and serves each in a
+// goroutine. Listeners with admin=false serve proxied traffic only.
+func (e *EngineV2) openListeners() error {
+	type opened struct {
+		addr     listener.Address
+		listener net.Listener
+	}
+	var all []opened
+	for _, addr := range e.listen {
+		listeners, err := listener.Listen(addr)
+		if err != nil {
+			for _, o := range all {
+				o.listener.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		for _, l := range listeners {
+			all = append(all, opened{addr: addr, listener: l})
+		}
+	}
+
+	for _, o := range all {
+		handler := e.router.Handler()
+		if !o.addr.Admin {
+			handler = e.router.PublicHandler()
+		}
+		server := &http.Server{
+			Handler:        handler,
+			ReadTimeout:    e.config.Server.ReadTimeout,
+			WriteTimeout:   e.config.Server.WriteTimeout,
+			MaxHeaderBytes: e.config.Server.MaxHeaderBytes,
+		}
+		e.servers = append(e.servers, server)
+
+		// Serving TLS also negotiates HTTP/2, which gRPC clients need. Local
+		// unix sockets are served in plain text.
+		tls := e.config.Server.TLSCertFile != "" && o.listener.Addr().Network() == "tcp"
+		scope := ""
+		if !o.addr.Admin {
+			scope = ", proxied traffic only"
+		}
+		if tls {
+			e.log.Infof("🚀 Serving HTTPS and HTTP/2 on %s (%s%s)", o.listener.Addr(), o.addr.Scheme, scope)
+		} else {
+			e.log.Infof("🚀 Serving HTTP on %s (%s%s)", o.listener.Addr(), o.addr.Scheme, scope)
+		}
+
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			var err error
+			if tls {
+				err = server.ServeTLS(o.listener, e.config.Server.TLSCertFile, e.config.Server.TLSKeyFile)
+			} else {
+				err = server.Serve(o.listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				e.log.Errorf("Server error on %s: %v", o.listener.Addr(), err)
+			}
+		}()
+	}
+	return nil
+}
+
 // Stop stops the engine gracefully
 func (e *EngineV2) Stop() error {
+	signal.Stop(e.shutdown)
+	signal.Stop(e.reopen)
+
 	// Create shutdown context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), e.config.Server.ShutdownTimeout)
 	defer cancel()
 
-	// Shutdown HTTP server first
-	if err := e.server.Shutdown(ctx); err != nil {
+	// Shutdown the HTTP servers together first, which closes their
+	// listeners and removes their unix socket files
+	errs := make([]error, len(e.servers))
+	var servers sync.WaitGroup
+	for i, server := range e.servers {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			errs[i] = server.Shutdown(ctx)
+		}()
+	}
+	servers.Wait()
+	if err := errors.Join(errs...); err != nil {
 		e.log.Errorf("Server shutdown error: %v", err)
 		return err
 	}
 
-	// Stop WebSocket hub
+	// Stop background workers
+	e.log.Info("Waiting for background workers to finish...")
+	stopDeadline, _ := ctx.Deadline()
+	if err := e.workers.Stop(time.Until(stopDeadline)); err != nil {
+		e.log.Errorf("Background worker shutdown error: %v", err)
+	}
+
+	// Close WebSocket connections, which the server shutdown leaves open as
+	// they're hijacked, then stop the hub and any pending database connection
+	// attempts
+	e.wsHub.Shutdown(ctx)
 	e.wsCancel()
+	e.dbCancel()
 
 	// Cleanup router (stops accepting new requests)
 	e.router.Shutdown()
 
-	// Stop cache background workers
+	// Stop cache background workers and key refreshes
 	e.cache.Stop()
+	e.authService.Stop()
 
-	// Wait for all background goroutines to finish BEFORE closing database
-	e.log.Info("Waiting for background workers to finish...")
+	// Wait for the server, hub and connection goroutines BEFORE closing database
 	e.wg.Wait()
 
 	// Now safe to close database
@@ -219,6 +516,11 @@ func (e *EngineV2) Stop() error {
 			e.log.Errorf("Tracer shutdown error: %v", err)
 		}
 	}
+	if e.meter != nil {
+		if err := e.meter.Shutdown(ctx); err != nil {
+			e.log.Errorf("Meter shutdown error: %v", err)
+		}
+	}
 
 	e.log.Info("✅ Server stopped gracefully")
 	return nil
@@ -227,98 +529,172 @@ func (e *EngineV2) Stop() error {
 // startBackgroundWorkers starts background worker goroutines
 func (e *EngineV2) startBackgroundWorkers() {
 	// Stats collector worker
-	e.wg.Add(1)
-	go func() {
-		defer e.wg.Done()
-		e.statsCollector()
-	}()
+	e.workers.Go(e.statsCollector)
 
 	// Health check worker
-	e.wg.Add(1)
-	go func() {
-		defer e.wg.Done()
-		e.healthChecker()
-	}()
+	e.workers.Go(e.healthChecker)
 
 	// Circuit breaker monitor
-	e.wg.Add(1)
-	go func() {
-		defer e.wg.Done()
-		e.circuitBreakerMonitor()
-	}()
+	e.workers.Go(e.circuitBreakerMonitor)
+
+	// Hourly request log rollups
+	if e.config.Database.RollupInterval > 0 {
+		e.workers.Go(e.requestRollup)
+	}
+
+	// Database pool and cache metrics
+	collector := metrics.NewCollector(e.metrics, e.config.Gateway.MetricsCollectInterval)
+	collector.WatchPool(e.db.PoolStats)
+	collector.WatchCache(func() metrics.CacheStats {
+		stats := e.cache.Stats()
+		return metrics.CacheStats{
+			Size:      stats.Size,
+			Hits:      stats.Hits,
+			Misses:    stats.Misses,
+			Evictions: stats.Evictions,
+			Expired:   stats.Expired,
+			Patterns:  stats.Patterns,
+		}
+	})
+	e.workers.Go(collector.Run)
+
+	// Backend service discovery
+	if e.discovery != nil {
+		e.observeWorker("service_discovery", e.discovery.Schedule())
+		e.workers.Go(e.discovery.Run)
+	}
+
+	// Refreshers their components run report their schedules too
+	e.observeWorker("jwks_refresh", e.authService.JWKSSchedule())
+	if geo := e.router.GeoIP(); geo != nil {
+		e.observeWorker("geoip_reload", geo.Schedule())
+	}
 
 	e.log.Info("✅ Background workers started")
 }
 
-// statsCollector collects and logs statistics periodically
-func (e *EngineV2) statsCollector() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+// recordWorkerState exports a worker's current schedule state as metrics
+func (e *EngineV2) recordWorkerState(worker string, s *schedule.Schedule) {
+	state := s.State()
+	e.metrics.WorkerInterval.WithLabelValues(worker).Set(state.Interval.Seconds())
+	e.metrics.WorkerFailures.WithLabelValues(worker).Set(float64(state.Failures))
+}
 
+// observeWorker records the state of a schedule a component runs each time
+// it schedules a run, starting with a run already scheduled. A nil schedule
+// is ignored.
+func (e *EngineV2) observeWorker(worker string, s *schedule.Schedule) {
+	if s == nil {
+		return
+	}
+	s.Observe(func(schedule.State) { e.recordWorkerState(worker, s) })
+	if !s.State().NextRun.IsZero() {
+		e.recordWorkerState(worker, s)
+	}
+}
+
+// statsCollector collects and logs statistics periodically
+func (e *EngineV2) statsCollector(ctx context.Context) {
 	for {
+		next := e.statsSchedule.After()
+		e.recordWorkerState("stats_collector", e.statsSchedule)
+
 		select {
-		case <-ticker.C:
+		case <-next:
+			// Don't log stats once shutdown has begun
+			if ctx.Err() != nil {
+				return
+			}
+
 			stats := map[string]interface{}{
 				"cache_size":        e.cache.Size(),
 				"websocket_clients": e.wsHub.GetClientCount(),
 				"backends":          len(e.lb.GetAllBackends()),
 			}
 			e.log.Debugf("📊 Stats: %v", stats)
-		case <-e.shutdown:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// healthChecker performs periodic health checks
-func (e *EngineV2) healthChecker() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
+// healthChecker performs periodic health checks, backing off while they fail
+func (e *EngineV2) healthChecker(ctx context.Context) {
 	for {
+		next := e.healthSchedule.After()
+		e.recordWorkerState("health_checker", e.healthSchedule)
+
 		select {
-		case <-ticker.C:
+		case <-next:
 			// Skip health checks during shutdown
-			select {
-			case <-e.shutdown:
+			if ctx.Err() != nil {
 				return
-			default:
 			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 
 			// Check database health
-			if err := e.db.Health(ctx); err != nil {
-				e.log.Warnf("⚠️  Database health check failed: %v", err)
+			dbErr := e.db.Health(checkCtx)
+			if dbErr != nil {
+				e.log.Warnf("⚠️  Database health check failed: %v", dbErr)
 			}
 
 			// Check cache health
-			if err := e.cache.Health(ctx); err != nil {
-				e.log.Warnf("⚠️  Cache health check failed: %v", err)
+			cacheErr := e.cache.Health(checkCtx)
+			if cacheErr != nil {
+				e.log.Warnf("⚠️  Cache health check failed: %v", cacheErr)
 			}
 
 			cancel()
-		case <-e.shutdown:
+			e.healthSchedule.Report(errors.Join(dbErr, cacheErr))
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
 // circuitBreakerMonitor monitors circuit breaker states
-func (e *EngineV2) circuitBreakerMonitor() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-
+func (e *EngineV2) circuitBreakerMonitor(ctx context.Context) {
 	for {
+		next := e.cbSchedule.After()
+		e.recordWorkerState("circuit_breaker_monitor", e.cbSchedule)
+
 		select {
-		case <-ticker.C:
+		case <-next:
 			states := e.cb.GetAllStates()
-			for name, state := range states {
-				if state.String() == "open" {
-					e.log.Warnf("🔴 Circuit breaker '%s' is OPEN", name)
+			for _, state := range states {
+				if state.State.String() == "open" {
+					e.log.Warnf("🔴 Circuit breaker '%s' is OPEN", state.Key)
 				}
 			}
-		case <-e.shutdown:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// requestRollup aggregates request logs into hourly stats, backfilling past
+// hours on its first run. Only the replica holding the rollup lock does the
+// work; the others skip the run.
+func (e *EngineV2) requestRollup(ctx context.Context) {
+	next := time.After(0)
+	for {
+		select {
+		case <-next:
+			hours, locked, err := e.db.RollupRequestLogs(ctx)
+			switch {
+			case err != nil && ctx.Err() == nil:
+				e.log.Warnf("⚠️  Request log rollup failed: %v", err)
+			case !locked && err == nil:
+				e.log.Debug("Request log rollup running on another replica")
+			case hours > 0:
+				e.log.Debugf("Rolled up %d hours of request logs", hours)
+			}
+			e.rollupSchedule.Report(err)
+
+			next = e.rollupSchedule.After()
+			e.recordWorkerState("request_rollup", e.rollupSchedule)
+		case <-ctx.Done():
 			return
 		}
 	}
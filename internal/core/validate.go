@@ -0,0 +1,235 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/discovery"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/listener"
+	"github.com/zakirkun/isekai/internal/plugin"
+	"github.com/zakirkun/isekai/internal/tracing"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"github.com/zakirkun/isekai/pkg/version"
+)
+
+// settings are what the configuration resolves to once checked
+type settings struct {
+	listen     []listener.Address
+	errorPages *response.ErrorPages // nil when GATEWAY_ERROR_PAGES_DIR is unset
+}
+
+// checkConfig checks cfg without side effects, returning every problem found
+// rather than the first, along with the settings it resolves to
+func checkConfig(cfg *config.Config) (*settings, []error) {
+	var problems []error
+
+	// Refuse unreadable secret files and the placeholder JWT secret
+	if err := cfg.Validate(); err != nil {
+		for _, err := range unjoin(err) {
+			problems = append(problems, fmt.Errorf("invalid configuration: %w", err))
+		}
+	}
+
+	// Reject malformed IP access lists
+	if err := acl.Validate(cfg.Gateway.IPAllow, cfg.Gateway.IPDeny); err != nil {
+		problems = append(problems, fmt.Errorf("invalid gateway IP access list: %w", err))
+	}
+
+	// Reject an unknown sampler rather than tracing with a default one
+	if cfg.Tracing.Enabled {
+		if _, err := tracing.Sampler(cfg.Tracing.Sampler, cfg.Tracing.SampleRatio); err != nil {
+			problems = append(problems, fmt.Errorf("invalid TRACING_SAMPLER: %w", err))
+		}
+	}
+
+	// Serving TLS needs both halves of the certificate
+	if (cfg.Server.TLSCertFile == "") != (cfg.Server.TLSKeyFile == "") {
+		problems = append(problems, errors.New("SERVER_TLS_CERT_FILE and SERVER_TLS_KEY_FILE must be set together"))
+	}
+
+	// Listen on SERVER_PORT unless other addresses are configured
+	s := &settings{listen: []listener.Address{{Scheme: listener.SchemeTCP, Addr: ":" + cfg.Server.Port, Admin: true}}}
+	if len(cfg.Server.Listen) > 0 {
+		s.listen = s.listen[:0]
+		for _, addr := range cfg.Server.Listen {
+			parsed, err := listener.Parse(addr)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("invalid SERVER_LISTEN: %w", err))
+				continue
+			}
+			s.listen = append(s.listen, parsed)
+		}
+	}
+
+	// Sticky cookies must be signed so clients can't choose their backend
+	if cfg.LoadBalancer.StickyCookie != "" && cfg.LoadBalancer.StickyKey == "" {
+		problems = append(problems, errors.New("LB_STICKY_KEY is required when LB_STICKY_COOKIE is set"))
+	}
+
+	// Load branded HTML error pages for the proxy path
+	if cfg.Gateway.ErrorPagesDir != "" {
+		pages, err := response.LoadErrorPages(cfg.Gateway.ErrorPagesDir)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("failed to load error pages: %w", err))
+		}
+		s.errorPages = pages
+	}
+
+	return s, problems
+}
+
+// unjoin splits errors joined with errors.Join
+func unjoin(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// Summary describes a configuration checked by Validate
+type Summary struct {
+	Version   version.Info    `json:"version"`
+	Valid     bool            `json:"valid"`
+	Features  map[string]bool `json:"features"`
+	Listeners []string        `json:"listeners"`
+	Backends  int             `json:"backends"`           // Static LB_BACKENDS
+	Routes    *int            `json:"routes"`             // Routes stored in the database, null unless they were checked
+	Database  *DatabaseCheck  `json:"database,omitempty"` // Set when the database was checked
+	Problems  []string        `json:"problems"`
+}
+
+// DatabaseCheck is what Validate found in the database
+type DatabaseCheck struct {
+	Connected bool     `json:"connected"`
+	Pending   []string `json:"pending_schema"` // Tables and table.column pairs the gateway adds when it starts
+}
+
+// Validate checks cfg the way NewV2 does, without listening or starting
+// workers, and reports every problem found rather than the first. Logs go to
+// stderr so the summary can be printed alone on stdout. With checkDatabase it
+// also connects read-only to compare the schema with this version's and to
+// check every stored route the way the management API does when saving one.
+func Validate(ctx context.Context, cfg *config.Config, checkDatabase bool) *Summary {
+	log := logger.New(os.Stderr)
+	summary := &Summary{
+		Version:   version.Get(),
+		Features:  features(cfg),
+		Listeners: []string{},
+		Backends:  len(cfg.LoadBalancer.Backends),
+		Problems:  []string{},
+	}
+	problem := func(err error) {
+		summary.Problems = append(summary.Problems, err.Error())
+	}
+
+	s, problems := checkConfig(cfg)
+	for _, err := range problems {
+		problem(err)
+	}
+	for _, addr := range s.listen {
+		summary.Listeners = append(summary.Listeners, addr.String())
+	}
+
+	// Building the services NewV2 builds checks their keys and settings. Like
+	// NewV2, only a configuration without problems gets this far.
+	if len(problems) > 0 {
+		return summary
+	}
+	authService, err := auth.NewAuthServiceFromConfig(&cfg.Auth, log)
+	if err != nil {
+		problem(fmt.Errorf("failed to initialize auth: %w", err))
+	} else {
+		defer authService.Stop()
+	}
+	if cfg.LoadBalancer.Discovery.Type != "" {
+		if _, err := discovery.NewProvider(&cfg.LoadBalancer.Discovery, log); err != nil {
+			problem(fmt.Errorf("failed to initialize service discovery: %w", err))
+		}
+	}
+
+	if checkDatabase {
+		summary.Database = &DatabaseCheck{Pending: []string{}}
+		// A cache without its cleanup worker is enough to build the cache plugin
+		cacheCfg := cfg.Cache
+		cacheCfg.Enabled = false
+		plugins := plugin.NewRegistry()
+		plugin.RegisterBuiltins(plugins, &plugin.Deps{
+			Auth:  authService,
+			Cache: cache.New(&cacheCfg, log, nil),
+			Log:   log,
+		})
+		validateDatabase(ctx, &cfg.Database, log, plugins, summary, problem)
+	}
+
+	summary.Valid = len(summary.Problems) == 0
+	return summary
+}
+
+// validateDatabase connects read-only, compares the schema and checks the
+// stored routes. Routes are only read once the schema is current, as the
+// queries reading them need every column.
+func validateDatabase(ctx context.Context, cfg *config.DatabaseConfig, log *logger.Logger, plugins *plugin.Registry, summary *Summary, problem func(error)) {
+	db, err := database.NewReadOnly(cfg, log, nil)
+	if err != nil {
+		problem(fmt.Errorf("failed to connect to the database: %w", err))
+		return
+	}
+	defer db.Close()
+	summary.Database.Connected = true
+
+	pending, err := db.CheckSchema(ctx)
+	if err != nil {
+		problem(err)
+		return
+	}
+	if len(pending) > 0 {
+		summary.Database.Pending = pending
+		return
+	}
+
+	routes, err := database.NewRouteRepository(db).FindAll(ctx)
+	if err != nil {
+		problem(fmt.Errorf("failed to load routes: %w", err))
+		return
+	}
+	count := len(routes)
+	summary.Routes = &count
+	for _, route := range routes {
+		if err := handlers.ValidateRoute(&route, plugins); err != nil {
+			problem(fmt.Errorf("route %d (%s %s): %w", route.ID, route.Method, route.Path, err))
+		}
+	}
+}
+
+// features reports which optional features cfg enables
+func features(cfg *config.Config) map[string]bool {
+	return map[string]bool{
+		"auth":              cfg.Auth.Enabled,
+		"rate_limit":        cfg.Gateway.RateLimitEnabled,
+		"cache":             cfg.Cache.Enabled,
+		"tls":               cfg.Server.TLSCertFile != "",
+		"database_required": cfg.Database.Required,
+		"tracing":           cfg.Tracing.Enabled,
+		"otlp_metrics":      cfg.Tracing.MetricsEnabled,
+		"dns_cache":         cfg.Proxy.DNSCache,
+		"service_discovery": cfg.LoadBalancer.Discovery.Type != "",
+		"sticky_sessions":   cfg.LoadBalancer.StickyCookie != "",
+		"outlier_detection": cfg.LoadBalancer.OutlierConsecutiveFailures > 0 || cfg.LoadBalancer.OutlierFailurePercent > 0,
+		"access_log":        cfg.AccessLog.Path != "",
+		"admin_ui":          cfg.AdminUI.Enabled,
+		"chaos":             cfg.Chaos.Enabled,
+		"geoip":             cfg.GeoIP.DatabasePath != "",
+		"warmup":            cfg.Warmup.Enabled,
+		"security_headers":  cfg.SecurityHeaders.Enabled,
+		"compression":       cfg.Compression.Enabled,
+	}
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/egress"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/upstreamtls"
+	"github.com/zakirkun/isekai/internal/warmup"
+)
+
+// warmupTarget is an upstream origin reached with a route's connection
+// settings
+type warmupTarget struct {
+	origin string
+	tls    *upstreamtls.Profile
+	egress *egress.Profile
+	h2c    bool
+}
+
+// warmup loads the routes into the proxy's route table, opens idle
+// connections to their upstreams and creates their circuit breakers closed,
+// so the first requests after startup pay for none of it
+func (e *EngineV2) warmup(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.config.Warmup.Timeout)
+	defer cancel()
+
+	var routes []database.Route
+	e.router.Warmup().Run(ctx, e.log, e.metrics, []warmup.Step{
+		{Name: "routes", Run: func(ctx context.Context) (int, error) {
+			var err error
+			routes, err = e.router.LoadRoutes(ctx)
+			return 0, err
+		}},
+		{Name: "connections", Run: func(ctx context.Context) (int, error) {
+			return e.warmConnections(ctx, routes)
+		}},
+		{Name: "breakers", Run: func(ctx context.Context) (int, error) {
+			for _, route := range routes {
+				for _, target := range e.routeTargets(&route) {
+					e.cb.GetBreaker(circuitbreaker.RouteKey(route.ID, route.Path, target, route.Breaker), route.Breaker)
+				}
+			}
+			return 0, nil
+		}},
+	})
+}
+
+// warmConnections opens WARMUP_CONNECTIONS idle connections to each upstream
+// of routes at once, returning how many upstreams couldn't be reached
+func (e *EngineV2) warmConnections(ctx context.Context, routes []database.Route) (int, error) {
+	n := e.config.Warmup.Connections
+	if n == 0 {
+		return 0, nil
+	}
+
+	seen := make(map[string]bool)
+	var targets []warmupTarget
+	for _, route := range routes {
+		profileKey := ""
+		if route.TLS != nil {
+			profileKey = route.TLS.Key()
+		}
+		if route.Egress != nil {
+			profileKey += "|" + route.Egress.Key()
+		}
+		for _, target := range e.routeTargets(&route) {
+			origin := circuitbreaker.Origin(target)
+			key := fmt.Sprintf("%s|%t|%s", origin, route.H2C, profileKey)
+			if !seen[key] {
+				seen[key] = true
+				targets = append(targets, warmupTarget{origin: origin, tls: route.TLS, egress: route.Egress, h2c: route.H2C})
+			}
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := ctx
+			if target.egress != nil {
+				ctx = proxy.WithEgress(ctx, target.egress)
+			}
+			opened, err := e.proxy.Prewarm(ctx, target.origin, n, target.tls, target.h2c)
+			if err == nil {
+				return
+			}
+			e.log.Warnf("Warm-up opened %d of %d connections to %s: %v", opened, n, target.origin, err)
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) == len(targets) && len(targets) > 0 {
+		return len(errs), errors.New("no upstream could be reached")
+	}
+	return len(errs), nil
+}
+
+// routeTargets returns the upstreams an enabled proxied route forwards to:
+// its target, canary, blue and green targets and, when it is load balanced,
+// the backend pool
+func (e *EngineV2) routeTargets(route *database.Route) []string {
+	if !route.Enabled || (route.Type != database.RouteTypeProxy && route.Type != database.RouteTypeRewrite) || route.MaintenanceEnabled {
+		return nil
+	}
+	targets := []string{route.TargetURL}
+	if route.CanaryURL != "" {
+		targets = append(targets, route.CanaryURL)
+	}
+	if route.BlueGreen != nil {
+		targets = append(targets, route.BlueGreen.Blue, route.BlueGreen.Green)
+	}
+	if route.LoadBalanced {
+		targets = append(targets, e.lb.Backends()...)
+	}
+	return targets
+}
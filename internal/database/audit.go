@@ -0,0 +1,192 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Audit actions recorded for route changes
+const (
+	AuditActionCreate  = "create"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionEnable  = "enable"
+	AuditActionDisable = "disable"
+	AuditActionImport  = "import"
+	AuditActionSwitch  = "switch"  // Blue/green traffic switch
+	AuditActionRestore = "restore" // Written back from a configuration snapshot
+)
+
+// AuditEntry represents a recorded route configuration change
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	RouteID   int             `json:"route_id"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	ClientIP  string          `json:"client_ip,omitempty"`
+	Changes   json.RawMessage `json:"changes" swaggertype:"object"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AuditRepository handles route audit database operations
+type AuditRepository struct {
+	db *Database
+	tx pgx.Tx
+}
+
+// NewAuditRepository creates a new audit repository
+func NewAuditRepository(db *Database) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs its queries inside tx
+func (r *AuditRepository) WithTx(tx pgx.Tx) *AuditRepository {
+	return &AuditRepository{db: r.db, tx: tx}
+}
+
+// conn returns the transaction if one is bound, otherwise the pool
+func (r *AuditRepository) conn() Querier {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db.conn()
+}
+
+// Create records a new audit entry
+func (r *AuditRepository) Create(ctx context.Context, entry *AuditEntry) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.AuditRepository.Create",
+		trace.WithAttributes(
+			attribute.Int("route.id", entry.RouteID),
+			attribute.String("audit.action", entry.Action),
+		),
+	)
+	defer span.End()
+
+	changes := entry.Changes
+	if len(changes) == 0 {
+		changes = json.RawMessage("{}")
+	}
+
+	query := `
+		INSERT INTO route_audit (route_id, action, actor, client_ip, changes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+
+	err := r.conn().QueryRow(
+		ctx,
+		query,
+		entry.RouteID,
+		entry.Action,
+		entry.Actor,
+		entry.ClientIP,
+		changes,
+	).Scan(&entry.ID, &entry.CreatedAt)
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to create audit entry")
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("audit.id", entry.ID))
+	span.SetStatus(codes.Ok, "audit entry created")
+	return nil
+}
+
+// FindByRouteID retrieves audit entries for a route, newest first
+func (r *AuditRepository) FindByRouteID(ctx context.Context, routeID, limit, offset int) ([]AuditEntry, int, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.AuditRepository.FindByRouteID",
+		trace.WithAttributes(
+			attribute.Int("route.id", routeID),
+			attribute.Int("query.limit", limit),
+			attribute.Int("query.offset", offset),
+		),
+	)
+	defer span.End()
+
+	entries, total, err := r.find(ctx, "WHERE route_id = $1", []interface{}{routeID}, limit, offset)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to query audit entries")
+		return nil, 0, err
+	}
+
+	span.SetAttributes(attribute.Int("audit.count", len(entries)))
+	span.SetStatus(codes.Ok, "audit entries retrieved")
+	return entries, total, nil
+}
+
+// FindAll retrieves audit entries across all routes, newest first
+func (r *AuditRepository) FindAll(ctx context.Context, limit, offset int) ([]AuditEntry, int, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.AuditRepository.FindAll",
+		trace.WithAttributes(
+			attribute.Int("query.limit", limit),
+			attribute.Int("query.offset", offset),
+		),
+	)
+	defer span.End()
+
+	entries, total, err := r.find(ctx, "", nil, limit, offset)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to query audit entries")
+		return nil, 0, err
+	}
+
+	span.SetAttributes(attribute.Int("audit.count", len(entries)))
+	span.SetStatus(codes.Ok, "audit entries retrieved")
+	return entries, total, nil
+}
+
+// find runs a paginated audit query with an optional WHERE clause
+func (r *AuditRepository) find(ctx context.Context, where string, args []interface{}, limit, offset int) ([]AuditEntry, int, error) {
+	var total int
+	if err := r.conn().QueryRow(ctx, `SELECT COUNT(*) FROM route_audit `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, route_id, action, actor, COALESCE(client_ip, ''), changes, created_at
+		FROM route_audit
+		%s
+		ORDER BY created_at DESC, id DESC
+		LIMIT $%d OFFSET $%d
+	`, where, len(args)+1, len(args)+2)
+
+	rows, err := r.conn().Query(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(
+			&entry.ID,
+			&entry.RouteID,
+			&entry.Action,
+			&entry.Actor,
+			&entry.ClientIP,
+			&entry.Changes,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, total, rows.Err()
+}
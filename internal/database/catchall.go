@@ -0,0 +1,31 @@
+package database
+
+import (
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/urlpath"
+)
+
+// MatchCatchAll picks the catch-all route serving a request whose path has
+// no route for its host. catchAlls holds the enabled catch-all routes by
+// path, then host, then method. The prefixes the path is under are tried
+// from the longest, so a nested catch-all wins over the one around it: the
+// first with catch-all routes for the host, matched by MatchHost, answers
+// with its route for method or a *MethodNotAllowedError, and is returned
+// with them. pgx.ErrNoRows is returned when no prefix has one.
+func MatchCatchAll(catchAlls map[string]map[string]map[string]*Route, host, path, method string) (*Route, string, error) {
+	if len(catchAlls) == 0 {
+		return nil, "", pgx.ErrNoRows
+	}
+	for _, prefix := range urlpath.Parents(path) {
+		methods, ok := MatchHost(catchAlls[prefix], host)
+		if !ok {
+			continue
+		}
+		route, ok := MatchMethod(methods, method)
+		if !ok {
+			return nil, prefix, &MethodNotAllowedError{Allowed: AllowedMethods(methods)}
+		}
+		return route, prefix, nil
+	}
+	return nil, "", pgx.ErrNoRows
+}
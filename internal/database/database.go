@@ -2,23 +2,153 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"sync/atomic"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/schedule"
 	"github.com/zakirkun/isekai/pkg/config"
 	"github.com/zakirkun/isekai/pkg/logger"
 )
 
+// ErrUnavailable is returned by queries while the gateway has no database connection
+var ErrUnavailable = errors.New("database unavailable")
+
+// maxConnectBackoff caps the delay between connection attempts
+const maxConnectBackoff = 30 * time.Second
+
 // Database represents the database connection
 type Database struct {
-	Pool *pgxpool.Pool
-	log  *logger.Logger
+	pool     atomic.Pointer[pgxpool.Pool]
+	cfg      *config.DatabaseConfig
+	log      *logger.Logger
+	metrics  *metrics.Metrics
+	readOnly bool
+}
+
+// New creates a new database connection, retrying with backoff while the
+// database is unreachable
+func New(cfg *config.DatabaseConfig, log *logger.Logger, m *metrics.Metrics) (*Database, error) {
+	db := NewDisconnected(cfg, log, m)
+	backoff := db.backoff()
+
+	for attempt := 1; ; attempt++ {
+		pool, err := db.connect(context.Background())
+		if err == nil {
+			db.pool.Store(pool)
+			log.Info("Database connection established successfully")
+			return db, nil
+		}
+		if attempt > cfg.ConnectRetries {
+			return nil, err
+		}
+
+		delay := backoff.Next()
+		backoff.Failure()
+		log.Warnf("Database connection failed, retrying in %s (%d/%d): %v", delay, attempt, cfg.ConnectRetries, err)
+		time.Sleep(delay)
+	}
 }
 
-// New creates a new database connection
-func New(cfg *config.DatabaseConfig, log *logger.Logger) (*Database, error) {
-	connString := cfg.GetDSN()
+// NewReadOnly connects once, without retrying, in sessions that can't write.
+// It is for inspecting a database without changing it, such as checking the
+// schema before a deploy; InitSchema fails on it.
+func NewReadOnly(cfg *config.DatabaseConfig, log *logger.Logger, m *metrics.Metrics) (*Database, error) {
+	db := NewDisconnected(cfg, log, m)
+	db.readOnly = true
+	pool, err := db.connect(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	db.pool.Store(pool)
+	return db, nil
+}
+
+// NewDisconnected creates a database without connecting. Queries fail with
+// ErrUnavailable until ConnectInBackground succeeds.
+func NewDisconnected(cfg *config.DatabaseConfig, log *logger.Logger, m *metrics.Metrics) *Database {
+	return &Database{
+		cfg:     cfg,
+		log:     log,
+		metrics: m,
+	}
+}
+
+// ConnectInBackground keeps attempting to connect until it succeeds or ctx is
+// done. The schema is initialized before the connection is used.
+func (db *Database) ConnectInBackground(ctx context.Context) {
+	backoff := db.backoff()
+
+	for !db.Connected() {
+		pool, err := db.connect(ctx)
+		if err == nil {
+			if err = initSchema(ctx, pool); err == nil {
+				db.pool.Store(pool)
+				db.log.Info("Database connection established successfully")
+				return
+			}
+			pool.Close()
+		}
+
+		delay := backoff.Next()
+		backoff.Failure()
+		db.log.Warnf("Database unavailable, retrying in %s: %v", delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Connected reports whether the database connection has been established
+func (db *Database) Connected() bool {
+	return db.pool.Load() != nil
+}
+
+// PoolStats returns the connection pool statistics, or false while the
+// database is not connected
+func (db *Database) PoolStats() (metrics.PoolStats, bool) {
+	pool := db.pool.Load()
+	if pool == nil {
+		return metrics.PoolStats{}, false
+	}
+
+	stat := pool.Stat()
+	return metrics.PoolStats{
+		AcquiredConns:        stat.AcquiredConns(),
+		IdleConns:            stat.IdleConns(),
+		TotalConns:           stat.TotalConns(),
+		MaxConns:             stat.MaxConns(),
+		ConstructingConns:    stat.ConstructingConns(),
+		NewConns:             stat.NewConnsCount(),
+		AcquireCount:         stat.AcquireCount(),
+		EmptyAcquireCount:    stat.EmptyAcquireCount(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+		AcquireDuration:      stat.AcquireDuration(),
+	}, true
+}
+
+// backoff returns the retry schedule for connection attempts
+func (db *Database) backoff() *schedule.Schedule {
+	return schedule.New(schedule.Policy{
+		Interval:    db.cfg.ConnectBackoff,
+		Jitter:      0.1,
+		Multiplier:  2,
+		MaxInterval: maxConnectBackoff,
+	}, nil)
+}
+
+// connect creates a connection pool and checks that the database answers
+func (db *Database) connect(ctx context.Context) (*pgxpool.Pool, error) {
+	connString := db.cfg.GetDSN()
 
 	poolConfig, err := pgxpool.ParseConfig(connString)
 	if err != nil {
@@ -26,12 +156,15 @@ func New(cfg *config.DatabaseConfig, log *logger.Logger) (*Database, error) {
 	}
 
 	// Set connection pool settings
-	poolConfig.MaxConns = int32(cfg.MaxOpenConns)
-	poolConfig.MinConns = int32(cfg.MaxIdleConns)
-	poolConfig.MaxConnLifetime = cfg.ConnMaxLifetime
+	poolConfig.MaxConns = int32(db.cfg.MaxOpenConns)
+	poolConfig.MinConns = int32(db.cfg.MaxIdleConns)
+	poolConfig.MaxConnLifetime = db.cfg.ConnMaxLifetime
 	poolConfig.MaxConnIdleTime = 30 * time.Minute
+	if db.readOnly {
+		poolConfig.ConnConfig.RuntimeParams["default_transaction_read_only"] = "on"
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
@@ -45,68 +178,313 @@ func New(cfg *config.DatabaseConfig, log *logger.Logger) (*Database, error) {
 		return nil, fmt.Errorf("unable to ping database: %w", err)
 	}
 
-	log.Info("Database connection established successfully")
-
-	return &Database{
-		Pool: pool,
-		log:  log,
-	}, nil
+	return pool, nil
 }
 
 // Close closes the database connection
 func (db *Database) Close() {
-	if db.Pool != nil {
-		db.Pool.Close()
+	if pool := db.pool.Swap(nil); pool != nil {
+		pool.Close()
 		db.log.Info("Database connection closed")
 	}
 }
 
 // Health checks the database health
 func (db *Database) Health(ctx context.Context) error {
+	pool := db.pool.Load()
+	if pool == nil {
+		return ErrUnavailable
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	return db.Pool.Ping(ctx)
+	return pool.Ping(ctx)
+}
+
+// IsUnavailable reports whether err means the database could not be reached
+// or didn't answer within DB_QUERY_TIMEOUT, as opposed to a failed query
+func IsUnavailable(err error) bool {
+	var netErr *net.OpError
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrQueryTimeout) || errors.As(err, &netErr)
+}
+
+// Querier is implemented by both the connection pool and transactions
+type Querier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// conn returns the connection pool, bounding each query by DB_QUERY_TIMEOUT,
+// or a querier failing with ErrUnavailable while disconnected
+func (db *Database) conn() Querier {
+	if pool := db.pool.Load(); pool != nil {
+		return db.timed(pool)
+	}
+	return unavailable{}
+}
+
+// streaming returns the connection pool without DB_QUERY_TIMEOUT, for
+// queries whose rows are read for as long as their caller keeps up, such as
+// exports. Their errors are classified and counted like other queries'.
+func (db *Database) streaming() Querier {
+	if pool := db.pool.Load(); pool != nil {
+		return timedQuerier{q: pool, db: db, deadline: func(ctx context.Context) (context.Context, context.CancelFunc) {
+			return context.WithCancel(ctx)
+		}}
+	}
+	return unavailable{}
+}
+
+// unavailable is the Querier used while there is no database connection
+type unavailable struct{}
+
+func (unavailable) Exec(context.Context, string, ...any) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, ErrUnavailable
+}
+
+func (unavailable) Query(context.Context, string, ...any) (pgx.Rows, error) {
+	return nil, ErrUnavailable
+}
+
+func (unavailable) QueryRow(context.Context, string, ...any) pgx.Row {
+	return unavailableRow{}
+}
+
+// unavailableRow is a row whose Scan always fails with ErrUnavailable
+type unavailableRow struct{}
+
+func (unavailableRow) Scan(...any) error {
+	return ErrUnavailable
+}
+
+// WithTx runs fn inside a transaction, committing on success and rolling back
+// on error. The whole transaction is bounded by DB_QUERY_TIMEOUT.
+func (db *Database) WithTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	pool := db.pool.Load()
+	if pool == nil {
+		return ErrUnavailable
+	}
+
+	txCtx, cancel := context.WithTimeout(ctx, db.queryTimeout())
+	defer cancel()
+	deadline, _ := txCtx.Deadline()
+
+	tx, err := pool.Begin(txCtx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", db.queryError(ctx, txCtx, err))
+	}
+
+	timed := timedTx{Tx: tx, timedQuerier: timedQuerier{q: tx, db: db, deadline: func(ctx context.Context) (context.Context, context.CancelFunc) {
+		return context.WithDeadline(ctx, deadline)
+	}}}
+	if err := fn(timed); err != nil {
+		// Roll back even when the request is gone or out of time
+		rbCtx, rbCancel := context.WithTimeout(context.WithoutCancel(ctx), db.queryTimeout())
+		defer rbCancel()
+		if rbErr := tx.Rollback(rbCtx); rbErr != nil {
+			db.log.Errorf("Failed to roll back transaction: %v", rbErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(txCtx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", db.queryError(ctx, txCtx, err))
+	}
+
+	return nil
 }
 
 // InitSchema initializes the database schema
 func (db *Database) InitSchema(ctx context.Context) error {
-	query := `
-		CREATE TABLE IF NOT EXISTS routes (
-			id SERIAL PRIMARY KEY,
-			path VARCHAR(255) NOT NULL UNIQUE,
-			target_url VARCHAR(500) NOT NULL,
-			method VARCHAR(10) NOT NULL DEFAULT 'GET',
-			enabled BOOLEAN NOT NULL DEFAULT true,
-			rate_limit INTEGER DEFAULT 0,
-			timeout INTEGER DEFAULT 30,
-			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
-			updated_at TIMESTAMP NOT NULL DEFAULT NOW()
-		);
-
-		CREATE TABLE IF NOT EXISTS request_logs (
-			id SERIAL PRIMARY KEY,
-			route_id INTEGER REFERENCES routes(id) ON DELETE SET NULL,
-			method VARCHAR(10) NOT NULL,
-			path VARCHAR(255) NOT NULL,
-			status_code INTEGER NOT NULL,
-			response_time INTEGER NOT NULL,
-			client_ip VARCHAR(45),
-			user_agent TEXT,
-			created_at TIMESTAMP NOT NULL DEFAULT NOW()
-		);
-
-		CREATE INDEX IF NOT EXISTS idx_routes_path ON routes(path);
-		CREATE INDEX IF NOT EXISTS idx_routes_enabled ON routes(enabled);
-		CREATE INDEX IF NOT EXISTS idx_request_logs_created_at ON request_logs(created_at);
-		CREATE INDEX IF NOT EXISTS idx_request_logs_route_id ON request_logs(route_id);
-	`
-
-	_, err := db.Pool.Exec(ctx, query)
-	if err != nil {
-		return fmt.Errorf("failed to initialize schema: %w", err)
+	if err := initSchema(ctx, db.conn()); err != nil {
+		return err
 	}
 
 	db.log.Info("Database schema initialized successfully")
 	return nil
 }
+
+// schema creates the gateway tables and indexes, and adds the columns of
+// later versions to existing tables
+const schema = `
+	CREATE TABLE IF NOT EXISTS tenants (
+		id VARCHAR(63) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL DEFAULT '',
+		rate_limit INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS routes (
+		id SERIAL PRIMARY KEY,
+		path VARCHAR(255) NOT NULL,
+		target_url VARCHAR(500) NOT NULL,
+		method VARCHAR(10) NOT NULL DEFAULT 'GET',
+		enabled BOOLEAN NOT NULL DEFAULT true,
+		rate_limit INTEGER DEFAULT 0,
+		timeout INTEGER DEFAULT 30,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS ip_allow TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS ip_deny TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS mirror_url TEXT NOT NULL DEFAULT '';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS mirror_percent INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS canary_target_url TEXT NOT NULL DEFAULT '';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS canary_weight INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS load_balanced BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS transform JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS tls JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS h2c BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS maintenance_enabled BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS maintenance_status INTEGER NOT NULL DEFAULT 503;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS maintenance_body TEXT NOT NULL DEFAULT '';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS maintenance_content_type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS maintenance_retry_after INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS idempotent BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS hedge_delay INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS plugins JSONB NOT NULL DEFAULT '[]';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS sensitive_headers TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS blue_green JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS max_concurrency INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS route_type VARCHAR(10) NOT NULL DEFAULT 'proxy';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS mock JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS breaker_statuses INTEGER[] NOT NULL DEFAULT '{}';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS upstream_auth JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS upstream_rate_limit DOUBLE PRECISION NOT NULL DEFAULT 0;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS upstream_burst INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(63) REFERENCES tenants(id);
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS host VARCHAR(255) NOT NULL DEFAULT '';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS preserve_host BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS redirect JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS rewrite JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS country_allow TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS country_deny TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS dedup JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS preserve_path BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS passthrough_options BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS slo JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS breaker JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS egress JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS skip_security_headers BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS trust_deadline_max_ms INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS metrics_tag TEXT NOT NULL DEFAULT '';
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS active_from TIMESTAMP WITH TIME ZONE;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS active_until TIMESTAMP WITH TIME ZONE;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS schedule JSONB;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS critical BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS catch_all BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE routes ADD COLUMN IF NOT EXISTS owner VARCHAR(255) NOT NULL DEFAULT '';
+
+	CREATE TABLE IF NOT EXISTS request_logs (
+		id SERIAL PRIMARY KEY,
+		route_id INTEGER REFERENCES routes(id) ON DELETE SET NULL,
+		method VARCHAR(10) NOT NULL,
+		path VARCHAR(255) NOT NULL,
+		status_code INTEGER NOT NULL,
+		response_time INTEGER NOT NULL,
+		client_ip VARCHAR(45),
+		user_agent TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS headers JSONB;
+	ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS fault VARCHAR(20) NOT NULL DEFAULT '';
+	ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS request_size BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS response_size BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(63) NOT NULL DEFAULT '';
+	ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS country VARCHAR(2) NOT NULL DEFAULT '';
+
+	CREATE TABLE IF NOT EXISTS request_stats (
+		route_id INTEGER NOT NULL REFERENCES routes(id) ON DELETE CASCADE,
+		hour TIMESTAMP NOT NULL,
+		requests BIGINT NOT NULL,
+		errors BIGINT NOT NULL,
+		response_time_total BIGINT NOT NULL,
+		p50 DOUBLE PRECISION NOT NULL,
+		p95 DOUBLE PRECISION NOT NULL,
+		p99 DOUBLE PRECISION NOT NULL,
+		request_bytes BIGINT NOT NULL,
+		response_bytes BIGINT NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (route_id, hour)
+	);
+
+	CREATE TABLE IF NOT EXISTS request_stats_state (
+		name VARCHAR(50) PRIMARY KEY,
+		rolled_until TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS route_audit (
+		id SERIAL PRIMARY KEY,
+		route_id INTEGER NOT NULL,
+		action VARCHAR(20) NOT NULL,
+		actor VARCHAR(255) NOT NULL,
+		client_ip VARCHAR(45),
+		changes JSONB NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS snapshots (
+		id SERIAL PRIMARY KEY,
+		actor VARCHAR(255) NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		automatic BOOLEAN NOT NULL DEFAULT false,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(255) NOT NULL UNIQUE,
+		password_hash VARCHAR(255) NOT NULL,
+		roles TEXT[] NOT NULL DEFAULT '{}',
+		enabled BOOLEAN NOT NULL DEFAULT true,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(63) REFERENCES tenants(id);
+
+	CREATE TABLE IF NOT EXISTS rate_limit_tiers (
+		name VARCHAR(100) PRIMARY KEY,
+		requests_per_second INTEGER NOT NULL,
+		subjects TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_routes_path ON routes(path);
+
+	ALTER TABLE routes DROP CONSTRAINT IF EXISTS routes_path_key;
+	DROP INDEX IF EXISTS idx_routes_path_method;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_routes_host_path_method ON routes(host, path, method);
+	UPDATE routes SET path = cleaned.path
+	FROM (
+		SELECT DISTINCT ON (host, method, clean) id, clean AS path
+		FROM (SELECT id, host, method, path, regexp_replace(regexp_replace(path, '/{2,}', '/', 'g'), '(.)/$', '\1') AS clean FROM routes) AS paths
+		WHERE path <> clean
+		ORDER BY host, method, clean, id
+	) AS cleaned
+	WHERE routes.id = cleaned.id
+		AND NOT EXISTS (SELECT 1 FROM routes other WHERE other.host = routes.host AND other.method = routes.method AND other.path = cleaned.path);
+	CREATE INDEX IF NOT EXISTS idx_routes_enabled ON routes(enabled);
+	CREATE INDEX IF NOT EXISTS idx_request_logs_created_at ON request_logs(created_at);
+	CREATE INDEX IF NOT EXISTS idx_request_logs_route_id ON request_logs(route_id);
+	CREATE INDEX IF NOT EXISTS idx_request_logs_tenant_id ON request_logs(tenant_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_routes_tenant_id ON routes(tenant_id);
+	CREATE INDEX IF NOT EXISTS idx_routes_tags ON routes USING GIN (tags);
+	CREATE INDEX IF NOT EXISTS idx_route_audit_route_id ON route_audit(route_id);
+	CREATE INDEX IF NOT EXISTS idx_route_audit_created_at ON route_audit(created_at);
+`
+
+// initSchema creates the gateway tables and indexes if they don't exist
+func initSchema(ctx context.Context, q Querier) error {
+	if _, err := q.Exec(ctx, schema); err != nil {
+		return fmt.Errorf("failed to initialize schema: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"net"
+	"strings"
+)
+
+// NormalizeHost returns the request host without its port, lowercased and
+// without a trailing dot, for matching against route hosts
+func NormalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// ValidHostPattern reports whether pattern is a route host: a hostname, or a
+// hostname under a leading "*." wildcard matching any of its subdomains.
+// Case is ignored; routes store hosts lowercased.
+func ValidHostPattern(pattern string) bool {
+	name := strings.TrimPrefix(strings.ToLower(pattern), "*.")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// MatchHost picks the routes serving host among a path's routes, keyed by
+// their host: the exact host, then the longest wildcard covering it, then
+// the routes with no host
+func MatchHost(hosts map[string]map[string]*Route, host string) (map[string]*Route, bool) {
+	pattern, ok := MatchHostPattern(hosts, host)
+	return hosts[pattern], ok
+}
+
+// MatchHostPattern returns the key of the routes MatchHost picks
+func MatchHostPattern[T any](hosts map[string]T, host string) (string, bool) {
+	host = NormalizeHost(host)
+	if _, ok := hosts[host]; ok && host != "" {
+		return host, true
+	}
+
+	// Each step drops the leftmost label, so the first wildcard found is the longest
+	for rest := host; ; {
+		dot := strings.IndexByte(rest, '.')
+		if dot < 0 {
+			break
+		}
+		rest = rest[dot+1:]
+		if _, ok := hosts["*."+rest]; ok {
+			return "*." + rest, true
+		}
+	}
+
+	_, ok := hosts[""]
+	return "", ok
+}
+
+// HostCovers reports whether a route host pattern serves host: the same
+// host, a wildcard over it or no host at all
+func HostCovers(pattern, host string) bool {
+	_, ok := MatchHostPattern(map[string]struct{}{pattern: {}}, host)
+	return ok
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// MethodAny is the route method serving requests of any method
+const MethodAny = "*"
+
+// MethodNotAllowedError reports a path with routes, none of which serves the
+// request's method
+type MethodNotAllowedError struct {
+	Allowed []string // Methods the path's routes serve
+}
+
+func (e *MethodNotAllowedError) Error() string {
+	return "method not allowed, allowed: " + strings.Join(e.Allowed, ", ")
+}
+
+// MatchMethod picks the route serving method among a path's routes, keyed by
+// their method: the route for the method itself, then for HEAD the GET
+// route, then a route for any method
+func MatchMethod(methods map[string]*Route, method string) (*Route, bool) {
+	if route, ok := methods[method]; ok {
+		return route, true
+	}
+	if method == http.MethodHead {
+		if route, ok := methods[http.MethodGet]; ok {
+			return route, true
+		}
+	}
+	route, ok := methods[MethodAny]
+	return route, ok
+}
+
+// AllowedMethods lists the methods a path's routes serve, sorted for an
+// Allow header. A GET route also serves HEAD.
+func AllowedMethods(methods map[string]*Route) []string {
+	allowed := make([]string, 0, len(methods)+1)
+	for method := range methods {
+		allowed = append(allowed, method)
+	}
+	if _, ok := methods[http.MethodGet]; ok {
+		if _, ok := methods[http.MethodHead]; !ok {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	slices.Sort(allowed)
+	return allowed
+}
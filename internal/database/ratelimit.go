@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RateLimitTier is a named rate limit and the API keys, users or client IPs assigned to it
+type RateLimitTier struct {
+	Name              string    `json:"name"`
+	RequestsPerSecond int       `json:"requests_per_second"`
+	Subjects          []string  `json:"subjects"` // Prefixed callers, e.g. "key:partner-1", "user:42" or "ip:192.0.2.1"
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// RateLimitTierRepository handles rate limit tier database operations
+type RateLimitTierRepository struct {
+	db *Database
+}
+
+// NewRateLimitTierRepository creates a new rate limit tier repository
+func NewRateLimitTierRepository(db *Database) *RateLimitTierRepository {
+	return &RateLimitTierRepository{db: db}
+}
+
+// FindAll retrieves all rate limit tiers
+func (r *RateLimitTierRepository) FindAll(ctx context.Context) ([]RateLimitTier, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RateLimitTierRepository.FindAll")
+	defer span.End()
+
+	rows, err := r.db.conn().Query(ctx, `
+		SELECT name, requests_per_second, subjects, created_at, updated_at
+		FROM rate_limit_tiers ORDER BY name
+	`)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "query failed")
+		return nil, err
+	}
+	defer rows.Close()
+
+	tiers := make([]RateLimitTier, 0)
+	for rows.Next() {
+		var tier RateLimitTier
+		if err := rows.Scan(&tier.Name, &tier.RequestsPerSecond, &tier.Subjects, &tier.CreatedAt, &tier.UpdatedAt); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "scan failed")
+			return nil, err
+		}
+		tiers = append(tiers, tier)
+	}
+
+	span.SetAttributes(attribute.Int("tiers.count", len(tiers)))
+	span.SetStatus(codes.Ok, "tiers retrieved")
+	return tiers, rows.Err()
+}
+
+// Upsert creates the tier or replaces the one with the same name
+func (r *RateLimitTierRepository) Upsert(ctx context.Context, tier *RateLimitTier) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RateLimitTierRepository.Upsert",
+		trace.WithAttributes(attribute.String("tier.name", tier.Name)),
+	)
+	defer span.End()
+
+	if tier.Subjects == nil {
+		tier.Subjects = []string{}
+	}
+
+	query := `
+		INSERT INTO rate_limit_tiers (name, requests_per_second, subjects)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE
+		SET requests_per_second = EXCLUDED.requests_per_second, subjects = EXCLUDED.subjects, updated_at = NOW()
+		RETURNING created_at, updated_at
+	`
+
+	err := r.db.conn().QueryRow(ctx, query, tier.Name, tier.RequestsPerSecond, tier.Subjects).
+		Scan(&tier.CreatedAt, &tier.UpdatedAt)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to save tier")
+		return err
+	}
+
+	span.SetStatus(codes.Ok, "tier saved")
+	return nil
+}
+
+// Delete deletes a rate limit tier
+func (r *RateLimitTierRepository) Delete(ctx context.Context, name string) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RateLimitTierRepository.Delete",
+		trace.WithAttributes(attribute.String("tier.name", name)),
+	)
+	defer span.End()
+
+	cmdTag, err := r.db.conn().Exec(ctx, `DELETE FROM rate_limit_tiers WHERE name = $1`, name)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to delete tier")
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		span.SetStatus(codes.Error, "tier not found")
+		return pgx.ErrNoRows
+	}
+
+	span.SetStatus(codes.Ok, "tier deleted")
+	return nil
+}
@@ -2,11 +2,29 @@ package database
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/bluegreen"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/dedup"
+	"github.com/zakirkun/isekai/internal/egress"
+	"github.com/zakirkun/isekai/internal/mock"
+	"github.com/zakirkun/isekai/internal/plugin"
+	"github.com/zakirkun/isekai/internal/rewrite"
+	"github.com/zakirkun/isekai/internal/slo"
+	"github.com/zakirkun/isekai/internal/timewindow"
+	"github.com/zakirkun/isekai/internal/transform"
+	"github.com/zakirkun/isekai/internal/upstreamauth"
+	"github.com/zakirkun/isekai/internal/upstreamtls"
+	"github.com/zakirkun/isekai/internal/urlpath"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -14,20 +32,135 @@ var tracer = otel.Tracer("isekai-database")
 
 // Route represents a gateway route
 type Route struct {
-	ID        int       `json:"id"`
-	Path      string    `json:"path"`
-	TargetURL string    `json:"target_url"`
-	Method    string    `json:"method"`
-	Enabled   bool      `json:"enabled"`
-	RateLimit int       `json:"rate_limit"`
-	Timeout   int       `json:"timeout"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID                     int                      `json:"id"`
+	Path                   string                   `json:"path"`
+	TargetURL              string                   `json:"target_url"`
+	Method                 string                   `json:"method"`
+	Enabled                bool                     `json:"enabled"`
+	RateLimit              int                      `json:"rate_limit"`
+	Timeout                int                      `json:"timeout"`
+	IPAllow                []string                 `json:"ip_allow"`
+	IPDeny                 []string                 `json:"ip_deny"`
+	MirrorURL              string                   `json:"mirror_url"` // Receives a copy of MirrorPercent percent of requests
+	MirrorPercent          int                      `json:"mirror_percent"`
+	CanaryURL              string                   `json:"canary_target_url"` // Receives CanaryWeight percent of requests instead of TargetURL
+	CanaryWeight           int                      `json:"canary_weight"`
+	LoadBalanced           bool                     `json:"load_balanced"`       // Sends requests to the load balancer's backends, keeping TargetURL's path
+	Transform              *transform.Rules         `json:"transform"`           // Rewrites JSON request and response bodies
+	TLS                    *upstreamtls.Profile     `json:"tls"`                 // Client certificate and CA settings for an https upstream
+	H2C                    bool                     `json:"h2c"`                 // Speaks HTTP/2 without TLS to the upstream, as plaintext gRPC servers do
+	MaintenanceEnabled     bool                     `json:"maintenance_enabled"` // Answers with the maintenance response instead of proxying
+	MaintenanceStatus      int                      `json:"maintenance_status"`  // Defaults to 503
+	MaintenanceBody        string                   `json:"maintenance_body"`    // Empty sends the JSON error envelope
+	MaintenanceContentType string                   `json:"maintenance_content_type"`
+	MaintenanceRetryAfter  int                      `json:"maintenance_retry_after"` // Seconds for the Retry-After header, 0 to omit
+	Idempotent             bool                     `json:"idempotent"`              // Replays responses to POST and PATCH requests repeating an Idempotency-Key
+	HedgeDelay             int                      `json:"hedge_delay"`             // Milliseconds before a slow GET is also sent to a second backend, 0 to disable
+	Plugins                []plugin.Spec            `json:"plugins"`                 // Run in order before the request is forwarded
+	SensitiveHeaders       []string                 `json:"sensitive_headers"`       // Masked in logs and spans on top of the gateway's sensitive headers
+	BlueGreen              *bluegreen.Deployment    `json:"blue_green,omitempty"`    // Blue and green targets; target_url follows the active one
+	MaxConcurrency         int                      `json:"max_concurrency"`         // In-flight requests allowed to the upstream, 0 for no limit
+	Type                   string                   `json:"type"`                    // proxy, or mock and echo to answer without an upstream
+	Mock                   *mock.Response           `json:"mock,omitempty"`          // Response served by mock routes
+	BreakerStatuses        []int                    `json:"breaker_statuses"`        // 4xx statuses the circuit breaker counts as failures, on top of 5xx
+	UpstreamAuth           *upstreamauth.Profile    `json:"upstream_auth,omitempty"` // Credentials proving to the upstream that requests came through the gateway
+	UpstreamRateLimit      float64                  `json:"upstream_rate_limit"`     // Requests per second sent to the upstream, retries included, 0 for no limit
+	UpstreamBurst          int                      `json:"upstream_burst"`          // Requests sent at once within the upstream rate limit, defaults to 1
+	TenantID               string                   `json:"tenant_id"`               // Tenant owning the route, empty for gateway-wide routes
+	Host                   string                   `json:"host"`                    // Request host served, exact or a *.example.com wildcard, empty for any host
+	PreserveHost           bool                     `json:"preserve_host"`           // Forwards the client's Host header instead of the target's
+	Redirect               *rewrite.Redirect        `json:"redirect,omitempty"`      // Redirect answered by redirect routes
+	Rewrite                *rewrite.Rule            `json:"rewrite,omitempty"`       // Path rewrite applied by rewrite routes before forwarding
+	CountryAllow           []string                 `json:"country_allow"`           // ISO country codes allowed when GeoIP is configured, empty for all
+	CountryDeny            []string                 `json:"country_deny"`            // ISO country codes refused when GeoIP is configured
+	Dedup                  *dedup.Config            `json:"dedup,omitempty"`         // Answers repeated deliveries of an event without forwarding them
+	PreservePath           bool                     `json:"preserve_path"`           // Forwards the path as the client sent it instead of normalized
+	PassthroughOptions     bool                     `json:"passthrough_options"`     // Forwards OPTIONS requests, preflights included, instead of answering them
+	SLO                    *slo.Config              `json:"slo,omitempty"`           // Service level objective reported on and turned into Prometheus rules
+	Breaker                *circuitbreaker.Settings `json:"breaker,omitempty"`       // Circuit breaker thresholds, disabled or shared per host; nil has the defaults
+	Egress                 *egress.Profile          `json:"egress,omitempty"`        // Egress proxy the upstream is reached through, replacing the global one
+	SkipSecurityHeaders    bool                     `json:"skip_security_headers"`   // Leaves responses as the upstream sent them, without the gateway's security headers
+	TrustDeadlineMax       int                      `json:"trust_deadline_max_ms"`   // Milliseconds of the client's deadline header honored, 0 to strip it
+	Tags                   []string                 `json:"tags"`                    // Labels grouping routes for listing and bulk operations
+	MetricsTag             string                   `json:"metrics_tag"`             // Tag requests are counted under, defaults to the first tag
+	ActiveFrom             *time.Time               `json:"active_from"`             // Start of the time the route serves, nil for no start
+	ActiveUntil            *time.Time               `json:"active_until"`            // End of the time the route serves, nil for no end
+	Schedule               *timewindow.Schedule     `json:"schedule,omitempty"`      // Weekly times within active_from and active_until the route serves
+	CurrentlyActive        bool                     `json:"currently_active"`        // Whether the route serves now, computed for the route list and not stored
+	Critical               bool                     `json:"critical"`                // Holds readiness while the route has no healthy backend
+	CatchAll               bool                     `json:"catch_all"`               // Also serves paths under its own that no route matches
+	Owner                  string                   `json:"owner"`                   // Team or service accountable for the route, for usage reports
+	CreatedAt              time.Time                `json:"created_at"`
+	UpdatedAt              time.Time                `json:"updated_at"`
 }
 
+// normalize replaces nil lists with empty ones and fills in defaults so
+// stored and submitted routes compare equal
+func (route *Route) normalize() {
+	if route.IPAllow == nil {
+		route.IPAllow = []string{}
+	}
+	if route.IPDeny == nil {
+		route.IPDeny = []string{}
+	}
+	if route.Plugins == nil {
+		route.Plugins = []plugin.Spec{}
+	}
+	if route.SensitiveHeaders == nil {
+		route.SensitiveHeaders = []string{}
+	}
+	if route.BreakerStatuses == nil {
+		route.BreakerStatuses = []int{}
+	}
+	if route.Tags == nil {
+		route.Tags = []string{}
+	}
+	route.CountryAllow = normalizeCountries(route.CountryAllow)
+	route.CountryDeny = normalizeCountries(route.CountryDeny)
+	if route.MaintenanceStatus == 0 {
+		route.MaintenanceStatus = http.StatusServiceUnavailable
+	}
+	route.Host = NormalizeHost(route.Host)
+	route.Path = urlpath.CleanPath(route.Path)
+	// Computed when listing, never taken from a submitted route
+	route.CurrentlyActive = false
+	if route.Type == "" {
+		route.Type = RouteTypeProxy
+	}
+	if route.Mock != nil && route.Mock.Status == 0 {
+		route.Mock.Status = http.StatusOK
+	}
+	if route.BlueGreen != nil {
+		if route.BlueGreen.Active == "" {
+			route.BlueGreen.Active = bluegreen.Blue
+		}
+		route.TargetURL = route.BlueGreen.Target(route.BlueGreen.Active)
+	}
+}
+
+// normalizeCountries uppercases country codes, replacing a nil list with an
+// empty one
+func normalizeCountries(codes []string) []string {
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = strings.ToUpper(strings.TrimSpace(code))
+	}
+	return normalized
+}
+
+// Route types
+const (
+	RouteTypeProxy    = "proxy"
+	RouteTypeMock     = "mock"
+	RouteTypeEcho     = "echo"
+	RouteTypeRedirect = "redirect"
+	RouteTypeRewrite  = "rewrite"
+)
+
 // RouteRepository handles route database operations
 type RouteRepository struct {
 	db *Database
+	tx pgx.Tx
 }
 
 // NewRouteRepository creates a new route repository
@@ -35,21 +168,143 @@ func NewRouteRepository(db *Database) *RouteRepository {
 	return &RouteRepository{db: db}
 }
 
+// WithTx returns a copy of the repository that runs its queries inside tx
+func (r *RouteRepository) WithTx(tx pgx.Tx) *RouteRepository {
+	return &RouteRepository{db: r.db, tx: tx}
+}
+
+// conn returns the transaction if one is bound, otherwise the pool
+func (r *RouteRepository) conn() Querier {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db.conn()
+}
+
 // FindAll retrieves all routes
 func (r *RouteRepository) FindAll(ctx context.Context) ([]Route, error) {
 	// Start tracing span
 	ctx, span := tracer.Start(ctx, "repository.RouteRepository.FindAll")
 	defer span.End()
+	defer r.db.timeQuery(span, "route_find_all")()
+
+	query := `
+		SELECT id, path, target_url, method, enabled, rate_limit, timeout, ip_allow, ip_deny, mirror_url, mirror_percent, canary_target_url, canary_weight, load_balanced, transform, tls, h2c,
+			maintenance_enabled, maintenance_status, maintenance_body, maintenance_content_type, maintenance_retry_after, idempotent, hedge_delay, plugins, sensitive_headers, blue_green, max_concurrency, route_type, mock, breaker_statuses, upstream_auth, upstream_rate_limit, upstream_burst, COALESCE(tenant_id, ''), host, preserve_host, redirect, rewrite, country_allow, country_deny, dedup, preserve_path, passthrough_options, slo, breaker, egress, skip_security_headers, trust_deadline_max_ms, tags, metrics_tag, active_from, active_until, schedule, critical, catch_all, owner, created_at, updated_at
+		FROM routes
+		ORDER BY id
+	`
+
+	span.SetAttributes(semconv.DBQuerySummary("SELECT routes"))
+
+	rows, err := r.conn().Query(ctx, query)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "query failed")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var routes []Route
+	for rows.Next() {
+		var route Route
+		err := rows.Scan(
+			&route.ID,
+			&route.Path,
+			&route.TargetURL,
+			&route.Method,
+			&route.Enabled,
+			&route.RateLimit,
+			&route.Timeout,
+			&route.IPAllow,
+			&route.IPDeny,
+			&route.MirrorURL,
+			&route.MirrorPercent,
+			&route.CanaryURL,
+			&route.CanaryWeight,
+			&route.LoadBalanced,
+			&route.Transform,
+			&route.TLS,
+			&route.H2C,
+			&route.MaintenanceEnabled,
+			&route.MaintenanceStatus,
+			&route.MaintenanceBody,
+			&route.MaintenanceContentType,
+			&route.MaintenanceRetryAfter,
+			&route.Idempotent,
+			&route.HedgeDelay,
+			&route.Plugins,
+			&route.SensitiveHeaders,
+			&route.BlueGreen,
+			&route.MaxConcurrency,
+			&route.Type,
+			&route.Mock,
+			&route.BreakerStatuses,
+			&route.UpstreamAuth,
+			&route.UpstreamRateLimit,
+			&route.UpstreamBurst,
+			&route.TenantID,
+			&route.Host,
+			&route.PreserveHost,
+			&route.Redirect,
+			&route.Rewrite,
+			&route.CountryAllow,
+			&route.CountryDeny,
+			&route.Dedup,
+			&route.PreservePath,
+			&route.PassthroughOptions,
+			&route.SLO,
+			&route.Breaker,
+			&route.Egress,
+			&route.SkipSecurityHeaders,
+			&route.TrustDeadlineMax,
+			&route.Tags,
+			&route.MetricsTag,
+			&route.ActiveFrom,
+			&route.ActiveUntil,
+			&route.Schedule,
+			&route.Critical,
+			&route.CatchAll,
+			&route.Owner,
+			&route.CreatedAt,
+			&route.UpdatedAt,
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "scan failed")
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	span.SetAttributes(attribute.Int("routes.count", len(routes)))
+	span.SetStatus(codes.Ok, "success")
+
+	return routes, nil
+}
+
+// FindByTag retrieves the routes carrying tag
+func (r *RouteRepository) FindByTag(ctx context.Context, tag string) ([]Route, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RouteRepository.FindByTag",
+		trace.WithAttributes(
+			attribute.String("route.tag", tag),
+		),
+	)
+	defer span.End()
+	defer r.db.timeQuery(span, "route_find_by_tag")()
 
 	query := `
-		SELECT id, path, target_url, method, enabled, rate_limit, timeout, created_at, updated_at
+		SELECT id, path, target_url, method, enabled, rate_limit, timeout, ip_allow, ip_deny, mirror_url, mirror_percent, canary_target_url, canary_weight, load_balanced, transform, tls, h2c,
+			maintenance_enabled, maintenance_status, maintenance_body, maintenance_content_type, maintenance_retry_after, idempotent, hedge_delay, plugins, sensitive_headers, blue_green, max_concurrency, route_type, mock, breaker_statuses, upstream_auth, upstream_rate_limit, upstream_burst, COALESCE(tenant_id, ''), host, preserve_host, redirect, rewrite, country_allow, country_deny, dedup, preserve_path, passthrough_options, slo, breaker, egress, skip_security_headers, trust_deadline_max_ms, tags, metrics_tag, active_from, active_until, schedule, critical, catch_all, owner, created_at, updated_at
 		FROM routes
+		WHERE $1 = ANY(tags)
 		ORDER BY id
 	`
 
-	span.SetAttributes(attribute.String("db.query", "SELECT routes"))
+	span.SetAttributes(semconv.DBQuerySummary("SELECT routes by tag"))
 
-	rows, err := r.db.Pool.Query(ctx, query)
+	rows, err := r.conn().Query(ctx, query, tag)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "query failed")
@@ -68,6 +323,56 @@ func (r *RouteRepository) FindAll(ctx context.Context) ([]Route, error) {
 			&route.Enabled,
 			&route.RateLimit,
 			&route.Timeout,
+			&route.IPAllow,
+			&route.IPDeny,
+			&route.MirrorURL,
+			&route.MirrorPercent,
+			&route.CanaryURL,
+			&route.CanaryWeight,
+			&route.LoadBalanced,
+			&route.Transform,
+			&route.TLS,
+			&route.H2C,
+			&route.MaintenanceEnabled,
+			&route.MaintenanceStatus,
+			&route.MaintenanceBody,
+			&route.MaintenanceContentType,
+			&route.MaintenanceRetryAfter,
+			&route.Idempotent,
+			&route.HedgeDelay,
+			&route.Plugins,
+			&route.SensitiveHeaders,
+			&route.BlueGreen,
+			&route.MaxConcurrency,
+			&route.Type,
+			&route.Mock,
+			&route.BreakerStatuses,
+			&route.UpstreamAuth,
+			&route.UpstreamRateLimit,
+			&route.UpstreamBurst,
+			&route.TenantID,
+			&route.Host,
+			&route.PreserveHost,
+			&route.Redirect,
+			&route.Rewrite,
+			&route.CountryAllow,
+			&route.CountryDeny,
+			&route.Dedup,
+			&route.PreservePath,
+			&route.PassthroughOptions,
+			&route.SLO,
+			&route.Breaker,
+			&route.Egress,
+			&route.SkipSecurityHeaders,
+			&route.TrustDeadlineMax,
+			&route.Tags,
+			&route.MetricsTag,
+			&route.ActiveFrom,
+			&route.ActiveUntil,
+			&route.Schedule,
+			&route.Critical,
+			&route.CatchAll,
+			&route.Owner,
 			&route.CreatedAt,
 			&route.UpdatedAt,
 		)
@@ -94,17 +399,19 @@ func (r *RouteRepository) FindByID(ctx context.Context, id int) (*Route, error)
 		),
 	)
 	defer span.End()
+	defer r.db.timeQuery(span, "route_find_by_id")()
 
 	query := `
-		SELECT id, path, target_url, method, enabled, rate_limit, timeout, created_at, updated_at
+		SELECT id, path, target_url, method, enabled, rate_limit, timeout, ip_allow, ip_deny, mirror_url, mirror_percent, canary_target_url, canary_weight, load_balanced, transform, tls, h2c,
+			maintenance_enabled, maintenance_status, maintenance_body, maintenance_content_type, maintenance_retry_after, idempotent, hedge_delay, plugins, sensitive_headers, blue_green, max_concurrency, route_type, mock, breaker_statuses, upstream_auth, upstream_rate_limit, upstream_burst, COALESCE(tenant_id, ''), host, preserve_host, redirect, rewrite, country_allow, country_deny, dedup, preserve_path, passthrough_options, slo, breaker, egress, skip_security_headers, trust_deadline_max_ms, tags, metrics_tag, active_from, active_until, schedule, critical, catch_all, owner, created_at, updated_at
 		FROM routes
 		WHERE id = $1
 	`
 
-	span.SetAttributes(attribute.String("db.query", "SELECT route by ID"))
+	span.SetAttributes(semconv.DBQuerySummary("SELECT route by ID"))
 
 	var route Route
-	err := r.db.Pool.QueryRow(ctx, query, id).Scan(
+	err := r.conn().QueryRow(ctx, query, id).Scan(
 		&route.ID,
 		&route.Path,
 		&route.TargetURL,
@@ -112,6 +419,56 @@ func (r *RouteRepository) FindByID(ctx context.Context, id int) (*Route, error)
 		&route.Enabled,
 		&route.RateLimit,
 		&route.Timeout,
+		&route.IPAllow,
+		&route.IPDeny,
+		&route.MirrorURL,
+		&route.MirrorPercent,
+		&route.CanaryURL,
+		&route.CanaryWeight,
+		&route.LoadBalanced,
+		&route.Transform,
+		&route.TLS,
+		&route.H2C,
+		&route.MaintenanceEnabled,
+		&route.MaintenanceStatus,
+		&route.MaintenanceBody,
+		&route.MaintenanceContentType,
+		&route.MaintenanceRetryAfter,
+		&route.Idempotent,
+		&route.HedgeDelay,
+		&route.Plugins,
+		&route.SensitiveHeaders,
+		&route.BlueGreen,
+		&route.MaxConcurrency,
+		&route.Type,
+		&route.Mock,
+		&route.BreakerStatuses,
+		&route.UpstreamAuth,
+		&route.UpstreamRateLimit,
+		&route.UpstreamBurst,
+		&route.TenantID,
+		&route.Host,
+		&route.PreserveHost,
+		&route.Redirect,
+		&route.Rewrite,
+		&route.CountryAllow,
+		&route.CountryDeny,
+		&route.Dedup,
+		&route.PreservePath,
+		&route.PassthroughOptions,
+		&route.SLO,
+		&route.Breaker,
+		&route.Egress,
+		&route.SkipSecurityHeaders,
+		&route.TrustDeadlineMax,
+		&route.Tags,
+		&route.MetricsTag,
+		&route.ActiveFrom,
+		&route.ActiveUntil,
+		&route.Schedule,
+		&route.Critical,
+		&route.CatchAll,
+		&route.Owner,
 		&route.CreatedAt,
 		&route.UpdatedAt,
 	)
@@ -130,50 +487,159 @@ func (r *RouteRepository) FindByID(ctx context.Context, id int) (*Route, error)
 	return &route, nil
 }
 
-// FindByPath retrieves a route by path and method
-func (r *RouteRepository) FindByPath(ctx context.Context, path, method string) (*Route, error) {
+// FindByPath retrieves the enabled route serving method on path for the
+// request host, matched by MatchHost and then MatchMethod. The path's routes
+// are loaded in one query, so when none for the host serves method but some
+// serve others, a *MethodNotAllowedError listing them is returned instead of
+// pgx.ErrNoRows. When the path has no route for the host, the catch-all
+// routes of the prefixes it is under, loaded by the same query, are matched
+// by MatchCatchAll.
+func (r *RouteRepository) FindByPath(ctx context.Context, host, path, method string) (*Route, error) {
 	// Start tracing span
 	ctx, span := tracer.Start(ctx, "repository.RouteRepository.FindByPath",
 		trace.WithAttributes(
+			attribute.String("route.host", host),
 			attribute.String("route.path", path),
 			attribute.String("route.method", method),
 		),
 	)
 	defer span.End()
+	defer r.db.timeQuery(span, "route_find_by_path")()
 
 	query := `
-		SELECT id, path, target_url, method, enabled, rate_limit, timeout, created_at, updated_at
+		SELECT id, path, target_url, method, enabled, rate_limit, timeout, ip_allow, ip_deny, mirror_url, mirror_percent, canary_target_url, canary_weight, load_balanced, transform, tls, h2c,
+			maintenance_enabled, maintenance_status, maintenance_body, maintenance_content_type, maintenance_retry_after, idempotent, hedge_delay, plugins, sensitive_headers, blue_green, max_concurrency, route_type, mock, breaker_statuses, upstream_auth, upstream_rate_limit, upstream_burst, COALESCE(tenant_id, ''), host, preserve_host, redirect, rewrite, country_allow, country_deny, dedup, preserve_path, passthrough_options, slo, breaker, egress, skip_security_headers, trust_deadline_max_ms, tags, metrics_tag, active_from, active_until, schedule, critical, catch_all, owner, created_at, updated_at
 		FROM routes
-		WHERE path = $1 AND method = $2 AND enabled = true
+		WHERE enabled = true AND (path = $1 OR (catch_all AND path = ANY($2)))
 	`
 
-	span.SetAttributes(attribute.String("db.query", "SELECT route by path"))
+	span.SetAttributes(semconv.DBQuerySummary("SELECT routes by path"))
 
-	var route Route
-	err := r.db.Pool.QueryRow(ctx, query, path, method).Scan(
-		&route.ID,
-		&route.Path,
-		&route.TargetURL,
-		&route.Method,
-		&route.Enabled,
-		&route.RateLimit,
-		&route.Timeout,
-		&route.CreatedAt,
-		&route.UpdatedAt,
-	)
+	rows, err := r.conn().Query(ctx, query, path, urlpath.Parents(path))
 	if err != nil {
 		span.RecordError(err)
-		span.SetStatus(codes.Error, "route not found")
+		span.SetStatus(codes.Error, "query failed")
+		return nil, err
+	}
+	defer rows.Close()
+
+	hosts := make(map[string]map[string]*Route)
+	catchAlls := make(map[string]map[string]map[string]*Route)
+	for rows.Next() {
+		var route Route
+		err := rows.Scan(
+			&route.ID,
+			&route.Path,
+			&route.TargetURL,
+			&route.Method,
+			&route.Enabled,
+			&route.RateLimit,
+			&route.Timeout,
+			&route.IPAllow,
+			&route.IPDeny,
+			&route.MirrorURL,
+			&route.MirrorPercent,
+			&route.CanaryURL,
+			&route.CanaryWeight,
+			&route.LoadBalanced,
+			&route.Transform,
+			&route.TLS,
+			&route.H2C,
+			&route.MaintenanceEnabled,
+			&route.MaintenanceStatus,
+			&route.MaintenanceBody,
+			&route.MaintenanceContentType,
+			&route.MaintenanceRetryAfter,
+			&route.Idempotent,
+			&route.HedgeDelay,
+			&route.Plugins,
+			&route.SensitiveHeaders,
+			&route.BlueGreen,
+			&route.MaxConcurrency,
+			&route.Type,
+			&route.Mock,
+			&route.BreakerStatuses,
+			&route.UpstreamAuth,
+			&route.UpstreamRateLimit,
+			&route.UpstreamBurst,
+			&route.TenantID,
+			&route.Host,
+			&route.PreserveHost,
+			&route.Redirect,
+			&route.Rewrite,
+			&route.CountryAllow,
+			&route.CountryDeny,
+			&route.Dedup,
+			&route.PreservePath,
+			&route.PassthroughOptions,
+			&route.SLO,
+			&route.Breaker,
+			&route.Egress,
+			&route.SkipSecurityHeaders,
+			&route.TrustDeadlineMax,
+			&route.Tags,
+			&route.MetricsTag,
+			&route.ActiveFrom,
+			&route.ActiveUntil,
+			&route.Schedule,
+			&route.Critical,
+			&route.CatchAll,
+			&route.Owner,
+			&route.CreatedAt,
+			&route.UpdatedAt,
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "scan failed")
+			return nil, err
+		}
+		byHost := hosts
+		if route.Path != path {
+			if byHost = catchAlls[route.Path]; byHost == nil {
+				byHost = make(map[string]map[string]*Route)
+				catchAlls[route.Path] = byHost
+			}
+		}
+		methods, exists := byHost[route.Host]
+		if !exists {
+			methods = make(map[string]*Route)
+			byHost[route.Host] = methods
+		}
+		methods[route.Method] = &route
+	}
+	if err := rows.Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "query failed")
 		return nil, err
 	}
 
+	methods, _ := MatchHost(hosts, host)
+	route, ok := MatchMethod(methods, method)
+	if !ok {
+		var err error = pgx.ErrNoRows
+		if len(methods) > 0 {
+			err = &MethodNotAllowedError{Allowed: AllowedMethods(methods)}
+		} else {
+			var prefix string
+			route, prefix, err = MatchCatchAll(catchAlls, host, path, method)
+			if prefix != "" {
+				span.SetAttributes(attribute.String("route.catch_all", prefix))
+			}
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "route not found")
+			return nil, err
+		}
+	}
+
 	span.SetAttributes(
 		attribute.Int("route.id", route.ID),
 		attribute.String("route.target_url", route.TargetURL),
 	)
 	span.SetStatus(codes.Ok, "success")
 
-	return &route, nil
+	return route, nil
 }
 
 // Create creates a new route
@@ -187,14 +653,34 @@ func (r *RouteRepository) Create(ctx context.Context, route *Route) error {
 		),
 	)
 	defer span.End()
+	defer r.db.timeQuery(span, "route_create")()
 
 	query := `
-		INSERT INTO routes (path, target_url, method, enabled, rate_limit, timeout)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO routes (path, target_url, method, enabled, rate_limit, timeout, ip_allow, ip_deny,
+			mirror_url, mirror_percent, canary_target_url, canary_weight, load_balanced, transform, tls, h2c,
+			maintenance_enabled, maintenance_status, maintenance_body, maintenance_content_type, maintenance_retry_after, idempotent, hedge_delay, plugins, sensitive_headers, blue_green, max_concurrency,
+			route_type, mock, breaker_statuses, upstream_auth, upstream_rate_limit, upstream_burst, tenant_id, host, preserve_host, redirect, rewrite, country_allow, country_deny, dedup, preserve_path, passthrough_options, slo, breaker, egress, skip_security_headers, trust_deadline_max_ms, tags, metrics_tag, active_from, active_until, schedule, critical, catch_all, owner)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, NULLIF($34, ''), $35, $36, $37, $38, $39, $40, $41, $42, $43, $44, $45, $46, $47, $48, $49, $50, $51, $52, $53, $54, $55, $56)
 		RETURNING id, created_at, updated_at
 	`
 
-	err := r.db.Pool.QueryRow(
+	route.normalize()
+	if err := route.TLS.Seal(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to seal tls key")
+		return err
+	}
+	if err := route.UpstreamAuth.Seal(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to seal upstream credentials")
+		return err
+	}
+	if err := route.Egress.Seal(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to seal egress proxy credentials")
+		return err
+	}
+	err := r.conn().QueryRow(
 		ctx,
 		query,
 		route.Path,
@@ -203,6 +689,56 @@ func (r *RouteRepository) Create(ctx context.Context, route *Route) error {
 		route.Enabled,
 		route.RateLimit,
 		route.Timeout,
+		route.IPAllow,
+		route.IPDeny,
+		route.MirrorURL,
+		route.MirrorPercent,
+		route.CanaryURL,
+		route.CanaryWeight,
+		route.LoadBalanced,
+		route.Transform,
+		route.TLS,
+		route.H2C,
+		route.MaintenanceEnabled,
+		route.MaintenanceStatus,
+		route.MaintenanceBody,
+		route.MaintenanceContentType,
+		route.MaintenanceRetryAfter,
+		route.Idempotent,
+		route.HedgeDelay,
+		route.Plugins,
+		route.SensitiveHeaders,
+		route.BlueGreen,
+		route.MaxConcurrency,
+		route.Type,
+		route.Mock,
+		route.BreakerStatuses,
+		route.UpstreamAuth,
+		route.UpstreamRateLimit,
+		route.UpstreamBurst,
+		route.TenantID,
+		route.Host,
+		route.PreserveHost,
+		route.Redirect,
+		route.Rewrite,
+		route.CountryAllow,
+		route.CountryDeny,
+		route.Dedup,
+		route.PreservePath,
+		route.PassthroughOptions,
+		route.SLO,
+		route.Breaker,
+		route.Egress,
+		route.SkipSecurityHeaders,
+		route.TrustDeadlineMax,
+		route.Tags,
+		route.MetricsTag,
+		route.ActiveFrom,
+		route.ActiveUntil,
+		route.Schedule,
+		route.Critical,
+		route.CatchAll,
+		route.Owner,
 	).Scan(&route.ID, &route.CreatedAt, &route.UpdatedAt)
 
 	if err != nil {
@@ -227,15 +763,43 @@ func (r *RouteRepository) Update(ctx context.Context, route *Route) error {
 		),
 	)
 	defer span.End()
+	defer r.db.timeQuery(span, "route_update")()
 
 	query := `
 		UPDATE routes
-		SET path = $1, target_url = $2, method = $3, enabled = $4, rate_limit = $5, timeout = $6, updated_at = NOW()
-		WHERE id = $7
+		SET path = $1, target_url = $2, method = $3, enabled = $4, rate_limit = $5, timeout = $6,
+			ip_allow = $7, ip_deny = $8, mirror_url = $9, mirror_percent = $10,
+			canary_target_url = $11, canary_weight = $12, load_balanced = $13, transform = $14,
+			tls = $15, h2c = $16, maintenance_enabled = $17, maintenance_status = $18, maintenance_body = $19,
+			maintenance_content_type = $20, maintenance_retry_after = $21, idempotent = $22, hedge_delay = $23,
+			plugins = $24, sensitive_headers = $25, blue_green = $26, max_concurrency = $27,
+			route_type = $28, mock = $29, breaker_statuses = $30, upstream_auth = $31,
+			upstream_rate_limit = $32, upstream_burst = $33, tenant_id = NULLIF($34, ''), host = $35, preserve_host = $36,
+			redirect = $37, rewrite = $38, country_allow = $39, country_deny = $40, dedup = $41,
+			preserve_path = $42, passthrough_options = $43, slo = $44, breaker = $45, egress = $46,
+			skip_security_headers = $47, trust_deadline_max_ms = $48,
+			tags = $49, metrics_tag = $50, active_from = $51, active_until = $52, schedule = $53, critical = $54, catch_all = $55, owner = $56, updated_at = NOW()
+		WHERE id = $57
 		RETURNING updated_at
 	`
 
-	err := r.db.Pool.QueryRow(
+	route.normalize()
+	if err := route.TLS.Seal(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to seal tls key")
+		return err
+	}
+	if err := route.UpstreamAuth.Seal(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to seal upstream credentials")
+		return err
+	}
+	if err := route.Egress.Seal(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to seal egress proxy credentials")
+		return err
+	}
+	err := r.conn().QueryRow(
 		ctx,
 		query,
 		route.Path,
@@ -244,6 +808,56 @@ func (r *RouteRepository) Update(ctx context.Context, route *Route) error {
 		route.Enabled,
 		route.RateLimit,
 		route.Timeout,
+		route.IPAllow,
+		route.IPDeny,
+		route.MirrorURL,
+		route.MirrorPercent,
+		route.CanaryURL,
+		route.CanaryWeight,
+		route.LoadBalanced,
+		route.Transform,
+		route.TLS,
+		route.H2C,
+		route.MaintenanceEnabled,
+		route.MaintenanceStatus,
+		route.MaintenanceBody,
+		route.MaintenanceContentType,
+		route.MaintenanceRetryAfter,
+		route.Idempotent,
+		route.HedgeDelay,
+		route.Plugins,
+		route.SensitiveHeaders,
+		route.BlueGreen,
+		route.MaxConcurrency,
+		route.Type,
+		route.Mock,
+		route.BreakerStatuses,
+		route.UpstreamAuth,
+		route.UpstreamRateLimit,
+		route.UpstreamBurst,
+		route.TenantID,
+		route.Host,
+		route.PreserveHost,
+		route.Redirect,
+		route.Rewrite,
+		route.CountryAllow,
+		route.CountryDeny,
+		route.Dedup,
+		route.PreservePath,
+		route.PassthroughOptions,
+		route.SLO,
+		route.Breaker,
+		route.Egress,
+		route.SkipSecurityHeaders,
+		route.TrustDeadlineMax,
+		route.Tags,
+		route.MetricsTag,
+		route.ActiveFrom,
+		route.ActiveUntil,
+		route.Schedule,
+		route.Critical,
+		route.CatchAll,
+		route.Owner,
 		route.ID,
 	).Scan(&route.UpdatedAt)
 
@@ -266,9 +880,10 @@ func (r *RouteRepository) Delete(ctx context.Context, id int) error {
 		),
 	)
 	defer span.End()
+	defer r.db.timeQuery(span, "route_delete")()
 
 	query := `DELETE FROM routes WHERE id = $1`
-	cmdTag, err := r.db.Pool.Exec(ctx, query, id)
+	cmdTag, err := r.conn().Exec(ctx, query, id)
 
 	if err != nil {
 		span.RecordError(err)
@@ -283,15 +898,21 @@ func (r *RouteRepository) Delete(ctx context.Context, id int) error {
 
 // RequestLog represents a logged request
 type RequestLog struct {
-	ID           int       `json:"id"`
-	RouteID      *int      `json:"route_id,omitempty"` // Nullable - may not have a matching route
-	Method       string    `json:"method"`
-	Path         string    `json:"path"`
-	StatusCode   int       `json:"status_code"`
-	ResponseTime int       `json:"response_time"`
-	ClientIP     string    `json:"client_ip"`
-	UserAgent    string    `json:"user_agent"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           int               `json:"id"`
+	RouteID      *int              `json:"route_id,omitempty"` // Nullable - may not have a matching route
+	Method       string            `json:"method"`
+	Path         string            `json:"path"`
+	StatusCode   int               `json:"status_code"`
+	ResponseTime int               `json:"response_time"`
+	ClientIP     string            `json:"client_ip"`
+	UserAgent    string            `json:"user_agent"`
+	Headers      map[string]string `json:"headers,omitempty"`   // Recorded request headers, sensitive values masked
+	Fault        string            `json:"fault,omitempty"`     // Fault injected into the request by chaos testing
+	RequestSize  int64             `json:"request_size"`        // Request body bytes read from the client
+	ResponseSize int64             `json:"response_size"`       // Response body bytes written to the client
+	TenantID     string            `json:"tenant_id,omitempty"` // Tenant owning the route, for chargeback
+	Country      string            `json:"country,omitempty"`   // Client country code, when GeoIP is configured
+	CreatedAt    time.Time         `json:"created_at"`
 }
 
 // RequestLogRepository handles request log database operations
@@ -304,7 +925,8 @@ func NewRequestLogRepository(db *Database) *RequestLogRepository {
 	return &RequestLogRepository{db: db}
 }
 
-// Create creates a new request log entry
+// Create creates a new request log entry, timestamped now unless CreatedAt
+// is set, as for imported logs
 func (r *RequestLogRepository) Create(ctx context.Context, log *RequestLog) error {
 	// Start tracing span
 	ctx, span := tracer.Start(ctx, "repository.RequestLogRepository.Create",
@@ -315,14 +937,19 @@ func (r *RequestLogRepository) Create(ctx context.Context, log *RequestLog) erro
 		),
 	)
 	defer span.End()
+	defer r.db.timeQuery(span, "request_log_create")()
 
 	query := `
-		INSERT INTO request_logs (route_id, method, path, status_code, response_time, client_ip, user_agent)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO request_logs (route_id, method, path, status_code, response_time, client_ip, user_agent, headers, fault, request_size, response_size, tenant_id, country, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, COALESCE($14, NOW()))
 		RETURNING id, created_at
 	`
 
-	err := r.db.Pool.QueryRow(
+	var createdAt *time.Time
+	if !log.CreatedAt.IsZero() {
+		createdAt = &log.CreatedAt
+	}
+	err := r.db.conn().QueryRow(
 		ctx,
 		query,
 		log.RouteID,
@@ -332,6 +959,13 @@ func (r *RequestLogRepository) Create(ctx context.Context, log *RequestLog) erro
 		log.ResponseTime,
 		log.ClientIP,
 		log.UserAgent,
+		log.Headers,
+		log.Fault,
+		log.RequestSize,
+		log.ResponseSize,
+		log.TenantID,
+		log.Country,
+		createdAt,
 	).Scan(&log.ID, &log.CreatedAt)
 
 	if err != nil {
@@ -355,16 +989,129 @@ func (r *RequestLogRepository) FindByRouteID(ctx context.Context, routeID int, l
 		),
 	)
 	defer span.End()
+	defer r.db.timeQuery(span, "request_log_find_by_route")()
 
 	query := `
-		SELECT id, route_id, method, path, status_code, response_time, client_ip, user_agent, created_at
+		SELECT id, route_id, method, path, status_code, response_time, client_ip, user_agent, headers, fault, request_size, response_size, tenant_id, country, created_at
 		FROM request_logs
 		WHERE route_id = $1
 		ORDER BY created_at DESC
 		LIMIT $2
 	`
 
-	rows, err := r.db.Pool.Query(ctx, query, routeID, limit)
+	rows, err := r.db.conn().Query(ctx, query, routeID, limit)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to query request logs")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []RequestLog
+	for rows.Next() {
+		var log RequestLog
+		err := rows.Scan(
+			&log.ID,
+			&log.RouteID,
+			&log.Method,
+			&log.Path,
+			&log.StatusCode,
+			&log.ResponseTime,
+			&log.ClientIP,
+			&log.UserAgent,
+			&log.Headers,
+			&log.Fault,
+			&log.RequestSize,
+			&log.ResponseSize,
+			&log.TenantID,
+			&log.Country,
+			&log.CreatedAt,
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to scan request log")
+			return nil, err
+		}
+		logs = append(logs, log)
+	}
+
+	span.SetAttributes(attribute.Int("logs.count", len(logs)))
+	span.SetStatus(codes.Ok, "request logs retrieved")
+	return logs, nil
+}
+
+// RequestLogFilter narrows down request log queries
+type RequestLogFilter struct {
+	RouteID  *int
+	TenantID string
+	Country  string
+	Method   string
+	Path     string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+// query returns the query selecting the logs matching the filter, newest
+// first, and its arguments
+func (filter RequestLogFilter) query() (string, []interface{}) {
+	query := `
+		SELECT id, route_id, method, path, status_code, response_time, client_ip, user_agent, headers, fault, request_size, response_size, tenant_id, country, created_at
+		FROM request_logs
+		WHERE 1 = 1
+	`
+	args := []interface{}{}
+
+	if filter.RouteID != nil {
+		args = append(args, *filter.RouteID)
+		query += fmt.Sprintf(" AND route_id = $%d", len(args))
+	}
+	if filter.TenantID != "" {
+		args = append(args, filter.TenantID)
+		query += fmt.Sprintf(" AND tenant_id = $%d", len(args))
+	}
+	if filter.Country != "" {
+		args = append(args, filter.Country)
+		query += fmt.Sprintf(" AND country = $%d", len(args))
+	}
+	if filter.Method != "" {
+		args = append(args, filter.Method)
+		query += fmt.Sprintf(" AND method = $%d", len(args))
+	}
+	if filter.Path != "" {
+		args = append(args, filter.Path)
+		query += fmt.Sprintf(" AND path = $%d", len(args))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		query += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+
+	query += " ORDER BY created_at DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	return query, args
+}
+
+// FindByFilter retrieves logs matching the given filter, newest first
+func (r *RequestLogRepository) FindByFilter(ctx context.Context, filter RequestLogFilter) ([]RequestLog, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RequestLogRepository.FindByFilter",
+		trace.WithAttributes(
+			attribute.Int("query.limit", filter.Limit),
+		),
+	)
+	defer span.End()
+	defer r.db.timeQuery(span, "request_log_find_by_filter")()
+
+	query, args := filter.query()
+	rows, err := r.db.conn().Query(ctx, query, args...)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "failed to query request logs")
@@ -384,6 +1131,12 @@ func (r *RequestLogRepository) FindByRouteID(ctx context.Context, routeID int, l
 			&log.ResponseTime,
 			&log.ClientIP,
 			&log.UserAgent,
+			&log.Headers,
+			&log.Fault,
+			&log.RequestSize,
+			&log.ResponseSize,
+			&log.TenantID,
+			&log.Country,
 			&log.CreatedAt,
 		)
 		if err != nil {
@@ -398,3 +1151,191 @@ func (r *RequestLogRepository) FindByRouteID(ctx context.Context, routeID int, l
 	span.SetStatus(codes.Ok, "request logs retrieved")
 	return logs, nil
 }
+
+// StreamByFilter calls fn with each log matching the filter, newest first,
+// as its row arrives, stopping at fn's first error. Rows are read from the
+// connection as fn consumes them rather than collected, so a filter matching
+// millions of logs takes no more memory than one. Unlike other queries it
+// isn't bounded by DB_QUERY_TIMEOUT: it runs until the rows run out, fn
+// fails or ctx is done.
+func (r *RequestLogRepository) StreamByFilter(ctx context.Context, filter RequestLogFilter, fn func(*RequestLog) error) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RequestLogRepository.StreamByFilter",
+		trace.WithAttributes(
+			attribute.Int("query.limit", filter.Limit),
+		),
+	)
+	defer span.End()
+	defer r.db.timeQuery(span, "request_log_stream_by_filter")()
+
+	query, args := filter.query()
+	rows, err := r.db.streaming().Query(ctx, query, args...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to query request logs")
+		return err
+	}
+	defer rows.Close()
+
+	count := 0
+	var log RequestLog
+	for rows.Next() {
+		log = RequestLog{}
+		err := rows.Scan(
+			&log.ID,
+			&log.RouteID,
+			&log.Method,
+			&log.Path,
+			&log.StatusCode,
+			&log.ResponseTime,
+			&log.ClientIP,
+			&log.UserAgent,
+			&log.Headers,
+			&log.Fault,
+			&log.RequestSize,
+			&log.ResponseSize,
+			&log.TenantID,
+			&log.Country,
+			&log.CreatedAt,
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to scan request log")
+			return err
+		}
+		if err := fn(&log); err != nil {
+			span.SetAttributes(attribute.Int("logs.count", count))
+			return err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to read request logs")
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("logs.count", count))
+	span.SetStatus(codes.Ok, "request logs streamed")
+	return nil
+}
+
+// RouteTraffic is the totals of a route's or tenant's request logs
+type RouteTraffic struct {
+	Requests        int64   `json:"requests"`
+	Errors          int64   `json:"errors"`            // Requests answered with a 5xx status
+	AvgResponseTime float64 `json:"avg_response_time"` // Milliseconds
+	P50             float64 `json:"p50_response_time"` // Milliseconds, approximated over rolled up hours
+	P95             float64 `json:"p95_response_time"`
+	P99             float64 `json:"p99_response_time"`
+	RequestBytes    int64   `json:"request_bytes"`
+	ResponseBytes   int64   `json:"response_bytes"`
+}
+
+// TrafficByRouteID totals a route's request logs created from from until to,
+// reading the hours already rolled up from request_stats. A zero time leaves
+// that end of the range open.
+func (r *RequestLogRepository) TrafficByRouteID(ctx context.Context, routeID int, from, to time.Time) (*RouteTraffic, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RequestLogRepository.TrafficByRouteID",
+		trace.WithAttributes(
+			attribute.Int("route.id", routeID),
+		),
+	)
+	defer span.End()
+	defer r.db.timeQuery(span, "request_log_traffic_by_route")()
+
+	return r.rolledTraffic(ctx, span, routeID, from, to)
+}
+
+// LatencyByRouteID counts a route's request logs created since from, and
+// those of them that took longer than latencyMS. Rollups only keep
+// percentiles, so this reads the logs themselves.
+func (r *RequestLogRepository) LatencyByRouteID(ctx context.Context, routeID, latencyMS int, from time.Time) (requests, slow int64, err error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RequestLogRepository.LatencyByRouteID",
+		trace.WithAttributes(
+			attribute.Int("route.id", routeID),
+			attribute.Int("latency.threshold_ms", latencyMS),
+		),
+	)
+	defer span.End()
+	defer r.db.timeQuery(span, "request_log_latency_by_route")()
+
+	err = r.db.conn().QueryRow(ctx, `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE response_time > $2)
+		FROM request_logs
+		WHERE route_id = $1 AND created_at >= $3
+	`, routeID, latencyMS, from).Scan(&requests, &slow)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to count request logs")
+		return 0, 0, err
+	}
+
+	span.SetAttributes(attribute.Int64("logs.count", requests))
+	span.SetStatus(codes.Ok, "request logs counted")
+	return requests, slow, nil
+}
+
+// TrafficByTenant totals the request logs of a tenant's routes created from
+// from until to, for chargeback. A zero time leaves that end of the range open.
+func (r *RequestLogRepository) TrafficByTenant(ctx context.Context, tenantID string, from, to time.Time) (*RouteTraffic, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RequestLogRepository.TrafficByTenant",
+		trace.WithAttributes(
+			attribute.String("tenant.id", tenantID),
+		),
+	)
+	defer span.End()
+	defer r.db.timeQuery(span, "request_log_traffic_by_tenant")()
+
+	return r.traffic(ctx, span, "tenant_id", tenantID, from, to)
+}
+
+// traffic totals the request logs whose column equals value
+func (r *RequestLogRepository) traffic(ctx context.Context, span trace.Span, column string, value interface{}, from, to time.Time) (*RouteTraffic, error) {
+	query := `
+		SELECT COUNT(*),
+			COUNT(*) FILTER (WHERE status_code >= 500),
+			COALESCE(AVG(response_time), 0),
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY response_time), 0),
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY response_time), 0),
+			COALESCE(percentile_cont(0.99) WITHIN GROUP (ORDER BY response_time), 0),
+			COALESCE(SUM(request_size), 0),
+			COALESCE(SUM(response_size), 0)
+		FROM request_logs
+		WHERE ` + column + ` = $1
+	`
+	args := []interface{}{value}
+
+	if !from.IsZero() {
+		args = append(args, from)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !to.IsZero() {
+		args = append(args, to)
+		query += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+
+	var traffic RouteTraffic
+	err := r.db.conn().QueryRow(ctx, query, args...).Scan(
+		&traffic.Requests,
+		&traffic.Errors,
+		&traffic.AvgResponseTime,
+		&traffic.P50,
+		&traffic.P95,
+		&traffic.P99,
+		&traffic.RequestBytes,
+		&traffic.ResponseBytes,
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to total request logs")
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int64("logs.count", traffic.Requests))
+	span.SetStatus(codes.Ok, "request logs totalled")
+	return &traffic, nil
+}
@@ -0,0 +1,256 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// rollupLockKey is the advisory lock held by the replica rolling up request
+// logs, so only one aggregates at a time
+const rollupLockKey int64 = 0x69736b6169 // "iskai"
+
+// rollupChunk bounds the hours aggregated per transaction, so a backfill
+// over a large table commits its progress as it goes
+const rollupChunk = 24 * time.Hour
+
+// rollupUpsert aggregates the request logs created in [$1, $2) into hourly
+// rows, replacing any rows already rolled up for those hours
+const rollupUpsert = `
+	INSERT INTO request_stats (route_id, hour, requests, errors, response_time_total,
+		p50, p95, p99, request_bytes, response_bytes, updated_at)
+	SELECT route_id, date_trunc('hour', created_at), COUNT(*),
+		COUNT(*) FILTER (WHERE status_code >= 500),
+		SUM(response_time),
+		percentile_cont(0.5) WITHIN GROUP (ORDER BY response_time),
+		percentile_cont(0.95) WITHIN GROUP (ORDER BY response_time),
+		percentile_cont(0.99) WITHIN GROUP (ORDER BY response_time),
+		SUM(request_size), SUM(response_size), NOW()
+	FROM request_logs
+	WHERE created_at >= $1 AND created_at < $2 AND route_id IS NOT NULL
+		AND EXISTS (SELECT 1 FROM routes WHERE routes.id = request_logs.route_id)
+	GROUP BY route_id, date_trunc('hour', created_at)
+	ON CONFLICT (route_id, hour) DO UPDATE
+	SET requests = EXCLUDED.requests, errors = EXCLUDED.errors,
+		response_time_total = EXCLUDED.response_time_total,
+		p50 = EXCLUDED.p50, p95 = EXCLUDED.p95, p99 = EXCLUDED.p99,
+		request_bytes = EXCLUDED.request_bytes, response_bytes = EXCLUDED.response_bytes,
+		updated_at = NOW()
+`
+
+// RollupRequestLogs aggregates the request logs of every complete hour since
+// the last run into request_stats, starting from the oldest log on the first
+// run. The last hour rolled up is aggregated again to take in logs written
+// late. It returns the hours covered, and false when another replica holds
+// the rollup lock.
+func (db *Database) RollupRequestLogs(ctx context.Context) (int, bool, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "database.RollupRequestLogs")
+	defer span.End()
+
+	pool := db.pool.Load()
+	if pool == nil {
+		return 0, false, ErrUnavailable
+	}
+
+	// Advisory locks belong to a session, so hold one connection throughout
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to acquire connection")
+		return 0, false, err
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, rollupLockKey).Scan(&locked); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to take rollup lock")
+		return 0, false, err
+	}
+	span.SetAttributes(attribute.Bool("rollup.locked", locked))
+	if !locked {
+		span.SetStatus(codes.Ok, "rollup running elsewhere")
+		return 0, false, nil
+	}
+	defer func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.Exec(unlockCtx, `SELECT pg_advisory_unlock($1)`, rollupLockKey); err != nil {
+			// Closing the session releases the lock with it
+			db.log.Warnf("Failed to release rollup lock: %v", err)
+			conn.Conn().Close(unlockCtx)
+		}
+	}()
+
+	// Roll up from the last hour done, or the oldest log on the first run,
+	// to the start of the current hour
+	var start, end time.Time
+	err = conn.QueryRow(ctx, `
+		SELECT COALESCE(
+			(SELECT rolled_until - INTERVAL '1 hour' FROM request_stats_state WHERE name = 'hourly'),
+			(SELECT date_trunc('hour', MIN(created_at)) FROM request_logs),
+			date_trunc('hour', LOCALTIMESTAMP)),
+			date_trunc('hour', LOCALTIMESTAMP)
+	`).Scan(&start, &end)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to find rollup range")
+		return 0, true, err
+	}
+
+	hours := 0
+	for from := start; from.Before(end); from = from.Add(rollupChunk) {
+		to := from.Add(rollupChunk)
+		if to.After(end) {
+			to = end
+		}
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if err := rollupHours(ctx, tx, from, to); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `
+				INSERT INTO request_stats_state (name, rolled_until) VALUES ('hourly', $1)
+				ON CONFLICT (name) DO UPDATE SET rolled_until = EXCLUDED.rolled_until
+			`, to)
+			return err
+		})
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to roll up request logs")
+			return hours, true, err
+		}
+		hours += int(to.Sub(from) / time.Hour)
+	}
+
+	span.SetAttributes(attribute.Int("rollup.hours", hours))
+	span.SetStatus(codes.Ok, "request logs rolled up")
+	return hours, true, nil
+}
+
+// RollupHours aggregates the request logs created from from until to into
+// request_stats. from and to should fall on the hour. Rerunning it replaces
+// the rows with the same numbers.
+func (db *Database) RollupHours(ctx context.Context, from, to time.Time) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "database.RollupHours")
+	defer span.End()
+	defer db.timeQuery(span, "request_stats_rollup")()
+
+	if err := rollupHours(ctx, db.conn(), from, to); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to roll up request logs")
+		return err
+	}
+	span.SetStatus(codes.Ok, "request logs rolled up")
+	return nil
+}
+
+// rollupHours runs rollupUpsert on q
+func rollupHours(ctx context.Context, q Querier, from, to time.Time) error {
+	_, err := q.Exec(ctx, rollupUpsert, from, to)
+	return err
+}
+
+// trafficSums holds the sums both parts of a route's traffic are combined from
+type trafficSums struct {
+	requests, errors, responseTime, requestBytes, responseBytes int64
+	p50, p95, p99                                               float64 // Weighted by requests
+}
+
+// add folds other's sums into s
+func (s *trafficSums) add(other trafficSums) {
+	s.requests += other.requests
+	s.errors += other.errors
+	s.responseTime += other.responseTime
+	s.requestBytes += other.requestBytes
+	s.responseBytes += other.responseBytes
+	s.p50 += other.p50
+	s.p95 += other.p95
+	s.p99 += other.p99
+}
+
+// traffic returns the totals, with percentiles averaged over the requests
+func (s *trafficSums) traffic() *RouteTraffic {
+	traffic := &RouteTraffic{
+		Requests:      s.requests,
+		Errors:        s.errors,
+		RequestBytes:  s.requestBytes,
+		ResponseBytes: s.responseBytes,
+	}
+	if s.requests > 0 {
+		n := float64(s.requests)
+		traffic.AvgResponseTime = float64(s.responseTime) / n
+		traffic.P50, traffic.P95, traffic.P99 = s.p50/n, s.p95/n, s.p99/n
+	}
+	return traffic
+}
+
+// rolledTraffic totals a route's traffic from its hourly rollups for the
+// complete hours between from and to that were rolled up, and from its raw
+// request logs for the rest of the range, such as the current hour.
+// Percentiles combine the hours' percentiles weighted by their requests, so
+// they approximate the range's.
+func (r *RequestLogRepository) rolledTraffic(ctx context.Context, span trace.Span, routeID int, from, to time.Time) (*RouteTraffic, error) {
+	var start, end *time.Time
+	if !from.IsZero() {
+		start = &from
+	}
+	if !to.IsZero() {
+		end = &to
+	}
+
+	// Totals of the rolled up hours [lo, hi) within the range and of the raw
+	// logs outside them
+	var rolled, raw trafficSums
+	err := r.db.conn().QueryRow(ctx, `
+		WITH bounds AS (
+			SELECT date_trunc('hour', COALESCE($2::timestamp, '-infinity') + INTERVAL '1 hour' - INTERVAL '1 microsecond') AS lo,
+				LEAST(date_trunc('hour', COALESCE($3::timestamp, 'infinity')),
+					COALESCE((SELECT rolled_until FROM request_stats_state WHERE name = 'hourly'), '-infinity')) AS hi
+		), covered AS (
+			SELECT lo, GREATEST(lo, hi) AS hi FROM bounds
+		), rolled AS (
+			SELECT COALESCE(SUM(requests), 0) AS requests, COALESCE(SUM(errors), 0) AS errors,
+				COALESCE(SUM(response_time_total), 0) AS response_time,
+				COALESCE(SUM(request_bytes), 0) AS request_bytes, COALESCE(SUM(response_bytes), 0) AS response_bytes,
+				COALESCE(SUM(p50 * requests), 0) AS p50, COALESCE(SUM(p95 * requests), 0) AS p95,
+				COALESCE(SUM(p99 * requests), 0) AS p99
+			FROM request_stats, covered
+			WHERE route_id = $1 AND hour >= covered.lo AND hour < covered.hi
+		), raw AS (
+			SELECT COUNT(*) AS requests, COUNT(*) FILTER (WHERE status_code >= 500) AS errors,
+				COALESCE(SUM(response_time), 0) AS response_time,
+				COALESCE(SUM(request_size), 0) AS request_bytes, COALESCE(SUM(response_size), 0) AS response_bytes,
+				COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY response_time) * COUNT(*), 0) AS p50,
+				COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY response_time) * COUNT(*), 0) AS p95,
+				COALESCE(percentile_cont(0.99) WITHIN GROUP (ORDER BY response_time) * COUNT(*), 0) AS p99
+			FROM request_logs, covered
+			WHERE route_id = $1
+				AND ($2::timestamp IS NULL OR created_at >= $2)
+				AND ($3::timestamp IS NULL OR created_at < $3)
+				AND NOT (created_at >= covered.lo AND created_at < covered.hi)
+		)
+		SELECT rolled.*, raw.* FROM rolled, raw
+	`, routeID, start, end).Scan(
+		&rolled.requests, &rolled.errors, &rolled.responseTime, &rolled.requestBytes, &rolled.responseBytes,
+		&rolled.p50, &rolled.p95, &rolled.p99,
+		&raw.requests, &raw.errors, &raw.responseTime, &raw.requestBytes, &raw.responseBytes,
+		&raw.p50, &raw.p95, &raw.p99,
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to total request stats")
+		return nil, err
+	}
+
+	rolled.add(raw)
+	traffic := rolled.traffic()
+	span.SetAttributes(attribute.Int64("logs.count", traffic.Requests))
+	span.SetStatus(codes.Ok, "request logs totalled")
+	return traffic, nil
+}
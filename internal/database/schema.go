@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+var (
+	// schemaTable finds the tables created by the schema
+	schemaTable = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS (\w+)`)
+	// schemaColumn finds the columns later versions added to them
+	schemaColumn = regexp.MustCompile(`ALTER TABLE (\w+) ADD COLUMN IF NOT EXISTS (\w+)`)
+)
+
+// CheckSchema compares the database's tables with the schema of this
+// version, without changing them. It returns the tables and table.column
+// pairs missing, which InitSchema adds when the gateway starts; none means
+// the schema is current.
+func (db *Database) CheckSchema(ctx context.Context) ([]string, error) {
+	rows, err := db.conn().Query(ctx, `
+		SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = current_schema()
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, fmt.Errorf("failed to read schema: %w", err)
+		}
+		existing[table] = true
+		existing[table+"."+column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+
+	var missing []string
+	for _, match := range schemaTable.FindAllStringSubmatch(schema, -1) {
+		if !existing[match[1]] {
+			missing = append(missing, match[1])
+		}
+	}
+	for _, match := range schemaColumn.FindAllStringSubmatch(schema, -1) {
+		// A missing table is reported once, not with each of its columns
+		if existing[match[1]] && !existing[match[1]+"."+match[2]] {
+			missing = append(missing, match[1]+"."+match[2])
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,349 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SnapshotPayload is the configuration captured by a snapshot
+type SnapshotPayload struct {
+	Routes []Route `json:"routes"`
+}
+
+// Snapshot is a copy of the gateway's configuration that can be restored
+type Snapshot struct {
+	ID         int              `json:"id"`
+	Actor      string           `json:"actor"`
+	Note       string           `json:"note"`
+	Automatic  bool             `json:"automatic"` // Taken by the gateway before a change, subject to retention
+	RouteCount int              `json:"route_count"`
+	Payload    *SnapshotPayload `json:"payload,omitempty"` // Left out of lists
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+// SnapshotRepository handles configuration snapshot database operations
+type SnapshotRepository struct {
+	db *Database
+	tx pgx.Tx
+}
+
+// NewSnapshotRepository creates a new snapshot repository
+func NewSnapshotRepository(db *Database) *SnapshotRepository {
+	return &SnapshotRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs its queries inside tx
+func (r *SnapshotRepository) WithTx(tx pgx.Tx) *SnapshotRepository {
+	return &SnapshotRepository{db: r.db, tx: tx}
+}
+
+// conn returns the transaction if one is bound, otherwise the pool
+func (r *SnapshotRepository) conn() Querier {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db.conn()
+}
+
+// Create captures every route into a new snapshot. Run it in a transaction
+// to capture the routes as of that transaction.
+func (r *SnapshotRepository) Create(ctx context.Context, snapshot *Snapshot) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.SnapshotRepository.Create",
+		trace.WithAttributes(attribute.Bool("snapshot.automatic", snapshot.Automatic)),
+	)
+	defer span.End()
+	defer r.db.timeQuery(span, "snapshot_create")()
+
+	routes, err := (&RouteRepository{db: r.db, tx: r.tx}).FindAll(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to read routes")
+		return err
+	}
+	snapshot.Payload = &SnapshotPayload{Routes: routes}
+	snapshot.RouteCount = len(routes)
+
+	query := `
+		INSERT INTO snapshots (actor, note, automatic, payload)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`
+
+	err = r.conn().QueryRow(
+		ctx,
+		query,
+		snapshot.Actor,
+		snapshot.Note,
+		snapshot.Automatic,
+		snapshot.Payload,
+	).Scan(&snapshot.ID, &snapshot.CreatedAt)
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to create snapshot")
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("snapshot.id", snapshot.ID), attribute.Int("snapshot.routes", snapshot.RouteCount))
+	span.SetStatus(codes.Ok, "snapshot created")
+	return nil
+}
+
+// FindAll retrieves snapshots without their payloads, newest first
+func (r *SnapshotRepository) FindAll(ctx context.Context, limit, offset int) ([]Snapshot, int, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.SnapshotRepository.FindAll",
+		trace.WithAttributes(
+			attribute.Int("query.limit", limit),
+			attribute.Int("query.offset", offset),
+		),
+	)
+	defer span.End()
+
+	var total int
+	if err := r.conn().QueryRow(ctx, `SELECT COUNT(*) FROM snapshots`).Scan(&total); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to count snapshots")
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, actor, note, automatic, jsonb_array_length(payload->'routes'), created_at
+		FROM snapshots
+		ORDER BY created_at DESC, id DESC
+		LIMIT $1 OFFSET $2
+	`
+
+	rows, err := r.conn().Query(ctx, query, limit, offset)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to query snapshots")
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	snapshots := make([]Snapshot, 0)
+	for rows.Next() {
+		var snapshot Snapshot
+		err := rows.Scan(
+			&snapshot.ID,
+			&snapshot.Actor,
+			&snapshot.Note,
+			&snapshot.Automatic,
+			&snapshot.RouteCount,
+			&snapshot.CreatedAt,
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to scan snapshot")
+			return nil, 0, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	span.SetAttributes(attribute.Int("snapshot.count", len(snapshots)))
+	span.SetStatus(codes.Ok, "snapshots retrieved")
+	return snapshots, total, rows.Err()
+}
+
+// FindByID retrieves a snapshot with its payload
+func (r *SnapshotRepository) FindByID(ctx context.Context, id int) (*Snapshot, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.SnapshotRepository.FindByID",
+		trace.WithAttributes(attribute.Int("snapshot.id", id)),
+	)
+	defer span.End()
+
+	query := `
+		SELECT id, actor, note, automatic, payload, created_at
+		FROM snapshots
+		WHERE id = $1
+	`
+
+	var snapshot Snapshot
+	err := r.conn().QueryRow(ctx, query, id).Scan(
+		&snapshot.ID,
+		&snapshot.Actor,
+		&snapshot.Note,
+		&snapshot.Automatic,
+		&snapshot.Payload,
+		&snapshot.CreatedAt,
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "snapshot not found")
+		return nil, err
+	}
+	snapshot.RouteCount = len(snapshot.Payload.Routes)
+
+	span.SetStatus(codes.Ok, "snapshot found")
+	return &snapshot, nil
+}
+
+// Prune deletes automatic snapshots beyond the newest keep. Snapshots taken
+// on request are kept.
+func (r *SnapshotRepository) Prune(ctx context.Context, keep int) (int64, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.SnapshotRepository.Prune",
+		trace.WithAttributes(attribute.Int("snapshot.keep", keep)),
+	)
+	defer span.End()
+
+	query := `
+		DELETE FROM snapshots
+		WHERE automatic AND id NOT IN (
+			SELECT id FROM snapshots WHERE automatic ORDER BY created_at DESC, id DESC LIMIT $1
+		)
+	`
+
+	cmdTag, err := r.conn().Exec(ctx, query, keep)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to prune snapshots")
+		return 0, err
+	}
+
+	span.SetAttributes(attribute.Int64("rows_affected", cmdTag.RowsAffected()))
+	span.SetStatus(codes.Ok, "snapshots pruned")
+	return cmdTag.RowsAffected(), nil
+}
+
+// Restore writes a route exactly as it was captured, keeping its ID and
+// timestamps. It replaces the route with the same ID or recreates it.
+func (r *RouteRepository) Restore(ctx context.Context, route *Route) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RouteRepository.Restore",
+		trace.WithAttributes(
+			attribute.Int("route.id", route.ID),
+			attribute.String("route.path", route.Path),
+		),
+	)
+	defer span.End()
+	defer r.db.timeQuery(span, "route_restore")()
+
+	query := `
+		INSERT INTO routes (id, path, target_url, method, enabled, rate_limit, timeout, ip_allow, ip_deny,
+			mirror_url, mirror_percent, canary_target_url, canary_weight, load_balanced, transform, tls, h2c,
+			maintenance_enabled, maintenance_status, maintenance_body, maintenance_content_type, maintenance_retry_after,
+			idempotent, hedge_delay, plugins, sensitive_headers, blue_green, max_concurrency, route_type, mock,
+			breaker_statuses, upstream_auth, upstream_rate_limit, upstream_burst, tenant_id, host, preserve_host, redirect, rewrite, country_allow, country_deny, dedup, preserve_path, passthrough_options, slo, breaker, egress, skip_security_headers, trust_deadline_max_ms, tags, metrics_tag, active_from, active_until, schedule, critical, catch_all, owner, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20,
+			$21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, NULLIF($35, ''), $36, $37, $38, $39, $40, $41, $42, $43, $44, $45, $46, $47, $48, $49, $50, $51, $52, $53, $54, $55, $56, $57, $58, $59)
+		ON CONFLICT (id) DO UPDATE
+		SET path = EXCLUDED.path, target_url = EXCLUDED.target_url, method = EXCLUDED.method,
+			enabled = EXCLUDED.enabled, rate_limit = EXCLUDED.rate_limit, timeout = EXCLUDED.timeout,
+			ip_allow = EXCLUDED.ip_allow, ip_deny = EXCLUDED.ip_deny, mirror_url = EXCLUDED.mirror_url,
+			mirror_percent = EXCLUDED.mirror_percent, canary_target_url = EXCLUDED.canary_target_url,
+			canary_weight = EXCLUDED.canary_weight, load_balanced = EXCLUDED.load_balanced,
+			transform = EXCLUDED.transform, tls = EXCLUDED.tls, h2c = EXCLUDED.h2c,
+			maintenance_enabled = EXCLUDED.maintenance_enabled, maintenance_status = EXCLUDED.maintenance_status,
+			maintenance_body = EXCLUDED.maintenance_body, maintenance_content_type = EXCLUDED.maintenance_content_type,
+			maintenance_retry_after = EXCLUDED.maintenance_retry_after, idempotent = EXCLUDED.idempotent,
+			hedge_delay = EXCLUDED.hedge_delay, plugins = EXCLUDED.plugins,
+			sensitive_headers = EXCLUDED.sensitive_headers, blue_green = EXCLUDED.blue_green,
+			max_concurrency = EXCLUDED.max_concurrency, route_type = EXCLUDED.route_type,
+			mock = EXCLUDED.mock, breaker_statuses = EXCLUDED.breaker_statuses,
+			upstream_auth = EXCLUDED.upstream_auth, upstream_rate_limit = EXCLUDED.upstream_rate_limit,
+			upstream_burst = EXCLUDED.upstream_burst, tenant_id = EXCLUDED.tenant_id,
+			host = EXCLUDED.host, preserve_host = EXCLUDED.preserve_host,
+			redirect = EXCLUDED.redirect, rewrite = EXCLUDED.rewrite,
+			country_allow = EXCLUDED.country_allow, country_deny = EXCLUDED.country_deny,
+			dedup = EXCLUDED.dedup, preserve_path = EXCLUDED.preserve_path,
+			passthrough_options = EXCLUDED.passthrough_options, slo = EXCLUDED.slo,
+			breaker = EXCLUDED.breaker, egress = EXCLUDED.egress,
+			skip_security_headers = EXCLUDED.skip_security_headers,
+			trust_deadline_max_ms = EXCLUDED.trust_deadline_max_ms,
+			tags = EXCLUDED.tags, metrics_tag = EXCLUDED.metrics_tag,
+			active_from = EXCLUDED.active_from, active_until = EXCLUDED.active_until, schedule = EXCLUDED.schedule,
+			critical = EXCLUDED.critical, catch_all = EXCLUDED.catch_all, owner = EXCLUDED.owner,
+			created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at
+	`
+
+	route.normalize()
+	_, err := r.conn().Exec(
+		ctx,
+		query,
+		route.ID,
+		route.Path,
+		route.TargetURL,
+		route.Method,
+		route.Enabled,
+		route.RateLimit,
+		route.Timeout,
+		route.IPAllow,
+		route.IPDeny,
+		route.MirrorURL,
+		route.MirrorPercent,
+		route.CanaryURL,
+		route.CanaryWeight,
+		route.LoadBalanced,
+		route.Transform,
+		route.TLS,
+		route.H2C,
+		route.MaintenanceEnabled,
+		route.MaintenanceStatus,
+		route.MaintenanceBody,
+		route.MaintenanceContentType,
+		route.MaintenanceRetryAfter,
+		route.Idempotent,
+		route.HedgeDelay,
+		route.Plugins,
+		route.SensitiveHeaders,
+		route.BlueGreen,
+		route.MaxConcurrency,
+		route.Type,
+		route.Mock,
+		route.BreakerStatuses,
+		route.UpstreamAuth,
+		route.UpstreamRateLimit,
+		route.UpstreamBurst,
+		route.TenantID,
+		route.Host,
+		route.PreserveHost,
+		route.Redirect,
+		route.Rewrite,
+		route.CountryAllow,
+		route.CountryDeny,
+		route.Dedup,
+		route.PreservePath,
+		route.PassthroughOptions,
+		route.SLO,
+		route.Breaker,
+		route.Egress,
+		route.SkipSecurityHeaders,
+		route.TrustDeadlineMax,
+		route.Tags,
+		route.MetricsTag,
+		route.ActiveFrom,
+		route.ActiveUntil,
+		route.Schedule,
+		route.Critical,
+		route.CatchAll,
+		route.Owner,
+		route.CreatedAt,
+		route.UpdatedAt,
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to restore route")
+		return err
+	}
+
+	// Keep new routes from being given a restored route's ID
+	_, err = r.conn().Exec(ctx, `SELECT setval(pg_get_serial_sequence('routes', 'id'), GREATEST((SELECT MAX(id) FROM routes), 1))`)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to advance route IDs")
+		return err
+	}
+
+	span.SetStatus(codes.Ok, "route restored")
+	return nil
+}
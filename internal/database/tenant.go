@@ -0,0 +1,135 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tenant owns a set of routes and users. Its rate limit, when set, applies
+// to its users and API keys that have no tier of their own.
+type Tenant struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	RateLimit int       `json:"rate_limit"` // Requests per second, 0 for the gateway default
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TenantRepository handles tenant database operations
+type TenantRepository struct {
+	db *Database
+}
+
+// NewTenantRepository creates a new tenant repository
+func NewTenantRepository(db *Database) *TenantRepository {
+	return &TenantRepository{db: db}
+}
+
+const tenantColumns = `id, name, rate_limit, created_at, updated_at`
+
+// FindAll retrieves all tenants
+func (r *TenantRepository) FindAll(ctx context.Context) ([]Tenant, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.TenantRepository.FindAll")
+	defer span.End()
+
+	rows, err := r.db.conn().Query(ctx, `SELECT `+tenantColumns+` FROM tenants ORDER BY id`)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "query failed")
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := make([]Tenant, 0)
+	for rows.Next() {
+		var tenant Tenant
+		if err := rows.Scan(&tenant.ID, &tenant.Name, &tenant.RateLimit, &tenant.CreatedAt, &tenant.UpdatedAt); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "scan failed")
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+
+	span.SetAttributes(attribute.Int("tenants.count", len(tenants)))
+	span.SetStatus(codes.Ok, "tenants retrieved")
+	return tenants, rows.Err()
+}
+
+// FindByID retrieves a tenant by ID
+func (r *TenantRepository) FindByID(ctx context.Context, id string) (*Tenant, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.TenantRepository.FindByID",
+		trace.WithAttributes(attribute.String("tenant.id", id)),
+	)
+	defer span.End()
+
+	var tenant Tenant
+	err := r.db.conn().QueryRow(ctx, `SELECT `+tenantColumns+` FROM tenants WHERE id = $1`, id).
+		Scan(&tenant.ID, &tenant.Name, &tenant.RateLimit, &tenant.CreatedAt, &tenant.UpdatedAt)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "tenant not found")
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, "tenant found")
+	return &tenant, nil
+}
+
+// Upsert creates the tenant or replaces the one with the same ID
+func (r *TenantRepository) Upsert(ctx context.Context, tenant *Tenant) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.TenantRepository.Upsert",
+		trace.WithAttributes(attribute.String("tenant.id", tenant.ID)),
+	)
+	defer span.End()
+
+	query := `
+		INSERT INTO tenants (id, name, rate_limit)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE
+		SET name = EXCLUDED.name, rate_limit = EXCLUDED.rate_limit, updated_at = NOW()
+		RETURNING created_at, updated_at
+	`
+
+	err := r.db.conn().QueryRow(ctx, query, tenant.ID, tenant.Name, tenant.RateLimit).
+		Scan(&tenant.CreatedAt, &tenant.UpdatedAt)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to save tenant")
+		return err
+	}
+
+	span.SetStatus(codes.Ok, "tenant saved")
+	return nil
+}
+
+// Delete deletes a tenant. It fails while routes or users still belong to it.
+func (r *TenantRepository) Delete(ctx context.Context, id string) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.TenantRepository.Delete",
+		trace.WithAttributes(attribute.String("tenant.id", id)),
+	)
+	defer span.End()
+
+	cmdTag, err := r.db.conn().Exec(ctx, `DELETE FROM tenants WHERE id = $1`, id)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to delete tenant")
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		span.SetStatus(codes.Error, "tenant not found")
+		return pgx.ErrNoRows
+	}
+
+	span.SetStatus(codes.Ok, "tenant deleted")
+	return nil
+}
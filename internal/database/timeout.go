@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// minQueryTimeout is the shortest per-operation timeout, so a tiny
+// DB_QUERY_TIMEOUT doesn't fail every query
+const minQueryTimeout = 100 * time.Millisecond
+
+// ErrQueryTimeout is returned when an operation runs past DB_QUERY_TIMEOUT
+var ErrQueryTimeout = errors.New("database query timed out")
+
+// ErrCanceled is returned when the request an operation ran for was
+// cancelled, because its client went away or it timed out, rather than the
+// database failing. It wraps context.Canceled.
+var ErrCanceled = fmt.Errorf("database query canceled with its request: %w", context.Canceled)
+
+// Reasons a query failed, as labelled in isekai_database_query_errors_total
+const (
+	QueryErrorCanceled = "canceled"
+	QueryErrorTimeout  = "timeout"
+	QueryErrorFailed   = "error"
+)
+
+// IsCanceled reports whether err comes from the caller's context being
+// cancelled rather than from the database
+func IsCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) && !errors.Is(err, ErrQueryTimeout)
+}
+
+// queryTimeout returns the time each repository operation may take
+func (db *Database) queryTimeout() time.Duration {
+	return max(db.cfg.QueryTimeout, minQueryTimeout)
+}
+
+// queryError classifies err from an operation run under qctx, derived from
+// the caller's ctx, and counts it
+func (db *Database) queryError(ctx, qctx context.Context, err error) error {
+	if err == nil || errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	reason := QueryErrorFailed
+	switch {
+	case ctx.Err() != nil:
+		reason, err = QueryErrorCanceled, fmt.Errorf("%w: %w", ErrCanceled, err)
+	case errors.Is(qctx.Err(), context.DeadlineExceeded):
+		reason, err = QueryErrorTimeout, fmt.Errorf("%w after %s: %w", ErrQueryTimeout, db.queryTimeout(), err)
+	}
+	if db.metrics != nil {
+		db.metrics.DatabaseQueryErrors.WithLabelValues(reason).Inc()
+	}
+	return err
+}
+
+// timedQuerier runs each query with a deadline, its rows holding it until
+// they are closed
+type timedQuerier struct {
+	q        Querier
+	db       *Database
+	deadline func(ctx context.Context) (context.Context, context.CancelFunc)
+}
+
+// timed wraps q so each query is bounded by DB_QUERY_TIMEOUT
+func (db *Database) timed(q Querier) Querier {
+	return timedQuerier{q: q, db: db, deadline: func(ctx context.Context) (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, db.queryTimeout())
+	}}
+}
+
+func (t timedQuerier) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	qctx, cancel := t.deadline(ctx)
+	defer cancel()
+
+	tag, err := t.q.Exec(qctx, sql, args...)
+	return tag, t.db.queryError(ctx, qctx, err)
+}
+
+func (t timedQuerier) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	qctx, cancel := t.deadline(ctx)
+	rows, err := t.q.Query(qctx, sql, args...)
+	if err != nil {
+		cancel()
+		return nil, t.db.queryError(ctx, qctx, err)
+	}
+	return &timedRows{Rows: rows, ctx: ctx, qctx: qctx, cancel: cancel, db: t.db}, nil
+}
+
+func (t timedQuerier) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	qctx, cancel := t.deadline(ctx)
+	return &timedRow{row: t.q.QueryRow(qctx, sql, args...), ctx: ctx, qctx: qctx, cancel: cancel, db: t.db}
+}
+
+// timedRows releases the query's deadline when closed
+type timedRows struct {
+	pgx.Rows
+	ctx, qctx context.Context
+	cancel    context.CancelFunc
+	db        *Database
+}
+
+func (r *timedRows) Close() {
+	r.Rows.Close()
+	r.cancel()
+}
+
+func (r *timedRows) Err() error {
+	return r.db.queryError(r.ctx, r.qctx, r.Rows.Err())
+}
+
+// timedRow releases the query's deadline once scanned
+type timedRow struct {
+	row       pgx.Row
+	ctx, qctx context.Context
+	cancel    context.CancelFunc
+	db        *Database
+}
+
+func (r *timedRow) Scan(dest ...any) error {
+	defer r.cancel()
+	return r.db.queryError(r.ctx, r.qctx, r.row.Scan(dest...))
+}
+
+// timedTx bounds every statement of a transaction by the deadline of the
+// whole transaction
+type timedTx struct {
+	pgx.Tx
+	timedQuerier
+}
+
+func (t timedTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return t.timedQuerier.Exec(ctx, sql, args...)
+}
+
+func (t timedTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return t.timedQuerier.Query(ctx, sql, args...)
+}
+
+func (t timedTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return t.timedQuerier.QueryRow(ctx, sql, args...)
+}
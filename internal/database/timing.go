@@ -0,0 +1,31 @@
+package database
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// timeQuery starts timing a query and marks the span as a Postgres call. The
+// returned function records the elapsed time on the span and in the query duration histogram, and logs the query
+// when it exceeds the slow query threshold. Use it as
+//
+//	defer r.db.timeQuery(span, "route_find_all")()
+func (db *Database) timeQuery(span trace.Span, name string) func() {
+	span.SetAttributes(semconv.DBSystemNamePostgreSQL)
+	start := time.Now()
+
+	return func() {
+		elapsed := time.Since(start)
+
+		span.SetAttributes(attribute.Float64("db.duration_ms", float64(elapsed)/float64(time.Millisecond)))
+		if db.metrics != nil {
+			db.metrics.DatabaseQueries.WithLabelValues(name).Observe(elapsed.Seconds())
+		}
+		if threshold := db.cfg.SlowQueryThreshold; threshold > 0 && elapsed >= threshold {
+			db.log.Warnf("Slow query %s took %s", name, elapsed)
+		}
+	}
+}
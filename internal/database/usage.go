@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Usage report groupings
+const (
+	UsageByOwner  = "owner"
+	UsageByTag    = "tag"
+	UsageByTenant = "tenant"
+)
+
+// ErrUsageGroup is returned for groupings other than owner, tag and tenant
+var ErrUsageGroup = errors.New("group_by must be owner, tag or tenant")
+
+// usageGroups are the rollups joined with their routes, with the key each
+// grouping totals them by. A route counts towards each of its tags.
+var usageGroups = map[string]string{
+	UsageByOwner:  `SELECT routes.owner AS key, request_stats.* FROM request_stats JOIN routes ON routes.id = request_stats.route_id`,
+	UsageByTenant: `SELECT COALESCE(routes.tenant_id, '') AS key, request_stats.* FROM request_stats JOIN routes ON routes.id = request_stats.route_id`,
+	UsageByTag: `SELECT COALESCE(route_tag, '') AS key, request_stats.* FROM request_stats JOIN routes ON routes.id = request_stats.route_id
+		LEFT JOIN LATERAL unnest(routes.tags) AS route_tag ON true`,
+}
+
+// UsageRow is the usage of one owner, tag or tenant
+type UsageRow struct {
+	Key           string  `json:"key"` // Owner, tag or tenant ID, empty for routes without one
+	Routes        int     `json:"routes"`
+	Requests      int64   `json:"requests"`
+	Errors        int64   `json:"errors"` // Requests answered with a 5xx status
+	RequestBytes  int64   `json:"request_bytes"`
+	ResponseBytes int64   `json:"response_bytes"`
+	TotalBytes    int64   `json:"total_bytes"`
+	P95           float64 `json:"p95_response_time"` // Milliseconds, the hours' p95 weighted by their requests
+}
+
+// UsageReport totals a month of hourly rollups by owner, tag or tenant
+type UsageReport struct {
+	GroupBy     string     `json:"group_by"`
+	Month       string     `json:"month"` // 2006-01
+	From        time.Time  `json:"from"`
+	To          time.Time  `json:"to"`           // End of the hours covered: the month's end, or the last rolled up hour before it
+	RolledUntil *time.Time `json:"rolled_until"` // End of the last hour rolled up, nil before the first rollup
+	Complete    bool       `json:"complete"`     // Whether every hour of the month was rolled up
+	Rows        []UsageRow `json:"rows"`
+}
+
+// UsageByMonth totals the hourly rollups of the month starting at month by
+// groupBy, one of UsageByOwner, UsageByTag or UsageByTenant. Hours not rolled
+// up yet, such as the rest of the current month, are left out, and the
+// report's To states where it stops.
+func (r *RequestLogRepository) UsageByMonth(ctx context.Context, groupBy string, month time.Time) (*UsageReport, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.RequestLogRepository.UsageByMonth",
+		trace.WithAttributes(
+			attribute.String("usage.group_by", groupBy),
+			attribute.String("usage.month", month.Format("2006-01")),
+		),
+	)
+	defer span.End()
+	defer r.db.timeQuery(span, "request_stats_usage")()
+
+	groups, ok := usageGroups[groupBy]
+	if !ok {
+		return nil, ErrUsageGroup
+	}
+
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	report := &UsageReport{
+		GroupBy: groupBy,
+		Month:   from.Format("2006-01"),
+		From:    from,
+		To:      from.AddDate(0, 1, 0),
+		Rows:    []UsageRow{},
+	}
+
+	err := r.db.conn().QueryRow(ctx, `SELECT rolled_until FROM request_stats_state WHERE name = 'hourly'`).Scan(&report.RolledUntil)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to read rollup state")
+		return nil, err
+	}
+	// Stop at the last rolled up hour, covering nothing of a month after it
+	switch {
+	case report.RolledUntil == nil:
+		report.To = from
+	case report.RolledUntil.Before(report.To):
+		report.To = *report.RolledUntil
+	}
+	if report.To.Before(from) {
+		report.To = from
+	}
+	report.Complete = report.To.Equal(from.AddDate(0, 1, 0))
+
+	rows, err := r.db.conn().Query(ctx, `
+		SELECT key, COUNT(DISTINCT route_id), SUM(requests), SUM(errors), SUM(request_bytes), SUM(response_bytes),
+			COALESCE(SUM(p95 * requests) / NULLIF(SUM(requests), 0), 0)
+		FROM (`+groups+`
+			WHERE hour >= $1 AND hour < $2) AS grouped
+		GROUP BY key
+		ORDER BY key
+	`, report.From, report.To)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to total usage")
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row UsageRow
+		if err := rows.Scan(&row.Key, &row.Routes, &row.Requests, &row.Errors, &row.RequestBytes, &row.ResponseBytes, &row.P95); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to scan usage")
+			return nil, err
+		}
+		row.TotalBytes = row.RequestBytes + row.ResponseBytes
+		report.Rows = append(report.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to read usage")
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("usage.rows", len(report.Rows)), attribute.Bool("usage.complete", report.Complete))
+	span.SetStatus(codes.Ok, "usage totalled")
+	return report, nil
+}
@@ -0,0 +1,260 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RoleAdmin is the role allowed to manage the gateway
+const RoleAdmin = "admin"
+
+// User represents a gateway account. The password hash is never serialized.
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	Roles        []string  `json:"roles"`
+	Enabled      bool      `json:"enabled"`
+	TenantID     string    `json:"tenant_id"` // Tenant whose routes the user manages, empty for gateway-wide accounts
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// IsAdmin reports whether the user is an enabled admin
+func (u *User) IsAdmin() bool {
+	if !u.Enabled {
+		return false
+	}
+	for _, role := range u.Roles {
+		if role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// UserRepository handles user database operations
+type UserRepository struct {
+	db *Database
+	tx pgx.Tx
+}
+
+// NewUserRepository creates a new user repository
+func NewUserRepository(db *Database) *UserRepository {
+	return &UserRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs its queries inside tx
+func (r *UserRepository) WithTx(tx pgx.Tx) *UserRepository {
+	return &UserRepository{db: r.db, tx: tx}
+}
+
+// conn returns the transaction if one is bound, otherwise the pool
+func (r *UserRepository) conn() Querier {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db.conn()
+}
+
+const userColumns = `id, username, password_hash, roles, enabled, COALESCE(tenant_id, ''), created_at, updated_at`
+
+// scanUser scans a row selected with userColumns
+func scanUser(row pgx.Row) (*User, error) {
+	var user User
+	err := row.Scan(
+		&user.ID,
+		&user.Username,
+		&user.PasswordHash,
+		&user.Roles,
+		&user.Enabled,
+		&user.TenantID,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// FindAll retrieves all users
+func (r *UserRepository) FindAll(ctx context.Context) ([]User, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.UserRepository.FindAll")
+	defer span.End()
+
+	rows, err := r.conn().Query(ctx, `SELECT `+userColumns+` FROM users ORDER BY id`)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "query failed")
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]User, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "scan failed")
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+
+	span.SetAttributes(attribute.Int("users.count", len(users)))
+	span.SetStatus(codes.Ok, "users retrieved")
+	return users, rows.Err()
+}
+
+// FindByID retrieves a user by ID
+func (r *UserRepository) FindByID(ctx context.Context, id int) (*User, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.UserRepository.FindByID",
+		trace.WithAttributes(attribute.Int("user.id", id)),
+	)
+	defer span.End()
+
+	user, err := scanUser(r.conn().QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "user not found")
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, "user found")
+	return user, nil
+}
+
+// FindByUsername retrieves a user by username
+func (r *UserRepository) FindByUsername(ctx context.Context, username string) (*User, error) {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.UserRepository.FindByUsername",
+		trace.WithAttributes(attribute.String("user.username", username)),
+	)
+	defer span.End()
+
+	user, err := scanUser(r.conn().QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE username = $1`, username))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "user not found")
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, "user found")
+	return user, nil
+}
+
+// Count returns the number of users
+func (r *UserRepository) Count(ctx context.Context) (int, error) {
+	var count int
+	err := r.conn().QueryRow(ctx, `SELECT COUNT(*) FROM users`).Scan(&count)
+	return count, err
+}
+
+// LockAdmins locks the enabled admin accounts for the rest of the transaction
+// and returns how many there are, so concurrent demotions can't remove the last one
+func (r *UserRepository) LockAdmins(ctx context.Context) (int, error) {
+	rows, err := r.conn().Query(ctx, `SELECT id FROM users WHERE enabled AND $1 = ANY(roles) FOR UPDATE`, RoleAdmin)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	return count, rows.Err()
+}
+
+// Create creates a new user
+func (r *UserRepository) Create(ctx context.Context, user *User) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.UserRepository.Create",
+		trace.WithAttributes(attribute.String("user.username", user.Username)),
+	)
+	defer span.End()
+
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+
+	query := `
+		INSERT INTO users (username, password_hash, roles, enabled, tenant_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		RETURNING id, created_at, updated_at
+	`
+
+	err := r.conn().QueryRow(ctx, query, user.Username, user.PasswordHash, user.Roles, user.Enabled, user.TenantID).
+		Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to create user")
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("user.id", user.ID))
+	span.SetStatus(codes.Ok, "user created")
+	return nil
+}
+
+// Update updates a user's username, roles, enabled flag, tenant and password hash
+func (r *UserRepository) Update(ctx context.Context, user *User) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.UserRepository.Update",
+		trace.WithAttributes(attribute.Int("user.id", user.ID)),
+	)
+	defer span.End()
+
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+
+	query := `
+		UPDATE users
+		SET username = $1, password_hash = $2, roles = $3, enabled = $4, tenant_id = NULLIF($5, ''), updated_at = NOW()
+		WHERE id = $6
+		RETURNING updated_at
+	`
+
+	err := r.conn().QueryRow(ctx, query, user.Username, user.PasswordHash, user.Roles, user.Enabled, user.TenantID, user.ID).
+		Scan(&user.UpdatedAt)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to update user")
+		return err
+	}
+
+	span.SetStatus(codes.Ok, "user updated")
+	return nil
+}
+
+// Delete deletes a user
+func (r *UserRepository) Delete(ctx context.Context, id int) error {
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "repository.UserRepository.Delete",
+		trace.WithAttributes(attribute.Int("user.id", id)),
+	)
+	defer span.End()
+
+	cmdTag, err := r.conn().Exec(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to delete user")
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		span.SetStatus(codes.Error, "user not found")
+		return pgx.ErrNoRows
+	}
+
+	span.SetStatus(codes.Ok, "user deleted")
+	return nil
+}
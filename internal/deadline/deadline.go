@@ -0,0 +1,97 @@
+package deadline
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GRPCHeader carries a gRPC call's timeout
+const GRPCHeader = "Grpc-Timeout"
+
+// grpcUnits are the grpc-timeout units, finest first
+var grpcUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// grpcMaxValue is the largest grpc-timeout value, which has at most 8 digits
+const grpcMaxValue = 99999999
+
+// IsGRPC reports whether h declares a gRPC request
+func IsGRPC(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "application/grpc")
+}
+
+// ParseMillis parses a budget in whole milliseconds
+func ParseMillis(value string) (time.Duration, bool) {
+	ms, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || ms < 0 || ms > int64(time.Duration(1<<63-1)/time.Millisecond) {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// FormatMillis formats d as whole milliseconds, rounded down
+func FormatMillis(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
+
+// ParseGRPC parses a grpc-timeout value, up to 8 digits followed by a unit
+func ParseGRPC(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	for _, u := range grpcUnits {
+		if u.unit == value[len(value)-1] {
+			return time.Duration(n) * u.d, true
+		}
+	}
+	return 0, false
+}
+
+// FormatGRPC formats d as a grpc-timeout value in the finest unit that fits
+// in 8 digits, rounded up so a budget left is never sent as none
+func FormatGRPC(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	for _, u := range grpcUnits {
+		if n := (d + u.d - 1) / u.d; n <= grpcMaxValue {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+	return strconv.Itoa(grpcMaxValue) + "H"
+}
+
+// FromRequest returns the budget the client gave a request in header, in
+// milliseconds, or in grpc-timeout when grpc is set and it is a gRPC
+// request. When both are present the smaller one wins; ok is false when
+// neither is or they don't parse.
+func FromRequest(h http.Header, header string, grpc bool) (budget time.Duration, ok bool) {
+	if header != "" {
+		if value := h.Get(header); value != "" {
+			budget, ok = ParseMillis(value)
+		}
+	}
+	if grpc && IsGRPC(h) {
+		if value := h.Get(GRPCHeader); value != "" {
+			if d, parsed := ParseGRPC(value); parsed && (!ok || d < budget) {
+				budget, ok = d, true
+			}
+		}
+	}
+	return budget, ok
+}
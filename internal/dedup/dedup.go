@@ -0,0 +1,206 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/idempotency"
+)
+
+// DuplicateHeader marks responses answered to a repeated delivery
+const DuplicateHeader = "Duplicate-Delivery"
+
+// MaxWindow is the longest time a route may remember event IDs
+const MaxWindow = 7 * 24 * 60 * 60
+
+// Answers to a duplicate delivery
+const (
+	OnDuplicateReplay = "replay" // The response to the first delivery
+	OnDuplicateOK     = "ok"     // A fixed 200
+)
+
+// Results recorded for requests on routes with deduplication
+const (
+	ResultFirst     = "first"
+	ResultDuplicate = "duplicate"
+	ResultNoID      = "no_id"
+)
+
+// Config is a route's deduplication of repeated deliveries, such as webhooks
+// a provider sends again. The event ID comes from a header or a JSON body.
+type Config struct {
+	Header      string `json:"header,omitempty"`       // Header carrying the event ID
+	BodyPath    string `json:"body_path,omitempty"`    // Dotted path of the event ID in a JSON body, such as "data.id"
+	Window      int    `json:"window"`                 // Seconds an event ID is remembered
+	OnDuplicate string `json:"on_duplicate,omitempty"` // replay (the default) or ok
+}
+
+// Validate checks that the config has one ID source and a window within
+// MaxWindow
+func (c *Config) Validate() error {
+	if (c.Header == "") == (c.BodyPath == "") {
+		return errors.New("dedup needs exactly one of header and body_path")
+	}
+	if c.BodyPath != "" && (strings.HasPrefix(c.BodyPath, ".") || strings.HasSuffix(c.BodyPath, ".") || strings.Contains(c.BodyPath, "..")) {
+		return fmt.Errorf("invalid dedup body_path %q", c.BodyPath)
+	}
+	if c.Window <= 0 || c.Window > MaxWindow {
+		return fmt.Errorf("dedup window must be between 1 and %d seconds", MaxWindow)
+	}
+	switch c.OnDuplicate {
+	case "", OnDuplicateReplay, OnDuplicateOK:
+		return nil
+	}
+	return errors.New("dedup on_duplicate must be replay or ok")
+}
+
+// Replays reports whether duplicates get the first delivery's response
+func (c *Config) Replays() bool {
+	return c.OnDuplicate != OnDuplicateOK
+}
+
+// seen is a delivered event ID, with the response to replay when there is one
+type seen struct {
+	resp *idempotency.Response
+}
+
+// Store remembers delivered event IDs in the cache and makes deliveries
+// arriving while the same event is in flight wait for it
+type Store struct {
+	cache    *cache.Cache
+	maxBody  int64
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+// New creates a store keeping event IDs in c. maxBody caps both the request
+// bodies read for an ID and the responses kept for replay.
+func New(c *cache.Cache, maxBody int64) *Store {
+	return &Store{cache: c, maxBody: maxBody, inflight: make(map[string]chan struct{})}
+}
+
+// EventID returns the event ID of r, or false when it has none. Reading an ID
+// from the body buffers it, leaving it readable for the upstream; bodies over
+// the size cap have no ID.
+func (s *Store) EventID(r *http.Request, c *Config) (string, bool) {
+	if c.Header != "" {
+		id := r.Header.Get(c.Header)
+		return id, id != ""
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", false
+	}
+
+	original := r.Body
+	buf, err := io.ReadAll(io.LimitReader(original, s.maxBody+1))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), original), original}
+	if err != nil || int64(len(buf)) > s.maxBody {
+		return "", false
+	}
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return lookup(buf, c.BodyPath)
+}
+
+// lookup returns the string or number at a dotted path of a JSON object
+func lookup(body []byte, path string) (string, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return "", false
+	}
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		v = obj[key]
+	}
+
+	switch id := v.(type) {
+	case string:
+		return id, id != ""
+	case json.Number:
+		return id.String(), true
+	}
+	return "", false
+}
+
+// Key returns the cache key of an event delivered to a route
+func Key(routeID int, id string) string {
+	return fmt.Sprintf("dedup:%d:%s", routeID, id)
+}
+
+// Acquire reports whether the event under key was delivered within the
+// window, with the response to replay when one was kept, first waiting for a
+// delivery of the event still in flight. When it wasn't delivered it reserves
+// the key; the caller must then call Release.
+func (s *Store) Acquire(ctx context.Context, key string) (bool, *idempotency.Response, error) {
+	for {
+		s.mu.Lock()
+		if cached, ok := s.cache.Get(key); ok {
+			s.mu.Unlock()
+			return true, cached.(*seen).resp, nil
+		}
+
+		done, ok := s.inflight[key]
+		if !ok {
+			s.inflight[key] = make(chan struct{})
+			s.mu.Unlock()
+			return false, nil, nil
+		}
+		s.mu.Unlock()
+
+		// A delivery that failed lets the next one through
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return false, nil, ctx.Err()
+		}
+	}
+}
+
+// Release remembers the event under key for window when its delivery
+// succeeded, with the response from rec when c replays it, and wakes the
+// deliveries waiting for it. Deliveries answered with 5xx or not at all are
+// forgotten so the provider's retry gets through.
+func (s *Store) Release(key string, c *Config, rec *idempotency.Recorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	done, ok := s.inflight[key]
+	if !ok {
+		return
+	}
+	if status := rec.Status(); status != 0 && status < http.StatusInternalServerError {
+		entry := &seen{}
+		if c.Replays() {
+			entry.resp = rec.Response()
+		}
+		s.cache.SetWithTTL(key, entry, time.Duration(c.Window)*time.Second)
+	}
+	delete(s.inflight, key)
+	close(done)
+}
+
+// Recorder wraps w to record the response to a first delivery
+func (s *Store) Recorder(w http.ResponseWriter) *idempotency.Recorder {
+	return idempotency.Record(w, s.maxBody)
+}
+
+// readCloser reads from a buffered copy but closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
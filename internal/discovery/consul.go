@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Consul resolves a service through the Consul health API, skipping
+// instances with any check that isn't passing
+type Consul struct {
+	Address string // Consul HTTP API, e.g. http://127.0.0.1:8500
+	Service string
+	Token   string // Sent as X-Consul-Token when set
+	Scheme  string // Scheme of the backend URLs
+	Client  *http.Client
+}
+
+// consulEntry is an instance in a /v1/health/service response
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+// Source returns "consul:" followed by the service name
+func (c *Consul) Source() string {
+	return "consul:" + c.Service
+}
+
+// Resolve returns the URLs of the service's passing instances
+func (c *Consul) Resolve(ctx context.Context) ([]string, error) {
+	endpoint := strings.TrimRight(c.Address, "/") + "/v1/health/service/" + url.PathEscape(c.Service)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid consul response: %w", err)
+	}
+
+	urls := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.passing() {
+			continue
+		}
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		urls = append(urls, c.Scheme+"://"+net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	return urls, nil
+}
+
+// passing reports whether all of the instance's checks pass
+func (e *consulEntry) passing() bool {
+	for _, check := range e.Checks {
+		if check.Status != "passing" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,228 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/schedule"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// Provider resolves a service to the URLs of its healthy instances
+type Provider interface {
+	// Source describes where the instances come from, e.g. "consul:orders"
+	Source() string
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+// Watcher is a provider that notices changes as they happen. Watch calls
+// changed once the provider is ready and after every change, until ctx is
+// done.
+type Watcher interface {
+	Watch(ctx context.Context, changed func())
+}
+
+// ServiceStatus is a watched service and its endpoint counts
+type ServiceStatus struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Ready     int    `json:"ready"`
+	NotReady  int    `json:"not_ready"`
+}
+
+// ServiceReporter is a provider that reports the services it watches
+type ServiceReporter interface {
+	Services() []ServiceStatus
+}
+
+// NewProvider creates the provider selected by cfg.Type
+func NewProvider(cfg *config.DiscoveryConfig, log *logger.Logger) (Provider, error) {
+	switch cfg.Type {
+	case "consul":
+		return &Consul{
+			Address: cfg.ConsulAddress,
+			Service: cfg.Service,
+			Token:   cfg.ConsulToken,
+			Scheme:  cfg.Scheme,
+		}, nil
+	case "dns":
+		dns := &DNS{Name: cfg.Service, Scheme: cfg.Scheme}
+		if cfg.DNSServer != "" {
+			dns.Resolver = &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, cfg.DNSServer)
+				},
+			}
+		}
+		return dns, nil
+	case "kubernetes":
+		return newKubernetes(cfg, log)
+	default:
+		return nil, fmt.Errorf("unknown discovery type %q", cfg.Type)
+	}
+}
+
+// Status describes the discovery for the load balancer status
+type Status struct {
+	Source    string          `json:"source"`
+	Backends  []string        `json:"backends"`            // The instances currently added to the pool
+	Services  []ServiceStatus `json:"services,omitempty"`  // Set by providers watching services
+	LastSync  *time.Time      `json:"last_sync,omitempty"` // Last successful resolution
+	LastError string          `json:"last_error,omitempty"`
+}
+
+// Discovery keeps the load balancer's backends in line with a provider. It
+// only adds and removes the backends it discovered, leaving configured ones
+// alone, and keeps the last known instances when resolution fails. Removed
+// backends are drained rather than dropped.
+type Discovery struct {
+	provider     Provider
+	lb           *loadbalancer.LoadBalancer
+	interval     time.Duration
+	schedule     *schedule.Schedule
+	drainTimeout time.Duration
+	log          *logger.Logger
+
+	mu        sync.Mutex
+	managed   map[string]bool
+	lastSync  time.Time
+	lastError string
+}
+
+// New creates a discovery resolving provider about every interval, jittered
+// so gateways started together don't resolve in lockstep and backing off
+// while resolution fails. Removed backends get up to drainTimeout to finish
+// their requests.
+func New(provider Provider, lb *loadbalancer.LoadBalancer, interval, drainTimeout time.Duration, log *logger.Logger) *Discovery {
+	return &Discovery{
+		provider: provider,
+		lb:       lb,
+		interval: interval,
+		schedule: schedule.New(schedule.Policy{
+			Interval:    interval,
+			Jitter:      0.1,
+			Multiplier:  2,
+			MaxInterval: 2 * interval,
+		}, nil),
+		drainTimeout: drainTimeout,
+		log:          log,
+		managed:      make(map[string]bool),
+	}
+}
+
+// Run syncs right away and then on the schedule until ctx is done. Watchers
+// are also synced whenever they report a change, starting once they're ready.
+func (d *Discovery) Run(ctx context.Context) {
+	changed := make(chan struct{}, 1)
+	if w, ok := d.provider.(Watcher); ok {
+		go w.Watch(ctx, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	} else {
+		d.schedule.Report(d.Sync(ctx))
+	}
+
+	next := d.schedule.After()
+	for {
+		select {
+		case <-changed:
+			d.schedule.Report(d.Sync(ctx))
+		case <-next:
+			d.schedule.Report(d.Sync(ctx))
+			next = d.schedule.After()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Schedule returns the schedule of the periodic syncs
+func (d *Discovery) Schedule() *schedule.Schedule {
+	return d.schedule
+}
+
+// Sync resolves the provider once and adds and removes backends to match.
+// Finding no instances counts as a failure, so a bad answer can't empty the
+// pool.
+func (d *Discovery) Sync(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.interval)
+	defer cancel()
+
+	urls, err := d.provider.Resolve(ctx)
+	if err == nil && len(urls) == 0 {
+		err = errors.New("no healthy instances found")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err != nil {
+		d.lastError = err.Error()
+		d.log.Warnf("Service discovery from %s failed, keeping %d known backends: %v", d.provider.Source(), len(d.managed), err)
+		return err
+	}
+
+	resolved := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		resolved[url] = true
+	}
+
+	existing := make(map[string]bool)
+	for _, url := range d.lb.Backends() {
+		existing[url] = true
+	}
+	for url := range resolved {
+		if !d.managed[url] && !existing[url] {
+			d.lb.AddBackend(url)
+			d.managed[url] = true
+			d.log.Infof("Discovered backend %s from %s", url, d.provider.Source())
+		}
+	}
+	for url := range d.managed {
+		if !resolved[url] {
+			d.lb.DrainBackend(url, d.drainTimeout)
+			delete(d.managed, url)
+			d.log.Infof("Draining backend %s no longer in %s", url, d.provider.Source())
+		}
+	}
+
+	d.lastSync = time.Now()
+	d.lastError = ""
+	return nil
+}
+
+// Status returns the discovery source and the outcome of the last sync
+func (d *Discovery) Status() Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := Status{
+		Source:    d.provider.Source(),
+		Backends:  make([]string, 0, len(d.managed)),
+		LastError: d.lastError,
+	}
+	for url := range d.managed {
+		status.Backends = append(status.Backends, url)
+	}
+	sort.Strings(status.Backends)
+	if reporter, ok := d.provider.(ServiceReporter); ok {
+		status.Services = reporter.Services()
+	}
+	if !d.lastSync.IsZero() {
+		lastSync := d.lastSync
+		status.LastSync = &lastSync
+	}
+	return status
+}
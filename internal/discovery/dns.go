@@ -0,0 +1,56 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SRVResolver looks up SRV records, as *net.Resolver does
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNS resolves a service from an SRV record such as _orders._tcp.example.com.
+// Only the targets with the lowest priority are used.
+type DNS struct {
+	Name     string
+	Scheme   string      // Scheme of the backend URLs
+	Resolver SRVResolver // nil uses net.DefaultResolver
+}
+
+// Source returns "dns:" followed by the record name
+func (d *DNS) Source() string {
+	return "dns:" + d.Name
+}
+
+// Resolve returns the URLs of the record's preferred targets
+func (d *DNS) Resolve(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	preferred := uint16(0)
+	for i, srv := range records {
+		if i == 0 || srv.Priority < preferred {
+			preferred = srv.Priority
+		}
+	}
+
+	urls := make([]string, 0, len(records))
+	for _, srv := range records {
+		if srv.Priority != preferred {
+			continue
+		}
+		host := strings.TrimSuffix(srv.Target, ".")
+		urls = append(urls, d.Scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	return urls, nil
+}
@@ -0,0 +1,285 @@
+//go:build kubernetes
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// namespaceFile holds the namespace of the pod the gateway runs in
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// serviceRef names a Kubernetes Service
+type serviceRef struct {
+	namespace string
+	name      string
+}
+
+func (s serviceRef) String() string {
+	return s.namespace + "/" + s.name
+}
+
+// Kubernetes resolves Services to their ready endpoints from EndpointSlices.
+// The slices are watched through informers, which re-establish dropped
+// watches on their own.
+type Kubernetes struct {
+	client   kubernetes.Interface
+	services []serviceRef
+	port     string // Endpoint port name; empty uses the first port
+	scheme   string
+	log      *logger.Logger
+
+	mu      sync.RWMutex
+	listers map[string]discoverylisters.EndpointSliceLister // By namespace, set once listed
+}
+
+// newKubernetes creates the provider from the in-cluster configuration, or
+// the kubeconfig file when one is given
+func newKubernetes(cfg *config.DiscoveryConfig, log *logger.Logger) (Provider, error) {
+	var restConfig *rest.Config
+	var err error
+	if cfg.Kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", cfg.Kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubernetes configuration: %w", err)
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+
+	namespace := cfg.KubeNamespace
+	if namespace == "" {
+		namespace = "default"
+		if data, err := os.ReadFile(namespaceFile); err == nil {
+			namespace = strings.TrimSpace(string(data))
+		}
+	}
+	return NewKubernetes(client, strings.Split(cfg.Service, ","), namespace, cfg.KubePort, cfg.Scheme, log)
+}
+
+// NewKubernetes creates a provider watching services, each given as name or
+// namespace/name, through client
+func NewKubernetes(client kubernetes.Interface, services []string, namespace, port, scheme string, log *logger.Logger) (*Kubernetes, error) {
+	k := &Kubernetes{client: client, port: port, scheme: scheme, log: log}
+	for _, service := range services {
+		service = strings.TrimSpace(service)
+		ref := serviceRef{namespace: namespace, name: service}
+		if ns, name, ok := strings.Cut(service, "/"); ok {
+			ref = serviceRef{namespace: ns, name: name}
+		}
+		if ref.namespace == "" || ref.name == "" {
+			return nil, fmt.Errorf("invalid kubernetes service %q", service)
+		}
+		k.services = append(k.services, ref)
+	}
+	if len(k.services) == 0 {
+		return nil, errors.New("no kubernetes services to watch")
+	}
+	return k, nil
+}
+
+// Source returns "kubernetes:" followed by the watched services
+func (k *Kubernetes) Source() string {
+	names := make([]string, 0, len(k.services))
+	for _, svc := range k.services {
+		names = append(names, svc.String())
+	}
+	return "kubernetes:" + strings.Join(names, ",")
+}
+
+// Watch watches the services' EndpointSlices until ctx is done, calling
+// changed once they're listed and whenever one changes
+func (k *Kubernetes) Watch(ctx context.Context, changed func()) {
+	byNamespace := make(map[string][]string)
+	for _, svc := range k.services {
+		byNamespace[svc.namespace] = append(byNamespace[svc.namespace], svc.name)
+	}
+
+	var listed bool
+	var listedMu sync.Mutex
+	notify := func() {
+		listedMu.Lock()
+		defer listedMu.Unlock()
+		if listed {
+			changed()
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	}
+
+	listers := make(map[string]discoverylisters.EndpointSliceLister, len(byNamespace))
+	factories := make([]informers.SharedInformerFactory, 0, len(byNamespace))
+	for namespace, names := range byNamespace {
+		requirement, err := labels.NewRequirement(discoveryv1.LabelServiceName, selection.In, names)
+		if err != nil {
+			k.log.Errorf("Invalid kubernetes services %v: %v", names, err)
+			return
+		}
+		selector := labels.NewSelector().Add(*requirement).String()
+
+		factory := informers.NewSharedInformerFactoryWithOptions(k.client, 0,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = selector
+			}),
+		)
+		slices := factory.Discovery().V1().EndpointSlices()
+		informer := slices.Informer()
+		informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+			k.log.Warnf("Watching EndpointSlices in %s failed, reconnecting: %v", namespace, err)
+		})
+		informer.AddEventHandler(handler)
+
+		listers[namespace] = slices.Lister()
+		factories = append(factories, factory)
+	}
+
+	for _, factory := range factories {
+		factory.Start(ctx.Done())
+	}
+	defer func() {
+		for _, factory := range factories {
+			factory.Shutdown()
+		}
+	}()
+	for _, factory := range factories {
+		for _, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return
+			}
+		}
+	}
+
+	k.mu.Lock()
+	k.listers = listers
+	k.mu.Unlock()
+
+	listedMu.Lock()
+	listed = true
+	listedMu.Unlock()
+	changed()
+
+	<-ctx.Done()
+}
+
+// Resolve returns the URLs of the services' ready endpoints
+func (k *Kubernetes) Resolve(ctx context.Context) ([]string, error) {
+	k.mu.RLock()
+	listers := k.listers
+	k.mu.RUnlock()
+
+	if listers == nil {
+		return nil, errors.New("waiting for the EndpointSlices to be listed")
+	}
+
+	var urls []string
+	for _, svc := range k.services {
+		ready, _, err := k.endpoints(listers[svc.namespace], svc)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, ready...)
+	}
+	return urls, nil
+}
+
+// Services returns the watched services with their endpoint counts, which
+// are zero until the EndpointSlices are listed
+func (k *Kubernetes) Services() []ServiceStatus {
+	k.mu.RLock()
+	listers := k.listers
+	k.mu.RUnlock()
+
+	statuses := make([]ServiceStatus, 0, len(k.services))
+	for _, svc := range k.services {
+		status := ServiceStatus{Namespace: svc.namespace, Name: svc.name}
+		if listers != nil {
+			if ready, notReady, err := k.endpoints(listers[svc.namespace], svc); err == nil {
+				status.Ready, status.NotReady = len(ready), notReady
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// endpoints returns the URLs of a service's ready endpoints and how many of
+// its endpoints are not ready. Endpoints listed in several slices count once.
+func (k *Kubernetes) endpoints(lister discoverylisters.EndpointSliceLister, svc serviceRef) ([]string, int, error) {
+	slices, err := lister.EndpointSlices(svc.namespace).List(labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: svc.name}))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ready := make(map[string]bool)
+	notReady := make(map[string]bool)
+	for _, slice := range slices {
+		port, ok := k.slicePort(slice)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+			// Addresses are interchangeable, and an unknown readiness counts as ready
+			url := k.scheme + "://" + net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(int(port)))
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				notReady[url] = true
+			} else {
+				ready[url] = true
+			}
+		}
+	}
+
+	urls := make([]string, 0, len(ready))
+	for url := range ready {
+		urls = append(urls, url)
+		delete(notReady, url)
+	}
+	sort.Strings(urls)
+	return urls, len(notReady), nil
+}
+
+// slicePort returns the configured port of a slice, or its first port
+func (k *Kubernetes) slicePort(slice *discoveryv1.EndpointSlice) (int32, bool) {
+	for _, port := range slice.Ports {
+		if port.Port == nil {
+			continue
+		}
+		if k.port == "" || (port.Name != nil && *port.Name == k.port) {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
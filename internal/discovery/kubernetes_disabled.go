@@ -0,0 +1,16 @@
+//go:build !kubernetes
+
+package discovery
+
+import (
+	"errors"
+
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// newKubernetes reports that Kubernetes discovery was left out of the build,
+// which keeps client-go out of gateways that don't need it
+func newKubernetes(cfg *config.DiscoveryConfig, log *logger.Logger) (Provider, error) {
+	return nil, errors.New("kubernetes discovery requires a gateway built with -tags kubernetes")
+}
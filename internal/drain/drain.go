@@ -0,0 +1,120 @@
+package drain
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDraining is reported by readiness checks while the gateway drains
+var ErrDraining = errors.New("draining")
+
+// pollInterval is how often Wait checks for in-flight requests to finish
+const pollInterval = 10 * time.Millisecond
+
+// Status describes the drain state
+type Status struct {
+	Draining bool       `json:"draining"`
+	Since    *time.Time `json:"since,omitempty"`
+	InFlight int64      `json:"in_flight"`
+}
+
+// Drainer tracks in-flight requests and whether the gateway is draining.
+// Once draining, readiness fails so load balancers stop sending new traffic
+// while requests already in flight finish.
+type Drainer struct {
+	inFlight atomic.Int64
+	once     sync.Once
+	started  chan struct{}
+	since    atomic.Pointer[time.Time]
+}
+
+// New creates a drainer
+func New() *Drainer {
+	return &Drainer{
+		started: make(chan struct{}),
+	}
+}
+
+// Middleware counts requests in flight
+func (d *Drainer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.inFlight.Add(1)
+		defer d.inFlight.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Start begins draining. It returns false if the gateway was already draining.
+func (d *Drainer) Start() bool {
+	started := false
+	d.once.Do(func() {
+		now := time.Now()
+		d.since.Store(&now)
+		close(d.started)
+		started = true
+	})
+	return started
+}
+
+// Started returns a channel closed once draining begins
+func (d *Drainer) Started() <-chan struct{} {
+	return d.started
+}
+
+// Draining reports whether draining has begun
+func (d *Drainer) Draining() bool {
+	return d.since.Load() != nil
+}
+
+// InFlight returns the number of requests being served
+func (d *Drainer) InFlight() int64 {
+	return d.inFlight.Load()
+}
+
+// Status returns the current drain state
+func (d *Drainer) Status() Status {
+	return Status{
+		Draining: d.Draining(),
+		Since:    d.since.Load(),
+		InFlight: d.InFlight(),
+	}
+}
+
+// Check fails once draining has begun, for use as a readiness check
+func (d *Drainer) Check(ctx context.Context) error {
+	if d.Draining() {
+		return ErrDraining
+	}
+	return nil
+}
+
+// Wait waits out the drain period so load balancers notice failing
+// readiness, then waits for in-flight requests to finish. It returns early
+// when ctx is done.
+func (d *Drainer) Wait(ctx context.Context, period time.Duration) error {
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for d.InFlight() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package egress
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zakirkun/isekai/internal/seal"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Profile is the egress proxy upstream connections go through. The proxy
+// password is sealed before it is stored.
+type Profile struct {
+	URL      string   `json:"url,omitempty"` // http://, https://, socks5:// or socks5h:// proxy
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"` // Sealed
+	NoProxy  []string `json:"no_proxy,omitempty"` // Hosts, domains and CIDRs reached directly, as in NO_PROXY
+	Direct   bool     `json:"direct,omitempty"`   // Connects directly, ignoring the global egress proxy and HTTP_PROXY
+}
+
+// ConnectError is returned when the egress proxy refuses to tunnel a
+// connection to the upstream
+type ConnectError struct {
+	Proxy  string
+	Status string
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("egress proxy %s refused CONNECT: %s", e.Proxy, e.Status)
+}
+
+// Validate checks the proxy URL and that the password opens
+func (p *Profile) Validate() error {
+	if p.Direct {
+		if p.URL != "" {
+			return errors.New("egress url can't be set when direct is")
+		}
+		return nil
+	}
+	if err := ValidateURL(p.URL); err != nil {
+		return err
+	}
+	if p.Password != "" {
+		if p.Username == "" {
+			return errors.New("egress password requires a username")
+		}
+		if _, err := seal.Open(p.Password); err != nil {
+			return fmt.Errorf("egress: %w", err)
+		}
+	}
+	return nil
+}
+
+// ValidateURL checks that rawURL is an HTTP, HTTPS or SOCKS5 proxy address
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid egress url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("egress url scheme must be http, https, socks5 or socks5h, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("egress url requires a host")
+	}
+	return nil
+}
+
+// Seal encrypts the password if it isn't sealed yet
+func (p *Profile) Seal() error {
+	if p == nil {
+		return nil
+	}
+	sealed, err := seal.Seal(p.Password)
+	if err != nil {
+		return err
+	}
+	p.Password = sealed
+	return nil
+}
+
+// Key identifies the profile among the transports it is used by
+func (p *Profile) Key() string {
+	key, _ := json.Marshal(p)
+	return string(key)
+}
+
+// ProxyFunc returns the transport Proxy function sending requests through
+// the egress proxy, with the credentials in the proxy URL. Hosts in NoProxy
+// and loopback addresses are reached directly. A direct profile returns nil.
+func (p *Profile) ProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if p.Direct {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress url: %w", err)
+	}
+	if p.Username != "" {
+		password := p.Password
+		// Passwords from the environment are used as they are
+		if seal.Sealed(password) {
+			if password, err = seal.Open(password); err != nil {
+				return nil, fmt.Errorf("egress: %w", err)
+			}
+		}
+		if password != "" {
+			proxyURL.User = url.UserPassword(p.Username, password)
+		} else {
+			proxyURL.User = url.User(p.Username)
+		}
+	}
+
+	config := &httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    strings.Join(p.NoProxy, ","),
+	}
+	proxy := config.ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxy(r.URL)
+	}, nil
+}
+
+// CheckConnect is a transport's OnProxyConnectResponse, returning a
+// ConnectError when the proxy refuses a tunnel so the failure can be told
+// apart from the upstream's
+func CheckConnect(_ context.Context, proxyURL *url.URL, _ *http.Request, resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return &ConnectError{Proxy: proxyURL.Redacted(), Status: resp.Status}
+	}
+	return nil
+}
+
+// Failed reports whether err is a failure to reach or go through the
+// egress proxy rather than one of the upstream itself
+func Failed(err error) bool {
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "proxyconnect" || strings.HasPrefix(opErr.Op, "socks "))
+}
@@ -0,0 +1,109 @@
+package etag
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Entry is a cached value stored with the entity tag of its JSON encoding,
+// so conditional requests are answered without encoding it again
+type Entry struct {
+	Value interface{} `json:"value"`
+	ETag  string      `json:"etag"`
+}
+
+// New returns an entry for value
+func New(value interface{}) (*Entry, error) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Value: value, ETag: Compute(body)}, nil
+}
+
+// Compute returns a strong entity tag for body
+func Compute(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Derive returns a strong entity tag for a view of the representation
+// tagged etag, such as a filtered list, distinguished by parts
+func Derive(etag string, parts ...string) string {
+	return Compute([]byte(etag + "\x00" + strings.Join(parts, "\x00")))
+}
+
+// Weak returns etag as a weak entity tag, for bodies the gateway rewrote
+// and so no longer match the upstream's byte for byte
+func Weak(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// opaque returns the quoted part of an entity tag, for weak comparison
+func opaque(etag string) string {
+	return strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+}
+
+// NoneMatch reports whether the If-None-Match header value matches etag,
+// comparing weakly as RFC 9110 requires for If-None-Match
+func NoneMatch(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if opaque(candidate) == opaque(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotModified reports whether a GET or HEAD request's preconditions show
+// the client already has the representation tagged etag and last modified
+// at modified. If-None-Match takes precedence; If-Modified-Since is only
+// evaluated without it, and only when modified is set.
+func NotModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etag != "" && NoneMatch(header, etag)
+	}
+	if header := r.Header.Get("If-Modified-Since"); header != "" && !modified.IsZero() {
+		since, err := http.ParseTime(header)
+		return err == nil && !modified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// Serve sets the validators of a representation on w and, when the
+// request's preconditions show the client already has it, answers 304 Not
+// Modified without a body and reports true. Headers set on w before, such as
+// Cache-Control and Vary, are sent with the 304 as RFC 9110 requires.
+// modified may be zero when the representation has no modification time.
+func Serve(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if !NotModified(r, etag, modified) {
+		return false
+	}
+
+	// A 304 describes the representation the client has; it carries no
+	// body or content headers of its own
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Encoding"} {
+		w.Header().Del(name)
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
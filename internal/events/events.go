@@ -0,0 +1,123 @@
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type identifies the kind of gateway event
+type Type string
+
+// Gateway event types
+const (
+	RouteCreated           Type = "route.created"
+	RouteUpdated           Type = "route.updated"
+	RouteDeleted           Type = "route.deleted"
+	RouteSwitched          Type = "route.switched"
+	SnapshotRestored       Type = "snapshot.restored"
+	CircuitBreakerOpen     Type = "circuitbreaker.open"
+	CircuitBreakerHalfOpen Type = "circuitbreaker.half_open"
+	CircuitBreakerClosed   Type = "circuitbreaker.closed"
+	BackendHealthy         Type = "backend.healthy"
+	BackendUnhealthy       Type = "backend.unhealthy"
+	BackendPriority        Type = "backend.priority_changed"
+	CriticalRouteUnhealthy Type = "critical_route.unhealthy"
+	CriticalRouteHealthy   Type = "critical_route.healthy"
+	CacheCleared           Type = "cache.cleared"
+)
+
+// gatewayTypes lists the gateway event types, whose namespaces only the
+// gateway may publish in
+var gatewayTypes = []Type{
+	RouteCreated, RouteUpdated, RouteDeleted, RouteSwitched, SnapshotRestored,
+	CircuitBreakerOpen, CircuitBreakerHalfOpen, CircuitBreakerClosed,
+	BackendHealthy, BackendUnhealthy, BackendPriority,
+	CriticalRouteUnhealthy, CriticalRouteHealthy, CacheCleared,
+}
+
+// IsGateway reports whether a message type is in the namespace of a gateway
+// event, such as route.created or any other route.* type
+func IsGateway(messageType string) bool {
+	namespace, _, _ := strings.Cut(messageType, ".")
+	for _, eventType := range gatewayTypes {
+		if prefix, _, _ := strings.Cut(string(eventType), "."); prefix == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is a typed notification emitted by a gateway component
+type Event struct {
+	Type      Type        `json:"type"`
+	Payload   interface{} `json:"payload"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// Handler receives published events. Handlers run synchronously on the
+// publisher's goroutine and must not block.
+type Handler func(Event)
+
+// Bus fans events out from components to subscribers
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers map[int]Handler
+	nextID      int
+}
+
+// NewBus creates a new event bus
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[int]Handler),
+	}
+}
+
+// Subscribe registers a handler and returns a function that removes it
+func (b *Bus) Subscribe(handler Handler) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = handler
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// Publish delivers an event to all subscribers. Publishing on a nil bus is a no-op
+// so components can be used without event wiring.
+func (b *Bus) Publish(eventType Type, payload interface{}) {
+	if b == nil {
+		return
+	}
+
+	event := Event{
+		Type:      eventType,
+		Payload:   payload,
+		Timestamp: time.Now(),
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, handler := range b.subscribers {
+		handler(event)
+	}
+}
+
+// Match reports whether an event type matches a subscription pattern. A
+// pattern is either an exact type, a prefix wildcard such as "route.*", or "*".
+func Match(pattern string, eventType Type) bool {
+	if pattern == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(string(eventType), prefix)
+	}
+	return pattern == string(eventType)
+}
@@ -0,0 +1,197 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/zakirkun/isekai/internal/schedule"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// DB resolves IP addresses to ISO country codes from a MaxMind mmdb file,
+// such as GeoLite2-Country, and reloads the file when it changes
+type DB struct {
+	path     string
+	log      *logger.Logger
+	reader   atomic.Pointer[maxminddb.Reader]
+	mu       sync.Mutex // Serialises reloads
+	stamp    string
+	schedule *schedule.Schedule // Nil until Start
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// record holds the fields read from a country or city database
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Open loads the mmdb file at path
+func Open(path string, log *logger.Logger) (*DB, error) {
+	db := &DB{path: path, log: log, stop: make(chan struct{})}
+	if _, err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload reads the file again if it changed since it was last loaded, and
+// reports whether it did. A file that can't be read leaves the loaded
+// database in use.
+func (db *DB) Reload() (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stamp, err := fileStamp(db.path)
+	if err != nil {
+		return false, err
+	}
+	if stamp == db.stamp {
+		return false, nil
+	}
+
+	// Read the whole file rather than mapping it, so a replaced reader can be
+	// dropped while lookups on it are still running
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return false, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return false, fmt.Errorf("invalid GeoIP database %s: %w", db.path, err)
+	}
+
+	db.reader.Store(reader)
+	db.stamp = stamp
+	return true, nil
+}
+
+// fileStamp summarises the modification time and size of a file
+func fileStamp(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// Start checks the file about every interval and reloads it when it
+// changed, until Stop is called. Checks back off while the file can't be
+// loaded.
+func (db *DB) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	db.schedule = schedule.New(schedule.Policy{
+		Interval:    interval,
+		Jitter:      0.1,
+		Multiplier:  2,
+		MaxInterval: 2 * interval,
+	}, nil)
+	go func() {
+		for {
+			select {
+			case <-db.schedule.After():
+				reloaded, err := db.Reload()
+				if err != nil {
+					db.log.Warnf("Keeping previous GeoIP database: %v", err)
+				} else if reloaded {
+					db.log.Infof("Reloaded GeoIP database %s", db.path)
+				}
+				db.schedule.Report(err)
+			case <-db.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Schedule returns the schedule of the reload checks, nil when the file
+// isn't checked for changes
+func (db *DB) Schedule() *schedule.Schedule {
+	return db.schedule
+}
+
+// Stop stops the periodic reload
+func (db *DB) Stop() {
+	db.stopOnce.Do(func() { close(db.stop) })
+}
+
+// Country returns the ISO country code of addr, or "" when it isn't in the
+// database. Addresses without a country, such as anycast ranges, fall back
+// to the country they are registered in.
+func (db *DB) Country(addr netip.Addr) string {
+	reader := db.reader.Load()
+	if reader == nil || !addr.IsValid() {
+		return ""
+	}
+
+	var rec record
+	if err := reader.Lookup(net.IP(addr.Unmap().AsSlice()), &rec); err != nil {
+		return ""
+	}
+	if rec.Country.ISOCode != "" {
+		return rec.Country.ISOCode
+	}
+	return rec.RegisteredCountry.ISOCode
+}
+
+type countryKey struct{}
+
+// WithCountry returns a context carrying the client's country code
+func WithCountry(ctx context.Context, country string) context.Context {
+	return context.WithValue(ctx, countryKey{}, country)
+}
+
+// CountryFromContext returns the client's country code, and whether the
+// country was looked up. The code is empty for addresses not in the database.
+func CountryFromContext(ctx context.Context) (string, bool) {
+	country, ok := ctx.Value(countryKey{}).(string)
+	return country, ok
+}
+
+// Reasons a client is blocked by a route's country lists
+const (
+	ReasonCountryDenied     = "country_denied"
+	ReasonCountryNotAllowed = "country_not_allowed"
+)
+
+// ValidCountry reports whether code is a two-letter ISO country code
+func ValidCountry(code string) bool {
+	if len(code) != 2 {
+		return false
+	}
+	for _, c := range code {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Check reports whether a client from country may use a route with the given
+// country lists, and the reason when it may not. Deny takes precedence, and
+// clients of unknown country only pass when the allow list is empty.
+func Check(country string, allow, deny []string) (bool, string) {
+	if country != "" && slices.Contains(deny, country) {
+		return false, ReasonCountryDenied
+	}
+	if len(allow) > 0 && !slices.Contains(allow, country) {
+		return false, ReasonCountryNotAllowed
+	}
+	return true, ""
+}
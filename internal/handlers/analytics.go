@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Analytics handles totalling a route's traffic from its hourly rollups and
+// request logs
+// @Summary Get route analytics
+// @Description Total the route's requests, 5xx errors, average and p50/p95/p99 response times and request and response body bytes, from its hourly rollups and, for the hours not rolled up yet, its request logs
+// @Tags routes
+// @Produce json
+// @Param id path int true "Route ID"
+// @Param from query string false "Start of the range, RFC 3339"
+// @Param to query string false "End of the range, RFC 3339"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/routes/{id}/analytics [get]
+func (h *RouteHandler) Analytics(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.RouteHandler.Analytics")
+	defer span.End()
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid route ID")
+		response.BadRequest(w, "Invalid route ID")
+		return
+	}
+
+	var from, to time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := r.URL.Query().Get(name); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				span.SetStatus(codes.Error, "invalid time range")
+				response.BadRequest(w, name+" must be an RFC 3339 time")
+				return
+			}
+		}
+	}
+
+	span.SetAttributes(attribute.Int("route.id", id))
+
+	if _, err := h.repo.FindByID(ctx, id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			span.SetStatus(codes.Error, "route not found")
+			response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+			return
+		}
+		logQueryError(h.log, err, "Failed to get route %d", id)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to get route")
+		response.InternalServerError(w, "Failed to get route")
+		return
+	}
+
+	traffic, err := h.logRepo.TrafficByRouteID(ctx, id, from, to)
+	if err != nil {
+		logQueryError(h.log, err, "Failed to total request logs for route %d", id)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to total request logs")
+		response.InternalServerError(w, "Failed to retrieve route analytics")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Route analytics retrieved", traffic)
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// AuditHandler serves the route change audit log
+type AuditHandler struct {
+	repo *database.AuditRepository
+	log  *logger.Logger
+}
+
+// NewAuditHandler creates a new audit handler
+func NewAuditHandler(db *database.Database, log *logger.Logger) *AuditHandler {
+	return &AuditHandler{
+		repo: database.NewAuditRepository(db),
+		log:  log,
+	}
+}
+
+// auditPage is a paginated list of audit entries
+type auditPage struct {
+	Entries []database.AuditEntry `json:"entries"`
+	Total   int                   `json:"total"`
+	Limit   int                   `json:"limit"`
+	Offset  int                   `json:"offset"`
+}
+
+// List handles listing audit entries for all routes
+// @Summary List audit entries
+// @Description Get route configuration changes across all routes, newest first
+// @Tags audit
+// @Produce json
+// @Param limit query int false "Page size (default 50, max 500)"
+// @Param offset query int false "Number of entries to skip"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/audit [get]
+func (h *AuditHandler) List(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "handler.AuditHandler.List")
+	defer span.End()
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid pagination")
+		response.BadRequest(w, "Invalid pagination parameters")
+		return
+	}
+
+	entries, total, err := h.repo.FindAll(ctx, limit, offset)
+	if err != nil {
+		logQueryError(h.log, err, "Failed to list audit entries")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve audit entries")
+		response.InternalServerError(w, "Failed to retrieve audit entries")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("audit.count", len(entries)))
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Audit entries retrieved", auditPage{
+		Entries: entries,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
+
+// ListByRoute handles listing audit entries for a single route
+// @Summary List audit entries for a route
+// @Description Get configuration changes of a specific route, newest first
+// @Tags audit
+// @Produce json
+// @Param id path int true "Route ID"
+// @Param limit query int false "Page size (default 50, max 500)"
+// @Param offset query int false "Number of entries to skip"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/routes/{id}/audit [get]
+func (h *AuditHandler) ListByRoute(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	idStr := chi.URLParam(r, "id")
+
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "handler.AuditHandler.ListByRoute")
+	defer span.End()
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid route ID")
+		response.BadRequest(w, "Invalid route ID")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("route.id", id))
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid pagination")
+		response.BadRequest(w, "Invalid pagination parameters")
+		return
+	}
+
+	entries, total, err := h.repo.FindByRouteID(ctx, id, limit, offset)
+	if err != nil {
+		logQueryError(h.log, err, "Failed to list audit entries for route %d", id)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve audit entries")
+		response.InternalServerError(w, "Failed to retrieve audit entries")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("audit.count", len(entries)))
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Audit entries retrieved", auditPage{
+		Entries: entries,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
+
+// parsePagination reads limit and offset query parameters
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageLimit
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return 0, 0, errors.New("invalid limit parameter")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+
+	if value := r.URL.Query().Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset parameter")
+		}
+	}
+
+	return limit, offset, nil
+}
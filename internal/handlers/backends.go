@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// BackendHandler manages the load balancer's backend pool
+type BackendHandler struct {
+	lb           *loadbalancer.LoadBalancer
+	drainTimeout time.Duration
+	log          *logger.Logger
+}
+
+// NewBackendHandler creates a new backend handler. Removed backends get
+// drainTimeout to finish their in-flight requests.
+func NewBackendHandler(lb *loadbalancer.LoadBalancer, drainTimeout time.Duration, log *logger.Logger) *BackendHandler {
+	return &BackendHandler{
+		lb:           lb,
+		drainTimeout: drainTimeout,
+		log:          log,
+	}
+}
+
+// backendPriorityRequest is the body of a priority change
+type backendPriorityRequest struct {
+	URL      string `json:"url"`
+	Priority *int   `json:"priority"`
+}
+
+// SetPriority moves a backend to another priority tier
+// @Summary Set a backend's priority
+// @Description Move a backend to another priority tier. Requests go to the lowest tier with an available backend, and fail over to the next tier when it is down. The change applies to the next request.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param backend body object true "Backend URL and priority"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/backends/priority [put]
+func (h *BackendHandler) SetPriority(w http.ResponseWriter, r *http.Request) {
+	var req backendPriorityRequest
+	if err := httpjson.Decode(w, r, &req); err != nil {
+		httpjson.WriteError(w, err)
+		return
+	}
+	if req.URL == "" || req.Priority == nil {
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "url and priority are required")
+		return
+	}
+
+	if !h.lb.SetPriority(req.URL, *req.Priority) {
+		response.NotFound(w, "Backend not found")
+		return
+	}
+
+	h.log.Infof("Backend %s moved to priority %d", req.URL, *req.Priority)
+	response.Success(w, "Backend priority updated", map[string]interface{}{
+		"backends": h.lb.GetAllBackends(),
+		"tiers":    h.lb.Tiers(),
+	})
+}
+
+// Remove takes a backend out of the pool
+// @Summary Remove a backend
+// @Description Stop sending new requests to a backend and remove it once its in-flight requests finish or the drain timeout passes. The response is sent when the backend is gone; if the client leaves first, the drain carries on. With force=true the backend is removed at once and the requests still in flight are reported.
+// @Tags admin
+// @Produce json
+// @Param url query string true "Backend URL"
+// @Param force query bool false "Remove without waiting for in-flight requests"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/backends [delete]
+func (h *BackendHandler) Remove(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "url is required")
+		return
+	}
+
+	var result loadbalancer.DrainResult
+	if r.URL.Query().Get("force") == "true" {
+		inflight, ok := h.lb.RemoveBackend(url)
+		if !ok {
+			response.NotFound(w, "Backend not found")
+			return
+		}
+		result = loadbalancer.DrainResult{Removed: true, Inflight: inflight}
+		if inflight > 0 {
+			h.log.Warnf("Backend %s removed with %d requests in flight", url, inflight)
+		}
+	} else {
+		done := h.lb.DrainBackend(url, h.drainTimeout)
+		if done == nil {
+			response.NotFound(w, "Backend not found")
+			return
+		}
+		h.log.Infof("Draining backend %s for up to %s", url, h.drainTimeout)
+		select {
+		case result = <-done:
+		case <-r.Context().Done():
+			return
+		}
+		if result.Inflight > 0 {
+			h.log.Warnf("Backend %s removed after the %s drain timeout with %d requests in flight", url, h.drainTimeout, result.Inflight)
+		}
+	}
+
+	message := "Backend removed"
+	if result.Removed {
+		h.log.Infof("Backend %s removed", url)
+	} else {
+		message = "Backend was added back while draining"
+	}
+	response.Success(w, message, map[string]interface{}{
+		"url":      url,
+		"removed":  result.Removed,
+		"inflight": result.Inflight,
+		"backends": h.lb.GetAllBackends(),
+	})
+}
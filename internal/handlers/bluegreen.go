@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/bluegreen"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// SwitchEvent is published when a route's traffic is switched between colors
+type SwitchEvent struct {
+	RouteID int             `json:"route_id"`
+	Path    string          `json:"path"`
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Route   *database.Route `json:"route"`
+}
+
+// errNotBlueGreen is returned when switching a route without blue/green targets
+var errNotBlueGreen = errors.New("Route has no blue_green targets")
+
+// Switch handles sending a blue/green route's traffic to the other color
+// @Summary Switch blue/green traffic
+// @Description Send all of the route's traffic to the given color. Requests started before the switch finish on the old color.
+// @Tags routes
+// @Produce json
+// @Param id path int true "Route ID"
+// @Param to query string true "Color to switch to" Enums(blue, green)
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/routes/{id}/switch [post]
+func (h *RouteHandler) Switch(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	to := r.URL.Query().Get("to")
+
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.RouteHandler.Switch")
+	defer span.End()
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid route ID")
+		response.BadRequest(w, "Invalid route ID")
+		return
+	}
+	if !bluegreen.ValidColor(to) {
+		span.SetStatus(codes.Error, "invalid color")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeBadRequest, "to must be blue or green")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("route.id", id), attribute.String("route.color", to))
+
+	var route database.Route
+	var from string
+	err = h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		repo := h.repo.WithTx(tx)
+
+		before, err := repo.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if before.BlueGreen == nil {
+			return errNotBlueGreen
+		}
+
+		route = *before
+		deployment := *before.BlueGreen
+		from, deployment.Active = deployment.Active, to
+		route.BlueGreen = &deployment
+		route.TargetURL = deployment.Target(to)
+		if from == to {
+			return nil
+		}
+
+		if err := repo.Update(ctx, &route); err != nil {
+			return err
+		}
+		return h.recordAudit(ctx, tx, r, id, database.AuditActionSwitch, before, &route)
+	})
+	if errors.Is(err, errNotBlueGreen) {
+		span.SetStatus(codes.Error, "not a blue/green route")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		span.SetStatus(codes.Error, "route not found")
+		response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+		return
+	}
+	if err != nil {
+		logQueryError(h.log, err, "Failed to switch route %d to %s", id, to)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to update route")
+		response.InternalServerError(w, "Failed to update route")
+		return
+	}
+
+	if from == to {
+		span.SetStatus(codes.Ok, "already active")
+		response.Success(w, "Route already on "+to, route)
+		return
+	}
+
+	// Invalidate cache
+	h.cache.Delete("routes:all")
+	h.cache.Delete("route:" + idStr)
+
+	span.SetStatus(codes.Ok, "route switched")
+
+	h.bus.Publish(events.RouteSwitched, SwitchEvent{RouteID: id, Path: route.Path, From: from, To: to, Route: &route})
+
+	h.log.Infof("Route %d switched from %s to %s", id, from, to)
+	response.Success(w, "Route switched to "+to, route)
+}
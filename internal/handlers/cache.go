@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/redact"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// maxInspectedValue caps the size of values the cache inspection shows
+const maxInspectedValue = 64 << 10
+
+// CacheHandler inspects and deletes cache items
+type CacheHandler struct {
+	cache   *cache.Cache
+	headers *redact.Headers
+	log     *logger.Logger
+}
+
+// NewCacheHandler creates a new cache handler masking values like headers
+func NewCacheHandler(cache *cache.Cache, headers *redact.Headers, log *logger.Logger) *CacheHandler {
+	return &CacheHandler{
+		cache:   cache,
+		headers: headers,
+		log:     log,
+	}
+}
+
+// cacheKey describes a cache item
+type cacheKey struct {
+	Key        string      `json:"key"`
+	Pattern    string      `json:"pattern"`
+	TTLSeconds float64     `json:"ttl_seconds"` // Negative once expired
+	Size       int         `json:"size"`        // Approximate size in bytes
+	Stale      bool        `json:"stale,omitempty"`
+	Value      interface{} `json:"value,omitempty"`
+	Truncated  bool        `json:"truncated,omitempty"` // The value was over the size cap
+}
+
+// cacheKeyPage is a paginated list of cache items
+type cacheKeyPage struct {
+	Keys   []cacheKey `json:"keys"`
+	Total  int        `json:"total"`
+	Limit  int        `json:"limit"`
+	Offset int        `json:"offset"`
+}
+
+// newCacheKey describes info
+func newCacheKey(info cache.KeyInfo) cacheKey {
+	return cacheKey{
+		Key:        info.Key,
+		Pattern:    cache.Pattern(info.Key),
+		TTLSeconds: info.TTL.Seconds(),
+		Size:       info.Size,
+		Stale:      info.Stale,
+	}
+}
+
+// ListKeys handles listing cache items
+// @Summary List cache keys
+// @Description List cache items by key with their remaining TTL and approximate size. Expired items still served stale are included.
+// @Tags cache
+// @Produce json
+// @Param prefix query string false "Only keys starting with this prefix, e.g. route:"
+// @Param limit query int false "Page size (default 50, max 500)"
+// @Param offset query int false "Number of keys to skip"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Security BearerAuth
+// @Router /api/cache/keys [get]
+func (h *CacheHandler) ListKeys(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		response.BadRequest(w, "Invalid pagination parameters")
+		return
+	}
+
+	infos := h.cache.Keys(r.URL.Query().Get("prefix"))
+	page := cacheKeyPage{Keys: []cacheKey{}, Total: len(infos), Limit: limit, Offset: offset}
+	if offset < len(infos) {
+		for _, info := range infos[offset:min(offset+limit, len(infos))] {
+			page.Keys = append(page.Keys, newCacheKey(info))
+		}
+	}
+
+	response.Success(w, "Cache keys retrieved", page)
+}
+
+// GetKey handles showing a cache item with its value
+// @Summary Get a cache item
+// @Description Show a cache item and its value, with fields named like secrets or sensitive headers masked. Values over 64 KiB are left out.
+// @Tags cache
+// @Produce json
+// @Param key path string true "Cache key"
+// @Success 200 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Security BearerAuth
+// @Router /api/cache/keys/{key} [get]
+func (h *CacheHandler) GetKey(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+	ttl, ok := h.cache.TTL(key)
+	value, found := h.cache.Peek(key)
+	if !ok || !found {
+		response.NotFound(w, "Cache key not found")
+		return
+	}
+
+	item := cacheKey{Key: key, Pattern: cache.Pattern(key), TTLSeconds: ttl.Seconds(), Size: cache.SizeOf(value), Stale: ttl < 0}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		h.log.Errorf("Failed to encode cache item %s: %v", key, err)
+		response.InternalServerError(w, "Failed to encode the cache item")
+		return
+	}
+
+	if len(encoded) > maxInspectedValue {
+		item.Truncated = true
+	} else {
+		var decoded interface{}
+		json.Unmarshal(encoded, &decoded)
+		item.Value = h.headers.Fields(decoded)
+	}
+
+	response.Success(w, "Cache item retrieved", item)
+}
+
+// DeleteKey handles deleting a cache item
+// @Summary Delete a cache item
+// @Description Remove an item from the cache, so the next lookup loads it again
+// @Tags cache
+// @Produce json
+// @Param key path string true "Cache key"
+// @Success 200 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Security BearerAuth
+// @Router /api/cache/keys/{key} [delete]
+func (h *CacheHandler) DeleteKey(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+	if _, ok := h.cache.TTL(key); !ok {
+		response.NotFound(w, "Cache key not found")
+		return
+	}
+
+	h.cache.Delete(key)
+	h.log.Infof("Cache key %s deleted", key)
+	response.Success(w, "Cache key deleted", map[string]string{"key": key})
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/accesslog"
+	"github.com/zakirkun/isekai/internal/chaos"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SetChaos injects the faults configured in registry into matching routes'
+// requests. A nil registry injects nothing.
+func (h *ProxyHandler) SetChaos(registry *chaos.Registry) {
+	h.chaos = registry
+}
+
+// injectFault applies the faults decided for a request: it waits out the
+// injected delay, then drops the connection or answers with the injected
+// error. It returns the request's context, labelled with the fault, and
+// reports whether the request was answered.
+func (h *ProxyHandler) injectFault(w http.ResponseWriter, r *http.Request, route *database.Route, decision chaos.Decision, startTime time.Time) (*http.Request, bool) {
+	fault := decision.Label()
+	ctx := chaos.NewContext(r.Context(), fault)
+	r = r.WithContext(ctx)
+	metrics.SetFaultLabel(ctx, fault)
+	accesslog.SetFault(ctx, fault)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("chaos.fault", fault))
+	h.metrics.ChaosFaults.WithLabelValues(route.Path, fault).Inc()
+
+	if decision.Delay > 0 {
+		timer := time.NewTimer(decision.Delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			// Forwarding fails on the ended context as it would without the delay
+			timer.Stop()
+		}
+	}
+
+	switch {
+	case decision.Abort:
+		// No response is written, so the request is logged without a status
+		h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, 0, time.Since(startTime), r)
+		panic(http.ErrAbortHandler)
+	case decision.Status != 0:
+		response.ErrorFor(w, r, decision.Status, response.CodeFaultInjected, "Fault injected")
+		h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, decision.Status, time.Since(startTime), r)
+		return r, true
+	}
+	return r, false
+}
+
+// ChaosHandler manages the faults injected into routes at runtime
+type ChaosHandler struct {
+	registry *chaos.Registry
+	repo     *database.RouteRepository
+	log      *logger.Logger
+}
+
+// NewChaosHandler creates a new chaos handler
+func NewChaosHandler(db *database.Database, registry *chaos.Registry, log *logger.Logger) *ChaosHandler {
+	return &ChaosHandler{
+		registry: registry,
+		repo:     database.NewRouteRepository(db),
+		log:      log,
+	}
+}
+
+// List handles listing the configured faults
+// @Summary List injected faults
+// @Description List the faults injected into each route. Faults are kept in memory and cleared on restart.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/chaos [get]
+func (h *ChaosHandler) List(w http.ResponseWriter, r *http.Request) {
+	response.Success(w, "Faults retrieved", h.registry.All())
+}
+
+// Set handles replacing the faults injected into a route
+// @Summary Inject faults into a route
+// @Description Inject errors, latency or aborted connections into a share of the route's requests. The change applies to the next request and isn't persisted.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path int true "Route ID"
+// @Param fault body chaos.Fault true "Fault configuration"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/chaos/routes/{id} [put]
+func (h *ChaosHandler) Set(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.BadRequest(w, "Invalid route ID")
+		return
+	}
+
+	var fault chaos.Fault
+	if err := httpjson.Decode(w, r, &fault); err != nil {
+		httpjson.WriteError(w, err)
+		return
+	}
+	if err := fault.Validate(); err != nil {
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+		return
+	}
+
+	route, err := h.repo.FindByID(r.Context(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+		return
+	}
+	if err != nil {
+		logQueryError(h.log, err, "Failed to get route %d", id)
+		response.InternalServerError(w, "Failed to get route")
+		return
+	}
+
+	h.registry.Set(id, fault)
+	fault, _ = h.registry.Get(id)
+	h.log.Warnf("Chaos faults enabled for route %s: %+v", route.Path, fault)
+	response.Success(w, "Faults set", chaos.RouteFault{RouteID: id, Fault: fault})
+}
+
+// Clear handles removing the faults injected into a route
+// @Summary Stop injecting faults into a route
+// @Tags admin
+// @Produce json
+// @Param id path int true "Route ID"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/chaos/routes/{id} [delete]
+func (h *ChaosHandler) Clear(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.BadRequest(w, "Invalid route ID")
+		return
+	}
+	if !h.registry.Clear(id) {
+		response.NotFound(w, "Route has no faults")
+		return
+	}
+
+	h.log.Infof("Chaos faults cleared for route %d", id)
+	response.Success(w, "Faults cleared", nil)
+}
+
+// Reset handles removing every route's faults
+// @Summary Stop injecting faults into every route
+// @Tags admin
+// @Produce json
+// @Success 200 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/chaos [delete]
+func (h *ChaosHandler) Reset(w http.ResponseWriter, r *http.Request) {
+	h.registry.Reset()
+	h.log.Infof("Chaos faults cleared for every route")
+	response.Success(w, "Faults cleared", nil)
+}
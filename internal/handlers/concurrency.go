@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/zakirkun/isekai/internal/concurrency"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/middleware"
+)
+
+// SetConcurrencyQueue sets how many requests may wait for a slot of a route
+// with max_concurrency, and for how long
+func (h *ProxyHandler) SetConcurrencyQueue(size int, wait time.Duration) {
+	h.limitersMu.Lock()
+	defer h.limitersMu.Unlock()
+	h.queueSize, h.queueWait = size, wait
+	clear(h.limiters)
+}
+
+// limiter returns the route's concurrency limiter, or nil when it has no
+// limit. A new limiter replaces the old one when the limit changes; requests
+// holding slots of the old one release them there.
+func (h *ProxyHandler) limiter(route *database.Route) *concurrency.Limiter {
+	if route.MaxConcurrency <= 0 {
+		return nil
+	}
+
+	h.limitersMu.Lock()
+	defer h.limitersMu.Unlock()
+
+	if l, ok := h.limiters[route.ID]; ok && l.Max() == route.MaxConcurrency {
+		return l
+	}
+	l := concurrency.New(route.MaxConcurrency, h.queueSize, h.queueWait, middleware.QueueGauge(h.metrics, route.Path))
+	h.limiters[route.ID] = l
+	return l
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+)
+
+// CriticalRoute is a critical route and how many of its backends can take
+// requests
+type CriticalRoute struct {
+	ID      int    `json:"id"`
+	Path    string `json:"path"`
+	Host    string `json:"host,omitempty"`
+	Healthy int    `json:"healthy"`
+	Total   int    `json:"total"`
+}
+
+// CriticalRoutesError lists the critical routes without a healthy backend.
+// Readiness reports them under the check's details.
+type CriticalRoutesError struct {
+	Routes []CriticalRoute
+}
+
+func (e *CriticalRoutesError) Error() string {
+	return fmt.Sprintf("%d critical routes without a healthy backend", len(e.Routes))
+}
+
+// Details lists the routes in the readiness report
+func (e *CriticalRoutesError) Details() interface{} {
+	return e.Routes
+}
+
+// criticalStates remembers the critical routes found down by the last
+// check, so only transitions are logged and published
+type criticalStates struct {
+	mu   sync.Mutex
+	down map[int]bool // By route ID
+}
+
+// SetBus publishes critical routes going down and coming back on bus
+func (h *ProxyHandler) SetBus(bus *events.Bus) {
+	h.bus = bus
+}
+
+// RouteBackends returns how many of the route's backends can take requests
+// and how many it has. A load-balanced route has the load balancer's
+// backends, counted while healthy and not draining; other routes have their
+// target, counted while the route's circuit breaker to it isn't open. A
+// canary target counts the same way on either.
+func (h *ProxyHandler) RouteBackends(route *database.Route) (healthy, total int) {
+	targets := []string{route.CanaryURL}
+	if route.LoadBalanced {
+		healthy, total = h.lb.HealthyCount()
+	} else {
+		targets = append(targets, route.TargetURL)
+	}
+
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+		total++
+		key := circuitbreaker.RouteKey(route.ID, route.Path, target, route.Breaker)
+		if h.cb.GetState(key.String()) != gobreaker.StateOpen {
+			healthy++
+		}
+	}
+	return healthy, total
+}
+
+// CheckCriticalRoutes fails with a *CriticalRoutesError when an enabled
+// critical route has no healthy backend. Routes come from the route table
+// while it is fresh, otherwise from the database. Critical routes found down
+// or back up since the last check are logged and published.
+func (h *ProxyHandler) CheckCriticalRoutes(ctx context.Context) error {
+	var routes []database.Route
+	if table := h.routeTable.Load(); table != nil && time.Now().Before(table.expires) {
+		routes = table.routes
+	} else {
+		var err error
+		if routes, err = h.repo.FindAll(ctx); err != nil {
+			return err
+		}
+	}
+
+	var down []CriticalRoute
+	checked := make(map[int]CriticalRoute)
+	for i := range routes {
+		route := &routes[i]
+		if !route.Critical || !route.Enabled {
+			continue
+		}
+		healthy, total := h.RouteBackends(route)
+		state := CriticalRoute{ID: route.ID, Path: route.Path, Host: route.Host, Healthy: healthy, Total: total}
+		checked[route.ID] = state
+		if healthy == 0 {
+			down = append(down, state)
+		}
+	}
+
+	h.critical.transition(h, checked, down)
+	if len(down) > 0 {
+		return &CriticalRoutesError{Routes: down}
+	}
+	return nil
+}
+
+// transition records the routes down now, reporting those that went down
+// and those checked again that came back. Routes no longer critical, disabled
+// or deleted while down are forgotten without a report.
+func (cs *criticalStates) transition(h *ProxyHandler, checked map[int]CriticalRoute, down []CriticalRoute) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := make(map[int]bool, len(down))
+	for _, route := range down {
+		now[route.ID] = true
+		if !cs.down[route.ID] {
+			h.log.Warnf("Critical route %d %s has no healthy backend (%d backends), failing readiness", route.ID, route.Path, route.Total)
+			h.bus.Publish(events.CriticalRouteUnhealthy, route)
+		}
+	}
+	for id := range cs.down {
+		route, ok := checked[id]
+		if !ok || now[id] {
+			continue
+		}
+		h.log.Warnf("Critical route %d %s has %d of %d backends healthy again", route.ID, route.Path, route.Healthy, route.Total)
+		h.bus.Publish(events.CriticalRouteHealthy, route)
+	}
+	cs.down = now
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/deadline"
+	"github.com/zakirkun/isekai/internal/stream"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SetDeadline sets the header clients send their latency budget in, whether
+// gRPC clients' grpc-timeout is read too, and the least budget a request must
+// have left to be forwarded
+func (h *ProxyHandler) SetDeadline(header string, grpc bool, floor time.Duration) {
+	h.deadlineHeader, h.deadlineGRPC, h.deadlineFloor = header, grpc, floor
+}
+
+// applyDeadline bounds ctx by the route's timeout, counted from start, or by
+// the budget the client sent when the route trusts it, capped at the route's
+// trust_deadline_max_ms. It answers 504 when the budget left is spent or
+// below the floor, so a doomed request isn't forwarded. The returned func
+// releases the deadline.
+func (h *ProxyHandler) applyDeadline(ctx context.Context, w http.ResponseWriter, r *http.Request, route *database.Route, start time.Time) (context.Context, func(), bool) {
+	budget := time.Duration(route.Timeout) * time.Second
+	if route.TrustDeadlineMax > 0 {
+		if client, ok := deadline.FromRequest(r.Header, h.deadlineHeader, h.deadlineGRPC); ok {
+			client = min(client, time.Duration(route.TrustDeadlineMax)*time.Millisecond)
+			if budget <= 0 || client < budget {
+				budget = client
+			}
+		}
+	}
+
+	stop := func() {}
+	if budget > 0 {
+		var d *stream.Deadline
+		ctx, d = stream.WithDeadline(ctx, budget-time.Since(start))
+		stop = d.Stop
+	}
+
+	remaining, ok := stream.Remaining(ctx)
+	if !ok || (remaining > 0 && remaining >= h.deadlineFloor) {
+		return ctx, stop, false
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetStatus(codes.Error, "deadline exceeded")
+	h.log.Debugf("Refused request to %s with %v of its budget left", route.Path, remaining)
+	h.metrics.DeadlineRejected.WithLabelValues(route.Path).Inc()
+	response.ErrorFor(w, r, http.StatusGatewayTimeout, response.CodeDeadlineExceeded, "Not enough time left to forward the request")
+	h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, http.StatusGatewayTimeout, time.Since(start), r)
+	return ctx, stop, true
+}
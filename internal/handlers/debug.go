@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/matcher"
+	"github.com/zakirkun/isekai/internal/urlpath"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// proxyPattern is the catch-all pattern the proxy is mounted on
+const proxyPattern = "/*"
+
+// DebugHandler explains how requests are routed without forwarding them
+type DebugHandler struct {
+	repo    *database.RouteRepository
+	gateway chi.Routes
+	log     *logger.Logger
+}
+
+// NewDebugHandler creates a debug handler. gateway is the router serving the
+// gateway's own endpoints in front of the proxy.
+func NewDebugHandler(db *database.Database, gateway chi.Routes, log *logger.Logger) *DebugHandler {
+	return &DebugHandler{
+		repo:    database.NewRouteRepository(db),
+		gateway: gateway,
+		log:     log,
+	}
+}
+
+// MatchResult explains which route serves a request
+type MatchResult struct {
+	Method          string `json:"method"`
+	Host            string `json:"host"`
+	Path            string `json:"path"`
+	GatewayEndpoint string `json:"gateway_endpoint,omitempty"` // Pattern of the gateway endpoint answering instead of the proxy
+	*matcher.Explanation
+	Effective *EffectiveSettings `json:"effective,omitempty"`
+}
+
+// EffectiveSettings is how the matched route would handle the request
+type EffectiveSettings struct {
+	AnsweredBy     string   `json:"answered_by"`             // upstream, or maintenance, mock, echo or redirect when the gateway answers
+	Target         string   `json:"target,omitempty"`        // URL forwarded to, after blue/green and rewrites
+	Color          string   `json:"color,omitempty"`         // Active blue/green color
+	CanaryTarget   string   `json:"canary_target,omitempty"` // Receives canary_weight percent of requests instead
+	CanaryWeight   int      `json:"canary_weight,omitempty"`
+	LoadBalanced   bool     `json:"load_balanced"`           // Target's host is replaced by a backend's
+	UpstreamHost   string   `json:"upstream_host,omitempty"` // Host header sent upstream, unknown for load-balanced routes
+	Plugins        []string `json:"plugins"`                 // Run in order before forwarding
+	IPAllow        []string `json:"ip_allow"`
+	IPDeny         []string `json:"ip_deny"`
+	CountryAllow   []string `json:"country_allow"`
+	CountryDeny    []string `json:"country_deny"`
+	MaxConcurrency int      `json:"max_concurrency"`
+	UpstreamRate   float64  `json:"upstream_rate_limit"`
+	Idempotent     bool     `json:"idempotent"`
+	Dedup          bool     `json:"dedup"`
+	MirrorURL      string   `json:"mirror_url,omitempty"`
+	MirrorPercent  int      `json:"mirror_percent,omitempty"`
+	TenantID       string   `json:"tenant_id,omitempty"`
+}
+
+// GatewayEndpoint is a pattern served by the gateway itself
+type GatewayEndpoint struct {
+	Pattern string   `json:"pattern"`
+	Methods []string `json:"methods"`
+}
+
+// RouteTable is the compiled route table
+type RouteTable struct {
+	Gateway []GatewayEndpoint `json:"gateway"` // Shadow proxied routes on the same paths
+	Routes  []matcher.Entry   `json:"routes"`
+}
+
+// Match handles explaining a route match
+// @Summary Explain a route match
+// @Description Run the proxy's route matching for a method, host and path without forwarding anything, returning the matched route, its effective settings and why the other routes for the path were passed over
+// @Tags admin
+// @Produce json
+// @Param path query string true "Request path"
+// @Param method query string false "Request method, GET by default"
+// @Param host query string false "Request host"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Failure 503 {object} response.Response
+// @Security BearerAuth
+// @Router /api/debug/match [get]
+func (h *DebugHandler) Match(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "handler.DebugHandler.Match")
+	defer span.End()
+
+	query := r.URL.Query()
+	requestURL, err := url.ParseRequestURI(query.Get("path"))
+	if err != nil || !strings.HasPrefix(requestURL.Path, "/") {
+		span.SetStatus(codes.Error, "invalid path")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "path must be an absolute request path")
+		return
+	}
+	original := requestURL
+	requestURL = urlpath.Normalize(requestURL)
+	method := strings.ToUpper(query.Get("method"))
+	if method == "" {
+		method = http.MethodGet
+	}
+	host := query.Get("host")
+
+	routes, err := h.repo.FindAll(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve routes")
+		logQueryError(h.log, err, "Failed to load routes")
+		if database.IsUnavailable(err) {
+			response.ServiceUnavailable(w, "Database unavailable")
+			return
+		}
+		response.InternalServerError(w, "Failed to retrieve routes")
+		return
+	}
+
+	result := &MatchResult{
+		Method:          method,
+		Host:            host,
+		Path:            requestURL.Path,
+		GatewayEndpoint: h.gatewayEndpoint(method, requestURL.Path),
+		Explanation:     matcher.New(routes).Explain(method, host, requestURL.Path),
+	}
+	if route := result.Route; route != nil {
+		forwarded := requestURL
+		if route.PreservePath {
+			forwarded = original
+		}
+		result.Effective = effectiveSettings(route, host, forwarded)
+		span.SetAttributes(attribute.Int("route.id", route.ID))
+	}
+
+	span.SetAttributes(
+		attribute.Int("debug.status", result.Status),
+		attribute.String("debug.gateway_endpoint", result.GatewayEndpoint),
+	)
+	span.SetStatus(codes.Ok, "match explained")
+	response.Success(w, "Match explained", result)
+}
+
+// Routes handles dumping the compiled route table
+// @Summary Dump the route table
+// @Description List the gateway's own endpoint patterns and every route, disabled ones included, with how its path, host and method match
+// @Tags admin
+// @Produce json
+// @Success 200 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Failure 503 {object} response.Response
+// @Security BearerAuth
+// @Router /api/debug/routes [get]
+func (h *DebugHandler) Routes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "handler.DebugHandler.Routes")
+	defer span.End()
+
+	routes, err := h.repo.FindAll(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve routes")
+		logQueryError(h.log, err, "Failed to load routes")
+		if database.IsUnavailable(err) {
+			response.ServiceUnavailable(w, "Database unavailable")
+			return
+		}
+		response.InternalServerError(w, "Failed to retrieve routes")
+		return
+	}
+
+	table := &RouteTable{Gateway: h.gatewayEndpoints(), Routes: matcher.New(routes).Table()}
+	span.SetAttributes(attribute.Int("routes.count", len(table.Routes)))
+	span.SetStatus(codes.Ok, "route table dumped")
+	response.Success(w, "Route table retrieved", table)
+}
+
+// gatewayEndpoint returns the pattern of the gateway endpoint a request
+// reaches instead of the proxy, or "" when it is proxied. Paths under a
+// gateway prefix belong to the gateway even when no endpoint matches them.
+func (h *DebugHandler) gatewayEndpoint(method, path string) string {
+	if h.gateway == nil {
+		return ""
+	}
+	rctx := chi.NewRouteContext()
+	h.gateway.Match(rctx, method, path)
+	if len(rctx.RoutePatterns) == 0 || rctx.RoutePatterns[0] == proxyPattern {
+		return ""
+	}
+	return rctx.RoutePattern()
+}
+
+// gatewayEndpoints lists the patterns served by the gateway itself, leaving
+// out the proxy's catch-all
+func (h *DebugHandler) gatewayEndpoints() []GatewayEndpoint {
+	endpoints := []GatewayEndpoint{}
+	if h.gateway == nil {
+		return endpoints
+	}
+	index := make(map[string]int)
+	chi.Walk(h.gateway, func(method, pattern string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if pattern == proxyPattern {
+			return nil
+		}
+		i, ok := index[pattern]
+		if !ok {
+			i = len(endpoints)
+			index[pattern] = i
+			endpoints = append(endpoints, GatewayEndpoint{Pattern: pattern})
+		}
+		endpoints[i].Methods = append(endpoints[i].Methods, method)
+		return nil
+	})
+	for i := range endpoints {
+		slices.Sort(endpoints[i].Methods)
+	}
+	slices.SortFunc(endpoints, func(a, b GatewayEndpoint) int {
+		return strings.Compare(a.Pattern, b.Pattern)
+	})
+	return endpoints
+}
+
+// effectiveSettings resolves how route handles a request for requestURL,
+// taking the active blue/green color and applying the route's rewrite
+func effectiveSettings(route *database.Route, host string, requestURL *url.URL) *EffectiveSettings {
+	settings := &EffectiveSettings{
+		AnsweredBy:     "upstream",
+		LoadBalanced:   route.LoadBalanced,
+		Plugins:        make([]string, 0, len(route.Plugins)),
+		IPAllow:        route.IPAllow,
+		IPDeny:         route.IPDeny,
+		CountryAllow:   route.CountryAllow,
+		CountryDeny:    route.CountryDeny,
+		MaxConcurrency: route.MaxConcurrency,
+		UpstreamRate:   route.UpstreamRateLimit,
+		Idempotent:     route.Idempotent,
+		Dedup:          route.Dedup != nil,
+		MirrorURL:      route.MirrorURL,
+		MirrorPercent:  route.MirrorPercent,
+		TenantID:       route.TenantID,
+	}
+	for _, spec := range route.Plugins {
+		settings.Plugins = append(settings.Plugins, spec.Name)
+	}
+
+	switch {
+	case route.MaintenanceEnabled:
+		settings.AnsweredBy = "maintenance"
+		return settings
+	case route.Type == database.RouteTypeMock, route.Type == database.RouteTypeEcho, route.Type == database.RouteTypeRedirect:
+		settings.AnsweredBy = route.Type
+		return settings
+	}
+
+	target := route.TargetURL
+	if route.BlueGreen != nil {
+		settings.Color = route.BlueGreen.Active
+		target = route.BlueGreen.Target(settings.Color)
+	}
+	if route.CanaryURL != "" {
+		settings.CanaryTarget, settings.CanaryWeight = route.CanaryURL, route.CanaryWeight
+	}
+	if route.Rewrite != nil {
+		target = route.Rewrite.Target(target, requestURL)
+	}
+	settings.Target = target
+
+	switch {
+	case route.PreserveHost:
+		settings.UpstreamHost = host
+	case !route.LoadBalanced:
+		if parsed, err := url.Parse(target); err == nil {
+			settings.UpstreamHost = parsed.Host
+		}
+	}
+	return settings
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/dedup"
+	"github.com/zakirkun/isekai/internal/idempotency"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SetDedup remembers the event IDs delivered to routes with deduplication in
+// store. A nil store passes every delivery through.
+func (h *ProxyHandler) SetDedup(store *dedup.Store) {
+	h.dedup = store
+}
+
+// checkDedup answers a repeated delivery of an event and returns the status
+// written. Otherwise it returns a recorder to proxy the first delivery
+// through and the function remembering it once answered, or nil when the
+// request has no event ID.
+func (h *ProxyHandler) checkDedup(ctx context.Context, w http.ResponseWriter, r *http.Request, route *database.Route) (*idempotency.Recorder, func(), int) {
+	span := trace.SpanFromContext(ctx)
+
+	id, ok := h.dedup.EventID(r, route.Dedup)
+	if !ok {
+		h.metrics.DedupRequests.WithLabelValues(route.Path, dedup.ResultNoID).Inc()
+		return nil, nil, 0
+	}
+	span.SetAttributes(attribute.String("dedup.event_id", id))
+
+	key := dedup.Key(route.ID, id)
+	duplicate, stored, err := h.dedup.Acquire(ctx, key)
+	switch {
+	case err != nil:
+		// Gave up waiting for the first delivery
+		response.ErrorFor(w, r, http.StatusGatewayTimeout, response.CodeRequestTimeout, "Request timeout")
+		return nil, nil, http.StatusGatewayTimeout
+	case duplicate:
+		span.SetAttributes(attribute.Bool("dedup.duplicate", true))
+		h.metrics.DedupRequests.WithLabelValues(route.Path, dedup.ResultDuplicate).Inc()
+		if stored != nil {
+			stored.Replay(w, dedup.DuplicateHeader)
+			return nil, nil, stored.Status
+		}
+		w.Header().Set(dedup.DuplicateHeader, "true")
+		response.Success(w, "Duplicate delivery ignored", nil)
+		return nil, nil, http.StatusOK
+	}
+
+	h.metrics.DedupRequests.WithLabelValues(route.Path, dedup.ResultFirst).Inc()
+	rec := h.dedup.Recorder(w)
+	return rec, func() { h.dedup.Release(key, route.Dedup, rec) }, 0
+}
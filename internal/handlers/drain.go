@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/zakirkun/isekai/internal/drain"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// DrainHandler takes the gateway out of rotation ahead of a shutdown
+type DrainHandler struct {
+	drainer *drain.Drainer
+	wsHub   *websocket.Hub
+	log     *logger.Logger
+}
+
+// NewDrainHandler creates a new drain handler
+func NewDrainHandler(drainer *drain.Drainer, wsHub *websocket.Hub, log *logger.Logger) *DrainHandler {
+	return &DrainHandler{
+		drainer: drainer,
+		wsHub:   wsHub,
+		log:     log,
+	}
+}
+
+// Drain starts draining the gateway
+// @Summary Drain the gateway
+// @Description Fail readiness and stop accepting WebSocket connections, then shut down once the drain period has passed and in-flight requests have finished
+// @Tags admin
+// @Produce json
+// @Success 202 {object} response.Response
+// @Success 200 {object} response.Response "Already draining"
+// @Security BearerAuth
+// @Router /api/admin/drain [post]
+func (h *DrainHandler) Drain(w http.ResponseWriter, r *http.Request) {
+	if !h.drainer.Start() {
+		response.Success(w, "Drain already in progress", h.drainer.Status())
+		return
+	}
+
+	h.wsHub.StopAccepting()
+	h.log.Warn("Drain requested, readiness now failing")
+
+	response.JSON(w, http.StatusAccepted, response.Response{
+		Success: true,
+		Message: "Drain started",
+		Data:    h.drainer.Status(),
+	})
+}
@@ -3,52 +3,118 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/accesslog"
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/audit"
 	"github.com/zakirkun/isekai/internal/auth"
 	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/canary"
+	"github.com/zakirkun/isekai/internal/chaos"
 	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/concurrency"
 	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/dedup"
+	"github.com/zakirkun/isekai/internal/egress"
+	"github.com/zakirkun/isekai/internal/etag"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/geoip"
+	"github.com/zakirkun/isekai/internal/idempotency"
+	"github.com/zakirkun/isekai/internal/inflight"
 	"github.com/zakirkun/isekai/internal/loadbalancer"
 	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/plugin"
 	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/throttle"
+	"github.com/zakirkun/isekai/internal/timewindow"
+	"github.com/zakirkun/isekai/internal/urlpath"
+	"github.com/zakirkun/isekai/pkg/httpjson"
 	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/redact"
 	"github.com/zakirkun/isekai/pkg/response"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http/httpguts"
 )
 
 var tracer = otel.Tracer("isekai-handlers")
 
 // RouteHandler handles route CRUD operations
 type RouteHandler struct {
-	repo  *database.RouteRepository
-	cache *cache.Cache
-	log   *logger.Logger
+	db        *database.Database
+	repo      *database.RouteRepository
+	auditRepo *database.AuditRepository
+	logRepo   *database.RequestLogRepository
+	cache     *cache.Cache
+	bus       *events.Bus
+	plugins   *plugin.Registry
+	log       *logger.Logger
+
+	windows windowStates // Whether scheduled routes are active, for the route list
 }
 
 // NewRouteHandler creates a new route handler
-func NewRouteHandler(db *database.Database, cache *cache.Cache, log *logger.Logger) *RouteHandler {
+func NewRouteHandler(db *database.Database, cache *cache.Cache, bus *events.Bus, log *logger.Logger) *RouteHandler {
 	return &RouteHandler{
-		repo:  database.NewRouteRepository(db),
-		cache: cache,
-		log:   log,
+		db:        db,
+		repo:      database.NewRouteRepository(db),
+		auditRepo: database.NewAuditRepository(db),
+		logRepo:   database.NewRequestLogRepository(db),
+		cache:     cache,
+		bus:       bus,
+		log:       log,
 	}
 }
 
+// recordAudit writes an audit entry for a route change inside the change's transaction
+func (h *RouteHandler) recordAudit(ctx context.Context, tx pgx.Tx, r *http.Request, routeID int, action string, before, after *database.Route) error {
+	return writeAudit(ctx, h.auditRepo.WithTx(tx), r, routeID, action, before, after)
+}
+
+// writeAudit records a route change made by r with repo
+func writeAudit(ctx context.Context, repo *database.AuditRepository, r *http.Request, routeID int, action string, before, after *database.Route) error {
+	changes, err := audit.Diff(before, after)
+	if err != nil {
+		return err
+	}
+
+	actor, clientIP := audit.Actor(r)
+	return repo.Create(ctx, &database.AuditEntry{
+		RouteID:  routeID,
+		Action:   action,
+		Actor:    actor,
+		ClientIP: clientIP,
+		Changes:  changes,
+	})
+}
+
 // List handles listing all routes
 // @Summary List all routes
 // @Description Get a list of all configured routes
 // @Tags routes
 // @Accept json
 // @Produce json
+// @Param tag query string false "Only routes carrying this tag"
+// @Param If-None-Match header string false "ETag of the list the client holds"
 // @Success 200 {object} response.Response
+// @Success 304 "The client's list is current"
 // @Failure 500 {object} response.Response
+// @Failure 503 {object} response.Response
 // @Router /api/routes [get]
 func (h *RouteHandler) List(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -57,33 +123,54 @@ func (h *RouteHandler) List(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracer.Start(ctx, "handler.RouteHandler.List")
 	defer span.End()
 
-	// Try cache first
-	cacheKey := "routes:all"
-	if cached, found := h.cache.Get(cacheKey); found {
-		span.SetAttributes(attribute.Bool("cache.hit", true))
-		span.SetStatus(codes.Ok, "retrieved from cache")
-		response.Success(w, "Routes retrieved from cache", cached)
-		return
-	}
-
-	span.SetAttributes(attribute.Bool("cache.hit", false))
-
-	routes, err := h.repo.FindAll(ctx)
+	// Concurrent misses share one query, tagged once for conditional requests
+	cachedRoutes, cached, err := h.cache.GetOrLoad(ctx, "routes:all", 2*time.Minute, func(ctx context.Context) (interface{}, error) {
+		routes, err := h.repo.FindAll(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return etag.New(routes)
+	})
+	span.SetAttributes(attribute.Bool("cache.hit", cached))
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "failed to retrieve routes")
-		h.log.Errorf("Failed to list routes: %v", err)
+		logQueryError(h.log, err, "Failed to list routes")
+		if database.IsUnavailable(err) {
+			response.ServiceUnavailable(w, "Database unavailable")
+			return
+		}
 		response.InternalServerError(w, "Failed to retrieve routes")
 		return
 	}
 
-	span.SetAttributes(attribute.Int("routes.count", len(routes)))
+	// Callers confined to a tenant only see its routes, narrowed to a tag
+	// when one is asked for
+	entry := cachedRoutes.(*etag.Entry)
+	tag := r.URL.Query().Get("tag")
+	visible, activity := h.windows.withActivity(filterTag(filterTenant(r, entry.Value.([]database.Route)), tag), time.Now())
+
+	// Polling clients holding the same view get a 304 instead of the list.
+	// Scheduled routes coming and going change the view too.
+	w.Header().Add("Vary", "Authorization")
+	view := entry.ETag
+	if tenantID, scoped := tenantScope(r); scoped || tag != "" || activity != "" {
+		view = etag.Derive(entry.ETag, tenantID, tag, activity)
+	}
+	if etag.Serve(w, r, view, time.Time{}) {
+		span.SetStatus(codes.Ok, "not modified")
+		return
+	}
 
-	// Cache the result
-	h.cache.SetWithTTL(cacheKey, routes, 2*time.Minute)
+	if cached {
+		span.SetStatus(codes.Ok, "retrieved from cache")
+		response.Success(w, "Routes retrieved from cache", visible)
+		return
+	}
 
+	span.SetAttributes(attribute.Int("routes.count", len(visible)))
 	span.SetStatus(codes.Ok, "success")
-	response.Success(w, "Routes retrieved", routes)
+	response.Success(w, "Routes retrieved", visible)
 }
 
 // Get handles getting a single route by ID
@@ -93,10 +180,14 @@ func (h *RouteHandler) List(w http.ResponseWriter, r *http.Request) {
 // @Accept json
 // @Produce json
 // @Param id path int true "Route ID"
+// @Param If-None-Match header string false "ETag of the route the client holds"
+// @Param If-Modified-Since header string false "Last-Modified of the route the client holds"
 // @Success 200 {object} response.Response
+// @Success 304 "The client's route is current"
 // @Failure 400 {object} response.Response
 // @Failure 404 {object} response.Response
 // @Failure 500 {object} response.Response
+// @Failure 503 {object} response.Response
 // @Router /api/routes/{id} [get]
 func (h *RouteHandler) Get(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -116,28 +207,40 @@ func (h *RouteHandler) Get(w http.ResponseWriter, r *http.Request) {
 
 	span.SetAttributes(attribute.Int("route.id", id))
 
-	// Try cache first
-	cacheKey := "route:" + idStr
-	if cached, found := h.cache.Get(cacheKey); found {
-		span.SetAttributes(attribute.Bool("cache.hit", true))
-		span.SetStatus(codes.Ok, "route retrieved from cache")
-		response.Success(w, "Route retrieved from cache", cached)
-		return
-	}
-
-	span.SetAttributes(attribute.Bool("cache.hit", false))
-
-	route, err := h.repo.FindByID(ctx, id)
+	// Concurrent misses share one query, tagged once for conditional requests
+	cachedRoute, cached, err := h.cache.GetOrLoad(ctx, "route:"+idStr, 2*time.Minute, func(ctx context.Context) (interface{}, error) {
+		route, err := h.repo.FindByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return etag.New(route)
+	})
+	span.SetAttributes(attribute.Bool("cache.hit", cached))
 	if err != nil {
-		h.log.Errorf("Failed to get route %d: %v", id, err)
+		logQueryError(h.log, err, "Failed to get route %d", id)
 		span.RecordError(err)
+		if database.IsUnavailable(err) {
+			span.SetStatus(codes.Error, "database unavailable")
+			response.ServiceUnavailable(w, "Database unavailable")
+			return
+		}
 		span.SetStatus(codes.Error, "route not found")
-		response.NotFound(w, "Route not found")
+		response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+		return
+	}
+
+	entry := cachedRoute.(*etag.Entry)
+	route := entry.Value.(*database.Route)
+	if etag.Serve(w, r, entry.ETag, route.UpdatedAt) {
+		span.SetStatus(codes.Ok, "not modified")
 		return
 	}
 
-	// Cache the result
-	h.cache.SetWithTTL(cacheKey, route, 2*time.Minute)
+	if cached {
+		span.SetStatus(codes.Ok, "route retrieved from cache")
+		response.Success(w, "Route retrieved from cache", route)
+		return
+	}
 
 	span.SetStatus(codes.Ok, "route retrieved")
 	response.Success(w, "Route retrieved", route)
@@ -152,6 +255,8 @@ func (h *RouteHandler) Get(w http.ResponseWriter, r *http.Request) {
 // @Param route body database.Route true "Route object"
 // @Success 201 {object} response.Response
 // @Failure 400 {object} response.Response
+// @Failure 403 {object} response.Response
+// @Failure 409 {object} response.Response
 // @Failure 500 {object} response.Response
 // @Security BearerAuth
 // @Router /api/routes [post]
@@ -163,17 +268,22 @@ func (h *RouteHandler) Create(w http.ResponseWriter, r *http.Request) {
 	defer span.End()
 
 	var route database.Route
-	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+	if err := httpjson.Decode(w, r, &route); err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "invalid request body")
-		response.BadRequest(w, "Invalid request body")
+		httpjson.WriteError(w, err)
 		return
 	}
 
-	// Validate required fields
-	if route.Path == "" || route.TargetURL == "" {
-		span.SetStatus(codes.Error, "missing required fields")
-		response.BadRequest(w, "Path and target URL are required")
+	if err := scopeTenant(r, &route); err != nil {
+		span.SetStatus(codes.Error, "foreign tenant")
+		response.ErrorCode(w, http.StatusForbidden, response.CodeForbidden, err.Error())
+		return
+	}
+
+	if err := ValidateRoute(&route, h.plugins); err != nil {
+		span.SetStatus(codes.Error, "invalid route")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
 		return
 	}
 
@@ -183,10 +293,19 @@ func (h *RouteHandler) Create(w http.ResponseWriter, r *http.Request) {
 		attribute.String("route.target_url", route.TargetURL),
 	)
 
-	if err := h.repo.Create(ctx, &route); err != nil {
-		h.log.Errorf("Failed to create route: %v", err)
+	err := h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		if err := h.repo.WithTx(tx).Create(ctx, &route); err != nil {
+			return err
+		}
+		return h.recordAudit(ctx, tx, r, route.ID, database.AuditActionCreate, nil, &route)
+	})
+	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "failed to create route")
+		if writeRouteConflict(w, err) {
+			return
+		}
+		logQueryError(h.log, err, "Failed to create route")
 		response.InternalServerError(w, "Failed to create route")
 		return
 	}
@@ -197,6 +316,8 @@ func (h *RouteHandler) Create(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(attribute.Int("route.id", route.ID))
 	span.SetStatus(codes.Ok, "route created")
 
+	h.bus.Publish(events.RouteCreated, route)
+
 	h.log.Infof("Route created: %s -> %s", route.Path, route.TargetURL)
 	response.JSON(w, http.StatusCreated, response.Response{
 		Success: true,
@@ -215,7 +336,9 @@ func (h *RouteHandler) Create(w http.ResponseWriter, r *http.Request) {
 // @Param route body database.Route true "Route object"
 // @Success 200 {object} response.Response
 // @Failure 400 {object} response.Response
+// @Failure 403 {object} response.Response
 // @Failure 404 {object} response.Response
+// @Failure 409 {object} response.Response
 // @Failure 500 {object} response.Response
 // @Security BearerAuth
 // @Router /api/routes/{id} [put]
@@ -238,19 +361,24 @@ func (h *RouteHandler) Update(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(attribute.Int("route.id", id))
 
 	var route database.Route
-	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+	if err := httpjson.Decode(w, r, &route); err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "invalid request body")
-		response.BadRequest(w, "Invalid request body")
+		httpjson.WriteError(w, err)
 		return
 	}
 
 	route.ID = id
 
-	// Validate required fields
-	if route.Path == "" || route.TargetURL == "" {
-		span.SetStatus(codes.Error, "missing required fields")
-		response.BadRequest(w, "Path and target URL are required")
+	if err := scopeTenant(r, &route); err != nil {
+		span.SetStatus(codes.Error, "foreign tenant")
+		response.ErrorCode(w, http.StatusForbidden, response.CodeForbidden, err.Error())
+		return
+	}
+
+	if err := ValidateRoute(&route, h.plugins); err != nil {
+		span.SetStatus(codes.Error, "invalid route")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
 		return
 	}
 
@@ -260,10 +388,30 @@ func (h *RouteHandler) Update(w http.ResponseWriter, r *http.Request) {
 		attribute.String("route.target_url", route.TargetURL),
 	)
 
-	if err := h.repo.Update(ctx, &route); err != nil {
-		h.log.Errorf("Failed to update route %d: %v", id, err)
+	err = h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		repo := h.repo.WithTx(tx)
+
+		before, err := repo.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := repo.Update(ctx, &route); err != nil {
+			return err
+		}
+		return h.recordAudit(ctx, tx, r, id, audit.UpdateAction(before, &route), before, &route)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		span.SetStatus(codes.Error, "route not found")
+		response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+		return
+	}
+	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "failed to update route")
+		if writeRouteConflict(w, err) {
+			return
+		}
+		logQueryError(h.log, err, "Failed to update route %d", id)
 		response.InternalServerError(w, "Failed to update route")
 		return
 	}
@@ -274,10 +422,175 @@ func (h *RouteHandler) Update(w http.ResponseWriter, r *http.Request) {
 
 	span.SetStatus(codes.Ok, "route updated")
 
+	h.bus.Publish(events.RouteUpdated, route)
+
 	h.log.Infof("Route updated: %d", id)
 	response.Success(w, "Route updated successfully", route)
 }
 
+// Patch handles partially updating a route
+// @Summary Patch a route
+// @Description Change only the fields present in the body, e.g. {"canary_weight": 25}
+// @Tags routes
+// @Accept json
+// @Produce json
+// @Param id path int true "Route ID"
+// @Param route body object true "Route fields to change"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 403 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 409 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/routes/{id} [patch]
+func (h *RouteHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.RouteHandler.Patch")
+	defer span.End()
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid route ID")
+		response.BadRequest(w, "Invalid route ID")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("route.id", id))
+
+	var body json.RawMessage
+	if err := httpjson.Decode(w, r, &body); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+
+	var route database.Route
+	var invalid error
+	invalidStatus, invalidCode := http.StatusBadRequest, response.CodeValidationFailed
+	err = h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		repo := h.repo.WithTx(tx)
+
+		before, err := repo.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		// Apply the body over a copy so omitted fields keep their values
+		route = *before
+		route.IPAllow = append([]string(nil), before.IPAllow...)
+		route.IPDeny = append([]string(nil), before.IPDeny...)
+		route.SensitiveHeaders = append([]string(nil), before.SensitiveHeaders...)
+		route.BreakerStatuses = append([]int(nil), before.BreakerStatuses...)
+		route.Tags = append([]string(nil), before.Tags...)
+		route.Transform, route.TLS, route.Mock, route.UpstreamAuth = nil, nil, nil, nil
+		route.Redirect, route.Rewrite, route.Dedup, route.SLO, route.Breaker, route.Egress = nil, nil, nil, nil, nil, nil
+		route.ActiveFrom, route.ActiveUntil, route.Schedule = nil, nil, nil
+		if before.BlueGreen != nil {
+			deployment := *before.BlueGreen
+			route.BlueGreen = &deployment
+		}
+		var fields map[string]json.RawMessage
+		if invalid = httpjson.Unmarshal(body, &fields); invalid == nil {
+			invalid = httpjson.Unmarshal(body, &route)
+		}
+		if invalid != nil {
+			invalidCode = response.CodeInvalidBody
+			return invalid
+		}
+		// A transform, TLS profile, mock, upstream auth, redirect, rewrite,
+		// dedup config, SLO, breaker settings, egress profile or schedule in
+		// the body replace the stored ones as a whole
+		if _, ok := fields["transform"]; !ok {
+			route.Transform = before.Transform
+		}
+		if _, ok := fields["tls"]; !ok {
+			route.TLS = before.TLS
+		}
+		if _, ok := fields["mock"]; !ok {
+			route.Mock = before.Mock
+		}
+		if _, ok := fields["upstream_auth"]; !ok {
+			route.UpstreamAuth = before.UpstreamAuth
+		}
+		if _, ok := fields["redirect"]; !ok {
+			route.Redirect = before.Redirect
+		}
+		if _, ok := fields["rewrite"]; !ok {
+			route.Rewrite = before.Rewrite
+		}
+		if _, ok := fields["dedup"]; !ok {
+			route.Dedup = before.Dedup
+		}
+		if _, ok := fields["slo"]; !ok {
+			route.SLO = before.SLO
+		}
+		if _, ok := fields["breaker"]; !ok {
+			route.Breaker = before.Breaker
+		}
+		if _, ok := fields["egress"]; !ok {
+			route.Egress = before.Egress
+		}
+		if _, ok := fields["active_from"]; !ok {
+			route.ActiveFrom = before.ActiveFrom
+		}
+		if _, ok := fields["active_until"]; !ok {
+			route.ActiveUntil = before.ActiveUntil
+		}
+		if _, ok := fields["schedule"]; !ok {
+			route.Schedule = before.Schedule
+		}
+		route.ID = id
+		if invalid = scopeTenant(r, &route); invalid != nil {
+			invalidStatus, invalidCode = http.StatusForbidden, response.CodeForbidden
+			return invalid
+		}
+		if invalid = ValidateRoute(&route, h.plugins); invalid != nil {
+			return invalid
+		}
+
+		if err := repo.Update(ctx, &route); err != nil {
+			return err
+		}
+		return h.recordAudit(ctx, tx, r, id, audit.UpdateAction(before, &route), before, &route)
+	})
+	if invalid != nil {
+		span.SetStatus(codes.Error, "invalid route")
+		response.ErrorCode(w, invalidStatus, invalidCode, invalid.Error())
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		span.SetStatus(codes.Error, "route not found")
+		response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to update route")
+		if writeRouteConflict(w, err) {
+			return
+		}
+		logQueryError(h.log, err, "Failed to patch route %d", id)
+		response.InternalServerError(w, "Failed to update route")
+		return
+	}
+
+	// Invalidate cache
+	h.cache.Delete("routes:all")
+	h.cache.Delete("route:" + idStr)
+
+	span.SetStatus(codes.Ok, "route updated")
+
+	h.bus.Publish(events.RouteUpdated, route)
+
+	h.log.Infof("Route patched: %d", id)
+	response.Success(w, "Route updated successfully", route)
+}
+
 // Delete handles deleting a route
 // @Summary Delete a route
 // @Description Delete a route by its ID
@@ -287,6 +600,7 @@ func (h *RouteHandler) Update(w http.ResponseWriter, r *http.Request) {
 // @Param id path int true "Route ID"
 // @Success 200 {object} response.Response
 // @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
 // @Failure 500 {object} response.Response
 // @Security BearerAuth
 // @Router /api/routes/{id} [delete]
@@ -308,8 +622,25 @@ func (h *RouteHandler) Delete(w http.ResponseWriter, r *http.Request) {
 
 	span.SetAttributes(attribute.Int("route.id", id))
 
-	if err := h.repo.Delete(ctx, id); err != nil {
-		h.log.Errorf("Failed to delete route %d: %v", id, err)
+	err = h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		repo := h.repo.WithTx(tx)
+
+		before, err := repo.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := repo.Delete(ctx, id); err != nil {
+			return err
+		}
+		return h.recordAudit(ctx, tx, r, id, database.AuditActionDelete, before, nil)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		span.SetStatus(codes.Error, "route not found")
+		response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+		return
+	}
+	if err != nil {
+		logQueryError(h.log, err, "Failed to delete route %d", id)
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "failed to delete route")
 		response.InternalServerError(w, "Failed to delete route")
@@ -322,6 +653,8 @@ func (h *RouteHandler) Delete(w http.ResponseWriter, r *http.Request) {
 
 	span.SetStatus(codes.Ok, "route deleted")
 
+	h.bus.Publish(events.RouteDeleted, map[string]int{"id": id})
+
 	h.log.Infof("Route deleted: %d", id)
 	response.Success(w, "Route deleted successfully", nil)
 }
@@ -333,18 +666,58 @@ type ProxyHandler struct {
 	cache          *cache.Cache
 	cb             *circuitbreaker.CircuitBreaker
 	lb             *loadbalancer.LoadBalancer
+	mirror         *proxy.Mirror
+	idempotency    *idempotency.Store
 	metrics        *metrics.Metrics
 	log            *logger.Logger
 	requestLogRepo *database.RequestLogRepository
+
+	plugins  *plugin.Registry
+	chainsMu sync.Mutex
+	chains   map[int]*routeChain // Plugin chains by route ID
+
+	headers *redact.Headers // Headers recorded in request logs and spans, nil for none
+
+	limitersMu sync.Mutex
+	limiters   map[int]*concurrency.Limiter // Concurrency limits by route ID
+	queueSize  int                          // Requests that may wait for a route's slot
+	queueWait  time.Duration
+
+	throttlesMu       sync.Mutex
+	throttles         map[int]*throttle.Throttle // Upstream rate limits by route ID
+	throttleQueueSize int                        // Requests that may wait for a route's token
+	throttleQueueWait time.Duration
+
+	chaos *chaos.Registry // Faults injected into routes, nil for none
+
+	dedup *dedup.Store // Event IDs delivered to routes with deduplication, nil to disable
+
+	allowTrace bool // Route TRACE requests instead of rejecting them
+
+	deadlineHeader string        // Header clients send their latency budget in, none when empty
+	deadlineGRPC   bool          // Reads grpc-timeout from gRPC clients
+	deadlineFloor  time.Duration // Least budget a request must have left to be forwarded
+
+	windows windowStates // Whether scheduled routes are active, until their next transition
+
+	bus      *events.Bus    // Receives critical route transitions, nil for none
+	critical criticalStates // Critical routes down at the last readiness check
+
+	routeTable    atomic.Pointer[routeTable] // Routes matched in memory, nil to query the database
+	routeTableMu  sync.Mutex                 // Serializes loading and dropping the table
+	routeTableGen uint64                     // Bumped when the table is dropped, so loads racing a change are discarded
 }
 
-// NewProxyHandler creates a new proxy handler
+// NewProxyHandler creates a new proxy handler. mirror and idem may be nil to
+// disable request mirroring and Idempotency-Key handling.
 func NewProxyHandler(
 	db *database.Database,
 	proxy *proxy.Proxy,
 	cache *cache.Cache,
 	cb *circuitbreaker.CircuitBreaker,
 	lb *loadbalancer.LoadBalancer,
+	mirror *proxy.Mirror,
+	idem *idempotency.Store,
 	metrics *metrics.Metrics,
 	log *logger.Logger,
 ) *ProxyHandler {
@@ -354,78 +727,785 @@ func NewProxyHandler(
 		cache:          cache,
 		cb:             cb,
 		lb:             lb,
+		mirror:         mirror,
+		idempotency:    idem,
 		metrics:        metrics,
 		log:            log,
 		requestLogRepo: database.NewRequestLogRepository(db),
+		chains:         make(map[int]*routeChain),
+		limiters:       make(map[int]*concurrency.Limiter),
+		throttles:      make(map[int]*throttle.Throttle),
 	}
 }
 
 // Handle handles proxy requests with circuit breaker and load balancing
 func (h *ProxyHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	w, r, sizes := countTransfer(w, r)
+	bodyless := newBodylessWriter(w, r)
+	defer bodyless.finish()
+	w = bodyless
 	ctx := r.Context()
 	startTime := time.Now()
 
 	// Start tracing span
 	ctx, span := tracer.Start(ctx, "handler.ProxyHandler.Handle",
+		trace.WithSpanKind(trace.SpanKindServer),
 		trace.WithAttributes(
-			attribute.String("http.method", r.Method),
-			attribute.String("http.path", r.URL.Path),
-			attribute.String("http.client_ip", r.RemoteAddr),
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
 		),
 	)
 	defer span.End()
+	if addr, ok := acl.ClientIP(r); ok {
+		span.SetAttributes(semconv.ClientAddress(addr.String()))
+	}
+
+	// Match and log the normalized path
+	var original *url.URL
+	if normalized := urlpath.Normalize(r.URL); normalized != r.URL {
+		original = r.URL
+		r = r.WithContext(ctx)
+		r.URL = normalized
+	}
+
+	// TRACE would reflect the request, credentials included, to the client
+	if r.Method == http.MethodTrace && !h.allowTrace {
+		span.SetStatus(codes.Error, "trace not allowed")
+		w.Header().Set("Allow", traceAllow)
+		response.ErrorFor(w, r, http.StatusMethodNotAllowed, response.CodeMethodNotAllowed, "TRACE is not allowed")
+		h.logRequest(ctx, nil, r.Method, r.URL.Path, http.StatusMethodNotAllowed, time.Since(startTime), r)
+		return
+	}
 
 	// Find matching route
-	route, err := h.repo.FindByPath(ctx, r.URL.Path, r.Method)
+	route, err := h.findRoute(ctx, r.Host, r.URL.Path, r.Method)
+	if database.IsCanceled(err) {
+		// The client went away or the request timed out mid-lookup, which
+		// says nothing about the database
+		span.SetStatus(codes.Error, "request canceled")
+		h.log.Debugf("Route lookup canceled for %s %s: %v", r.Method, r.URL.Path, err)
+		h.logRequest(ctx, nil, r.Method, r.URL.Path, proxy.StatusClientClosed, time.Since(startTime), r)
+		return
+	}
+	if database.IsUnavailable(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "database unavailable")
+		h.log.Warnf("Route lookup failed for %s %s: %v", r.Method, r.URL.Path, err)
+		response.ErrorFor(w, r, http.StatusServiceUnavailable, response.CodeServiceUnavailable, "Route lookup unavailable")
+		return
+	}
+	var notAllowed *database.MethodNotAllowedError
+	if errors.As(err, &notAllowed) {
+		span.SetAttributes(attribute.Bool("route.found", false), attribute.StringSlice("route.allowed_methods", notAllowed.Allowed))
+		ctx = h.withHeaders(ctx, r, nil)
+		h.log.Debugf("No route for %s %s, allowed: %v", r.Method, r.URL.Path, notAllowed.Allowed)
+		w.Header().Set("Allow", strings.Join(notAllowed.Allowed, ", "))
+		response.ErrorFor(w, r, http.StatusMethodNotAllowed, response.CodeMethodNotAllowed, "Method not allowed")
+		h.logRequest(ctx, nil, r.Method, r.URL.Path, http.StatusMethodNotAllowed, time.Since(startTime), r)
+		return
+	}
 	if err != nil {
 		span.SetAttributes(attribute.Bool("route.found", false))
-		span.SetStatus(codes.Error, "route not found")
+		ctx = h.withHeaders(ctx, r, nil)
 		h.log.Debugf("No route found for %s %s", r.Method, r.URL.Path)
-		response.NotFound(w, "Route not found")
+		response.ErrorFor(w, r, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
 
 		// Log failed request with no route
 		h.logRequest(ctx, nil, r.Method, r.URL.Path, http.StatusNotFound, time.Since(startTime), r)
 		return
 	}
 
+	// Label request metrics with the route rather than the raw path
+	metrics.SetRouteLabel(ctx, route.Path)
+	defer h.observeSizes(route.Path, sizes)
+	accesslog.SetRoute(ctx, route.ID)
+	inflight.SetRoute(ctx, route.ID, route.Path)
+	if route.SkipSecurityHeaders {
+		middleware.SkipSecurityHeaders(ctx)
+	}
+	ctx = h.withHeaders(ctx, r, route)
+	ctx = withTenant(ctx, route.TenantID)
+	ctx = withTag(ctx, metricsTag(route))
+
 	span.SetAttributes(
+		semconv.HTTPRoute(route.Path),
 		attribute.Bool("route.found", true),
 		attribute.Int("route.id", route.ID),
 		attribute.String("route.target_url", route.TargetURL),
 		attribute.Bool("route.enabled", route.Enabled),
+		attribute.String("route.tenant", route.TenantID),
 	)
 
 	if !route.Enabled {
-		response.ServiceUnavailable(w, "Route is disabled")
+		response.ErrorFor(w, r, http.StatusServiceUnavailable, response.CodeRouteDisabled, "Route is disabled")
 		routeIDPtr := &route.ID
 		h.logRequest(ctx, routeIDPtr, r.Method, r.URL.Path, http.StatusServiceUnavailable, time.Since(startTime), r)
 		return
 	}
 
-	// Use circuit breaker for proxying
-	result, err := h.cb.Execute(route.TargetURL, func() (interface{}, error) {
-		return nil, h.proxy.ForwardAndCopy(ctx, w, r, route.TargetURL)
-	})
+	// Outside its active window the route is treated as disabled
+	if !h.windows.active(route, startTime) {
+		span.SetAttributes(attribute.Bool("route.active", false))
+		status := writeInactive(w, r, route)
+		h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, status, time.Since(startTime), r)
+		return
+	}
+
+	// Enforce the route's IP allow/deny lists before forwarding
+	if allowed, reason := h.checkRouteACL(route, r); !allowed {
+		span.SetAttributes(attribute.String("acl.reason", reason))
+		h.metrics.ACLBlocked.WithLabelValues("route", reason).Inc()
+		response.ErrorFor(w, r, http.StatusForbidden, response.CodeAccessDenied, "Access denied")
+		h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, http.StatusForbidden, time.Since(startTime), r)
+		return
+	}
+
+	// Enforce the route's country lists when client countries are looked up
+	if country, ok := geoip.CountryFromContext(ctx); ok {
+		span.SetAttributes(attribute.String("client.geo.country_iso_code", country))
+		if allowed, reason := geoip.Check(country, route.CountryAllow, route.CountryDeny); !allowed {
+			span.SetAttributes(attribute.String("acl.reason", reason))
+			h.metrics.ACLBlocked.WithLabelValues("route", reason).Inc()
+			response.ErrorFor(w, r, http.StatusForbidden, response.CodeAccessDenied, "Access denied")
+			h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, http.StatusForbidden, time.Since(startTime), r)
+			return
+		}
+	}
+
+	// Answer directly while the route's upstream is under maintenance
+	if route.MaintenanceEnabled {
+		span.SetAttributes(attribute.Bool("route.maintenance", true))
+		status := writeMaintenance(w, r, route)
+		h.metrics.MaintenanceResponses.WithLabelValues(route.Path).Inc()
+		h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, status, time.Since(startTime), r)
+		return
+	}
+
+	// Hold one of the route's concurrency slots until the request is done
+	if limiter := h.limiter(route); limiter != nil {
+		release, err := limiter.Acquire(ctx)
+		if err != nil {
+			span.SetAttributes(attribute.String("route.concurrency_rejected", concurrency.Reason(err)))
+			middleware.RejectConcurrency(w, r, h.metrics, route.Path, err)
+			h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, http.StatusServiceUnavailable, time.Since(startTime), r)
+			return
+		}
+		defer release()
+	}
+
+	// Run the route's plugins, which may answer the request themselves,
+	// before forwarding it
+	req := &routeRequest{route: route, start: startTime, original: original}
+	r = r.WithContext(context.WithValue(ctx, routeRequestKey{}, req))
+	if len(route.Plugins) == 0 {
+		h.forwardRoute(w, r)
+		return
+	}
+	h.runPlugins(w, r, req)
+}
+
+// forwardRoute sends a request to the route found by Handle, once it has
+// passed the route's plugins
+func (h *ProxyHandler) forwardRoute(w http.ResponseWriter, r *http.Request) {
+	req := r.Context().Value(routeRequestKey{}).(*routeRequest)
+	req.forwarded = true
+
+	ctx, route, startTime := r.Context(), req.route, req.start
+	span := trace.SpanFromContext(ctx)
+
+	// Replay the stored response to a retry repeating an Idempotency-Key
+	if route.Idempotent && h.idempotency != nil && idempotency.Applies(r) {
+		rec, status := h.checkIdempotency(ctx, w, r, route)
+		if status != 0 {
+			h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, status, time.Since(startTime), r)
+			return
+		}
+		if rec != nil {
+			defer rec.Release()
+			w = rec
+		}
+	}
+
+	// Answer repeated deliveries of an event within the route's window
+	if route.Dedup != nil && h.dedup != nil {
+		rec, release, status := h.checkDedup(ctx, w, r, route)
+		if status != 0 {
+			h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, status, time.Since(startTime), r)
+			return
+		}
+		if rec != nil {
+			defer release()
+			w = rec
+		}
+	}
+
+	// Rewrite JSON bodies with the route's transform
+	if route.Transform != nil {
+		if err := h.proxy.TransformRequest(r, route.Transform); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "request transform failed")
+			h.log.Warnf("Request transform failed for %s: %v", route.Path, err)
+			response.ErrorFor(w, r, http.StatusBadGateway, response.CodeTransformFailed, "Request body could not be transformed")
+			h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, http.StatusBadGateway, time.Since(startTime), r)
+			return
+		}
+		ctx = proxy.WithTransform(ctx, route.Transform)
+	}
+
+	// Inject the faults configured for chaos testing
+	if decision := h.chaos.Decide(route.ID); decision.Label() != "" {
+		var answered bool
+		if r, answered = h.injectFault(w, r, route, decision, startTime); answered {
+			return
+		}
+		ctx = r.Context()
+	}
+
+	// Mock and echo routes answer without an upstream
+	if route.Type == database.RouteTypeMock || route.Type == database.RouteTypeEcho {
+		status := h.serveMock(ctx, w, r, route)
+		h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, status, time.Since(startTime), r)
+		return
+	}
+
+	// Redirect routes answer with their redirect instead of proxying
+	if route.Type == database.RouteTypeRedirect {
+		status := h.serveRedirect(ctx, w, r, route)
+		h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, status, time.Since(startTime), r)
+		return
+	}
+
+	// Forward the path as the client sent it when the route opts out of
+	// normalization
+	path := r.URL.Path
+	if route.PreservePath && req.original != nil {
+		forwarded := *r.URL
+		forwarded.Path, forwarded.RawPath = req.original.Path, req.original.RawPath
+		r = r.WithContext(ctx)
+		r.URL = &forwarded
+	}
+
+	// Connect with the route's client certificate and CA settings, or over h2c
+	if route.TLS != nil {
+		ctx = proxy.WithTLS(ctx, route.TLS)
+	}
+	if route.H2C {
+		ctx = proxy.WithH2C(ctx)
+	}
+	// Reach the upstream through the route's egress proxy
+	if route.Egress != nil {
+		ctx = proxy.WithEgress(ctx, route.Egress)
+	}
+	// Keep the client's Host header rather than the target's
+	if route.PreserveHost {
+		ctx = proxy.WithPreserveHost(ctx)
+	}
+	// Sign or authenticate the forwarded request with the route's credentials
+	if route.UpstreamAuth != nil {
+		ctx = proxy.WithUpstreamAuth(ctx, route.UpstreamAuth)
+	}
+
+	// Replay a sample of the route's traffic against its mirror target
+	if h.mirror != nil && route.MirrorURL != "" && proxy.Sampled(route.MirrorPercent) {
+		h.mirror.Submit(route.Path, route.MirrorURL, r)
+	}
+
+	// Send the canary's share of traffic to its target, or blue/green routes'
+	// traffic to the active color
+	target, variant := route.TargetURL, ""
+	if route.BlueGreen != nil {
+		var color string
+		color, target = route.BlueGreen.Choose(r)
+		span.SetAttributes(attribute.String("route.color", color))
+	}
+	if route.CanaryURL != "" {
+		variant = canary.Choose(r, route.CanaryWeight)
+		if variant == canary.VariantCanary {
+			target = route.CanaryURL
+		}
+		span.SetAttributes(attribute.String("route.variant", variant))
+	}
+
+	// Rewrite routes forward the rewritten path to their target
+	if route.Rewrite != nil {
+		target = route.Rewrite.Target(target, r.URL)
+		span.SetAttributes(attribute.String("route.rewritten_url", target))
+	}
+
+	// Spread load-balanced routes over the backend pool
+	var backend *loadbalancer.Backend
+	if route.LoadBalanced && variant != canary.VariantCanary {
+		backend = h.selectBackend(w, r)
+	}
+	routeTarget := target
+	if backend != nil {
+		target = backendTarget(backend.URL, target)
+		span.SetAttributes(attribute.String("route.backend", backend.URL))
+	}
+
+	// Hold the request to the route's timeout, or to its client's deadline
+	// when the route trusts it, and refuse it when too little time is left
+	ctx, stop, answered := h.applyDeadline(ctx, w, r, route, startTime)
+	defer stop()
+	if answered {
+		return
+	}
+
+	// Use circuit breaker for proxying, racing a second backend when a
+	// hedged GET is slow to respond and failing over to the pool's next
+	// priority tier when the backend is down
+	var statusCode int
+	var err error
+	func() {
+		// An upstream body failing partway through aborts the handler with a
+		// panic, which must still take the request off the gauge
+		inflightGauge := h.metrics.UpstreamInflight.WithLabelValues(route.Path)
+		inflightGauge.Inc()
+		defer inflightGauge.Dec()
+
+		if backend != nil && hedgeable(route, r) {
+			statusCode, target, err = h.forwardHedged(ctx, w, r, route, backend, routeTarget)
+		} else if backend != nil && replayable(r) {
+			statusCode, target, err = h.forwardFailover(ctx, w, r, route, backend, routeTarget)
+		} else {
+			statusCode, err = h.forward(ctx, w, r, route, backend, target)
+		}
+	}()
+	accesslog.SetUpstream(ctx, target)
 
 	duration := time.Since(startTime)
-	statusCode := http.StatusOK
 
-	if err != nil {
-		h.log.Errorf("Proxy error for %s: %v", route.TargetURL, err)
-		h.metrics.ProxyErrors.WithLabelValues(route.TargetURL, "circuit_breaker").Inc()
-		response.ServiceUnavailable(w, "Service temporarily unavailable")
+	if errors.Is(err, proxy.ErrClientClosed) {
+		// The client went away; neither the gateway nor the upstream failed
+		h.log.Debugf("Client closed request to %s", target)
+		h.metrics.ProxyErrors.WithLabelValues(target, "client_closed").Inc()
+		statusCode = proxy.StatusClientClosed
+	} else if inflight.Cancelled(ctx) {
+		// Cancelled by an administrator; the gateway has answered
+		h.log.Warnf("Request to %s cancelled by an administrator", target)
+		h.metrics.ProxyErrors.WithLabelValues(target, "cancelled").Inc()
+		statusCode = http.StatusServiceUnavailable
+	} else if throttled(err) {
+		// Held back before reaching the upstream
+		h.log.Debugf("Upstream rate limit reached for %s: %v", route.Path, err)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("route.upstream_throttled", throttle.Reason(err)))
+		rejectThrottled(w, r)
 		statusCode = http.StatusServiceUnavailable
+	} else if err != nil {
+		h.log.Errorf("Proxy error for %s: %v", target, err)
+
+		// Upstream failures have already been answered by the proxy
+		var upstreamErr *proxy.UpstreamError
+		if errors.As(err, &upstreamErr) {
+			errorType := "upstream"
+			if egress.Failed(err) {
+				errorType = "egress_proxy"
+			} else if proxy.TLSVerifyFailed(err) {
+				errorType = "tls_verify"
+			}
+			h.metrics.ProxyErrors.WithLabelValues(target, errorType).Inc()
+			statusCode = upstreamErr.Status
+		} else {
+			h.metrics.ProxyErrors.WithLabelValues(target, "circuit_breaker").Inc()
+			response.ErrorFor(w, r, http.StatusServiceUnavailable, response.CodeCircuitOpen, "Service temporarily unavailable")
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+
+	h.metrics.UpstreamRequests.WithLabelValues(route.Path, metrics.StatusClass(statusCode)).Inc()
+	if variant != "" {
+		h.metrics.CanaryRequests.WithLabelValues(route.Path, variant, metrics.StatusClass(statusCode)).Inc()
 	}
 
 	// Log request with route ID
 	routeIDPtr := &route.ID
-	h.logRequest(ctx, routeIDPtr, r.Method, r.URL.Path, statusCode, duration, r)
+	h.logRequest(ctx, routeIDPtr, r.Method, path, statusCode, duration, r)
+}
+
+// forward sends the request to target through the route's circuit breaker and feeds
+// the outcome of a load-balanced backend to passive outlier detection
+func (h *ProxyHandler) forward(ctx context.Context, w http.ResponseWriter, r *http.Request, route *database.Route, backend *loadbalancer.Backend, target string) (int, error) {
+	if backend != nil {
+		backend.IncrementConnections()
+		defer backend.DecrementConnections()
+	}
+
+	// Every attempt, retries and hedges included, takes a token of the
+	// route's upstream rate limit
+	if err := h.waitUpstream(ctx, route); err != nil {
+		return 0, err
+	}
+
+	upstreamStart := time.Now()
+	breaker := circuitbreaker.RouteKey(route.ID, route.Path, target, route.Breaker)
+	statusCode, err := h.cb.ExecuteRoute(breaker, route.Breaker, route.BreakerStatuses, func() (int, error) {
+		return h.proxy.ForwardAndCopy(ctx, w, r, target)
+	})
+	h.metrics.UpstreamDuration.WithLabelValues(route.Path, target).Observe(time.Since(upstreamStart).Seconds())
+
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	if backend != nil {
+		if outcome, ok := upstreamOutcome(statusCode, err); ok {
+			h.lb.ReportResult(backend, outcome)
+		}
+	}
+	return statusCode, err
+}
+
+// hedgeable reports whether a request may be sent to a second backend: only
+// safe methods without a body or upgrade on routes with a hedge delay
+func hedgeable(route *database.Route, r *http.Request) bool {
+	if route.HedgeDelay <= 0 || r.ContentLength != 0 || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// forwardHedged sends the request to backend and, when no response has
+// arrived after the route's hedge delay, to another backend as well. It
+// returns the status and target of the attempt that answered the client.
+func (h *ProxyHandler) forwardHedged(ctx context.Context, w http.ResponseWriter, r *http.Request, route *database.Route, backend *loadbalancer.Backend, routeTarget string) (int, string, error) {
+	targets := []string{backendTarget(backend.URL, routeTarget), ""}
+
+	primary := func(ctx context.Context, w http.ResponseWriter) (int, error) {
+		return h.forward(ctx, w, r, route, backend, targets[0])
+	}
+	hedge := func() proxy.Attempt {
+		alternate := h.lb.Alternate(backend)
+		if alternate == nil {
+			return nil
+		}
+		targets[1] = backendTarget(alternate.URL, routeTarget)
+		return func(ctx context.Context, w http.ResponseWriter) (int, error) {
+			return h.forward(ctx, w, r, route, alternate, targets[1])
+		}
+	}
+
+	delay := time.Duration(route.HedgeDelay) * time.Millisecond
+	result := h.proxy.Hedge(ctx, w, route.Path, delay, primary, hedge)
+
+	span := trace.SpanFromContext(ctx)
+	switch {
+	case result.Hedged:
+		winner := "primary"
+		if result.Winner == 1 {
+			winner = "hedge"
+		}
+		span.SetAttributes(attribute.String("hedge.winner", winner))
+		h.metrics.HedgedRequests.WithLabelValues(route.Path, winner).Inc()
+	case result.Capped:
+		h.metrics.HedgedRequests.WithLabelValues(route.Path, "capped").Inc()
+	}
+
+	return result.Status, targets[result.Winner], result.Err
+}
+
+// replayable reports whether a request can be sent again after a failed
+// attempt: only requests without a body or upgrade
+func replayable(r *http.Request) bool {
+	return r.ContentLength == 0 && r.Header.Get("Upgrade") == ""
+}
+
+// forwardFailover sends the request to backend and, while attempts fail, on
+// to a backend in the pool's next priority tier. It returns the status and
+// target of the attempt that answered the client.
+func (h *ProxyHandler) forwardFailover(ctx context.Context, w http.ResponseWriter, r *http.Request, route *database.Route, backend *loadbalancer.Backend, routeTarget string) (int, string, error) {
+	current, target := backend, backendTarget(backend.URL, routeTarget)
+
+	first := func(ctx context.Context, w http.ResponseWriter) (int, error) {
+		return h.forward(ctx, w, r, route, backend, target)
+	}
+	next := func() proxy.Attempt {
+		following := h.lb.Failover(current)
+		if following == nil {
+			return nil
+		}
+		return func(ctx context.Context, w http.ResponseWriter) (int, error) {
+			current, target = following, backendTarget(following.URL, routeTarget)
+			h.metrics.Failovers.WithLabelValues(route.Path).Inc()
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("route.failover_backend", following.URL))
+			return h.forward(ctx, w, r, route, following, target)
+		}
+	}
+
+	result := h.proxy.Failover(ctx, w, first, next)
+	return result.Status, target, result.Err
+}
+
+// ValidateRoute checks required fields, the route type, IP access lists, the
+// tags, the mirror and canary settings, the blue/green targets, the body transform, the
+// upstream TLS and h2c settings, the maintenance response, the sensitive
+// headers and the plugins
+func ValidateRoute(route *database.Route, plugins *plugin.Registry) error {
+	if err := validateRouteType(route); err != nil {
+		return err
+	}
+	if err := acl.Validate(route.IPAllow, route.IPDeny); err != nil {
+		return err
+	}
+	if err := validateTags(route); err != nil {
+		return err
+	}
+	if len(route.Owner) > maxOwnerLength {
+		return fmt.Errorf("owner must be at most %d characters", maxOwnerLength)
+	}
+	if route.Host != "" && !database.ValidHostPattern(route.Host) {
+		return errors.New("host must be a hostname or a *.example.com wildcard")
+	}
+	for _, codes := range [][]string{route.CountryAllow, route.CountryDeny} {
+		for _, code := range codes {
+			if !geoip.ValidCountry(code) {
+				return fmt.Errorf("invalid country code %q, expected two letters such as US", code)
+			}
+		}
+	}
+
+	if route.MirrorPercent < 0 || route.MirrorPercent > 100 {
+		return errors.New("mirror_percent must be between 0 and 100")
+	}
+	if route.MirrorURL == "" && route.MirrorPercent > 0 {
+		return errors.New("mirror_url is required when mirror_percent is set")
+	}
+	if route.MirrorURL != "" && !validTargetURL(route.MirrorURL) {
+		return errors.New("mirror_url must be an absolute http or https URL")
+	}
+
+	if route.CanaryWeight < 0 || route.CanaryWeight > 100 {
+		return errors.New("canary_weight must be between 0 and 100")
+	}
+	if route.CanaryURL == "" && route.CanaryWeight > 0 {
+		return errors.New("canary_target_url is required when canary_weight is set")
+	}
+	if route.CanaryURL != "" && !validTargetURL(route.CanaryURL) {
+		return errors.New("canary_target_url must be an absolute http or https URL")
+	}
+
+	if route.BlueGreen != nil {
+		if err := route.BlueGreen.Validate(); err != nil {
+			return err
+		}
+		if route.CanaryURL != "" {
+			return errors.New("blue_green can't be combined with canary_target_url")
+		}
+		if route.LoadBalanced {
+			return errors.New("blue_green can't be combined with load_balanced")
+		}
+	}
+
+	if route.Transform != nil {
+		if err := route.Transform.Validate(); err != nil {
+			return err
+		}
+	}
+	if route.TLS != nil {
+		if err := route.TLS.Validate(); err != nil {
+			return err
+		}
+	}
+	if route.UpstreamAuth != nil {
+		if err := route.UpstreamAuth.Validate(); err != nil {
+			return err
+		}
+	}
+	if route.Dedup != nil {
+		if err := route.Dedup.Validate(); err != nil {
+			return err
+		}
+	}
+	if route.SLO != nil {
+		if err := route.SLO.Validate(); err != nil {
+			return err
+		}
+		if route.Timeout > 0 && route.SLO.LatencyMS >= route.Timeout*1000 {
+			return errors.New("slo latency_ms must be below the route timeout")
+		}
+	}
+	if route.Breaker != nil {
+		if err := route.Breaker.Validate(); err != nil {
+			return err
+		}
+	}
+	if route.Egress != nil {
+		if err := route.Egress.Validate(); err != nil {
+			return err
+		}
+		if route.H2C {
+			return errors.New("egress can't be combined with h2c")
+		}
+	}
+
+	if route.MaintenanceStatus != 0 && (route.MaintenanceStatus < 200 || route.MaintenanceStatus > 599) {
+		return errors.New("maintenance_status must be between 200 and 599")
+	}
+	if route.MaintenanceRetryAfter < 0 {
+		return errors.New("maintenance_retry_after can't be negative")
+	}
+
+	if route.HedgeDelay < 0 {
+		return errors.New("hedge_delay can't be negative")
+	}
+
+	if route.TrustDeadlineMax < 0 {
+		return errors.New("trust_deadline_max_ms can't be negative")
+	}
+
+	if route.MaxConcurrency < 0 {
+		return errors.New("max_concurrency can't be negative")
+	}
+	if route.UpstreamRateLimit < 0 || route.UpstreamBurst < 0 {
+		return errors.New("upstream_rate_limit and upstream_burst can't be negative")
+	}
+	if route.UpstreamBurst > 0 && route.UpstreamRateLimit == 0 {
+		return errors.New("upstream_burst requires upstream_rate_limit")
+	}
+	for _, status := range route.BreakerStatuses {
+		if status < 400 || status > 499 {
+			return errors.New("breaker_statuses must be between 400 and 499")
+		}
+	}
+	if route.HedgeDelay > 0 {
+		if !route.LoadBalanced {
+			return errors.New("hedge_delay requires load_balanced")
+		}
+		if route.Method != "" && route.Method != http.MethodGet && route.Method != http.MethodHead {
+			return errors.New("hedge_delay is only allowed on GET and HEAD routes")
+		}
+	}
+	if route.PassthroughOptions && route.Method != http.MethodOptions && route.Method != database.MethodAny {
+		return errors.New("passthrough_options requires a route serving OPTIONS, with method OPTIONS or *")
+	}
+
+	if route.H2C {
+		if route.TLS != nil {
+			return errors.New("h2c upstreams don't use TLS; remove tls or h2c")
+		}
+		targets := []string{route.TargetURL, route.CanaryURL}
+		if route.BlueGreen != nil {
+			targets = append(targets, route.BlueGreen.Blue, route.BlueGreen.Green)
+		}
+		for _, target := range targets {
+			if target != "" && !strings.HasPrefix(target, "http://") {
+				return errors.New("h2c requires http target URLs")
+			}
+		}
+	}
 
-	_ = result
+	if scheduled(route) {
+		if _, err := timewindow.New(route.ActiveFrom, route.ActiveUntil, route.Schedule); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range route.SensitiveHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid sensitive header %q", name)
+		}
+	}
+
+	for _, spec := range route.Plugins {
+		if spec.Name == plugin.Transform && route.Transform != nil {
+			return errors.New("the transform plugin can't be combined with the route's transform")
+		}
+	}
+	return plugins.Validate(route.Plugins)
+}
+
+// validTargetURL reports whether s is an absolute http or https URL
+func validTargetURL(s string) bool {
+	target, err := url.Parse(s)
+	return err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != ""
+}
+
+// selectBackend picks the pool backend for a request, keeping clients with a
+// sticky cookie on their backend and pinning new ones. It returns nil when the
+// pool is empty so the route's own target is used.
+func (h *ProxyHandler) selectBackend(w http.ResponseWriter, r *http.Request) *loadbalancer.Backend {
+	backend, pinned, err := h.lb.Select(r)
+	if err != nil {
+		return nil
+	}
+	if !pinned {
+		h.lb.Pin(w, backend)
+	}
+	return backend
+}
+
+// upstreamOutcome classifies a proxied attempt for outlier detection. It
+// reports false when the request never reached the backend.
+func upstreamOutcome(statusCode int, err error) (loadbalancer.Outcome, bool) {
+	if err != nil {
+		var upstreamErr *proxy.UpstreamError
+		if !errors.As(err, &upstreamErr) || errors.Is(err, context.Canceled) {
+			return "", false
+		}
+		if upstreamErr.Status == http.StatusGatewayTimeout {
+			return loadbalancer.OutcomeTimeout, true
+		}
+		return loadbalancer.OutcomeConnectError, true
+	}
+	if statusCode >= 500 {
+		return loadbalancer.OutcomeServerError, true
+	}
+	return loadbalancer.OutcomeSuccess, true
+}
+
+// backendTarget points target at a backend, keeping the target's path and query
+func backendTarget(backendURL, target string) string {
+	b, err := url.Parse(backendURL)
+	if err != nil {
+		return target
+	}
+	t, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	b.Path = strings.TrimSuffix(b.Path, "/") + t.Path
+	b.RawPath = ""
+	b.RawQuery = t.RawQuery
+	return b.String()
+}
+
+// checkRouteACL checks the client against a route's IP lists. Routes with
+// lists that fail to parse reject every client.
+func (h *ProxyHandler) checkRouteACL(route *database.Route, r *http.Request) (bool, string) {
+	if len(route.IPAllow) == 0 && len(route.IPDeny) == 0 {
+		return true, ""
+	}
+
+	list, err := acl.Parse(route.IPAllow, route.IPDeny)
+	if err != nil {
+		h.log.Errorf("Invalid IP access list on route %d: %v", route.ID, err)
+		return false, acl.ReasonInvalidList
+	}
+	return list.CheckRequest(r)
 }
 
-// logRequest logs request to database
+// logRequest records the response status on the request span and logs the
+// request to the database
 func (h *ProxyHandler) logRequest(ctx context.Context, routeID *int, method, path string, statusCode int, duration time.Duration, r *http.Request) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+	proxy.SetSpanStatus(span, statusCode)
+
+	var headers map[string]string
+	if recorded, ok := redact.FromContext(ctx); ok {
+		headers = recorded.Record(r.Header)
+	}
+
+	requestSize, responseSize := transferSizesFrom(ctx)
+	tenantID := tenantFrom(ctx)
+	country, _ := geoip.CountryFromContext(ctx)
+	if tenantID != "" {
+		h.observeTenant(tenantID, statusCode, requestSize, responseSize)
+	}
+	if tag := tagFrom(ctx); tag != "" {
+		h.observeTag(tag, statusCode, duration)
+	}
+
 	go func() {
 		logEntry := &database.RequestLog{
 			RouteID:      routeID,
@@ -435,64 +1515,98 @@ func (h *ProxyHandler) logRequest(ctx context.Context, routeID *int, method, pat
 			ResponseTime: int(duration.Milliseconds()),
 			ClientIP:     r.RemoteAddr,
 			UserAgent:    r.UserAgent(),
+			Headers:      headers,
+			Fault:        chaos.FromContext(ctx),
+			RequestSize:  requestSize,
+			ResponseSize: responseSize,
+			TenantID:     tenantID,
+			Country:      country,
 		}
 
+		// Detached from the request, which is over, but bounded by
+		// DB_QUERY_TIMEOUT so writes don't pile up while Postgres stalls
 		if err := h.requestLogRepo.Create(context.Background(), logEntry); err != nil {
-			h.log.Errorf("Failed to log request: %v", err)
+			logQueryError(h.log, err, "Failed to log request")
 		}
 	}()
 }
 
+// logQueryError logs a failed database call, at debug level when the request
+// was cancelled rather than the database failing
+func logQueryError(log *logger.Logger, err error, format string, args ...interface{}) {
+	if database.IsCanceled(err) {
+		log.Debugf(format+": %v", append(args, err)...)
+		return
+	}
+	log.Errorf(format+": %v", append(args, err)...)
+}
+
 // AuthHandler handles authentication endpoints
 type AuthHandler struct {
-	authService *auth.AuthService
-	log         *logger.Logger
+	authService       *auth.AuthService
+	db                *database.Database
+	users             *database.UserRepository
+	passwordMinLength int
+	log               *logger.Logger
 }
 
 // NewAuthHandler creates a new auth handler
-func NewAuthHandler(authService *auth.AuthService, log *logger.Logger) *AuthHandler {
+func NewAuthHandler(authService *auth.AuthService, db *database.Database, passwordMinLength int, log *logger.Logger) *AuthHandler {
 	return &AuthHandler{
-		authService: authService,
-		log:         log,
+		authService:       authService,
+		db:                db,
+		users:             database.NewUserRepository(db),
+		passwordMinLength: passwordMinLength,
+		log:               log,
 	}
 }
 
+// Bootstrap credentials accepted only until the first user account is created
+const (
+	bootstrapUsername = "admin"
+	bootstrapPassword = "password"
+)
+
 // Login handles user login
 // @Summary User login
-// @Description Authenticate user and return JWT token
+// @Description Authenticate user and return JWT token. Credentials are read from HTTP basic auth when sent, otherwise from the body.
 // @Tags auth
 // @Accept json
 // @Produce json
-// @Param credentials body object true "Login credentials"
+// @Param credentials body object false "Login credentials"
 // @Success 200 {object} response.Response
 // @Failure 400 {object} response.Response
 // @Failure 401 {object} response.Response
+// @Failure 503 {object} response.Response
 // @Router /api/auth/login [post]
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	var credentials struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
-		response.BadRequest(w, "Invalid request body")
+	if username, password, ok := r.BasicAuth(); ok {
+		credentials.Username, credentials.Password = username, password
+	} else if err := httpjson.Decode(w, r, &credentials); err != nil {
+		httpjson.WriteError(w, err)
 		return
 	}
 
-	// TODO: Validate credentials against database
-	// For now, simple hardcoded check
-	if credentials.Username != "admin" || credentials.Password != "password" {
+	claims, err := h.authenticate(ctx, credentials.Username, credentials.Password)
+	if database.IsUnavailable(err) {
+		response.ServiceUnavailable(w, "Database unavailable")
+		return
+	}
+	if err != nil {
 		response.Unauthorized(w, "Invalid credentials")
 		return
 	}
 
 	// Generate token
-	token, err := h.authService.GenerateToken(
-		"1",
-		credentials.Username,
-		[]string{"admin"},
-		24*time.Hour,
-	)
+	claims.Username = credentials.Username
+	token, err := h.authService.IssueToken(claims, 24*time.Hour)
 
 	if err != nil {
 		h.log.Errorf("Failed to generate token: %v", err)
@@ -504,3 +1618,127 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		"token": token,
 	})
 }
+
+// authenticate checks credentials against the user accounts. Until the first
+// account exists, the bootstrap admin credentials are accepted so it can be created.
+func (h *AuthHandler) authenticate(ctx context.Context, username, password string) (auth.Claims, error) {
+	user, err := h.users.FindByUsername(ctx, username)
+	if err == nil {
+		if !user.Enabled || !auth.CheckPassword(user.PasswordHash, password) {
+			return auth.Claims{}, errInvalidCredentials
+		}
+		return auth.Claims{UserID: strconv.Itoa(user.ID), Roles: user.Roles, TenantID: user.TenantID}, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return auth.Claims{}, err
+	}
+
+	count, err := h.users.Count(ctx)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	if count > 0 || username != bootstrapUsername || password != bootstrapPassword {
+		return auth.Claims{}, errInvalidCredentials
+	}
+
+	h.log.Warn("Bootstrap admin login used, create a user account to disable it")
+	return auth.Claims{UserID: "0", Roles: []string{database.RoleAdmin}}, nil
+}
+
+// ChangePassword handles a user changing their own password
+// @Summary Change password
+// @Description Change the authenticated user's password
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param passwords body object true "Current and new password"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 401 {object} response.Response
+// @Failure 403 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/auth/password [post]
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "handler.AuthHandler.ChangePassword")
+	defer span.End()
+
+	claims, err := auth.GetClaims(r)
+	if err != nil {
+		response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthMissing, auth.ErrMissingToken.Error())
+		return
+	}
+
+	var body struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := httpjson.Decode(w, r, &body); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+
+	if err := auth.ValidatePassword(body.NewPassword, h.passwordMinLength); err != nil {
+		span.SetStatus(codes.Error, "password policy")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+		return
+	}
+	if body.NewPassword == body.OldPassword {
+		span.SetStatus(codes.Error, "password unchanged")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "New password must differ from the current password")
+		return
+	}
+
+	id, err := strconv.Atoi(claims.UserID)
+	if err != nil {
+		response.NotFound(w, "User not found")
+		return
+	}
+
+	hash, err := auth.HashPassword(body.NewPassword)
+	if err != nil {
+		h.log.Errorf("Failed to hash password: %v", err)
+		response.InternalServerError(w, "Failed to change password")
+		return
+	}
+
+	err = h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		repo := h.users.WithTx(tx)
+
+		user, err := repo.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !auth.CheckPassword(user.PasswordHash, body.OldPassword) {
+			return errWrongPassword
+		}
+
+		user.PasswordHash = hash
+		return repo.Update(ctx, user)
+	})
+	switch {
+	case errors.Is(err, errWrongPassword):
+		span.SetStatus(codes.Error, "wrong password")
+		response.Forbidden(w, "Current password is incorrect")
+		return
+	case errors.Is(err, pgx.ErrNoRows):
+		span.SetStatus(codes.Error, "user not found")
+		response.NotFound(w, "User not found")
+		return
+	case err != nil:
+		logQueryError(h.log, err, "Failed to change password for user %d", id)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to change password")
+		response.InternalServerError(w, "Failed to change password")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "password changed")
+	h.log.Infof("Password changed for user %d", id)
+	response.Success(w, "Password changed successfully", nil)
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/zakirkun/isekai/internal/accesslog"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/pkg/redact"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SetHeaders sets the headers recorded in request logs and spans
+func (h *ProxyHandler) SetHeaders(headers *redact.Headers) {
+	h.headers = headers
+}
+
+// withHeaders records the request's headers on its span, masking the
+// route's sensitive headers on top of the gateway's, and returns a context
+// carrying them for the request log. route is nil when none matched.
+func (h *ProxyHandler) withHeaders(ctx context.Context, r *http.Request, route *database.Route) context.Context {
+	if h.headers == nil {
+		return ctx
+	}
+
+	headers := h.headers
+	if route != nil {
+		headers = headers.With(route.SensitiveHeaders)
+		accesslog.SetSensitiveHeaders(ctx, route.SensitiveHeaders)
+	}
+
+	span := trace.SpanFromContext(ctx)
+	for name, value := range headers.Record(r.Header) {
+		span.SetAttributes(attribute.StringSlice("http.request.header."+strings.ToLower(name), []string{value}))
+	}
+	return redact.NewContext(ctx, headers)
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/zakirkun/isekai/internal/health"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// HealthHandler serves liveness, readiness and human-oriented health endpoints
+type HealthHandler struct {
+	health *health.Checker
+	ready  *health.Checker
+}
+
+// NewHealthHandler creates a new health handler. The health checker backs
+// /health and the ready checker backs /health/ready.
+func NewHealthHandler(healthChecker, readyChecker *health.Checker) *HealthHandler {
+	return &HealthHandler{
+		health: healthChecker,
+		ready:  readyChecker,
+	}
+}
+
+// Health reports dependency health. It always returns 200 unless strict=true
+// is passed, in which case a degraded gateway returns 503.
+// @Summary Health check
+// @Description Report database and cache health
+// @Tags health
+// @Produce json
+// @Param strict query bool false "Return 503 when degraded"
+// @Success 200 {object} response.Response
+// @Failure 503 {object} response.Response
+// @Router /health [get]
+func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
+	report := h.health.Check(r.Context())
+
+	if !report.OK() && r.URL.Query().Get("strict") == "true" {
+		response.JSON(w, http.StatusServiceUnavailable, response.Response{
+			Success: false,
+			Message: "Health check failed",
+			Data:    report,
+		})
+		return
+	}
+
+	response.Success(w, "Health check completed", report)
+}
+
+// Live reports that the process is up
+// @Summary Liveness probe
+// @Description Always returns 200 while the process is running
+// @Tags health
+// @Produce json
+// @Success 200 {object} response.Response
+// @Router /health/live [get]
+func (h *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+	response.Success(w, "Alive", map[string]string{"status": health.StatusOK})
+}
+
+// Ready reports whether the gateway can serve traffic
+// @Summary Readiness probe
+// @Description Returns 503 with the failing checks when a dependency is unavailable
+// @Tags health
+// @Produce json
+// @Success 200 {object} response.Response
+// @Failure 503 {object} response.Response
+// @Router /health/ready [get]
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	report := h.ready.Check(r.Context())
+
+	if !report.OK() {
+		response.JSON(w, http.StatusServiceUnavailable, response.Response{
+			Success: false,
+			Message: "Not ready",
+			Data:    report,
+		})
+		return
+	}
+
+	response.Success(w, "Ready", report)
+}
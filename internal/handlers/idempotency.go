@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/idempotency"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// checkIdempotency answers a request repeating an Idempotency-Key from the
+// store and returns the status written. Otherwise it returns a recorder, nil
+// when the body is too large to compare, to proxy the response through.
+func (h *ProxyHandler) checkIdempotency(ctx context.Context, w http.ResponseWriter, r *http.Request, route *database.Route) (*idempotency.Recorder, int) {
+	span := trace.SpanFromContext(ctx)
+
+	hash, ok := h.idempotency.Hash(r)
+	if !ok {
+		h.metrics.IdempotentRequests.WithLabelValues(route.Path, idempotency.ResultTooLarge).Inc()
+		h.log.Debugf("Request body too large for idempotency on %s", route.Path)
+		return nil, 0
+	}
+
+	// Keys are scoped to the caller so one client can't replay another's response
+	claims, _ := auth.ClaimsFromContext(ctx)
+	key := fmt.Sprintf("idempotency:%d:%q:%s", route.ID, middleware.Subject(r, claims), r.Header.Get(idempotency.Header))
+	stored, err := h.idempotency.Acquire(ctx, key, hash)
+	switch {
+	case errors.Is(err, idempotency.ErrConflict):
+		h.metrics.IdempotentRequests.WithLabelValues(route.Path, idempotency.ResultConflict).Inc()
+		response.ErrorFor(w, r, http.StatusConflict, response.CodeKeyInProgress, "A request with this Idempotency-Key is still in progress")
+		return nil, http.StatusConflict
+	case errors.Is(err, idempotency.ErrMismatch):
+		h.metrics.IdempotentRequests.WithLabelValues(route.Path, idempotency.ResultMismatch).Inc()
+		response.ErrorFor(w, r, http.StatusUnprocessableEntity, response.CodeKeyReused, "Idempotency-Key was already used for a different request")
+		return nil, http.StatusUnprocessableEntity
+	case err != nil:
+		// Gave up waiting for the first request
+		response.ErrorFor(w, r, http.StatusGatewayTimeout, response.CodeRequestTimeout, "Request timeout")
+		return nil, http.StatusGatewayTimeout
+	case stored != nil:
+		span.SetAttributes(attribute.Bool("idempotency.replayed", true))
+		h.metrics.IdempotentRequests.WithLabelValues(route.Path, idempotency.ResultReplayed).Inc()
+		stored.Write(w)
+		return nil, stored.Status
+	}
+
+	h.metrics.IdempotentRequests.WithLabelValues(route.Path, idempotency.ResultMiss).Inc()
+	return h.idempotency.NewRecorder(w, key), 0
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/inflight"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// InFlightHandler shows and cancels the requests the gateway is serving
+type InFlightHandler struct {
+	registry *inflight.Registry
+	log      *logger.Logger
+}
+
+// NewInFlightHandler creates a new in-flight request handler
+func NewInFlightHandler(registry *inflight.Registry, log *logger.Logger) *InFlightHandler {
+	return &InFlightHandler{
+		registry: registry,
+		log:      log,
+	}
+}
+
+// InFlightList lists the requests in flight
+type InFlightList struct {
+	Requests  []inflight.Request `json:"requests"`
+	Tracked   int64              `json:"tracked"`   // Requests in flight, including younger ones filtered out
+	Untracked int64              `json:"untracked"` // Requests not tracked since startup because the registry was full
+}
+
+// List handles listing the requests in flight
+// @Summary List in-flight requests
+// @Description List the requests the gateway is serving, oldest first, with their matched route and upstream target
+// @Tags debug
+// @Produce json
+// @Param min_age query string false "Only requests in flight at least this long, such as 5s"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Security BearerAuth
+// @Router /api/debug/inflight [get]
+func (h *InFlightHandler) List(w http.ResponseWriter, r *http.Request) {
+	var minAge time.Duration
+	if value := r.URL.Query().Get("min_age"); value != "" {
+		var err error
+		if minAge, err = time.ParseDuration(value); err != nil || minAge < 0 {
+			response.BadRequest(w, "min_age must be a duration such as 5s")
+			return
+		}
+	}
+
+	response.Success(w, "In-flight requests retrieved", InFlightList{
+		Requests:  h.registry.List(minAge),
+		Tracked:   h.registry.Tracked(),
+		Untracked: h.registry.Untracked(),
+	})
+}
+
+// Cancel handles cancelling a request in flight
+// @Summary Cancel an in-flight request
+// @Description Cancel the request's context, aborting its upstream request. The client is answered with 503 REQUEST_CANCELLED unless its response already started.
+// @Tags debug
+// @Produce json
+// @Param id path string true "In-flight request ID"
+// @Success 200 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Security BearerAuth
+// @Router /api/debug/inflight/{id}/cancel [post]
+func (h *InFlightHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if unescaped, err := url.PathUnescape(id); err == nil {
+		id = unescaped
+	}
+
+	if !h.registry.Cancel(id) {
+		response.NotFound(w, "Request not in flight")
+		return
+	}
+
+	h.log.Warnf("Cancelled in-flight request %s", id)
+	response.Success(w, "Request cancelled", nil)
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Me handles a caller asking about their own token
+// @Summary Current token
+// @Description Return the validated claims of the presented token, with its roles, expiry and the seconds of validity left. A rejected token gets a 401 saying why.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} response.Response
+// @Failure 401 {object} response.Response
+// @Security BearerAuth
+// @Router /api/auth/me [get]
+func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
+	claims, err := auth.GetClaims(r)
+	if err != nil {
+		response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthMissing, auth.ErrMissingToken.Error())
+		return
+	}
+
+	response.Success(w, "Token is valid", auth.Describe(claims, time.Now()))
+}
+
+// Introspect handles checking an arbitrary token
+// @Summary Introspect token
+// @Description Validate a token and report whether it is active and, if not, why: malformed, bad_signature, unexpected_algorithm, unknown_key, expired, not_yet_valid, revoked or invalid_claims. The claims of a rejected token are unverified.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param token body object true "Token to introspect"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 401 {object} response.Response
+// @Failure 403 {object} response.Response
+// @Security BearerAuth
+// @Router /api/auth/introspect [post]
+func (h *AuthHandler) Introspect(w http.ResponseWriter, r *http.Request) {
+	_, span := tracer.Start(r.Context(), "handler.AuthHandler.Introspect")
+	defer span.End()
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := httpjson.Decode(w, r, &body); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+	if body.Token == "" {
+		span.SetStatus(codes.Error, "missing token")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "token is required")
+		return
+	}
+
+	result := h.authService.Introspect(body.Token)
+	span.SetAttributes(attribute.Bool("token.active", result.Active))
+	if !result.Active {
+		span.SetAttributes(attribute.String("token.reason", result.Reason))
+	}
+	response.Success(w, "Token introspected", result)
+}
+
+// Logout handles a caller revoking their own token
+// @Summary Logout
+// @Description Revoke the presented token until it expires
+// @Tags auth
+// @Produce json
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 401 {object} response.Response
+// @Security BearerAuth
+// @Router /api/auth/logout [post]
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, err := auth.GetClaims(r)
+	if err != nil {
+		response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthMissing, auth.ErrMissingToken.Error())
+		return
+	}
+
+	if err := h.authService.Revoke(claims); err != nil {
+		if errors.Is(err, auth.ErrNotRevocable) {
+			response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+			return
+		}
+		h.log.Errorf("Failed to revoke token: %v", err)
+		response.InternalServerError(w, "Failed to revoke token")
+		return
+	}
+
+	response.Success(w, "Logged out", nil)
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/logexport"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// LogHandler exports request logs
+type LogHandler struct {
+	logRepo *database.RequestLogRepository
+	maxRows int
+	rate    int
+	log     *logger.Logger
+}
+
+// NewLogHandler creates a new request log handler exporting up to maxRows
+// logs at a time at rate bytes per second, 0 for no limit
+func NewLogHandler(db *database.Database, maxRows, rate int, log *logger.Logger) *LogHandler {
+	return &LogHandler{
+		logRepo: database.NewRequestLogRepository(db),
+		maxRows: maxRows,
+		rate:    rate,
+		log:     log,
+	}
+}
+
+// Export handles streaming request logs as CSV or NDJSON
+// @Summary Export request logs
+// @Description Stream the request logs matching the filters, newest first, as CSV or NDJSON picked by format or the Accept header. Rows are sent as they are read, at most GATEWAY_LOG_EXPORT_MAX_ROWS of them at GATEWAY_LOG_EXPORT_RATE bytes per second; the X-Export-Rows and X-Export-Truncated trailers report how many were sent and whether the cap cut the export short.
+// @Tags logs
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Param format query string false "csv or ndjson"
+// @Param route_id query int false "Route ID"
+// @Param tenant_id query string false "Tenant ID"
+// @Param country query string false "Client country code"
+// @Param method query string false "Request method"
+// @Param path query string false "Normalized request path"
+// @Param from query string false "Start of the range, RFC 3339"
+// @Param to query string false "End of the range, RFC 3339"
+// @Param limit query int false "Rows to export, at most GATEWAY_LOG_EXPORT_MAX_ROWS"
+// @Success 200 {string} string "Request logs"
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Failure 503 {object} response.Response
+// @Security BearerAuth
+// @Router /api/logs/export [get]
+func (h *LogHandler) Export(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.LogHandler.Export")
+	defer span.End()
+
+	query := r.URL.Query()
+	format, err := logexport.Negotiate(query.Get("format"), r.Header.Get("Accept"))
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid format")
+		response.BadRequest(w, "format must be csv or ndjson")
+		return
+	}
+
+	filter := database.RequestLogFilter{
+		TenantID: query.Get("tenant_id"),
+		Country:  query.Get("country"),
+		Method:   query.Get("method"),
+		Path:     query.Get("path"),
+	}
+	if value := query.Get("route_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			span.SetStatus(codes.Error, "invalid route ID")
+			response.BadRequest(w, "Invalid route ID")
+			return
+		}
+		filter.RouteID = &id
+	}
+	for name, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(name); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				span.SetStatus(codes.Error, "invalid time range")
+				response.BadRequest(w, name+" must be an RFC 3339 time")
+				return
+			}
+		}
+	}
+	maxRows := h.maxRows
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			span.SetStatus(codes.Error, "invalid limit")
+			response.BadRequest(w, "limit must be a positive number")
+			return
+		}
+		maxRows = min(limit, h.maxRows)
+	}
+	// One row past the cap tells the export it was cut short
+	filter.Limit = maxRows + 1
+
+	span.SetAttributes(
+		attribute.String("export.format", string(format)),
+		attribute.Int("export.max_rows", maxRows),
+	)
+
+	rows, started, err := logexport.Export(ctx, w, func(ctx context.Context, fn func(*database.RequestLog) error) error {
+		return h.logRepo.StreamByFilter(ctx, filter, fn)
+	}, logexport.Options{
+		Format:   format,
+		Filename: logexport.Filename(format, filter.From, filter.To),
+		MaxRows:  maxRows,
+		Rate:     h.rate,
+	})
+	span.SetAttributes(attribute.Int("export.rows", rows))
+	if err == nil {
+		span.SetStatus(codes.Ok, "success")
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, "failed to export request logs")
+	if errors.Is(err, context.Canceled) || r.Context().Err() != nil {
+		h.log.Debugf("Request log export stopped after %d rows: %v", rows, err)
+	} else {
+		logQueryError(h.log, err, "Failed to export request logs after %d rows", rows)
+	}
+	if started {
+		// A cut-off export must not pass for a complete one
+		panic(http.ErrAbortHandler)
+	}
+	if database.IsUnavailable(err) {
+		response.ServiceUnavailable(w, "Database unavailable")
+		return
+	}
+	response.InternalServerError(w, "Failed to export request logs")
+}
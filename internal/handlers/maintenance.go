@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/audit"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// MaintenanceRequest optionally changes a route's maintenance response as
+// maintenance is enabled. Omitted fields keep their stored values.
+type MaintenanceRequest struct {
+	Status      *int    `json:"status,omitempty" example:"503"`
+	Body        *string `json:"body,omitempty" example:"Back at 14:00 UTC"`
+	ContentType *string `json:"content_type,omitempty" example:"text/plain"`
+	RetryAfter  *int    `json:"retry_after,omitempty" example:"600"` // Seconds
+}
+
+// EnableMaintenance handles putting a route into maintenance
+// @Summary Enable maintenance mode
+// @Description Answer the route's requests with its maintenance response instead of proxying them
+// @Tags routes
+// @Accept json
+// @Produce json
+// @Param id path int true "Route ID"
+// @Param request body MaintenanceRequest false "Maintenance response"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/routes/{id}/maintenance/enable [post]
+func (h *RouteHandler) EnableMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceRequest
+	if err := httpjson.DecodeOptional(w, r, &req); err != nil {
+		httpjson.WriteError(w, err)
+		return
+	}
+
+	h.setMaintenance(w, r, func(route *database.Route) {
+		route.MaintenanceEnabled = true
+		if req.Status != nil {
+			route.MaintenanceStatus = *req.Status
+		}
+		if req.Body != nil {
+			route.MaintenanceBody = *req.Body
+		}
+		if req.ContentType != nil {
+			route.MaintenanceContentType = *req.ContentType
+		}
+		if req.RetryAfter != nil {
+			route.MaintenanceRetryAfter = *req.RetryAfter
+		}
+	})
+}
+
+// DisableMaintenance handles taking a route out of maintenance
+// @Summary Disable maintenance mode
+// @Description Resume proxying the route's requests. The maintenance response is kept for next time.
+// @Tags routes
+// @Produce json
+// @Param id path int true "Route ID"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/routes/{id}/maintenance/disable [post]
+func (h *RouteHandler) DisableMaintenance(w http.ResponseWriter, r *http.Request) {
+	h.setMaintenance(w, r, func(route *database.Route) {
+		route.MaintenanceEnabled = false
+	})
+}
+
+// setMaintenance applies change to the route and saves it with an audit entry
+func (h *RouteHandler) setMaintenance(w http.ResponseWriter, r *http.Request, change func(*database.Route)) {
+	idStr := chi.URLParam(r, "id")
+
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.RouteHandler.setMaintenance")
+	defer span.End()
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid route ID")
+		response.BadRequest(w, "Invalid route ID")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("route.id", id))
+
+	var route database.Route
+	var invalid error
+	err = h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		repo := h.repo.WithTx(tx)
+
+		before, err := repo.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		route = *before
+		change(&route)
+		if invalid = ValidateRoute(&route, h.plugins); invalid != nil {
+			return invalid
+		}
+
+		if err := repo.Update(ctx, &route); err != nil {
+			return err
+		}
+		return h.recordAudit(ctx, tx, r, id, audit.UpdateAction(before, &route), before, &route)
+	})
+	if invalid != nil {
+		span.SetStatus(codes.Error, "invalid maintenance settings")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, invalid.Error())
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		span.SetStatus(codes.Error, "route not found")
+		response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+		return
+	}
+	if err != nil {
+		logQueryError(h.log, err, "Failed to change maintenance of route %d", id)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to update route")
+		response.InternalServerError(w, "Failed to update route")
+		return
+	}
+
+	// Invalidate cache
+	h.cache.Delete("routes:all")
+	h.cache.Delete("route:" + idStr)
+
+	span.SetStatus(codes.Ok, "maintenance changed")
+
+	h.bus.Publish(events.RouteUpdated, route)
+
+	h.log.Infof("Route %d maintenance enabled: %v", id, route.MaintenanceEnabled)
+	response.Success(w, "Route maintenance updated", route)
+}
+
+// writeMaintenance answers a request with the route's maintenance response
+// and returns the status written
+func writeMaintenance(w http.ResponseWriter, r *http.Request, route *database.Route) int {
+	status := route.MaintenanceStatus
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	if route.MaintenanceRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(route.MaintenanceRetryAfter))
+	}
+
+	if route.MaintenanceBody == "" {
+		response.ErrorFor(w, r, status, response.CodeMaintenance, "Route is under maintenance")
+		return status
+	}
+
+	contentType := route.MaintenanceContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(route.MaintenanceBody)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, route.MaintenanceBody)
+	}
+	return status
+}
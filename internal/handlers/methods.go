@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/urlpath"
+)
+
+// traceAllow is the Allow header answered to TRACE requests when they are
+// rejected: any method the proxy may route
+const traceAllow = "DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT"
+
+// SetAllowTrace sets whether TRACE requests are routed like any other method
+// instead of being rejected with 405
+func (h *ProxyHandler) SetAllowTrace(allow bool) {
+	h.allowTrace = allow
+}
+
+// OptionsPassthrough returns a check for the CORS middleware telling whether
+// an OPTIONS request is for a route forwarding OPTIONS to its upstream.
+// Lookup errors leave the request to the middleware.
+func OptionsPassthrough(db *database.Database) func(r *http.Request) bool {
+	repo := database.NewRouteRepository(db)
+	return func(r *http.Request) bool {
+		route, err := repo.FindByPath(r.Context(), r.Host, urlpath.Normalize(r.URL).Path, r.Method)
+		return err == nil && route.PassthroughOptions
+	}
+}
+
+// bodylessWriter drops the body of responses that can't have one: responses
+// to HEAD requests and 1xx, 204 and 304 responses. For HEAD it holds the
+// status until the handler is done, so the response can carry the length of
+// the body a GET would have received.
+type bodylessWriter struct {
+	http.ResponseWriter
+	head        bool
+	held        int  // Status held for a HEAD request, 0 once written
+	bodiless    bool // The status written can't have a body
+	wroteHeader bool
+	dropped     int64 // Body bytes dropped
+}
+
+// newBodylessWriter wraps w for a response to r
+func newBodylessWriter(w http.ResponseWriter, r *http.Request) *bodylessWriter {
+	return &bodylessWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+}
+
+func (bw *bodylessWriter) WriteHeader(status int) {
+	if bw.wroteHeader {
+		return
+	}
+	// Informational responses precede the final one
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		bw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	bw.wroteHeader = true
+	bw.bodiless = bw.head || status < 200 || status == http.StatusNoContent || status == http.StatusNotModified
+	if bw.head {
+		bw.held = status
+		return
+	}
+	bw.ResponseWriter.WriteHeader(status)
+}
+
+func (bw *bodylessWriter) Write(b []byte) (int, error) {
+	if !bw.wroteHeader {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if bw.bodiless {
+		bw.dropped += int64(len(b))
+		return len(b), nil
+	}
+	return bw.ResponseWriter.Write(b)
+}
+
+// Flush writes a held status before flushing, without a length
+func (bw *bodylessWriter) Flush() {
+	bw.release(false)
+	http.NewResponseController(bw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer for connection upgrades
+func (bw *bodylessWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// finish writes a held status once the handler is done, giving the length
+// of the dropped body when the handler didn't set one
+func (bw *bodylessWriter) finish() {
+	bw.release(true)
+}
+
+// release writes the held status, if any
+func (bw *bodylessWriter) release(done bool) {
+	if bw.held == 0 {
+		return
+	}
+	header := bw.Header()
+	if done && bw.dropped > 0 && header.Get("Content-Length") == "" && header.Get("Transfer-Encoding") == "" {
+		header.Set("Content-Length", strconv.FormatInt(bw.dropped, 10))
+	}
+	bw.ResponseWriter.WriteHeader(bw.held)
+	bw.held = 0
+}
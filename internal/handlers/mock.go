@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/mock"
+	"github.com/zakirkun/isekai/pkg/redact"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// validateRouteType checks that proxy and rewrite routes have a target, mock
+// routes a mock response, redirect routes a redirect and rewrite routes a
+// rewrite rule, and that routes answered by the gateway don't use upstream
+// settings
+func validateRouteType(route *database.Route) error {
+	if route.Path == "" {
+		return errors.New("Path is required")
+	}
+	if route.Mock != nil && route.Type != database.RouteTypeMock {
+		return errors.New("mock is only allowed on mock routes")
+	}
+	if route.Redirect != nil && route.Type != database.RouteTypeRedirect {
+		return errors.New("redirect is only allowed on redirect routes")
+	}
+	if route.Rewrite != nil && route.Type != database.RouteTypeRewrite {
+		return errors.New("rewrite is only allowed on rewrite routes")
+	}
+
+	switch route.Type {
+	case "", database.RouteTypeProxy, database.RouteTypeRewrite:
+		if route.TargetURL == "" && route.BlueGreen == nil {
+			return errors.New("Path and target URL are required")
+		}
+		if route.Type == database.RouteTypeRewrite {
+			if route.Rewrite == nil {
+				return errors.New("rewrite routes require a rewrite rule")
+			}
+			return route.Rewrite.Validate()
+		}
+		return nil
+	case database.RouteTypeMock:
+		if route.Mock == nil {
+			return errors.New("mock routes require a mock response")
+		}
+		if err := route.Mock.Validate(); err != nil {
+			return err
+		}
+	case database.RouteTypeEcho:
+	case database.RouteTypeRedirect:
+		if route.Redirect == nil {
+			return errors.New("redirect routes require a redirect")
+		}
+		if err := route.Redirect.Validate(); err != nil {
+			return err
+		}
+	default:
+		return errors.New("type must be proxy, mock, echo, redirect or rewrite")
+	}
+
+	if route.LoadBalanced || route.CanaryURL != "" || route.BlueGreen != nil || route.HedgeDelay > 0 || route.MaxConcurrency > 0 || route.UpstreamRateLimit > 0 || route.PreserveHost || route.Critical {
+		return errors.New("load_balanced, canary, blue_green, hedge_delay, max_concurrency, upstream_rate_limit, preserve_host and critical only apply to proxy routes")
+	}
+	return nil
+}
+
+// serveMock answers a mock route with its mock response, or an echo route
+// with the request, and returns the status written
+func (h *ProxyHandler) serveMock(ctx context.Context, w http.ResponseWriter, r *http.Request, route *database.Route) int {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("route.type", route.Type))
+
+	status := http.StatusOK
+	if route.Type == database.RouteTypeEcho {
+		headers := map[string][]string(r.Header)
+		if redacted, ok := redact.FromContext(ctx); ok {
+			headers = redacted.All(r.Header)
+		}
+		response.Success(w, "Request echoed", mock.Echo(r, headers))
+	} else {
+		var err error
+		if status, err = route.Mock.Serve(ctx, w, r); err != nil {
+			// The request timed out or the client left during injected latency
+			status = http.StatusGatewayTimeout
+			response.ErrorFor(w, r, status, response.CodeUpstreamTimeout, "Mock response timed out")
+		}
+	}
+
+	h.metrics.MockResponses.WithLabelValues(route.Path, route.Type).Inc()
+	return status
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/adminui"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// oidcStateCookie carries the state, nonce and return path of a sign-in
+// from the login request to the callback
+const (
+	oidcStateCookie = "isekai_oidc_state"
+	oidcStatePath   = "/api/auth/oidc"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// adminPath matches the admin UI pages a sign-in may return to, so the
+// callback can't be used to redirect elsewhere
+var adminPath = regexp.MustCompile(`^` + adminui.Prefix + `(/|\?|$)`)
+
+// OIDCHandler signs admins in with an OpenID Connect provider and issues
+// the gateway's own token, so the rest of the API authenticates as usual
+type OIDCHandler struct {
+	oidc          *auth.OIDC
+	authService   *auth.AuthService
+	tokenDuration time.Duration
+	log           *logger.Logger
+}
+
+// NewOIDCHandler creates a new OIDC handler
+func NewOIDCHandler(oidc *auth.OIDC, authService *auth.AuthService, tokenDuration time.Duration, log *logger.Logger) *OIDCHandler {
+	return &OIDCHandler{
+		oidc:          oidc,
+		authService:   authService,
+		tokenDuration: tokenDuration,
+		log:           log,
+	}
+}
+
+// Login handles starting an OIDC sign-in
+// @Summary OIDC login
+// @Description Redirect to the identity provider to sign in. With next set to an admin UI page, the callback stores the token for the admin UI and returns there.
+// @Tags auth
+// @Param next query string false "Admin UI page to return to"
+// @Success 302
+// @Failure 502 {object} response.Response
+// @Router /api/auth/oidc/login [get]
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.OIDCHandler.Login")
+	defer span.End()
+
+	next := r.URL.Query().Get("next")
+	if next != "" && !adminPath.MatchString(next) {
+		next = adminui.Prefix
+	}
+
+	state, nonce := randomToken(), randomToken()
+	target, err := h.oidc.AuthCodeURL(ctx, state, nonce)
+	if err != nil {
+		h.log.Errorf("Failed to start OIDC login: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "provider unavailable")
+		response.ErrorCode(w, http.StatusBadGateway, response.CodeBadGateway, "Identity provider unavailable")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state + "." + nonce + "." + base64.RawURLEncoding.EncodeToString([]byte(next)),
+		Path:     oidcStatePath,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// Lax so the cookie comes back with the provider's redirect
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	span.SetStatus(codes.Ok, "redirected to provider")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// Callback handles the identity provider's redirect after sign-in
+// @Summary OIDC callback
+// @Description Redeem the authorization code, verify the ID token and issue a gateway token with the roles mapped from it
+// @Tags auth
+// @Produce json
+// @Param code query string true "Authorization code"
+// @Param state query string true "Sign-in state"
+// @Success 200 {object} response.Response
+// @Success 302
+// @Failure 400 {object} response.Response
+// @Failure 401 {object} response.Response
+// @Failure 502 {object} response.Response
+// @Router /api/auth/oidc/callback [get]
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.OIDCHandler.Callback")
+	defer span.End()
+
+	// The state is good for one callback
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: oidcStatePath, MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil})
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		span.SetStatus(codes.Error, "sign-in refused")
+		response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthInvalid, "Sign-in refused by the identity provider: "+providerErr)
+		return
+	}
+
+	state, nonce, next, ok := readOIDCState(r)
+	if !ok || query.Get("code") == "" || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		span.SetStatus(codes.Error, "invalid state")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeAuthInvalid, "Invalid or expired sign-in, start again")
+		return
+	}
+
+	claims, err := h.oidc.Exchange(ctx, query.Get("code"), nonce)
+	if err != nil {
+		span.RecordError(err)
+		if errors.Is(err, auth.ErrInvalidToken) {
+			h.log.Warnf("OIDC login rejected: %v", err)
+			span.SetStatus(codes.Error, "invalid ID token")
+			response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthInvalid, "Sign-in could not be verified")
+			return
+		}
+		h.log.Errorf("Failed to complete OIDC login: %v", err)
+		span.SetStatus(codes.Error, "provider unavailable")
+		response.ErrorCode(w, http.StatusBadGateway, response.CodeBadGateway, "Identity provider unavailable")
+		return
+	}
+	span.SetAttributes(attribute.String("user.id", claims.UserID))
+
+	token, err := h.authService.IssueToken(claims, h.tokenDuration)
+	if err != nil {
+		h.log.Errorf("Failed to generate token: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to generate token")
+		response.InternalServerError(w, "Failed to generate token")
+		return
+	}
+	h.log.Infof("OIDC login for %s with roles %v", claims.Username, claims.Roles)
+	span.SetStatus(codes.Ok, "signed in")
+
+	// Browsers signing in to the admin UI get its token cookie, set the way
+	// its login page does, and are sent back
+	if next != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     adminui.TokenCookie,
+			Value:    token,
+			Path:     adminui.Prefix,
+			MaxAge:   int(h.tokenDuration.Seconds()),
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, next, http.StatusFound)
+		return
+	}
+
+	response.Success(w, "Login successful", map[string]string{
+		"token": token,
+	})
+}
+
+// readOIDCState returns the state, nonce and return path stored by Login
+func readOIDCState(r *http.Request) (state, nonce, next string, ok bool) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return "", "", "", false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", false
+	}
+	path, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || (len(path) > 0 && !adminPath.Match(path)) {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], string(path), true
+}
+
+// randomToken returns 128 random bits as hex, for sign-in state and nonces
+func randomToken() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/plugin"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// routeRequestKey holds the request's *routeRequest in its context
+type routeRequestKey struct{}
+
+// routeRequest carries the matched route through its plugins
+type routeRequest struct {
+	route     *database.Route
+	start     time.Time
+	original  *url.URL // The URL as sent when its path was normalized
+	forwarded bool     // Set once the plugins let the request through
+}
+
+// routeChain is a route's plugin chain and the route version it was built from
+type routeChain struct {
+	updatedAt time.Time
+	chain     *plugin.Chain
+}
+
+// SetPlugins sets the plugins routes may list. Routes listing plugins are
+// rejected until it is called.
+func (h *RouteHandler) SetPlugins(plugins *plugin.Registry) {
+	h.plugins = plugins
+}
+
+// SetPlugins sets the plugins that routes' plugin lists are built from
+func (h *ProxyHandler) SetPlugins(plugins *plugin.Registry) {
+	h.plugins = plugins
+}
+
+// runPlugins passes the request through the route's plugin chain, logging it
+// when a plugin answers it without forwarding
+func (h *ProxyHandler) runPlugins(w http.ResponseWriter, r *http.Request, req *routeRequest) {
+	ctx, route := r.Context(), req.route
+	span := trace.SpanFromContext(ctx)
+
+	chain, err := h.chain(route)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "plugin chain failed")
+		h.log.Errorf("Failed to build plugins for route %s: %v", route.Path, err)
+		response.ErrorFor(w, r, http.StatusInternalServerError, response.CodeInternal, "Route plugins are misconfigured")
+		h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, http.StatusInternalServerError, time.Since(req.start), r)
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	chain.ServeHTTP(sw, r)
+	if !req.forwarded {
+		span.SetAttributes(attribute.Bool("route.plugin_answered", true))
+		h.logRequest(ctx, &route.ID, r.Method, r.URL.Path, sw.Status(), time.Since(req.start), r)
+	}
+}
+
+// chain returns the route's plugin chain, building it on first use and again
+// after the route is updated
+func (h *ProxyHandler) chain(route *database.Route) (*plugin.Chain, error) {
+	h.chainsMu.Lock()
+	defer h.chainsMu.Unlock()
+
+	cached, ok := h.chains[route.ID]
+	if ok && cached.updatedAt.Equal(route.UpdatedAt) {
+		return cached.chain, nil
+	}
+
+	chain, err := h.plugins.Build(route.Plugins, http.HandlerFunc(h.forwardRoute))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cached.chain.Close()
+	}
+	h.chains[route.ID] = &routeChain{updatedAt: route.UpdatedAt, chain: chain}
+	return chain, nil
+}
+
+// statusWriter records the status of a response written by a plugin
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Status returns the response status, 200 when none was written
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
+
+// Unwrap exposes the underlying writer so streamed responses can be flushed
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// maxTierName is the longest rate limit tier name the schema stores
+const maxTierName = 100
+
+// RateLimitHandler manages the rate limit tiers stored in the database and
+// keeps the limiter's tiers in sync with them
+type RateLimitHandler struct {
+	repo     *database.RateLimitTierRepository
+	tenants  *database.TenantRepository
+	tiers    *middleware.RateLimitTiers
+	log      *logger.Logger
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewRateLimitHandler creates a new rate limit tier handler
+func NewRateLimitHandler(db *database.Database, tiers *middleware.RateLimitTiers, log *logger.Logger) *RateLimitHandler {
+	return &RateLimitHandler{
+		repo:    database.NewRateLimitTierRepository(db),
+		tenants: database.NewTenantRepository(db),
+		tiers:   tiers,
+		log:     log,
+		stop:    make(chan struct{}),
+	}
+}
+
+// rateLimitTierRequest is the body of a tier update
+type rateLimitTierRequest struct {
+	RequestsPerSecond int      `json:"requests_per_second"`
+	Subjects          []string `json:"subjects"`
+}
+
+// Tiers returns the tiers the handler keeps in sync
+func (h *RateLimitHandler) Tiers() *middleware.RateLimitTiers {
+	return h.tiers
+}
+
+// Reload replaces the limiter's runtime tiers and tenant rates with the
+// stored ones
+func (h *RateLimitHandler) Reload(ctx context.Context) error {
+	stored, err := h.repo.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	tenants, err := h.tenants.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	tiers := make([]middleware.RateLimitTier, 0, len(stored))
+	for _, tier := range stored {
+		tiers = append(tiers, middleware.RateLimitTier{
+			Name:              tier.Name,
+			RequestsPerSecond: tier.RequestsPerSecond,
+			Subjects:          tier.Subjects,
+		})
+	}
+	h.tiers.Replace(tiers)
+
+	limits := make(map[string]int, len(tenants))
+	for _, tenant := range tenants {
+		limits[tenant.ID] = tenant.RateLimit
+	}
+	h.tiers.ReplaceTenants(limits)
+	return nil
+}
+
+// Start loads the stored tiers and reloads them every interval until Stop
+// is called, so changes made through other gateway instances apply here too
+func (h *RateLimitHandler) Start(interval time.Duration) {
+	if err := h.Reload(context.Background()); err != nil {
+		h.log.Warnf("Failed to load rate limit tiers: %v", err)
+	}
+
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := h.Reload(context.Background()); err != nil {
+					h.log.Warnf("Failed to reload rate limit tiers: %v", err)
+				}
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic reload
+func (h *RateLimitHandler) Stop() {
+	h.stopOnce.Do(func() { close(h.stop) })
+}
+
+// List handles listing the stored rate limit tiers
+// @Summary List rate limit tiers
+// @Description Get the rate limit tiers stored in the database. Tiers from GATEWAY_RATE_LIMIT_TIERS aren't included.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/rate-limit-tiers [get]
+func (h *RateLimitHandler) List(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.RateLimitHandler.List")
+	defer span.End()
+
+	tiers, err := h.repo.FindAll(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve tiers")
+		h.writeError(w, "retrieve", "", err)
+		return
+	}
+
+	span.SetAttributes(attribute.Int("tiers.count", len(tiers)))
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Rate limit tiers retrieved", tiers)
+}
+
+// Put handles creating or replacing a rate limit tier
+// @Summary Create or replace a rate limit tier
+// @Description Set a tier's requests per second and the API keys ("key:<id>"), users ("user:<id>") or client IPs ("ip:<addr>") assigned to it. Changes apply without a restart.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param name path string true "Tier name"
+// @Param tier body object true "Requests per second and subjects"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/rate-limit-tiers/{name} [put]
+func (h *RateLimitHandler) Put(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.RateLimitHandler.Put")
+	defer span.End()
+
+	name := chi.URLParam(r, "name")
+	span.SetAttributes(attribute.String("tier.name", name))
+
+	var req rateLimitTierRequest
+	if err := httpjson.Decode(w, r, &req); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+
+	tier := &database.RateLimitTier{Name: name, RequestsPerSecond: req.RequestsPerSecond, Subjects: req.Subjects}
+	if err := validateTier(tier); err != nil {
+		span.SetStatus(codes.Error, "invalid tier")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+		return
+	}
+
+	conflict, err := h.assignedElsewhere(ctx, tier)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to check tiers")
+		h.writeError(w, "save", name, err)
+		return
+	}
+	if conflict != "" {
+		span.SetStatus(codes.Error, "subject already assigned")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, conflict)
+		return
+	}
+
+	if err := h.repo.Upsert(ctx, tier); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to save tier")
+		h.writeError(w, "save", name, err)
+		return
+	}
+	h.reloadAfterChange(ctx)
+
+	span.SetStatus(codes.Ok, "tier saved")
+	h.log.Infof("Rate limit tier saved: %s (%d rps)", name, tier.RequestsPerSecond)
+	response.Success(w, "Rate limit tier saved", tier)
+}
+
+// Delete handles deleting a rate limit tier
+// @Summary Delete a rate limit tier
+// @Description Delete a stored rate limit tier. Its subjects fall back to the default limit.
+// @Tags admin
+// @Produce json
+// @Param name path string true "Tier name"
+// @Success 200 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/rate-limit-tiers/{name} [delete]
+func (h *RateLimitHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.RateLimitHandler.Delete")
+	defer span.End()
+
+	name := chi.URLParam(r, "name")
+	span.SetAttributes(attribute.String("tier.name", name))
+
+	err := h.repo.Delete(ctx, name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		span.SetStatus(codes.Error, "tier not found")
+		response.NotFound(w, "Rate limit tier not found")
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to delete tier")
+		h.writeError(w, "delete", name, err)
+		return
+	}
+	h.reloadAfterChange(ctx)
+
+	span.SetStatus(codes.Ok, "tier deleted")
+	h.log.Infof("Rate limit tier deleted: %s", name)
+	response.Success(w, "Rate limit tier deleted", nil)
+}
+
+// writeError maps a failed tier query to a response
+func (h *RateLimitHandler) writeError(w http.ResponseWriter, action, name string, err error) {
+	target := "rate limit tiers"
+	if name != "" {
+		target = "rate limit tier " + name
+	}
+	logQueryError(h.log, err, "Failed to %s %s", action, target)
+	if database.IsUnavailable(err) {
+		response.ServiceUnavailable(w, "Database unavailable")
+		return
+	}
+	response.InternalServerError(w, "Failed to "+action+" rate limit tiers")
+}
+
+// reloadAfterChange applies a stored change right away; the periodic reload
+// catches up if it fails
+func (h *RateLimitHandler) reloadAfterChange(ctx context.Context) {
+	if err := h.Reload(ctx); err != nil {
+		h.log.Warnf("Failed to reload rate limit tiers: %v", err)
+	}
+}
+
+// validateTier checks a tier's name, rate and subjects
+func validateTier(tier *database.RateLimitTier) error {
+	if tier.Name == "" || len(tier.Name) > maxTierName {
+		return fmt.Errorf("tier name must be 1 to %d characters", maxTierName)
+	}
+	if tier.Name == middleware.DefaultRateLimitTier {
+		return fmt.Errorf("%q is reserved for callers without a tier", middleware.DefaultRateLimitTier)
+	}
+	if tier.RequestsPerSecond <= 0 {
+		return errors.New("requests_per_second must be positive")
+	}
+
+	seen := make(map[string]bool, len(tier.Subjects))
+	for _, subject := range tier.Subjects {
+		if !validSubject(subject) {
+			return fmt.Errorf("subject %q must be key:<id>, user:<id> or ip:<addr>", subject)
+		}
+		if seen[subject] {
+			return fmt.Errorf("subject %q is listed twice", subject)
+		}
+		seen[subject] = true
+	}
+	return nil
+}
+
+// assignedElsewhere describes the first of the tier's subjects that already
+// belongs to another stored tier, or returns "" when there is none
+func (h *RateLimitHandler) assignedElsewhere(ctx context.Context, tier *database.RateLimitTier) (string, error) {
+	existing, err := h.repo.FindAll(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, other := range existing {
+		if other.Name == tier.Name {
+			continue
+		}
+		for _, subject := range other.Subjects {
+			if slices.Contains(tier.Subjects, subject) {
+				return fmt.Sprintf("subject %q is already assigned to tier %q", subject, other.Name), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// validSubject reports whether subject names an API key, user or client IP
+func validSubject(subject string) bool {
+	for _, prefix := range []string{middleware.SubjectAPIKey, middleware.SubjectUser, middleware.SubjectIP} {
+		id, ok := strings.CutPrefix(subject, prefix)
+		if !ok {
+			continue
+		}
+		if prefix == middleware.SubjectIP {
+			// Client IPs are matched in their canonical form
+			addr, err := netip.ParseAddr(id)
+			return err == nil && addr.String() == id
+		}
+		return id != ""
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// ReportHandler reports gateway usage for chargeback
+type ReportHandler struct {
+	logRepo *database.RequestLogRepository
+	log     *logger.Logger
+}
+
+// NewReportHandler creates a new report handler
+func NewReportHandler(db *database.Database, log *logger.Logger) *ReportHandler {
+	return &ReportHandler{
+		logRepo: database.NewRequestLogRepository(db),
+		log:     log,
+	}
+}
+
+// usageColumns are the CSV columns of a usage report, in order
+var usageColumns = []string{
+	"key", "routes", "requests", "errors", "request_bytes", "response_bytes", "total_bytes", "p95_response_time",
+}
+
+// Usage handles reporting a month's usage by route owner, tag or tenant
+// @Summary Get usage report
+// @Description Total a month's requests, 5xx errors, body bytes and p95 response time by route owner, tag or tenant, from the hourly rollups. A month still being rolled up is reported up to the last rolled up hour, given by to, with complete false. A route counts towards each of its tags. JSON by default, CSV with Accept: text/csv, where the boundary is in the X-Report-To and X-Report-Complete headers.
+// @Tags reports
+// @Produce json
+// @Produce text/csv
+// @Param group_by query string true "owner, tag or tenant"
+// @Param month query string false "Month as 2006-01, the current month by default"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Failure 503 {object} response.Response
+// @Security BearerAuth
+// @Router /api/reports/usage [get]
+func (h *ReportHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.ReportHandler.Usage")
+	defer span.End()
+
+	query := r.URL.Query()
+	month := time.Now().UTC()
+	if value := query.Get("month"); value != "" {
+		var err error
+		if month, err = time.Parse("2006-01", value); err != nil {
+			span.SetStatus(codes.Error, "invalid month")
+			response.BadRequest(w, "month must be a month such as 2024-06")
+			return
+		}
+	}
+
+	report, err := h.logRepo.UsageByMonth(ctx, query.Get("group_by"), month)
+	if errors.Is(err, database.ErrUsageGroup) {
+		span.SetStatus(codes.Error, "invalid grouping")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+		return
+	}
+	if err != nil {
+		logQueryError(h.log, err, "Failed to total usage by %s", query.Get("group_by"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to total usage")
+		if database.IsUnavailable(err) {
+			response.ServiceUnavailable(w, "Database unavailable")
+			return
+		}
+		response.InternalServerError(w, "Failed to retrieve usage report")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("usage.group_by", report.GroupBy),
+		attribute.String("usage.month", report.Month),
+		attribute.Bool("usage.complete", report.Complete),
+	)
+
+	if !acceptsCSV(r.Header.Get("Accept")) {
+		span.SetStatus(codes.Ok, "success")
+		response.Success(w, "Usage report retrieved", report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage_%s_%s.csv"`, report.GroupBy, report.Month))
+	w.Header().Set("X-Report-To", report.To.Format(time.RFC3339))
+	w.Header().Set("X-Report-Complete", strconv.FormatBool(report.Complete))
+	if err := writeUsageCSV(w, report); err != nil {
+		h.log.Debugf("Failed to write usage report: %v", err)
+	}
+	span.SetStatus(codes.Ok, "success")
+}
+
+// writeUsageCSV encodes a usage report's rows as CSV with a header row
+func writeUsageCSV(w io.Writer, report *database.UsageReport) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(usageColumns); err != nil {
+		return err
+	}
+	for _, row := range report.Rows {
+		err := cw.Write([]string{
+			row.Key,
+			strconv.Itoa(row.Routes),
+			strconv.FormatInt(row.Requests, 10),
+			strconv.FormatInt(row.Errors, 10),
+			strconv.FormatInt(row.RequestBytes, 10),
+			strconv.FormatInt(row.ResponseBytes, 10),
+			strconv.FormatInt(row.TotalBytes, 10),
+			strconv.FormatFloat(row.P95, 'f', 2, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// acceptsCSV reports whether an Accept header lists CSV before JSON
+func acceptsCSV(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/csv":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
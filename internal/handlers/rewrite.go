@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serveRedirect answers a redirect route with its redirect and returns the
+// status written
+func (h *ProxyHandler) serveRedirect(ctx context.Context, w http.ResponseWriter, r *http.Request, route *database.Route) int {
+	status := route.Redirect.StatusCode()
+	location := route.Redirect.Location(r)
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("route.type", route.Type),
+		attribute.String("route.redirect_location", location),
+	)
+
+	http.Redirect(w, r, location, status)
+	h.metrics.Redirects.WithLabelValues(route.Path, strconv.Itoa(status)).Inc()
+	return status
+}
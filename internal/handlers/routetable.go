@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/matcher"
+)
+
+// routeTable is an in-memory copy of the routes, matched by proxied requests
+// until it expires
+type routeTable struct {
+	matcher *matcher.Matcher
+	routes  []database.Route
+	expires time.Time
+}
+
+// SetRoutes matches proxied requests against routes in memory for ttl rather
+// than looking each one up in the database. Route changes made through this
+// gateway drop the table early; changes made through other replicas are
+// picked up once it expires.
+func (h *ProxyHandler) SetRoutes(routes []database.Route, ttl time.Duration) {
+	h.routeTableMu.Lock()
+	defer h.routeTableMu.Unlock()
+	h.setRoutes(routes, ttl)
+}
+
+func (h *ProxyHandler) setRoutes(routes []database.Route, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	h.routeTable.Store(&routeTable{matcher: matcher.New(routes), routes: routes, expires: time.Now().Add(ttl)})
+}
+
+// LoadRoutes loads every route from the database into the in-memory route
+// table for ttl, returning them. Routes changed while they were loading
+// leave the table empty rather than stale.
+func (h *ProxyHandler) LoadRoutes(ctx context.Context, ttl time.Duration) ([]database.Route, error) {
+	h.routeTableMu.Lock()
+	generation := h.routeTableGen
+	h.routeTableMu.Unlock()
+
+	routes, err := h.repo.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	h.routeTableMu.Lock()
+	defer h.routeTableMu.Unlock()
+	if h.routeTableGen == generation {
+		h.setRoutes(routes, ttl)
+	}
+	return routes, nil
+}
+
+// InvalidateRoutes drops the in-memory route table, sending lookups back to
+// the database
+func (h *ProxyHandler) InvalidateRoutes() {
+	h.routeTableMu.Lock()
+	defer h.routeTableMu.Unlock()
+	h.routeTableGen++
+	h.routeTable.Store(nil)
+}
+
+// findRoute finds the route serving a request in the route table while it
+// is fresh, otherwise in the database
+func (h *ProxyHandler) findRoute(ctx context.Context, host, path, method string) (*database.Route, error) {
+	if table := h.routeTable.Load(); table != nil {
+		if time.Now().Before(table.expires) {
+			h.metrics.RouteLookups.WithLabelValues("table").Inc()
+			return table.matcher.Find(method, host, path)
+		}
+		h.routeTable.CompareAndSwap(table, nil)
+	}
+	h.metrics.RouteLookups.WithLabelValues("database").Inc()
+	return h.repo.FindByPath(ctx, host, path, method)
+}
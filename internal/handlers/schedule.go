@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/timewindow"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// windowStates remembers whether scheduled routes are active and when that
+// next changes, so requests only evaluate a route's window at its
+// transitions. A route changed since is evaluated again.
+type windowStates struct {
+	mu     sync.Mutex
+	states map[int]windowState // By route ID
+}
+
+// windowState is a route's window evaluated for the settings in key
+type windowState struct {
+	key    string
+	active bool
+	next   time.Time // Zero when the window never changes again
+}
+
+// scheduled reports whether the route has an active window
+func scheduled(route *database.Route) bool {
+	return route.ActiveFrom != nil || route.ActiveUntil != nil || route.Schedule != nil
+}
+
+// windowKey identifies the route's window settings
+func windowKey(route *database.Route) string {
+	var from, until int64
+	if route.ActiveFrom != nil {
+		from = route.ActiveFrom.UnixNano()
+	}
+	if route.ActiveUntil != nil {
+		until = route.ActiveUntil.UnixNano()
+	}
+	var expression, timezone string
+	if route.Schedule != nil {
+		expression, timezone = route.Schedule.Expression, route.Schedule.Timezone
+	}
+	return fmt.Sprintf("%d\x00%d\x00%s\x00%s", from, until, expression, timezone)
+}
+
+// active reports whether the route serves at now. Routes without a window
+// always do, and so do routes whose stored window no longer compiles,
+// rather than going dark over a schedule written before validation caught it.
+func (ws *windowStates) active(route *database.Route, now time.Time) bool {
+	if !scheduled(route) {
+		return true
+	}
+
+	key := windowKey(route)
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if state, ok := ws.states[route.ID]; ok && state.key == key && (state.next.IsZero() || now.Before(state.next)) {
+		return state.active
+	}
+
+	state := windowState{key: key, active: true}
+	if window, err := timewindow.New(route.ActiveFrom, route.ActiveUntil, route.Schedule); err == nil {
+		state.active, state.next = window.State(now)
+	}
+	if ws.states == nil {
+		ws.states = make(map[int]windowState)
+	}
+	ws.states[route.ID] = state
+	return state.active
+}
+
+// writeInactive answers a request for a route outside its active window with
+// the route's maintenance response when it has a body, or a 503 otherwise,
+// and returns the status written
+func writeInactive(w http.ResponseWriter, r *http.Request, route *database.Route) int {
+	if route.MaintenanceBody != "" {
+		return writeMaintenance(w, r, route)
+	}
+	response.ErrorFor(w, r, http.StatusServiceUnavailable, response.CodeRouteInactive, "Route is not active at this time")
+	return http.StatusServiceUnavailable
+}
+
+// withActivity returns routes with currently_active set at now, copied so
+// the cached list is left as it was, and a signature of the states for
+// tagging the view. The signature is empty when no route is scheduled, as
+// the view then doesn't change with time.
+func (ws *windowStates) withActivity(routes []database.Route, now time.Time) ([]database.Route, string) {
+	listed := make([]database.Route, len(routes))
+	signature := make([]byte, len(routes))
+	anyScheduled := false
+	for i, route := range routes {
+		route.CurrentlyActive = route.Enabled && ws.active(&route, now)
+		listed[i] = route
+		signature[i] = '0'
+		if route.CurrentlyActive {
+			signature[i] = '1'
+		}
+		anyScheduled = anyScheduled || scheduled(&route)
+	}
+	if !anyScheduled {
+		return listed, ""
+	}
+	return listed, string(signature)
+}
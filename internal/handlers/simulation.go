@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/matcher"
+	"github.com/zakirkun/isekai/internal/simulation"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	defaultSimulationSample = 1000
+	maxSimulationSample     = 10000
+	defaultSimulationWindow = 24 * time.Hour
+)
+
+// SimulationHandler replays traffic against proposed route tables
+type SimulationHandler struct {
+	repo           *database.RouteRepository
+	requestLogRepo *database.RequestLogRepository
+	log            *logger.Logger
+}
+
+// NewSimulationHandler creates a new simulation handler
+func NewSimulationHandler(db *database.Database, log *logger.Logger) *SimulationHandler {
+	return &SimulationHandler{
+		repo:           database.NewRouteRepository(db),
+		requestLogRepo: database.NewRequestLogRepository(db),
+		log:            log,
+	}
+}
+
+// SimulateRequest is the payload accepted by the simulate endpoint
+type SimulateRequest struct {
+	Routes         []database.Route     `json:"routes"`
+	Requests       []simulation.Request `json:"requests"`
+	SampleFromLogs *LogSample           `json:"sample_from_logs,omitempty"`
+	IncludeDiffs   bool                 `json:"include_diffs"`
+}
+
+// LogSample selects recorded traffic from request_logs
+type LogSample struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Limit int       `json:"limit"`
+}
+
+// Simulate handles offline route simulation
+// @Summary Simulate a route table
+// @Description Match recorded or supplied traffic against a proposed route set without forwarding anything
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param simulation body SimulateRequest true "Proposed routes and traffic sample"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/admin/simulate [post]
+func (h *SimulationHandler) Simulate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Start tracing span
+	ctx, span := tracer.Start(ctx, "handler.SimulationHandler.Simulate")
+	defer span.End()
+
+	var req SimulateRequest
+	if err := httpjson.Decode(w, r, &req); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+
+	if len(req.Requests) == 0 && req.SampleFromLogs == nil {
+		span.SetStatus(codes.Error, "missing traffic sample")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "Either requests or sample_from_logs is required")
+		return
+	}
+
+	requests := req.Requests
+	if req.SampleFromLogs != nil {
+		sample, err := h.sampleFromLogs(ctx, req.SampleFromLogs)
+		if err != nil {
+			logQueryError(h.log, err, "Failed to sample request logs")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to sample request logs")
+			response.InternalServerError(w, "Failed to sample request logs")
+			return
+		}
+		requests = append(requests, sample...)
+	}
+
+	currentRoutes, err := h.repo.FindAll(ctx)
+	if err != nil {
+		logQueryError(h.log, err, "Failed to load current routes")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to load current routes")
+		response.InternalServerError(w, "Failed to load current routes")
+		return
+	}
+
+	report := simulation.Run(matcher.New(currentRoutes), matcher.New(req.Routes), requests, req.IncludeDiffs)
+
+	span.SetAttributes(
+		attribute.Int("simulation.requests", report.Total),
+		attribute.Int("simulation.changed", report.Changed),
+	)
+	span.SetStatus(codes.Ok, "simulation completed")
+
+	response.Success(w, "Simulation completed", report)
+}
+
+// sampleFromLogs converts recorded request logs into simulation requests
+func (h *SimulationHandler) sampleFromLogs(ctx context.Context, sample *LogSample) ([]simulation.Request, error) {
+	to := sample.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from := sample.From
+	if from.IsZero() {
+		from = to.Add(-defaultSimulationWindow)
+	}
+
+	limit := sample.Limit
+	if limit <= 0 {
+		limit = defaultSimulationSample
+	}
+	if limit > maxSimulationSample {
+		limit = maxSimulationSample
+	}
+
+	logs, err := h.requestLogRepo.FindByFilter(ctx, database.RequestLogFilter{
+		From:  from,
+		To:    to,
+		Limit: limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]simulation.Request, 0, len(logs))
+	for _, entry := range logs {
+		requests = append(requests, simulation.Request{
+			Method: entry.Method,
+			Path:   entry.Path,
+		})
+	}
+
+	return requests, nil
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// transferSizes counts the body bytes a request transferred with its client.
+// The transport may still be reading the body while the response is logged.
+type transferSizes struct {
+	request  atomic.Int64
+	response atomic.Int64
+}
+
+type transferSizesKey struct{}
+
+// countTransfer wraps the request body and the response writer to count the
+// bytes actually read from and written to the client, so chunked bodies and
+// clients that disconnect early are counted as far as they got
+func countTransfer(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *transferSizes) {
+	sizes := &transferSizes{}
+	r = r.WithContext(context.WithValue(r.Context(), transferSizesKey{}, sizes))
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingBody{ReadCloser: r.Body, n: &sizes.request}
+	}
+	return &countingWriter{ResponseWriter: w, n: &sizes.response}, r, sizes
+}
+
+// transferSizesFrom returns the request and response body bytes counted for
+// the request, zero when they weren't counted
+func transferSizesFrom(ctx context.Context) (request, response int64) {
+	if sizes, ok := ctx.Value(transferSizesKey{}).(*transferSizes); ok {
+		return sizes.request.Load(), sizes.response.Load()
+	}
+	return 0, 0
+}
+
+// observeSizes records the request's body sizes in the route's size histograms
+func (h *ProxyHandler) observeSizes(route string, sizes *transferSizes) {
+	h.metrics.RequestSize.WithLabelValues(route).Observe(float64(sizes.request.Load()))
+	h.metrics.ResponseSize.WithLabelValues(route).Observe(float64(sizes.response.Load()))
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts the response body bytes written
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+// Unwrap exposes the underlying writer for flushing and connection upgrades
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
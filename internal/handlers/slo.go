@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/slo"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// SLOHandler reports on route SLOs and turns them into Prometheus rules
+type SLOHandler struct {
+	repo    *database.RouteRepository
+	logRepo *database.RequestLogRepository
+	log     *logger.Logger
+}
+
+// NewSLOHandler creates a new SLO handler
+func NewSLOHandler(db *database.Database, log *logger.Logger) *SLOHandler {
+	return &SLOHandler{
+		repo:    database.NewRouteRepository(db),
+		logRepo: database.NewRequestLogRepository(db),
+		log:     log,
+	}
+}
+
+// Compliance handles reporting how a route stands against its SLO
+// @Summary Get route SLO compliance
+// @Description Count the route's requests over its SLO window and those that were bad, 5xx responses or requests slower than the latency threshold, and report the compliance and error budget left
+// @Tags routes
+// @Produce json
+// @Param id path int true "Route ID"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/routes/{id}/slo [get]
+func (h *SLOHandler) Compliance(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.SLOHandler.Compliance")
+	defer span.End()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid route ID")
+		response.BadRequest(w, "Invalid route ID")
+		return
+	}
+	span.SetAttributes(attribute.Int("route.id", id))
+
+	route, err := h.repo.FindByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			span.SetStatus(codes.Error, "route not found")
+			response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+			return
+		}
+		logQueryError(h.log, err, "Failed to get route %d", id)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to get route")
+		response.InternalServerError(w, "Failed to get route")
+		return
+	}
+	if route.SLO == nil {
+		span.SetStatus(codes.Error, "route has no SLO")
+		response.NotFound(w, "Route has no SLO")
+		return
+	}
+
+	// Availability objectives read the hourly rollups; latency objectives
+	// need each request's response time
+	from := time.Now().Add(-time.Duration(route.SLO.Window()) * 24 * time.Hour)
+	var requests, bad int64
+	if route.SLO.LatencyMS == 0 {
+		var traffic *database.RouteTraffic
+		if traffic, err = h.logRepo.TrafficByRouteID(ctx, id, from, time.Time{}); err == nil {
+			requests, bad = traffic.Requests, traffic.Errors
+		}
+	} else {
+		requests, bad, err = h.logRepo.LatencyByRouteID(ctx, id, route.SLO.LatencyMS, from)
+	}
+	if err != nil {
+		logQueryError(h.log, err, "Failed to count request logs for route %d", id)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to count request logs")
+		response.InternalServerError(w, "Failed to retrieve SLO compliance")
+		return
+	}
+
+	compliance := slo.Evaluate(route.SLO, requests, bad)
+	span.SetAttributes(attribute.Float64("slo.compliance", compliance.Compliance))
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Route SLO compliance retrieved", compliance)
+}
+
+// Rules handles generating Prometheus rules from the configured SLOs
+// @Summary Generate SLO Prometheus rules
+// @Description Generate a Prometheus rule file recording each route SLO's error ratio over 5m to 3d windows, from the gateway's upstream metrics, with multiwindow burn rate alerts paging on fast error budget burn and opening tickets on slow burn
+// @Tags slo
+// @Produce application/yaml
+// @Success 200 {string} string "Prometheus rule file"
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/slo/rules [get]
+func (h *SLOHandler) Rules(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.SLOHandler.Rules")
+	defer span.End()
+
+	routes, err := h.repo.FindAll(ctx)
+	if err != nil {
+		logQueryError(h.log, err, "Failed to list routes")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to list routes")
+		response.InternalServerError(w, "Failed to retrieve routes")
+		return
+	}
+
+	var targets []slo.Target
+	for _, route := range routes {
+		if route.SLO != nil {
+			targets = append(targets, slo.Target{RouteID: route.ID, Route: route.Path, SLO: route.SLO})
+		}
+	}
+	rules, err := slo.Rules(targets)
+	if err != nil {
+		h.log.Errorf("Failed to generate SLO rules: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to generate rules")
+		response.InternalServerError(w, "Failed to generate SLO rules")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("slo.count", len(targets)))
+	span.SetStatus(codes.Ok, "success")
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(rules)
+}
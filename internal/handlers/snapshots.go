@@ -0,0 +1,365 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/zakirkun/isekai/internal/audit"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Restore modes. Replace removes routes the snapshot doesn't have; merge
+// keeps them.
+const (
+	RestoreReplace = "replace"
+	RestoreMerge   = "merge"
+)
+
+// SnapshotRequest describes a snapshot taken on request
+type SnapshotRequest struct {
+	Note string `json:"note" example:"Before the partner import"`
+}
+
+// RestoreResult summarizes a restore
+type RestoreResult struct {
+	SnapshotID           int    `json:"snapshot_id"`
+	PreRestoreSnapshotID int    `json:"pre_restore_snapshot_id"` // Restore this to undo the restore
+	Mode                 string `json:"mode"`
+	Created              int    `json:"created"`
+	Updated              int    `json:"updated"`
+	Deleted              int    `json:"deleted"`
+}
+
+// snapshotPage is a paginated list of snapshots
+type snapshotPage struct {
+	Snapshots []database.Snapshot `json:"snapshots"`
+	Total     int                 `json:"total"`
+	Limit     int                 `json:"limit"`
+	Offset    int                 `json:"offset"`
+}
+
+// SnapshotHandler takes and restores configuration snapshots
+type SnapshotHandler struct {
+	db        *database.Database
+	repo      *database.SnapshotRepository
+	routes    *database.RouteRepository
+	auditRepo *database.AuditRepository
+	cache     *cache.Cache
+	bus       *events.Bus
+	retention int // Automatic snapshots kept, 0 for all
+	log       *logger.Logger
+}
+
+// NewSnapshotHandler creates a new snapshot handler keeping retention
+// automatic snapshots
+func NewSnapshotHandler(db *database.Database, cache *cache.Cache, bus *events.Bus, retention int, log *logger.Logger) *SnapshotHandler {
+	return &SnapshotHandler{
+		db:        db,
+		repo:      database.NewSnapshotRepository(db),
+		routes:    database.NewRouteRepository(db),
+		auditRepo: database.NewAuditRepository(db),
+		cache:     cache,
+		bus:       bus,
+		retention: retention,
+		log:       log,
+	}
+}
+
+// Create handles taking a snapshot
+// @Summary Take a configuration snapshot
+// @Description Capture every route so the configuration can be restored later
+// @Tags snapshots
+// @Accept json
+// @Produce json
+// @Param request body SnapshotRequest false "Snapshot note"
+// @Success 201 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/snapshots [post]
+func (h *SnapshotHandler) Create(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.SnapshotHandler.Create")
+	defer span.End()
+
+	var req SnapshotRequest
+	if err := httpjson.DecodeOptional(w, r, &req); err != nil {
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+
+	actor, _ := audit.Actor(r)
+	snapshot := &database.Snapshot{Actor: actor, Note: req.Note}
+	if err := h.repo.Create(ctx, snapshot); err != nil {
+		logQueryError(h.log, err, "Failed to create snapshot")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to create snapshot")
+		response.InternalServerError(w, "Failed to create snapshot")
+		return
+	}
+	snapshot.Payload = nil
+
+	span.SetAttributes(attribute.Int("snapshot.id", snapshot.ID))
+	span.SetStatus(codes.Ok, "snapshot created")
+
+	h.log.Infof("Snapshot %d taken by %s with %d routes", snapshot.ID, actor, snapshot.RouteCount)
+	response.JSON(w, http.StatusCreated, response.Response{
+		Success: true,
+		Message: "Snapshot created",
+		Data:    snapshot,
+	})
+}
+
+// List handles listing snapshots
+// @Summary List configuration snapshots
+// @Description Get snapshots without their contents, newest first
+// @Tags snapshots
+// @Produce json
+// @Param limit query int false "Page size (default 50, max 500)"
+// @Param offset query int false "Number of snapshots to skip"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/snapshots [get]
+func (h *SnapshotHandler) List(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.SnapshotHandler.List")
+	defer span.End()
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid pagination")
+		response.BadRequest(w, "Invalid pagination parameters")
+		return
+	}
+
+	snapshots, total, err := h.repo.FindAll(ctx, limit, offset)
+	if err != nil {
+		logQueryError(h.log, err, "Failed to list snapshots")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve snapshots")
+		response.InternalServerError(w, "Failed to retrieve snapshots")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("snapshot.count", len(snapshots)))
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Snapshots retrieved", snapshotPage{
+		Snapshots: snapshots,
+		Total:     total,
+		Limit:     limit,
+		Offset:    offset,
+	})
+}
+
+// Get handles reading a snapshot with its routes
+// @Summary Get a configuration snapshot
+// @Description Get a snapshot including the routes it captured
+// @Tags snapshots
+// @Produce json
+// @Param id path int true "Snapshot ID"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Security BearerAuth
+// @Router /api/snapshots/{id} [get]
+func (h *SnapshotHandler) Get(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.SnapshotHandler.Get")
+	defer span.End()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid snapshot ID")
+		response.BadRequest(w, "Invalid snapshot ID")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("snapshot.id", id))
+
+	snapshot, err := h.repo.FindByID(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		span.SetStatus(codes.Error, "snapshot not found")
+		response.NotFound(w, "Snapshot not found")
+		return
+	}
+	if err != nil {
+		logQueryError(h.log, err, "Failed to get snapshot %d", id)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve snapshot")
+		response.InternalServerError(w, "Failed to retrieve snapshot")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Snapshot retrieved", snapshot)
+}
+
+// Restore handles writing a snapshot's routes back
+// @Summary Restore a configuration snapshot
+// @Description Write the snapshot's routes back in one transaction, after taking an automatic snapshot of the current routes. Replace mode deletes routes the snapshot doesn't have; merge mode keeps them.
+// @Tags snapshots
+// @Produce json
+// @Param id path int true "Snapshot ID"
+// @Param mode query string false "Restore mode (default replace)" Enums(replace, merge)
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 409 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/snapshots/{id}/restore [post]
+func (h *SnapshotHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.SnapshotHandler.Restore")
+	defer span.End()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid snapshot ID")
+		response.BadRequest(w, "Invalid snapshot ID")
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = RestoreReplace
+	}
+	if mode != RestoreReplace && mode != RestoreMerge {
+		span.SetStatus(codes.Error, "invalid restore mode")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeBadRequest, "mode must be replace or merge")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("snapshot.id", id), attribute.String("snapshot.mode", mode))
+
+	result := RestoreResult{SnapshotID: id, Mode: mode}
+	var touched []int
+	err = h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		snapshots, routes, auditRepo := h.repo.WithTx(tx), h.routes.WithTx(tx), h.auditRepo.WithTx(tx)
+
+		snapshot, err := snapshots.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		// Capture the routes being replaced so the restore can be undone
+		actor, _ := audit.Actor(r)
+		pre := &database.Snapshot{Actor: actor, Note: fmt.Sprintf("Before restoring snapshot %d", id), Automatic: true}
+		if err := snapshots.Create(ctx, pre); err != nil {
+			return err
+		}
+		result.PreRestoreSnapshotID = pre.ID
+
+		current := make(map[int]*database.Route, len(pre.Payload.Routes))
+		for i := range pre.Payload.Routes {
+			current[pre.Payload.Routes[i].ID] = &pre.Payload.Routes[i]
+		}
+		restored := make(map[int]bool, len(snapshot.Payload.Routes))
+		for _, route := range snapshot.Payload.Routes {
+			restored[route.ID] = true
+		}
+
+		// Delete first so restored routes can take back their paths
+		if mode == RestoreReplace {
+			for _, before := range pre.Payload.Routes {
+				if restored[before.ID] {
+					continue
+				}
+				if err := routes.Delete(ctx, before.ID); err != nil {
+					return err
+				}
+				if err := writeAudit(ctx, auditRepo, r, before.ID, database.AuditActionRestore, &before, nil); err != nil {
+					return err
+				}
+				result.Deleted++
+				touched = append(touched, before.ID)
+			}
+		}
+
+		for i := range snapshot.Payload.Routes {
+			route := &snapshot.Payload.Routes[i]
+			before := current[route.ID]
+			if before != nil && sameRoute(before, route) {
+				continue
+			}
+			if err := routes.Restore(ctx, route); err != nil {
+				return err
+			}
+			if err := writeAudit(ctx, auditRepo, r, route.ID, database.AuditActionRestore, before, route); err != nil {
+				return err
+			}
+			if before == nil {
+				result.Created++
+			} else {
+				result.Updated++
+			}
+			touched = append(touched, route.ID)
+		}
+
+		if h.retention > 0 {
+			if _, err := snapshots.Prune(ctx, h.retention); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		span.SetStatus(codes.Error, "snapshot not found")
+		response.NotFound(w, "Snapshot not found")
+		return
+	case errors.As(err, &pgErr) && pgErr.Code == uniqueViolation:
+		span.SetStatus(codes.Error, "path conflict")
+		response.ErrorCode(w, http.StatusConflict, response.CodeConflict, "A route outside the snapshot uses the path of a restored route; restore with mode=replace or delete it first")
+		return
+	case err != nil:
+		logQueryError(h.log, err, "Failed to restore snapshot %d", id)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to restore snapshot")
+		response.InternalServerError(w, "Failed to restore snapshot")
+		return
+	}
+
+	// Invalidate cache
+	h.cache.Delete("routes:all")
+	for _, routeID := range touched {
+		h.cache.Delete("route:" + strconv.Itoa(routeID))
+	}
+
+	span.SetAttributes(
+		attribute.Int("snapshot.created", result.Created),
+		attribute.Int("snapshot.updated", result.Updated),
+		attribute.Int("snapshot.deleted", result.Deleted),
+	)
+	span.SetStatus(codes.Ok, "snapshot restored")
+
+	h.bus.Publish(events.SnapshotRestored, result)
+
+	h.log.Infof("Snapshot %d restored (%s): %d created, %d updated, %d deleted", id, mode, result.Created, result.Updated, result.Deleted)
+	response.Success(w, "Snapshot restored", result)
+}
+
+// sameRoute reports whether two routes are stored identically
+func sameRoute(a, b *database.Route) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/audit"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Limits on route tags, which double as metrics labels
+const (
+	maxRouteTags = 16
+	maxTagLength = 64
+)
+
+// maxOwnerLength is the longest route owner, as stored
+const maxOwnerLength = 255
+
+// tagPattern keeps tags short lowercase words usable in query strings and
+// as metrics label values
+var tagPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]*[a-z0-9])?$`)
+
+// Bulk actions
+const (
+	BulkEnable       = "enable"
+	BulkDisable      = "disable"
+	BulkSetRateLimit = "set_rate_limit"
+	BulkDelete       = "delete"
+)
+
+// BulkRequest selects routes by tag and changes them all at once
+type BulkRequest struct {
+	Tag       string `json:"tag" example:"payments"`
+	Action    string `json:"action" example:"disable"` // enable, disable, set_rate_limit or delete
+	RateLimit *int   `json:"rate_limit,omitempty" example:"100"`
+	DryRun    bool   `json:"dry_run"` // Lists the routes that would change without changing them
+}
+
+// BulkResult lists the routes a bulk action changed, or would change on a
+// dry run, as they are after it
+type BulkResult struct {
+	Tag    string           `json:"tag"`
+	Action string           `json:"action"`
+	DryRun bool             `json:"dry_run"`
+	Count  int              `json:"count"`
+	Routes []database.Route `json:"routes"`
+}
+
+// validateTags checks the number, length and spelling of a route's tags,
+// and that its metrics tag is one of them
+func validateTags(route *database.Route) error {
+	if len(route.Tags) > maxRouteTags {
+		return fmt.Errorf("a route can have at most %d tags", maxRouteTags)
+	}
+	for i, tag := range route.Tags {
+		if len(tag) > maxTagLength || !tagPattern.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q, expected up to %d lowercase letters, digits, dots, dashes or underscores", tag, maxTagLength)
+		}
+		if slices.Contains(route.Tags[:i], tag) {
+			return fmt.Errorf("duplicate tag %q", tag)
+		}
+	}
+	if route.MetricsTag != "" && !slices.Contains(route.Tags, route.MetricsTag) {
+		return errors.New("metrics_tag must be one of the route's tags")
+	}
+	return nil
+}
+
+// metricsTag returns the tag a route's requests are counted under, empty
+// for untagged routes
+func metricsTag(route *database.Route) string {
+	if route.MetricsTag != "" {
+		return route.MetricsTag
+	}
+	if len(route.Tags) > 0 {
+		return route.Tags[0]
+	}
+	return ""
+}
+
+// filterTag returns the routes carrying tag, all of them when tag is empty
+func filterTag(routes []database.Route, tag string) []database.Route {
+	if tag == "" {
+		return routes
+	}
+
+	filtered := make([]database.Route, 0)
+	for _, route := range routes {
+		if slices.Contains(route.Tags, tag) {
+			filtered = append(filtered, route)
+		}
+	}
+	return filtered
+}
+
+type tagKey struct{}
+
+// withTag records the metrics tag of the matched route for the tag metrics
+func withTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, tagKey{}, tag)
+}
+
+// tagFrom returns the metrics tag recorded for the request, empty for none
+func tagFrom(ctx context.Context) string {
+	tag, _ := ctx.Value(tagKey{}).(string)
+	return tag
+}
+
+// observeTag counts a request and its duration against its route's metrics tag
+func (h *ProxyHandler) observeTag(tag string, statusCode int, duration time.Duration) {
+	h.metrics.TagRequests.WithLabelValues(tag, metrics.StatusClass(statusCode)).Inc()
+	h.metrics.TagRequestDuration.WithLabelValues(tag).Observe(duration.Seconds())
+}
+
+// applyBulk changes route as action does and reports whether it changed
+func applyBulk(route *database.Route, req *BulkRequest) bool {
+	switch req.Action {
+	case BulkEnable:
+		changed := !route.Enabled
+		route.Enabled = true
+		return changed
+	case BulkDisable:
+		changed := route.Enabled
+		route.Enabled = false
+		return changed
+	case BulkSetRateLimit:
+		changed := route.RateLimit != *req.RateLimit
+		route.RateLimit = *req.RateLimit
+		return changed
+	}
+	return true
+}
+
+// Bulk handles changing every route carrying a tag
+// @Summary Change routes by tag
+// @Description Enable, disable, set the rate limit of or delete every route carrying a tag in one transaction. Routes the action doesn't change are left out. dry_run lists the routes without changing them.
+// @Tags routes
+// @Accept json
+// @Produce json
+// @Param request body BulkRequest true "Tag and action"
+// @Success 200 {object} response.Response{data=BulkResult}
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/routes/bulk [post]
+func (h *RouteHandler) Bulk(w http.ResponseWriter, r *http.Request) {
+	// Start tracing span
+	ctx, span := tracer.Start(r.Context(), "handler.RouteHandler.Bulk")
+	defer span.End()
+
+	var req BulkRequest
+	if err := httpjson.Decode(w, r, &req); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+
+	switch {
+	case req.Tag == "":
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "tag is required")
+		return
+	case req.Action != BulkEnable && req.Action != BulkDisable && req.Action != BulkSetRateLimit && req.Action != BulkDelete:
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "action must be enable, disable, set_rate_limit or delete")
+		return
+	case req.Action == BulkSetRateLimit && (req.RateLimit == nil || *req.RateLimit < 0):
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "set_rate_limit requires a rate_limit of 0 or more")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("bulk.tag", req.Tag),
+		attribute.String("bulk.action", req.Action),
+		attribute.Bool("bulk.dry_run", req.DryRun),
+	)
+
+	result := BulkResult{Tag: req.Tag, Action: req.Action, DryRun: req.DryRun, Routes: []database.Route{}}
+	var invalid error
+	err := h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		repo := h.repo.WithTx(tx)
+
+		// Callers confined to a tenant only change its routes
+		matched, err := repo.FindByTag(ctx, req.Tag)
+		if err != nil {
+			return err
+		}
+		matched = filterTenant(r, matched)
+
+		for i := range matched {
+			before := &matched[i]
+			route := *before
+			if !applyBulk(&route, &req) {
+				continue
+			}
+			if req.Action != BulkDelete {
+				if err := ValidateRoute(&route, h.plugins); err != nil {
+					invalid = fmt.Errorf("route %d: %w", route.ID, err)
+					return invalid
+				}
+			}
+			result.Routes = append(result.Routes, route)
+			if req.DryRun {
+				continue
+			}
+
+			if req.Action == BulkDelete {
+				if err := repo.Delete(ctx, route.ID); err != nil {
+					return err
+				}
+				if err := h.recordAudit(ctx, tx, r, route.ID, database.AuditActionDelete, before, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := repo.Update(ctx, &route); err != nil {
+				return err
+			}
+			result.Routes[len(result.Routes)-1] = route
+			if err := h.recordAudit(ctx, tx, r, route.ID, audit.UpdateAction(before, &route), before, &route); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if invalid != nil {
+		span.SetStatus(codes.Error, "invalid route")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, invalid.Error())
+		return
+	}
+	if err != nil {
+		logQueryError(h.log, err, "Failed to %s routes tagged %s", req.Action, req.Tag)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to change routes")
+		if database.IsUnavailable(err) {
+			response.ServiceUnavailable(w, "Database unavailable")
+			return
+		}
+		response.InternalServerError(w, "Failed to change routes")
+		return
+	}
+
+	result.Count = len(result.Routes)
+	span.SetAttributes(attribute.Int("routes.count", result.Count))
+	if req.DryRun {
+		span.SetStatus(codes.Ok, "dry run")
+		response.Success(w, "Routes that would change", result)
+		return
+	}
+
+	// Invalidate cache
+	h.cache.Delete("routes:all")
+	for _, route := range result.Routes {
+		h.cache.Delete("route:" + strconv.Itoa(route.ID))
+		if req.Action == BulkDelete {
+			h.bus.Publish(events.RouteDeleted, map[string]int{"id": route.ID})
+		} else {
+			h.bus.Publish(events.RouteUpdated, route)
+		}
+	}
+
+	span.SetStatus(codes.Ok, "routes changed")
+	h.log.Infof("Bulk %s of routes tagged %s changed %d routes", req.Action, req.Tag, result.Count)
+	response.Success(w, "Routes changed", result)
+}
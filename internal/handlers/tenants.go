@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// tenantIDPattern keeps tenant IDs usable as DNS labels, for host-based
+// tenancy later
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var errForeignTenant = errors.New("routes can only be assigned to your own tenant")
+
+type tenantKey struct{}
+
+// withTenant records the tenant owning the matched route for the request log
+// and the tenant metrics
+func withTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// tenantFrom returns the tenant recorded for the request, empty for none
+func tenantFrom(ctx context.Context) string {
+	tenantID, _ := ctx.Value(tenantKey{}).(string)
+	return tenantID
+}
+
+// observeTenant counts a request and its body bytes against the tenant
+// owning its route, for chargeback
+func (h *ProxyHandler) observeTenant(tenantID string, statusCode int, requestSize, responseSize int64) {
+	h.metrics.TenantRequests.WithLabelValues(tenantID, strconv.Itoa(statusCode)).Inc()
+	h.metrics.TenantTransferBytes.WithLabelValues(tenantID, "request").Add(float64(requestSize))
+	h.metrics.TenantTransferBytes.WithLabelValues(tenantID, "response").Add(float64(responseSize))
+}
+
+// tenantScope returns the tenant the caller is confined to. Admins cross
+// tenants, and requests without claims aren't scoped.
+func tenantScope(r *http.Request) (string, bool) {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok || claims.HasRole(database.RoleAdmin) {
+		return "", false
+	}
+	return claims.TenantID, true
+}
+
+// scopeTenant assigns the route to the caller's tenant, refusing a route
+// naming another one
+func scopeTenant(r *http.Request, route *database.Route) error {
+	tenantID, scoped := tenantScope(r)
+	if !scoped {
+		return nil
+	}
+	if route.TenantID != "" && route.TenantID != tenantID {
+		return errForeignTenant
+	}
+	route.TenantID = tenantID
+	return nil
+}
+
+// RequireTenant answers routes outside the caller's tenant as not found, so
+// tenants can't modify or even learn of each other's routes
+func (h *RouteHandler) RequireTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantID, scoped := tenantScope(r)
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if !scoped || err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route, err := h.repo.FindByID(r.Context(), id)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			logQueryError(h.log, err, "Failed to get route %d", id)
+			if database.IsUnavailable(err) {
+				response.ServiceUnavailable(w, "Database unavailable")
+				return
+			}
+			response.InternalServerError(w, "Failed to get route")
+			return
+		}
+		if err != nil || route.TenantID != tenantID {
+			response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// filterTenant returns the routes the caller may see
+func filterTenant(r *http.Request, routes []database.Route) []database.Route {
+	tenantID, scoped := tenantScope(r)
+	if !scoped {
+		return routes
+	}
+
+	filtered := make([]database.Route, 0)
+	for _, route := range routes {
+		if route.TenantID == tenantID {
+			filtered = append(filtered, route)
+		}
+	}
+	return filtered
+}
+
+// writeRouteConflict answers a route write the database refused for a path
+// and method another route has, or for an unknown tenant. It reports whether
+// it wrote a response.
+func writeRouteConflict(w http.ResponseWriter, err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	switch pgErr.Code {
+	case uniqueViolation:
+		// Hosts and paths are global, whichever tenant holds them
+		response.ErrorCode(w, http.StatusConflict, response.CodeConflict, "Another route already serves this host, path and method")
+	case foreignKeyViolation:
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "Unknown tenant")
+	default:
+		return false
+	}
+	return true
+}
+
+// TenantHandler manages tenants and keeps their rate limits in sync
+type TenantHandler struct {
+	repo    *database.TenantRepository
+	logRepo *database.RequestLogRepository
+	tiers   *RateLimitHandler
+	log     *logger.Logger
+}
+
+// NewTenantHandler creates a new tenant handler. tiers may be nil when rate
+// limiting is disabled.
+func NewTenantHandler(db *database.Database, tiers *RateLimitHandler, log *logger.Logger) *TenantHandler {
+	return &TenantHandler{
+		repo:    database.NewTenantRepository(db),
+		logRepo: database.NewRequestLogRepository(db),
+		tiers:   tiers,
+		log:     log,
+	}
+}
+
+// tenantRequest is the body of a tenant update
+type tenantRequest struct {
+	Name      string `json:"name"`
+	RateLimit int    `json:"rate_limit"`
+}
+
+// List handles listing tenants
+// @Summary List tenants
+// @Description Get all tenants and their rate limits
+// @Tags tenants
+// @Produce json
+// @Success 200 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/tenants [get]
+func (h *TenantHandler) List(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.TenantHandler.List")
+	defer span.End()
+
+	tenants, err := h.repo.FindAll(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve tenants")
+		h.writeError(w, "retrieve", "", err)
+		return
+	}
+
+	span.SetAttributes(attribute.Int("tenants.count", len(tenants)))
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Tenants retrieved", tenants)
+}
+
+// Put handles creating or replacing a tenant
+// @Summary Create or replace a tenant
+// @Description Set a tenant's name and the requests per second its users and API keys get when they have no rate limit tier. Changes apply without a restart.
+// @Tags tenants
+// @Accept json
+// @Produce json
+// @Param id path string true "Tenant ID"
+// @Param tenant body object true "Name and rate limit"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/tenants/{id} [put]
+func (h *TenantHandler) Put(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.TenantHandler.Put")
+	defer span.End()
+
+	id := chi.URLParam(r, "id")
+	span.SetAttributes(attribute.String("tenant.id", id))
+
+	var req tenantRequest
+	if err := httpjson.Decode(w, r, &req); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+
+	if !tenantIDPattern.MatchString(id) {
+		span.SetStatus(codes.Error, "invalid tenant")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "tenant ID must be 1 to 63 lowercase letters, digits or hyphens")
+		return
+	}
+	if req.RateLimit < 0 {
+		span.SetStatus(codes.Error, "invalid tenant")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "rate_limit must not be negative")
+		return
+	}
+
+	tenant := &database.Tenant{ID: id, Name: req.Name, RateLimit: req.RateLimit}
+	if err := h.repo.Upsert(ctx, tenant); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to save tenant")
+		h.writeError(w, "save", id, err)
+		return
+	}
+	h.reloadAfterChange(ctx)
+
+	span.SetStatus(codes.Ok, "tenant saved")
+	h.log.Infof("Tenant saved: %s (%d rps)", id, tenant.RateLimit)
+	response.Success(w, "Tenant saved", tenant)
+}
+
+// Delete handles deleting a tenant
+// @Summary Delete a tenant
+// @Description Delete a tenant that no longer owns routes or users
+// @Tags tenants
+// @Produce json
+// @Param id path string true "Tenant ID"
+// @Success 200 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 409 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/tenants/{id} [delete]
+func (h *TenantHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.TenantHandler.Delete")
+	defer span.End()
+
+	id := chi.URLParam(r, "id")
+	span.SetAttributes(attribute.String("tenant.id", id))
+
+	err := h.repo.Delete(ctx, id)
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		span.SetStatus(codes.Error, "tenant not found")
+		response.NotFound(w, "Tenant not found")
+		return
+	case errors.As(err, &pgErr) && pgErr.Code == foreignKeyViolation:
+		span.SetStatus(codes.Error, "tenant in use")
+		response.ErrorCode(w, http.StatusConflict, response.CodeConflict, "Tenant still owns routes or users")
+		return
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to delete tenant")
+		h.writeError(w, "delete", id, err)
+		return
+	}
+	h.reloadAfterChange(ctx)
+
+	span.SetStatus(codes.Ok, "tenant deleted")
+	h.log.Infof("Tenant deleted: %s", id)
+	response.Success(w, "Tenant deleted", nil)
+}
+
+// Usage handles totalling a tenant's traffic for chargeback
+// @Summary Get tenant usage
+// @Description Total the requests, 5xx errors, average response time and body bytes of the tenant's routes from their request logs
+// @Tags tenants
+// @Produce json
+// @Param id path string true "Tenant ID"
+// @Param from query string false "Start of the range, RFC 3339"
+// @Param to query string false "End of the range, RFC 3339"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/tenants/{id}/usage [get]
+func (h *TenantHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.TenantHandler.Usage")
+	defer span.End()
+
+	id := chi.URLParam(r, "id")
+	span.SetAttributes(attribute.String("tenant.id", id))
+
+	var from, to time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := r.URL.Query().Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				span.SetStatus(codes.Error, "invalid time range")
+				response.BadRequest(w, name+" must be an RFC 3339 time")
+				return
+			}
+		}
+	}
+
+	if _, err := h.repo.FindByID(ctx, id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			span.SetStatus(codes.Error, "tenant not found")
+			response.NotFound(w, "Tenant not found")
+			return
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to get tenant")
+		h.writeError(w, "retrieve", id, err)
+		return
+	}
+
+	traffic, err := h.logRepo.TrafficByTenant(ctx, id, from, to)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to total request logs")
+		h.writeError(w, "total usage of", id, err)
+		return
+	}
+
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Tenant usage retrieved", traffic)
+}
+
+// writeError maps a failed tenant query to a response
+func (h *TenantHandler) writeError(w http.ResponseWriter, action, id string, err error) {
+	target := "tenants"
+	if id != "" {
+		target = "tenant " + id
+	}
+	logQueryError(h.log, err, "Failed to %s %s", action, target)
+	if database.IsUnavailable(err) {
+		response.ServiceUnavailable(w, "Database unavailable")
+		return
+	}
+	response.InternalServerError(w, "Failed to "+action+" "+target)
+}
+
+// reloadAfterChange applies a tenant's rate limit right away; the periodic
+// reload catches up if it fails
+func (h *TenantHandler) reloadAfterChange(ctx context.Context) {
+	if h.tiers == nil {
+		return
+	}
+	if err := h.tiers.Reload(ctx); err != nil {
+		h.log.Warnf("Failed to reload rate limits: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/throttle"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// ThrottleRetryAfter is the Retry-After, in seconds, sent to requests held
+// back by a route's upstream rate limit
+const ThrottleRetryAfter = "1"
+
+// SetThrottleQueue sets how many requests may wait for a token of a route
+// with upstream_rate_limit, and for how long
+func (h *ProxyHandler) SetThrottleQueue(size int, wait time.Duration) {
+	h.throttlesMu.Lock()
+	defer h.throttlesMu.Unlock()
+	h.throttleQueueSize, h.throttleQueueWait = size, wait
+	clear(h.throttles)
+}
+
+// throttle returns the route's upstream rate limit, or nil when it has none.
+// A new bucket replaces the old one when the rate or burst changes.
+func (h *ProxyHandler) throttle(route *database.Route) *throttle.Throttle {
+	if route.UpstreamRateLimit <= 0 {
+		return nil
+	}
+
+	h.throttlesMu.Lock()
+	defer h.throttlesMu.Unlock()
+
+	burst := max(route.UpstreamBurst, 1)
+	if t, ok := h.throttles[route.ID]; ok && t.Rate() == route.UpstreamRateLimit && t.Burst() == burst {
+		return t
+	}
+
+	var onQueue func(delta int)
+	if h.metrics != nil {
+		gauge := h.metrics.UpstreamQueueDepth.WithLabelValues(route.Path)
+		onQueue = func(delta int) { gauge.Add(float64(delta)) }
+	}
+	t := throttle.New(route.UpstreamRateLimit, burst, h.throttleQueueSize, h.throttleQueueWait, onQueue)
+	h.throttles[route.ID] = t
+	return t
+}
+
+// waitUpstream takes a token of the route's upstream rate limit for one
+// attempt. A client going away while waiting is reported as such.
+func (h *ProxyHandler) waitUpstream(ctx context.Context, route *database.Route) error {
+	t := h.throttle(route)
+	if t == nil {
+		return nil
+	}
+
+	err := t.Wait(ctx)
+	if err == nil {
+		return nil
+	}
+	h.metrics.UpstreamThrottled.WithLabelValues(route.Path, throttle.Reason(err)).Inc()
+	if errors.Is(err, context.Canceled) {
+		return proxy.ErrClientClosed
+	}
+	return err
+}
+
+// throttled reports whether an attempt was held back by the upstream rate limit
+func throttled(err error) bool {
+	return errors.Is(err, throttle.ErrQueueFull) || errors.Is(err, throttle.ErrQueueTimeout)
+}
+
+// rejectThrottled answers a request held back by the route's upstream rate
+// limit without touching the upstream
+func rejectThrottled(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", ThrottleRetryAfter)
+	response.ErrorFor(w, r, http.StatusServiceUnavailable, response.CodeUpstreamThrottled, "Upstream rate limit reached")
+}
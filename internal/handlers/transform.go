@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/transform"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// TransformTestRequest is the payload accepted by the transform dry-run endpoint
+type TransformTestRequest struct {
+	Direction string           `json:"direction" example:"request"` // "request" or "response"
+	Body      json.RawMessage  `json:"body" swaggertype:"object"`
+	Transform *transform.Rules `json:"transform,omitempty"` // Tried instead of the route's saved transform
+}
+
+// TransformTestResult is the outcome of a transform dry run
+type TransformTestResult struct {
+	Direction string          `json:"direction" example:"request"`
+	Body      json.RawMessage `json:"body" swaggertype:"object"`
+}
+
+// TestTransform handles a transform dry run
+// @Summary Dry-run a route's body transform
+// @Description Apply a route's saved transform, or the one in the payload, to a sample JSON body without proxying anything
+// @Tags routes
+// @Accept json
+// @Produce json
+// @Param id path int true "Route ID"
+// @Param request body TransformTestRequest true "Sample body"
+// @Success 200 {object} response.Response{data=TransformTestResult}
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 503 {object} response.Response
+// @Security BearerAuth
+// @Router /api/routes/{id}/transform/test [post]
+func (h *RouteHandler) TestTransform(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.RouteHandler.TestTransform")
+	defer span.End()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid route ID")
+		response.BadRequest(w, "Invalid route ID")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("route.id", id))
+
+	var req TransformTestRequest
+	if err := httpjson.Decode(w, r, &req); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+	if req.Direction == "" {
+		req.Direction = transform.DirectionRequest
+	}
+	if req.Direction != transform.DirectionRequest && req.Direction != transform.DirectionResponse {
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "direction must be request or response")
+		return
+	}
+	if len(req.Body) == 0 {
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "body is required")
+		return
+	}
+
+	route, err := h.repo.FindByID(ctx, id)
+	if database.IsUnavailable(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "database unavailable")
+		response.ServiceUnavailable(w, "Database unavailable")
+		return
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, "route not found")
+		response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+		return
+	}
+
+	rules := route.Transform
+	if req.Transform != nil {
+		if err := req.Transform.Validate(); err != nil {
+			response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+			return
+		}
+		rules = req.Transform
+	}
+
+	// Without rules for the direction the body would be forwarded unchanged
+	result := TransformTestResult{Direction: req.Direction, Body: req.Body}
+	if rules != nil && rules.Ops(req.Direction) != nil {
+		body, err := rules.Ops(req.Direction).Apply(req.Body)
+		if err != nil {
+			span.SetStatus(codes.Error, "transform failed")
+			response.ErrorCode(w, http.StatusBadRequest, response.CodeTransformFailed, err.Error())
+			return
+		}
+		result.Body = body
+	}
+
+	span.SetStatus(codes.Ok, "transform tested")
+	response.Success(w, "Transform applied", result)
+}
@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errWrongPassword      = errors.New("current password is incorrect")
+	errLastAdmin          = errors.New("cannot remove the last enabled admin")
+)
+
+// Postgres error codes for a duplicate key and a missing or still
+// referenced row
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
+)
+
+// UserHandler handles user account management
+type UserHandler struct {
+	db                *database.Database
+	repo              *database.UserRepository
+	passwordMinLength int
+	log               *logger.Logger
+}
+
+// NewUserHandler creates a new user handler
+func NewUserHandler(db *database.Database, passwordMinLength int, log *logger.Logger) *UserHandler {
+	return &UserHandler{
+		db:                db,
+		repo:              database.NewUserRepository(db),
+		passwordMinLength: passwordMinLength,
+		log:               log,
+	}
+}
+
+// userRequest is the body of user create and update requests. Omitted fields
+// are left unchanged on update.
+type userRequest struct {
+	Username *string   `json:"username"`
+	Password *string   `json:"password"`
+	Roles    *[]string `json:"roles"`
+	Enabled  *bool     `json:"enabled"`
+	TenantID *string   `json:"tenant_id"` // Empty for a gateway-wide account
+}
+
+// passwordHash validates and hashes the requested password, if any
+func (req *userRequest) passwordHash(minLength int) (string, error) {
+	if req.Password == nil {
+		return "", nil
+	}
+	if err := auth.ValidatePassword(*req.Password, minLength); err != nil {
+		return "", err
+	}
+	return auth.HashPassword(*req.Password)
+}
+
+// apply copies the set fields onto user, replacing the password hash when one is given
+func (req *userRequest) apply(user *database.User, hash string) error {
+	if req.Username != nil {
+		user.Username = strings.TrimSpace(*req.Username)
+	}
+	if req.Roles != nil {
+		user.Roles = *req.Roles
+	}
+	if req.Enabled != nil {
+		user.Enabled = *req.Enabled
+	}
+	if req.TenantID != nil {
+		user.TenantID = *req.TenantID
+	}
+	if hash != "" {
+		user.PasswordHash = hash
+	}
+
+	if user.Username == "" {
+		return errors.New("username is required")
+	}
+	return nil
+}
+
+// guardLastAdmin fails when a change would leave no enabled admin
+func guardLastAdmin(ctx context.Context, repo *database.UserRepository, before, after *database.User) error {
+	if !before.IsAdmin() || (after != nil && after.IsAdmin()) {
+		return nil
+	}
+
+	admins, err := repo.LockAdmins(ctx)
+	if err != nil {
+		return err
+	}
+	if admins <= 1 {
+		return errLastAdmin
+	}
+	return nil
+}
+
+// List handles listing all users
+// @Summary List users
+// @Description Get all user accounts. Password hashes are never returned.
+// @Tags users
+// @Produce json
+// @Success 200 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/users [get]
+func (h *UserHandler) List(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.UserHandler.List")
+	defer span.End()
+
+	users, err := h.repo.FindAll(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve users")
+		logQueryError(h.log, err, "Failed to list users")
+		response.InternalServerError(w, "Failed to retrieve users")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("users.count", len(users)))
+	span.SetStatus(codes.Ok, "success")
+	response.Success(w, "Users retrieved", users)
+}
+
+// Get handles getting a single user by ID
+// @Summary Get user by ID
+// @Description Get a user account by its ID
+// @Tags users
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Security BearerAuth
+// @Router /api/users/{id} [get]
+func (h *UserHandler) Get(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.UserHandler.Get")
+	defer span.End()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid user ID")
+		response.BadRequest(w, "Invalid user ID")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("user.id", id))
+
+	user, err := h.repo.FindByID(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		span.SetStatus(codes.Error, "user not found")
+		response.NotFound(w, "User not found")
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to retrieve user")
+		logQueryError(h.log, err, "Failed to get user %d", id)
+		response.InternalServerError(w, "Failed to retrieve user")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "user retrieved")
+	response.Success(w, "User retrieved", user)
+}
+
+// Create handles creating a new user
+// @Summary Create a user
+// @Description Create a user account with a password and roles
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param user body object true "Username, password, roles, enabled flag and tenant"
+// @Success 201 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 409 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/users [post]
+func (h *UserHandler) Create(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.UserHandler.Create")
+	defer span.End()
+
+	var req userRequest
+	if err := httpjson.Decode(w, r, &req); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+	if req.Password == nil {
+		span.SetStatus(codes.Error, "missing password")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "Password is required")
+		return
+	}
+
+	hash, err := req.passwordHash(h.passwordMinLength)
+	if err != nil {
+		span.SetStatus(codes.Error, "password policy")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+		return
+	}
+
+	user := database.User{Enabled: true}
+	if err := req.apply(&user, hash); err != nil {
+		span.SetStatus(codes.Error, "invalid user")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+		return
+	}
+
+	span.SetAttributes(attribute.String("user.username", user.Username))
+
+	if err := h.repo.Create(ctx, &user); err != nil {
+		h.writeError(w, "create", &user, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to create user")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("user.id", user.ID))
+	span.SetStatus(codes.Ok, "user created")
+
+	h.log.Infof("User created: %s", user.Username)
+	response.JSON(w, http.StatusCreated, response.Response{
+		Success: true,
+		Message: "User created successfully",
+		Data:    user,
+	})
+}
+
+// Update handles updating a user's roles, enabled flag, username or password
+// @Summary Update a user
+// @Description Update a user account. Omitted fields are left unchanged.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param user body object true "Fields to change"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 409 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/users/{id} [put]
+func (h *UserHandler) Update(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.UserHandler.Update")
+	defer span.End()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid user ID")
+		response.BadRequest(w, "Invalid user ID")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("user.id", id))
+
+	var req userRequest
+	if err := httpjson.Decode(w, r, &req); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid request body")
+		httpjson.WriteError(w, err)
+		return
+	}
+	hash, err := req.passwordHash(h.passwordMinLength)
+	if err != nil {
+		span.SetStatus(codes.Error, "password policy")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, err.Error())
+		return
+	}
+
+	var user *database.User
+	var invalid error
+	err = h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		repo := h.repo.WithTx(tx)
+
+		before, err := repo.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		after := *before
+		if invalid = req.apply(&after, hash); invalid != nil {
+			return invalid
+		}
+		if err := guardLastAdmin(ctx, repo, before, &after); err != nil {
+			return err
+		}
+
+		user = &after
+		return repo.Update(ctx, user)
+	})
+	if invalid != nil {
+		span.SetStatus(codes.Error, "invalid user")
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, invalid.Error())
+		return
+	}
+	if err != nil {
+		h.writeError(w, "update", &database.User{ID: id}, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to update user")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "user updated")
+
+	h.log.Infof("User updated: %d", id)
+	response.Success(w, "User updated successfully", user)
+}
+
+// Delete handles deleting a user
+// @Summary Delete a user
+// @Description Delete a user account. The last enabled admin can't be deleted.
+// @Tags users
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Failure 404 {object} response.Response
+// @Failure 409 {object} response.Response
+// @Failure 500 {object} response.Response
+// @Security BearerAuth
+// @Router /api/users/{id} [delete]
+func (h *UserHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handler.UserHandler.Delete")
+	defer span.End()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid user ID")
+		response.BadRequest(w, "Invalid user ID")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("user.id", id))
+
+	err = h.db.WithTx(ctx, func(tx pgx.Tx) error {
+		repo := h.repo.WithTx(tx)
+
+		before, err := repo.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := guardLastAdmin(ctx, repo, before, nil); err != nil {
+			return err
+		}
+		return repo.Delete(ctx, id)
+	})
+	if err != nil {
+		h.writeError(w, "delete", &database.User{ID: id}, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to delete user")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "user deleted")
+
+	h.log.Infof("User deleted: %d", id)
+	response.Success(w, "User deleted successfully", nil)
+}
+
+// writeError maps a failed user change to a response
+func (h *UserHandler) writeError(w http.ResponseWriter, action string, user *database.User, err error) {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		response.NotFound(w, "User not found")
+	case errors.Is(err, errLastAdmin):
+		response.Error(w, http.StatusConflict, "Cannot remove or disable the last enabled admin")
+	case errors.As(err, &pgErr) && pgErr.Code == uniqueViolation:
+		response.Error(w, http.StatusConflict, "Username already exists")
+	case errors.As(err, &pgErr) && pgErr.Code == foreignKeyViolation:
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed, "Unknown tenant")
+	default:
+		logQueryError(h.log, err, "Failed to %s user %d", action, user.ID)
+		response.InternalServerError(w, "Failed to "+action+" user")
+	}
+}
@@ -0,0 +1,169 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Check reports an error when a dependency is unhealthy
+type Check func(ctx context.Context) error
+
+// Check result values
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+	Healthy        = "healthy"
+	Unhealthy      = "unhealthy"
+)
+
+// Report is the combined result of all checks
+type Report struct {
+	Status  string                 `json:"status"`
+	Checks  map[string]string      `json:"checks"`
+	Details map[string]interface{} `json:"details,omitempty"` // What failing checks found, by check name
+}
+
+// Detailed is a check error carrying details listed in the report, such as
+// the items that failed
+type Detailed interface {
+	error
+	Details() interface{}
+}
+
+// OK reports whether every check passed
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs a set of checks and caches the result for a short time so
+// aggressive probes don't hammer dependencies. Concurrent probes missing the
+// cache share a single run.
+type Checker struct {
+	mu        sync.Mutex
+	checks    []namedCheck
+	ttl       time.Duration
+	timeout   time.Duration
+	cached    *Report
+	checkedAt time.Time
+	runs      singleflight.Group
+}
+
+// New creates a checker caching results for ttl. Each check run is bounded by timeout.
+func New(ttl, timeout time.Duration) *Checker {
+	return &Checker{
+		ttl:     ttl,
+		timeout: timeout,
+	}
+}
+
+// Register adds a named check
+func (c *Checker) Register(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+	c.cached = nil
+}
+
+// Check runs all checks concurrently, or returns the cached report if it is
+// still fresh. The checks run detached from ctx, bounded by the checker's
+// timeout, so a probe that gives up doesn't leave a degraded report cached
+// for every probe after it.
+func (c *Checker) Check(ctx context.Context) Report {
+	c.mu.Lock()
+	if c.cached != nil && time.Since(c.checkedAt) < c.ttl {
+		report := *c.cached
+		c.mu.Unlock()
+		return report
+	}
+	c.mu.Unlock()
+
+	result := c.runs.DoChan("check", func() (interface{}, error) {
+		return c.run(context.WithoutCancel(ctx)), nil
+	})
+	select {
+	case res := <-result:
+		return res.Val.(Report)
+	case <-ctx.Done():
+		return c.abandoned()
+	}
+}
+
+// run runs the registered checks and caches the report
+func (c *Checker) run(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := c.checks
+	c.mu.Unlock()
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	report := Report{
+		Status: StatusOK,
+		Checks: make(map[string]string, len(checks)),
+	}
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			errs[i] = check(ctx)
+		}(i, nc.check)
+	}
+	wg.Wait()
+
+	for i, nc := range checks {
+		if errs[i] == nil {
+			report.Checks[nc.name] = Healthy
+			continue
+		}
+
+		report.Status = StatusDegraded
+		report.Checks[nc.name] = Unhealthy
+
+		var detailed Detailed
+		if errors.As(errs[i], &detailed) {
+			if report.Details == nil {
+				report.Details = make(map[string]interface{})
+			}
+			report.Details[nc.name] = detailed.Details()
+		}
+	}
+
+	c.mu.Lock()
+	c.cached = &report
+	c.checkedAt = time.Now()
+	c.mu.Unlock()
+	return report
+}
+
+// abandoned is the report for a caller giving up before the checks finish.
+// Every check is reported unhealthy, as none answered in time, and nothing is
+// cached.
+func (c *Checker) abandoned() Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := Report{
+		Status: StatusDegraded,
+		Checks: make(map[string]string, len(c.checks)),
+	}
+	for _, nc := range c.checks {
+		report.Checks[nc.name] = Unhealthy
+	}
+	return report
+}
@@ -0,0 +1,271 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/pkg/config"
+)
+
+// Header carries the client's idempotency key
+const Header = "Idempotency-Key"
+
+// ReplayedHeader marks responses replayed from the store
+const ReplayedHeader = "Idempotent-Replayed"
+
+// Results recorded for requests carrying a key
+const (
+	ResultMiss     = "miss"
+	ResultReplayed = "replayed"
+	ResultConflict = "conflict"
+	ResultMismatch = "mismatch"
+	ResultTooLarge = "too_large"
+)
+
+// ErrConflict is returned while another request with the same key but a
+// different body is still in flight
+var ErrConflict = errors.New("a request with this idempotency key is in progress")
+
+// ErrMismatch is returned when a stored key was used for a different request
+var ErrMismatch = errors.New("idempotency key was used for a different request")
+
+// Response is a stored upstream response
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	hash   string
+}
+
+// Write replays the response to w
+func (resp *Response) Write(w http.ResponseWriter) {
+	resp.Replay(w, ReplayedHeader)
+}
+
+// Replay writes the response to w with header set to mark it as replayed
+func (resp *Response) Replay(w http.ResponseWriter, header string) {
+	for key, values := range resp.Header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	w.Header().Set(header, "true")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
+// Size approximates the response's size in bytes
+func (resp *Response) Size() int {
+	n := len(resp.Body)
+	for key, values := range resp.Header {
+		n += len(key)
+		for _, value := range values {
+			n += len(value)
+		}
+	}
+	return n
+}
+
+// Store keeps responses by idempotency key in the cache and makes concurrent
+// requests with the same key wait for the first one
+type Store struct {
+	cache    *cache.Cache
+	ttl      time.Duration
+	maxBody  int64
+	mu       sync.Mutex
+	inflight map[string]*call
+}
+
+// call is a request holding a key until its response is stored
+type call struct {
+	hash string
+	done chan struct{}
+}
+
+// New creates a store keeping responses in c
+func New(c *cache.Cache, cfg *config.ProxyConfig) *Store {
+	return &Store{
+		cache:    c,
+		ttl:      cfg.IdempotencyTTL,
+		maxBody:  cfg.IdempotencyMaxBody,
+		inflight: make(map[string]*call),
+	}
+}
+
+// Applies reports whether r carries a key on a method that isn't idempotent by itself
+func Applies(r *http.Request) bool {
+	return r.Header.Get(Header) != "" && (r.Method == http.MethodPost || r.Method == http.MethodPatch)
+}
+
+// Hash buffers the request body and returns a hash of the method, URI and
+// body. It reports false, leaving the body readable, when the body is over the
+// size cap.
+func (s *Store) Hash(r *http.Request) (string, bool) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		original := r.Body
+		buf, err := io.ReadAll(io.LimitReader(original, s.maxBody+1))
+		if err != nil || int64(len(buf)) > s.maxBody {
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), original), original}
+			return "", false
+		}
+		r.Body = readCloser{bytes.NewReader(buf), original}
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+		body = buf
+	}
+
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// Acquire returns the stored response for key, first waiting for a request
+// with the same key and hash still in flight. When there is none it reserves
+// the key and returns nil; the caller must then call Release.
+func (s *Store) Acquire(ctx context.Context, key, hash string) (*Response, error) {
+	for {
+		s.mu.Lock()
+		if cached, ok := s.cache.Get(key); ok {
+			s.mu.Unlock()
+			resp := cached.(*Response)
+			if resp.hash != hash {
+				return nil, ErrMismatch
+			}
+			return resp, nil
+		}
+
+		c, ok := s.inflight[key]
+		if !ok {
+			s.inflight[key] = &call{hash: hash, done: make(chan struct{})}
+			s.mu.Unlock()
+			return nil, nil
+		}
+		s.mu.Unlock()
+
+		if c.hash != hash {
+			return nil, ErrConflict
+		}
+
+		// A request whose response wasn't stored lets the next waiter through
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Release stores resp under key, unless it is nil, and wakes the requests
+// waiting for it. Cookies the response set are left out of the stored copy
+// rather than handed to whoever replays it.
+func (s *Store) Release(key string, resp *Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.inflight[key]
+	if !ok {
+		return
+	}
+	if resp != nil {
+		resp.hash = c.hash
+		resp.Header = resp.Header.Clone()
+		resp.Header.Del("Set-Cookie")
+		s.cache.SetWithTTL(key, resp, s.ttl)
+	}
+	delete(s.inflight, key)
+	close(c.done)
+}
+
+// Recorder passes a response through to the client while keeping a copy of
+// it up to the size cap
+type Recorder struct {
+	http.ResponseWriter
+	store    *Store
+	key      string
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	maxBody  int64
+	overflow bool
+}
+
+// NewRecorder wraps w to record the response to the request holding key
+func (s *Store) NewRecorder(w http.ResponseWriter, key string) *Recorder {
+	return &Recorder{ResponseWriter: w, store: s, key: key, maxBody: s.maxBody}
+}
+
+// Record wraps w to record a response of up to maxBody bytes for callers
+// that keep responses themselves. Its Release does nothing.
+func Record(w http.ResponseWriter, maxBody int64) *Recorder {
+	return &Recorder{ResponseWriter: w, maxBody: maxBody}
+}
+
+func (rec *Recorder) WriteHeader(code int) {
+	// Informational responses precede the one to record
+	if rec.status == 0 && code >= http.StatusOK {
+		rec.status = code
+		rec.header = rec.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *Recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.maxBody {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer so streamed responses can be flushed
+func (rec *Recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Response returns the recorded response, or nil when it shouldn't be
+// replayed: nothing was written, the body was over the size cap or the
+// status was 5xx, which a retry may get past
+func (rec *Recorder) Response() *Response {
+	if rec.status == 0 || rec.overflow || rec.status >= http.StatusInternalServerError {
+		return nil
+	}
+	return &Response{
+		Status: rec.status,
+		Header: rec.header,
+		Body:   bytes.Clone(rec.body.Bytes()),
+	}
+}
+
+// Status returns the status written, 0 when nothing was
+func (rec *Recorder) Status() int {
+	return rec.status
+}
+
+// Release stores the recorded response and releases the key
+func (rec *Recorder) Release() {
+	if rec.store != nil {
+		rec.store.Release(rec.key, rec.Response())
+	}
+}
+
+// readCloser reads from a buffered copy but closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,181 @@
+package inflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCancelled is the cause of the context of a request cancelled through
+// the registry. It wraps context.Canceled, so the circuit breaker and outlier
+// detection don't hold it against the upstream.
+var ErrCancelled = fmt.Errorf("request cancelled by an administrator: %w", context.Canceled)
+
+// shards spreads requests over separately locked maps so registering one
+// rarely waits on another
+const shards = 32
+
+// Request describes a request the gateway is serving
+type Request struct {
+	ID        string    `json:"id"`                 // Key to cancel it by: the request ID, suffixed when a client reused one
+	RequestID string    `json:"request_id"`         // X-Request-ID
+	Method    string    `json:"method"`             // Request method
+	Path      string    `json:"path"`               // Normalized request path
+	ClientIP  string    `json:"client_ip"`          // Client address
+	RouteID   int       `json:"route_id,omitempty"` // Matched route, once the proxy found it
+	Route     string    `json:"route,omitempty"`    // Path of the matched route
+	Upstream  string    `json:"upstream,omitempty"` // Target forwarded to, once known
+	Started   time.Time `json:"started"`
+	AgeMS     int64     `json:"age_ms"`
+}
+
+// entry is a registered request. The route and upstream are set by the proxy
+// while the request is listed, so they are guarded.
+type entry struct {
+	mu     sync.Mutex
+	req    Request
+	cancel context.CancelCauseFunc
+}
+
+type shard struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// Registry tracks the requests in flight, up to a bound
+type Registry struct {
+	max       int64
+	count     atomic.Int64
+	untracked atomic.Int64 // Requests not tracked because the registry was full
+	seq       atomic.Uint64
+	seed      maphash.Seed
+	shards    [shards]shard
+}
+
+// New creates a registry tracking up to max requests at once
+func New(max int) *Registry {
+	r := &Registry{max: int64(max), seed: maphash.MakeSeed()}
+	for i := range r.shards {
+		r.shards[i].entries = make(map[string]*entry)
+	}
+	return r
+}
+
+type entryKey struct{}
+
+// Register tracks a request until the returned func is called. The returned
+// context is cancelled when the request is cancelled through Cancel. When
+// the registry is full the request isn't tracked and ctx is returned as is.
+func (r *Registry) Register(ctx context.Context, req Request) (context.Context, func()) {
+	if r.count.Add(1) > r.max {
+		r.count.Add(-1)
+		r.untracked.Add(1)
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	e := &entry{req: req, cancel: cancel}
+	id := req.ID
+	s := r.shard(id)
+	s.mu.Lock()
+	if _, taken := s.entries[id]; taken {
+		// Clients may send the same X-Request-ID more than once
+		s.mu.Unlock()
+		id = req.ID + "." + strconv.FormatUint(r.seq.Add(1), 10)
+		s = r.shard(id)
+		s.mu.Lock()
+	}
+	e.req.ID = id
+	s.entries[id] = e
+	s.mu.Unlock()
+
+	return context.WithValue(ctx, entryKey{}, e), func() {
+		s.mu.Lock()
+		delete(s.entries, id)
+		s.mu.Unlock()
+		r.count.Add(-1)
+		cancel(nil)
+	}
+}
+
+func (r *Registry) shard(id string) *shard {
+	return &r.shards[maphash.String(r.seed, id)%shards]
+}
+
+// List returns the requests in flight for at least minAge, oldest first
+func (r *Registry) List(minAge time.Duration) []Request {
+	now := time.Now()
+	requests := []Request{}
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		for _, e := range s.entries {
+			e.mu.Lock()
+			req := e.req
+			e.mu.Unlock()
+			if age := now.Sub(req.Started); age >= minAge {
+				req.AgeMS = age.Milliseconds()
+				requests = append(requests, req)
+			}
+		}
+		s.mu.Unlock()
+	}
+	slices.SortFunc(requests, func(a, b Request) int {
+		return a.Started.Compare(b.Started)
+	})
+	return requests
+}
+
+// Cancel cancels the context of the request in flight with id, reporting
+// whether there was one
+func (r *Registry) Cancel(id string) bool {
+	s := r.shard(id)
+	s.mu.Lock()
+	e, ok := s.entries[id]
+	s.mu.Unlock()
+	if ok {
+		e.cancel(ErrCancelled)
+	}
+	return ok
+}
+
+// Tracked returns the number of requests being tracked
+func (r *Registry) Tracked() int64 {
+	return r.count.Load()
+}
+
+// Untracked returns the number of requests that went untracked because the
+// registry was full
+func (r *Registry) Untracked() int64 {
+	return r.untracked.Load()
+}
+
+// SetRoute records the route matched for the request of ctx. It is a no-op
+// for requests that aren't tracked.
+func SetRoute(ctx context.Context, id int, path string) {
+	if e, ok := ctx.Value(entryKey{}).(*entry); ok {
+		e.mu.Lock()
+		e.req.RouteID, e.req.Route = id, path
+		e.mu.Unlock()
+	}
+}
+
+// SetUpstream records the target the request of ctx is forwarded to
+func SetUpstream(ctx context.Context, target string) {
+	if e, ok := ctx.Value(entryKey{}).(*entry); ok {
+		e.mu.Lock()
+		e.req.Upstream = target
+		e.mu.Unlock()
+	}
+}
+
+// Cancelled reports whether ctx was cancelled through the registry
+func Cancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrCancelled)
+}
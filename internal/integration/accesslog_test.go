@@ -0,0 +1,195 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/accesslog"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// readAccessLog returns the lines of the access log at path and its rotated files
+func readAccessLog(t *testing.T, path string) (lines []string, files int) {
+	t.Helper()
+	matches, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatalf("Failed to list access logs: %v", err)
+	}
+	for _, name := range matches {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", name, err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		file.Close()
+	}
+	return lines, len(matches)
+}
+
+// TestAccessLogRotation tests that a busy access log rotates by size, keeps
+// the configured number of files and loses no entries when closed
+func TestAccessLogRotation(t *testing.T) {
+	const entries = 5000
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, err := accesslog.New(&config.AccessLogConfig{
+		Path:       path,
+		Format:     accesslog.FormatJSON,
+		MaxBytes:   64 << 10,
+		MaxBackups: 100,
+		QueueSize:  entries,
+	}, nil, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to open access log: %v", err)
+	}
+
+	for i := 0; i < entries; i++ {
+		w.Write(accesslog.Entry{
+			Time:      time.Now(),
+			RequestID: fmt.Sprintf("req-%d", i),
+			Method:    "GET",
+			URI:       "/api/items",
+			Proto:     "HTTP/1.1",
+			Status:    http.StatusOK,
+			Latency:   time.Millisecond,
+		})
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close access log: %v", err)
+	}
+
+	lines, files := readAccessLog(t, path)
+	if files < 5 {
+		t.Errorf("Expected the log to rotate several times, got %d files", files)
+	}
+	seen := make(map[string]bool, entries)
+	for _, line := range lines {
+		var entry struct {
+			RequestID string  `json:"request_id"`
+			LatencyMS float64 `json:"latency_ms"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid entry %q: %v", line, err)
+		}
+		seen[entry.RequestID] = true
+	}
+	if len(lines) != entries || len(seen) != entries {
+		t.Errorf("Expected %d distinct entries, got %d lines with %d distinct", entries, len(lines), len(seen))
+	}
+
+	// Writes after closing are ignored
+	w.Write(accesslog.Entry{RequestID: "late"})
+}
+
+// TestAccessLogRetention tests that the oldest rotated files are removed
+func TestAccessLogRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, err := accesslog.New(&config.AccessLogConfig{
+		Path:       path,
+		Format:     accesslog.FormatCombined,
+		MaxBytes:   4 << 10,
+		MaxBackups: 2,
+		QueueSize:  3000,
+	}, nil, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to open access log: %v", err)
+	}
+
+	for i := 0; i < 3000; i++ {
+		w.Write(accesslog.Entry{Time: time.Now(), RequestID: fmt.Sprintf("req-%d", i), Method: "GET", URI: "/", Proto: "HTTP/1.1", Status: 200})
+	}
+	w.Close()
+
+	if _, files := readAccessLog(t, path); files != 3 {
+		t.Errorf("Expected the current file and 2 rotated files, got %d", files)
+	}
+	// The newest entry is in the current file
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read access log: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(current)), "\n"); !strings.Contains(lines[len(lines)-1], `"req-2999"`) {
+		t.Errorf("Expected the last entry in the current file, got %q", lines[len(lines)-1])
+	}
+}
+
+// TestAccessLogReopen tests that the log follows its path after being moved
+func TestAccessLogReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, err := accesslog.New(&config.AccessLogConfig{Path: path, Format: accesslog.FormatJSON, QueueSize: 16}, nil, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to open access log: %v", err)
+	}
+	defer w.Close()
+
+	w.Write(accesslog.Entry{RequestID: "before"})
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Failed to move access log: %v", err)
+	}
+	if err := w.Reopen(); err != nil {
+		t.Fatalf("Failed to reopen access log: %v", err)
+	}
+	w.Write(accesslog.Entry{RequestID: "after"})
+	w.Close()
+
+	moved, _ := os.ReadFile(path + ".1")
+	current, _ := os.ReadFile(path)
+	if !strings.Contains(string(moved), `"before"`) || strings.Contains(string(moved), `"after"`) {
+		t.Errorf("Expected only the earlier entry in the moved file, got %q", moved)
+	}
+	if !strings.Contains(string(current), `"after"`) {
+		t.Errorf("Expected the later entry in the reopened file, got %q", current)
+	}
+}
+
+// TestAccessLogMiddleware tests that the Logger middleware records the
+// request ID, route, upstream, size and latency of each request
+func TestAccessLogMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, err := accesslog.New(&config.AccessLogConfig{Path: path, Format: accesslog.FormatCombined, QueueSize: 16}, nil, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to open access log: %v", err)
+	}
+
+	log := logger.Get()
+	handler := middleware.RequestID(middleware.Logger(log, w, nil)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		accesslog.SetRoute(r.Context(), 7)
+		accesslog.SetUpstream(r.Context(), "http://backend:8080/items")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte("hello"))
+	})))
+
+	req := httptest.NewRequest("POST", "/items?x=1", nil)
+	req.Header.Set("X-Request-ID", "access-log-test")
+	req.Header.Set("User-Agent", "tester")
+	req.RemoteAddr = "192.0.2.7:5000"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	w.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read access log: %v", err)
+	}
+	line := string(data)
+	for _, want := range []string{
+		`192.0.2.7 - - [`,
+		`"POST /items?x=1 HTTP/1.1" 201 5 "-" "tester" "access-log-test" 7 "http://backend:8080/items" `,
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected %q in %q", want, line)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestACLCheck tests CIDR matching and deny precedence
+func TestACLCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		allow      []string
+		deny       []string
+		ip         string
+		wantAllow  bool
+		wantReason string
+	}{
+		{"EmptyAllowsAll", nil, nil, "203.0.113.7", true, ""},
+		{"IPv4Allowed", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true, ""},
+		{"IPv4NotAllowed", []string{"10.0.0.0/8"}, nil, "192.168.1.1", false, acl.ReasonNotAllowed},
+		{"IPv4Denied", nil, []string{"198.51.100.0/24"}, "198.51.100.9", false, acl.ReasonDenied},
+		{"IPv4NotDenied", nil, []string{"198.51.100.0/24"}, "198.51.101.9", true, ""},
+		{"DenyBeatsAllow", []string{"10.0.0.0/8"}, []string{"10.0.5.0/24"}, "10.0.5.1", false, acl.ReasonDenied},
+		{"DenyBeatsSameAllow", []string{"10.0.0.1"}, []string{"10.0.0.1"}, "10.0.0.1", false, acl.ReasonDenied},
+		{"BareAddress", []string{"10.0.0.1"}, nil, "10.0.0.2", false, acl.ReasonNotAllowed},
+		{"IPv6Allowed", []string{"2001:db8::/32"}, nil, "2001:db8:1::1", true, ""},
+		{"IPv6NotAllowed", []string{"2001:db8::/32"}, nil, "2001:db9::1", false, acl.ReasonNotAllowed},
+		{"IPv6Denied", []string{"::/0"}, []string{"2001:db8:bad::/48"}, "2001:db8:bad::1", false, acl.ReasonDenied},
+		{"IPv6ClientIPv4List", []string{"10.0.0.0/8"}, nil, "2001:db8::1", false, acl.ReasonNotAllowed},
+		{"MappedIPv4Client", []string{"10.0.0.0/8"}, nil, "::ffff:10.0.0.1", true, ""},
+		{"MappedIPv4List", []string{"::ffff:10.0.0.0/104"}, nil, "10.0.0.1", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := acl.Parse(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatalf("Failed to parse lists: %v", err)
+			}
+
+			allowed, reason := list.Check(netip.MustParseAddr(tt.ip))
+			if allowed != tt.wantAllow || reason != tt.wantReason {
+				t.Errorf("Expected (%v, %q), got (%v, %q)", tt.wantAllow, tt.wantReason, allowed, reason)
+			}
+		})
+	}
+
+	t.Run("InvalidSyntax", func(t *testing.T) {
+		for _, value := range []string{"10.0.0.0/33", "2001:db8::/129", "not-an-ip", "10.0.0"} {
+			if err := acl.Validate([]string{value}, nil); err == nil {
+				t.Errorf("Expected %q to be rejected", value)
+			}
+			if err := acl.Validate(nil, []string{value}); err == nil {
+				t.Errorf("Expected %q to be rejected in the deny list", value)
+			}
+		}
+	})
+}
+
+// TestACLMiddleware tests the gateway-wide IP filter
+func TestACLMiddleware(t *testing.T) {
+	m := testMetrics()
+	list, err := acl.Parse([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.66.0.0/16"})
+	if err != nil {
+		t.Fatalf("Failed to parse lists: %v", err)
+	}
+
+	handler := middleware.IPFilter(list, m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+		reason     string
+	}{
+		{"10.1.1.1:4000", http.StatusOK, ""},
+		{"[2001:db8::1]:4000", http.StatusOK, ""},
+		{"10.66.1.1:4000", http.StatusForbidden, acl.ReasonDenied},
+		{"[2001:db9::1]:4000", http.StatusForbidden, acl.ReasonNotAllowed},
+		{"garbage", http.StatusForbidden, acl.ReasonInvalidIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			var before float64
+			if tt.reason != "" {
+				before = testutil.ToFloat64(m.ACLBlocked.WithLabelValues("global", tt.reason))
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, w.Code)
+			}
+			if tt.reason != "" {
+				if got := testutil.ToFloat64(m.ACLBlocked.WithLabelValues("global", tt.reason)); got != before+1 {
+					t.Errorf("Expected blocked counter to increase, got %v -> %v", before, got)
+				}
+			}
+		})
+	}
+}
+
+// TestRouteACL tests per-route IP lists enforced by the proxy handler
+func TestRouteACL(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	path := fmt.Sprintf("/acl-%d", time.Now().UnixNano())
+	route := &database.Route{
+		Path:      path,
+		TargetURL: backend.URL,
+		Method:    "GET",
+		Enabled:   true,
+		Timeout:   30,
+		IPAllow:   []string{"192.0.2.0/24"},
+		IPDeny:    []string{"192.0.2.66"},
+	}
+	repo := database.NewRouteRepository(db)
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, testMetrics(), nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		testMetrics(),
+		log,
+	)
+
+	for remoteAddr, want := range map[string]int{
+		"192.0.2.10:5000":   http.StatusOK,
+		"192.0.2.66:5000":   http.StatusForbidden,
+		"203.0.113.1:5000":  http.StatusForbidden,
+		"[2001:db8::1]:500": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, req)
+
+		if w.Code != want {
+			t.Errorf("%s: expected status %d, got %d", remoteAddr, want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/adminui"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/drain"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/router"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// testRouter creates a router without a database, adjusting its
+// configuration with configure
+func testRouter(t *testing.T, authService *auth.AuthService, configure func(*config.Config)) http.Handler {
+	t.Helper()
+
+	cfg := config.Load()
+	configure(cfg)
+
+	log := logger.Get()
+	bus := events.NewBus()
+	cacheInstance := cache.New(&cfg.Cache, log, bus)
+	t.Cleanup(cacheInstance.Stop)
+
+	r := router.NewV2(
+		database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		cacheInstance,
+		proxy.New(5*time.Second, &cfg.Proxy, log),
+		cfg,
+		log,
+		authService,
+		nil,
+		circuitbreaker.New(log, testMetrics(), nil),
+		loadbalancer.New(loadbalancer.RoundRobin, bus),
+		websocket.NewHub(&cfg.WebSocket, log, nil),
+		bus,
+		drain.New(),
+	)
+	t.Cleanup(r.Shutdown)
+	return r.Handler()
+}
+
+// adminUIGet sends a GET request with headers to handler
+func adminUIGet(handler http.Handler, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// TestAdminUIFiles tests serving the embedded files and the SPA fallback
+func TestAdminUIFiles(t *testing.T) {
+	handler := testRouter(t, auth.NewAuthService("test-secret", logger.Get()), func(cfg *config.Config) {
+		cfg.Auth.Enabled = false
+		cfg.AdminUI.Enabled = true
+	})
+
+	index := adminUIGet(handler, "/admin", nil)
+	if index.Code != http.StatusOK || !strings.Contains(index.Body.String(), "<title>Isekai Admin</title>") {
+		t.Fatalf("Expected the index page, got %d: %s", index.Code, index.Body.String())
+	}
+	if got := index.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Expected an HTML content type, got %q", got)
+	}
+	if got := index.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Expected the index page to be revalidated, got %q", got)
+	}
+
+	t.Run("ClientRoutes", func(t *testing.T) {
+		for _, path := range []string{"/admin/", "/admin/routes", "/admin/routes/42/edit"} {
+			w := adminUIGet(handler, path, nil)
+			if w.Code != http.StatusOK || w.Body.String() != index.Body.String() {
+				t.Errorf("Expected %s to serve the index page, got %d", path, w.Code)
+			}
+		}
+	})
+
+	t.Run("Assets", func(t *testing.T) {
+		w := adminUIGet(handler, "/admin/assets/app.js", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/javascript; charset=utf-8" {
+			t.Errorf("Expected a JavaScript content type, got %q", got)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "public, max-age=3600" {
+			t.Errorf("Expected an unversioned asset to be cached briefly, got %q", got)
+		}
+
+		css := adminUIGet(handler, "/admin/assets/app.css", nil)
+		if got := css.Header().Get("Content-Type"); got != "text/css; charset=utf-8" {
+			t.Errorf("Expected a CSS content type, got %q", got)
+		}
+
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Fatal("Expected an ETag")
+		}
+		if !strings.Contains(index.Body.String(), `"/admin/assets/app.js?v=`+strings.Trim(etag, `"`)+`"`) {
+			t.Errorf("Expected the index page to link the asset by its hash %s", etag)
+		}
+
+		versioned := adminUIGet(handler, "/admin/assets/app.js?v="+strings.Trim(etag, `"`), nil)
+		if got := versioned.Header().Get("Cache-Control"); got != "public, max-age=31536000, immutable" {
+			t.Errorf("Expected a versioned asset to be cached for good, got %q", got)
+		}
+
+		cached := adminUIGet(handler, "/admin/assets/app.js", map[string]string{"If-None-Match": etag})
+		if cached.Code != http.StatusNotModified {
+			t.Errorf("Expected status 304 for a matching ETag, got %d", cached.Code)
+		}
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		for _, path := range []string{"/admin/assets/missing.js", "/admin/favicon.png"} {
+			if w := adminUIGet(handler, path, nil); w.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404 for %s, got %d", path, w.Code)
+			}
+		}
+	})
+
+	t.Run("Config", func(t *testing.T) {
+		w := adminUIGet(handler, "/admin/config.js", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/javascript; charset=utf-8" {
+			t.Errorf("Expected a JavaScript content type, got %q", got)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Expected config.js not to be cached, got %q", got)
+		}
+		body := w.Body.String()
+		for _, want := range []string{`window.ISEKAI_CONFIG = {`, `"apiBase":"/api"`, `"wsURL":"/ws"`, `"authentication":false`, `"websocket":true`} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Expected config.js to contain %s, got %s", want, body)
+			}
+		}
+	})
+}
+
+// TestAdminUIAuth tests that the app is only served to admins when auth is enabled
+func TestAdminUIAuth(t *testing.T) {
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	handler := testRouter(t, authService, func(cfg *config.Config) {
+		cfg.Auth.Enabled = true
+		cfg.AdminUI.Enabled = true
+	})
+
+	adminToken, err := authService.GenerateToken("1", "admin", []string{"admin"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	userToken, err := authService.GenerateToken("2", "user", []string{"user"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	t.Run("BrowserRedirect", func(t *testing.T) {
+		w := adminUIGet(handler, "/admin/routes?page=2", map[string]string{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8"})
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected status 302, got %d", w.Code)
+		}
+		if got := w.Header().Get("Location"); got != "/admin/login?next=%2Fadmin%2Froutes%3Fpage%3D2" {
+			t.Errorf("Expected a redirect to the login page, got %q", got)
+		}
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		w := adminUIGet(handler, "/admin/routes", map[string]string{"Accept": "application/json"})
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `"code":"AUTH_MISSING"`) {
+			t.Errorf("Expected status 401 with AUTH_MISSING, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = adminUIGet(handler, "/admin", map[string]string{"Accept": "application/json", "Cookie": adminui.TokenCookie + "=garbage"})
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `"code":"AUTH_INVALID"`) {
+			t.Errorf("Expected status 401 with AUTH_INVALID, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		w := adminUIGet(handler, "/admin", map[string]string{"Authorization": "Bearer " + userToken})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		for name, headers := range map[string]map[string]string{
+			"Header": {"Authorization": "Bearer " + adminToken},
+			"Cookie": {"Cookie": adminui.TokenCookie + "=" + adminToken, "Accept": "text/html"},
+		} {
+			w := adminUIGet(handler, "/admin/breakers", headers)
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<title>Isekai Admin</title>") {
+				t.Errorf("%s: expected the index page, got %d", name, w.Code)
+			}
+		}
+	})
+
+	t.Run("Public", func(t *testing.T) {
+		for _, path := range []string{"/admin/login", "/admin/assets/login.js", "/admin/config.js"} {
+			if w := adminUIGet(handler, path, map[string]string{"Accept": "text/html"}); w.Code != http.StatusOK {
+				t.Errorf("Expected %s to be public, got %d", path, w.Code)
+			}
+		}
+	})
+}
+
+// TestAdminUIDisabled tests that a disabled UI leaves /admin to the proxy
+func TestAdminUIDisabled(t *testing.T) {
+	handler := testRouter(t, auth.NewAuthService("test-secret", logger.Get()), func(cfg *config.Config) {
+		cfg.Auth.Enabled = false
+		cfg.AdminUI.Enabled = false
+	})
+
+	for _, path := range []string{"/admin", "/admin/config.js", "/admin/assets/app.js"} {
+		w := adminUIGet(handler, path, nil)
+		if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "ISEKAI") {
+			t.Errorf("Expected %s to fall through to the proxy, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/audit"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// testDatabase connects to the configured test database or skips the test
+func testDatabase(t *testing.T) *database.Database {
+	t.Helper()
+
+	cfg := config.Load()
+	cfg.Database.ConnectRetries = 0
+	db, err := database.New(&cfg.Database, logger.Get(), testMetrics())
+	if err != nil {
+		t.Skipf("Skipping integration test - database not available: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	if err := db.InitSchema(context.Background()); err != nil {
+		t.Fatalf("Failed to initialize schema: %v", err)
+	}
+	return db
+}
+
+// TestAuditDiff tests the recorded diff for route changes
+func TestAuditDiff(t *testing.T) {
+	before := &database.Route{ID: 1, Path: "/users", TargetURL: "http://users-v1", Method: "GET", Enabled: true, Timeout: 30}
+	after := *before
+	after.TargetURL = "http://users-v2"
+	after.Timeout = 10
+	after.UpdatedAt = time.Now()
+
+	raw, err := audit.Diff(before, &after)
+	if err != nil {
+		t.Fatalf("Failed to compute diff: %v", err)
+	}
+
+	var changes map[string]audit.FieldChange
+	if err := json.Unmarshal(raw, &changes); err != nil {
+		t.Fatalf("Failed to decode diff: %v", err)
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changed fields, got %v", changes)
+	}
+	if c := changes["target_url"]; c.Before != "http://users-v1" || c.After != "http://users-v2" {
+		t.Errorf("Unexpected target_url change: %+v", c)
+	}
+	if c := changes["timeout"]; c.Before != float64(30) || c.After != float64(10) {
+		t.Errorf("Unexpected timeout change: %+v", c)
+	}
+
+	if action := audit.UpdateAction(before, &after); action != database.AuditActionUpdate {
+		t.Errorf("Expected update action, got %s", action)
+	}
+
+	disabled := *before
+	disabled.Enabled = false
+	if action := audit.UpdateAction(before, &disabled); action != database.AuditActionDisable {
+		t.Errorf("Expected disable action, got %s", action)
+	}
+}
+
+// TestAuditTransaction tests that audit rows are written with, and only with, successful changes
+func TestAuditTransaction(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	handler := handlers.NewRouteHandler(db, cacheInstance, nil, log)
+	auditRepo := database.NewAuditRepository(db)
+	ctx := context.Background()
+
+	suffix := time.Now().UnixNano()
+	create := func(path string) database.Route {
+		body, _ := json.Marshal(database.Route{Path: path, TargetURL: "http://example.com", Method: "GET", Enabled: true})
+		w := httptest.NewRecorder()
+		handler.Create(w, httptest.NewRequest("POST", "/api/routes", bytes.NewReader(body)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d", w.Code)
+		}
+
+		var resp struct {
+			Data database.Route `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Data
+	}
+
+	update := func(route database.Route) int {
+		body, _ := json.Marshal(route)
+		req := httptest.NewRequest("PUT", "/api/routes/"+fmt.Sprint(route.ID), bytes.NewReader(body))
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", fmt.Sprint(route.ID))
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		w := httptest.NewRecorder()
+		handler.Update(w, req)
+		return w.Code
+	}
+
+	first := create(fmt.Sprintf("/audit-a-%d", suffix))
+	second := create(fmt.Sprintf("/audit-b-%d", suffix))
+
+	t.Run("UpdateRecordsDiff", func(t *testing.T) {
+		changed := first
+		changed.TargetURL = "http://example.org"
+		if code := update(changed); code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", code)
+		}
+
+		entries, total, err := auditRepo.FindByRouteID(ctx, first.ID, 10, 0)
+		if err != nil {
+			t.Fatalf("Failed to read audit entries: %v", err)
+		}
+		if total != 2 || entries[0].Action != database.AuditActionUpdate {
+			t.Fatalf("Expected create and update entries, got %+v", entries)
+		}
+		if entries[0].Actor != audit.AnonymousActor || entries[0].ClientIP == "" {
+			t.Errorf("Expected anonymous actor with client IP, got %q / %q", entries[0].Actor, entries[0].ClientIP)
+		}
+
+		var changes map[string]audit.FieldChange
+		json.Unmarshal(entries[0].Changes, &changes)
+		if len(changes) != 1 || changes["target_url"].After != "http://example.org" {
+			t.Errorf("Unexpected diff: %s", entries[0].Changes)
+		}
+	})
+
+	t.Run("FailedUpdateWritesNoAudit", func(t *testing.T) {
+		// Conflicts with the unique path of the first route
+		conflicting := second
+		conflicting.Path = first.Path
+		if code := update(conflicting); code != http.StatusInternalServerError {
+			t.Fatalf("Expected status 500, got %d", code)
+		}
+
+		_, total, err := auditRepo.FindByRouteID(ctx, second.ID, 10, 0)
+		if err != nil {
+			t.Fatalf("Failed to read audit entries: %v", err)
+		}
+		if total != 1 {
+			t.Errorf("Expected only the create entry, got %d entries", total)
+		}
+	})
+}
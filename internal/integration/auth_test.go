@@ -0,0 +1,475 @@
+package integration
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// writePEM writes a PEM block to a file in the test's temp directory
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// writeKeyPair writes a private key and its public key as PEM files
+func writeKeyPair(t *testing.T, key crypto.Signer) (privatePath, publicPath string) {
+	t.Helper()
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	return writePEM(t, "private.pem", "PRIVATE KEY", privateDER), writePEM(t, "public.pem", "PUBLIC KEY", publicDER)
+}
+
+// signToken signs claims for a user with the given method, key and key ID
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, auth.Claims{
+		UserID: "user-1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign %s token: %v", method.Alg(), err)
+	}
+	return signed
+}
+
+// TestAuthAlgorithms tests signing and verification for each supported algorithm
+func TestAuthAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+
+	rsaPrivate, rsaPublic := writeKeyPair(t, rsaKey)
+	ecPrivate, ecPublic := writeKeyPair(t, ecKey)
+	rsaPublicPEM, _ := os.ReadFile(rsaPublic)
+
+	otherRSA, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name    string
+		cfg     config.AuthConfig
+		token   func(t *testing.T) string
+		wantErr bool
+	}{
+		{
+			name:  "HS256",
+			cfg:   config.AuthConfig{Algorithm: "HS256", JWTSecret: "secret"},
+			token: func(t *testing.T) string { return signToken(t, jwt.SigningMethodHS256, []byte("secret"), "") },
+		},
+		{
+			name:    "HS256RejectsRS256",
+			cfg:     config.AuthConfig{Algorithm: "HS256", JWTSecret: "secret"},
+			token:   func(t *testing.T) string { return signToken(t, jwt.SigningMethodRS256, rsaKey, "") },
+			wantErr: true,
+		},
+		{
+			name:  "RS256PublicKey",
+			cfg:   config.AuthConfig{Algorithm: "RS256", PublicKeyFile: rsaPublic},
+			token: func(t *testing.T) string { return signToken(t, jwt.SigningMethodRS256, rsaKey, "") },
+		},
+		{
+			name:    "RS256WrongKey",
+			cfg:     config.AuthConfig{Algorithm: "RS256", PublicKeyFile: rsaPublic},
+			token:   func(t *testing.T) string { return signToken(t, jwt.SigningMethodRS256, otherRSA, "") },
+			wantErr: true,
+		},
+		{
+			// The classic confusion attack: HMAC signed with the RSA public key as the secret
+			name:    "RS256RejectsSpoofedHS256",
+			cfg:     config.AuthConfig{Algorithm: "RS256", PublicKeyFile: rsaPublic, JWTSecret: "secret"},
+			token:   func(t *testing.T) string { return signToken(t, jwt.SigningMethodHS256, rsaPublicPEM, "") },
+			wantErr: true,
+		},
+		{
+			name:    "RS256RejectsSharedSecret",
+			cfg:     config.AuthConfig{Algorithm: "RS256", PublicKeyFile: rsaPublic, JWTSecret: "secret"},
+			token:   func(t *testing.T) string { return signToken(t, jwt.SigningMethodHS256, []byte("secret"), "") },
+			wantErr: true,
+		},
+		{
+			name: "RS256RejectsNone",
+			cfg:  config.AuthConfig{Algorithm: "RS256", PublicKeyFile: rsaPublic},
+			token: func(t *testing.T) string {
+				return signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "")
+			},
+			wantErr: true,
+		},
+		{
+			name:  "ES256PublicKey",
+			cfg:   config.AuthConfig{Algorithm: "ES256", PublicKeyFile: ecPublic},
+			token: func(t *testing.T) string { return signToken(t, jwt.SigningMethodES256, ecKey, "") },
+		},
+		{
+			name:    "ES256RejectsRS256",
+			cfg:     config.AuthConfig{Algorithm: "ES256", PublicKeyFile: ecPublic},
+			token:   func(t *testing.T) string { return signToken(t, jwt.SigningMethodRS256, rsaKey, "") },
+			wantErr: true,
+		},
+		{
+			name:  "ES256PrivateKeyOnly",
+			cfg:   config.AuthConfig{Algorithm: "ES256", PrivateKeyFile: ecPrivate},
+			token: func(t *testing.T) string { return signToken(t, jwt.SigningMethodES256, ecKey, "") },
+		},
+		{
+			name:  "RS256PrivateKeyOnly",
+			cfg:   config.AuthConfig{Algorithm: "RS256", PrivateKeyFile: rsaPrivate},
+			token: func(t *testing.T) string { return signToken(t, jwt.SigningMethodRS256, rsaKey, "") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authService, err := auth.NewAuthServiceFromConfig(&tt.cfg, logger.Get())
+			if err != nil {
+				t.Fatalf("Failed to create auth service: %v", err)
+			}
+			defer authService.Stop()
+
+			claims, err := authService.ValidateToken(tt.token(t))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected token to be rejected")
+				}
+				return
+			}
+			if err != nil || claims.UserID != "user-1" {
+				t.Errorf("Expected valid token, got %v", err)
+			}
+		})
+	}
+
+	t.Run("GenerateRS256", func(t *testing.T) {
+		authService, err := auth.NewAuthServiceFromConfig(&config.AuthConfig{Algorithm: "RS256", PrivateKeyFile: rsaPrivate}, logger.Get())
+		if err != nil {
+			t.Fatalf("Failed to create auth service: %v", err)
+		}
+
+		token, err := authService.GenerateToken("user-1", "alice", []string{"admin"}, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+
+		parsed, _, _ := jwt.NewParser().ParseUnverified(token, &auth.Claims{})
+		if parsed.Method.Alg() != "RS256" {
+			t.Errorf("Expected RS256 token, got %s", parsed.Method.Alg())
+		}
+		if _, err := authService.ValidateToken(token); err != nil {
+			t.Errorf("Expected generated token to validate: %v", err)
+		}
+	})
+
+	t.Run("GenerateWithoutPrivateKey", func(t *testing.T) {
+		authService, err := auth.NewAuthServiceFromConfig(&config.AuthConfig{Algorithm: "RS256", PublicKeyFile: rsaPublic}, logger.Get())
+		if err != nil {
+			t.Fatalf("Failed to create auth service: %v", err)
+		}
+
+		if _, err := authService.GenerateToken("user-1", "alice", nil, time.Hour); !errors.Is(err, auth.ErrSigningKeyMissing) {
+			t.Errorf("Expected ErrSigningKeyMissing, got %v", err)
+		}
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		for _, cfg := range []config.AuthConfig{
+			{Algorithm: "PS512"},
+			{Algorithm: "RS256"},
+			{Algorithm: "ES256", PublicKeyFile: rsaPublic},
+		} {
+			if _, err := auth.NewAuthServiceFromConfig(&cfg, logger.Get()); err == nil {
+				t.Errorf("Expected config %+v to be rejected", cfg)
+			}
+		}
+	})
+}
+
+// jwkSet serves a mutable JSON Web Key Set
+type jwkSet struct {
+	mu   sync.Mutex
+	keys []map[string]string
+}
+
+func (s *jwkSet) add(kid string, key *rsa.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = append(s.keys, map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	})
+}
+
+func (s *jwkSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+}
+
+// TestAuthJWKS tests key selection and refresh from a JWKS URL
+func TestAuthJWKS(t *testing.T) {
+	first, _ := rsa.GenerateKey(rand.Reader, 2048)
+	second, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	set := &jwkSet{}
+	set.add("first", &first.PublicKey)
+	set.add("second", &second.PublicKey)
+	server := httptest.NewServer(set)
+	defer server.Close()
+
+	authService, err := auth.NewAuthServiceFromConfig(&config.AuthConfig{
+		Algorithm:           "RS256",
+		JWKSURL:             server.URL,
+		JWKSRefreshInterval: 20 * time.Millisecond,
+	}, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to create auth service: %v", err)
+	}
+	defer authService.Stop()
+
+	t.Run("SelectsByKid", func(t *testing.T) {
+		for kid, key := range map[string]*rsa.PrivateKey{"first": first, "second": second} {
+			if _, err := authService.ValidateToken(signToken(t, jwt.SigningMethodRS256, key, kid)); err != nil {
+				t.Errorf("Expected token for kid %s to validate: %v", kid, err)
+			}
+		}
+	})
+
+	t.Run("MismatchedKid", func(t *testing.T) {
+		if _, err := authService.ValidateToken(signToken(t, jwt.SigningMethodRS256, first, "second")); err == nil {
+			t.Error("Expected token verified against the wrong kid to be rejected")
+		}
+	})
+
+	t.Run("UnknownKid", func(t *testing.T) {
+		if _, err := authService.ValidateToken(signToken(t, jwt.SigningMethodRS256, first, "missing")); !errors.Is(err, auth.ErrUnknownKey) {
+			t.Errorf("Expected ErrUnknownKey, got %v", err)
+		}
+	})
+
+	t.Run("PeriodicRefresh", func(t *testing.T) {
+		set.add("rotated", &rotated.PublicKey)
+		token := signToken(t, jwt.SigningMethodRS256, rotated, "rotated")
+
+		waitFor(t, func() bool {
+			_, err := authService.ValidateToken(token)
+			return err == nil
+		})
+	})
+}
+
+// TestAuthJWKSRefetch tests that tokens with unknown key IDs share a single
+// refetch, and that a failed refetch still holds off the next one
+func TestAuthJWKSRefetch(t *testing.T) {
+	var mu sync.Mutex
+	hits := 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	fetches := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits
+	}
+
+	jwks := auth.NewJWKS(server.URL, 0, logger.Get())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := jwks.Key("rotated"); !errors.Is(err, auth.ErrUnknownKey) {
+				t.Errorf("Expected ErrUnknownKey, got %v", err)
+			}
+		}()
+	}
+	waitFor(t, func() bool { return fetches() == 1 })
+	close(release)
+	wg.Wait()
+
+	if _, err := jwks.Key("rotated"); !errors.Is(err, auth.ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+	if got := fetches(); got != 1 {
+		t.Errorf("Expected 1 fetch, got %d", got)
+	}
+}
+
+// TestAuthJWKSBackoff tests that periodic refreshes of an unreachable key set
+// back off
+func TestAuthJWKSBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	authService, err := auth.NewAuthServiceFromConfig(&config.AuthConfig{
+		Algorithm:           "RS256",
+		JWKSURL:             server.URL,
+		JWKSRefreshInterval: 10 * time.Millisecond,
+	}, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to create auth service: %v", err)
+	}
+	defer authService.Stop()
+
+	s := authService.JWKSSchedule()
+	if s == nil {
+		t.Fatal("Expected a refresh schedule")
+	}
+	waitFor(t, func() bool { return s.State().Failures >= 2 })
+	if interval := s.State().Interval; interval <= 11*time.Millisecond {
+		t.Errorf("Expected the refresh interval to back off, got %v", interval)
+	}
+
+	if auth.NewAuthService("test-secret", logger.Get()).JWKSSchedule() != nil {
+		t.Error("Expected no refresh schedule without a JWKS URL")
+	}
+}
+
+// TestAuthContext tests claims in the request context and role checks
+func TestAuthContext(t *testing.T) {
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	token, err := authService.GenerateToken("user-1", "alice", []string{"editor"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	// echo reports the authenticated user, or "anonymous" without claims
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, err := auth.GetClaims(r); err == nil {
+			w.Write([]byte(claims.UserID))
+			return
+		}
+		w.Write([]byte("anonymous"))
+	})
+
+	serve := func(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	withClaims := func(roles ...string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		return req.WithContext(auth.WithClaims(req.Context(), &auth.Claims{UserID: "user-1", Roles: roles}))
+	}
+
+	t.Run("MissingClaims", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		if _, ok := auth.ClaimsFromContext(req.Context()); ok {
+			t.Error("Expected no claims in a fresh context")
+		}
+		if _, err := auth.GetClaims(req); !errors.Is(err, auth.ErrMissingClaims) {
+			t.Errorf("Expected ErrMissingClaims, got %v", err)
+		}
+		if w := serve(auth.RequireRole("admin")(echo), req); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 without claims, got %d", w.Code)
+		}
+	})
+
+	t.Run("Roles", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			middleware func(http.Handler) http.Handler
+			roles      []string
+			want       int
+		}{
+			{"RoleMatch", auth.RequireRole("admin"), []string{"admin"}, http.StatusOK},
+			{"RoleMismatch", auth.RequireRole("admin"), []string{"editor"}, http.StatusForbidden},
+			{"AnyRoleMatch", auth.RequireAnyRole("admin", "editor"), []string{"editor"}, http.StatusOK},
+			{"AnyRoleMismatch", auth.RequireAnyRole("admin", "editor"), []string{"viewer"}, http.StatusForbidden},
+			{"AllRolesMatch", auth.RequireAllRoles("admin", "editor"), []string{"editor", "admin"}, http.StatusOK},
+			{"AllRolesPartial", auth.RequireAllRoles("admin", "editor"), []string{"editor"}, http.StatusForbidden},
+			{"NoRoles", auth.RequireAnyRole("admin"), nil, http.StatusForbidden},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if w := serve(tt.middleware(echo), withClaims(tt.roles...)); w.Code != tt.want {
+					t.Errorf("Expected status %d, got %d", tt.want, w.Code)
+				}
+			})
+		}
+	})
+
+	t.Run("Optional", func(t *testing.T) {
+		handler := authService.Middleware(auth.Optional())(echo)
+
+		w := serve(handler, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "anonymous" {
+			t.Errorf("Expected anonymous request to pass, got %d %q", w.Code, w.Body.String())
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if w := serve(handler, req); w.Body.String() != "user-1" {
+			t.Errorf("Expected claims to be attached, got %q", w.Body.String())
+		}
+
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer not-a-token")
+		if w := serve(handler, req); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected invalid token to be rejected, got %d", w.Code)
+		}
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		if w := serve(authService.Middleware()(echo), httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 without a token, got %d", w.Code)
+		}
+	})
+}
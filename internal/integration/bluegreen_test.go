@@ -0,0 +1,224 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/bluegreen"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestBlueGreenDeployment tests validating targets and choosing a color
+func TestBlueGreenDeployment(t *testing.T) {
+	valid := bluegreen.Deployment{Blue: "http://blue:8080", Green: "http://green:8080", Active: bluegreen.Blue, PreviewHeader: "X-Preview"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected a valid deployment, got %v", err)
+	}
+
+	for name, d := range map[string]bluegreen.Deployment{
+		"MissingGreen":  {Blue: "http://blue:8080", Active: bluegreen.Blue},
+		"RelativeBlue":  {Blue: "/blue", Green: "http://green:8080"},
+		"UnknownActive": {Blue: "http://blue:8080", Green: "http://green:8080", Active: "red"},
+		"BadHeader":     {Blue: "http://blue:8080", Green: "http://green:8080", PreviewHeader: "X Preview"},
+	} {
+		if err := d.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if color, target := valid.Choose(req); color != bluegreen.Blue || target != valid.Blue {
+		t.Errorf("Expected the active color, got %s %s", color, target)
+	}
+	req.Header.Set("X-Preview", "1")
+	if color, target := valid.Choose(req); color != bluegreen.Green || target != valid.Green {
+		t.Errorf("Expected the preview header to choose the inactive color, got %s %s", color, target)
+	}
+}
+
+// TestBlueGreenSwitch tests preview routing and that no request reaches the
+// old color once a switch has completed
+func TestBlueGreenSwitch(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	var blueHits, greenHits atomic.Int64
+	backend := func(name string, hits *atomic.Int64) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	blue, green := backend("blue", &blueHits), backend("green", &greenHits)
+
+	repo := database.NewRouteRepository(db)
+	route := &database.Route{
+		Path:    fmt.Sprintf("/bluegreen-%d", time.Now().UnixNano()),
+		Method:  "GET",
+		Enabled: true,
+		Timeout: 30,
+		BlueGreen: &bluegreen.Deployment{
+			Blue:          blue.URL,
+			Green:         green.URL,
+			PreviewHeader: "X-Preview",
+		},
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+	if route.BlueGreen.Active != bluegreen.Blue || route.TargetURL != blue.URL {
+		t.Fatalf("Expected blue to be active by default, got %+v", route.BlueGreen)
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, testMetrics(), nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		testMetrics(),
+		log,
+	)
+
+	bus := events.NewBus()
+	var switched []events.Event
+	var mu sync.Mutex
+	bus.Subscribe(func(event events.Event) {
+		if event.Type == events.RouteSwitched {
+			mu.Lock()
+			switched = append(switched, event)
+			mu.Unlock()
+		}
+	})
+
+	router := chi.NewRouter()
+	router.Post("/api/routes/{id}/switch", handlers.NewRouteHandler(db, cacheInstance, bus, log).Switch)
+	switchTo := func(color string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/api/routes/%d/switch?to=%s", route.ID, color), nil))
+		return w
+	}
+	call := func(preview bool) string {
+		req := httptest.NewRequest("GET", route.Path, nil)
+		if preview {
+			req.Header.Set("X-Preview", "smoke-test")
+		}
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, req)
+		return w.Body.String()
+	}
+
+	t.Run("Preview", func(t *testing.T) {
+		if got := call(false); got != "blue" {
+			t.Errorf("Expected the active color, got %q", got)
+		}
+		if got := call(true); got != "green" {
+			t.Errorf("Expected the preview header to reach green, got %q", got)
+		}
+	})
+
+	t.Run("Switch", func(t *testing.T) {
+		// Keep traffic flowing while the switch happens
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						call(false)
+					}
+				}
+			}()
+		}
+
+		w := switchTo(bluegreen.Green)
+		close(stop)
+		wg.Wait()
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		blueBefore := blueHits.Load()
+		for i := 0; i < 50; i++ {
+			if got := call(false); got != "green" {
+				t.Fatalf("Expected green after the switch, got %q", got)
+			}
+		}
+		if got := blueHits.Load(); got != blueBefore {
+			t.Errorf("Expected no requests to reach blue after the switch, got %d", got-blueBefore)
+		}
+		if got := call(true); got != "blue" {
+			t.Errorf("Expected the preview header to reach the now inactive blue, got %q", got)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(switched) != 1 {
+			t.Fatalf("Expected one switch event, got %d", len(switched))
+		}
+		data, _ := json.Marshal(switched[0].Payload)
+		var payload struct {
+			RouteID int    `json:"route_id"`
+			From    string `json:"from"`
+			To      string `json:"to"`
+		}
+		json.Unmarshal(data, &payload)
+		if payload.RouteID != route.ID || payload.From != bluegreen.Blue || payload.To != bluegreen.Green {
+			t.Errorf("Unexpected switch event %s", data)
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		entries, _, err := database.NewAuditRepository(db).FindByRouteID(context.Background(), route.ID, 10, 0)
+		if err != nil {
+			t.Fatalf("Failed to read audit entries: %v", err)
+		}
+		if len(entries) == 0 || entries[0].Action != database.AuditActionSwitch {
+			t.Errorf("Expected a switch audit entry, got %+v", entries)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		if w := switchTo("red"); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for an unknown color, got %d", w.Code)
+		}
+		if w := switchTo(bluegreen.Green); w.Code != http.StatusOK {
+			t.Errorf("Expected switching to the active color to succeed, got %d", w.Code)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(switched) != 1 {
+			t.Errorf("Expected no event for a switch to the active color, got %d", len(switched))
+		}
+	})
+}
@@ -0,0 +1,504 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sony/gobreaker"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/drain"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/router"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestBreakerClassification tests which outcomes the circuit breaker counts
+// as upstream failures
+func TestBreakerClassification(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		successful bool
+	}{
+		{"Success", nil, true},
+		{"OK", &circuitbreaker.StatusError{Status: 200}, true},
+		{"NotFound", &circuitbreaker.StatusError{Status: 404}, true},
+		{"TooManyRequests", &circuitbreaker.StatusError{Status: 429}, true},
+		{"TooManyRequestsCounted", &circuitbreaker.StatusError{Status: 429, Failures: []int{429}}, false},
+		{"ServerError", &circuitbreaker.StatusError{Status: 503}, false},
+		{"Canceled", context.Canceled, true},
+		{"ClientClosed", proxy.ErrClientClosed, true},
+		{"ShortCircuit", fmt.Errorf("fallback: %w", circuitbreaker.ErrShortCircuit), true},
+		{"Timeout", context.DeadlineExceeded, false},
+		{"Connect", errors.New("dial tcp: connection refused"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := circuitbreaker.IsSuccessful(tt.err); got != tt.successful {
+				t.Errorf("Expected successful %v, got %v", tt.successful, got)
+			}
+		})
+	}
+}
+
+// TestBreakerMixedOutcomes tests that the circuit breaker only opens on
+// genuine upstream failures
+func TestBreakerMixedOutcomes(t *testing.T) {
+	log := logger.Get()
+
+	// run executes one request per outcome against target
+	run := func(cb *circuitbreaker.CircuitBreaker, target string, failures []int, outcomes ...interface{}) {
+		for _, outcome := range outcomes {
+			status, err := cb.ExecuteStatus(target, failures, func() (int, error) {
+				if err, ok := outcome.(error); ok {
+					return 0, err
+				}
+				return outcome.(int), nil
+			})
+			if code, ok := outcome.(int); ok && (status != code || err != nil) {
+				t.Errorf("Expected status %d returned without an error, got %d (%v)", code, status, err)
+			}
+		}
+	}
+
+	t.Run("ClientErrors", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		run(cb, "client", nil, 404, 429, context.Canceled, circuitbreaker.ErrShortCircuit, 400, 429, 200)
+		if state := cb.GetState("client"); state != gobreaker.StateClosed {
+			t.Errorf("Expected the breaker to stay closed, got %s", state)
+		}
+	})
+
+	t.Run("ServerErrors", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		run(cb, "server", nil, 200, 503, 502)
+		if state := cb.GetState("server"); state != gobreaker.StateOpen {
+			t.Errorf("Expected the breaker to open, got %s", state)
+		}
+		if _, err := cb.ExecuteStatus("server", nil, func() (int, error) { return 200, nil }); !errors.Is(err, gobreaker.ErrOpenState) {
+			t.Errorf("Expected an open breaker error, got %v", err)
+		}
+	})
+
+	t.Run("ConnectErrors", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		run(cb, "unreachable", nil, 200, context.DeadlineExceeded, errors.New("connection refused"))
+		if state := cb.GetState("unreachable"); state != gobreaker.StateOpen {
+			t.Errorf("Expected the breaker to open, got %s", state)
+		}
+	})
+
+	t.Run("ConfiguredStatuses", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		run(cb, "throttled", []int{429}, 404, 429, 429)
+		if state := cb.GetState("throttled"); state != gobreaker.StateOpen {
+			t.Errorf("Expected configured 429s to open the breaker, got %s", state)
+		}
+	})
+}
+
+// TestBreakerStatusesValidation tests the breaker statuses a route accepts
+func TestBreakerStatusesValidation(t *testing.T) {
+	log := logger.Get()
+	handler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), nil, nil, log)
+
+	for name, statuses := range map[string]string{
+		"Success":     "[200]",
+		"ServerError": "[500]",
+		"Mixed":       "[429, 503]",
+	} {
+		t.Run(name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"path": "/breaker", "target_url": "http://localhost:9000", "breaker_statuses": %s}`, statuses)
+			w := httptest.NewRecorder()
+			handler.Create(w, httptest.NewRequest("POST", "/api/routes", bytes.NewBufferString(body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400, got %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestBreakerRouteSettings tests that routes with their own breaker settings
+// get breakers of their own, even to a target they share
+func TestBreakerRouteSettings(t *testing.T) {
+	log := logger.Get()
+	target := "http://shared-upstream"
+	fail := func() (int, error) { return 503, nil }
+
+	t.Run("Independent", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		strict := &circuitbreaker.Settings{MinRequests: 2, FailureRatio: 1}
+		lenient := &circuitbreaker.Settings{MinRequests: 10, FailureRatio: 0.9}
+		strictKey := circuitbreaker.RouteKey(1, "/strict", target, strict)
+		lenientKey := circuitbreaker.RouteKey(2, "/lenient", target, lenient)
+
+		for i := 0; i < 3; i++ {
+			cb.ExecuteRoute(strictKey, strict, nil, fail)
+			cb.ExecuteRoute(lenientKey, lenient, nil, fail)
+		}
+		if state := cb.GetState(strictKey.String()); state != gobreaker.StateOpen {
+			t.Errorf("Expected the strict route's breaker to open, got %s", state)
+		}
+		if state := cb.GetState(lenientKey.String()); state != gobreaker.StateClosed {
+			t.Errorf("Expected the lenient route's breaker to stay closed below min_requests, got %s", state)
+		}
+		if _, err := cb.ExecuteRoute(circuitbreaker.RouteKey(3, "/default", target, nil), nil, nil, func() (int, error) { return 200, nil }); err != nil {
+			t.Errorf("Expected routes with default settings unaffected, got %v", err)
+		}
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		for i := 0; i < circuitbreaker.DefaultMinRequests; i++ {
+			cb.ExecuteStatus(target, nil, fail)
+		}
+		if state := cb.GetState(target); state != gobreaker.StateOpen {
+			t.Errorf("Expected the default breaker to open after %d failures, got %s", circuitbreaker.DefaultMinRequests, state)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		disabled := &circuitbreaker.Settings{Disabled: true}
+		key := circuitbreaker.RouteKey(1, "/disabled", target, disabled)
+		for i := 0; i < 50; i++ {
+			if _, err := cb.ExecuteRoute(key, disabled, nil, fail); err != nil {
+				t.Fatalf("Expected every request forwarded, got %v", err)
+			}
+		}
+		if state := cb.GetState(key.String()); state != gobreaker.StateClosed {
+			t.Errorf("Expected a disabled breaker to stay closed, got %s", state)
+		}
+	})
+
+	t.Run("HalfOpen", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		settings := &circuitbreaker.Settings{MinRequests: 1, OpenTimeout: 1, HalfOpenRequests: 2}
+		key := circuitbreaker.RouteKey(1, "/half-open", target, settings)
+		cb.ExecuteRoute(key, settings, nil, fail)
+		if state := cb.GetState(key.String()); state != gobreaker.StateOpen {
+			t.Fatalf("Expected the breaker to open, got %s", state)
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+		if state := cb.GetState(key.String()); state != gobreaker.StateHalfOpen {
+			t.Fatalf("Expected the breaker half-open after open_timeout, got %s", state)
+		}
+		ok := func() (int, error) { return 200, nil }
+		cb.ExecuteRoute(key, settings, nil, ok)
+		if state := cb.GetState(key.String()); state != gobreaker.StateHalfOpen {
+			t.Errorf("Expected the breaker to wait for 2 probes, got %s", state)
+		}
+		cb.ExecuteRoute(key, settings, nil, ok)
+		if state := cb.GetState(key.String()); state != gobreaker.StateClosed {
+			t.Errorf("Expected the breaker closed after 2 probes, got %s", state)
+		}
+	})
+
+	t.Run("Updated", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		before := &circuitbreaker.Settings{MinRequests: 1}
+		key := circuitbreaker.RouteKey(1, "/updated", target, before)
+		cb.ExecuteRoute(key, before, nil, fail)
+
+		if cb.GetBreaker(key, &circuitbreaker.Settings{MinRequests: 1}).State() != gobreaker.StateOpen {
+			t.Error("Expected unchanged settings to keep the breaker")
+		}
+		if state := cb.GetBreaker(key, &circuitbreaker.Settings{MinRequests: 5}).State(); state != gobreaker.StateClosed {
+			t.Errorf("Expected changed settings to rebuild the breaker closed, got %s", state)
+		}
+		for i := 0; i < 4; i++ {
+			cb.ExecuteRoute(key, &circuitbreaker.Settings{MinRequests: 5}, nil, fail)
+		}
+		if state := cb.GetState(key.String()); state != gobreaker.StateClosed {
+			t.Errorf("Expected the new min_requests applied, got %s", state)
+		}
+	})
+}
+
+// TestBreakerSettingsValidation tests the bounds of a route's breaker settings
+func TestBreakerSettingsValidation(t *testing.T) {
+	for name, settings := range map[string]circuitbreaker.Settings{
+		"Empty":    {},
+		"Full":     {MinRequests: 20, FailureRatio: 0.25, OpenTimeout: 30, HalfOpenRequests: 5},
+		"Disabled": {Disabled: true},
+		"Route":    {Scope: circuitbreaker.ScopeRoute, MinRequests: 5},
+		"Host":     {Scope: circuitbreaker.ScopeHost},
+		"Maximums": {MinRequests: circuitbreaker.MaxMinRequests, FailureRatio: 1, OpenTimeout: circuitbreaker.MaxOpenTimeout, HalfOpenRequests: circuitbreaker.MaxHalfOpenRequests},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := settings.Validate(); err != nil {
+				t.Errorf("Expected valid settings, got %v", err)
+			}
+		})
+	}
+
+	log := logger.Get()
+	handler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), nil, nil, log)
+	for name, breaker := range map[string]string{
+		"NegativeMinRequests":  `{"min_requests": -1}`,
+		"TooManyMinRequests":   `{"min_requests": 20000}`,
+		"RatioAboveOne":        `{"failure_ratio": 1.5}`,
+		"NegativeRatio":        `{"failure_ratio": -0.1}`,
+		"LongOpenTimeout":      `{"open_timeout": 7200}`,
+		"NegativeOpenTimeout":  `{"open_timeout": -5}`,
+		"TooManyProbes":        `{"half_open_requests": 1000}`,
+		"DisabledWithSettings": `{"disabled": true, "min_requests": 5}`,
+		"UnknownScope":         `{"scope": "cluster"}`,
+		"HostScopeThresholds":  `{"scope": "host", "min_requests": 5}`,
+		"HostScopeDisabled":    `{"scope": "host", "disabled": true}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"path": "/breaker", "target_url": "http://localhost:9000", "breaker": %s}`, breaker)
+			w := httptest.NewRecorder()
+			handler.Create(w, httptest.NewRequest("POST", "/api/routes", bytes.NewBufferString(body)))
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "breaker") {
+				t.Errorf("Expected 400, got %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestBreakerSettingsStored tests that a route's breaker settings are stored
+// with it
+func TestBreakerSettingsStored(t *testing.T) {
+	db := testDatabase(t)
+	repo := database.NewRouteRepository(db)
+
+	route := &database.Route{Path: fmt.Sprintf("/breaker-%d", time.Now().UnixNano()), TargetURL: "http://api", Method: "GET", Enabled: true, Timeout: 30,
+		Breaker: &circuitbreaker.Settings{MinRequests: 20, FailureRatio: 0.5, OpenTimeout: 10, HalfOpenRequests: 2}}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	stored, err := repo.FindByID(context.Background(), route.ID)
+	if err != nil {
+		t.Fatalf("Failed to get route: %v", err)
+	}
+	if stored.Breaker == nil || *stored.Breaker != *route.Breaker {
+		t.Errorf("Expected the breaker settings stored, got %+v", stored.Breaker)
+	}
+
+	stored.Breaker = &circuitbreaker.Settings{Disabled: true}
+	if err := repo.Update(context.Background(), stored); err != nil {
+		t.Fatalf("Failed to update route: %v", err)
+	}
+	if updated, _ := repo.FindByID(context.Background(), route.ID); updated == nil || updated.Breaker == nil || !updated.Breaker.Disabled {
+		t.Errorf("Expected the breaker disabled, got %+v", updated)
+	}
+}
+
+// TestBreakerIsolation tests that breakers are kept per route and backend, so
+// neither another route to the same backend nor another backend of the same
+// route opens with a failing one
+func TestBreakerIsolation(t *testing.T) {
+	log := logger.Get()
+	fail := func() (int, error) { return 503, nil }
+	ok := func() (int, error) { return 200, nil }
+
+	t.Run("RoutesSharingBackend", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		failing := circuitbreaker.RouteKey(1, "/billing", "http://shared:8080/billing", nil)
+		healthy := circuitbreaker.RouteKey(2, "/orders", "http://shared:8080/orders", nil)
+		for i := 0; i < circuitbreaker.DefaultMinRequests; i++ {
+			cb.ExecuteRoute(failing, nil, nil, fail)
+		}
+		if state := cb.GetState(failing.String()); state != gobreaker.StateOpen {
+			t.Fatalf("Expected the failing route's breaker to open, got %s", state)
+		}
+		if _, err := cb.ExecuteRoute(healthy, nil, nil, ok); err != nil {
+			t.Errorf("Expected the other route to the backend unaffected, got %v", err)
+		}
+	})
+
+	t.Run("BackendsOfRoute", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		unhealthy := circuitbreaker.RouteKey(1, "/api", "http://10.0.0.1:8080/api/users", nil)
+		healthy := circuitbreaker.RouteKey(1, "/api", "http://10.0.0.2:8080/api/users", nil)
+		for i := 0; i < circuitbreaker.DefaultMinRequests; i++ {
+			cb.ExecuteRoute(unhealthy, nil, nil, fail)
+		}
+		if _, err := cb.ExecuteRoute(unhealthy, nil, nil, ok); !errors.Is(err, gobreaker.ErrOpenState) {
+			t.Errorf("Expected the unhealthy backend short-circuited, got %v", err)
+		}
+		if _, err := cb.ExecuteRoute(healthy, nil, nil, ok); err != nil {
+			t.Errorf("Expected the healthy backend unaffected, got %v", err)
+		}
+	})
+
+	t.Run("PathsOfBackend", func(t *testing.T) {
+		a := circuitbreaker.RouteKey(1, "/api/*", "http://users:8080/api/a?x=1", nil)
+		b := circuitbreaker.RouteKey(1, "/api/*", "http://users:8080/api/b", nil)
+		if a != b || a.Backend != "http://users:8080" {
+			t.Errorf("Expected one breaker per backend origin, got %+v and %+v", a, b)
+		}
+	})
+
+	t.Run("HostScope", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		host := &circuitbreaker.Settings{Scope: circuitbreaker.ScopeHost}
+		first := circuitbreaker.RouteKey(1, "/billing", "http://shared:8080/billing", host)
+		second := circuitbreaker.RouteKey(2, "/orders", "http://shared:8080/orders", host)
+		if first != second || first.Route != "" {
+			t.Fatalf("Expected routes with the host scope to share a breaker, got %+v and %+v", first, second)
+		}
+		for i := 0; i < circuitbreaker.DefaultMinRequests; i++ {
+			cb.ExecuteRoute(first, host, nil, fail)
+		}
+		if _, err := cb.ExecuteRoute(second, host, nil, ok); !errors.Is(err, gobreaker.ErrOpenState) {
+			t.Errorf("Expected the shared breaker open for the other route, got %v", err)
+		}
+		if _, err := cb.ExecuteRoute(circuitbreaker.RouteKey(3, "/users", "http://shared:8080/users", nil), nil, nil, ok); err != nil {
+			t.Errorf("Expected routes with their own breaker unaffected, got %v", err)
+		}
+	})
+
+	t.Run("States", func(t *testing.T) {
+		cb := circuitbreaker.New(log, testMetrics(), nil)
+		cb.GetBreaker(circuitbreaker.RouteKey(2, "/b", "http://b:80/x", nil), nil)
+		cb.GetBreaker(circuitbreaker.RouteKey(1, "/a", "http://a:80/x", nil), nil)
+		states := cb.GetAllStates()
+		if len(states) != 2 || states[0].Key != (circuitbreaker.Key{RouteID: 1, Route: "/a", Backend: "http://a:80"}) || states[0].State != gobreaker.StateClosed {
+			t.Errorf("Expected states keyed by route and backend in order, got %+v", states)
+		}
+	})
+}
+
+// TestBreakerRemoval tests that breakers and their state series go with the
+// route or pool backend they guard
+func TestBreakerRemoval(t *testing.T) {
+	m := testMetrics()
+	cb := circuitbreaker.New(logger.Get(), m, nil)
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	lb.SetRemoveHook(cb.RemoveBackend)
+	lb.AddBackend("http://a:80")
+	lb.AddBackend("http://b:80")
+
+	host := &circuitbreaker.Settings{Scope: circuitbreaker.ScopeHost}
+	for _, key := range []circuitbreaker.Key{
+		circuitbreaker.RouteKey(1, "/orders", "http://a:80/orders", nil),
+		circuitbreaker.RouteKey(1, "/orders", "http://b:80/orders", nil),
+		circuitbreaker.RouteKey(2, "/orders", "http://a:80/orders", nil),
+		circuitbreaker.RouteKey(3, "/users", "http://b:80/users", nil),
+		circuitbreaker.RouteKey(4, "/users", "http://b:80/users", host),
+	} {
+		cb.GetBreaker(key, nil)
+	}
+	keys := func() []string {
+		var keys []string
+		for _, state := range cb.GetAllStates() {
+			keys = append(keys, state.Key.String())
+		}
+		return keys
+	}
+	series := func() int { return testutil.CollectAndCount(m.CircuitBreakerState) }
+
+	cb.RemoveRoute(1)
+	if got := keys(); len(got) != 3 {
+		t.Errorf("Expected route 1's breakers removed, got %q", got)
+	}
+	// Route 2 shares the path of route 1, so the series of its breaker stays
+	if got := series(); got != 3 {
+		t.Errorf("Expected 3 state series, got %d", got)
+	}
+
+	if _, ok := lb.RemoveBackend("http://b:80"); !ok {
+		t.Fatal("Expected the backend removed")
+	}
+	if got := keys(); len(got) != 1 || got[0] != "http://a:80 (route 2 /orders)" {
+		t.Errorf("Expected only route 2's breaker to http://a:80 left, got %q", got)
+	}
+	if got := series(); got != 1 {
+		t.Errorf("Expected 1 state series, got %d", got)
+	}
+
+	t.Run("Drained", func(t *testing.T) {
+		done := lb.DrainBackend("http://a:80", time.Second)
+		if result := <-done; !result.Removed {
+			t.Fatal("Expected the backend drained")
+		}
+		if got := keys(); len(got) != 0 || series() != 0 {
+			t.Errorf("Expected no breakers left, got %q", got)
+		}
+	})
+
+	t.Run("Routes", func(t *testing.T) {
+		cb.GetBreaker(circuitbreaker.RouteKey(5, "/a", "http://c:80", nil), nil)
+		cb.GetBreaker(circuitbreaker.RouteKey(5, "/a", "http://c:80", host), nil)
+		cb.RemoveRoutes()
+		if got := keys(); len(got) != 1 || got[0] != "http://c:80" {
+			t.Errorf("Expected only the host breaker left, got %q", got)
+		}
+	})
+}
+
+// TestBreakerRouteEvents tests that route changes published on the bus drop
+// the changed routes' breakers
+func TestBreakerRouteEvents(t *testing.T) {
+	log := logger.Get()
+	cfg := config.Load()
+	cfg.Auth.Enabled = false
+	cfg.Gateway.RateLimitEnabled = false
+
+	bus := events.NewBus()
+	cacheInstance := cache.New(&cfg.Cache, log, bus)
+	defer cacheInstance.Stop()
+	cb := circuitbreaker.New(log, testMetrics(), bus)
+
+	r := router.NewV2(
+		database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		cacheInstance,
+		proxy.New(5*time.Second, &cfg.Proxy, log),
+		cfg,
+		log,
+		auth.NewAuthService("test-secret", log),
+		nil,
+		cb,
+		loadbalancer.New(loadbalancer.RoundRobin, bus),
+		websocket.NewHub(&cfg.WebSocket, log, nil),
+		bus,
+		drain.New(),
+	)
+	defer r.Shutdown()
+
+	routes := func() []int {
+		var ids []int
+		for _, state := range cb.GetAllStates() {
+			ids = append(ids, state.RouteID)
+		}
+		return ids
+	}
+	for id := 1; id <= 4; id++ {
+		cb.GetBreaker(circuitbreaker.RouteKey(id, fmt.Sprintf("/r%d", id), "http://upstream:80", nil), nil)
+	}
+
+	bus.Publish(events.RouteUpdated, database.Route{ID: 1})
+	bus.Publish(events.RouteDeleted, map[string]int{"id": 2})
+	bus.Publish(events.RouteSwitched, handlers.SwitchEvent{RouteID: 3})
+	bus.Publish(events.RouteCreated, database.Route{ID: 4})
+	if got := routes(); len(got) != 1 || got[0] != 4 {
+		t.Errorf("Expected only route 4's breaker left, got %v", got)
+	}
+
+	bus.Publish(events.SnapshotRestored, handlers.RestoreResult{})
+	if got := routes(); len(got) != 0 {
+		t.Errorf("Expected no route breakers after a restore, got %v", got)
+	}
+}
@@ -0,0 +1,268 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/buffering"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/transform"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestBufferingGuard tests the size limit and watermark bodies are buffered
+// within, and that released bodies stop counting
+func TestBufferingGuard(t *testing.T) {
+	m := testMetrics()
+	g := buffering.NewGuard(100, 150, m)
+	skipped := func(feature, reason string) float64 {
+		return testutil.ToFloat64(m.BufferingSkipped.WithLabelValues(feature, reason))
+	}
+
+	if _, err := g.Acquire(buffering.FeatureTransform, 200); !errors.Is(err, buffering.ErrTooLarge) {
+		t.Errorf("Expected a known length over the limit rejected, got %v", err)
+	}
+	if got := skipped(buffering.FeatureTransform, "too_large"); got != 1 {
+		t.Errorf("Expected 1 transform skip, got %v", got)
+	}
+
+	first, err := g.Acquire(buffering.FeatureCache, -1)
+	if err != nil {
+		t.Fatalf("Failed to acquire: %v", err)
+	}
+	if err := first.Grow(80); err != nil {
+		t.Fatalf("Failed to grow: %v", err)
+	}
+	if g.Buffered() != 80 || testutil.ToFloat64(m.BufferedBytes) != 80 {
+		t.Errorf("Expected 80 bytes buffered, got %d and gauge %v", g.Buffered(), testutil.ToFloat64(m.BufferedBytes))
+	}
+
+	t.Run("Watermark", func(t *testing.T) {
+		if _, err := g.Acquire(buffering.FeatureMirror, 80); !errors.Is(err, buffering.ErrWatermark) {
+			t.Errorf("Expected a known length over the watermark rejected, got %v", err)
+		}
+
+		second, err := g.Acquire(buffering.FeatureMirror, -1)
+		if err != nil {
+			t.Fatalf("Failed to acquire: %v", err)
+		}
+		if err := second.Grow(50); err != nil {
+			t.Fatalf("Failed to grow: %v", err)
+		}
+		if err := second.Grow(30); !errors.Is(err, buffering.ErrWatermark) {
+			t.Errorf("Expected growing past the watermark to fail, got %v", err)
+		}
+		if g.Buffered() != 80 {
+			t.Errorf("Expected the failed body released, got %d bytes buffered", g.Buffered())
+		}
+		if got := skipped(buffering.FeatureMirror, "watermark"); got != 2 {
+			t.Errorf("Expected 2 mirror skips at the watermark, got %v", got)
+		}
+	})
+
+	if err := first.Grow(30); !errors.Is(err, buffering.ErrTooLarge) {
+		t.Errorf("Expected growing past the limit to fail, got %v", err)
+	}
+	first.Release()
+	if g.Buffered() != 0 || testutil.ToFloat64(m.BufferedBytes) != 0 {
+		t.Errorf("Expected nothing buffered, got %d", g.Buffered())
+	}
+
+	t.Run("NoGuard", func(t *testing.T) {
+		var none *buffering.Guard
+		hold, err := none.Acquire(buffering.FeatureCache, 1<<40)
+		if err != nil || hold.Grow(1<<40) != nil || none.Limit(5) != 5 {
+			t.Errorf("Expected a nil guard to buffer anything, got %v", err)
+		}
+		hold.Release()
+	})
+}
+
+// holdBuffered holds n bodies of size bytes against g, returning a func
+// releasing them
+func holdBuffered(g *buffering.Guard, n int, size int64) func() {
+	holds := make([]*buffering.Hold, n)
+	for i := range holds {
+		holds[i], _ = g.Acquire(buffering.FeatureCache, -1)
+		holds[i].Grow(size)
+	}
+	return func() {
+		for _, hold := range holds {
+			hold.Release()
+		}
+	}
+}
+
+// TestBufferingTransform tests response transforms passing bodies through
+// when the guard turns them away, and failing strict transforms
+func TestBufferingTransform(t *testing.T) {
+	m := testMetrics()
+	g := buffering.NewGuard(1024, 4096, m)
+	p := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+	p.SetBuffers(g)
+
+	rules := &transform.Rules{Response: &transform.Ops{Set: map[string]interface{}{"gateway": "isekai"}}}
+	send := func(rules *transform.Rules, body string, chunked bool) *httptest.ResponseRecorder {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if !chunked {
+				w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			}
+			io.WriteString(w, body)
+		}))
+		defer server.Close()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		p.ForwardAndCopy(proxy.WithTransform(req.Context(), rules), w, req, server.URL)
+		return w
+	}
+
+	w := send(rules, `{"id":1}`, false)
+	assertJSON(t, w.Body.Bytes(), `{"id":1,"gateway":"isekai"}`)
+	if g.Buffered() != 0 {
+		t.Errorf("Expected the body released once sent, got %d bytes buffered", g.Buffered())
+	}
+
+	large := `{"data":"` + strings.Repeat("x", 2048) + `"}`
+	for _, chunked := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TooLargeChunked%v", chunked), func(t *testing.T) {
+			w := send(rules, large, chunked)
+			if w.Code != http.StatusOK || w.Body.String() != large {
+				t.Errorf("Expected the body passed through, got %d with %d bytes", w.Code, w.Body.Len())
+			}
+		})
+	}
+	if got := testutil.ToFloat64(m.BufferingSkipped.WithLabelValues(buffering.FeatureTransform, "too_large")); got != 2 {
+		t.Errorf("Expected 2 transform skips, got %v", got)
+	}
+
+	t.Run("Watermark", func(t *testing.T) {
+		defer holdBuffered(g, 4, 1024)()
+
+		w := send(rules, `{"id":1}`, false)
+		if w.Body.String() != `{"id":1}` {
+			t.Errorf("Expected the body passed through at the watermark, got %q", w.Body.String())
+		}
+		if got := testutil.ToFloat64(m.BufferingSkipped.WithLabelValues(buffering.FeatureTransform, "watermark")); got != 1 {
+			t.Errorf("Expected 1 skip at the watermark, got %v", got)
+		}
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		strict := &transform.Rules{Response: rules.Response, Strict: true}
+		w := send(strict, large, true)
+
+		var resp response.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusBadGateway || resp.Code != response.CodeTransformFailed {
+			t.Errorf("Expected 502 %s, got %d %q", response.CodeTransformFailed, w.Code, resp.Code)
+		}
+	})
+
+	if g.Buffered() != 0 {
+		t.Errorf("Expected nothing left buffered, got %d", g.Buffered())
+	}
+}
+
+// TestBufferingMirror tests mirroring skipping bodies over the guard's limit
+// as too large and dropping them at the watermark
+func TestBufferingMirror(t *testing.T) {
+	m := testMetrics()
+	release := make(chan struct{})
+	close(release)
+	target, received := mirrorTarget(t, release)
+
+	g := buffering.NewGuard(64, 256, m)
+	mirror := proxy.NewMirror(mirrorConfig(1, 10, 1024), logger.Get(), m)
+	mirror.SetBuffers(g)
+	defer mirror.Stop()
+
+	result := func(route, result string) float64 {
+		return testutil.ToFloat64(m.MirrorRequests.WithLabelValues(route, result))
+	}
+	submit := func(route, body string) {
+		req := httptest.NewRequest("POST", route, strings.NewReader(body))
+		mirror.Submit(route, target.URL, req)
+		if primary, _ := io.ReadAll(req.Body); string(primary) != body {
+			t.Errorf("Expected the primary to read all %d bytes, got %d", len(body), len(primary))
+		}
+	}
+
+	submit("/mirror-small", "ok")
+	select {
+	case got := <-received:
+		if got.body != "ok" {
+			t.Errorf("Expected mirrored body %q, got %q", "ok", got.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for mirrored request")
+	}
+	waitFor(t, func() bool { return g.Buffered() == 0 })
+
+	submit("/mirror-large", strings.Repeat("x", 100))
+	if got := result("/mirror-large", proxy.MirrorTooLarge); got != 1 {
+		t.Errorf("Expected 1 too_large result, got %v", got)
+	}
+
+	releaseHeld := holdBuffered(g, 4, 60)
+	submit("/mirror-watermark", strings.Repeat("x", 32))
+	releaseHeld()
+	if got := result("/mirror-watermark", proxy.MirrorDropped); got != 1 {
+		t.Errorf("Expected 1 dropped result, got %v", got)
+	}
+}
+
+// BenchmarkProxyCopy compares allocations copying large responses with a
+// new buffer for each response and with pooled buffers
+func BenchmarkProxyCopy(b *testing.B) {
+	payload := strings.Repeat("x", 1<<20)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, payload)
+	}))
+	defer backend.Close()
+
+	pooled := config.Load().Proxy
+	unpooled := pooled
+	unpooled.CopyBufferSize = 0
+
+	for _, bc := range []struct {
+		name string
+		cfg  config.ProxyConfig
+	}{
+		{"Unpooled", unpooled},
+		{"Pooled", pooled},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			p := proxy.New(5*time.Second, &bc.cfg, logger.Get())
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					p.ForwardAndCopy(context.Background(), discardWriter{}, httptest.NewRequest("GET", "/", nil), backend.URL)
+				}
+			})
+		})
+	}
+}
+
+// discardWriter is a response writer throwing the body away, so the
+// benchmark measures the proxy's copy rather than a recorder's buffer
+type discardWriter struct{}
+
+func (discardWriter) Header() http.Header         { return http.Header{} }
+func (discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardWriter) WriteHeader(int)             {}
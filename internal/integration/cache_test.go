@@ -0,0 +1,329 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/redact"
+)
+
+// newCache creates a cache that may serve items maxStale after they expire
+func newCache(t *testing.T, maxStale time.Duration) *cache.Cache {
+	t.Helper()
+
+	cfg := config.Load().Cache
+	cfg.MaxStale = maxStale
+	c := cache.New(&cfg, logger.Get(), nil)
+	t.Cleanup(c.Stop)
+	return c
+}
+
+// TestCacheGetOrLoad tests that concurrent misses share one loader call
+func TestCacheGetOrLoad(t *testing.T) {
+	t.Run("ConcurrentMisses", func(t *testing.T) {
+		c := newCache(t, 0)
+		var calls atomic.Int32
+		loader := func(ctx context.Context) (interface{}, error) {
+			calls.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			return "routes", nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if value, _, err := c.GetOrLoad(context.Background(), "routes:all", time.Minute, loader); err != nil || value != "routes" {
+					t.Errorf("Expected the loaded value, got %v %v", value, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := calls.Load(); n != 1 {
+			t.Errorf("Expected the loader to run once, ran %d times", n)
+		}
+		if _, cached, _ := c.GetOrLoad(context.Background(), "routes:all", time.Minute, loader); !cached || calls.Load() != 1 {
+			t.Error("Expected the loaded value to be cached")
+		}
+	})
+
+	t.Run("ErrorsNotCached", func(t *testing.T) {
+		c := newCache(t, 0)
+		failing := errors.New("database unavailable")
+		if _, _, err := c.GetOrLoad(context.Background(), "key", time.Minute, func(ctx context.Context) (interface{}, error) {
+			return nil, failing
+		}); !errors.Is(err, failing) {
+			t.Fatalf("Expected the loader's error, got %v", err)
+		}
+		if value, cached, err := c.GetOrLoad(context.Background(), "key", time.Minute, func(ctx context.Context) (interface{}, error) {
+			return "value", nil
+		}); err != nil || cached || value != "value" {
+			t.Errorf("Expected a fresh load after the error, got %v %v %v", value, cached, err)
+		}
+	})
+
+	t.Run("DeleteDuringLoad", func(t *testing.T) {
+		c := newCache(t, 0)
+		loading := make(chan struct{})
+		release := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.GetOrLoad(context.Background(), "route:1", time.Minute, func(ctx context.Context) (interface{}, error) {
+				close(loading)
+				<-release
+				return "outdated", nil
+			})
+		}()
+
+		<-loading
+		c.Delete("route:1")
+		close(release)
+		<-done
+
+		if value, found := c.Get("route:1"); found {
+			t.Errorf("Expected a load overtaken by a delete not to be cached, got %v", value)
+		}
+	})
+
+	t.Run("StaleWhileRevalidate", func(t *testing.T) {
+		c := newCache(t, time.Minute)
+		c.SetWithTTL("key", "old", time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+
+		refreshed := make(chan bool, 1)
+		value, cached, err := c.GetOrLoad(context.Background(), "key", time.Minute, func(ctx context.Context) (interface{}, error) {
+			refreshed <- cache.Refreshing(ctx)
+			return "new", nil
+		})
+		if err != nil || !cached || value != "old" {
+			t.Errorf("Expected the stale value served, got %v %v %v", value, cached, err)
+		}
+		if !<-refreshed {
+			t.Error("Expected the loader to run as a background refresh")
+		}
+		waitFor(t, func() bool {
+			value, found := c.Get("key")
+			return found && value == "new"
+		})
+		if stale := c.Stats().Stale; stale != 1 {
+			t.Errorf("Expected 1 stale hit, got %d", stale)
+		}
+	})
+
+	t.Run("PastMaxStale", func(t *testing.T) {
+		c := newCache(t, time.Millisecond)
+		c.SetWithTTL("key", "old", time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+
+		value, cached, _ := c.GetOrLoad(context.Background(), "key", time.Minute, func(ctx context.Context) (interface{}, error) {
+			return "new", nil
+		})
+		if cached || value != "new" {
+			t.Errorf("Expected a value past the max stale duration to be reloaded, got %v", value)
+		}
+	})
+}
+
+// TestCachePluginConcurrentMisses tests that the cache plugin sends one of
+// many concurrent misses upstream and answers the others with its response
+func TestCachePluginConcurrentMisses(t *testing.T) {
+	reg := builtinRegistry(t)
+
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, "response %d", n)
+	})
+	chain := buildChain(t, reg, `[{"name":"cache","config":{"ttl":"1m"}}]`, upstream)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			chain.ServeHTTP(w, httptest.NewRequest("GET", "/items", nil))
+			if w.Code != http.StatusOK || w.Body.String() != "response 1" {
+				t.Errorf("Expected the shared response, got %d %q", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected one upstream request, got %d", n)
+	}
+
+	t.Run("NotCacheable", func(t *testing.T) {
+		var calls atomic.Int32
+		private := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			time.Sleep(20 * time.Millisecond)
+			w.Header().Set("Cache-Control", "private")
+			json.NewEncoder(w).Encode(map[string]string{"user": "alice"})
+		})
+		chain := buildChain(t, reg, `[{"name":"cache"}]`, private)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				chain.ServeHTTP(w, httptest.NewRequest("GET", "/me", nil))
+				if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "private" {
+					t.Errorf("Expected each request served, got %d", w.Code)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := calls.Load(); n < 2 {
+			t.Errorf("Expected uncacheable responses fetched by each waiting request, got %d upstream requests", n)
+		}
+	})
+}
+
+// TestCacheKeys tests listing cache items by prefix with their TTL
+func TestCacheKeys(t *testing.T) {
+	c := newCache(t, time.Minute)
+	c.SetWithTTL("route:1", "a", time.Minute)
+	c.SetWithTTL("route:2", "bb", 30*time.Second)
+	c.SetWithTTL("routes:all", "ccc", time.Minute)
+	c.SetWithTTL("idempotency:1:abc", "d", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	keys := c.Keys("route:")
+	if len(keys) != 2 || keys[0].Key != "route:1" || keys[1].Key != "route:2" {
+		t.Fatalf("Expected the route: keys in order, got %+v", keys)
+	}
+	if keys[1].Size != 2 {
+		t.Errorf("Expected a size of 2, got %d", keys[1].Size)
+	}
+	if ttl := keys[1].TTL; ttl > 30*time.Second || ttl < 29*time.Second {
+		t.Errorf("Expected about 30s left, got %v", ttl)
+	}
+	if n := len(c.Keys("")); n != 4 {
+		t.Errorf("Expected 4 keys without a prefix, got %d", n)
+	}
+
+	ttl, ok := c.TTL("idempotency:1:abc")
+	if !ok || ttl >= 0 {
+		t.Errorf("Expected a negative TTL for a stale item, got %v %v", ttl, ok)
+	}
+	if stale := c.Keys("idempotency:"); len(stale) != 1 || !stale[0].Stale {
+		t.Errorf("Expected the stale item listed as stale, got %+v", stale)
+	}
+	if _, ok := c.TTL("missing"); ok {
+		t.Error("Expected no TTL for a missing key")
+	}
+
+	patterns := c.Stats().Patterns
+	if patterns["route"] != 2 || patterns["routes"] != 1 || patterns["idempotency"] != 1 {
+		t.Errorf("Unexpected key patterns %v", patterns)
+	}
+}
+
+// TestCacheInspectionEndpoints tests listing, showing and deleting cache
+// items over the API
+func TestCacheInspectionEndpoints(t *testing.T) {
+	c := newCache(t, 0)
+	c.Set("route:1", map[string]interface{}{"path": "/users", "tls": map[string]string{"key_pem": "sealed"}})
+	c.Set("route:2", map[string]interface{}{"path": "/orders"})
+	c.Set("session:1", map[string]interface{}{"Authorization": "Bearer abc", "user": map[string]string{"password": "hunter2"}})
+	c.Set("large:1", strings.Repeat("x", 100<<10))
+
+	h := handlers.NewCacheHandler(c, redact.NewHeaders(nil, redact.DefaultHeaders), logger.Get())
+	r := chi.NewRouter()
+	r.Get("/api/cache/keys", h.ListKeys)
+	r.Get("/api/cache/keys/*", h.GetKey)
+	r.Delete("/api/cache/keys/*", h.DeleteKey)
+
+	do := func(method, path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Data
+	}
+
+	t.Run("List", func(t *testing.T) {
+		code, data := do("GET", "/api/cache/keys?prefix=route:&limit=1&offset=1")
+		keys, _ := data["keys"].([]interface{})
+		if code != http.StatusOK || data["total"] != float64(2) || len(keys) != 1 {
+			t.Fatalf("Expected the second of 2 route keys, got %d %v", code, data)
+		}
+		if key := keys[0].(map[string]interface{}); key["key"] != "route:2" || key["pattern"] != "route" || key["ttl_seconds"].(float64) <= 0 {
+			t.Errorf("Unexpected key %v", key)
+		}
+		if code, _ := do("GET", "/api/cache/keys?limit=-1"); code != http.StatusBadRequest {
+			t.Errorf("Expected an invalid limit rejected, got %d", code)
+		}
+	})
+
+	t.Run("Redaction", func(t *testing.T) {
+		code, data := do("GET", "/api/cache/keys/session:1")
+		value, _ := data["value"].(map[string]interface{})
+		if code != http.StatusOK || value["Authorization"] != redact.Mask || value["user"].(map[string]interface{})["password"] != redact.Mask {
+			t.Errorf("Expected sensitive fields masked, got %d %v", code, data)
+		}
+		_, data = do("GET", "/api/cache/keys/route:1")
+		if tls := data["value"].(map[string]interface{})["tls"].(map[string]interface{}); tls["key_pem"] != redact.Mask {
+			t.Errorf("Expected the key masked, got %v", tls)
+		}
+	})
+
+	t.Run("SizeCap", func(t *testing.T) {
+		_, data := do("GET", "/api/cache/keys/large:1")
+		if data["truncated"] != true || data["value"] != nil || data["size"] != float64(100<<10) {
+			t.Errorf("Expected a large value left out, got %v", data)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if code, _ := do("DELETE", "/api/cache/keys/route:1"); code != http.StatusOK {
+			t.Fatalf("Expected the key deleted, got %d", code)
+		}
+		if _, found := c.Peek("route:1"); found {
+			t.Error("Expected the key gone from the cache")
+		}
+		if code, _ := do("DELETE", "/api/cache/keys/route:1"); code != http.StatusNotFound {
+			t.Errorf("Expected 404 for a missing key, got %d", code)
+		}
+		if code, _ := do("GET", "/api/cache/keys/missing"); code != http.StatusNotFound {
+			t.Errorf("Expected 404 for a missing key, got %d", code)
+		}
+	})
+
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		handler := testRouter(t, auth.NewAuthService("test-secret", logger.Get()), func(cfg *config.Config) {
+			cfg.Auth.Enabled = true
+			cfg.Gateway.RateLimitEnabled = false
+		})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/cache/keys", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected the endpoint to require authentication, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/canary"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// canaryShare returns the fraction of requests sent to the canary
+func canaryShare(n, weight int, user func(i int) string) float64 {
+	hits := 0
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest("GET", "/split", nil)
+		if id := user(i); id != "" {
+			req.Header.Set(canary.StickyHeader, id)
+		}
+		if canary.Choose(req, weight) == canary.VariantCanary {
+			hits++
+		}
+	}
+	return float64(hits) / float64(n)
+}
+
+// TestCanarySplit tests that the canary receives its weight's share of a large sample
+func TestCanarySplit(t *testing.T) {
+	const n = 20000
+
+	for _, weight := range []int{0, 5, 30, 100} {
+		want := float64(weight) / 100
+
+		random := canaryShare(n, weight, func(int) string { return "" })
+		if math.Abs(random-want) > 0.015 {
+			t.Errorf("Weight %d: expected random share near %.2f, got %.4f", weight, want, random)
+		}
+
+		users := canaryShare(n, weight, func(i int) string { return fmt.Sprintf("user-%d", i) })
+		if math.Abs(users-want) > 0.015 {
+			t.Errorf("Weight %d: expected share across users near %.2f, got %.4f", weight, want, users)
+		}
+	}
+}
+
+// TestCanarySticky tests that requests with the same user header stay on one variant
+func TestCanarySticky(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		user := fmt.Sprintf("user-%d", i)
+
+		var first string
+		for j := 0; j < 20; j++ {
+			req := httptest.NewRequest("GET", "/sticky", nil)
+			req.Header.Set(canary.StickyHeader, user)
+
+			variant := canary.Choose(req, 30)
+			if first == "" {
+				first = variant
+			} else if variant != first {
+				t.Fatalf("Expected %s to stay on %s, got %s", user, first, variant)
+			}
+		}
+
+		// Raising the weight only moves users onto the canary
+		req := httptest.NewRequest("GET", "/sticky", nil)
+		req.Header.Set(canary.StickyHeader, user)
+		if first == canary.VariantCanary && canary.Choose(req, 60) != canary.VariantCanary {
+			t.Errorf("Expected %s to stay on the canary when the weight grows", user)
+		}
+	}
+}
+
+// TestRouteCanary tests that a PATCHed canary weight applies to the next request
+func TestRouteCanary(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	backend := func(name string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	stable, next := backend("stable"), backend("canary")
+
+	path := fmt.Sprintf("/canary-%d", time.Now().UnixNano())
+	route := &database.Route{
+		Path:      path,
+		TargetURL: stable.URL,
+		Method:    "GET",
+		Enabled:   true,
+		Timeout:   30,
+		CanaryURL: next.URL,
+	}
+	repo := database.NewRouteRepository(db)
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	routeHandler := handlers.NewRouteHandler(db, cacheInstance, nil, log)
+
+	router := chi.NewRouter()
+	router.Patch("/api/routes/{id}", routeHandler.Patch)
+
+	patch := func(body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("PATCH", fmt.Sprintf("/api/routes/%d", route.ID), strings.NewReader(body)))
+		return w.Code
+	}
+	call := func() string {
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", path, nil))
+		return w.Body.String()
+	}
+
+	if got := call(); got != "stable" {
+		t.Fatalf("Expected weight 0 to use the stable target, got %q", got)
+	}
+
+	before := testutil.ToFloat64(m.CanaryRequests.WithLabelValues(path, canary.VariantCanary, "2xx"))
+	if code := patch(`{"canary_weight": 100}`); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if got := call(); got != "canary" {
+		t.Errorf("Expected the patched weight to apply immediately, got %q", got)
+	}
+	if got := testutil.ToFloat64(m.CanaryRequests.WithLabelValues(path, canary.VariantCanary, "2xx")); got != before+1 {
+		t.Errorf("Expected the canary request to be counted, got %v -> %v", before, got)
+	}
+
+	// The patch must leave the other fields alone
+	updated, err := repo.FindByID(context.Background(), route.ID)
+	if err != nil {
+		t.Fatalf("Failed to read route: %v", err)
+	}
+	if updated.TargetURL != stable.URL || updated.CanaryURL != next.URL || !updated.Enabled {
+		t.Errorf("Expected untouched fields to be kept, got %+v", updated)
+	}
+
+	for _, body := range []string{`{"canary_weight": 150}`, `{"canary_target_url": "", "canary_weight": 10}`, `{"canary_weight":`} {
+		if code := patch(body); code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, code)
+		}
+	}
+}
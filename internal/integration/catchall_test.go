@@ -0,0 +1,200 @@
+package integration
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/matcher"
+	"github.com/zakirkun/isekai/internal/mock"
+	"github.com/zakirkun/isekai/internal/rewrite"
+	"github.com/zakirkun/isekai/pkg/config"
+)
+
+// TestCatchAllMatch tests that catch-all routes answer paths under their own
+// that no route matches, the longest prefix first, and that disabled routes
+// fall through to them
+func TestCatchAllMatch(t *testing.T) {
+	m := matcher.New([]database.Route{
+		{ID: 1, Path: "/shop", Method: "*", Enabled: true, CatchAll: true},
+		{ID: 2, Path: "/shop/admin", Method: "*", Enabled: true, CatchAll: true},
+		{ID: 3, Path: "/shop/cart", Method: "GET", Enabled: true},
+		{ID: 4, Path: "/shop/orders", Method: "GET", Enabled: false},
+		{ID: 5, Path: "/shop/admin/old", Method: "*", Enabled: false, CatchAll: true},
+		{ID: 6, Path: "/shop/cart", Method: "GET", Host: "eu.example.com", Enabled: true},
+		{ID: 7, Path: "/shop/admin", Method: "GET", Host: "*.example.com", Enabled: true, CatchAll: true},
+		{ID: 8, Path: "/docs", Method: "GET", Host: "docs.example.com", Enabled: true, CatchAll: true},
+		{ID: 9, Path: "/shop/checkout", Method: "POST", Enabled: true},
+		{ID: 10, Path: "/shop/admin/users", Method: "GET", Host: "other.org", Enabled: true},
+		{ID: 11, Path: "/shop/admin/list", Method: "GET", Enabled: true},
+	})
+
+	tests := []struct {
+		name, method, host, path string
+		id                       int
+	}{
+		{"OwnPath", "GET", "", "/shop", 1},
+		{"UnderPrefix", "GET", "", "/shop/missing/page", 1},
+		{"SpecificRouteFirst", "GET", "", "/shop/cart", 3},
+		{"NestedCatchAll", "DELETE", "", "/shop/admin/x/y", 2},
+		{"DisabledRouteFallsThrough", "GET", "", "/shop/orders", 1},
+		{"DisabledCatchAllSkipped", "GET", "", "/shop/admin/old/page", 2},
+		{"WildcardHostCatchAll", "GET", "www.example.com", "/shop/admin/x", 7},
+		{"RouteForAnotherHostFallsThrough", "GET", "", "/shop/admin/users", 2},
+		{"HostSpecificRoute", "GET", "eu.example.com", "/shop/cart", 6},
+		// The path is matched before the host, so any host's route for it
+		// beats a catch-all for the request's host
+		{"PathBeatsHostCatchAll", "GET", "www.example.com", "/shop/admin/list", 11},
+		{"CatchAllForAnotherHost", "GET", "www.example.com", "/docs/guide", 0},
+		{"CatchAllForHost", "GET", "docs.example.com", "/docs/guide", 8},
+		{"NoPrefix", "GET", "", "/other", 0},
+		// A path with routes for the host answers 405 rather than falling through
+		{"MethodNotAllowedKept", "GET", "", "/shop/checkout", 0},
+		// The longest catch-all for the host owns its prefix, methods included
+		{"CatchAllMethodNotAllowed", "POST", "www.example.com", "/shop/admin/x", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route, ok := m.Match(tt.method, tt.host, tt.path)
+			switch {
+			case tt.id == 0 && ok:
+				t.Errorf("Expected no route, got %d", route.ID)
+			case tt.id != 0 && (!ok || route.ID != tt.id):
+				t.Errorf("Expected route %d, got %+v", tt.id, route)
+			}
+		})
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		var notAllowed *database.MethodNotAllowedError
+		if _, err := m.Find("GET", "", "/shop/checkout"); !errors.As(err, &notAllowed) || notAllowed.Allowed[0] != "POST" {
+			t.Errorf("Expected the path's own 405, got %v", err)
+		}
+		if _, err := m.Find("POST", "www.example.com", "/shop/admin/x"); !errors.As(err, &notAllowed) || len(notAllowed.Allowed) != 2 {
+			t.Errorf("Expected the catch-all's GET and HEAD allowed, got %v", err)
+		}
+	})
+}
+
+// TestExplainCatchAll tests the reasons given when a catch-all route answers
+// a path and for the catch-alls passed over
+func TestExplainCatchAll(t *testing.T) {
+	m := matcher.New([]database.Route{
+		{ID: 1, Path: "/shop", Method: "*", Enabled: true, CatchAll: true},
+		{ID: 2, Path: "/shop/admin", Method: "GET", Enabled: true, CatchAll: true},
+		{ID: 3, Path: "/shop/admin/x", Method: "GET", Enabled: false},
+		{ID: 4, Path: "/shop/admin", Method: "GET", Host: "api.example.com", Enabled: true, CatchAll: true},
+		{ID: 5, Path: "/shop/admin/y", Method: "GET", Enabled: true},
+		{ID: 6, Path: "/", Method: "GET", Enabled: false, CatchAll: true},
+	})
+
+	explanation := m.Explain("GET", "www.example.com", "/shop/admin/x")
+	if explanation.Status != http.StatusOK || explanation.Route == nil || explanation.Route.ID != 2 || explanation.CatchAll != "/shop/admin" {
+		t.Fatalf("Expected the /shop/admin catch-all to answer, got %d %q %+v", explanation.Status, explanation.CatchAll, explanation.Route)
+	}
+	reasons := map[int]string{
+		1: "catch-all for /shop/admin is more specific",
+		2: "matched: catch-all for /shop/admin, no route for /shop/admin/x, any host, exact method",
+		3: "route is disabled",
+		4: `host "api.example.com" does not match "www.example.com"`,
+		6: "route is disabled",
+	}
+	if len(explanation.Candidates) != len(reasons) {
+		t.Errorf("Expected %d candidates, got %+v", len(reasons), explanation.Candidates)
+	}
+	for _, candidate := range explanation.Candidates {
+		if want := reasons[candidate.ID]; candidate.Reason != want {
+			t.Errorf("Expected route %d reason %q, got %q", candidate.ID, want, candidate.Reason)
+		}
+		if candidate.Matched != (candidate.ID == 2) {
+			t.Errorf("Expected only route 2 matched, got %d", candidate.ID)
+		}
+		if want := map[bool]string{true: matcher.MatchCatchAll, false: matcher.MatchExact}[candidate.ID != 3]; candidate.PathMatch != want {
+			t.Errorf("Expected route %d path match %q, got %q", candidate.ID, want, candidate.PathMatch)
+		}
+	}
+
+	t.Run("HostMatchedMoreSpecifically", func(t *testing.T) {
+		explanation := m.Explain("GET", "api.example.com", "/shop/admin/z")
+		for _, candidate := range explanation.Candidates {
+			if candidate.ID == 2 && candidate.Reason != `host "api.example.com" is matched more specifically by "api.example.com"` {
+				t.Errorf("Unexpected reason %q", candidate.Reason)
+			}
+		}
+		if explanation.Route == nil || explanation.Route.ID != 4 {
+			t.Errorf("Expected route 4, got %+v", explanation.Route)
+		}
+	})
+
+	t.Run("PathAnswered", func(t *testing.T) {
+		explanation := m.Explain("POST", "", "/shop/admin/y")
+		if explanation.Status != http.StatusMethodNotAllowed || explanation.CatchAll != "" {
+			t.Errorf("Expected the path's own 405, got %d %q", explanation.Status, explanation.CatchAll)
+		}
+		for _, candidate := range explanation.Candidates {
+			if candidate.ID == 1 && candidate.Reason != "path /shop/admin/y has its own routes" {
+				t.Errorf("Unexpected reason %q", candidate.Reason)
+			}
+		}
+	})
+
+	t.Run("CatchAllMethodNotAllowed", func(t *testing.T) {
+		explanation := m.Explain("POST", "", "/shop/admin/z")
+		if explanation.Status != http.StatusMethodNotAllowed || explanation.CatchAll != "/shop/admin" || len(explanation.Allowed) != 2 {
+			t.Errorf("Expected 405 from the /shop/admin catch-all, got %d %q %v", explanation.Status, explanation.CatchAll, explanation.Allowed)
+		}
+	})
+}
+
+// TestCatchAllProxy tests a rewrite catch-all forwarding unmatched paths to
+// the backend that renders its own 404, and a mock catch-all answering with
+// a custom one
+func TestCatchAllProxy(t *testing.T) {
+	shop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/shop/cart" {
+			w.Write([]byte("cart"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("shop has no " + r.URL.Path))
+	}))
+	defer shop.Close()
+
+	cart := egressRoute(1, "/shop/cart", shop.URL+"/shop/cart", nil)
+	orders := egressRoute(2, "/shop/orders", shop.URL+"/shop/orders", nil)
+	orders.Enabled = false
+	catchAll := egressRoute(3, "/shop", shop.URL, nil)
+	catchAll.Type, catchAll.Method, catchAll.CatchAll = database.RouteTypeRewrite, "*", true
+	catchAll.Rewrite = &rewrite.Rule{Prefix: "/shop", Replacement: "/shop"}
+	docs := database.Route{ID: 4, Path: "/docs", Method: "GET", Enabled: true, CatchAll: true, Type: database.RouteTypeMock,
+		Mock: &mock.Response{Status: http.StatusNotFound, Body: "no such page in the docs"}}
+
+	h := egressHandler(t, &config.Load().Proxy, testMetrics(), nil, cart, orders, catchAll, docs)
+	for _, tt := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/shop/cart", http.StatusOK, "cart"},
+		{"/shop/missing", http.StatusNotFound, "shop has no /shop/missing"},
+		{"/shop/orders", http.StatusNotFound, "shop has no /shop/orders"},
+		{"/docs/v9/intro", http.StatusNotFound, "no such page in the docs"},
+	} {
+		w := httptest.NewRecorder()
+		h.Handle(w, httptest.NewRequest("GET", tt.path, nil))
+		body, _ := io.ReadAll(w.Body)
+		if w.Code != tt.status || string(body) != tt.body {
+			t.Errorf("Expected %s answered %d %q, got %d %q", tt.path, tt.status, tt.body, w.Code, body)
+		}
+	}
+
+	// Paths under no catch-all keep the gateway's own 404
+	w := httptest.NewRecorder()
+	h.Handle(w, httptest.NewRequest("GET", "/elsewhere", nil))
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the gateway's JSON 404, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
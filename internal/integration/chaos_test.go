@@ -0,0 +1,314 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/chaos"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestChaosInjectionRates tests that faults are injected into the configured
+// share of requests
+func TestChaosInjectionRates(t *testing.T) {
+	const n = 20000
+	registry := chaos.NewRegistry()
+	registry.Set(1, chaos.Fault{ErrorPercent: 25, DelayPercent: 50, Delay: 5, Jitter: 10, AbortPercent: 10})
+
+	var errs, delays, aborts int
+	for i := 0; i < n; i++ {
+		d := registry.Decide(1)
+		if d.Abort && d.Status != 0 {
+			t.Fatalf("Expected an aborted request not to be answered, got %+v", d)
+		}
+		if d.Abort {
+			aborts++
+		}
+		if d.Status != 0 {
+			if d.Status != http.StatusServiceUnavailable {
+				t.Fatalf("Expected the default 503, got %d", d.Status)
+			}
+			errs++
+		}
+		if d.Delay != 0 {
+			if d.Delay < 5*time.Millisecond || d.Delay > 15*time.Millisecond {
+				t.Fatalf("Expected a delay between 5ms and 15ms, got %s", d.Delay)
+			}
+			delays++
+		}
+	}
+
+	// Errors are only rolled for requests that aren't aborted
+	for name, tt := range map[string]struct {
+		got  int
+		want float64
+	}{
+		"Abort":   {aborts, 0.10},
+		"Error":   {errs, 0.25 * 0.90},
+		"Latency": {delays, 0.50},
+	} {
+		if share := float64(tt.got) / n; math.Abs(share-tt.want) > 0.015 {
+			t.Errorf("%s: expected a share of %.3f, got %.3f", name, tt.want, share)
+		}
+	}
+
+	if d := registry.Decide(2); d.Label() != "" {
+		t.Errorf("Expected no faults on an unconfigured route, got %+v", d)
+	}
+	var disabled *chaos.Registry
+	if d := disabled.Decide(1); d.Label() != "" {
+		t.Errorf("Expected no faults without a registry, got %+v", d)
+	}
+
+	registry.Set(1, chaos.Fault{ErrorPercent: 100, ErrorStatus: 500})
+	for i := 0; i < 100; i++ {
+		if d := registry.Decide(1); d.Status != 500 || d.Label() != chaos.FaultError {
+			t.Fatalf("Expected every request to get a 500, got %+v", d)
+		}
+	}
+}
+
+// TestChaosFaultValidation tests the fault configurations rejected
+func TestChaosFaultValidation(t *testing.T) {
+	maxDelay := int(chaos.MaxDelay / time.Millisecond)
+	for name, tt := range map[string]struct {
+		fault chaos.Fault
+		valid bool
+	}{
+		"Empty":            {chaos.Fault{}, false},
+		"NegativePercent":  {chaos.Fault{ErrorPercent: -1}, false},
+		"OverPercent":      {chaos.Fault{AbortPercent: 101}, false},
+		"ClientStatus":     {chaos.Fault{ErrorPercent: 10, ErrorStatus: 404}, false},
+		"NegativeDelay":    {chaos.Fault{DelayPercent: 10, Delay: -5}, false},
+		"ExcessiveDelay":   {chaos.Fault{DelayPercent: 10, Delay: maxDelay, Jitter: 1}, false},
+		"DelayWithoutTime": {chaos.Fault{DelayPercent: 50}, false},
+		"Error":            {chaos.Fault{ErrorPercent: 5, ErrorStatus: 500}, true},
+		"Latency":          {chaos.Fault{DelayPercent: 100, Jitter: 200}, true},
+		"MaxDelay":         {chaos.Fault{DelayPercent: 100, Delay: maxDelay}, true},
+		"Abort":            {chaos.Fault{AbortPercent: 0.5}, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.fault.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Expected valid=%v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+// TestChaosProductionGuard tests that fault injection can't be enabled in
+// production
+func TestChaosProductionGuard(t *testing.T) {
+	cfg := config.Load()
+	if cfg.Chaos.Enabled || cfg.Environment != "production" || !cfg.Production() {
+		t.Errorf("Expected chaos off in production by default, got %+v in %q", cfg.Chaos, cfg.Environment)
+	}
+
+	for _, tt := range []struct {
+		environment string
+		valid       bool
+	}{
+		{"production", false},
+		{"prod", false},
+		{"", false},
+		{"staging", true},
+		{"development", true},
+	} {
+		t.Run("Environment="+tt.environment, func(t *testing.T) {
+			t.Setenv("ENVIRONMENT", tt.environment)
+			t.Setenv("CHAOS_ENABLED", "true")
+			err := config.Load().Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("Expected valid=%v, got %v", tt.valid, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "CHAOS_ENABLED") {
+				t.Errorf("Expected the error to name CHAOS_ENABLED, got %v", err)
+			}
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Setenv("CHAOS_ENABLED", "false")
+		if err := config.Load().Validate(); err != nil {
+			t.Errorf("Expected chaos off to be allowed in production, got %v", err)
+		}
+	})
+}
+
+// TestChaosAdminEndpoints tests the fault management endpoints
+func TestChaosAdminEndpoints(t *testing.T) {
+	send := func(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	disabled := testRouter(t, nil, func(cfg *config.Config) {})
+	if w := send(disabled, "GET", "/api/admin/chaos", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected no chaos endpoints when disabled, got %d", w.Code)
+	}
+
+	handler := testRouter(t, nil, func(cfg *config.Config) {
+		cfg.Environment = "staging"
+		cfg.Chaos.Enabled = true
+	})
+	for name, tt := range map[string]struct {
+		method, path, body string
+		status             int
+	}{
+		"List":          {"GET", "/api/admin/chaos", "", http.StatusOK},
+		"Reset":         {"DELETE", "/api/admin/chaos", "", http.StatusOK},
+		"InvalidID":     {"PUT", "/api/admin/chaos/routes/abc", `{"error_percent":10}`, http.StatusBadRequest},
+		"InvalidBody":   {"PUT", "/api/admin/chaos/routes/1", `{`, http.StatusBadRequest},
+		"InvalidFault":  {"PUT", "/api/admin/chaos/routes/1", `{"error_percent":150}`, http.StatusBadRequest},
+		"NothingToDo":   {"PUT", "/api/admin/chaos/routes/1", `{}`, http.StatusBadRequest},
+		"ClearUnknown":  {"DELETE", "/api/admin/chaos/routes/1", "", http.StatusNotFound},
+		"ClearBadRoute": {"DELETE", "/api/admin/chaos/routes/abc", "", http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if w := send(handler, tt.method, tt.path, tt.body); w.Code != tt.status {
+				t.Errorf("Expected %d, got %d %s", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestAbortThroughMiddleware tests that an aborted handler drops the
+// connection through the timeout and recovery middleware
+func TestAbortThroughMiddleware(t *testing.T) {
+	log := logger.Get()
+	wrap := func(h http.HandlerFunc) http.Handler {
+		return middleware.Recovery(log, nil, nil)(middleware.Timeout(5 * time.Second)(h))
+	}
+
+	aborted := httptest.NewServer(wrap(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer aborted.Close()
+	if resp, err := http.Get(aborted.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected the connection to be dropped, got %d", resp.StatusCode)
+	}
+
+	// Other panics in the timed handler still become a 500
+	panicked := httptest.NewServer(wrap(func(w http.ResponseWriter, r *http.Request) {
+		panic(errors.New("boom"))
+	}))
+	defer panicked.Close()
+	resp, err := http.Get(panicked.URL)
+	if err != nil {
+		t.Fatalf("Expected a response, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected 500, got %d", resp.StatusCode)
+	}
+}
+
+// TestChaosRoute tests faults injected into a route by the proxy handler
+func TestChaosRoute(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+	repo := database.NewRouteRepository(db)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	route := &database.Route{
+		Path:      fmt.Sprintf("/chaos-%d", time.Now().UnixNano()),
+		TargetURL: upstream.URL,
+		Method:    "GET",
+		Enabled:   true,
+		Timeout:   30,
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	registry := chaos.NewRegistry()
+	proxyHandler.SetChaos(registry)
+	server := httptest.NewServer(middleware.Recovery(log, nil, nil)(http.HandlerFunc(proxyHandler.Handle)))
+	defer server.Close()
+
+	get := func() (*http.Response, error) {
+		resp, err := http.Get(server.URL + route.Path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		registry.Set(route.ID, chaos.Fault{ErrorPercent: 100, ErrorStatus: 500})
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", route.Path, nil))
+		if w.Code != 500 || !strings.Contains(w.Body.String(), response.CodeFaultInjected) {
+			t.Errorf("Expected an injected 500, got %d %s", w.Code, w.Body.String())
+		}
+		if got := testutil.ToFloat64(m.ChaosFaults.WithLabelValues(route.Path, chaos.FaultError)); got != 1 {
+			t.Errorf("Expected the fault to be counted, got %v", got)
+		}
+	})
+
+	t.Run("Latency", func(t *testing.T) {
+		registry.Set(route.ID, chaos.Fault{DelayPercent: 100, Delay: 50})
+		start := time.Now()
+		resp, err := get()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the delayed request to be forwarded, got %v %v", resp, err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Expected a 50ms delay, took %s", elapsed)
+		}
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		registry.Set(route.ID, chaos.Fault{AbortPercent: 100})
+		if resp, err := get(); err == nil {
+			t.Errorf("Expected the connection to be dropped, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Cleared", func(t *testing.T) {
+		if !registry.Clear(route.ID) {
+			t.Fatal("Expected the route's faults to be cleared")
+		}
+		resp, err := get()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected the request to be forwarded, got %v %v", resp, err)
+		}
+	})
+}
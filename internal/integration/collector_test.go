@@ -0,0 +1,154 @@
+package integration
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// metricValue returns the current value of a gauge or counter
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	t.Helper()
+
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil {
+		t.Fatalf("Failed to read metric: %v", err)
+	}
+	if metric.Gauge != nil {
+		return metric.GetGauge().GetValue()
+	}
+	return metric.GetCounter().GetValue()
+}
+
+// TestCollectorPoolMetrics tests that pool statistics are exported as gauges
+// and cumulative counts advance their counters by the difference
+func TestCollectorPoolMetrics(t *testing.T) {
+	m := testMetrics()
+	collector := metrics.NewCollector(m, time.Hour)
+
+	var mu sync.Mutex
+	stats := metrics.PoolStats{AcquiredConns: 3, IdleConns: 2, TotalConns: 5, MaxConns: 10, ConstructingConns: 1, NewConns: 5, AcquireCount: 100, EmptyAcquireCount: 4, AcquireDuration: 2 * time.Second}
+	connected := true
+	collector.WatchPool(func() (metrics.PoolStats, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		return stats, connected
+	})
+
+	acquires := metricValue(t, m.DBPoolAcquires)
+	empty := metricValue(t, m.DBPoolEmptyAcquires)
+	waited := metricValue(t, m.DBPoolAcquireDuration)
+
+	collector.Collect()
+	for name, want := range map[string]struct {
+		metric prometheus.Metric
+		value  float64
+	}{
+		"acquired":     {m.DBPoolAcquired, 3},
+		"idle":         {m.DBPoolIdle, 2},
+		"total":        {m.DBPoolTotal, 5},
+		"max":          {m.DBPoolMax, 10},
+		"constructing": {m.DBPoolConstructing, 1},
+	} {
+		if got := metricValue(t, want.metric); got != want.value {
+			t.Errorf("Expected %s connections %v, got %v", name, want.value, got)
+		}
+	}
+	if got := metricValue(t, m.DBPoolAcquires) - acquires; got != 100 {
+		t.Errorf("Expected 100 acquires, got %v", got)
+	}
+
+	// Pool exhaustion shows up as waiting acquires
+	mu.Lock()
+	stats.AcquiredConns, stats.IdleConns, stats.TotalConns = 10, 0, 10
+	stats.AcquireCount, stats.EmptyAcquireCount, stats.AcquireDuration = 150, 30, 5*time.Second
+	mu.Unlock()
+	collector.Collect()
+	if got := metricValue(t, m.DBPoolAcquires) - acquires; got != 150 {
+		t.Errorf("Expected 150 acquires in total, got %v", got)
+	}
+	if got := metricValue(t, m.DBPoolEmptyAcquires) - empty; got != 30 {
+		t.Errorf("Expected 30 empty acquires in total, got %v", got)
+	}
+	if got := metricValue(t, m.DBPoolAcquireDuration) - waited; got != 5 {
+		t.Errorf("Expected 5s spent acquiring, got %v", got)
+	}
+
+	// A new pool starts its counts over
+	mu.Lock()
+	stats.AcquireCount = 20
+	mu.Unlock()
+	collector.Collect()
+	if got := metricValue(t, m.DBPoolAcquires) - acquires; got != 170 {
+		t.Errorf("Expected the new pool's acquires to be added, got %v", got)
+	}
+
+	// Nothing changes while disconnected
+	mu.Lock()
+	connected = false
+	stats.AcquiredConns = 0
+	mu.Unlock()
+	collector.Collect()
+	if got := metricValue(t, m.DBPoolAcquired); got != 10 {
+		t.Errorf("Expected the last pool stats to remain, got %v", got)
+	}
+}
+
+// TestCollectorCacheMetrics tests that cache lookups and removals are exported
+func TestCollectorCacheMetrics(t *testing.T) {
+	m := testMetrics()
+	c := cache.New(&config.CacheConfig{Enabled: false, TTL: time.Minute, MaxSize: 2}, logger.Get(), nil)
+
+	collector := metrics.NewCollector(m, 10*time.Millisecond)
+	collector.WatchCache(func() metrics.CacheStats {
+		stats := c.Stats()
+		return metrics.CacheStats{Size: stats.Size, Hits: stats.Hits, Misses: stats.Misses, Evictions: stats.Evictions, Expired: stats.Expired, Patterns: stats.Patterns}
+	})
+
+	hits := metricValue(t, m.CacheHits)
+	misses := metricValue(t, m.CacheMisses)
+	evictions := metricValue(t, m.CacheEvictions.WithLabelValues("capacity"))
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3) // evicts the oldest
+	c.Get("c")
+	c.Get("c")
+	c.Get("missing")
+
+	// The collector runs on its interval until stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		collector.Run(ctx)
+		close(done)
+	}()
+	waitFor(t, func() bool { return metricValue(t, m.CacheHits)-hits == 2 })
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the collector to stop")
+	}
+
+	if got := metricValue(t, m.CacheSize); got != 2 {
+		t.Errorf("Expected a cache size of 2, got %v", got)
+	}
+	if got := metricValue(t, m.CacheMisses) - misses; got != 1 {
+		t.Errorf("Expected 1 miss, got %v", got)
+	}
+	if got := metricValue(t, m.CacheEvictions.WithLabelValues("capacity")) - evictions; got != 1 {
+		t.Errorf("Expected 1 eviction, got %v", got)
+	}
+	if got := metricValue(t, m.CacheKeys.WithLabelValues("c")); got != 1 {
+		t.Errorf("Expected 1 key with pattern c, got %v", got)
+	}
+}
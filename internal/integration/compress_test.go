@@ -0,0 +1,251 @@
+package integration
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zakirkun/isekai/internal/compress"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/transform"
+	"github.com/zakirkun/isekai/pkg/config"
+)
+
+// TestCompressNegotiate tests picking an encoding from Accept-Encoding
+func TestCompressNegotiate(t *testing.T) {
+	preferred := []string{compress.Brotli, compress.Gzip}
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"br;q=0.8, gzip", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, br", "br"},
+		{"*", "br"},
+		{"*;q=0", ""},
+		{"*, br;q=0", "gzip"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"br;q=0.5, gzip;q=0.5", "br"},
+		{"GZIP;Q=1", "gzip"},
+		{"x-gzip", "gzip"},
+		{"gzip;q=bogus, br;q=0.1", "br"},
+		{"deflate, compress", ""},
+		{"gzip;q=0, gzip;q=0.3", "gzip"},
+	}
+	for _, tt := range tests {
+		if got := compress.Negotiate(tt.header, preferred); got != tt.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+
+	if got := compress.Negotiate("br, gzip", []string{compress.Gzip, compress.Brotli}); got != compress.Gzip {
+		t.Errorf("Expected the configured preference to break ties, got %q", got)
+	}
+}
+
+// decoded decompresses a recorded body with its Content-Encoding
+func decoded(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	encoding := rec.Header().Get("Content-Encoding")
+	if encoding == "" {
+		return rec.Body.String()
+	}
+	body, err := compress.Decode(encoding, rec.Body.Bytes(), 1<<20)
+	if err != nil {
+		t.Fatalf("Failed to decode the %s body: %v", encoding, err)
+	}
+	return string(body)
+}
+
+// TestCompressMiddleware tests which responses are compressed, with what,
+// and the headers that go with it
+func TestCompressMiddleware(t *testing.T) {
+	cfg := config.Load().Compression
+	cfg.MinSize = 64
+	large := `{"items":"` + strings.Repeat("isekai ", 40) + `"}`
+
+	handler := middleware.Compress(&cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(large))
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"ok":true}`))
+		case "/sniffed":
+			w.Write([]byte("<html><body>" + large + "</body></html>"))
+		case "/encoded":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			body, _ := compress.Encode(compress.Gzip, []byte(large))
+			w.Write(body)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		case "/no-transform":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Cache-Control", "no-transform")
+			w.Write([]byte(large))
+		case "/stream":
+			w.Header().Set("Content-Type", "text/plain")
+			for i := 0; i < 3; i++ {
+				w.Write([]byte(`{"n":1}` + "\n"))
+				http.NewResponseController(w).Flush()
+			}
+		case "/empty":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	get := func(method, path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tt := range []struct{ acceptEncoding, want string }{
+		{"gzip, br", "br"},
+		{"gzip;q=1, br;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"*", "br"},
+		{"", ""},
+	} {
+		rec := get(http.MethodGet, "/json", tt.acceptEncoding)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("Expected %q for Accept-Encoding %q, got %q", tt.want, tt.acceptEncoding, got)
+		}
+		if body := decoded(t, rec); body != large {
+			t.Errorf("Expected the body intact for Accept-Encoding %q, got %q", tt.acceptEncoding, body)
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Expected Vary: Accept-Encoding for Accept-Encoding %q, got %v", tt.acceptEncoding, rec.Header().Values("Vary"))
+		}
+		if tt.want != "" {
+			if rec.Header().Get("Content-Length") != "" || rec.Header().Get("ETag") != `W/"v1"` {
+				t.Errorf("Expected no Content-Length and a weak ETag when compressed, got %v", rec.Header())
+			}
+		} else if rec.Header().Get("Content-Length") != strconv.Itoa(len(large)) || rec.Header().Get("ETag") != `"v1"` {
+			t.Errorf("Expected the length and ETag kept when not compressed, got %v", rec.Header())
+		}
+	}
+
+	rec := get(http.MethodGet, "/sniffed", "gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Expected a sniffed HTML body compressed, got %v", rec.Header())
+	}
+	decoded(t, rec)
+
+	rec = get(http.MethodGet, "/encoded", "br, gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" || decoded(t, rec) != large {
+		t.Errorf("Expected an encoded body passed through once, got %v", rec.Header())
+	}
+
+	rec = get(http.MethodGet, "/stream", "gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" || !rec.Flushed {
+		t.Errorf("Expected a flushed stream compressed as it goes, got %v", rec.Header())
+	}
+	if body := decoded(t, rec); body != strings.Repeat(`{"n":1}`+"\n", 3) {
+		t.Errorf("Expected the whole stream, got %q", body)
+	}
+
+	// Small bodies vary but aren't compressed; other types don't vary
+	rec = get(http.MethodGet, "/small", "gzip")
+	if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "Accept-Encoding" || rec.Body.String() != `{"ok":true}` {
+		t.Errorf("Expected a small body sent as it is with Vary, got %v %q", rec.Header(), rec.Body.String())
+	}
+	for _, path := range []string{"/image", "/no-transform", "/empty"} {
+		rec = get(http.MethodGet, path, "gzip")
+		if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "" {
+			t.Errorf("Expected %s left alone, got %v", path, rec.Header())
+		}
+	}
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Errorf("Expected an empty 204, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if rec = get(http.MethodHead, "/json", "gzip"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected HEAD requests left alone, got %v", rec.Header())
+	}
+}
+
+// TestTransformCompressed tests transforming bodies the upstream or client
+// compressed, decoded for the transform and encoded again afterwards
+func TestTransformCompressed(t *testing.T) {
+	var received []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		encoding := r.Header.Get("X-Test-Encoding")
+		body := []byte(`{"a":{"b":1}}`)
+		if encoding != "" {
+			body, _ = compress.Encode(encoding, body)
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	route := egressRoute(1, "/orders", upstream.URL, nil)
+	route.Method = "*"
+	route.Transform = &transform.Rules{
+		Request:  &transform.Ops{Set: map[string]interface{}{"source": "gateway"}},
+		Response: &transform.Ops{Rename: map[string]string{"a.b": "c"}},
+	}
+	h := egressHandler(t, &config.Load().Proxy, testMetrics(), nil, route)
+
+	for _, encoding := range []string{compress.Brotli, compress.Gzip, ""} {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("X-Test-Encoding", encoding)
+		req.Header.Set("Accept-Encoding", "br, gzip")
+		rec := httptest.NewRecorder()
+		h.Handle(rec, req)
+
+		if got := rec.Header().Get("Content-Encoding"); got != encoding {
+			t.Errorf("Expected the response encoded with %q again, got %q", encoding, got)
+		}
+		if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("Expected Content-Length %d for the %q body, got %q", rec.Body.Len(), encoding, got)
+		}
+		if body := decoded(t, rec); !strings.Contains(body, `"c":1`) || strings.Contains(body, `"b"`) {
+			t.Errorf("Expected the %q response transformed, got %s", encoding, body)
+		}
+	}
+
+	// A gzipped request body is decoded, transformed and sent on gzipped
+	body, _ := compress.Encode(compress.Gzip, []byte(`{"id":7}`))
+	req := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	h.Handle(httptest.NewRecorder(), req)
+	plain, err := compress.Decode(compress.Gzip, received, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected the upstream to get a gzipped body, got %q: %v", received, err)
+	}
+	if !strings.Contains(string(plain), `"source":"gateway"`) || !strings.Contains(string(plain), `"id":7`) {
+		t.Errorf("Expected the request body transformed, got %s", plain)
+	}
+
+	// An encoding the gateway can't decode passes through unchanged
+	req = httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("opaque"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "zstd")
+	h.Handle(httptest.NewRecorder(), req)
+	if string(received) != "opaque" {
+		t.Errorf("Expected a zstd body forwarded as it was, got %q", received)
+	}
+}
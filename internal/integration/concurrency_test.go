@@ -0,0 +1,272 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/concurrency"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// peakTracker records the most requests seen in flight at once
+type peakTracker struct {
+	current, peak atomic.Int64
+}
+
+func (p *peakTracker) enter() {
+	n := p.current.Add(1)
+	for {
+		peak := p.peak.Load()
+		if n <= peak || p.peak.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+func (p *peakTracker) leave() {
+	p.current.Add(-1)
+}
+
+// TestConcurrencyLimit tests that requests over the cap queue, and are
+// turned away once the queue is full or their wait times out
+func TestConcurrencyLimit(t *testing.T) {
+	m := testMetrics()
+	limiter := concurrency.New(3, 2, 50*time.Millisecond, middleware.QueueGauge(m, middleware.ConcurrencyScopeGateway))
+
+	unblock := make(chan struct{})
+	var peak peakTracker
+	handler := middleware.ConcurrencyLimit(limiter, m, []string{"/health", "/metrics"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			peak.enter()
+			defer peak.leave()
+			<-unblock
+		}
+	}))
+
+	send := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan *httptest.ResponseRecorder, 10)
+	start := func(n int) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results <- send("/slow")
+			}()
+		}
+	}
+
+	// Fill the slots, then the queue
+	start(3)
+	waitFor(t, func() bool { return limiter.InFlight() == 3 })
+	start(2)
+	waitFor(t, func() bool { return limiter.Queued() == 2 })
+	if got := testutil.ToFloat64(m.RequestQueueDepth.WithLabelValues(middleware.ConcurrencyScopeGateway)); got != 2 {
+		t.Errorf("Expected a queue depth of 2, got %v", got)
+	}
+
+	t.Run("QueueFull", func(t *testing.T) {
+		w := send("/slow")
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected status 503, got %d", w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != middleware.ConcurrencyRetryAfter {
+			t.Errorf("Expected Retry-After %s, got %q", middleware.ConcurrencyRetryAfter, got)
+		}
+		if !strings.Contains(w.Body.String(), `"code":"OVERLOADED"`) {
+			t.Errorf("Expected the OVERLOADED code, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("Exempt", func(t *testing.T) {
+		for _, path := range []string{"/health", "/health/ready", "/metrics"} {
+			if w := send(path); w.Code != http.StatusOK {
+				t.Errorf("Expected %s to be served while saturated, got %d", path, w.Code)
+			}
+		}
+		if w := send("/healthz"); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected only paths below /health to be exempt, got %d", w.Code)
+		}
+	})
+
+	t.Run("QueueTimeout", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if w := <-results; w.Code != http.StatusServiceUnavailable {
+				t.Errorf("Expected queued requests to time out with 503, got %d", w.Code)
+			}
+		}
+		if got := testutil.ToFloat64(m.ConcurrencyRejected.WithLabelValues(middleware.ConcurrencyScopeGateway, "queue_timeout")); got != 2 {
+			t.Errorf("Expected 2 queue timeouts, got %v", got)
+		}
+		if got := testutil.ToFloat64(m.ConcurrencyRejected.WithLabelValues(middleware.ConcurrencyScopeGateway, "queue_full")); got != 2 {
+			t.Errorf("Expected 2 rejections with a full queue, got %v", got)
+		}
+		if got := testutil.ToFloat64(m.RequestQueueDepth.WithLabelValues(middleware.ConcurrencyScopeGateway)); got != 0 {
+			t.Errorf("Expected an empty queue, got %v", got)
+		}
+	})
+
+	close(unblock)
+	wg.Wait()
+	close(results)
+	for w := range results {
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected requests holding slots to finish, got %d", w.Code)
+		}
+	}
+	if got := peak.peak.Load(); got > 3 {
+		t.Errorf("Expected at most 3 requests in flight, got %d", got)
+	}
+	if limiter.InFlight() != 0 {
+		t.Errorf("Expected every slot to be released, got %d", limiter.InFlight())
+	}
+}
+
+// TestConcurrencyLoad sends a burst of requests and checks that the cap
+// holds and the queue absorbs what it can
+func TestConcurrencyLoad(t *testing.T) {
+	const limit, queue, requests = 4, 16, 200
+
+	m := testMetrics()
+	limiter := concurrency.New(limit, queue, 20*time.Millisecond, nil)
+	var peak peakTracker
+	handler := middleware.ConcurrencyLimit(limiter, m, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peak.enter()
+		defer peak.leave()
+		time.Sleep(2 * time.Millisecond)
+	}))
+
+	var ok, rejected atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			switch w.Code {
+			case http.StatusOK:
+				ok.Add(1)
+			case http.StatusServiceUnavailable:
+				rejected.Add(1)
+			default:
+				t.Errorf("Unexpected status %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.peak.Load(); got > limit {
+		t.Errorf("Expected at most %d requests in flight, got %d", limit, got)
+	}
+	if ok.Load() < limit || ok.Load()+rejected.Load() != requests {
+		t.Errorf("Expected every request to be served or rejected, got %d served and %d rejected", ok.Load(), rejected.Load())
+	}
+	counted := testutil.ToFloat64(m.ConcurrencyRejected.WithLabelValues(middleware.ConcurrencyScopeGateway, "queue_full")) +
+		testutil.ToFloat64(m.ConcurrencyRejected.WithLabelValues(middleware.ConcurrencyScopeGateway, "queue_timeout"))
+	if int64(counted) != rejected.Load() {
+		t.Errorf("Expected %d rejections to be counted, got %v", rejected.Load(), counted)
+	}
+	t.Logf("%d served, %d rejected, peak %d in flight", ok.Load(), rejected.Load(), peak.peak.Load())
+}
+
+// TestRouteConcurrencyLimit tests a route's own max_concurrency
+func TestRouteConcurrencyLimit(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	unblock := make(chan struct{})
+	var peak peakTracker
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peak.enter()
+		defer peak.leave()
+		<-unblock
+	}))
+	defer backend.Close()
+
+	repo := database.NewRouteRepository(db)
+	route := &database.Route{
+		Path:           fmt.Sprintf("/fragile-%d", time.Now().UnixNano()),
+		TargetURL:      backend.URL,
+		Method:         "GET",
+		Enabled:        true,
+		Timeout:        30,
+		MaxConcurrency: 2,
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	proxyHandler.SetConcurrencyQueue(0, 0)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			proxyHandler.Handle(w, httptest.NewRequest("GET", route.Path, nil))
+			codes <- w.Code
+		}()
+	}
+	waitFor(t, func() bool { return peak.current.Load() == 2 })
+
+	w := httptest.NewRecorder()
+	proxyHandler.Handle(w, httptest.NewRequest("GET", route.Path, nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected status 503 with Retry-After over the route's limit, got %d", w.Code)
+	}
+	if got := testutil.ToFloat64(m.ConcurrencyRejected.WithLabelValues(route.Path, "queue_full")); got != 1 {
+		t.Errorf("Expected the rejection to be counted for the route, got %v", got)
+	}
+
+	close(unblock)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Expected requests within the limit to succeed, got %d", code)
+		}
+	}
+	if got := peak.peak.Load(); got > 2 {
+		t.Errorf("Expected at most 2 requests at the upstream, got %d", got)
+	}
+}
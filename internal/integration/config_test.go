@@ -0,0 +1,209 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/drain"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/router"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// secretEnv lists every secret setting with a value for the tests
+var secretEnv = map[string]string{
+	"DB_PASSWORD":               "db-secret-value",
+	"JWT_SECRET":                "jwt-secret-value",
+	"PROXY_TLS_SEAL_KEY":        "seal-secret-value",
+	"LB_STICKY_KEY":             "sticky-secret-value",
+	"LB_DISCOVERY_CONSUL_TOKEN": "consul-secret-value",
+	"METRICS_AUTH_TOKEN":        "metrics-secret-value",
+	"AUTH_OIDC_CLIENT_SECRET":   "oidc-secret-value",
+}
+
+// writeSecret writes value to a file in a temporary directory
+func writeSecret(t *testing.T, value string) string {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+	return path
+}
+
+// TestSecretFiles tests that secrets are read from _FILE variants, which take
+// precedence over the plain environment variables
+func TestSecretFiles(t *testing.T) {
+	for key := range secretEnv {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, "from-env")
+			t.Setenv(key+"_FILE", writeSecret(t, "from-file\n"))
+
+			cfg := config.Load()
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Expected valid configuration, got %v", err)
+			}
+			if got := secretValues(cfg)[key]; got != "from-file" {
+				t.Errorf("Expected %s from the file without the newline, got %q", key, got)
+			}
+		})
+	}
+
+	t.Run("EnvWithoutFile", func(t *testing.T) {
+		t.Setenv("DB_PASSWORD", "from-env")
+		if got := config.Load().Database.Password; got != "from-env" {
+			t.Errorf("Expected DB_PASSWORD from the environment, got %q", got)
+		}
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		t.Setenv("DB_PASSWORD_FILE", filepath.Join(t.TempDir(), "missing"))
+		err := config.Load().Validate()
+		if err == nil || !strings.Contains(err.Error(), "DB_PASSWORD_FILE") {
+			t.Errorf("Expected an error naming DB_PASSWORD_FILE, got %v", err)
+		}
+	})
+}
+
+// TestDefaultJWTSecret tests that the placeholder secret is refused only when
+// it would be used to sign tokens
+func TestDefaultJWTSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"AuthDisabled", map[string]string{"AUTH_ENABLED": "false"}, false},
+		{"Default", map[string]string{"AUTH_ENABLED": "true"}, true},
+		{"Explicit", map[string]string{"AUTH_ENABLED": "true", "JWT_SECRET": config.DefaultJWTSecret}, true},
+		{"Changed", map[string]string{"AUTH_ENABLED": "true", "JWT_SECRET": "a-real-secret"}, false},
+		{"Asymmetric", map[string]string{"AUTH_ENABLED": "true", "AUTH_ALG": "RS256"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_SECRET", "")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			err := config.Load().Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestRedactedConfig tests that every secret is masked in the redacted copy,
+// its JSON and the admin config endpoint, and the original is left intact
+func TestRedactedConfig(t *testing.T) {
+	for key, value := range secretEnv {
+		t.Setenv(key, value)
+	}
+	cfg := config.Load()
+	cfg.Auth.Enabled = false
+	cfg.Gateway.RateLimitEnabled = false
+
+	redacted := cfg.Redacted()
+	for key, value := range secretValues(redacted) {
+		if value != "[REDACTED]" {
+			t.Errorf("Expected %s to be redacted, got %q", key, value)
+		}
+	}
+	for key, value := range secretValues(cfg) {
+		if value != secretEnv[key] {
+			t.Errorf("Expected the original %s to be unchanged, got %q", key, value)
+		}
+	}
+
+	data, err := json.Marshal(redacted)
+	if err != nil {
+		t.Fatalf("Failed to encode configuration: %v", err)
+	}
+	assertNoSecrets(t, string(data))
+
+	t.Run("Unset", func(t *testing.T) {
+		empty := *cfg
+		empty.Proxy.TLSSealKey = ""
+		if got := empty.Redacted().Proxy.TLSSealKey; got != "" {
+			t.Errorf("Expected an unset secret to stay empty, got %q", got)
+		}
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		log := logger.Get()
+		bus := events.NewBus()
+		cacheInstance := cache.New(&cfg.Cache, log, bus)
+		defer cacheInstance.Stop()
+
+		r := router.NewV2(
+			database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+			cacheInstance,
+			proxy.New(5*time.Second, &cfg.Proxy, log),
+			cfg,
+			log,
+			auth.NewAuthService("test-secret", log),
+			nil,
+			circuitbreaker.New(log, testMetrics(), nil),
+			loadbalancer.New(loadbalancer.RoundRobin, bus),
+			websocket.NewHub(&cfg.WebSocket, log, nil),
+			bus,
+			drain.New(),
+		)
+		defer r.Shutdown()
+
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/admin/config", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		assertNoSecrets(t, w.Body.String())
+
+		var resp struct {
+			Data config.Config `json:"data"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode configuration: %v", err)
+		}
+		if resp.Data.Database.Password != "[REDACTED]" || resp.Data.Server.Port != cfg.Server.Port {
+			t.Errorf("Expected the effective configuration with secrets masked, got %+v", resp.Data.Database)
+		}
+	})
+}
+
+// secretValues returns the configured secrets by environment variable
+func secretValues(cfg *config.Config) map[string]string {
+	return map[string]string{
+		"DB_PASSWORD":               cfg.Database.Password,
+		"JWT_SECRET":                cfg.Auth.JWTSecret,
+		"PROXY_TLS_SEAL_KEY":        cfg.Proxy.TLSSealKey,
+		"LB_STICKY_KEY":             cfg.LoadBalancer.StickyKey,
+		"LB_DISCOVERY_CONSUL_TOKEN": cfg.LoadBalancer.Discovery.ConsulToken,
+		"METRICS_AUTH_TOKEN":        cfg.Gateway.MetricsAuthToken,
+		"AUTH_OIDC_CLIENT_SECRET":   cfg.Auth.OIDCClientSecret,
+	}
+}
+
+// assertNoSecrets fails if any secret value appears in body
+func assertNoSecrets(t *testing.T, body string) {
+	t.Helper()
+	for key, value := range secretEnv {
+		if strings.Contains(body, value) {
+			t.Errorf("Expected %s to be redacted, found it in %s", key, body)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/health"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestCriticalRouteReadiness tests readiness failing while a critical route
+// has no healthy backend and recovering with it, both for load-balanced
+// routes and routes guarded by their circuit breaker
+func TestCriticalRouteReadiness(t *testing.T) {
+	log := logger.Get()
+	m := testMetrics()
+	bus := events.NewBus()
+	var mu sync.Mutex
+	var transitions []events.Event
+	bus.Subscribe(func(event events.Event) {
+		if events.Match("critical_route.*", event.Type) {
+			mu.Lock()
+			transitions = append(transitions, event)
+			mu.Unlock()
+		}
+	})
+	taken := func() []events.Event {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := transitions
+		transitions = nil
+		return taken
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	t.Cleanup(cacheInstance.Stop)
+	cb := circuitbreaker.New(log, m, nil)
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	lb.AddBackend("http://10.0.0.1:8080")
+	lb.AddBackend("http://10.0.0.2:8080")
+	h := handlers.NewProxyHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		proxy.New(5*time.Second, &config.Load().Proxy, log), cacheInstance, cb, lb, nil, nil, m, log)
+	h.SetBus(bus)
+
+	balanced := egressRoute(1, "/orders", "http://orders", nil)
+	balanced.LoadBalanced, balanced.Critical = true, true
+	direct := egressRoute(2, "/payments", "http://payments:9000", nil)
+	direct.Critical = true
+	direct.Breaker = &circuitbreaker.Settings{MinRequests: 1, FailureRatio: 1, OpenTimeout: 1}
+	// Not critical, so its breaker opening doesn't matter
+	other := egressRoute(3, "/reports", "http://payments:9000", nil)
+	h.SetRoutes([]database.Route{balanced, direct, other}, time.Minute)
+
+	checker := health.New(0, time.Second)
+	checker.Register("critical_routes", h.CheckCriticalRoutes)
+	ready := handlers.NewHealthHandler(checker, checker).Ready
+	probe := func() (int, []handlers.CriticalRoute) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		ready(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+		var resp struct {
+			Data struct {
+				Checks  map[string]string `json:"checks"`
+				Details struct {
+					CriticalRoutes []handlers.CriticalRoute `json:"critical_routes"`
+				} `json:"details"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode the readiness response: %v", err)
+		}
+		return rec.Code, resp.Data.Details.CriticalRoutes
+	}
+
+	if code, down := probe(); code != http.StatusOK || len(down) != 0 {
+		t.Fatalf("Expected ready with every backend healthy, got %d %v", code, down)
+	}
+
+	// One backend down leaves the route a healthy one
+	lb.MarkHealthy("http://10.0.0.1:8080", false)
+	if code, _ := probe(); code != http.StatusOK {
+		t.Errorf("Expected ready with one backend left, got %d", code)
+	}
+
+	lb.MarkHealthy("http://10.0.0.2:8080", false)
+	code, down := probe()
+	if code != http.StatusServiceUnavailable || len(down) != 1 || down[0].ID != 1 || down[0].Healthy != 0 || down[0].Total != 2 {
+		t.Fatalf("Expected not ready listing the load-balanced route, got %d %+v", code, down)
+	}
+	if got := taken(); len(got) != 1 || got[0].Type != events.CriticalRouteUnhealthy {
+		t.Errorf("Expected one unhealthy transition, got %+v", got)
+	}
+	probe()
+	if got := taken(); len(got) != 0 {
+		t.Errorf("Expected no event while the route stays down, got %+v", got)
+	}
+
+	lb.MarkHealthy("http://10.0.0.2:8080", true)
+	if code, down := probe(); code != http.StatusOK || len(down) != 0 {
+		t.Errorf("Expected ready again once a backend recovers, got %d %v", code, down)
+	}
+	if got := taken(); len(got) != 1 || got[0].Type != events.CriticalRouteHealthy {
+		t.Errorf("Expected one healthy transition, got %+v", got)
+	}
+
+	// The direct route goes down with its breaker and comes back once it
+	// half-opens to probe the target
+	key := circuitbreaker.RouteKey(direct.ID, direct.Path, direct.TargetURL, direct.Breaker)
+	cb.ExecuteRoute(key, direct.Breaker, nil, func() (int, error) {
+		return 0, errors.New("connection refused")
+	})
+	code, down = probe()
+	if code != http.StatusServiceUnavailable || len(down) != 1 || down[0].ID != 2 || down[0].Total != 1 {
+		t.Fatalf("Expected not ready listing the route with an open breaker, got %d %+v", code, down)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if code, _ := probe(); code != http.StatusOK {
+		t.Errorf("Expected ready once the breaker half-opens, got %d", code)
+	}
+	if got := taken(); len(got) != 2 || got[0].Type != events.CriticalRouteUnhealthy || got[1].Type != events.CriticalRouteHealthy {
+		t.Errorf("Expected the direct route to go down and back up, got %+v", got)
+	}
+
+	// Disabled critical routes don't hold readiness
+	lb.MarkHealthy("http://10.0.0.2:8080", false)
+	balanced.Enabled = false
+	h.SetRoutes([]database.Route{balanced, direct, other}, time.Minute)
+	if err := h.CheckCriticalRoutes(context.Background()); err != nil {
+		t.Errorf("Expected a disabled route ignored, got %v", err)
+	}
+}
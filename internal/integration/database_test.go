@@ -0,0 +1,133 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/health"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// closedDatabaseConfig returns a database config pointing at a port nothing listens on
+func closedDatabaseConfig(t *testing.T) *config.DatabaseConfig {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	cfg := config.Load().Database
+	cfg.Host = "127.0.0.1"
+	cfg.Port = port
+	cfg.ConnectRetries = 2
+	cfg.ConnectBackoff = 20 * time.Millisecond
+	return &cfg
+}
+
+// TestDatabaseConnectRetries tests that startup retries with backoff before failing
+func TestDatabaseConnectRetries(t *testing.T) {
+	cfg := closedDatabaseConfig(t)
+
+	start := time.Now()
+	_, err := database.New(cfg, logger.Get(), nil)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("Expected connection to a closed port to fail")
+	}
+	if !database.IsUnavailable(err) {
+		t.Errorf("Expected an unavailable error, got %v", err)
+	}
+
+	// Two retries wait roughly 20ms and 40ms, each within 10% jitter
+	if elapsed < 54*time.Millisecond {
+		t.Errorf("Expected retries to back off, finished after %s", elapsed)
+	}
+}
+
+// TestDatabaseOptional tests the gateway's behaviour while the database is down
+func TestDatabaseOptional(t *testing.T) {
+	log := logger.Get()
+	db := database.NewDisconnected(closedDatabaseConfig(t), log, nil)
+	defer db.Close()
+
+	t.Run("Repositories", func(t *testing.T) {
+		_, err := database.NewRouteRepository(db).FindAll(context.Background())
+		if !errors.Is(err, database.ErrUnavailable) {
+			t.Errorf("Expected ErrUnavailable, got %v", err)
+		}
+
+		err = db.WithTx(context.Background(), func(tx pgx.Tx) error { return nil })
+		if !errors.Is(err, database.ErrUnavailable) {
+			t.Errorf("Expected ErrUnavailable from transaction, got %v", err)
+		}
+	})
+
+	t.Run("NotReady", func(t *testing.T) {
+		checker := health.New(0, time.Second)
+		checker.Register("database", db.Health)
+
+		if report := checker.Check(context.Background()); report.OK() {
+			t.Errorf("Expected readiness to fail, got %+v", report)
+		}
+	})
+
+	t.Run("RouteLookup", func(t *testing.T) {
+		cacheInstance := cache.New(&config.Load().Cache, log, nil)
+		defer cacheInstance.Stop()
+
+		proxyHandler := handlers.NewProxyHandler(
+			db,
+			proxy.New(5*time.Second, &config.Load().Proxy, log),
+			cacheInstance,
+			circuitbreaker.New(log, testMetrics(), nil),
+			loadbalancer.New(loadbalancer.RoundRobin, nil),
+			nil,
+			nil,
+			testMetrics(),
+			log,
+		)
+
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", "/api/users", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503, got %d", w.Code)
+		}
+	})
+
+	t.Run("BackgroundConnect", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		done := make(chan struct{})
+		go func() {
+			db.ConnectInBackground(ctx)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Background connect did not stop when its context ended")
+		}
+		if db.Connected() {
+			t.Error("Expected database to remain disconnected")
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/chaos"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/deadline"
+	"github.com/zakirkun/isekai/pkg/config"
+)
+
+// deadlineRoute returns an enabled proxied route with a timeout in seconds,
+// trusting the client's deadline up to trustMax milliseconds
+func deadlineRoute(id int, path, target string, timeout, trustMax int) database.Route {
+	route := egressRoute(id, path, target, nil)
+	route.Timeout = timeout
+	route.TrustDeadlineMax = trustMax
+	return route
+}
+
+// headerMillis parses a deadline header the test saw
+func headerMillis(t *testing.T, value string) int {
+	t.Helper()
+	ms, err := strconv.Atoi(value)
+	if err != nil {
+		t.Fatalf("Expected a deadline in milliseconds, got %q", value)
+	}
+	return ms
+}
+
+// TestDeadlineChain tests the budget shrinking across two gateway hops, the
+// second trusting the first's header
+func TestDeadlineChain(t *testing.T) {
+	var upstreamSaw atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamSaw.Store(r.Header.Get("X-Deadline-Ms"))
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Load().Proxy
+	inner := egressHandler(t, cfg, testMetrics(), nil, deadlineRoute(1, "/chain", upstream.URL, 30, 60000))
+	inner.SetDeadline(cfg.DeadlineHeader, cfg.DeadlineGRPC, cfg.DeadlineFloor)
+
+	// The inner gateway holds requests a while, so it has less left to send
+	// on than the outer one gave it
+	faults := chaos.NewRegistry()
+	faults.Set(1, chaos.Fault{DelayPercent: 100, Delay: 50})
+	inner.SetChaos(faults)
+
+	var innerSaw atomic.Value
+	innerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		innerSaw.Store(r.Header.Get("X-Deadline-Ms"))
+		inner.Handle(w, r)
+	}))
+	defer innerServer.Close()
+
+	outer := egressHandler(t, cfg, testMetrics(), nil, deadlineRoute(1, "/chain", innerServer.URL+"/chain", 2, 0))
+	outer.SetDeadline(cfg.DeadlineHeader, cfg.DeadlineGRPC, cfg.DeadlineFloor)
+
+	req := httptest.NewRequest(http.MethodGet, "/chain", nil)
+	req.Header.Set("X-Deadline-Ms", "60000")
+	rec := httptest.NewRecorder()
+	outer.Handle(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the chain to answer, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	first := headerMillis(t, innerSaw.Load().(string))
+	if first > 2000 || first < 1500 {
+		t.Errorf("Expected the outer gateway to send its route's 2s timeout, not the client's, got %dms", first)
+	}
+	second := headerMillis(t, upstreamSaw.Load().(string))
+	if second > first-50 || second <= 0 {
+		t.Errorf("Expected the inner gateway to send less than %dms minus its delay, got %dms", first, second)
+	}
+}
+
+// TestDeadlineTrust tests client deadlines stripped by routes not trusting
+// them, capped by routes trusting them, grpc-timeout set on gRPC requests
+// and requests below the floor refused
+func TestDeadlineTrust(t *testing.T) {
+	var hits atomic.Int32
+	var saw atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		saw.Store(r.Header.Clone())
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Load().Proxy
+	m := testMetrics()
+	h := egressHandler(t, cfg, m, nil,
+		deadlineRoute(1, "/plain", upstream.URL, 0, 0),
+		deadlineRoute(2, "/trusted", upstream.URL, 0, 1000),
+	)
+	h.SetDeadline(cfg.DeadlineHeader, cfg.DeadlineGRPC, 200*time.Millisecond)
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		h.Handle(rec, req)
+		return rec
+	}
+	seen := func() http.Header { return saw.Load().(http.Header) }
+
+	// The proxy's own 5s timeout applies, not the client's 300ms
+	if rec := get("/plain", http.Header{"X-Deadline-Ms": {"300"}}); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the untrusted deadline ignored, got %d", rec.Code)
+	}
+	if ms := headerMillis(t, seen().Get("X-Deadline-Ms")); ms <= 4000 || ms > 5000 {
+		t.Errorf("Expected the proxy timeout sent in place of the client's, got %dms", ms)
+	}
+
+	if rec := get("/trusted", http.Header{"X-Deadline-Ms": {"999999"}}); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the trusted deadline honored, got %d", rec.Code)
+	}
+	if ms := headerMillis(t, seen().Get("X-Deadline-Ms")); ms <= 500 || ms > 1000 {
+		t.Errorf("Expected the client's deadline capped at 1000ms, got %dms", ms)
+	}
+
+	grpc := http.Header{"Content-Type": {"application/grpc"}, "Grpc-Timeout": {"700m"}}
+	if rec := get("/trusted", grpc); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the gRPC request forwarded, got %d", rec.Code)
+	}
+	timeout, ok := deadline.ParseGRPC(seen().Get("Grpc-Timeout"))
+	if !ok || timeout <= 500*time.Millisecond || timeout > 700*time.Millisecond {
+		t.Errorf("Expected grpc-timeout below the client's 700ms, got %q", seen().Get("Grpc-Timeout"))
+	}
+	if ms := headerMillis(t, seen().Get("X-Deadline-Ms")); ms > 700 {
+		t.Errorf("Expected the deadline header to match grpc-timeout, got %dms", ms)
+	}
+
+	before := hits.Load()
+	rec := get("/trusted", http.Header{"X-Deadline-Ms": {"100"}})
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected 504 below the floor, got %d", rec.Code)
+	}
+	if hits.Load() != before {
+		t.Errorf("Expected the doomed request not forwarded")
+	}
+	if got := testutil.ToFloat64(m.DeadlineRejected.WithLabelValues("/trusted")); got != 1 {
+		t.Errorf("Expected one rejection counted, got %v", got)
+	}
+}
+
+// TestDeadlineFormat tests grpc-timeout values round tripping in the finest
+// unit that fits
+func TestDeadlineFormat(t *testing.T) {
+	cases := map[time.Duration]string{
+		0:                       "0n",
+		1500 * time.Millisecond: "1500000u",
+		2 * time.Minute:         "120000m",
+		200 * time.Hour:         "720000S",
+	}
+	for d, want := range cases {
+		if got := deadline.FormatGRPC(d); got != want {
+			t.Errorf("Expected %v formatted as %q, got %q", d, want, got)
+		}
+	}
+	for _, value := range []string{"", "5", "123456789S", "-1m", "10x"} {
+		if _, ok := deadline.ParseGRPC(value); ok {
+			t.Errorf("Expected %q refused", value)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/matcher"
+	"github.com/zakirkun/isekai/internal/rewrite"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestExplainMatch tests the reasons given for the route picked for a
+// request and for the routes passed over
+func TestExplainMatch(t *testing.T) {
+	m := matcher.New([]database.Route{
+		{ID: 1, Path: "/api", Method: "GET", Host: "api.example.com", Enabled: true},
+		{ID: 2, Path: "/api", Method: "GET", Host: "*.example.com", Enabled: true},
+		{ID: 3, Path: "/api", Method: "GET", Enabled: true},
+		{ID: 4, Path: "/api", Method: "POST", Host: "api.example.com", Enabled: false},
+		{ID: 5, Path: "/api", Method: "*", Host: "api.example.com", Enabled: true},
+		{ID: 6, Path: "/other", Method: "GET", Enabled: true},
+	})
+
+	tests := []struct {
+		name, method, host, path string
+		status, id               int
+		reasons                  map[int]string
+	}{
+		{
+			name: "ExactBeatsWildcard", method: "GET", host: "api.example.com", path: "/api",
+			status: http.StatusOK, id: 1,
+			reasons: map[int]string{
+				1: "matched: exact path, exact host, exact method",
+				2: `host "api.example.com" is matched more specifically by "api.example.com"`,
+				3: `host "api.example.com" is matched more specifically by "api.example.com"`,
+				4: "route is disabled",
+				5: "method GET is matched more specifically by route 1 (GET)",
+			},
+		},
+		{
+			name: "Wildcard", method: "GET", host: "www.example.com", path: "/api",
+			status: http.StatusOK, id: 2,
+			reasons: map[int]string{
+				1: `host "api.example.com" does not match "www.example.com"`,
+				2: "matched: exact path, wildcard host, exact method",
+				3: `host "www.example.com" is matched more specifically by "*.example.com"`,
+			},
+		},
+		{
+			name: "DisabledSkipped", method: "POST", host: "api.example.com", path: "/api",
+			status: http.StatusOK, id: 5,
+			reasons: map[int]string{
+				1: "method GET does not match POST",
+				4: "route is disabled",
+				5: "matched: exact path, exact host, any method",
+			},
+		},
+		{
+			name: "HeadServedByGet", method: "HEAD", host: "", path: "/api",
+			status: http.StatusOK, id: 3,
+			reasons: map[int]string{
+				1: `host "api.example.com" does not match ""`,
+				3: "matched: exact path, any host, GET serving HEAD method",
+			},
+		},
+		{
+			name: "MethodNotAllowed", method: "POST", host: "other.org", path: "/api",
+			status: http.StatusMethodNotAllowed,
+			reasons: map[int]string{
+				3: "method GET does not match POST",
+				4: "route is disabled",
+			},
+		},
+		{name: "NotFound", method: "GET", host: "", path: "/missing", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			explanation := m.Explain(tt.method, tt.host, tt.path)
+			if explanation.Status != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, explanation.Status)
+			}
+			switch {
+			case tt.id == 0 && explanation.Route != nil:
+				t.Errorf("Expected no route, got %d", explanation.Route.ID)
+			case tt.id != 0 && (explanation.Route == nil || explanation.Route.ID != tt.id):
+				t.Errorf("Expected route %d, got %+v", tt.id, explanation.Route)
+			}
+
+			matched := 0
+			for _, candidate := range explanation.Candidates {
+				if candidate.Path != tt.path {
+					t.Errorf("Unexpected candidate %d for another path", candidate.ID)
+				}
+				if candidate.Matched {
+					matched++
+					if candidate.ID != tt.id {
+						t.Errorf("Expected route %d marked matched, got %d", tt.id, candidate.ID)
+					}
+				}
+				if want, ok := tt.reasons[candidate.ID]; ok && candidate.Reason != want {
+					t.Errorf("Expected route %d reason %q, got %q", candidate.ID, want, candidate.Reason)
+				}
+			}
+			if want := min(tt.id, 1); matched != want {
+				t.Errorf("Expected %d matched candidates, got %d", want, matched)
+			}
+		})
+	}
+
+	t.Run("Allowed", func(t *testing.T) {
+		explanation := m.Explain("POST", "other.org", "/api")
+		if !slices.Equal(explanation.Allowed, []string{"GET", "HEAD"}) {
+			t.Errorf("Expected GET and HEAD allowed, got %v", explanation.Allowed)
+		}
+	})
+}
+
+// TestRouteTable tests the match types listed for each route, disabled
+// routes included
+func TestRouteTable(t *testing.T) {
+	m := matcher.New([]database.Route{
+		{ID: 3, Path: "/b", Method: "*", Host: "*.example.com", Enabled: true, Type: database.RouteTypeMock},
+		{ID: 1, Path: "/a", Method: "GET", Host: "API.example.com", Enabled: false},
+		{ID: 2, Path: "/a", Method: "POST", Enabled: true},
+	})
+
+	table := m.Table()
+	want := []matcher.Entry{
+		{ID: 2, Method: "POST", Path: "/a", Enabled: true, Type: database.RouteTypeProxy, PathMatch: matcher.MatchExact, HostMatch: matcher.MatchAny, MethodMatch: matcher.MatchExact},
+		{ID: 1, Method: "GET", Host: "api.example.com", Path: "/a", Type: database.RouteTypeProxy, PathMatch: matcher.MatchExact, HostMatch: matcher.MatchExact, MethodMatch: matcher.MatchExact},
+		{ID: 3, Method: "*", Host: "*.example.com", Path: "/b", Enabled: true, Type: database.RouteTypeMock, PathMatch: matcher.MatchExact, HostMatch: matcher.MatchWildcard, MethodMatch: matcher.MatchAny},
+	}
+	if !slices.Equal(table, want) {
+		t.Errorf("Expected table %+v, got %+v", want, table)
+	}
+}
+
+// TestDebugMatchValidation tests that a match request without a usable path
+// is refused before routes are loaded
+func TestDebugMatchValidation(t *testing.T) {
+	handler := testRouter(t, nil, func(cfg *config.Config) {})
+
+	for _, query := range []string{"", "?path=relative", "?path=%2F%2F%zz"} {
+		w := adminUIGet(handler, "/api/debug/match"+query, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", query, w.Code)
+		}
+	}
+
+	// A valid request reaches the database, which is down here
+	w := adminUIGet(handler, "/api/debug/match?path=/orders", nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a database, got %d", w.Code)
+	}
+}
+
+// TestDebugMatch tests explaining a match against stored routes, without
+// forwarding anything to the upstream
+func TestDebugMatch(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer upstream.Close()
+
+	routes := database.NewRouteRepository(db)
+	path := fmt.Sprintf("/debug-%d", time.Now().UnixNano())
+	exact := &database.Route{Path: path, TargetURL: upstream.URL + "/v1", Method: "GET", Host: "api.example.com", Enabled: true, Timeout: 30,
+		Type: database.RouteTypeRewrite, Rewrite: &rewrite.Rule{Prefix: path, Replacement: "/v2"}}
+	wildcard := &database.Route{Path: path, TargetURL: upstream.URL, Method: "GET", Host: "*.example.com", Enabled: true, Timeout: 30}
+	disabled := &database.Route{Path: path, TargetURL: upstream.URL, Method: "POST", Enabled: false, Timeout: 30}
+	for _, route := range []*database.Route{exact, wildcard, disabled} {
+		if err := routes.Create(ctx, route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		defer routes.Delete(ctx, route.ID)
+	}
+
+	// A gateway in front of the proxy, like the router's
+	gateway := chi.NewRouter()
+	debugHandler := handlers.NewDebugHandler(db, gateway, logger.Get())
+	gateway.Route("/api", func(api chi.Router) {
+		api.Get("/debug/match", debugHandler.Match)
+		api.Get("/debug/routes", debugHandler.Routes)
+	})
+	gateway.HandleFunc("/*", func(w http.ResponseWriter, r *http.Request) {})
+
+	match := func(t *testing.T, method, host, path string) *handlers.MatchResult {
+		t.Helper()
+		query := url.Values{"method": {method}, "host": {host}, "path": {path}}
+		w := adminUIGet(gateway, "/api/debug/match?"+query.Encode(), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var body struct {
+			Data handlers.MatchResult `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return &body.Data
+	}
+
+	t.Run("Exact", func(t *testing.T) {
+		result := match(t, "GET", "api.example.com", path+"/orders?id=1")
+		if result.Route != nil {
+			t.Fatalf("Expected no route for a longer path, got %d", result.Route.ID)
+		}
+
+		result = match(t, "GET", "api.example.com", path+"?id=1")
+		if result.Route == nil || result.Route.ID != exact.ID {
+			t.Fatalf("Expected route %d, got %+v", exact.ID, result.Route)
+		}
+		if result.GatewayEndpoint != "" {
+			t.Errorf("Expected a proxied path, got gateway endpoint %q", result.GatewayEndpoint)
+		}
+		if want := upstream.URL + "/v1/v2?id=1"; result.Effective == nil || result.Effective.Target != want {
+			t.Errorf("Expected target %q, got %+v", want, result.Effective)
+		}
+		if want := upstream.Listener.Addr().String(); result.Effective.UpstreamHost != want {
+			t.Errorf("Expected upstream host %q, got %q", want, result.Effective.UpstreamHost)
+		}
+		if len(result.Candidates) != 3 {
+			t.Errorf("Expected 3 candidates, got %+v", result.Candidates)
+		}
+	})
+
+	t.Run("DisabledSkipped", func(t *testing.T) {
+		result := match(t, "POST", "other.org", path)
+		if result.Route != nil || result.Status != http.StatusNotFound {
+			t.Errorf("Expected no route, got %+v with status %d", result.Route, result.Status)
+		}
+		for _, candidate := range result.Candidates {
+			if candidate.ID == disabled.ID && candidate.Reason != "route is disabled" {
+				t.Errorf("Expected the disabled route skipped, got %q", candidate.Reason)
+			}
+		}
+	})
+
+	t.Run("GatewayEndpoint", func(t *testing.T) {
+		for path, want := range map[string]string{
+			"/api/debug/routes": "/api/debug/routes",
+			"/api/unknown":      "/api/*",
+			"/orders":           "",
+		} {
+			if result := match(t, "GET", "", path); result.GatewayEndpoint != want {
+				t.Errorf("Expected gateway endpoint %q for %s, got %q", want, path, result.GatewayEndpoint)
+			}
+		}
+	})
+
+	t.Run("Routes", func(t *testing.T) {
+		w := adminUIGet(gateway, "/api/debug/routes", nil)
+		var body struct {
+			Data handlers.RouteTable `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(body.Data.Gateway) != 2 || body.Data.Gateway[0].Pattern != "/api/debug/match" {
+			t.Errorf("Unexpected gateway endpoints %+v", body.Data.Gateway)
+		}
+		found := 0
+		for _, entry := range body.Data.Routes {
+			if entry.Path == path {
+				found++
+			}
+		}
+		if found != 3 {
+			t.Errorf("Expected 3 routes for %s, got %d", path, found)
+		}
+	})
+
+	if n := hits.Load(); n != 0 {
+		t.Errorf("Expected nothing forwarded, upstream got %d requests", n)
+	}
+}
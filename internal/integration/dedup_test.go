@@ -0,0 +1,311 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/dedup"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// dedupHandler guards upstream with the store the way the proxy handler does
+func dedupHandler(store *dedup.Store, cfg *dedup.Config, upstream http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := store.EventID(r, cfg)
+		if !ok {
+			upstream(w, r)
+			return
+		}
+
+		key := dedup.Key(1, id)
+		duplicate, stored, err := store.Acquire(r.Context(), key)
+		switch {
+		case err != nil:
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		case duplicate && stored != nil:
+			stored.Replay(w, dedup.DuplicateHeader)
+			return
+		case duplicate:
+			w.Header().Set(dedup.DuplicateHeader, "true")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		rec := store.Recorder(w)
+		defer store.Release(key, cfg, rec)
+		upstream(rec, r)
+	}
+}
+
+// TestDedupStore tests repeated and distinct deliveries, concurrent
+// redeliveries, failed deliveries and the window
+func TestDedupStore(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	var hits atomic.Int64
+	var gate chan struct{}
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		if gate != nil {
+			<-gate
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Order", fmt.Sprint(n))
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "processed %s", body)
+	}
+	send := func(handler http.HandlerFunc, header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/webhooks", strings.NewReader(body))
+		if header != "" {
+			req.Header.Set("X-Event-ID", header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	reset := func() {
+		hits.Store(0)
+		gate = nil
+	}
+
+	byHeader := &dedup.Config{Header: "X-Event-ID", Window: 60}
+	handler := dedupHandler(dedup.New(cacheInstance, 64), byHeader, upstream)
+
+	t.Run("RepeatedDelivery", func(t *testing.T) {
+		reset()
+		first := send(handler, "evt-1", "a")
+		second := send(handler, "evt-1", "a")
+		if hits.Load() != 1 {
+			t.Fatalf("Expected the upstream to be called once, got %d", hits.Load())
+		}
+		if second.Code != http.StatusAccepted || second.Body.String() != "processed a" || second.Header().Get("X-Order") != "1" {
+			t.Errorf("Expected the first response replayed, got %d %q %v", second.Code, second.Body.String(), second.Header())
+		}
+		if first.Header().Get(dedup.DuplicateHeader) != "" || second.Header().Get(dedup.DuplicateHeader) != "true" {
+			t.Error("Expected only the duplicate to be marked")
+		}
+	})
+
+	t.Run("DistinctEvents", func(t *testing.T) {
+		reset()
+		for i := 0; i < 3; i++ {
+			if w := send(handler, fmt.Sprintf("distinct-%d", i), "b"); w.Header().Get(dedup.DuplicateHeader) != "" {
+				t.Errorf("Expected event %d passed through", i)
+			}
+		}
+		send(handler, "", "b")
+		send(handler, "", "b")
+		if hits.Load() != 5 {
+			t.Errorf("Expected distinct events and deliveries without an ID to reach the upstream, got %d calls", hits.Load())
+		}
+	})
+
+	t.Run("ConcurrentRedelivery", func(t *testing.T) {
+		reset()
+		gate = make(chan struct{})
+
+		var wg sync.WaitGroup
+		results := make([]*httptest.ResponseRecorder, 5)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = send(handler, "concurrent", "c")
+			}(i)
+		}
+
+		waitFor(t, func() bool { return hits.Load() == 1 })
+		time.Sleep(50 * time.Millisecond)
+		close(gate)
+		wg.Wait()
+
+		if hits.Load() != 1 {
+			t.Fatalf("Expected simultaneous deliveries to reach the upstream once, got %d", hits.Load())
+		}
+		for _, w := range results {
+			if w.Code != http.StatusAccepted || w.Body.String() != "processed c" {
+				t.Errorf("Expected every delivery to get the response, got %d %q", w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("BodyPath", func(t *testing.T) {
+		reset()
+		byBody := dedupHandler(dedup.New(cacheInstance, 64), &dedup.Config{BodyPath: "data.id", Window: 60}, upstream)
+		first := send(byBody, "", `{"data":{"id":42}}`)
+		second := send(byBody, "", `{"data": {"id": 42}, "attempt": 2}`)
+		send(byBody, "", `{"data":{"id":"43"}}`)
+		if hits.Load() != 2 {
+			t.Errorf("Expected one upstream call per event, got %d", hits.Load())
+		}
+		if first.Body.String() != `processed {"data":{"id":42}}` || second.Header().Get(dedup.DuplicateHeader) != "true" {
+			t.Errorf("Expected the body forwarded and the redelivery replayed, got %q and %v", first.Body.String(), second.Header())
+		}
+
+		// Bodies over the cap, not JSON or without the ID are forwarded whole
+		large := `{"data":{"id":1},"pad":"` + strings.Repeat("x", 100) + `"}`
+		for _, body := range []string{large, large, "not json", "not json", `{"data":{}}`, `{"data":{}}`} {
+			if w := send(byBody, "", body); w.Body.String() != "processed "+body {
+				t.Fatalf("Expected the full body forwarded, got %q", w.Body.String())
+			}
+		}
+		if hits.Load() != 8 {
+			t.Errorf("Expected deliveries without an ID to bypass the store, got %d calls", hits.Load())
+		}
+	})
+
+	t.Run("FixedOK", func(t *testing.T) {
+		reset()
+		fixed := dedupHandler(dedup.New(cacheInstance, 64), &dedup.Config{Header: "X-Event-ID", Window: 60, OnDuplicate: dedup.OnDuplicateOK}, upstream)
+		send(fixed, "fixed", "d")
+		w := send(fixed, "fixed", "d")
+		if hits.Load() != 1 || w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Errorf("Expected a fixed 200 for the duplicate, got %d %q after %d calls", w.Code, w.Body.String(), hits.Load())
+		}
+	})
+
+	t.Run("FailedDeliveryForgotten", func(t *testing.T) {
+		failing := dedupHandler(dedup.New(cacheInstance, 64), byHeader, func(w http.ResponseWriter, r *http.Request) {
+			if hits.Add(1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		})
+
+		reset()
+		for i := 0; i < 3; i++ {
+			send(failing, "retry-after-error", "e")
+		}
+		if hits.Load() != 2 {
+			t.Errorf("Expected the redelivery after a 5xx to reach the upstream, got %d calls", hits.Load())
+		}
+	})
+
+	t.Run("Window", func(t *testing.T) {
+		reset()
+		store := dedup.New(cacheInstance, 64)
+		cfg := &dedup.Config{Header: "X-Event-ID", Window: 1}
+		expiring := dedupHandler(store, cfg, upstream)
+		send(expiring, "window", "f")
+		send(expiring, "window", "f")
+		time.Sleep(1100 * time.Millisecond)
+		send(expiring, "window", "f")
+		if hits.Load() != 2 {
+			t.Errorf("Expected the event to be forgotten after its window, got %d calls", hits.Load())
+		}
+	})
+}
+
+// TestDedupValidation tests route dedup configs
+func TestDedupValidation(t *testing.T) {
+	for _, tt := range []struct {
+		cfg   dedup.Config
+		valid bool
+	}{
+		{dedup.Config{Header: "X-Event-ID", Window: 60}, true},
+		{dedup.Config{BodyPath: "data.id", Window: dedup.MaxWindow, OnDuplicate: dedup.OnDuplicateOK}, true},
+		{dedup.Config{Window: 60}, false},
+		{dedup.Config{Header: "X-Event-ID", BodyPath: "id", Window: 60}, false},
+		{dedup.Config{BodyPath: "data..id", Window: 60}, false},
+		{dedup.Config{Header: "X-Event-ID"}, false},
+		{dedup.Config{Header: "X-Event-ID", Window: dedup.MaxWindow + 1}, false},
+		{dedup.Config{Header: "X-Event-ID", Window: 60, OnDuplicate: "drop"}, false},
+	} {
+		if err := tt.cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v, expected valid %v", tt.cfg, err, tt.valid)
+		}
+	}
+
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+	w := httptest.NewRecorder()
+	routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(`{"path":"/hooks","target_url":"http://api/hooks","dedup":{"window":60}}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "dedup") {
+		t.Errorf("Expected a dedup config without an ID source refused, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// TestRouteDedup tests duplicate webhook deliveries through the proxy handler
+func TestRouteDedup(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "delivery %d", hits.Add(1))
+	}))
+	defer upstream.Close()
+
+	repo := database.NewRouteRepository(db)
+	path := fmt.Sprintf("/dedup-%d", time.Now().UnixNano())
+	route := &database.Route{
+		Path:      path,
+		TargetURL: upstream.URL,
+		Method:    "*",
+		Enabled:   true,
+		Timeout:   30,
+		Dedup:     &dedup.Config{BodyPath: "event.id", Window: 60},
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	proxyHandler.SetDedup(dedup.New(cacheInstance, 1<<20))
+
+	deliver := func(method, id string) string {
+		req := httptest.NewRequest(method, path, strings.NewReader(fmt.Sprintf(`{"event":{"id":%q}}`, id)))
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, req)
+		return w.Body.String()
+	}
+
+	event := fmt.Sprintf("evt-%d", time.Now().UnixNano())
+	first, second, third := deliver("POST", event), deliver("PUT", event), deliver("POST", event+"-other")
+	if first != second || first == third || hits.Load() != 2 {
+		t.Errorf("Expected only the redelivery answered by the gateway, got %q, %q and %q after %d calls", first, second, third, hits.Load())
+	}
+	if got := testutil.ToFloat64(m.DedupRequests.WithLabelValues(path, dedup.ResultDuplicate)); got != 1 {
+		t.Errorf("Expected one duplicate counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.DedupRequests.WithLabelValues(path, dedup.ResultFirst)); got != 2 {
+		t.Errorf("Expected two first deliveries counted, got %v", got)
+	}
+}
@@ -0,0 +1,219 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sony/gobreaker"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// slowBody is a backend that sends a 64 KiB chunk, then another every 20ms
+// until its request is cancelled, which it reports on cancelled
+func slowBody(cancelled chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("s"), 64<<10)
+		rc := http.NewResponseController(w)
+		for {
+			w.Write(chunk)
+			rc.Flush()
+			select {
+			case <-time.After(20 * time.Millisecond):
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+				return
+			}
+		}
+	}
+}
+
+// slowHeaders is a backend that doesn't answer until its request is
+// cancelled, which it reports on cancelled
+func slowHeaders(cancelled chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(10 * time.Second):
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		}
+	}
+}
+
+// waitCancelled waits for a backend to report its request cancelled
+func waitCancelled(t *testing.T, cancelled <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the backend request to be cancelled")
+	}
+}
+
+// TestClientDisconnect tests that a client going away cancels the upstream
+// request and is recorded as a 499 rather than an upstream failure
+func TestClientDisconnect(t *testing.T) {
+	log := logger.Get()
+	p := proxy.New(30*time.Second, &config.Load().Proxy, log)
+	cb := circuitbreaker.New(log, testMetrics(), nil)
+
+	cancelled := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/body", slowBody(cancelled))
+	mux.Handle("/headers", slowHeaders(cancelled))
+	backend := httptest.NewServer(mux)
+	defer backend.Close()
+
+	type outcome struct {
+		status int
+		err    error
+	}
+	outcomes := make(chan outcome, 1)
+	gateway := httptest.NewServer(middleware.Recovery(log, nil, nil)(middleware.Timeout(30 * time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, err := cb.Execute(backend.URL, func() (interface{}, error) {
+			return p.ForwardAndCopy(r.Context(), w, r, backend.URL+r.URL.Path)
+		})
+		status, _ := result.(int)
+		var upstreamErr *proxy.UpstreamError
+		if errors.As(err, &upstreamErr) {
+			status = upstreamErr.Status
+		}
+		outcomes <- outcome{status, err}
+	}))))
+	defer gateway.Close()
+
+	assertClientClosed := func(t *testing.T) {
+		t.Helper()
+		select {
+		case got := <-outcomes:
+			if got.status != proxy.StatusClientClosed || !errors.Is(got.err, proxy.ErrClientClosed) {
+				t.Errorf("Expected a 499 client closed request, got %d (%v)", got.status, got.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the forward to return")
+		}
+	}
+
+	t.Run("DuringResponse", func(t *testing.T) {
+		resp, err := http.Get(gateway.URL + "/body")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if n, _ := io.ReadFull(resp.Body, make([]byte, 64<<10)); n != 64<<10 {
+			t.Fatalf("Expected the first chunk, got %d bytes", n)
+		}
+		resp.Body.Close()
+
+		waitCancelled(t, cancelled)
+		assertClientClosed(t)
+	})
+
+	t.Run("BeforeResponse", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", gateway.URL+"/headers", nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			t.Fatalf("Expected the client to give up, got %d", resp.StatusCode)
+		}
+
+		waitCancelled(t, cancelled)
+		assertClientClosed(t)
+	})
+
+	t.Run("CircuitBreaker", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			req, _ := http.NewRequestWithContext(ctx, "GET", gateway.URL+"/headers", nil)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+			cancel()
+			waitCancelled(t, cancelled)
+			assertClientClosed(t)
+		}
+		if state := cb.GetState(backend.URL); state != gobreaker.StateClosed {
+			t.Errorf("Expected disconnects not to trip the circuit breaker, got %s", state)
+		}
+	})
+}
+
+// TestClientDisconnectLogged tests that the proxy handler logs a client
+// disconnect as 499 and counts it apart from upstream errors
+func TestClientDisconnectLogged(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+	repo := database.NewRouteRepository(db)
+	logRepo := database.NewRequestLogRepository(db)
+
+	cancelled := make(chan struct{}, 1)
+	backend := httptest.NewServer(slowBody(cancelled))
+	defer backend.Close()
+
+	route := &database.Route{
+		Path:      fmt.Sprintf("/disconnect-%d", time.Now().UnixNano()),
+		TargetURL: backend.URL,
+		Method:    "GET",
+		Enabled:   true,
+		Timeout:   30,
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(30*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	gateway := httptest.NewServer(middleware.Recovery(log, nil, nil)(http.HandlerFunc(proxyHandler.Handle)))
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + route.Path)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	io.ReadFull(resp.Body, make([]byte, 64<<10))
+	resp.Body.Close()
+	waitCancelled(t, cancelled)
+
+	var logs []database.RequestLog
+	waitFor(t, func() bool {
+		logs, _ = logRepo.FindByRouteID(context.Background(), route.ID, 1)
+		return len(logs) == 1
+	})
+	if logs[0].StatusCode != proxy.StatusClientClosed {
+		t.Errorf("Expected the request to be logged as 499, got %d", logs[0].StatusCode)
+	}
+	if got := testutil.ToFloat64(m.ProxyErrors.WithLabelValues(backend.URL, "client_closed")); got != 1 {
+		t.Errorf("Expected the disconnect to be counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.ProxyErrors.WithLabelValues(backend.URL, "upstream")); got != 0 {
+		t.Errorf("Expected no upstream errors, got %v", got)
+	}
+}
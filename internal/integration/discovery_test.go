@@ -0,0 +1,400 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/discovery"
+	"github.com/zakirkun/isekai/internal/drain"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/router"
+	"github.com/zakirkun/isekai/internal/schedule"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// fakeConsul serves /v1/health/service/orders from a settable body
+type fakeConsul struct {
+	*httptest.Server
+	mu     sync.Mutex
+	status int
+	body   string
+	token  string
+}
+
+func newFakeConsul(t *testing.T) *fakeConsul {
+	fc := &fakeConsul{status: http.StatusOK, body: "[]"}
+	fc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+
+		fc.token = r.Header.Get("X-Consul-Token")
+		if r.URL.Path != "/v1/health/service/orders" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(fc.status)
+		w.Write([]byte(fc.body))
+	}))
+	t.Cleanup(fc.Close)
+	return fc
+}
+
+func (fc *fakeConsul) respond(status int, body string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.status, fc.body = status, body
+}
+
+// consulInstance is an entry of a Consul health response with the given check statuses
+func consulInstance(node, address string, port int, checks ...string) map[string]interface{} {
+	entry := map[string]interface{}{
+		"Node":    map[string]interface{}{"Address": node},
+		"Service": map[string]interface{}{"Address": address, "Port": port},
+	}
+	list := make([]map[string]string, 0, len(checks))
+	for _, status := range checks {
+		list = append(list, map[string]string{"Status": status})
+	}
+	entry["Checks"] = list
+	return entry
+}
+
+func consulBody(t *testing.T, entries ...map[string]interface{}) string {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("Failed to encode consul response: %v", err)
+	}
+	return string(body)
+}
+
+// fakeResolver answers SRV lookups with settable records
+type fakeResolver struct {
+	mu      sync.Mutex
+	records []*net.SRV
+	err     error
+	names   []string
+}
+
+func (f *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.names = append(f.names, name)
+	return name, f.records, f.err
+}
+
+func (f *fakeResolver) set(records []*net.SRV, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records, f.err = records, err
+}
+
+// sortedBackends returns the load balancer's backend URLs in order
+func sortedBackends(lb *loadbalancer.LoadBalancer) string {
+	urls := lb.Backends()
+	sort.Strings(urls)
+	return strings.Join(urls, ",")
+}
+
+// TestConsulDiscovery tests syncing backends from the Consul health API
+func TestConsulDiscovery(t *testing.T) {
+	fc := newFakeConsul(t)
+	provider, err := discovery.NewProvider(&config.DiscoveryConfig{
+		Type:          "consul",
+		Service:       "orders",
+		Scheme:        "http",
+		ConsulAddress: fc.URL,
+		ConsulToken:   "consul-token",
+	}, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	lb.AddBackend("http://static:8080")
+	d := discovery.New(provider, lb, time.Second, 0, logger.Get())
+
+	fc.respond(http.StatusOK, consulBody(t,
+		consulInstance("10.0.0.1", "", 8080, "passing", "passing"),
+		consulInstance("10.0.0.9", "10.0.1.2", 9090, "passing"),
+		consulInstance("10.0.0.3", "", 8080, "passing", "critical"),
+		consulInstance("10.0.0.4", "", 8080, "warning"),
+		consulInstance("10.0.0.5", "2001:db8::5", 8080),
+	))
+	if err := d.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if fc.token != "consul-token" {
+		t.Errorf("Expected the ACL token to be sent, got %q", fc.token)
+	}
+	want := "http://10.0.0.1:8080,http://10.0.1.2:9090,http://[2001:db8::5]:8080,http://static:8080"
+	if got := sortedBackends(lb); got != want {
+		t.Errorf("Expected backends %s, got %s", want, got)
+	}
+
+	t.Run("InstanceLeaves", func(t *testing.T) {
+		fc.respond(http.StatusOK, consulBody(t,
+			consulInstance("10.0.0.1", "", 8080, "critical"),
+			consulInstance("10.0.0.9", "10.0.1.2", 9090, "passing"),
+			consulInstance("10.0.0.6", "", 8080, "passing"),
+		))
+		if err := d.Sync(context.Background()); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+		want := "http://10.0.0.6:8080,http://10.0.1.2:9090,http://static:8080"
+		if got := sortedBackends(lb); got != want {
+			t.Errorf("Expected backends %s, got %s", want, got)
+		}
+	})
+
+	t.Run("FailureKeepsLastKnown", func(t *testing.T) {
+		before := sortedBackends(lb)
+		for _, resp := range []struct {
+			status int
+			body   string
+		}{
+			{http.StatusInternalServerError, "boom"},
+			{http.StatusOK, "not json"},
+			{http.StatusOK, consulBody(t, consulInstance("10.0.0.1", "", 8080, "critical"))},
+		} {
+			fc.respond(resp.status, resp.body)
+			if err := d.Sync(context.Background()); err == nil {
+				t.Errorf("Expected sync to fail for %d %q", resp.status, resp.body)
+			}
+			if got := sortedBackends(lb); got != before {
+				t.Errorf("Expected backends %s to be kept, got %s", before, got)
+			}
+		}
+
+		status := d.Status()
+		if status.LastError == "" {
+			t.Error("Expected the last error to be reported")
+		}
+		if status.LastSync == nil || time.Since(*status.LastSync) > time.Minute {
+			t.Errorf("Expected the last successful sync time, got %v", status.LastSync)
+		}
+	})
+
+	t.Run("StaticBackendKept", func(t *testing.T) {
+		fc.respond(http.StatusOK, consulBody(t, consulInstance("static", "", 8080, "passing")))
+		if err := d.Sync(context.Background()); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+		if got := sortedBackends(lb); got != "http://static:8080" {
+			t.Errorf("Expected only the static backend, got %s", got)
+		}
+		if status := d.Status(); len(status.Backends) != 0 || status.LastError != "" {
+			t.Errorf("Expected no discovered backends and no error, got %+v", status)
+		}
+	})
+}
+
+// TestDNSDiscovery tests syncing backends from SRV records
+func TestDNSDiscovery(t *testing.T) {
+	resolver := &fakeResolver{}
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	d := discovery.New(&discovery.DNS{Name: "_orders._tcp.example.com", Scheme: "https", Resolver: resolver}, lb, time.Second, 0, logger.Get())
+
+	resolver.set([]*net.SRV{
+		{Target: "b.example.com.", Port: 8443, Priority: 10},
+		{Target: "a.example.com.", Port: 8443, Priority: 10},
+		{Target: "backup.example.com.", Port: 8443, Priority: 20},
+	}, nil)
+	if err := d.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if got := sortedBackends(lb); got != "https://a.example.com:8443,https://b.example.com:8443" {
+		t.Errorf("Expected the preferred targets, got %s", got)
+	}
+	if len(resolver.names) != 1 || resolver.names[0] != "_orders._tcp.example.com" {
+		t.Errorf("Expected a lookup of the record name, got %v", resolver.names)
+	}
+
+	resolver.set(nil, &net.DNSError{Err: "server misbehaving", Name: "_orders._tcp.example.com", IsTemporary: true})
+	if err := d.Sync(context.Background()); err == nil {
+		t.Error("Expected sync to fail")
+	}
+	if got := sortedBackends(lb); got != "https://a.example.com:8443,https://b.example.com:8443" {
+		t.Errorf("Expected the last known backends to be kept, got %s", got)
+	}
+
+	resolver.set([]*net.SRV{{Target: "backup.example.com.", Port: 8443, Priority: 20}}, nil)
+	if err := d.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if got := sortedBackends(lb); got != "https://backup.example.com:8443" {
+		t.Errorf("Expected the pool to move to the remaining target, got %s", got)
+	}
+}
+
+// TestDiscoveryRun tests that Run syncs right away and keeps syncing,
+// backing off while syncs fail
+func TestDiscoveryRun(t *testing.T) {
+	resolver := &fakeResolver{}
+	resolver.set([]*net.SRV{{Target: "a.example.com.", Port: 80}}, nil)
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	d := discovery.New(&discovery.DNS{Name: "_web._tcp.example.com", Scheme: "http", Resolver: resolver}, lb, 20*time.Millisecond, 0, logger.Get())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+
+	resolver.set([]*net.SRV{{Target: "b.example.com.", Port: 80}}, nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for sortedBackends(lb) != "http://b.example.com:80" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := sortedBackends(lb); got != "http://b.example.com:80" {
+		t.Errorf("Expected periodic syncs to pick up the new target, got %s", got)
+	}
+
+	// Failing syncs back off beyond the jittered interval, and recover
+	var observed atomic.Int64
+	d.Schedule().Observe(func(state schedule.State) { observed.Store(int64(state.Failures)) })
+	resolver.set(nil, errors.New("servfail"))
+	waitFor(t, func() bool { return observed.Load() >= 2 })
+	if state := d.Schedule().State(); state.Interval <= 22*time.Millisecond {
+		t.Errorf("Expected the interval to back off, got %v", state.Interval)
+	}
+	if got := sortedBackends(lb); got != "http://b.example.com:80" {
+		t.Errorf("Expected the known backends kept while failing, got %s", got)
+	}
+	resolver.set([]*net.SRV{{Target: "b.example.com.", Port: 80}}, nil)
+	waitFor(t, func() bool { return observed.Load() == 0 })
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Run to return once the context is cancelled")
+	}
+}
+
+// TestDiscoveryConfig tests validation of the discovery settings
+func TestDiscoveryConfig(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"UnknownType":     {"LB_DISCOVERY_TYPE": "etcd", "LB_DISCOVERY_SERVICE": "orders"},
+		"MissingService":  {"LB_DISCOVERY_TYPE": "consul"},
+		"NonPositiveTick": {"LB_DISCOVERY_TYPE": "dns", "LB_DISCOVERY_SERVICE": "_orders._tcp.example.com", "LB_DISCOVERY_INTERVAL": "0s"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for key, value := range env {
+				t.Setenv(key, value)
+			}
+			if err := config.Load().Validate(); err == nil {
+				t.Error("Expected validation to fail")
+			}
+		})
+	}
+
+	t.Setenv("LB_DISCOVERY_TYPE", "consul")
+	t.Setenv("LB_DISCOVERY_SERVICE", "orders")
+	if err := config.Load().Validate(); err != nil {
+		t.Errorf("Expected valid configuration, got %v", err)
+	}
+
+	t.Run("KubernetesUnavailable", func(t *testing.T) {
+		// Without the kubernetes build tag, or outside a cluster, the provider can't start
+		cfg := &config.DiscoveryConfig{Type: "kubernetes", Service: "orders", Kubeconfig: filepath.Join(t.TempDir(), "missing")}
+		if _, err := discovery.NewProvider(cfg, logger.Get()); err == nil {
+			t.Error("Expected the kubernetes provider to fail")
+		}
+	})
+}
+
+// TestLoadBalancerStatusDiscovery tests that the load balancer status reports the discovery
+func TestLoadBalancerStatusDiscovery(t *testing.T) {
+	cfg := config.Load()
+	log := logger.Get()
+	bus := events.NewBus()
+	cacheInstance := cache.New(&cfg.Cache, log, bus)
+	defer cacheInstance.Stop()
+
+	lb := loadbalancer.New(loadbalancer.RoundRobin, bus)
+	lb.AddBackend("http://static:8080")
+
+	r := router.NewV2(
+		database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		cacheInstance,
+		proxy.New(5*time.Second, &cfg.Proxy, log),
+		cfg,
+		log,
+		auth.NewAuthService("test-secret", log),
+		nil,
+		circuitbreaker.New(log, testMetrics(), nil),
+		lb,
+		websocket.NewHub(&cfg.WebSocket, log, nil),
+		bus,
+		drain.New(),
+	)
+	defer r.Shutdown()
+
+	var resp struct {
+		Data struct {
+			Backends  []map[string]interface{} `json:"backends"`
+			Discovery *discovery.Status        `json:"discovery"`
+		} `json:"data"`
+	}
+	status := func() {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/load-balancer/status", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		resp.Data.Discovery = nil
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode status: %v", err)
+		}
+	}
+
+	status()
+	if len(resp.Data.Backends) != 1 || resp.Data.Discovery != nil {
+		t.Errorf("Expected the static backend and no discovery, got %+v", resp.Data)
+	}
+
+	resolver := &fakeResolver{}
+	resolver.set([]*net.SRV{{Target: "a.example.com.", Port: 80}}, nil)
+	d := discovery.New(&discovery.DNS{Name: "_web._tcp.example.com", Scheme: "http", Resolver: resolver}, lb, time.Second, 0, log)
+	r.SetDiscovery(d)
+
+	status()
+	if resp.Data.Discovery == nil || resp.Data.Discovery.Source != "dns:_web._tcp.example.com" || resp.Data.Discovery.LastSync != nil {
+		t.Errorf("Expected the discovery source before any sync, got %+v", resp.Data.Discovery)
+	}
+
+	if err := d.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	resolver.set(nil, errors.New("lookup failed"))
+	d.Sync(context.Background())
+
+	status()
+	if len(resp.Data.Backends) != 2 {
+		t.Errorf("Expected the static and discovered backends, got %v", resp.Data.Backends)
+	}
+	if got := resp.Data.Discovery; got == nil || got.LastSync == nil || got.LastError != "lookup failed" || len(got.Backends) != 1 {
+		t.Errorf("Expected the last sync time and error, got %+v", got)
+	}
+}
@@ -0,0 +1,304 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/resolver"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// fakeDNS answers lookups with a configurable address, failure and delay
+type fakeDNS struct {
+	mu    sync.Mutex
+	addr  netip.Addr
+	err   error
+	delay time.Duration
+	calls atomic.Int64
+}
+
+func newFakeDNS(addr string) *fakeDNS {
+	return &fakeDNS{addr: netip.MustParseAddr(addr)}
+}
+
+func (f *fakeDNS) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	f.calls.Add(1)
+	f.mu.Lock()
+	addr, err, delay := f.addr, f.err, f.delay
+	f.mu.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []netip.Addr{addr}, nil
+}
+
+func (f *fakeDNS) set(addr string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if addr != "" {
+		f.addr = netip.MustParseAddr(addr)
+	}
+	f.err = err
+}
+
+// lookupAddr resolves host and returns its first address
+func lookupAddr(t *testing.T, c *resolver.Cache, host string) (string, error) {
+	t.Helper()
+	addrs, err := c.Lookup(context.Background(), host)
+	if err != nil {
+		return "", err
+	}
+	return addrs[0].String(), nil
+}
+
+// TestDNSCache tests that answers are reused for their TTL and looked up
+// again afterwards
+func TestDNSCache(t *testing.T) {
+	m := testMetrics()
+	fake := newFakeDNS("10.0.0.1")
+	c := resolver.New(resolver.Options{TTL: 100 * time.Millisecond}, fake, m)
+
+	for range 3 {
+		if addr, err := lookupAddr(t, c, "api.internal"); err != nil || addr != "10.0.0.1" {
+			t.Fatalf("Expected 10.0.0.1, got %q %v", addr, err)
+		}
+	}
+	if got := fake.calls.Load(); got != 1 {
+		t.Errorf("Expected 1 lookup within the TTL, got %d", got)
+	}
+	if got := testutil.ToFloat64(m.DNSCacheResults.WithLabelValues(resolver.ResultHit)); got != 2 {
+		t.Errorf("Expected 2 cache hits, got %v", got)
+	}
+
+	fake.set("10.0.0.2", nil)
+	time.Sleep(150 * time.Millisecond)
+	if addr, err := lookupAddr(t, c, "api.internal"); err != nil || addr != "10.0.0.2" {
+		t.Errorf("Expected the changed address after the TTL, got %q %v", addr, err)
+	}
+	if got := testutil.CollectAndCount(m.DNSLookupDuration); got != 1 {
+		t.Errorf("Expected lookup latency recorded for the host, got %d series", got)
+	}
+}
+
+// TestDNSCacheNegative tests that failures are cached for the negative TTL
+func TestDNSCacheNegative(t *testing.T) {
+	m := testMetrics()
+	fake := newFakeDNS("10.0.0.1")
+	fake.set("", &net.DNSError{Err: "no such host", Name: "missing.internal", IsNotFound: true})
+	c := resolver.New(resolver.Options{TTL: time.Minute, NegativeTTL: 100 * time.Millisecond}, fake, m)
+
+	for range 3 {
+		if _, err := lookupAddr(t, c, "missing.internal"); err == nil {
+			t.Fatal("Expected the lookup to fail")
+		}
+	}
+	if got := fake.calls.Load(); got != 1 {
+		t.Errorf("Expected 1 lookup within the negative TTL, got %d", got)
+	}
+	if got := testutil.ToFloat64(m.DNSCacheResults.WithLabelValues(resolver.ResultNegative)); got != 2 {
+		t.Errorf("Expected 2 negative cache hits, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.DNSLookupFailures.WithLabelValues("missing.internal")); got != 1 {
+		t.Errorf("Expected 1 lookup failure counted, got %v", got)
+	}
+
+	fake.set("", nil)
+	time.Sleep(150 * time.Millisecond)
+	if addr, err := lookupAddr(t, c, "missing.internal"); err != nil || addr != "10.0.0.1" {
+		t.Errorf("Expected the host resolved after the negative TTL, got %q %v", addr, err)
+	}
+}
+
+// TestDNSCacheStale tests that expired answers are served while lookups fail,
+// but no longer than the stale bound
+func TestDNSCacheStale(t *testing.T) {
+	m := testMetrics()
+	fake := newFakeDNS("10.0.0.1")
+	c := resolver.New(resolver.Options{TTL: 50 * time.Millisecond, MaxStale: 200 * time.Millisecond}, fake, m)
+
+	if _, err := lookupAddr(t, c, "api.internal"); err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	fake.set("", errors.New("server misbehaving"))
+	time.Sleep(100 * time.Millisecond)
+	if addr, err := lookupAddr(t, c, "api.internal"); err != nil || addr != "10.0.0.1" {
+		t.Fatalf("Expected the stale address while DNS fails, got %q %v", addr, err)
+	}
+	if got := testutil.ToFloat64(m.DNSCacheResults.WithLabelValues(resolver.ResultStale)); got != 1 {
+		t.Errorf("Expected 1 stale answer, got %v", got)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := lookupAddr(t, c, "api.internal"); err == nil {
+		t.Error("Expected the lookup to fail past the stale bound")
+	}
+}
+
+// TestDNSCacheRefreshAhead tests that an answer used close to expiry is
+// refreshed in the background while the cached one is served
+func TestDNSCacheRefreshAhead(t *testing.T) {
+	fake := newFakeDNS("10.0.0.1")
+	c := resolver.New(resolver.Options{TTL: 300 * time.Millisecond, RefreshAhead: 200 * time.Millisecond}, fake, nil)
+
+	if _, err := lookupAddr(t, c, "api.internal"); err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	fake.set("10.0.0.2", nil)
+	time.Sleep(150 * time.Millisecond)
+
+	if addr, _ := lookupAddr(t, c, "api.internal"); addr != "10.0.0.1" {
+		t.Errorf("Expected the cached address while refreshing, got %q", addr)
+	}
+	deadline := time.Now().Add(time.Second)
+	for fake.calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if addr, _ := lookupAddr(t, c, "api.internal"); addr != "10.0.0.2" {
+		t.Errorf("Expected the refreshed address before expiry, got %q", addr)
+	}
+	if got := fake.calls.Load(); got != 2 {
+		t.Errorf("Expected 2 lookups, got %d", got)
+	}
+}
+
+// TestDNSCacheSharedLookup tests that concurrent misses share one slow
+// lookup and that a caller giving up doesn't fail it for the others
+func TestDNSCacheSharedLookup(t *testing.T) {
+	fake := newFakeDNS("10.0.0.1")
+	fake.delay = 100 * time.Millisecond
+	c := resolver.New(resolver.Options{TTL: time.Minute}, fake, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Lookup(ctx, "slow.internal"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the impatient caller to give up, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var failures atomic.Int64
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Lookup(context.Background(), "slow.internal"); err != nil {
+				failures.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := fake.calls.Load(); got != 1 {
+		t.Errorf("Expected one shared lookup, got %d", got)
+	}
+	if got := failures.Load(); got != 0 {
+		t.Errorf("Expected every waiting caller resolved, %d failed", got)
+	}
+}
+
+// TestDNSCacheTimeout tests that a stalled lookup is bounded by the timeout
+func TestDNSCacheTimeout(t *testing.T) {
+	fake := newFakeDNS("10.0.0.1")
+	fake.delay = 5 * time.Second
+	c := resolver.New(resolver.Options{TTL: time.Minute, Timeout: 50 * time.Millisecond}, fake, nil)
+
+	start := time.Now()
+	if _, err := lookupAddr(t, c, "stalled.internal"); err == nil {
+		t.Error("Expected the stalled lookup to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the lookup abandoned after the timeout, took %s", elapsed)
+	}
+}
+
+// TestDNSPinnedHosts tests that pinned hostnames never reach the resolver
+func TestDNSPinnedHosts(t *testing.T) {
+	hosts, err := resolver.ParseHosts(map[string][]string{"API.internal": {"10.0.0.5", "::ffff:10.0.0.6"}})
+	if err != nil {
+		t.Fatalf("Failed to parse hosts: %v", err)
+	}
+	if _, err := resolver.ParseHosts(map[string][]string{"api.internal": {"not-an-ip"}}); err == nil {
+		t.Error("Expected an invalid pinned address rejected")
+	}
+
+	m := testMetrics()
+	fake := newFakeDNS("10.0.0.1")
+	c := resolver.New(resolver.Options{Hosts: hosts}, fake, m)
+
+	addrs, err := c.Lookup(context.Background(), "api.internal.")
+	if err != nil || len(addrs) != 2 || addrs[0].String() != "10.0.0.5" || addrs[1].String() != "10.0.0.6" {
+		t.Errorf("Expected the pinned addresses, got %v %v", addrs, err)
+	}
+	if addr, _ := lookupAddr(t, c, "10.1.2.3"); addr != "10.1.2.3" {
+		t.Errorf("Expected an IP literal returned as is, got %q", addr)
+	}
+	if got := fake.calls.Load(); got != 0 {
+		t.Errorf("Expected no lookups, got %d", got)
+	}
+	if got := testutil.ToFloat64(m.DNSCacheResults.WithLabelValues(resolver.ResultPinned)); got != 1 {
+		t.Errorf("Expected 1 pinned answer, got %v", got)
+	}
+
+	t.Run("Config", func(t *testing.T) {
+		t.Setenv("PROXY_DNS_HOSTS", "api.internal=10.0.0.5|10.0.0.6,bad.internal=nope")
+		cfg := config.Load()
+		if got := cfg.Proxy.DNSHosts["api.internal"]; len(got) != 2 || got[1] != "10.0.0.6" {
+			t.Errorf("Expected two pinned addresses, got %v", got)
+		}
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "bad.internal") {
+			t.Errorf("Expected the invalid pin reported, got %v", err)
+		}
+	})
+}
+
+// TestDNSCacheProxy tests that the proxy dials upstreams at the addresses the
+// cache resolves, keeping the hostname for the request
+func TestDNSCacheProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	fake := newFakeDNS("127.0.0.1")
+	p := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+	p.SetResolver(resolver.New(resolver.Options{TTL: time.Minute}, fake, nil))
+
+	target := "http://upstream.isekai.test:" + port
+	w := httptest.NewRecorder()
+	if _, err := p.ForwardAndCopy(context.Background(), w, httptest.NewRequest("GET", "/", nil), target); err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "upstream.isekai.test:"+port {
+		t.Errorf("Expected the upstream reached by hostname, got %d %s", w.Code, w.Body.String())
+	}
+	if got := fake.calls.Load(); got != 1 {
+		t.Errorf("Expected the hostname resolved through the cache, got %d lookups", got)
+	}
+
+	fake.set("", errors.New("server misbehaving"))
+	w = httptest.NewRecorder()
+	p.ForwardAndCopy(context.Background(), w, httptest.NewRequest("GET", "/", nil), "http://down.isekai.test:"+port)
+	if w.Code != http.StatusBadGateway && w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a failed lookup to fail the request, got %d", w.Code)
+	}
+}
@@ -0,0 +1,184 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/drain"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/router"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestDrainWaitsForInFlight tests that Wait outlasts slow in-flight requests
+func TestDrainWaitsForInFlight(t *testing.T) {
+	drainer := drain.New()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(drainer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})))
+	defer server.Close()
+
+	requests := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := http.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			requests <- err
+		}()
+	}
+	waitFor(t, func() bool { return drainer.InFlight() == 2 })
+
+	if !drainer.Start() {
+		t.Fatal("Expected first Start to begin draining")
+	}
+	if drainer.Start() {
+		t.Error("Expected second Start to report an existing drain")
+	}
+	if err := drainer.Check(context.Background()); err != drain.ErrDraining {
+		t.Errorf("Expected readiness check to fail, got %v", err)
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- drainer.Wait(context.Background(), 10*time.Millisecond) }()
+
+	select {
+	case <-waited:
+		t.Fatal("Expected Wait to block while requests are in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-requests; err != nil {
+			t.Errorf("Expected in-flight request to complete, got %v", err)
+		}
+	}
+
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("Expected Wait to succeed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for drain")
+	}
+
+	t.Run("BoundedByContext", func(t *testing.T) {
+		blocked := drain.New()
+		stuck := make(chan struct{})
+		defer close(stuck)
+
+		go blocked.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-stuck
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		waitFor(t, func() bool { return blocked.InFlight() == 1 })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := blocked.Wait(ctx, 0); err != context.DeadlineExceeded {
+			t.Errorf("Expected deadline exceeded, got %v", err)
+		}
+	})
+}
+
+// TestDrainEndpoint tests the admin drain endpoint through the full router
+func TestDrainEndpoint(t *testing.T) {
+	log := logger.Get()
+	cfg := config.Load()
+	cfg.Auth.Enabled = false
+	cfg.Gateway.RateLimitEnabled = false
+	cfg.Gateway.HealthCacheTTL = 0
+
+	bus := events.NewBus()
+	cacheInstance := cache.New(&cfg.Cache, log, bus)
+	defer cacheInstance.Stop()
+
+	drainer := drain.New()
+	r := router.NewV2(
+		database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		cacheInstance,
+		proxy.New(5*time.Second, &cfg.Proxy, log),
+		cfg,
+		log,
+		auth.NewAuthService("test-secret", log),
+		nil, // keep these requests out of the shared path label metrics
+		circuitbreaker.New(log, testMetrics(), bus),
+		loadbalancer.New(loadbalancer.RoundRobin, bus),
+		websocket.NewHub(&cfg.WebSocket, log, nil),
+		bus,
+		drainer,
+	)
+	defer r.Shutdown()
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	readiness := func() string {
+		var resp struct {
+			Data struct {
+				Checks map[string]string `json:"checks"`
+			} `json:"data"`
+		}
+		json.NewDecoder(serve("GET", "/health/ready").Body).Decode(&resp)
+		return resp.Data.Checks["drain"]
+	}
+
+	draining := func() bool {
+		var resp struct {
+			Data struct {
+				Drain drain.Status `json:"drain"`
+			} `json:"data"`
+		}
+		json.NewDecoder(serve("GET", "/api/status").Body).Decode(&resp)
+		return resp.Data.Drain.Draining
+	}
+
+	if got := readiness(); got != "healthy" {
+		t.Fatalf("Expected drain check to pass before draining, got %q", got)
+	}
+	if draining() {
+		t.Fatal("Expected status to report not draining")
+	}
+
+	if w := serve("POST", "/api/admin/drain"); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", w.Code)
+	}
+	if w := serve("POST", "/api/admin/drain"); w.Code != http.StatusOK {
+		t.Errorf("Expected repeated drain to return 200, got %d", w.Code)
+	}
+
+	if got := readiness(); got != "unhealthy" {
+		t.Errorf("Expected drain check to fail while draining, got %q", got)
+	}
+	if !draining() {
+		t.Error("Expected status to report draining")
+	}
+	if w := serve("GET", "/ws"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected WebSocket upgrade to be refused with 503, got %d", w.Code)
+	}
+
+	select {
+	case <-drainer.Started():
+	default:
+		t.Error("Expected drain to signal the engine")
+	}
+}
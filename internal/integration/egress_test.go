@@ -0,0 +1,290 @@
+package integration
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/egress"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/resolver"
+	"github.com/zakirkun/isekai/internal/seal"
+	"github.com/zakirkun/isekai/internal/upstreamtls"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// egressProxy is an HTTP forward proxy tunnelling CONNECT requests and
+// relaying absolute-form ones, which reaches the hosts named in hosts at the
+// addresses they map to. It counts the requests it relayed.
+type egressProxy struct {
+	*httptest.Server
+	auth      string // Proxy-Authorization required, none when empty
+	hosts     map[string]string
+	tunnels   atomic.Int64
+	forwarded atomic.Int64
+}
+
+func newEgressProxy(t *testing.T, auth string, hosts map[string]string) *egressProxy {
+	t.Helper()
+
+	p := &egressProxy{auth: auth, hosts: hosts}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *egressProxy) serve(w http.ResponseWriter, r *http.Request) {
+	if p.auth != "" && r.Header.Get("Proxy-Authorization") != p.auth {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="egress"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	addr := r.Host
+	if mapped, ok := p.hosts[addr]; ok {
+		addr = mapped
+	}
+
+	if r.Method == http.MethodConnect {
+		upstream, err := net.Dial("tcp", addr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		p.tunnels.Add(1)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, buf)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+		return
+	}
+
+	p.forwarded.Add(1)
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.URL.Host = addr
+	out.Header.Del("Proxy-Authorization")
+	resp, err := (&http.Transport{}).RoundTrip(out)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// egressHandler returns a proxy handler serving routes, with upstream
+// hostnames in hosts pinned to their addresses
+func egressHandler(t *testing.T, cfg *config.ProxyConfig, m *metrics.Metrics, hosts map[string][]netip.Addr, routes ...database.Route) *handlers.ProxyHandler {
+	t.Helper()
+
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	t.Cleanup(cacheInstance.Stop)
+	p := proxy.New(5*time.Second, cfg, log)
+	p.SetResolver(resolver.New(resolver.Options{Hosts: hosts}, nil, m))
+
+	h := handlers.NewProxyHandler(
+		database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		p,
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	h.SetRoutes(routes, time.Minute)
+	return h
+}
+
+// egressRoute returns an enabled proxied route
+func egressRoute(id int, path, target string, profile *egress.Profile) database.Route {
+	return database.Route{ID: id, Path: path, TargetURL: target, Method: "GET", Enabled: true, Type: database.RouteTypeProxy, Egress: profile}
+}
+
+// TestEgressRouteProxy tests a route reaching a TLS upstream through its
+// egress proxy with sealed credentials, and failures of the proxy labelled
+// apart from the upstream's
+func TestEgressRouteProxy(t *testing.T) {
+	seal.SetKey("egress-test-key")
+	defer seal.SetKey("")
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("via egress"))
+	}))
+	defer upstream.Close()
+	egressProxy := newEgressProxy(t, "Basic Z3c6czNjcmV0", map[string]string{
+		"upstream.test:443": upstream.Listener.Addr().String(),
+	})
+
+	profile := &egress.Profile{URL: egressProxy.URL, Username: "gw", Password: "s3cret"}
+	if err := profile.Seal(); err != nil || !seal.Sealed(profile.Password) {
+		t.Fatalf("Expected the password sealed, got %q, %v", profile.Password, err)
+	}
+	if err := profile.Validate(); err != nil {
+		t.Fatalf("Expected the profile valid, got %v", err)
+	}
+	wrong := &egress.Profile{URL: egressProxy.URL, Username: "gw", Password: "wrong"}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	closed := "http://" + listener.Addr().String()
+	listener.Close()
+
+	insecure := &upstreamtls.Profile{InsecureSkipVerify: true}
+	routes := []database.Route{
+		egressRoute(1, "/ok", "https://upstream.test", profile),
+		egressRoute(2, "/denied", "https://upstream.test", wrong),
+		egressRoute(3, "/down", "https://upstream.test", &egress.Profile{URL: closed}),
+	}
+	for i := range routes {
+		routes[i].TLS = insecure
+	}
+
+	m := testMetrics()
+	h := egressHandler(t, &config.Load().Proxy, m, nil, routes...)
+
+	w := httptest.NewRecorder()
+	h.Handle(w, httptest.NewRequest("GET", "/ok", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "via egress" {
+		t.Fatalf("Expected the upstream reached through the egress proxy, got %d %q", w.Code, w.Body.String())
+	}
+	if egressProxy.tunnels.Load() != 1 {
+		t.Errorf("Expected one tunnel through the egress proxy, got %d", egressProxy.tunnels.Load())
+	}
+
+	for _, path := range []string{"/denied", "/down"} {
+		w := httptest.NewRecorder()
+		h.Handle(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("Expected 502 for %s, got %d", path, w.Code)
+		}
+	}
+	if got := testutil.ToFloat64(m.ProxyErrors.WithLabelValues("https://upstream.test", "egress_proxy")); got != 2 {
+		t.Errorf("Expected 2 egress proxy errors, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.ProxyErrors.WithLabelValues("https://upstream.test", "upstream")); got != 0 {
+		t.Errorf("Expected no upstream errors, got %v", got)
+	}
+}
+
+// TestEgressGlobalProxy tests the global egress proxy relaying plain HTTP
+// requests, and hosts in its no-proxy list and direct routes bypassing it
+func TestEgressGlobalProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer upstream.Close()
+	port := strconv.Itoa(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	egressProxy := newEgressProxy(t, "", map[string]string{
+		"upstream.test": upstream.Listener.Addr().String(),
+	})
+
+	cfg := config.Load().Proxy
+	cfg.EgressURL = egressProxy.URL
+	cfg.EgressNoProxy = []string{"internal.test"}
+	hosts := map[string][]netip.Addr{
+		"direct.test":       {netip.MustParseAddr("127.0.0.1")},
+		"api.internal.test": {netip.MustParseAddr("127.0.0.1")},
+	}
+
+	h := egressHandler(t, &cfg, testMetrics(), hosts,
+		egressRoute(1, "/proxied", "http://upstream.test", nil),
+		egressRoute(2, "/internal", "http://api.internal.test:"+port, nil),
+		egressRoute(3, "/direct", "http://direct.test:"+port, &egress.Profile{Direct: true}),
+	)
+
+	want := map[string]string{
+		"/proxied":  "upstream.test",
+		"/internal": "api.internal.test:" + port,
+		"/direct":   "direct.test:" + port,
+	}
+	for path, host := range want {
+		w := httptest.NewRecorder()
+		h.Handle(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != host {
+			t.Errorf("Expected %s answered for %s, got %d %q", path, host, w.Code, w.Body.String())
+		}
+	}
+	if egressProxy.forwarded.Load() != 1 {
+		t.Errorf("Expected only the proxied route through the egress proxy, got %d requests", egressProxy.forwarded.Load())
+	}
+}
+
+// TestEgressProfileValidate tests validating egress profiles
+func TestEgressProfileValidate(t *testing.T) {
+	seal.SetKey("egress-test-key")
+	defer seal.SetKey("")
+
+	for _, profile := range []egress.Profile{
+		{URL: "http://proxy.internal:3128"},
+		{URL: "socks5://proxy.internal:1080", Username: "gw", Password: "secret"},
+		{URL: "socks5h://proxy.internal:1080", NoProxy: []string{"10.0.0.0/8", ".svc.cluster.local"}},
+		{Direct: true},
+	} {
+		if err := profile.Validate(); err != nil {
+			t.Errorf("Expected %+v valid, got %v", profile, err)
+		}
+	}
+	for _, profile := range []egress.Profile{
+		{},
+		{URL: "ftp://proxy.internal"},
+		{URL: "http://"},
+		{URL: "http://proxy.internal:3128", Password: "secret"},
+		{URL: "http://proxy.internal:3128", Direct: true},
+	} {
+		if err := profile.Validate(); err == nil {
+			t.Errorf("Expected %+v refused", profile)
+		}
+	}
+
+	seal.SetKey("")
+	plain := egress.Profile{URL: "http://proxy.internal:3128", Username: "gw", Password: "secret"}
+	if err := plain.Validate(); err == nil {
+		t.Errorf("Expected a password refused without a seal key")
+	}
+}
+
+// TestEgressPrewarm tests warming up connections through an egress proxy
+func TestEgressPrewarm(t *testing.T) {
+	upstream, conns := countingUpstream(t)
+	egressProxy := newEgressProxy(t, "", map[string]string{
+		"upstream.test": upstream.Listener.Addr().String(),
+	})
+
+	p := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+	ctx := proxy.WithEgress(context.Background(), &egress.Profile{URL: egressProxy.URL})
+	if opened, err := p.Prewarm(ctx, "http://upstream.test", 2, nil, false); err != nil || opened != 2 {
+		t.Fatalf("Expected 2 connections opened, got %d, %v", opened, err)
+	}
+	if egressProxy.forwarded.Load() != 2 || conns.Load() == 0 {
+		t.Errorf("Expected the warm-up sent through the egress proxy, got %d requests", egressProxy.forwarded.Load())
+	}
+}
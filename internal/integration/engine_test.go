@@ -0,0 +1,54 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zakirkun/isekai/internal/core"
+)
+
+// TestTwoEngines tests that engines in one process keep separate metrics
+func TestTwoEngines(t *testing.T) {
+	t.Setenv("DB_REQUIRED", "false")
+	t.Setenv("DB_HOST", "127.0.0.1")
+	t.Setenv("DB_PORT", closedDatabaseConfig(t).Port)
+	t.Setenv("TRACING_ENABLED", "false")
+
+	first, err := core.NewV2()
+	if err != nil {
+		t.Fatalf("Failed to create the first engine: %v", err)
+	}
+	defer first.Stop()
+
+	second, err := core.NewV2()
+	if err != nil {
+		t.Fatalf("Failed to create the second engine: %v", err)
+	}
+	defer second.Stop()
+
+	scrape := func(engine *core.EngineV2) string {
+		w := httptest.NewRecorder()
+		engine.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	// A request to the first engine only shows up in its own metrics
+	first.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/status", nil))
+	firstMetrics, secondMetrics := scrape(first), scrape(second)
+	for _, series := range []string{"isekai_build_info", "go_goroutines", "process_start_time_seconds"} {
+		if !strings.Contains(firstMetrics, series) || !strings.Contains(secondMetrics, series) {
+			t.Errorf("Expected %s from both engines", series)
+		}
+	}
+	if !strings.Contains(firstMetrics, `path="/api/status"`) {
+		t.Error("Expected the first engine to count its request")
+	}
+	if strings.Contains(secondMetrics, `path="/api/status"`) {
+		t.Error("Expected the second engine not to count the first engine's request")
+	}
+}
@@ -0,0 +1,292 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestErrorEnvelope tests the JSON shape of each error path
+func TestErrorEnvelope(t *testing.T) {
+	log := logger.Get()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	authService := auth.NewAuthService("test-secret", log)
+	token := func(roles []string, ttl time.Duration) string {
+		token, err := authService.GenerateToken("user-1", "alice", roles, ttl)
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		return "Bearer " + token
+	}
+	authenticated := authService.Middleware()(ok)
+
+	rl := middleware.NewRateLimiter(1, log)
+	defer rl.Stop()
+	rl.Allow(middleware.SubjectIP + "192.0.2.1")
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(ok)
+	closed.Close()
+
+	forward := func(timeout time.Duration, target string) http.Handler {
+		p := proxy.New(timeout, &config.Load().Proxy, log)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.ForwardAndCopy(r.Context(), w, r, target)
+		})
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		body    string
+		header  map[string]string
+		status  int
+		code    string
+	}{
+		{"AuthMissing", authenticated, "GET", "", nil, http.StatusUnauthorized, response.CodeAuthMissing},
+		{"AuthInvalid", authenticated, "GET", "", map[string]string{"Authorization": "Bearer not-a-token"}, http.StatusUnauthorized, response.CodeAuthInvalid},
+		{"AuthExpired", authenticated, "GET", "", map[string]string{"Authorization": token(nil, -time.Minute)}, http.StatusUnauthorized, response.CodeAuthExpired},
+		{"Forbidden", authService.Middleware()(auth.RequireRole("admin")(ok)), "GET", "", map[string]string{"Authorization": token([]string{"viewer"}, time.Hour)}, http.StatusForbidden, response.CodeForbidden},
+		{"RateLimited", middleware.RateLimit(rl)(ok), "GET", "", nil, http.StatusTooManyRequests, response.CodeRateLimited},
+		{"UpstreamTimeout", forward(50*time.Millisecond, slow.URL), "GET", "", nil, http.StatusGatewayTimeout, response.CodeUpstreamTimeout},
+		{"BadGateway", forward(time.Second, closed.URL), "GET", "", nil, http.StatusBadGateway, response.CodeBadGateway},
+		{"InvalidBody", http.HandlerFunc(routeHandler.Create), "POST", "{", nil, http.StatusBadRequest, response.CodeInvalidBody},
+		{"RouteValidation", http.HandlerFunc(routeHandler.Create), "POST", `{"path":"/a","target_url":"http://a","canary_weight":150}`, nil, http.StatusBadRequest, response.CodeValidationFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/errors", strings.NewReader(tt.body))
+			req.RemoteAddr = "192.0.2.1:1234"
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+
+			w := httptest.NewRecorder()
+			middleware.RequestID(tt.handler).ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			var envelope map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("Expected a JSON body, got %q", w.Body.String())
+			}
+			if envelope["success"] != false {
+				t.Errorf("Expected success false, got %v", envelope["success"])
+			}
+			if envelope["code"] != tt.code {
+				t.Errorf("Expected code %s, got %v", tt.code, envelope["code"])
+			}
+			if msg, _ := envelope["error"].(string); msg == "" {
+				t.Errorf("Expected an error message, got %v", envelope["error"])
+			}
+			if id := w.Header().Get(response.RequestIDHeader); id == "" || envelope["request_id"] != id {
+				t.Errorf("Expected request_id to match the %s header %q, got %v", response.RequestIDHeader, id, envelope["request_id"])
+			}
+		})
+	}
+}
+
+// TestRequestID tests that client request IDs are kept when well formed and forwarded upstream
+func TestRequestID(t *testing.T) {
+	var upstreamID string
+	handler := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(response.RequestIDHeader)
+		if middleware.RequestIDFromContext(r.Context()) != upstreamID {
+			t.Errorf("Expected the context and header IDs to match")
+		}
+	}))
+
+	tests := []struct {
+		name string
+		id   string
+		keep bool
+	}{
+		{"Generated", "", false},
+		{"ClientSupplied", "support-ticket-42", true},
+		{"Whitespace", "two words", false},
+		{"TooLong", strings.Repeat("x", 200), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.id != "" {
+				req.Header.Set(response.RequestIDHeader, tt.id)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			id := w.Header().Get(response.RequestIDHeader)
+			if id == "" || id != upstreamID {
+				t.Fatalf("Expected the response and upstream IDs to match, got %q and %q", id, upstreamID)
+			}
+			if (id == tt.id) != tt.keep {
+				t.Errorf("Expected keep=%v for %q, got %q", tt.keep, tt.id, id)
+			}
+		})
+	}
+}
+
+// TestErrorNegotiation tests that error bodies follow the Accept header
+func TestErrorNegotiation(t *testing.T) {
+	tests := []struct {
+		accept      string
+		contentType string
+		contains    string
+	}{
+		{"", "application/json", `"code":"ROUTE_NOT_FOUND"`},
+		{"*/*", "application/json", `"code":"ROUTE_NOT_FOUND"`},
+		{"application/json", "application/json", `"code":"ROUTE_NOT_FOUND"`},
+		{"text/plain", "text/plain; charset=utf-8", "404 Not Found: Route not found\nCode: ROUTE_NOT_FOUND\n"},
+		{"text/html", "text/html; charset=utf-8", "<h1>404 Not Found</h1>"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8", "<p>Route not found</p>"},
+		{"application/json;q=0.5, text/plain", "text/plain; charset=utf-8", "Route not found"},
+		{"image/png", "application/json", `"success":false`},
+	}
+
+	handler := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response.ErrorFor(w, r, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+	}))
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/missing", nil)
+			req.Header.Set("Accept", tt.accept)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404, got %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Expected Content-Type %q, got %q", tt.contentType, got)
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("Expected body to contain %q, got %q", tt.contains, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), w.Header().Get(response.RequestIDHeader)) {
+				t.Errorf("Expected body to include the request ID, got %q", w.Body.String())
+			}
+			if got := w.Header().Get("Content-Length"); got != fmt.Sprint(w.Body.Len()) {
+				t.Errorf("Expected Content-Length %d, got %q", w.Body.Len(), got)
+			}
+		})
+	}
+
+	t.Run("Head", func(t *testing.T) {
+		for _, accept := range []string{"application/json", "text/plain", "text/html"} {
+			get := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/missing", nil)
+			req.Header.Set("Accept", accept)
+			req.Header.Set(response.RequestIDHeader, "head-check")
+			handler.ServeHTTP(get, req)
+
+			head := httptest.NewRecorder()
+			req = httptest.NewRequest("HEAD", "/missing", nil)
+			req.Header.Set("Accept", accept)
+			req.Header.Set(response.RequestIDHeader, "head-check")
+			handler.ServeHTTP(head, req)
+
+			if head.Code != http.StatusNotFound || head.Body.Len() != 0 {
+				t.Errorf("%s: expected 404 without a body, got %d %q", accept, head.Code, head.Body.String())
+			}
+			if got := head.Header().Get("Content-Length"); got != fmt.Sprint(get.Body.Len()) {
+				t.Errorf("%s: expected HEAD Content-Length %d, got %q", accept, get.Body.Len(), got)
+			}
+		}
+	})
+
+	t.Run("NoContent", func(t *testing.T) {
+		for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+			w := httptest.NewRecorder()
+			response.JSON(w, status, response.Response{Success: true})
+			if w.Code != status || w.Body.Len() != 0 {
+				t.Errorf("Expected %d without a body, got %d %q", status, w.Code, w.Body.String())
+			}
+		}
+	})
+}
+
+// TestErrorPages tests operator error templates on the proxy path
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "502.html"), []byte(`<h1>Acme is down</h1><p>{{.Code}} {{.RequestID}}</p>`), 0o644)
+	os.WriteFile(filepath.Join(dir, "README.txt"), []byte("ignored"), 0o644)
+
+	pages, err := response.LoadErrorPages(dir)
+	if err != nil {
+		t.Fatalf("Failed to load error pages: %v", err)
+	}
+	response.SetErrorPages(pages)
+	defer response.SetErrorPages(nil)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	p := proxy.New(time.Second, &config.Load().Proxy, logger.Get())
+	gateway := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ForwardAndCopy(r.Context(), w, r, closed.URL)
+	}))
+
+	req := httptest.NewRequest("GET", "/down", nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set(response.RequestIDHeader, "page-check")
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("Expected status 502, got %d", w.Code)
+	}
+	if want := "<h1>Acme is down</h1><p>BAD_GATEWAY page-check</p>"; w.Body.String() != want {
+		t.Errorf("Expected the operator page %q, got %q", want, w.Body.String())
+	}
+
+	// Statuses without a template use the built-in page
+	w = httptest.NewRecorder()
+	response.ErrorFor(w, req, http.StatusServiceUnavailable, response.CodeServiceUnavailable, "Down for maintenance")
+	if !strings.Contains(w.Body.String(), "<h1>503 Service Unavailable</h1>") {
+		t.Errorf("Expected the built-in page, got %q", w.Body.String())
+	}
+
+	t.Run("InvalidTemplate", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "404.html"), []byte(`{{.Broken`), 0o644)
+		if _, err := response.LoadErrorPages(dir); err == nil {
+			t.Error("Expected an error for a malformed template")
+		}
+	})
+}
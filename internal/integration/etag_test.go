@@ -0,0 +1,211 @@
+package integration
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/etag"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/transform"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// conditionalGet sends a GET through handle with the given headers
+func conditionalGet(handle http.HandlerFunc, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	handle(rec, req)
+	return rec
+}
+
+// expectNotModified checks rec is a bodiless 304 carrying etag
+func expectNotModified(t *testing.T, rec *httptest.ResponseRecorder, etag string) {
+	t.Helper()
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("Expected 304, got %d", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("Expected no body on a 304, got %q", rec.Body.String())
+	}
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Errorf("Expected the 304 to carry ETag %s, got %q", etag, got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "" {
+		t.Errorf("Expected no Content-Type on a 304, got %q", got)
+	}
+}
+
+// TestETagRouteList tests conditional requests for the cached route list,
+// each filtered view tagged apart and a changed list tagged anew
+func TestETagRouteList(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	handler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	routes := []database.Route{
+		{ID: 1, Path: "/pay", Tags: []string{"payments"}},
+		{ID: 2, Path: "/users", TenantID: "acme"},
+	}
+	entry, err := etag.New(routes)
+	if err != nil {
+		t.Fatalf("Failed to tag routes: %v", err)
+	}
+	cacheInstance.Set("routes:all", entry)
+
+	first := conditionalGet(handler.List, "/api/routes", nil)
+	tag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || tag != entry.ETag {
+		t.Fatalf("Expected the list with the cached entry's ETag, got %d %q", first.Code, tag)
+	}
+	if first.Header().Get("Last-Modified") != "" {
+		t.Errorf("Expected no Last-Modified on the list, whose deletions no route records")
+	}
+
+	for _, header := range []string{tag, "W/" + tag, `"stale", ` + tag, "*"} {
+		rec := conditionalGet(handler.List, "/api/routes", http.Header{"If-None-Match": {header}})
+		expectNotModified(t, rec, tag)
+		if rec.Header().Get("Vary") != "Authorization" {
+			t.Errorf("Expected the 304 to vary on Authorization like the list")
+		}
+	}
+	if rec := conditionalGet(handler.List, "/api/routes", http.Header{"If-None-Match": {`"stale"`}}); rec.Code != http.StatusOK {
+		t.Errorf("Expected a stale ETag to get the list, got %d", rec.Code)
+	}
+
+	// Views of the list are tagged apart from it and from each other
+	tagged := conditionalGet(handler.List, "/api/routes?tag=payments", nil).Header().Get("ETag")
+	scopedReq := httptest.NewRequest(http.MethodGet, "/api/routes", nil)
+	scopedReq = scopedReq.WithContext(auth.WithClaims(scopedReq.Context(), &auth.Claims{UserID: "7", TenantID: "acme"}))
+	scopedRec := httptest.NewRecorder()
+	handler.List(scopedRec, scopedReq)
+	scoped := scopedRec.Header().Get("ETag")
+	if tagged == tag || scoped == tag || tagged == scoped || tagged == "" || scoped == "" {
+		t.Errorf("Expected distinct ETags for each view, got %q, %q and %q", tag, tagged, scoped)
+	}
+	if rec := conditionalGet(handler.List, "/api/routes?tag=payments", http.Header{"If-None-Match": {tag}}); rec.Code != http.StatusOK {
+		t.Errorf("Expected the full list's ETag not to match the tagged view, got %d", rec.Code)
+	}
+
+	// A changed list is tagged anew
+	routes[0].Path = "/payments"
+	changed, _ := etag.New(routes)
+	cacheInstance.Set("routes:all", changed)
+	rec := conditionalGet(handler.List, "/api/routes", http.Header{"If-None-Match": {tag}})
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == tag {
+		t.Errorf("Expected the changed list with a new ETag, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+// TestETagRoute tests conditional requests for a cached route, If-None-Match
+// taking precedence over If-Modified-Since
+func TestETagRoute(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	handler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	updated := time.Date(2026, 5, 1, 12, 0, 0, 500, time.UTC)
+	entry, _ := etag.New(&database.Route{ID: 1, Path: "/pay", UpdatedAt: updated})
+	cacheInstance.Set("route:1", entry)
+
+	get := func(method string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/routes/1", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", "1")
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rec := httptest.NewRecorder()
+		handler.Get(rec, req)
+		return rec
+	}
+
+	first := get(http.MethodGet, nil)
+	if first.Code != http.StatusOK || first.Header().Get("ETag") != entry.ETag {
+		t.Fatalf("Expected the route with its ETag, got %d %q", first.Code, first.Header().Get("ETag"))
+	}
+	lastModified := first.Header().Get("Last-Modified")
+	if lastModified != updated.Format(http.TimeFormat) {
+		t.Fatalf("Expected Last-Modified %s, got %q", updated.Format(http.TimeFormat), lastModified)
+	}
+
+	expectNotModified(t, get(http.MethodGet, http.Header{"If-None-Match": {entry.ETag}}), entry.ETag)
+	expectNotModified(t, get(http.MethodHead, http.Header{"If-None-Match": {entry.ETag}}), entry.ETag)
+	expectNotModified(t, get(http.MethodGet, http.Header{"If-Modified-Since": {lastModified}}), entry.ETag)
+
+	earlier := updated.Add(-time.Minute).Format(http.TimeFormat)
+	if rec := get(http.MethodGet, http.Header{"If-Modified-Since": {earlier}}); rec.Code != http.StatusOK {
+		t.Errorf("Expected a route modified since to be sent, got %d", rec.Code)
+	}
+	if rec := get(http.MethodGet, http.Header{"If-None-Match": {`"stale"`}, "If-Modified-Since": {lastModified}}); rec.Code != http.StatusOK {
+		t.Errorf("Expected If-None-Match to take precedence over If-Modified-Since, got %d", rec.Code)
+	}
+	if rec := get(http.MethodGet, http.Header{"If-Modified-Since": {"yesterday"}}); rec.Code != http.StatusOK {
+		t.Errorf("Expected an invalid date ignored, got %d", rec.Code)
+	}
+}
+
+// TestETagPassthrough tests conditional requests reaching the upstream and
+// its validators and 304s reaching the client, with ETags weakened on
+// routes that rewrite the body
+func TestETagPassthrough(t *testing.T) {
+	modified := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", modified)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if etag.NotModified(r, `"v1"`, time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"a":{"b":1}}`))
+	}))
+	defer upstream.Close()
+
+	rewritten := egressRoute(2, "/rewritten", upstream.URL, nil)
+	rewritten.Transform = &transform.Rules{Response: &transform.Ops{Rename: map[string]string{"a.b": "c"}}}
+	h := egressHandler(t, &config.Load().Proxy, testMetrics(), nil, egressRoute(1, "/plain", upstream.URL, nil), rewritten)
+
+	plain := conditionalGet(h.Handle, "/plain", nil)
+	if plain.Code != http.StatusOK || plain.Header().Get("ETag") != `"v1"` || plain.Header().Get("Last-Modified") != modified {
+		t.Fatalf("Expected the upstream's validators passed through, got %d %v", plain.Code, plain.Header())
+	}
+
+	for _, header := range []http.Header{{"If-None-Match": {`"v1"`}}, {"If-Modified-Since": {modified}}} {
+		rec := conditionalGet(h.Handle, "/plain", header)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Fatalf("Expected the upstream's bodiless 304 for %v, got %d %q", header, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("ETag") != `"v1"` || rec.Header().Get("Cache-Control") != "max-age=60" {
+			t.Errorf("Expected the 304's headers passed through, got %v", rec.Header())
+		}
+	}
+
+	body := conditionalGet(h.Handle, "/rewritten", nil)
+	if got, _ := io.ReadAll(body.Body); !strings.Contains(string(got), `"c":1`) {
+		t.Fatalf("Expected the body rewritten, got %s", got)
+	}
+	if got := body.Header().Get("ETag"); got != `W/"v1"` {
+		t.Errorf("Expected the rewritten body's ETag weakened, got %q", got)
+	}
+	rec := conditionalGet(h.Handle, "/rewritten", http.Header{"If-None-Match": {`W/"v1"`}})
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != `W/"v1"` {
+		t.Errorf("Expected the weak ETag to revalidate with a weak 304, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
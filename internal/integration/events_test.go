@@ -0,0 +1,197 @@
+package integration
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// fakeHub records events delivered by the bus
+type fakeHub struct {
+	mu       sync.Mutex
+	received []events.Event
+}
+
+func (h *fakeHub) PublishEvent(event events.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.received = append(h.received, event)
+}
+
+func (h *fakeHub) types() []events.Type {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	types := make([]events.Type, 0, len(h.received))
+	for _, event := range h.received {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// TestEventPublishing tests that components publish events on the expected topics
+func TestEventPublishing(t *testing.T) {
+	log := logger.Get()
+
+	t.Run("BackendHealth", func(t *testing.T) {
+		bus := events.NewBus()
+		hub := &fakeHub{}
+		bus.Subscribe(hub.PublishEvent)
+
+		lb := loadbalancer.New(loadbalancer.RoundRobin, bus)
+		lb.AddBackend("http://backend-1")
+
+		lb.MarkHealthy("http://backend-1", false)
+		lb.MarkHealthy("http://backend-1", false) // no transition, no event
+		lb.MarkHealthy("http://backend-1", true)
+
+		got := hub.types()
+		if len(got) != 2 || got[0] != events.BackendUnhealthy || got[1] != events.BackendHealthy {
+			t.Errorf("Expected unhealthy then healthy events, got %v", got)
+		}
+	})
+
+	t.Run("CircuitBreakerTrip", func(t *testing.T) {
+		bus := events.NewBus()
+		hub := &fakeHub{}
+		bus.Subscribe(hub.PublishEvent)
+
+		cb := circuitbreaker.New(log, nil, bus)
+		for i := 0; i < 3; i++ {
+			cb.Execute("http://failing", func() (interface{}, error) {
+				return nil, errors.New("backend down")
+			})
+		}
+
+		got := hub.types()
+		if len(got) != 1 || got[0] != events.CircuitBreakerOpen {
+			t.Fatalf("Expected a single open event, got %v", got)
+		}
+		payload := hub.received[0].Payload.(map[string]string)
+		if payload["name"] != "http://failing" || payload["to"] != "open" {
+			t.Errorf("Unexpected payload: %v", payload)
+		}
+	})
+
+	t.Run("CacheCleared", func(t *testing.T) {
+		bus := events.NewBus()
+		hub := &fakeHub{}
+		bus.Subscribe(hub.PublishEvent)
+
+		cacheInstance := cache.New(&config.Load().Cache, log, bus)
+		defer cacheInstance.Stop()
+
+		cacheInstance.Set("key", "value")
+		cacheInstance.Clear()
+
+		got := hub.types()
+		if len(got) != 1 || got[0] != events.CacheCleared {
+			t.Errorf("Expected a cache cleared event, got %v", got)
+		}
+	})
+
+	t.Run("Unsubscribe", func(t *testing.T) {
+		bus := events.NewBus()
+		hub := &fakeHub{}
+		unsubscribe := bus.Subscribe(hub.PublishEvent)
+		unsubscribe()
+
+		bus.Publish(events.RouteCreated, nil)
+		if got := hub.types(); len(got) != 0 {
+			t.Errorf("Expected no events after unsubscribe, got %v", got)
+		}
+	})
+}
+
+// TestEventMatch tests subscription pattern matching
+func TestEventMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		event   events.Type
+		want    bool
+	}{
+		{"route.created", events.RouteCreated, true},
+		{"route.created", events.RouteDeleted, false},
+		{"route.*", events.RouteDeleted, true},
+		{"route.*", events.CacheCleared, false},
+		{"*", events.BackendHealthy, true},
+	}
+
+	for _, tt := range tests {
+		if got := events.Match(tt.pattern, tt.event); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.event, got, tt.want)
+		}
+	}
+}
+
+// TestWebSocketEventSubscription tests that clients only receive subscribed events
+func TestWebSocketEventSubscription(t *testing.T) {
+	hub, server := startHub(t, &config.Load().WebSocket)
+
+	bus := events.NewBus()
+	bus.Subscribe(hub.PublishEvent)
+
+	conn := dialHub(t, server, "?user=user-1")
+
+	err := conn.WriteJSON(websocket.Message{
+		Type:    websocket.MessageSubscribe,
+		Payload: websocket.Subscription{Events: []string{"backend.*"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	var msg websocket.Message
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != websocket.MessageSubscribed {
+		t.Fatalf("Expected subscription confirmation, got %+v (%v)", msg, err)
+	}
+
+	bus.Publish(events.RouteCreated, nil)
+	bus.Publish(events.BackendUnhealthy, map[string]string{"url": "http://backend-1"})
+
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	if msg.Type != string(events.BackendUnhealthy) {
+		t.Errorf("Expected %s, got %s", events.BackendUnhealthy, msg.Type)
+	}
+}
+
+// TestWebSocketForgedEvents tests that clients can't send gateway events or
+// hub messages to other clients, while their other messages are relayed
+func TestWebSocketForgedEvents(t *testing.T) {
+	_, server := startHub(t, &config.Load().WebSocket)
+
+	sender := dialHub(t, server, "?user=user-1")
+	receiver := dialHub(t, server, "?user=user-2")
+
+	for _, messageType := range []string{string(events.RouteDeleted), "route.forged", websocket.MessageShutdown} {
+		if err := sender.WriteJSON(websocket.Message{Type: messageType, Payload: map[string]int{"id": 1}}); err != nil {
+			t.Fatalf("Failed to send %s: %v", messageType, err)
+		}
+		var msg websocket.Message
+		if err := sender.ReadJSON(&msg); err != nil || msg.Type != websocket.MessageError {
+			t.Errorf("Expected %s refused with an error, got %+v (%v)", messageType, msg, err)
+		}
+	}
+	if err := sender.WriteJSON(websocket.Message{Type: "chat", Payload: "hello"}); err != nil {
+		t.Fatalf("Failed to send chat: %v", err)
+	}
+
+	// The relayed message is the first the other client gets
+	var msg websocket.Message
+	if err := receiver.ReadJSON(&msg); err != nil || msg.Type != "chat" {
+		t.Errorf("Expected only the chat message relayed, got %+v (%v)", msg, err)
+	}
+	if !events.IsGateway("route.forged") || events.IsGateway("chat") || events.IsGateway("routes") {
+		t.Error("Expected only gateway event namespaces reserved")
+	}
+}
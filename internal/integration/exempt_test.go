@@ -0,0 +1,170 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestPathMatcher tests matching paths against exempt prefixes
+func TestPathMatcher(t *testing.T) {
+	m := middleware.NewPathMatcher([]string{"/health", "metrics/", " ", "/api/status/"})
+	for path, want := range map[string]bool{
+		"/health":        true,
+		"/health/ready":  true,
+		"/healthz":       false,
+		"/metrics":       true,
+		"/api/status":    true,
+		"/api/statusbar": false,
+		"/":              false,
+		"/api/routes":    false,
+	} {
+		if got := m.Match(path); got != want {
+			t.Errorf("Expected %s matched %v, got %v", path, want, got)
+		}
+	}
+
+	var none *middleware.PathMatcher
+	if none.Match("/health") {
+		t.Error("Expected a nil matcher to match nothing")
+	}
+}
+
+// TestRateLimitExemptPaths tests that exempt paths skip the global rate limit
+// and that its exemptions can be set apart from the shared list
+func TestRateLimitExemptPaths(t *testing.T) {
+	// statuses sends n requests to path and returns their statuses
+	statuses := func(handler http.Handler, path string, n int) map[int]int {
+		got := make(map[int]int)
+		for i := 0; i < n; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			got[w.Code]++
+		}
+		return got
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		handler := testRouter(t, nil, func(cfg *config.Config) {
+			cfg.Auth.Enabled = false
+			cfg.Gateway.RateLimitEnabled = true
+			cfg.Gateway.RateLimitPerSecond = 2
+		})
+		if got := statuses(handler, "/health/live", 10); got[http.StatusTooManyRequests] != 0 {
+			t.Errorf("Expected health checks not to be rate limited, got %v", got)
+		}
+		if got := statuses(handler, "/api/status", 5); got[http.StatusTooManyRequests] != 3 {
+			t.Errorf("Expected 3 of 5 status requests rate limited, got %v", got)
+		}
+	})
+
+	t.Run("Override", func(t *testing.T) {
+		handler := testRouter(t, nil, func(cfg *config.Config) {
+			cfg.Auth.Enabled = false
+			cfg.Gateway.RateLimitEnabled = true
+			cfg.Gateway.RateLimitPerSecond = 2
+			cfg.Gateway.RateLimitExemptPaths = []string{"/api/status"}
+		})
+		if got := statuses(handler, "/api/status", 10); got[http.StatusTooManyRequests] != 0 {
+			t.Errorf("Expected the exempted path not to be rate limited, got %v", got)
+		}
+		if got := statuses(handler, "/health/live", 5); got[http.StatusTooManyRequests] != 3 {
+			t.Errorf("Expected health checks rate limited once no longer exempt, got %v", got)
+		}
+	})
+}
+
+// TestAuthExemptPaths tests that authentication exemptions apply apart from
+// the rate limit's
+func TestAuthExemptPaths(t *testing.T) {
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	get := func(handler http.Handler, path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	t.Run("Required", func(t *testing.T) {
+		handler := testRouter(t, authService, func(cfg *config.Config) {
+			cfg.Auth.Enabled = true
+			cfg.Gateway.RateLimitEnabled = true
+			cfg.Gateway.RateLimitExemptPaths = []string{"/api/users"}
+		})
+		if code := get(handler, "/api/users"); code != http.StatusUnauthorized {
+			t.Errorf("Expected a rate limit exemption to leave authentication on, got %d", code)
+		}
+	})
+
+	t.Run("Exempt", func(t *testing.T) {
+		handler := testRouter(t, authService, func(cfg *config.Config) {
+			cfg.Auth.Enabled = true
+			cfg.Gateway.RateLimitEnabled = false
+			cfg.Gateway.AuthExemptPaths = []string{"/api/users"}
+		})
+		if code := get(handler, "/api/users"); code == http.StatusUnauthorized || code == http.StatusForbidden {
+			t.Errorf("Expected the exempted path to skip authentication, got %d", code)
+		}
+		if code := get(handler, "/api/audit"); code != http.StatusUnauthorized {
+			t.Errorf("Expected other paths to require authentication, got %d", code)
+		}
+	})
+}
+
+// TestMetricsAuth tests protecting the metrics endpoint with its own token
+func TestMetricsAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	jwt, err := authService.IssueToken(auth.Claims{UserID: "admin", Roles: []string{"admin"}}, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	handler := middleware.MetricsAuth("scrape-token")(ok)
+	tests := []struct {
+		name   string
+		setup  func(*http.Request)
+		status int
+	}{
+		{"Missing", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"WrongBearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, http.StatusUnauthorized},
+		{"GatewayJWT", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+jwt) }, http.StatusUnauthorized},
+		{"Bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer scrape-token") }, http.StatusOK},
+		{"BasicAuth", func(r *http.Request) { r.SetBasicAuth("prometheus", "scrape-token") }, http.StatusOK},
+		{"WrongBasicAuth", func(r *http.Request) { r.SetBasicAuth("prometheus", "other") }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			tt.setup(req)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("Expected %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+
+	t.Run("Challenge", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if got := w.Header().Get("WWW-Authenticate"); got != `Basic realm="metrics"` {
+			t.Errorf("Expected a basic auth challenge, got %q", got)
+		}
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		middleware.MetricsAuth("")(ok).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected no token to leave metrics open, got %d", w.Code)
+		}
+	})
+}
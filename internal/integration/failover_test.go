@@ -0,0 +1,337 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// pickedURLs returns the backends GetBackend picks over n requests
+func pickedURLs(t *testing.T, lb *loadbalancer.LoadBalancer, n int) map[string]int {
+	t.Helper()
+	picked := make(map[string]int)
+	for i := 0; i < n; i++ {
+		backend, err := lb.GetBackend()
+		if err != nil {
+			t.Fatalf("Failed to get backend: %v", err)
+		}
+		picked[backend.URL]++
+	}
+	return picked
+}
+
+// TestPriorityTiers tests that the lowest tier with an available backend
+// takes all traffic, and that it takes it back once it recovers
+func TestPriorityTiers(t *testing.T) {
+	for _, strategy := range []loadbalancer.Strategy{loadbalancer.RoundRobin, loadbalancer.LeastConn} {
+		t.Run(string(strategy), func(t *testing.T) {
+			bus := events.NewBus()
+			var changes atomic.Int32
+			bus.Subscribe(func(event events.Event) {
+				if event.Type == events.BackendPriority {
+					changes.Add(1)
+				}
+			})
+
+			lb := loadbalancer.New(strategy, bus)
+			for _, url := range []string{"http://secondary:80", "http://primary-a:80", "http://primary-b:80"} {
+				lb.AddBackend(url)
+			}
+			lb.SetPriority("http://secondary:80", 1)
+
+			picked := pickedURLs(t, lb, 20)
+			if picked["http://secondary:80"] != 0 || len(picked) == 0 {
+				t.Errorf("Expected only tier 0 to be used, got %v", picked)
+			}
+			if strategy == loadbalancer.RoundRobin && len(picked) != 2 {
+				t.Errorf("Expected both tier 0 backends to share traffic, got %v", picked)
+			}
+
+			// Tier 0 fails: the secondary takes over
+			lb.MarkHealthy("http://primary-a:80", false)
+			lb.MarkHealthy("http://primary-b:80", false)
+			if picked := pickedURLs(t, lb, 10); picked["http://secondary:80"] != 10 {
+				t.Errorf("Expected tier 1 to take all traffic, got %v", picked)
+			}
+
+			// One tier 0 backend recovers: traffic returns
+			lb.MarkHealthy("http://primary-b:80", true)
+			if picked := pickedURLs(t, lb, 10); picked["http://primary-b:80"] != 10 {
+				t.Errorf("Expected traffic to return to tier 0, got %v", picked)
+			}
+
+			// Priorities change immediately
+			if !lb.SetPriority("http://secondary:80", -1) {
+				t.Fatal("Expected the backend to be found")
+			}
+			if picked := pickedURLs(t, lb, 10); picked["http://secondary:80"] != 10 {
+				t.Errorf("Expected the promoted backend to take all traffic, got %v", picked)
+			}
+			if lb.SetPriority("http://unknown:80", 1) {
+				t.Error("Expected an unknown backend not to be found")
+			}
+			if got := changes.Load(); got != 2 {
+				t.Errorf("Expected 2 priority change events, got %d", got)
+			}
+		})
+	}
+}
+
+// TestFailoverSelection tests the backend chosen when escalating tiers
+func TestFailoverSelection(t *testing.T) {
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	for _, url := range []string{"http://a:80", "http://b:80", "http://c:80", "http://d:80"} {
+		lb.AddBackend(url)
+	}
+	lb.SetPriority("http://b:80", 1)
+	lb.SetPriority("http://c:80", 2)
+	lb.SetPriority("http://d:80", 2)
+
+	first, _ := lb.GetBackend()
+	if first.URL != "http://a:80" {
+		t.Fatalf("Expected tier 0, got %s", first.URL)
+	}
+	second := lb.Failover(first)
+	if second == nil || second.URL != "http://b:80" {
+		t.Fatalf("Expected to fail over to tier 1, got %v", second)
+	}
+
+	// Unavailable tiers are skipped
+	lb.MarkHealthy("http://b:80", false)
+	if next := lb.Failover(first); next == nil || next.Priority != 2 {
+		t.Errorf("Expected to skip the unhealthy tier, got %v", next)
+	}
+	third := lb.Failover(second)
+	if third == nil || third.Priority != 2 {
+		t.Fatalf("Expected tier 2, got %v", third)
+	}
+	if last := lb.Failover(third); last != nil {
+		t.Errorf("Expected no tier after the last, got %s", last.URL)
+	}
+
+	tiers := lb.Tiers()
+	if len(tiers) != 3 {
+		t.Fatalf("Expected 3 tiers, got %v", tiers)
+	}
+	if tiers[0]["priority"] != 0 || tiers[0]["active"] != true || tiers[1]["healthy"] != 0 || tiers[2]["backends"] != 2 {
+		t.Errorf("Unexpected tiers %v", tiers)
+	}
+}
+
+// TestProxyFailover tests which failures move a request on to the next attempt
+func TestProxyFailover(t *testing.T) {
+	log := logger.Get()
+	p := proxy.New(5*time.Second, &config.Load().Proxy, log)
+
+	upstream := func(status int, body string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", body)
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	forwardTo := func(r *http.Request, target string) proxy.Attempt {
+		return func(ctx context.Context, w http.ResponseWriter) (int, error) {
+			return p.ForwardAndCopy(ctx, w, r, target)
+		}
+	}
+	breakerOpen := func(ctx context.Context, w http.ResponseWriter) (int, error) {
+		return 0, errors.New("circuit breaker is open")
+	}
+
+	tests := []struct {
+		name     string
+		first    func(r *http.Request) proxy.Attempt
+		fallback string
+		status   int
+		body     string
+		attempts int
+	}{
+		{"Unavailable", func(r *http.Request) proxy.Attempt { return forwardTo(r, upstream(503, "primary")) }, upstream(200, "secondary"), 200, "secondary", 2},
+		{"GatewayTimeout", func(r *http.Request) proxy.Attempt { return forwardTo(r, upstream(504, "primary")) }, upstream(200, "secondary"), 200, "secondary", 2},
+		{"ConnectError", func(r *http.Request) proxy.Attempt { return forwardTo(r, down.URL) }, upstream(200, "secondary"), 200, "secondary", 2},
+		{"BreakerOpen", func(r *http.Request) proxy.Attempt { return breakerOpen }, upstream(200, "secondary"), 200, "secondary", 2},
+		{"ServerError", func(r *http.Request) proxy.Attempt { return forwardTo(r, upstream(500, "primary")) }, upstream(200, "secondary"), 500, "primary", 1},
+		{"NotFound", func(r *http.Request) proxy.Attempt { return forwardTo(r, upstream(404, "primary")) }, upstream(200, "secondary"), 404, "primary", 1},
+		{"AllDown", func(r *http.Request) proxy.Attempt { return forwardTo(r, upstream(503, "primary")) }, upstream(503, "secondary"), 503, "secondary", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/orders", nil)
+			w := httptest.NewRecorder()
+			fallback := forwardTo(r, tt.fallback)
+			next := func() proxy.Attempt {
+				attempt := fallback
+				fallback = nil
+				return attempt
+			}
+
+			result := p.Failover(r.Context(), w, tt.first(r), next)
+			if w.Code != tt.status || result.Status != tt.status {
+				t.Errorf("Expected status %d, got %d (result %d)", tt.status, w.Code, result.Status)
+			}
+			if w.Body.String() != tt.body || w.Header().Get("X-Upstream") != tt.body {
+				t.Errorf("Expected the %s response, got %q", tt.body, w.Body.String())
+			}
+			if result.Attempts != tt.attempts {
+				t.Errorf("Expected %d attempts, got %d", tt.attempts, result.Attempts)
+			}
+		})
+	}
+}
+
+// TestBackendPriorityAPI tests changing a backend's priority over the admin API
+func TestBackendPriorityAPI(t *testing.T) {
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	lb.AddBackend("http://primary:80")
+	lb.AddBackend("http://secondary:80")
+	handler := handlers.NewBackendHandler(lb, time.Minute, logger.Get())
+
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.SetPriority(w, httptest.NewRequest("PUT", "/api/admin/backends/priority", strings.NewReader(body)))
+		return w
+	}
+
+	for body, status := range map[string]int{
+		`{"url": "http://primary:80"}`: http.StatusBadRequest,
+		`{"priority": 1}`:              http.StatusBadRequest,
+		`not json`:                     http.StatusBadRequest,
+		`{"url": "http://unknown:80", "priority": 1}`:  http.StatusNotFound,
+		`{"url": "http://primary:80", "priority": 10}`: http.StatusOK,
+	} {
+		if w := send(body); w.Code != status {
+			t.Errorf("Expected status %d for %s, got %d", status, body, w.Code)
+		}
+	}
+
+	if picked := pickedURLs(t, lb, 5); picked["http://secondary:80"] != 5 {
+		t.Errorf("Expected the demoted backend to stop taking traffic, got %v", picked)
+	}
+
+	// The status endpoint lists the tiers
+	router := testRouter(t, auth.NewAuthService("test-secret", logger.Get()), func(cfg *config.Config) {
+		cfg.Auth.Enabled = false
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/load-balancer/status", nil))
+	var status struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status.Data["tiers"] == nil {
+		t.Errorf("Expected the status to list tiers, got %s", w.Body.String())
+	}
+}
+
+// TestRouteFailover tests that a load-balanced route fails over to the next
+// tier while the primary is down and moves back once it recovers
+func TestRouteFailover(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	var primaryDown atomic.Bool
+	var primaryHits, secondaryHits atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		if primaryDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryHits.Add(1)
+		w.Write([]byte("secondary"))
+	}))
+	defer secondary.Close()
+
+	repo := database.NewRouteRepository(db)
+	route := &database.Route{
+		Path:         fmt.Sprintf("/failover-%d", time.Now().UnixNano()),
+		TargetURL:    "http://localhost:9001",
+		Method:       "GET",
+		Enabled:      true,
+		Timeout:      30,
+		LoadBalanced: true,
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	lb.AddBackend(primary.URL)
+	lb.AddBackend(secondary.URL)
+	lb.SetPriority(secondary.URL, 1)
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		lb,
+		nil,
+		nil,
+		m,
+		log,
+	)
+
+	send := func() string {
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", route.Path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	if got := send(); got != "primary" || secondaryHits.Load() != 0 {
+		t.Fatalf("Expected tier 0 to answer while up, got %q", got)
+	}
+
+	primaryDown.Store(true)
+	for i := 0; i < 3; i++ {
+		if got := send(); got != "secondary" {
+			t.Fatalf("Expected tier 1 to answer while tier 0 is down, got %q", got)
+		}
+	}
+	if got := testutil.ToFloat64(m.Failovers.WithLabelValues(route.Path)); got != 3 {
+		t.Errorf("Expected 3 failovers, got %v", got)
+	}
+
+	primaryDown.Store(false)
+	before := secondaryHits.Load()
+	if got := send(); got != "primary" || secondaryHits.Load() != before {
+		t.Errorf("Expected traffic to return to tier 0 once it recovered, got %q", got)
+	}
+}
@@ -0,0 +1,277 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/geoip"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// testGeoIPDatabase is MaxMind's GeoLite2 country test database, from
+// https://github.com/maxmind/MaxMind-DB/tree/main/test-data
+const testGeoIPDatabase = "testdata/GeoLite2-Country-Test.mmdb"
+
+// Addresses of the test database
+const (
+	geoGB = "81.2.69.142"
+	geoSE = "89.160.20.112"
+	geoUS = "216.160.83.56"
+)
+
+// openGeoIP opens the test database
+func openGeoIP(t *testing.T) *geoip.DB {
+	t.Helper()
+
+	db, err := geoip.Open(testGeoIPDatabase, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to open GeoIP database: %v", err)
+	}
+	t.Cleanup(db.Stop)
+	return db
+}
+
+// TestGeoIPLookup tests resolving addresses to country codes
+func TestGeoIPLookup(t *testing.T) {
+	db := openGeoIP(t)
+
+	for ip, want := range map[string]string{
+		geoGB:                   "GB",
+		geoSE:                   "SE",
+		geoUS:                   "US",
+		"::ffff:" + geoGB:       "GB",
+		"2001:218::1":           "JP",
+		"127.0.0.1":             "",
+		"10.1.2.3":              "",
+		"2001:db8::1":           "",
+		"2.125.160.216":         "GB",
+		"2001:250:ffff:ffff::1": "CN",
+	} {
+		if got := db.Country(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("Country(%s) = %q, want %q", ip, got, want)
+		}
+	}
+
+	if _, err := geoip.Open(filepath.Join(t.TempDir(), "missing.mmdb"), logger.Get()); err == nil {
+		t.Error("Expected a missing database file to fail")
+	}
+}
+
+// TestGeoIPReload tests that a changed file is reloaded and that a broken
+// one leaves the loaded database in use
+func TestGeoIPReload(t *testing.T) {
+	data, err := os.ReadFile(testGeoIPDatabase)
+	if err != nil {
+		t.Fatalf("Failed to read test database: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geoip.Open(path, logger.Get()); err == nil {
+		t.Fatal("Expected an invalid database file to fail")
+	}
+
+	os.WriteFile(path, data, 0o644)
+	db, err := geoip.Open(path, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to open GeoIP database: %v", err)
+	}
+	defer db.Stop()
+
+	if reloaded, err := db.Reload(); reloaded || err != nil {
+		t.Errorf("Expected an unchanged file to be left alone, got %v %v", reloaded, err)
+	}
+
+	os.WriteFile(path, []byte("truncated"), 0o644)
+	if _, err := db.Reload(); err == nil {
+		t.Error("Expected a broken file to fail to reload")
+	}
+	if got := db.Country(netip.MustParseAddr(geoGB)); got != "GB" {
+		t.Errorf("Expected the previous database kept, got %q", got)
+	}
+
+	os.WriteFile(path, data, 0o644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if reloaded, err := db.Reload(); !reloaded || err != nil {
+		t.Errorf("Expected the fixed file to be reloaded, got %v %v", reloaded, err)
+	}
+
+	// Periodic checks back off while the file is broken
+	db.Start(10 * time.Millisecond)
+	os.WriteFile(path, []byte("truncated"), 0o644)
+	waitFor(t, func() bool { return db.Schedule().State().Failures >= 2 })
+	os.WriteFile(path, data, 0o644)
+	later = later.Add(time.Minute)
+	os.Chtimes(path, later, later)
+	waitFor(t, func() bool { return db.Schedule().State().Failures == 0 })
+}
+
+// TestGeoIPMiddleware tests that the client country is stored in the request
+// context and counted with a bounded number of labels
+func TestGeoIPMiddleware(t *testing.T) {
+	db := openGeoIP(t)
+	m := testMetrics()
+
+	var seen []string
+	handler := middleware.GeoIP(db, m, metrics.NewLabelGuard(1, "other", nil))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		country, ok := geoip.CountryFromContext(r.Context())
+		if !ok {
+			t.Error("Expected the country to be looked up")
+		}
+		seen = append(seen, country)
+	}))
+
+	for _, ip := range []string{geoGB, geoGB, geoSE, "10.0.0.1"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":4321"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if strings.Join(seen, ",") != "GB,GB,SE," {
+		t.Errorf("Unexpected countries %v", seen)
+	}
+	for label, want := range map[string]float64{"GB": 2, "other": 1, middleware.UnknownCountry: 1} {
+		if got := testutil.ToFloat64(m.CountryRequests.WithLabelValues(label)); got != want {
+			t.Errorf("Expected %v requests labelled %s, got %v", want, label, got)
+		}
+	}
+
+	t.Run("NoMetrics", func(t *testing.T) {
+		m := testMetrics()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = geoGB + ":4321"
+		middleware.GeoIP(db, m, nil)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+		if got := testutil.CollectAndCount(m.CountryRequests); got != 0 {
+			t.Errorf("Expected no country labels without the metrics option, got %d", got)
+		}
+	})
+}
+
+// TestGeoIPCheck tests route country lists
+func TestGeoIPCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		country     string
+		allow, deny []string
+		allowed     bool
+		reason      string
+	}{
+		{"NoLists", "GB", nil, nil, true, ""},
+		{"UnknownNoLists", "", nil, nil, true, ""},
+		{"Denied", "GB", nil, []string{"GB", "FR"}, false, geoip.ReasonCountryDenied},
+		{"NotDenied", "SE", nil, []string{"GB"}, true, ""},
+		{"Allowed", "SE", []string{"SE"}, nil, true, ""},
+		{"NotAllowed", "GB", []string{"SE"}, nil, false, geoip.ReasonCountryNotAllowed},
+		{"UnknownNotAllowed", "", []string{"SE"}, nil, false, geoip.ReasonCountryNotAllowed},
+		{"DenyWins", "SE", []string{"SE"}, []string{"SE"}, false, geoip.ReasonCountryDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, reason := geoip.Check(tt.country, tt.allow, tt.deny)
+			if allowed != tt.allowed || reason != tt.reason {
+				t.Errorf("Expected %v %q, got %v %q", tt.allowed, tt.reason, allowed, reason)
+			}
+		})
+	}
+
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+	for _, body := range []string{
+		`{"path":"/a","target_url":"http://api/a","country_deny":["USA"]}`,
+		`{"path":"/a","target_url":"http://api/a","country_allow":["G1"]}`,
+	} {
+		w := httptest.NewRecorder()
+		routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "country") {
+			t.Errorf("Expected %s refused, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestRouteCountryLists tests that routes refuse clients from blocked
+// countries with 403 and that request logs record the client's country
+func TestRouteCountryLists(t *testing.T) {
+	db := testDatabase(t)
+	geo := openGeoIP(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	repo := database.NewRouteRepository(db)
+	route := &database.Route{
+		Path:        fmt.Sprintf("/geo-%d", time.Now().UnixNano()),
+		TargetURL:   backend.URL,
+		Method:      "GET",
+		Enabled:     true,
+		Timeout:     30,
+		CountryDeny: []string{"gb"},
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	handler := middleware.GeoIP(geo, m, nil)(http.HandlerFunc(proxyHandler.Handle))
+
+	send := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", route.Path, nil)
+		req.RemoteAddr = ip + ":4321"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(geoGB); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), response.CodeAccessDenied) {
+		t.Errorf("Expected a client from a denied country refused, got %d %s", w.Code, w.Body.String())
+	}
+	if got := testutil.ToFloat64(m.ACLBlocked.WithLabelValues("route", geoip.ReasonCountryDenied)); got != 1 {
+		t.Errorf("Expected the refusal to be counted, got %v", got)
+	}
+	if w := send(geoSE); w.Code != http.StatusOK {
+		t.Errorf("Expected a client from another country through, got %d", w.Code)
+	}
+
+	logs := database.NewRequestLogRepository(db)
+	waitFor(t, func() bool {
+		found, err := logs.FindByFilter(context.Background(), database.RequestLogFilter{RouteID: &route.ID, Country: "SE"})
+		return err == nil && len(found) == 1
+	})
+}
@@ -0,0 +1,155 @@
+package integration
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// startGRPCGateway starts a plaintext gRPC health server and an HTTPS gateway
+// forwarding every method to it over h2c, and returns a client for the gateway
+func startGRPCGateway(t *testing.T) (*health.Server, healthpb.HealthClient) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	log := logger.Get()
+	p := proxy.New(0, &config.Load().Proxy, log)
+	upstream := "http://" + lis.Addr().String()
+
+	gateway := httptest.NewUnstartedServer(middleware.Logger(log, nil, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ForwardAndCopy(proxy.WithH2C(r.Context()), w, r, upstream+r.URL.Path)
+	})))
+	gateway.EnableHTTP2 = true
+	gateway.StartTLS()
+	t.Cleanup(gateway.Close)
+
+	creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	conn, err := grpc.NewClient(strings.TrimPrefix(gateway.URL, "https://"), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatalf("Failed to dial the gateway: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return healthServer, healthpb.NewHealthClient(conn)
+}
+
+// TestGRPCProxy tests unary and streaming gRPC calls through the gateway
+func TestGRPCProxy(t *testing.T) {
+	healthServer, client := startGRPCGateway(t)
+	healthServer.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "echo"})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING, got %v", resp.Status)
+	}
+
+	t.Run("StatusTrailers", func(t *testing.T) {
+		// grpc-status and grpc-message arrive as trailers
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "missing"})
+		st, _ := status.FromError(err)
+		if st.Code() != codes.NotFound || st.Message() != "unknown service" {
+			t.Errorf("Expected NotFound \"unknown service\", got %v %q", st.Code(), st.Message())
+		}
+	})
+
+	t.Run("ServerStreaming", func(t *testing.T) {
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "echo"})
+		if err != nil {
+			t.Fatalf("Watch failed: %v", err)
+		}
+
+		// Each update must be flushed through the gateway as it happens
+		first, err := stream.Recv()
+		if err != nil || first.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("Expected SERVING, got %v (%v)", first, err)
+		}
+		healthServer.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+		second, err := stream.Recv()
+		if err != nil || second.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Fatalf("Expected NOT_SERVING, got %v (%v)", second, err)
+		}
+	})
+}
+
+// TestProxyTrailers tests that HTTP/1.1 response trailers reach the client
+func TestProxyTrailers(t *testing.T) {
+	p := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+	gateway := startProxy(t, p, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "payload")
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Set(http.TrailerPrefix+"X-Undeclared", "late")
+	})
+
+	resp, err := http.Get(gateway.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	io.ReadAll(resp.Body)
+
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Errorf("Expected the declared trailer, got %q", got)
+	}
+	if got := resp.Trailer.Get("X-Undeclared"); got != "late" {
+		t.Errorf("Expected the undeclared trailer, got %q", got)
+	}
+}
+
+// TestH2CRouteValidation tests that h2c routes must use plaintext targets
+func TestH2CRouteValidation(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	for name, body := range map[string]string{
+		"HTTPSTarget": `{"path":"/a","target_url":"https://grpc.internal/a","h2c":true}`,
+		"HTTPSCanary": `{"path":"/a","target_url":"http://grpc.internal/a","canary_target_url":"https://canary/a","h2c":true}`,
+		"WithTLS":     `{"path":"/a","target_url":"http://grpc.internal/a","h2c":true,"tls":{"server_name":"grpc.internal"}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(body)))
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), response.CodeValidationFailed) {
+				t.Errorf("Expected 400 %s, got %d %s", response.CodeValidationFailed, w.Code, w.Body.String())
+			}
+		})
+	}
+}
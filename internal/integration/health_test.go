@@ -0,0 +1,144 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/health"
+)
+
+// TestHealthProbes tests liveness, readiness and strict health semantics
+func TestHealthProbes(t *testing.T) {
+	var down atomic.Bool
+	newChecker := func() *health.Checker {
+		checker := health.New(0, time.Second)
+		checker.Register("database", func(ctx context.Context) error {
+			if down.Load() {
+				return errors.New("connection refused")
+			}
+			return nil
+		})
+		checker.Register("cache", func(ctx context.Context) error { return nil })
+		return checker
+	}
+	handler := handlers.NewHealthHandler(newChecker(), newChecker())
+
+	serve := func(h http.HandlerFunc, target string) (int, health.Report) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", target, nil))
+
+		var resp struct {
+			Data health.Report `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Data
+	}
+
+	down.Store(true)
+	t.Run("LiveIgnoresDependencies", func(t *testing.T) {
+		if code, _ := serve(handler.Live, "/health/live"); code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", code)
+		}
+	})
+
+	t.Run("ReadyFailsWithDatabaseDown", func(t *testing.T) {
+		code, report := serve(handler.Ready, "/health/ready")
+		if code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected status 503, got %d", code)
+		}
+		if report.Checks["database"] != health.Unhealthy || report.Checks["cache"] != health.Healthy {
+			t.Errorf("Unexpected checks: %v", report.Checks)
+		}
+	})
+
+	t.Run("HealthDegraded", func(t *testing.T) {
+		code, report := serve(handler.Health, "/health")
+		if code != http.StatusOK || report.Status != health.StatusDegraded {
+			t.Errorf("Expected 200 degraded, got %d %s", code, report.Status)
+		}
+
+		if code, _ := serve(handler.Health, "/health?strict=true"); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected strict status 503, got %d", code)
+		}
+	})
+
+	down.Store(false)
+	t.Run("ReadyWithDatabaseUp", func(t *testing.T) {
+		if code, _ := serve(handler.Ready, "/health/ready"); code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", code)
+		}
+	})
+}
+
+// TestHealthCheckCaching tests that check results are reused within the TTL
+func TestHealthCheckCaching(t *testing.T) {
+	var calls atomic.Int32
+	checker := health.New(time.Hour, time.Second)
+	checker.Register("database", func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	})
+
+	for i := 0; i < 10; i++ {
+		if report := checker.Check(context.Background()); !report.OK() {
+			t.Fatalf("Expected healthy report, got %+v", report)
+		}
+	}
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Expected 1 check run, got %d", got)
+	}
+}
+
+// TestHealthCheckCancelledCaller tests that probes missing the cache share one
+// run, and that a probe giving up doesn't cache a degraded report for the
+// probes after it
+func TestHealthCheckCancelledCaller(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	checker := health.New(time.Hour, time.Second)
+	checker.Register("database", func(ctx context.Context) error {
+		calls.Add(1)
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan health.Report)
+	go func() { abandoned <- checker.Check(ctx) }()
+	waitFor(t, func() bool { return calls.Load() == 1 })
+
+	reports := make(chan health.Report, 3)
+	for i := 0; i < 3; i++ {
+		go func() { reports <- checker.Check(context.Background()) }()
+	}
+
+	cancel()
+	if report := <-abandoned; report.OK() {
+		t.Errorf("Expected the cancelled probe reported degraded, got %+v", report)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if report := <-reports; !report.OK() {
+			t.Errorf("Expected the shared run healthy, got %+v", report)
+		}
+	}
+	if report := checker.Check(context.Background()); !report.OK() {
+		t.Errorf("Expected the healthy report cached, got %+v", report)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Expected 1 check run, got %d", got)
+	}
+}
@@ -0,0 +1,238 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// slowBackend answers after delay and counts requests cancelled before then
+type slowBackend struct {
+	*httptest.Server
+	requests  atomic.Int64
+	cancelled atomic.Int64
+}
+
+func newSlowBackend(t *testing.T, name string, delay time.Duration) *slowBackend {
+	t.Helper()
+
+	b := &slowBackend{}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.requests.Add(1)
+		select {
+		case <-time.After(delay):
+			w.Header().Set("X-Backend", name)
+			io.WriteString(w, name)
+		case <-r.Context().Done():
+			b.cancelled.Add(1)
+		}
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+// TestProxyHedge tests that the first response wins and the other attempt is cancelled
+func TestProxyHedge(t *testing.T) {
+	cfg := config.Load().Proxy
+	p := proxy.New(5*time.Second, &cfg, logger.Get())
+
+	attempt := func(target string) proxy.Attempt {
+		return func(ctx context.Context, w http.ResponseWriter) (int, error) {
+			return p.ForwardAndCopy(ctx, w, httptest.NewRequest("GET", "/", nil), target)
+		}
+	}
+	hedgeTo := func(target string) func() proxy.Attempt {
+		return func() proxy.Attempt { return attempt(target) }
+	}
+
+	t.Run("FastHedgeWins", func(t *testing.T) {
+		slow := newSlowBackend(t, "slow", 2*time.Second)
+		fast := newSlowBackend(t, "fast", 0)
+
+		w := httptest.NewRecorder()
+		start := time.Now()
+		result := p.Hedge(context.Background(), w, "/hedge", 20*time.Millisecond, attempt(slow.URL), hedgeTo(fast.URL))
+
+		if !result.Hedged || result.Winner != 1 || result.Status != http.StatusOK || result.Err != nil {
+			t.Fatalf("Expected the hedge to win, got %+v", result)
+		}
+		if w.Body.String() != "fast" || w.Header().Get("X-Backend") != "fast" {
+			t.Errorf("Expected only the fast response, got %q %v", w.Body.String(), w.Header())
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("Expected the hedge to answer quickly, took %v", time.Since(start))
+		}
+		waitFor(t, func() bool { return slow.cancelled.Load() == 1 })
+	})
+
+	t.Run("FastPrimaryNotHedged", func(t *testing.T) {
+		fast := newSlowBackend(t, "fast", 0)
+		other := newSlowBackend(t, "other", 0)
+
+		w := httptest.NewRecorder()
+		result := p.Hedge(context.Background(), w, "/hedge", 500*time.Millisecond, attempt(fast.URL), hedgeTo(other.URL))
+		if result.Hedged || result.Winner != 0 || w.Body.String() != "fast" {
+			t.Errorf("Expected the primary to answer alone, got %+v %q", result, w.Body.String())
+		}
+		if other.requests.Load() != 0 {
+			t.Error("Expected no hedge to be sent")
+		}
+	})
+
+	t.Run("FailedHedgeIgnored", func(t *testing.T) {
+		slow := newSlowBackend(t, "slow", 100*time.Millisecond)
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+
+		w := httptest.NewRecorder()
+		result := p.Hedge(context.Background(), w, "/hedge", 10*time.Millisecond, attempt(slow.URL), hedgeTo(closed.URL))
+		if !result.Hedged || result.Winner != 0 || w.Code != http.StatusOK || w.Body.String() != "slow" {
+			t.Errorf("Expected the primary to answer after the hedge failed, got %+v %d %q", result, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("AllFailed", func(t *testing.T) {
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+
+		w := httptest.NewRecorder()
+		result := p.Hedge(context.Background(), w, "/hedge", time.Millisecond, attempt(closed.URL), hedgeTo(closed.URL))
+		if result.Err == nil || w.Code != http.StatusBadGateway || strings.Count(w.Body.String(), response.CodeBadGateway) != 1 {
+			t.Errorf("Expected a single 502 response, got %+v %d %q", result, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Capped", func(t *testing.T) {
+		capped := cfg
+		capped.HedgeMaxInflight = 1
+		p := proxy.New(5*time.Second, &capped, logger.Get())
+		slow := newSlowBackend(t, "slow", 300*time.Millisecond)
+		hedges := newSlowBackend(t, "hedge", 300*time.Millisecond)
+
+		attempt := func(target string) proxy.Attempt {
+			return func(ctx context.Context, w http.ResponseWriter) (int, error) {
+				return p.ForwardAndCopy(ctx, w, httptest.NewRequest("GET", "/", nil), target)
+			}
+		}
+
+		var wg sync.WaitGroup
+		results := make([]proxy.HedgeResult, 2)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = p.Hedge(context.Background(), httptest.NewRecorder(), "/capped", 20*time.Millisecond, attempt(slow.URL), func() proxy.Attempt {
+					return attempt(hedges.URL)
+				})
+			}(i)
+		}
+		wg.Wait()
+
+		if results[0].Capped == results[1].Capped || results[0].Hedged == results[1].Hedged {
+			t.Errorf("Expected exactly one of two concurrent requests to hedge, got %+v", results)
+		}
+		if hedges.requests.Load() != 1 {
+			t.Errorf("Expected one hedge, got %d", hedges.requests.Load())
+		}
+	})
+}
+
+// TestHedgeRouteValidation tests that hedging is limited to load-balanced GET routes
+func TestHedgeRouteValidation(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	for name, body := range map[string]string{
+		"Negative":        `{"path":"/a","target_url":"http://api/a","load_balanced":true,"hedge_delay":-1}`,
+		"NotLoadBalanced": `{"path":"/a","target_url":"http://api/a","hedge_delay":50}`,
+		"Post":            `{"path":"/a","target_url":"http://api/a","method":"POST","load_balanced":true,"hedge_delay":50}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(body)))
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), response.CodeValidationFailed) {
+				t.Errorf("Expected 400 %s, got %d %s", response.CodeValidationFailed, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestRouteHedging tests hedged GETs across load-balanced backends
+func TestRouteHedging(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	slow := newSlowBackend(t, "slow", 2*time.Second)
+	fast := newSlowBackend(t, "fast", 0)
+
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	lb.AddBackend(slow.URL)
+	lb.AddBackend(fast.URL)
+
+	path := fmt.Sprintf("/hedged-%d", time.Now().UnixNano())
+	route := &database.Route{Path: path, TargetURL: "http://upstream" + path, Method: "GET", Enabled: true, Timeout: 30, LoadBalanced: true, HedgeDelay: 20}
+	repo := database.NewRouteRepository(db)
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		lb,
+		nil,
+		nil,
+		m,
+		log,
+	)
+
+	won := testutil.ToFloat64(m.HedgedRequests.WithLabelValues(path, "hedge"))
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != "fast" {
+			t.Errorf("Expected the fast backend to answer, got %d %q", w.Code, w.Body.String())
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("Expected a fast answer, took %v", time.Since(start))
+		}
+	}
+
+	// Every request started on the slow backend is rescued by a hedge
+	started := slow.requests.Load()
+	if started == 0 {
+		t.Fatal("Expected some requests to start on the slow backend")
+	}
+	if got := testutil.ToFloat64(m.HedgedRequests.WithLabelValues(path, "hedge")) - won; got != float64(started) {
+		t.Errorf("Expected %d hedge wins, got %v", started, got)
+	}
+	waitFor(t, func() bool { return slow.cancelled.Load() == started })
+}
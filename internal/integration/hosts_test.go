@@ -0,0 +1,189 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/matcher"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestMatchHost tests picking a path's route by request host: exact hosts
+// over wildcards, longer wildcards over shorter ones, and routes without a
+// host last
+func TestMatchHost(t *testing.T) {
+	m := matcher.New([]database.Route{
+		{ID: 1, Path: "/api", Method: "GET", Enabled: true},
+		{ID: 2, Path: "/api", Method: "GET", Host: "*.example.com", Enabled: true},
+		{ID: 3, Path: "/api", Method: "GET", Host: "*.eu.example.com", Enabled: true},
+		{ID: 4, Path: "/api", Method: "GET", Host: "api.example.com", Enabled: true},
+		{ID: 5, Path: "/only", Method: "GET", Host: "shop.example.com", Enabled: true},
+		{ID: 6, Path: "/methods", Method: "POST", Host: "api.example.com", Enabled: true},
+		{ID: 7, Path: "/methods", Method: "GET", Enabled: true},
+	})
+
+	tests := []struct {
+		method, host, path string
+		id                 int
+	}{
+		{"GET", "api.example.com", "/api", 4},
+		{"GET", "API.Example.com:8080", "/api", 4},
+		{"GET", "api.example.com.", "/api", 4},
+		{"GET", "www.example.com", "/api", 2},
+		{"GET", "a.b.example.com", "/api", 2},
+		{"GET", "fr.eu.example.com", "/api", 3},
+		{"GET", "eu.example.com", "/api", 2},
+		{"GET", "example.com", "/api", 1},
+		{"GET", "other.org", "/api", 1},
+		{"GET", "", "/api", 1},
+		{"GET", "shop.example.com", "/only", 5},
+		{"GET", "other.org", "/only", 0},
+		// The most specific host wins even when another host serves the method
+		{"GET", "api.example.com", "/methods", 0},
+		{"GET", "other.org", "/methods", 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.host+tt.path, func(t *testing.T) {
+			route, ok := m.Match(tt.method, tt.host, tt.path)
+			switch {
+			case tt.id == 0 && ok:
+				t.Errorf("Expected no route, got %d", route.ID)
+			case tt.id != 0 && (!ok || route.ID != tt.id):
+				t.Errorf("Expected route %d, got %+v", tt.id, route)
+			}
+		})
+	}
+}
+
+// TestHostValidation tests that routes with malformed hosts are refused
+// before they reach the database
+func TestHostValidation(t *testing.T) {
+	for pattern, want := range map[string]bool{
+		"example.com":      true,
+		"api.Example.com":  true,
+		"*.example.com":    true,
+		"localhost":        true,
+		"*":                false,
+		"*.":               false,
+		"api.*.com":        false,
+		"**.example.com":   false,
+		"example..com":     false,
+		"-api.example.com": false,
+		"example.com:8080": false,
+		"exa_mple.com":     false,
+		"http://a.com":     false,
+	} {
+		if got := database.ValidHostPattern(pattern); got != want {
+			t.Errorf("ValidHostPattern(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+
+	handler := testRouter(t, nil, func(cfg *config.Config) {})
+	w := sendJSON(handler, "POST", "/api/routes", map[string]any{"path": "/a", "target_url": "http://a", "method": "GET", "host": "*.*.example.com"})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "host") {
+		t.Errorf("Expected an invalid host refused, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// TestPreserveHost tests that the client's Host header reaches the upstream
+// only when the route asks for it
+func TestPreserveHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+
+	p := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+	for _, preserve := range []bool{false, true} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "shop.example.com"
+		ctx := req.Context()
+		if preserve {
+			ctx = proxy.WithPreserveHost(ctx)
+		}
+
+		w := httptest.NewRecorder()
+		p.ForwardAndCopy(ctx, w, req, backend.URL)
+
+		want := strings.TrimPrefix(backend.URL, "http://")
+		if preserve {
+			want = "shop.example.com"
+		}
+		if w.Body.String() != want {
+			t.Errorf("Expected Host %q with preserve_host %v, got %q", want, preserve, w.Body.String())
+		}
+	}
+}
+
+// TestHostRouting tests that requests for the same path with different Host
+// headers reach the routes for their hosts
+func TestHostRouting(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.URL.Path, r.Host)
+	}))
+	defer backend.Close()
+
+	repo := database.NewRouteRepository(db)
+	path := fmt.Sprintf("/hosts-%d", time.Now().UnixNano())
+	for _, route := range []*database.Route{
+		{Path: path, TargetURL: backend.URL + "/any", Method: "GET", Enabled: true, Timeout: 30},
+		{Path: path, TargetURL: backend.URL + "/wildcard", Method: "GET", Enabled: true, Timeout: 30, Host: "*.example.com"},
+		{Path: path, TargetURL: backend.URL + "/exact", Method: "GET", Enabled: true, Timeout: 30, Host: "api.example.com", PreserveHost: true},
+	} {
+		if err := repo.Create(context.Background(), route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		defer repo.Delete(context.Background(), route.ID)
+	}
+
+	duplicate := &database.Route{Path: path, TargetURL: backend.URL, Method: "GET", Host: "api.example.com"}
+	if err := repo.Create(context.Background(), duplicate); err == nil {
+		repo.Delete(context.Background(), duplicate.ID)
+		t.Errorf("Expected a second route for the same host, path and method refused")
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	m := testMetrics()
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+	for host, want := range map[string]string{
+		"api.example.com:8080": "/exact api.example.com:8080",
+		"www.example.com":      "/wildcard " + backendHost,
+		"example.org":          "/any " + backendHost,
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, req)
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("Expected %s answered by %q, got %d %q", host, want, w.Code, w.Body.String())
+		}
+	}
+}
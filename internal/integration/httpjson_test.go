@@ -0,0 +1,139 @@
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/pkg/httpjson"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// jsonPayload is the document decoded in the httpjson tests
+type jsonPayload struct {
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+	Nested struct {
+		Enabled bool `json:"enabled"`
+	} `json:"nested"`
+	Tags []string `json:"tags"`
+}
+
+// TestDecode tests the message and status given for each kind of malformed
+// body
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		code    string
+		message string
+	}{
+		{name: "Valid", body: `{"name":"a","count":2,"nested":{"enabled":true},"tags":["x"]}` + "\n"},
+		{name: "Empty", body: "", status: http.StatusBadRequest, code: response.CodeInvalidBody, message: "Request body is empty"},
+		{name: "Whitespace", body: " \n\t", status: http.StatusBadRequest, code: response.CodeInvalidBody, message: "Request body is empty"},
+		{name: "Syntax", body: `{"name": "a",}`, status: http.StatusBadRequest, code: response.CodeInvalidBody,
+			message: "Malformed JSON at byte 14: invalid character '}' looking for beginning of object key string"},
+		{name: "Truncated", body: `{"name": "a"`, status: http.StatusBadRequest, code: response.CodeInvalidBody,
+			message: "Request body ends in the middle of the JSON document"},
+		{name: "WrongType", body: `{"count": "two"}`, status: http.StatusBadRequest, code: response.CodeInvalidBody,
+			message: `Field "count" must be an integer, got string at byte 15`},
+		{name: "NestedWrongType", body: `{"nested": {"enabled": 1}}`, status: http.StatusBadRequest, code: response.CodeInvalidBody,
+			message: `Field "nested.enabled" must be a boolean, got number at byte 24`},
+		{name: "WrongArrayType", body: `{"tags": "x"}`, status: http.StatusBadRequest, code: response.CodeInvalidBody,
+			message: `Field "tags" must be an array, got string at byte 12`},
+		{name: "NotAnObject", body: `[1, 2]`, status: http.StatusBadRequest, code: response.CodeInvalidBody,
+			message: "Request body must be an object, got array"},
+		{name: "UnknownField", body: `{"name": "a", "colour": "red"}`, status: http.StatusBadRequest, code: response.CodeInvalidBody,
+			message: `Unknown field "colour"`},
+		{name: "TrailingGarbage", body: `{"name": "a"} trailing`, status: http.StatusBadRequest, code: response.CodeInvalidBody,
+			message: "Request body has data after the JSON document ending at byte 13"},
+		{name: "MultipleDocuments", body: `{"name": "a"}{"name": "b"}`, status: http.StatusBadRequest, code: response.CodeInvalidBody,
+			message: "Request body has data after the JSON document ending at byte 13"},
+		{name: "TooLarge", body: `{"name": "` + strings.Repeat("a", httpjson.MaxBytes) + `"}`, status: http.StatusRequestEntityTooLarge,
+			code: response.CodeBodyTooLarge, message: "Request body exceeds 1048576 bytes"},
+		{name: "TooLargeAfterDocument", body: `{"name": "a"}` + strings.Repeat(" ", httpjson.MaxBytes), status: http.StatusRequestEntityTooLarge,
+			code: response.CodeBodyTooLarge, message: "Request body exceeds 1048576 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload jsonPayload
+			w := httptest.NewRecorder()
+			err := httpjson.Decode(w, httptest.NewRequest("POST", "/", strings.NewReader(tt.body)), &payload)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if payload.Name != "a" || payload.Count != 2 || !payload.Nested.Enabled || len(payload.Tags) != 1 {
+					t.Errorf("Unexpected payload %+v", payload)
+				}
+				return
+			}
+
+			var decodeErr *httpjson.Error
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("Expected a decode error, got %v", err)
+			}
+			if decodeErr.Status != tt.status || decodeErr.Code != tt.code || decodeErr.Message != tt.message {
+				t.Errorf("Expected %d %s %q, got %d %s %q", tt.status, tt.code, tt.message, decodeErr.Status, decodeErr.Code, decodeErr.Message)
+			}
+
+			// The error is written in the standard envelope
+			httpjson.WriteError(w, err)
+			var resp response.Response
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if w.Code != tt.status || resp.Code != tt.code || resp.Error != tt.message || resp.Success {
+				t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestDecodeOptional tests that an optional body may be left out but is
+// checked when given
+func TestDecodeOptional(t *testing.T) {
+	payload := jsonPayload{Name: "default"}
+	if err := httpjson.DecodeOptional(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), &payload); err != nil {
+		t.Fatalf("Expected an empty body accepted, got %v", err)
+	}
+	if payload.Name != "default" {
+		t.Errorf("Expected the payload untouched, got %+v", payload)
+	}
+
+	err := httpjson.DecodeOptional(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(`{"nme": "a"}`)), &payload)
+	if err == nil || err.Error() != `Unknown field "nme"` {
+		t.Errorf("Expected the unknown field refused, got %v", err)
+	}
+}
+
+// TestHandlerDecodeErrors tests that handlers answer malformed bodies with
+// the precise message instead of a generic one
+func TestHandlerDecodeErrors(t *testing.T) {
+	log := logger.Get()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), nil, nil, log)
+
+	for body, want := range map[string]string{
+		`{"path": "/a", "target_url": "http://a", "timout": 5}`: `Unknown field "timout"`,
+		`{"path": "/a", "timeout": "5s"}`:                       `Field "timeout" must be an integer, got string at byte 30`,
+		`{"path": "/a"} {"path": "/b"}`:                         "Request body has data after the JSON document ending at byte 14",
+	} {
+		w := httptest.NewRecorder()
+		routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(body)))
+
+		var resp response.Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if w.Code != http.StatusBadRequest || resp.Code != response.CodeInvalidBody || resp.Error != want {
+			t.Errorf("Expected 400 %q for %s, got %d %s", want, body, w.Code, w.Body.String())
+		}
+	}
+}
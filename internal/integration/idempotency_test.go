@@ -0,0 +1,355 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/idempotency"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// idempotentHandler guards upstream with the store the way the proxy handler does
+func idempotentHandler(store *idempotency.Store, upstream http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash, ok := store.Hash(r)
+		if !ok {
+			upstream(w, r)
+			return
+		}
+
+		key := r.Header.Get(idempotency.Header)
+		stored, err := store.Acquire(r.Context(), key, hash)
+		switch {
+		case errors.Is(err, idempotency.ErrConflict):
+			w.WriteHeader(http.StatusConflict)
+			return
+		case errors.Is(err, idempotency.ErrMismatch):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		case stored != nil:
+			stored.Write(w)
+			return
+		}
+
+		rec := store.NewRecorder(w, key)
+		defer rec.Release()
+		upstream(rec, r)
+	}
+}
+
+// TestIdempotencyStore tests replay, concurrent retries, conflicts and expiry
+func TestIdempotencyStore(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	cfg := config.Load().Proxy
+	cfg.IdempotencyTTL = time.Minute
+	cfg.IdempotencyMaxBody = 64
+
+	var hits atomic.Int64
+	var gate chan struct{}
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		if gate != nil {
+			<-gate
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Order", fmt.Sprint(n))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "created %s", body)
+	}
+	handler := idempotentHandler(idempotency.New(cacheInstance, &cfg), upstream)
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/orders", strings.NewReader(body))
+		req.Header.Set(idempotency.Header, key)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	reset := func() {
+		hits.Store(0)
+		gate = nil
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		reset()
+		first := send("replay", "a")
+		second := send("replay", "a")
+		if hits.Load() != 1 {
+			t.Fatalf("Expected the upstream to be called once, got %d", hits.Load())
+		}
+		if second.Code != http.StatusCreated || second.Body.String() != "created a" || second.Header().Get("X-Order") != "1" {
+			t.Errorf("Expected the first response replayed, got %d %q %v", second.Code, second.Body.String(), second.Header())
+		}
+		if first.Header().Get(idempotency.ReplayedHeader) != "" || second.Header().Get(idempotency.ReplayedHeader) != "true" {
+			t.Error("Expected only the replay to be marked")
+		}
+	})
+
+	t.Run("ConcurrentRetries", func(t *testing.T) {
+		reset()
+		gate = make(chan struct{})
+
+		var wg sync.WaitGroup
+		results := make([]*httptest.ResponseRecorder, 5)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = send("concurrent", "b")
+			}(i)
+		}
+
+		waitFor(t, func() bool { return hits.Load() == 1 })
+		time.Sleep(50 * time.Millisecond)
+		close(gate)
+		wg.Wait()
+
+		if hits.Load() != 1 {
+			t.Fatalf("Expected simultaneous retries to reach the upstream once, got %d", hits.Load())
+		}
+		for _, w := range results {
+			if w.Code != http.StatusCreated || w.Body.String() != "created b" {
+				t.Errorf("Expected every retry to get the response, got %d %q", w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("ConflictInFlight", func(t *testing.T) {
+		reset()
+		gate = make(chan struct{})
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- send("conflict", "c") }()
+		waitFor(t, func() bool { return hits.Load() == 1 })
+
+		if w := send("conflict", "different"); w.Code != http.StatusConflict {
+			t.Errorf("Expected status 409 for a different body in flight, got %d", w.Code)
+		}
+		close(gate)
+		if w := <-done; w.Code != http.StatusCreated {
+			t.Errorf("Expected the first request to complete, got %d", w.Code)
+		}
+	})
+
+	t.Run("KeyReused", func(t *testing.T) {
+		reset()
+		send("reused", "d")
+		if w := send("reused", "different"); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected status 422 for a stored key with a different body, got %d", w.Code)
+		}
+	})
+
+	t.Run("ServerErrorNotStored", func(t *testing.T) {
+		failing := idempotentHandler(idempotency.New(cacheInstance, &cfg), func(w http.ResponseWriter, r *http.Request) {
+			n := hits.Add(1)
+			if n == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		})
+
+		reset()
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("POST", "/orders", strings.NewReader("e"))
+			req.Header.Set(idempotency.Header, "retry-after-error")
+			failing(httptest.NewRecorder(), req)
+		}
+		if hits.Load() != 2 {
+			t.Errorf("Expected the retry to reach the upstream after a 5xx, got %d calls", hits.Load())
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		reset()
+		body := strings.Repeat("x", 100)
+		for i := 0; i < 2; i++ {
+			if w := send("large", body); w.Body.String() != "created "+body {
+				t.Fatalf("Expected the full body to be forwarded, got %q", w.Body.String())
+			}
+		}
+		if hits.Load() != 2 {
+			t.Errorf("Expected bodies over the cap to bypass the store, got %d calls", hits.Load())
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		short := cfg
+		short.IdempotencyTTL = 50 * time.Millisecond
+		expiring := idempotentHandler(idempotency.New(cacheInstance, &short), upstream)
+
+		reset()
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("POST", "/orders", strings.NewReader("f"))
+			req.Header.Set(idempotency.Header, "expiry")
+			expiring(httptest.NewRecorder(), req)
+			time.Sleep(100 * time.Millisecond)
+		}
+		if hits.Load() != 2 {
+			t.Errorf("Expected the key to expire after its TTL, got %d calls", hits.Load())
+		}
+	})
+}
+
+// TestRouteIdempotency tests Idempotency-Key handling through the proxy handler
+func TestRouteIdempotency(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "order %d", hits.Add(1))
+	}))
+	defer upstream.Close()
+
+	repo := database.NewRouteRepository(db)
+	path := fmt.Sprintf("/idempotency-%d", time.Now().UnixNano())
+	route := &database.Route{Path: path, TargetURL: upstream.URL, Method: "POST", Enabled: true, Timeout: 30, Idempotent: true}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		idempotency.New(cacheInstance, &config.Load().Proxy),
+		m,
+		log,
+	)
+
+	call := func(key string) string {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"item":1}`))
+		if key != "" {
+			req.Header.Set(idempotency.Header, key)
+		}
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, req)
+		return w.Body.String()
+	}
+
+	key := fmt.Sprintf("key-%d", time.Now().UnixNano())
+	replayed := testutil.ToFloat64(m.IdempotentRequests.WithLabelValues(path, idempotency.ResultReplayed))
+	first, second := call(key), call(key)
+	if first != second || hits.Load() != 1 {
+		t.Errorf("Expected the retry to be replayed, got %q then %q after %d calls", first, second, hits.Load())
+	}
+	if got := testutil.ToFloat64(m.IdempotentRequests.WithLabelValues(path, idempotency.ResultReplayed)); got != replayed+1 {
+		t.Errorf("Expected the replay to be counted, got %v", got-replayed)
+	}
+
+	// Requests without a key always reach the upstream
+	call("")
+	call("")
+	if hits.Load() != 3 {
+		t.Errorf("Expected 3 upstream calls, got %d", hits.Load())
+	}
+}
+
+// TestRouteIdempotencyCallers tests that keys are scoped to the caller and
+// that replayed responses don't carry the cookies set for the first request
+func TestRouteIdempotencyCallers(t *testing.T) {
+	log := logger.Get()
+	m := testMetrics()
+
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint(n)})
+		fmt.Fprintf(w, "order %d", n)
+	}))
+	defer upstream.Close()
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	proxyHandler := handlers.NewProxyHandler(
+		database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		idempotency.New(cacheInstance, &config.Load().Proxy),
+		m,
+		log,
+	)
+	route := egressRoute(1, "/orders", upstream.URL, nil)
+	route.Method = "POST"
+	route.Idempotent = true
+	proxyHandler.SetRoutes([]database.Route{route}, time.Minute)
+
+	call := func(claims *auth.Claims, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/orders", strings.NewReader(`{"item":1}`))
+		req.Header.Set(idempotency.Header, "order-1")
+		req.RemoteAddr = remoteAddr
+		if claims != nil {
+			req = req.WithContext(auth.WithClaims(req.Context(), claims))
+		}
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, req)
+		return w
+	}
+
+	alice := &auth.Claims{UserID: "alice"}
+	first := call(alice, "192.0.2.1:1234")
+	replayed := call(alice, "192.0.2.2:1234")
+	if first.Body.String() != "order 1" || replayed.Body.String() != "order 1" {
+		t.Fatalf("Expected the same user's retry replayed, got %q then %q", first.Body.String(), replayed.Body.String())
+	}
+	if first.Header().Get("Set-Cookie") == "" {
+		t.Error("Expected the first response to set its cookie")
+	}
+	if cookie := replayed.Header().Get("Set-Cookie"); cookie != "" || replayed.Header().Get(idempotency.ReplayedHeader) != "true" {
+		t.Errorf("Expected a replay without the cookie, got %q", cookie)
+	}
+
+	for name, tc := range map[string]struct {
+		claims     *auth.Claims
+		remoteAddr string
+	}{
+		"OtherUser":   {&auth.Claims{UserID: "bob"}, "192.0.2.1:1234"},
+		"APIKey":      {&auth.Claims{UserID: "alice", APIKeyID: "partner"}, "192.0.2.1:1234"},
+		"Anonymous":   {nil, "192.0.2.1:1234"},
+		"AnonymousIP": {nil, "192.0.2.3:1234"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			before := hits.Load()
+			if w := call(tc.claims, tc.remoteAddr); w.Header().Get(idempotency.ReplayedHeader) != "" || hits.Load() != before+1 {
+				t.Errorf("Expected another caller's request to reach the upstream, got %q", w.Body.String())
+			}
+		})
+	}
+
+	if w := call(nil, "192.0.2.1:5678"); w.Header().Get(idempotency.ReplayedHeader) != "true" {
+		t.Errorf("Expected an anonymous retry from the same IP replayed, got %q", w.Body.String())
+	}
+}
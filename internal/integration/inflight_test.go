@@ -0,0 +1,310 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/inflight"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// inflightGateway serves handler behind the request ID, in-flight and
+// timeout middlewares, tracking requests in registry
+func inflightGateway(registry *inflight.Registry, handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(middleware.RequestID(middleware.InFlight(registry)(middleware.Timeout(30 * time.Second)(handler))))
+}
+
+// sendInflight sends a GET with the request ID id in the background,
+// returning its response or error on the channel
+func sendInflight(url, id string) <-chan *http.Response {
+	responses := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set(response.RequestIDHeader, id)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			responses <- nil
+			return
+		}
+		responses <- resp
+	}()
+	return responses
+}
+
+// waitInflight waits for the request with id to be listed
+func waitInflight(t *testing.T, registry *inflight.Registry, id string) inflight.Request {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, req := range registry.List(0) {
+			if req.ID == id {
+				return req
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected request %s in flight, got %+v", id, registry.List(0))
+	return inflight.Request{}
+}
+
+// assertCancelled checks that the client was answered 503 REQUEST_CANCELLED
+func assertCancelled(t *testing.T, responses <-chan *http.Response) {
+	t.Helper()
+	select {
+	case resp := <-responses:
+		if resp == nil {
+			t.Fatal("Expected a response, the request failed")
+		}
+		defer resp.Body.Close()
+		var body response.Response
+		json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode != http.StatusServiceUnavailable || body.Code != response.CodeRequestCancelled {
+			t.Errorf("Expected 503 %s, got %d %s", response.CodeRequestCancelled, resp.StatusCode, body.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the cancelled request to be answered")
+	}
+}
+
+// TestInFlight tests that slow requests are listed while they are served
+// and can be cancelled
+func TestInFlight(t *testing.T) {
+	registry := inflight.New(100)
+	release := make(chan struct{})
+	causes := make(chan error, 1)
+	gateway := inflightGateway(registry, func(w http.ResponseWriter, r *http.Request) {
+		inflight.SetRoute(r.Context(), 7, "/slow")
+		inflight.SetUpstream(r.Context(), "http://stuck.internal/slow")
+		select {
+		case <-release:
+			w.Write([]byte("done"))
+		case <-r.Context().Done():
+			causes <- context.Cause(r.Context())
+		}
+	})
+	defer gateway.Close()
+
+	t.Run("Visible", func(t *testing.T) {
+		responses := sendInflight(gateway.URL+"/slow//path", "visible-1")
+		req := waitInflight(t, registry, "visible-1")
+		if req.Method != "GET" || req.Path != "/slow/path" || req.ClientIP != "127.0.0.1" || req.RouteID != 7 ||
+			req.Route != "/slow" || req.Upstream != "http://stuck.internal/slow" || req.RequestID != "visible-1" || req.Started.IsZero() {
+			t.Errorf("Expected the request described, got %+v", req)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		if got := registry.List(10 * time.Millisecond); len(got) != 1 || got[0].AgeMS < 10 {
+			t.Errorf("Expected the request older than 10ms, got %+v", got)
+		}
+		if got := registry.List(time.Hour); len(got) != 0 {
+			t.Errorf("Expected no request older than an hour, got %+v", got)
+		}
+
+		release <- struct{}{}
+		if resp := <-responses; resp == nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the request to finish, got %v", resp)
+		}
+		if got := registry.List(0); len(got) != 0 || registry.Tracked() != 0 {
+			t.Errorf("Expected finished requests removed, got %+v", got)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		responses := sendInflight(gateway.URL+"/slow", "cancel-1")
+		waitInflight(t, registry, "cancel-1")
+
+		if registry.Cancel("missing") {
+			t.Error("Expected no request to cancel with an unknown ID")
+		}
+		if !registry.Cancel("cancel-1") {
+			t.Fatal("Expected the request cancelled")
+		}
+		assertCancelled(t, responses)
+		select {
+		case cause := <-causes:
+			if !errors.Is(cause, inflight.ErrCancelled) {
+				t.Errorf("Expected the handler's context cancelled by the registry, got %v", cause)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the handler's context cancelled")
+		}
+	})
+
+	t.Run("ReusedID", func(t *testing.T) {
+		first := sendInflight(gateway.URL+"/slow", "reused")
+		waitInflight(t, registry, "reused")
+		second := sendInflight(gateway.URL+"/slow", "reused")
+
+		var duplicate inflight.Request
+		deadline := time.Now().Add(5 * time.Second)
+		for duplicate.ID == "" && time.Now().Before(deadline) {
+			for _, req := range registry.List(0) {
+				if req.RequestID == "reused" && req.ID != "reused" {
+					duplicate = req
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !strings.HasPrefix(duplicate.ID, "reused.") {
+			t.Fatalf("Expected the second request under its own ID, got %+v", registry.List(0))
+		}
+
+		registry.Cancel(duplicate.ID)
+		assertCancelled(t, second)
+		<-causes
+		release <- struct{}{}
+		if resp := <-first; resp == nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected the first request unaffected, got %v", resp)
+		}
+	})
+}
+
+// TestInFlightBound tests that requests past the bound go untracked
+func TestInFlightBound(t *testing.T) {
+	registry := inflight.New(2)
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		ctx, done := registry.Register(context.Background(), inflight.Request{ID: fmt.Sprint(i), Started: time.Now()})
+		releases = append(releases, done)
+		if i == 2 && ctx != context.Background() {
+			t.Error("Expected the untracked request's context left alone")
+		}
+	}
+	if registry.Tracked() != 2 || registry.Untracked() != 1 || len(registry.List(0)) != 2 {
+		t.Errorf("Expected 2 tracked and 1 untracked, got %d and %d", registry.Tracked(), registry.Untracked())
+	}
+	for _, done := range releases {
+		done()
+	}
+	if registry.Tracked() != 0 {
+		t.Errorf("Expected no requests tracked, got %d", registry.Tracked())
+	}
+}
+
+// TestInFlightProxy tests that cancelling a request stuck on a hanging
+// upstream aborts the upstream request and answers the client
+func TestInFlightProxy(t *testing.T) {
+	log := logger.Get()
+	p := proxy.New(30*time.Second, &config.Load().Proxy, log)
+
+	cancelled := make(chan struct{}, 1)
+	backend := httptest.NewServer(slowHeaders(cancelled))
+	defer backend.Close()
+
+	registry := inflight.New(100)
+	errs := make(chan error, 1)
+	gateway := inflightGateway(registry, func(w http.ResponseWriter, r *http.Request) {
+		_, err := p.ForwardAndCopy(r.Context(), w, r, backend.URL+r.URL.Path)
+		errs <- err
+	})
+	defer gateway.Close()
+
+	responses := sendInflight(gateway.URL+"/hang", "hanging-1")
+	req := waitInflight(t, registry, "hanging-1")
+	if req.Upstream != backend.URL+"/hang" {
+		t.Errorf("Expected the upstream target recorded, got %q", req.Upstream)
+	}
+
+	registry.Cancel("hanging-1")
+	assertCancelled(t, responses)
+	waitCancelled(t, cancelled)
+	err := <-errs
+	var upstreamErr *proxy.UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.Status != http.StatusServiceUnavailable || errors.Is(err, proxy.ErrClientClosed) {
+		t.Errorf("Expected a 503 that isn't a client closed request, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the error to wrap context.Canceled so the upstream isn't blamed, got %v", err)
+	}
+}
+
+// TestInFlightEndpoints tests listing and cancelling through the debug API
+func TestInFlightEndpoints(t *testing.T) {
+	registry := inflight.New(100)
+	inflightHandler := handlers.NewInFlightHandler(registry, logger.Get())
+	router := chi.NewRouter()
+	router.Get("/api/debug/inflight", inflightHandler.List)
+	router.Post("/api/debug/inflight/{id}/cancel", inflightHandler.Cancel)
+
+	ctx, done := registry.Register(context.Background(), inflight.Request{ID: "a/b", Method: "POST", Started: time.Now().Add(-time.Minute)})
+	defer done()
+	_, doneYoung := registry.Register(context.Background(), inflight.Request{ID: "young", Started: time.Now()})
+	defer doneYoung()
+
+	t.Run("List", func(t *testing.T) {
+		w := adminUIGet(router, "/api/debug/inflight?min_age=30s", nil)
+		var body struct {
+			Data handlers.InFlightList `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusOK || len(body.Data.Requests) != 1 || body.Data.Requests[0].ID != "a/b" || body.Data.Tracked != 2 {
+			t.Errorf("Expected the minute old request, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("InvalidMinAge", func(t *testing.T) {
+		for _, minAge := range []string{"soon", "-1s"} {
+			if w := adminUIGet(router, "/api/debug/inflight?min_age="+minAge, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400 for min_age %q, got %d", minAge, w.Code)
+			}
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/debug/inflight/missing/cancel", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for a request not in flight, got %d", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/debug/inflight/a%2Fb/cancel", nil))
+		if w.Code != http.StatusOK || !inflight.Cancelled(ctx) {
+			t.Errorf("Expected the request cancelled, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// TestInFlightRouter tests that the gateway tracks its requests and keeps
+// the endpoints for admins
+func TestInFlightRouter(t *testing.T) {
+	handler := testRouter(t, nil, func(cfg *config.Config) {})
+	w := adminUIGet(handler, "/api/debug/inflight", nil)
+	var body struct {
+		Data handlers.InFlightList `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusOK || len(body.Data.Requests) != 1 || body.Data.Requests[0].Path != "/api/debug/inflight" {
+		t.Errorf("Expected the listing request itself in flight, got %d %s", w.Code, w.Body.String())
+	}
+
+	handler = testRouter(t, nil, func(cfg *config.Config) { cfg.Auth.Enabled = true })
+	if w := adminUIGet(handler, "/api/debug/inflight", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", w.Code)
+	}
+}
+
+// BenchmarkInFlight measures the cost the registry adds to each request
+func BenchmarkInFlight(b *testing.B) {
+	registry := inflight.New(10000)
+	handler := middleware.RequestID(middleware.InFlight(registry)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	b.RunParallel(func(pb *testing.PB) {
+		req := httptest.NewRequest("GET", "/bench", nil)
+		for pb.Next() {
+			handler.ServeHTTP(httptest.NewRecorder(), req.Clone(req.Context()))
+		}
+	})
+}
@@ -20,9 +20,10 @@ import (
 func TestRouteLifecycle(t *testing.T) {
 	// Skip if no database connection
 	cfg := config.Load()
+	cfg.Database.ConnectRetries = 0
 	log := logger.Get()
 
-	db, err := database.New(&cfg.Database, log)
+	db, err := database.New(&cfg.Database, log, testMetrics())
 	if err != nil {
 		t.Skipf("Skipping integration test - database not available: %v", err)
 	}
@@ -35,11 +36,11 @@ func TestRouteLifecycle(t *testing.T) {
 	}
 
 	// Create cache
-	cacheInstance := cache.New(&cfg.Cache, log)
+	cacheInstance := cache.New(&cfg.Cache, log, nil)
 	defer cacheInstance.Stop()
 
 	// Create handler
-	handler := handlers.NewRouteHandler(db, cacheInstance, log)
+	handler := handlers.NewRouteHandler(db, cacheInstance, nil, log)
 
 	// Test Create
 	t.Run("CreateRoute", func(t *testing.T) {
@@ -101,7 +102,7 @@ func TestCacheExpiration(t *testing.T) {
 		MaxSize:         10,
 	}
 
-	c := cache.New(cfg, log)
+	c := cache.New(cfg, log, nil)
 	defer c.Stop()
 
 	// Set value
@@ -150,7 +151,7 @@ func BenchmarkCacheOperations(b *testing.B) {
 		MaxSize:         1000,
 	}
 
-	c := cache.New(cfg, log)
+	c := cache.New(cfg, log, nil)
 	defer c.Stop()
 
 	b.Run("Set", func(b *testing.B) {
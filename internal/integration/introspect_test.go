@@ -0,0 +1,195 @@
+package integration
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// signClaims signs claims with HS256 and secret
+func signClaims(t *testing.T, secret string, claims auth.Claims) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// TestTokenValidationReasons tests the reason each class of rejected token
+// is reported with, and that the errors still match the sentinel errors
+func TestTokenValidationReasons(t *testing.T) {
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	now := time.Now()
+	claims := func(issued, notBefore, expires time.Time) auth.Claims {
+		return auth.Claims{UserID: "user-1", Username: "alice", Roles: []string{"editor"}, RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(issued),
+			NotBefore: jwt.NewNumericDate(notBefore),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		}}
+	}
+	valid := claims(now, now, now.Add(time.Hour))
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	revoked, err := authService.GenerateToken("user-1", "alice", nil, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	revokedClaims, err := authService.ValidateToken(revoked)
+	if err != nil {
+		t.Fatalf("Expected a fresh token to validate: %v", err)
+	}
+	if err := authService.Revoke(revokedClaims); err != nil {
+		t.Fatalf("Failed to revoke token: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string
+		claims bool // Whether the rejected token's claims are reported
+	}{
+		{"Malformed", "not-a-jwt", auth.ReasonMalformed, false},
+		{"BadSignature", signClaims(t, "other-secret", valid), auth.ReasonBadSignature, true},
+		{"ExpiredBadSignature", signClaims(t, "other-secret", claims(now.Add(-2*time.Hour), now.Add(-2*time.Hour), now.Add(-time.Hour))), auth.ReasonBadSignature, true},
+		{"Algorithm", signToken(t, jwt.SigningMethodRS256, rsaKey, ""), auth.ReasonAlgorithm, true},
+		{"Expired", signClaims(t, "test-secret", claims(now.Add(-2*time.Hour), now.Add(-2*time.Hour), now.Add(-time.Hour))), auth.ReasonExpired, true},
+		{"NotYetValid", signClaims(t, "test-secret", claims(now, now.Add(time.Hour), now.Add(2*time.Hour))), auth.ReasonNotYetValid, true},
+		{"Revoked", revoked, auth.ReasonRevoked, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := authService.ValidateToken(tt.token)
+			if got := auth.Reason(err); got != tt.reason {
+				t.Fatalf("Expected reason %q, got %q (%v)", tt.reason, got, err)
+			}
+			if !errors.Is(err, auth.ErrInvalidToken) {
+				t.Errorf("Expected the error to match ErrInvalidToken, got %v", err)
+			}
+			if errors.Is(err, auth.ErrExpiredToken) != (tt.reason == auth.ReasonExpired) {
+				t.Errorf("Expected ErrExpiredToken to match only expired tokens, got %v", err)
+			}
+			if strings.Contains(err.Error(), "test-secret") {
+				t.Errorf("Expected the error not to mention the secret, got %q", err)
+			}
+
+			result := authService.Introspect(tt.token)
+			if result.Active || result.Reason != tt.reason || result.Error != err.Error() {
+				t.Errorf("Expected an inactive token for %q, got %+v", tt.reason, result)
+			}
+			if (result.Claims != nil) != tt.claims {
+				t.Errorf("Expected claims reported %v, got %+v", tt.claims, result.Claims)
+			}
+		})
+	}
+
+	if _, err := authService.ValidateToken(tests[4].token); auth.ErrorCode(err) != response.CodeAuthExpired {
+		t.Errorf("Expected expired tokens answered with %s", response.CodeAuthExpired)
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		result := authService.Introspect(signClaims(t, "test-secret", valid))
+		if !result.Active || result.Reason != "" || result.Claims == nil {
+			t.Fatalf("Expected an active token with claims, got %+v", result)
+		}
+		if result.Claims.Username != "alice" || result.Claims.ExpiresIn < 3590 || result.Claims.ExpiresIn > 3600 {
+			t.Errorf("Unexpected claims %+v", result.Claims)
+		}
+	})
+
+	t.Run("NotRevocable", func(t *testing.T) {
+		if err := authService.Revoke(&valid); !errors.Is(err, auth.ErrNotRevocable) {
+			t.Errorf("Expected a token without an ID not to be revocable, got %v", err)
+		}
+	})
+}
+
+// TestTokenEndpoints tests /api/auth/me, introspection by admins and
+// services, and logging out revoking the token
+func TestTokenEndpoints(t *testing.T) {
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	authHandler := handlers.NewAuthHandler(authService, nil, 12, logger.Get())
+	me := authService.Middleware()(http.HandlerFunc(authHandler.Me))
+	logout := authService.Middleware()(http.HandlerFunc(authHandler.Logout))
+	introspect := authService.Middleware()(auth.RequireAnyRole(database.RoleAdmin, "service")(http.HandlerFunc(authHandler.Introspect)))
+
+	token := func(roles ...string) string {
+		signed, err := authService.IssueToken(auth.Claims{UserID: "7", Username: "alice", Roles: roles, TenantID: "acme"}, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to issue token: %v", err)
+		}
+		return signed
+	}
+	serve := func(h http.Handler, method, bearer, body string) (int, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var resp map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	user := token("editor")
+	code, resp := serve(me, http.MethodGet, user, "")
+	data, _ := resp["data"].(map[string]interface{})
+	if code != http.StatusOK || data["username"] != "alice" || data["tenant_id"] != "acme" || data["token_id"] == "" || data["expires_in"].(float64) < 3590 {
+		t.Fatalf("Expected the caller's claims, got %d %v", code, resp)
+	}
+	if _, ok := data["issued_at"]; !ok {
+		t.Errorf("Expected issued_at, got %v", data)
+	}
+
+	expired := signClaims(t, "test-secret", auth.Claims{UserID: "7", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}})
+	code, resp = serve(me, http.MethodGet, expired, "")
+	if code != http.StatusUnauthorized || resp["code"] != response.CodeAuthExpired || resp["error"] != "token has expired" {
+		t.Errorf("Expected an expired token refused with %s, got %d %v", response.CodeAuthExpired, code, resp)
+	}
+
+	// Only admins and services introspect other tokens
+	body := `{"token":"` + expired + `"}`
+	if code, _ := serve(introspect, http.MethodPost, user, body); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for an editor, got %d", code)
+	}
+	for _, role := range []string{database.RoleAdmin, "service"} {
+		code, resp := serve(introspect, http.MethodPost, token(role), body)
+		data, _ := resp["data"].(map[string]interface{})
+		if code != http.StatusOK || data["active"] != false || data["reason"] != auth.ReasonExpired || data["claims"] == nil {
+			t.Errorf("Expected %s to see the token expired, got %d %v", role, code, resp)
+		}
+	}
+	if code, _ := serve(introspect, http.MethodPost, token("service"), `{}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a token, got %d", code)
+	}
+
+	// Logging out revokes the token for every later request
+	if code, resp := serve(logout, http.MethodPost, user, ""); code != http.StatusOK {
+		t.Fatalf("Expected logout to succeed, got %d %v", code, resp)
+	}
+	if code, _ := serve(me, http.MethodGet, user, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked token refused, got %d", code)
+	}
+	code, resp = serve(introspect, http.MethodPost, token(database.RoleAdmin), `{"token":"`+user+`"}`)
+	if data, _ := resp["data"].(map[string]interface{}); code != http.StatusOK || data["reason"] != auth.ReasonRevoked {
+		t.Errorf("Expected the token reported revoked, got %d %v", code, resp)
+	}
+}
@@ -0,0 +1,187 @@
+//go:build kubernetes
+
+package integration
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/zakirkun/isekai/internal/discovery"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// endpointSlice builds a slice of service with an http and a metrics port.
+// Endpoints map addresses to their readiness, nil meaning unknown.
+func endpointSlice(namespace, name, service string, endpoints map[string]*bool) *discoveryv1.EndpointSlice {
+	httpName, httpPort := "http", int32(8080)
+	metricsName, metricsPort := "metrics", int32(9090)
+
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: &metricsName, Port: &metricsPort},
+			{Name: &httpName, Port: &httpPort},
+		},
+	}
+	for address, ready := range endpoints {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{address},
+			Conditions: discoveryv1.EndpointConditions{Ready: ready},
+		})
+	}
+	return slice
+}
+
+// watchCounter hands out the fake clientset's watches so tests can drop them
+type watchCounter struct {
+	mu      sync.Mutex
+	watches []watch.Interface
+}
+
+func (wc *watchCounter) count() int {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return len(wc.watches)
+}
+
+// dropAll stops every open watch, as a lost connection to the API server would
+func (wc *watchCounter) dropAll() {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	for _, w := range wc.watches {
+		w.Stop()
+	}
+}
+
+// TestKubernetesDiscovery tests syncing backends from watched EndpointSlices
+func TestKubernetesDiscovery(t *testing.T) {
+	ready, notReady := true, false
+	client := fake.NewClientset(
+		endpointSlice("shop", "orders-a", "orders", map[string]*bool{"10.0.0.1": &ready, "10.0.0.2": &notReady}),
+		endpointSlice("shop", "orders-b", "orders", map[string]*bool{"10.0.0.3": nil, "10.0.0.1": &ready}),
+		endpointSlice("shop", "other", "other", map[string]*bool{"10.0.9.9": &ready}),
+		endpointSlice("default", "payments", "payments", map[string]*bool{"10.0.1.1": &ready}),
+	)
+
+	watches := &watchCounter{}
+	client.PrependWatchReactor("endpointslices", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w, err := client.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		watches.mu.Lock()
+		watches.watches = append(watches.watches, w)
+		watches.mu.Unlock()
+		return true, w, nil
+	})
+
+	provider, err := discovery.NewKubernetes(client, []string{"shop/orders", "payments"}, "default", "http", "http", logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+	if provider.Source() != "kubernetes:shop/orders,default/payments" {
+		t.Errorf("Unexpected source %q", provider.Source())
+	}
+
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	d := discovery.New(provider, lb, time.Hour, 0, logger.Get())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	backends := func(want string) {
+		t.Helper()
+		waitFor(t, func() bool { return sortedBackends(lb) == want })
+	}
+	backends("http://10.0.0.1:8080,http://10.0.0.3:8080,http://10.0.1.1:8080")
+
+	status := d.Status()
+	if status.LastSync == nil || len(status.Services) != 2 {
+		t.Fatalf("Expected a sync and two watched services, got %+v", status)
+	}
+	if got := status.Services[0]; got.Namespace != "shop" || got.Name != "orders" || got.Ready != 2 || got.NotReady != 1 {
+		t.Errorf("Expected shop/orders with 2 ready and 1 not ready endpoints, got %+v", got)
+	}
+	if got := status.Services[1]; got.Namespace != "default" || got.Name != "payments" || got.Ready != 1 || got.NotReady != 0 {
+		t.Errorf("Expected default/payments with 1 ready endpoint, got %+v", got)
+	}
+
+	slices := client.DiscoveryV1().EndpointSlices("shop")
+
+	t.Run("Readiness", func(t *testing.T) {
+		update := endpointSlice("shop", "orders-a", "orders", map[string]*bool{"10.0.0.1": &ready, "10.0.0.2": &ready})
+		if _, err := slices.Update(ctx, update, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("Failed to update slice: %v", err)
+		}
+		backends("http://10.0.0.1:8080,http://10.0.0.2:8080,http://10.0.0.3:8080,http://10.0.1.1:8080")
+
+		update = endpointSlice("shop", "orders-b", "orders", map[string]*bool{"10.0.0.3": &notReady})
+		if _, err := slices.Update(ctx, update, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("Failed to update slice: %v", err)
+		}
+		backends("http://10.0.0.1:8080,http://10.0.0.2:8080,http://10.0.1.1:8080")
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		if err := client.DiscoveryV1().EndpointSlices("default").Delete(ctx, "payments", metav1.DeleteOptions{}); err != nil {
+			t.Fatalf("Failed to delete slice: %v", err)
+		}
+		backends("http://10.0.0.1:8080,http://10.0.0.2:8080")
+	})
+
+	t.Run("Reconnect", func(t *testing.T) {
+		before := watches.count()
+		watches.dropAll()
+		waitFor(t, func() bool { return watches.count() > before })
+
+		added := endpointSlice("shop", "orders-c", "orders", map[string]*bool{"10.0.0.4": &ready})
+		if _, err := slices.Create(ctx, added, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("Failed to create slice: %v", err)
+		}
+		backends("http://10.0.0.1:8080,http://10.0.0.2:8080,http://10.0.0.4:8080")
+	})
+}
+
+// TestKubernetesServices tests parsing of the watched service names
+func TestKubernetesServices(t *testing.T) {
+	client := fake.NewClientset([]runtime.Object{}...)
+	for _, services := range [][]string{{}, {"shop/"}, {"/orders"}, {""}} {
+		if _, err := discovery.NewKubernetes(client, services, "default", "", "http", logger.Get()); err == nil {
+			t.Errorf("Expected %q to be rejected", services)
+		}
+	}
+
+	provider, err := discovery.NewKubernetes(client, []string{" orders ", "payments/api"}, "shop", "", "http", logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+	if provider.Source() != "kubernetes:shop/orders,payments/api" {
+		t.Errorf("Unexpected source %q", provider.Source())
+	}
+	if _, err := provider.Resolve(context.Background()); err == nil {
+		t.Error("Expected resolving before the slices are listed to fail")
+	}
+}
@@ -0,0 +1,208 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/core"
+	"github.com/zakirkun/isekai/internal/listener"
+)
+
+// unixClient returns an HTTP client connecting to the unix socket at path
+// whatever the request's host
+func unixClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// unixGet requests path from the server on the unix socket at socket
+func unixGet(t *testing.T, socket, method, path string) (int, string) {
+	t.Helper()
+
+	req, _ := http.NewRequest(method, "http://isekai"+path, nil)
+	resp, err := unixClient(socket).Do(req)
+	if err != nil {
+		t.Fatalf("Failed to request %s over %s: %v", path, socket, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// TestListenerParse tests parsing SERVER_LISTEN addresses
+func TestListenerParse(t *testing.T) {
+	valid := map[string]listener.Address{
+		":8080":                               {Scheme: "tcp", Addr: ":8080", Admin: true},
+		"tcp://127.0.0.1:9000?admin=false":    {Scheme: "tcp", Addr: "127.0.0.1:9000"},
+		"unix:///var/run/isekai.sock":         {Scheme: "unix", Addr: "/var/run/isekai.sock", Mode: 0o660, Admin: true},
+		"unix:///run/admin.sock?mode=0600":    {Scheme: "unix", Addr: "/run/admin.sock", Mode: 0o600, Admin: true},
+		"unix://isekai.sock":                  {Scheme: "unix", Addr: "isekai.sock", Mode: 0o660, Admin: true},
+		"systemd://":                          {Scheme: "systemd", Admin: true},
+		"systemd://public?admin=false":        {Scheme: "systemd", Addr: "public"},
+		" tcp://[::1]:8443 ":                  {Scheme: "tcp", Addr: "[::1]:8443", Admin: true},
+		"unix:///tmp/a.sock?mode=644&admin=0": {Scheme: "unix", Addr: "/tmp/a.sock", Mode: 0o644},
+	}
+	for s, want := range valid {
+		got, err := listener.Parse(s)
+		if err != nil || got != want {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{
+		"udp://:53",
+		"tcp://:8080/path",
+		"8080",
+		"unix://",
+		"unix:///a.sock?mode=999",
+		"tcp://:8080?mode=0600",
+		"tcp://:8080?admin=maybe",
+		"systemd://name/extra",
+	} {
+		if _, err := listener.Parse(s); err == nil {
+			t.Errorf("Expected %q refused", s)
+		}
+	}
+}
+
+// TestListenerUnixSocket tests serving over a unix socket: its permissions,
+// replacing a stale socket file, refusing one in use and removing it on
+// shutdown
+func TestListenerUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "run", "isekai.sock")
+
+	// A gateway that crashed leaves its socket file behind
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("Failed to create socket directory: %v", err)
+	}
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	listeners, err := listener.Listen(listener.Address{Scheme: "unix", Addr: path, Mode: 0o600, Admin: true})
+	if err != nil {
+		t.Fatalf("Expected the stale socket replaced, got %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Type() != fs.ModeSocket || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected a socket with mode 0600, got %v, %v", info.Mode(), err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	})}
+	go server.Serve(listeners[0])
+
+	status, body := unixGet(t, path, "GET", "/")
+	if status != http.StatusOK || !strings.HasPrefix(body, "127.0.0.1:") {
+		t.Errorf("Expected the peer reported as loopback, got %d %q", status, body)
+	}
+
+	if _, err := listener.Listen(listener.Address{Scheme: "unix", Addr: path, Mode: 0o600}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Expected a socket in use refused, got %v", err)
+	}
+	regular := filepath.Join(dir, "regular")
+	os.WriteFile(regular, nil, 0o644)
+	if _, err := listener.Listen(listener.Address{Scheme: "unix", Addr: regular, Mode: 0o600}); err == nil {
+		t.Errorf("Expected a regular file left alone")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the socket file removed on shutdown, got %v", err)
+	}
+}
+
+// TestListenerSystemdNotActivated tests systemd addresses outside socket
+// activation
+func TestListenerSystemdNotActivated(t *testing.T) {
+	if _, err := listener.Listen(listener.Address{Scheme: "systemd", Admin: true}); !errors.Is(err, listener.ErrNotActivated) {
+		t.Errorf("Expected ErrNotActivated, got %v", err)
+	}
+}
+
+// TestEngineListeners tests an engine serving the admin API on one unix
+// socket and proxied traffic only on another, then removing both on shutdown
+func TestEngineListeners(t *testing.T) {
+	dir := t.TempDir()
+	admin, public := filepath.Join(dir, "admin.sock"), filepath.Join(dir, "public.sock")
+
+	t.Setenv("DB_REQUIRED", "false")
+	t.Setenv("DB_HOST", "127.0.0.1")
+	t.Setenv("DB_PORT", closedDatabaseConfig(t).Port)
+	t.Setenv("TRACING_ENABLED", "false")
+	t.Setenv("AUTH_ENABLED", "false")
+	t.Setenv("WARMUP_ENABLED", "false")
+	t.Setenv("DRAIN_PERIOD", "0s")
+	t.Setenv("SERVER_LISTEN", "unix://"+admin+", unix://"+public+"?admin=false")
+
+	engine, err := core.NewV2()
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- engine.Start() }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(public); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the sockets created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status, _ := unixGet(t, public, "GET", "/health/live"); status != http.StatusOK {
+		t.Errorf("Expected health checks on the public socket, got %d", status)
+	}
+	if status, body := unixGet(t, public, "GET", "/api/status"); status != http.StatusNotFound || !strings.Contains(body, "ROUTE_NOT_FOUND") {
+		t.Errorf("Expected the management API hidden on the public socket, got %d %s", status, body)
+	}
+	if status, _ := unixGet(t, admin, "GET", "/api/status"); status != http.StatusOK {
+		t.Errorf("Expected the management API on the admin socket, got %d", status)
+	}
+
+	// Draining shuts the engine down
+	if status, body := unixGet(t, admin, "POST", "/api/admin/drain"); status != http.StatusAccepted {
+		t.Fatalf("Expected the drain started, got %d %s", status, body)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Expected the engine to stop after draining")
+	}
+	for _, path := range []string{admin, public} {
+		if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected %s removed on shutdown, got %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package integration
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// stickyPool returns a round-robin pool of backends with session affinity
+func stickyPool(key string, ttl time.Duration, urls ...string) *loadbalancer.LoadBalancer {
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	for _, url := range urls {
+		lb.AddBackend(url)
+	}
+	lb.SetStickyCookie(&loadbalancer.StickyCookie{Name: "isekai_backend", TTL: ttl, Key: []byte(key)})
+	return lb
+}
+
+// pin selects a backend without a cookie and returns it with the cookie set for it
+func pin(t *testing.T, lb *loadbalancer.LoadBalancer) (*loadbalancer.Backend, *http.Cookie) {
+	t.Helper()
+
+	backend, pinned, err := lb.Select(httptest.NewRequest("GET", "/", nil))
+	if err != nil || pinned {
+		t.Fatalf("Expected an unpinned backend, got pinned=%v err=%v", pinned, err)
+	}
+
+	w := httptest.NewRecorder()
+	lb.Pin(w, backend)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("Expected one HttpOnly sticky cookie, got %v", cookies)
+	}
+	return backend, cookies[0]
+}
+
+// selectWith selects a backend for a request carrying cookie
+func selectWith(lb *loadbalancer.LoadBalancer, cookie *http.Cookie) (*loadbalancer.Backend, bool) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	backend, pinned, _ := lb.Select(req)
+	return backend, pinned
+}
+
+// TestStickyCookie tests that a signed cookie keeps a client on its backend
+func TestStickyCookie(t *testing.T) {
+	lb := stickyPool("sticky-secret", time.Hour, "http://backend-1", "http://backend-2", "http://backend-3")
+	backend, cookie := pin(t, lb)
+
+	// Round robin would move the client on every request
+	for i := 0; i < 10; i++ {
+		got, pinned := selectWith(lb, cookie)
+		if !pinned || got.URL != backend.URL {
+			t.Fatalf("Expected request %d to stay on %s, got %s (pinned=%v)", i, backend.URL, got.URL, pinned)
+		}
+	}
+
+	t.Run("Failover", func(t *testing.T) {
+		lb.MarkHealthy(backend.URL, false)
+		defer lb.MarkHealthy(backend.URL, true)
+
+		got, pinned := selectWith(lb, cookie)
+		if pinned || got.URL == backend.URL {
+			t.Fatalf("Expected failover away from unhealthy %s, got %s (pinned=%v)", backend.URL, got.URL, pinned)
+		}
+	})
+
+	t.Run("Recovered", func(t *testing.T) {
+		if got, pinned := selectWith(lb, cookie); !pinned || got.URL != backend.URL {
+			t.Errorf("Expected the cookie to apply again once %s is healthy, got %s", backend.URL, got.URL)
+		}
+	})
+
+	t.Run("Forged", func(t *testing.T) {
+		// A cookie signed with another key must not steer the client
+		_, forged := pin(t, stickyPool("attacker-key", time.Hour, "http://backend-1", "http://backend-2", "http://backend-3"))
+		if _, pinned := selectWith(lb, forged); pinned {
+			t.Error("Expected a cookie with a bad signature to be ignored")
+		}
+
+		other := "http://backend-3"
+		if backend.URL == other {
+			other = "http://backend-1"
+		}
+		encode := base64.RawURLEncoding.EncodeToString
+		tampered := *cookie
+		tampered.Value = encode([]byte(other)) + cookie.Value[len(encode([]byte(backend.URL))):]
+		if _, pinned := selectWith(lb, &tampered); pinned {
+			t.Error("Expected a cookie with a rewritten backend to be ignored")
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		expiring := stickyPool("sticky-secret", -time.Minute, "http://backend-1", "http://backend-2")
+		_, cookie := pin(t, expiring)
+		if _, pinned := selectWith(expiring, cookie); pinned {
+			t.Error("Expected an expired cookie to be ignored")
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		plain := loadbalancer.New(loadbalancer.RoundRobin, nil)
+		plain.AddBackend("http://backend-1")
+
+		backend, _, _ := plain.Select(httptest.NewRequest("GET", "/", nil))
+		w := httptest.NewRecorder()
+		plain.Pin(w, backend)
+		if cookies := w.Result().Cookies(); len(cookies) != 0 {
+			t.Errorf("Expected no cookie without session affinity, got %v", cookies)
+		}
+	})
+}
+
+// TestRouteStickySession tests affinity and failover through the proxy handler
+func TestRouteStickySession(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	backend := func(name string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	first, second := backend("first"), backend("second")
+
+	lb := stickyPool("sticky-secret", time.Hour, first.URL, second.URL)
+
+	path := fmt.Sprintf("/sticky-%d", time.Now().UnixNano())
+	route := &database.Route{
+		Path:         path,
+		TargetURL:    "http://unused.invalid/session",
+		Method:       "GET",
+		Enabled:      true,
+		Timeout:      30,
+		LoadBalanced: true,
+	}
+	repo := database.NewRouteRepository(db)
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, testMetrics(), nil),
+		lb,
+		nil,
+		nil,
+		testMetrics(),
+		log,
+	)
+
+	call := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, req)
+
+		var set *http.Cookie
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			set = cookies[0]
+		}
+		return w.Body.String(), set
+	}
+
+	body, cookie := call(nil)
+	if cookie == nil {
+		t.Fatalf("Expected the first response to set the sticky cookie, got %q", body)
+	}
+	for i := 0; i < 5; i++ {
+		if got, set := call(cookie); got != body || set != nil {
+			t.Fatalf("Expected to stay on %q without a new cookie, got %q (cookie %v)", body, got, set)
+		}
+	}
+
+	// Fail over when the pinned backend goes unhealthy, and pin the new one
+	pinned := first.URL
+	if body == "second /session" {
+		pinned = second.URL
+	}
+	lb.MarkHealthy(pinned, false)
+
+	failover, newCookie := call(cookie)
+	if failover == body || newCookie == nil {
+		t.Fatalf("Expected failover to the other backend with a new cookie, got %q (cookie %v)", failover, newCookie)
+	}
+	if got, _ := call(newCookie); got != failover {
+		t.Errorf("Expected the new cookie to keep the client on %q, got %q", failover, got)
+	}
+}
+
+// backendStatus returns a backend's entry from GetAllBackends
+func backendStatus(lb *loadbalancer.LoadBalancer, url string) map[string]interface{} {
+	for _, status := range lb.GetAllBackends() {
+		if status["url"] == url {
+			return status
+		}
+	}
+	return nil
+}
+
+// TestOutlierDetection tests the ejection and re-admission timeline of a flapping backend
+func TestOutlierDetection(t *testing.T) {
+	m := testMetrics()
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	lb.AddBackend("http://flapping")
+	lb.AddBackend("http://steady")
+	lb.SetOutlierDetection(&loadbalancer.OutlierPolicy{
+		ConsecutiveFailures: 3,
+		Window:              time.Minute,
+		BaseEjection:        100 * time.Millisecond,
+		MaxEjection:         300 * time.Millisecond,
+	}, m)
+
+	var flapping *loadbalancer.Backend
+	for flapping == nil || flapping.URL != "http://flapping" {
+		flapping, _ = lb.GetBackend()
+	}
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			lb.ReportResult(flapping, loadbalancer.OutcomeConnectError)
+		}
+	}
+	ejected := func() bool { return backendStatus(lb, flapping.URL)["ejected"] == true }
+	before := testutil.ToFloat64(m.BackendEjections.WithLabelValues(flapping.URL))
+
+	// A success in between resets the consecutive count
+	fail(2)
+	lb.ReportResult(flapping, loadbalancer.OutcomeSuccess)
+	fail(2)
+	if ejected() {
+		t.Fatal("Expected no ejection without 3 failures in a row")
+	}
+
+	// Each ejection in a row lasts longer, up to the maximum
+	for i, minimum := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond} {
+		fail(3)
+		start := time.Now()
+
+		status := backendStatus(lb, flapping.URL)
+		if status["ejected"] != true || status["healthy"] != false || status["ejections"] != i+1 {
+			t.Fatalf("Ejection %d: unexpected status %v", i+1, status)
+		}
+		for j := 0; j < 10; j++ {
+			if backend, _ := lb.GetBackend(); backend.URL == flapping.URL {
+				t.Fatalf("Ejection %d: expected the ejected backend not to be selected", i+1)
+			}
+		}
+
+		// Results arriving during the ejection are ignored
+		fail(3)
+
+		waitFor(t, func() bool { return backendStatus(lb, flapping.URL)["healthy"] == true })
+		if elapsed := time.Since(start); elapsed < minimum {
+			t.Errorf("Ejection %d: expected at least %s, re-admitted after %s", i+1, minimum, elapsed)
+		}
+		if ejected() {
+			t.Errorf("Ejection %d: expected the backend to be re-admitted", i+1)
+		}
+	}
+
+	if got := testutil.ToFloat64(m.BackendEjections.WithLabelValues(flapping.URL)); got != before+4 {
+		t.Errorf("Expected 4 ejections to be counted, got %v", got-before)
+	}
+
+	t.Run("FailureRate", func(t *testing.T) {
+		lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+		lb.AddBackend("http://lossy")
+		lb.SetOutlierDetection(&loadbalancer.OutlierPolicy{
+			FailurePercent: 50,
+			MinRequests:    10,
+			Window:         time.Minute,
+			BaseEjection:   time.Minute,
+			MaxEjection:    time.Minute,
+		}, nil)
+		backend, _ := lb.GetBackend()
+
+		// Alternating results never trip a consecutive check but fail half the time
+		for i := 0; i < 9; i++ {
+			outcome := loadbalancer.OutcomeSuccess
+			if i%2 == 1 {
+				outcome = loadbalancer.OutcomeServerError
+			}
+			lb.ReportResult(backend, outcome)
+		}
+		if backendStatus(lb, backend.URL)["ejected"] == true {
+			t.Fatal("Expected no ejection below the minimum request count")
+		}
+
+		lb.ReportResult(backend, loadbalancer.OutcomeTimeout)
+		if backendStatus(lb, backend.URL)["ejected"] != true {
+			t.Error("Expected ejection once half of 10 requests failed")
+		}
+	})
+}
+
+// TestDrainBackend tests that a draining backend gets no new requests and is
+// removed once its in-flight requests finish
+func TestDrainBackend(t *testing.T) {
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	lb.AddBackend("http://leaving")
+	lb.AddBackend("http://staying")
+
+	var leaving *loadbalancer.Backend
+	for leaving == nil || leaving.URL != "http://leaving" {
+		leaving, _ = lb.GetBackend()
+	}
+	leaving.IncrementConnections()
+
+	lb.DrainBackend("http://leaving", time.Minute)
+	if urls := lb.Backends(); len(urls) != 1 || urls[0] != "http://staying" {
+		t.Errorf("Expected only the staying backend to take requests, got %v", urls)
+	}
+	for i := 0; i < 10; i++ {
+		if backend, _ := lb.GetBackend(); backend.URL != "http://staying" {
+			t.Fatalf("Expected new requests to avoid the draining backend, got %s", backend.URL)
+		}
+	}
+	if status := backendStatus(lb, "http://leaving"); status == nil || status["draining"] != true {
+		t.Fatalf("Expected the draining backend to be listed while busy, got %v", status)
+	}
+	if healthy, total := lb.HealthyCount(); healthy != 1 || total != 2 {
+		t.Errorf("Expected 1 of 2 backends available, got %d of %d", healthy, total)
+	}
+
+	leaving.DecrementConnections()
+	waitFor(t, func() bool { return backendStatus(lb, "http://leaving") == nil })
+
+	t.Run("AddedBack", func(t *testing.T) {
+		lb.AddBackend("http://returning")
+		var returning *loadbalancer.Backend
+		for returning == nil || returning.URL != "http://returning" {
+			returning, _ = lb.GetBackend()
+		}
+		returning.IncrementConnections()
+		lb.DrainBackend("http://returning", time.Minute)
+		lb.AddBackend("http://returning")
+		returning.DecrementConnections()
+
+		time.Sleep(200 * time.Millisecond)
+		if status := backendStatus(lb, "http://returning"); status == nil || status["draining"] != false {
+			t.Errorf("Expected the re-added backend to stay, got %v", status)
+		}
+		if _, total := lb.HealthyCount(); total != 2 {
+			t.Errorf("Expected no duplicate backend, got %d backends", total)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		lb.AddBackend("http://stuck")
+		var stuck *loadbalancer.Backend
+		for stuck == nil || stuck.URL != "http://stuck" {
+			stuck, _ = lb.GetBackend()
+		}
+		stuck.IncrementConnections()
+		lb.DrainBackend("http://stuck", 50*time.Millisecond)
+		waitFor(t, func() bool { return backendStatus(lb, "http://stuck") == nil })
+	})
+}
+
+// TestRemoveBackendAPI tests removing a backend over the admin API while it
+// serves long-lived requests: new requests go elsewhere and the removal
+// answers once the requests finish
+func TestRemoveBackendAPI(t *testing.T) {
+	release := make(chan struct{})
+	var slowHits atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowHits.Add(1)
+		<-release
+		io.WriteString(w, "slow")
+	}))
+	defer slow.Close()
+	defer close(release)
+	var fastHits atomic.Int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastHits.Add(1)
+		io.WriteString(w, "fast")
+	}))
+	defer fast.Close()
+
+	route := egressRoute(1, "/reports", "http://unused.invalid/reports", nil)
+	route.LoadBalanced = true
+	lb := loadbalancer.New(loadbalancer.RoundRobin, nil)
+	lb.AddBackend(slow.URL)
+	lb.AddBackend(fast.URL)
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	proxyHandler := handlers.NewProxyHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		proxy.New(5*time.Second, &config.Load().Proxy, log), cacheInstance,
+		circuitbreaker.New(log, testMetrics(), nil), lb, nil, nil, testMetrics(), log)
+	proxyHandler.SetRoutes([]database.Route{route}, time.Minute)
+	backendHandler := handlers.NewBackendHandler(lb, time.Minute, log)
+
+	call := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", "/reports", nil))
+		return w
+	}
+	remove := func(h *handlers.BackendHandler, query string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		h.Remove(w, httptest.NewRequest("DELETE", "/api/admin/backends?"+query, nil))
+		var resp struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Data
+	}
+
+	// Round robin sends every other request to the slow backend, where they
+	// stay in flight
+	var inflight sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			if w := call(); w.Code != http.StatusOK {
+				t.Errorf("Expected in-flight requests to complete, got %d %s", w.Code, w.Body)
+			}
+		}()
+		waitFor(t, func() bool { return slowHits.Load()+fastHits.Load() == int32(i+1) })
+	}
+	if got := slowHits.Load(); got != 2 {
+		t.Fatalf("Expected 2 requests in flight on the slow backend, got %d", got)
+	}
+	waitFor(t, func() bool { return backendStatus(lb, slow.URL)["connections"] == int32(2) })
+
+	removed := make(chan map[string]interface{}, 1)
+	go func() {
+		code, data := remove(backendHandler, "url="+slow.URL)
+		if code != http.StatusOK {
+			t.Errorf("Expected the removal to succeed, got %d", code)
+		}
+		removed <- data
+	}()
+	waitFor(t, func() bool { return backendStatus(lb, slow.URL)["draining"] == true })
+
+	for i := 0; i < 10; i++ {
+		if w := call(); w.Code != http.StatusOK || w.Body.String() != "fast" {
+			t.Fatalf("Expected new requests to avoid the draining backend, got %d %q", w.Code, w.Body)
+		}
+	}
+	if got := slowHits.Load(); got != 2 || fastHits.Load() != 12 {
+		t.Errorf("Expected no new request on the draining backend, got %d", got)
+	}
+	select {
+	case data := <-removed:
+		t.Fatalf("Expected the removal to wait for in-flight requests, got %v", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	release <- struct{}{}
+	release <- struct{}{}
+	inflight.Wait()
+	select {
+	case data := <-removed:
+		if data["removed"] != true || data["inflight"] != float64(0) {
+			t.Errorf("Expected the backend removed with nothing in flight, got %v", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the removal")
+	}
+	if status := backendStatus(lb, slow.URL); status != nil {
+		t.Errorf("Expected the drained backend gone, got %v", status)
+	}
+
+	t.Run("Panic", func(t *testing.T) {
+		// A handler panicking mid-response still gives its connection back
+		func() {
+			defer func() { recover() }()
+			proxyHandler.Handle(panickingWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/reports", nil))
+		}()
+		if status := backendStatus(lb, fast.URL); status["connections"] != int32(0) {
+			t.Errorf("Expected no connection left after a panic, got %v", status["connections"])
+		}
+	})
+
+	t.Run("Force", func(t *testing.T) {
+		lb.AddBackend("http://busy")
+		var busy *loadbalancer.Backend
+		for busy == nil || busy.URL != "http://busy" {
+			busy, _ = lb.GetBackend()
+		}
+		busy.IncrementConnections()
+		defer busy.DecrementConnections()
+
+		code, data := remove(backendHandler, "url=http://busy&force=true")
+		if code != http.StatusOK || data["removed"] != true || data["inflight"] != float64(1) {
+			t.Errorf("Expected the busy backend removed at once with 1 request in flight, got %d %v", code, data)
+		}
+		if backendStatus(lb, "http://busy") != nil {
+			t.Error("Expected the forced backend gone")
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		lb.AddBackend("http://stuck")
+		var stuck *loadbalancer.Backend
+		for stuck == nil || stuck.URL != "http://stuck" {
+			stuck, _ = lb.GetBackend()
+		}
+		stuck.IncrementConnections()
+		defer stuck.DecrementConnections()
+
+		code, data := remove(handlers.NewBackendHandler(lb, 50*time.Millisecond, log), "url=http://stuck")
+		if code != http.StatusOK || data["removed"] != true || data["inflight"] != float64(1) {
+			t.Errorf("Expected the stuck backend removed after the timeout with 1 request in flight, got %d %v", code, data)
+		}
+	})
+
+	for query, status := range map[string]int{
+		"":                              http.StatusBadRequest,
+		"url=http://unknown":            http.StatusNotFound,
+		"url=http://unknown&force=true": http.StatusNotFound,
+	} {
+		if code, _ := remove(backendHandler, query); code != status {
+			t.Errorf("Expected status %d for %q, got %d", status, query, code)
+		}
+	}
+}
+
+// panickingWriter panics when the response body is written
+type panickingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (panickingWriter) Write([]byte) (int, error) {
+	panic("client went away")
+}
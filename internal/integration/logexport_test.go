@@ -0,0 +1,295 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/logexport"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// exportLogs returns a source yielding n request logs
+func exportLogs(n int) logexport.Source {
+	return func(ctx context.Context, fn func(*database.RequestLog) error) error {
+		for i := 1; i <= n; i++ {
+			log := &database.RequestLog{ID: i, Method: "GET", Path: "/export", StatusCode: 200, UserAgent: "curl/8.0", CreatedAt: time.Now()}
+			if err := fn(log); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// TestLogExportNegotiate tests picking the export format from ?format= and Accept
+func TestLogExportNegotiate(t *testing.T) {
+	tests := []struct {
+		format, accept string
+		want           logexport.Format
+	}{
+		{"", "", logexport.CSV},
+		{"csv", "application/x-ndjson", logexport.CSV},
+		{"NDJSON", "", logexport.NDJSON},
+		{"", "application/x-ndjson", logexport.NDJSON},
+		{"", "text/html, text/csv;q=0.9", logexport.CSV},
+		{"", "application/json, application/jsonl", logexport.NDJSON},
+		{"", "*/*", logexport.CSV},
+	}
+	for _, tt := range tests {
+		if got, err := logexport.Negotiate(tt.format, tt.accept); err != nil || got != tt.want {
+			t.Errorf("Negotiate(%q, %q) = %q, %v, want %q", tt.format, tt.accept, got, err, tt.want)
+		}
+	}
+	if _, err := logexport.Negotiate("xml", ""); !errors.Is(err, logexport.ErrFormat) {
+		t.Errorf("Expected ErrFormat for xml, got %v", err)
+	}
+
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	if got := logexport.Filename(logexport.CSV, from, time.Time{}); got != "request-logs_20240501T000000Z_now.csv" {
+		t.Errorf("Expected the range in the filename, got %q", got)
+	}
+}
+
+// TestLogExportCSVEscaping tests that user agents with commas, quotes and
+// line breaks survive a CSV export
+func TestLogExportCSVEscaping(t *testing.T) {
+	agents := []string{
+		`Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko)`,
+		`bot "quoted", with commas`,
+		"multi\nline\r\nagent",
+		`""`,
+	}
+
+	var buf bytes.Buffer
+	w, err := logexport.NewWriter(&buf, logexport.CSV)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	routeID := 7
+	for i, agent := range agents {
+		if err := w.Write(&database.RequestLog{ID: i + 1, RouteID: &routeID, Method: "GET", Path: "/a,b", StatusCode: 200, UserAgent: agent}); err != nil {
+			t.Fatalf("Failed to write log: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Expected valid CSV, got %v", err)
+	}
+	if len(records) != len(agents)+1 || records[0][8] != "user_agent" {
+		t.Fatalf("Expected a header row and %d rows, got %q", len(agents), records)
+	}
+	for i, agent := range agents {
+		row := records[i+1]
+		if row[8] != strings.ReplaceAll(agent, "\r\n", "\n") || row[4] != "/a,b" || row[2] != "7" {
+			t.Errorf("Expected user agent %q round-tripped, got %q", agent, row)
+		}
+	}
+}
+
+// TestLogExportStreaming tests that the first rows reach the client while
+// the source is still producing the rest
+func TestLogExportStreaming(t *testing.T) {
+	release := make(chan struct{})
+	source := func(ctx context.Context, fn func(*database.RequestLog) error) error {
+		if err := fn(&database.RequestLog{ID: 1, Method: "GET", Path: "/first", UserAgent: "first"}); err != nil {
+			return err
+		}
+		// The query hasn't finished until the client has the first row
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return exportLogs(3)(ctx, fn)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logexport.Export(r.Context(), w, source, logexport.Options{Format: logexport.NDJSON, Filename: "logs.ndjson", MaxRows: 100})
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to request export: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" || !strings.Contains(resp.Header.Get("Content-Disposition"), `filename=logs.ndjson`) {
+		t.Errorf("Expected NDJSON with a filename, got %v", resp.Header)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	first := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		first <- line
+	}()
+	select {
+	case line := <-first:
+		if !strings.Contains(line, `"path":"/first"`) {
+			t.Fatalf("Expected the first row, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("Expected the first row before the source finished")
+	}
+	close(release)
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read export: %v", err)
+	}
+	if lines := strings.Count(string(rest), "\n"); lines != 3 {
+		t.Errorf("Expected 3 more rows, got %d", lines)
+	}
+	if resp.Trailer.Get(logexport.TrailerRows) != "4" || resp.Trailer.Get(logexport.TrailerTruncated) != "false" {
+		t.Errorf("Expected trailers for 4 rows, got %v", resp.Trailer)
+	}
+}
+
+// TestLogExportLimits tests the row cap, the download rate and failures
+// before and after the response starts
+func TestLogExportLimits(t *testing.T) {
+	t.Run("MaxRows", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logexport.Export(r.Context(), w, exportLogs(10), logexport.Options{Format: logexport.CSV, Filename: "logs.csv", MaxRows: 4})
+		}))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Failed to request export: %v", err)
+		}
+		defer resp.Body.Close()
+		records, err := csv.NewReader(resp.Body).ReadAll()
+		if err != nil || len(records) != 5 {
+			t.Fatalf("Expected a header and 4 rows, got %d rows, %v", len(records), err)
+		}
+		if resp.Trailer.Get(logexport.TrailerRows) != "4" || resp.Trailer.Get(logexport.TrailerTruncated) != "true" {
+			t.Errorf("Expected the export marked truncated, got %v", resp.Trailer)
+		}
+	})
+
+	t.Run("Rate", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		// About 15KB at 5KB a second, after a 5KB burst
+		logexport.Export(context.Background(), w, exportLogs(100), logexport.Options{Format: logexport.NDJSON, MaxRows: 100, Rate: 5000})
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("Expected the export throttled to 5000 bytes a second, took %s for %d bytes", elapsed, w.Body.Len())
+		}
+	})
+
+	t.Run("FailBeforeStart", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		failure := errors.New("query failed")
+		rows, started, err := logexport.Export(context.Background(), w, func(context.Context, func(*database.RequestLog) error) error {
+			return failure
+		}, logexport.Options{Format: logexport.CSV, MaxRows: 10})
+		if !errors.Is(err, failure) || started || rows != 0 {
+			t.Errorf("Expected the failure before the response started, got %d, %v, %v", rows, started, err)
+		}
+		if w.Header().Get("Content-Disposition") != "" || w.Body.Len() != 0 {
+			t.Errorf("Expected the response left to the caller, got %v %q", w.Header(), w.Body.String())
+		}
+	})
+
+	t.Run("FailAfterStart", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		failure := errors.New("connection lost")
+		rows, started, err := logexport.Export(context.Background(), w, func(ctx context.Context, fn func(*database.RequestLog) error) error {
+			exportLogs(2)(ctx, fn)
+			return failure
+		}, logexport.Options{Format: logexport.NDJSON, MaxRows: 10})
+		if !errors.Is(err, failure) || !started || rows != 2 {
+			t.Errorf("Expected the failure after 2 rows were sent, got %d, %v, %v", rows, started, err)
+		}
+	})
+}
+
+// TestLogExportEndpoint tests the export endpoint's validation, admin
+// requirement and answer while the database is down
+func TestLogExportEndpoint(t *testing.T) {
+	handler := testRouter(t, nil, func(cfg *config.Config) {})
+
+	for query, want := range map[string]int{
+		"?format=xml":         http.StatusBadRequest,
+		"?route_id=abc":       http.StatusBadRequest,
+		"?from=yesterday":     http.StatusBadRequest,
+		"?limit=0":            http.StatusBadRequest,
+		"?format=ndjson":      http.StatusServiceUnavailable,
+		"?limit=5&method=GET": http.StatusServiceUnavailable,
+	} {
+		if w := adminUIGet(handler, "/api/logs/export"+query, nil); w.Code != want {
+			t.Errorf("Expected %d for %s, got %d %s", want, query, w.Code, w.Body.String())
+		}
+	}
+
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	secured := testRouter(t, authService, func(cfg *config.Config) { cfg.Auth.Enabled = true })
+	userToken, err := authService.GenerateToken("2", "user", []string{"user"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	if w := adminUIGet(secured, "/api/logs/export", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", w.Code)
+	}
+	if w := adminUIGet(secured, "/api/logs/export", map[string]string{"Authorization": "Bearer " + userToken}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-admin, got %d", w.Code)
+	}
+}
+
+// TestLogExportStored tests exporting stored request logs by filter
+func TestLogExportStored(t *testing.T) {
+	db := testDatabase(t)
+	logs := database.NewRequestLogRepository(db)
+	ctx := context.Background()
+
+	path := fmt.Sprintf("/export-test-%d", time.Now().UnixNano())
+	for i := 0; i < 3; i++ {
+		if err := logs.Create(ctx, &database.RequestLog{Method: "GET", Path: path, StatusCode: 200, UserAgent: `agent "x", y`}); err != nil {
+			t.Fatalf("Failed to create request log: %v", err)
+		}
+	}
+
+	handler := handlers.NewLogHandler(db, 2, 0, logger.Get())
+	w := httptest.NewRecorder()
+	handler.Export(w, httptest.NewRequest("GET", "/api/logs/export?format=ndjson&path="+path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body.String())
+	}
+
+	var exported []database.RequestLog
+	decoder := json.NewDecoder(w.Body)
+	for decoder.More() {
+		var log database.RequestLog
+		if err := decoder.Decode(&log); err != nil {
+			t.Fatalf("Failed to decode row: %v", err)
+		}
+		exported = append(exported, log)
+	}
+	if len(exported) != 2 || exported[0].Path != path || exported[0].UserAgent != `agent "x", y` {
+		t.Errorf("Expected 2 of the 3 logs under the row cap, got %+v", exported)
+	}
+	if w.Header().Get(logexport.TrailerTruncated) != "true" {
+		t.Errorf("Expected the export marked truncated, got %v", w.Header())
+	}
+}
@@ -0,0 +1,146 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestRouteMaintenance tests the maintenance short-circuit and that disabling
+// it restores proxying at once
+func TestRouteMaintenance(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+
+	path := fmt.Sprintf("/maintenance-%d", time.Now().UnixNano())
+	route := &database.Route{Path: path, TargetURL: upstream.URL, Method: "GET", Enabled: true, Timeout: 30}
+	repo := database.NewRouteRepository(db)
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	if route.MaintenanceStatus != http.StatusServiceUnavailable {
+		t.Errorf("Expected the maintenance status to default to 503, got %d", route.MaintenanceStatus)
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	routeHandler := handlers.NewRouteHandler(db, cacheInstance, nil, log)
+
+	router := chi.NewRouter()
+	router.Get("/api/routes/{id}", routeHandler.Get)
+	router.Post("/api/routes/{id}/maintenance/enable", routeHandler.EnableMaintenance)
+	router.Post("/api/routes/{id}/maintenance/disable", routeHandler.DisableMaintenance)
+
+	admin := func(method, action, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, fmt.Sprintf("/api/routes/%d%s", route.ID, action), strings.NewReader(body)))
+		return w
+	}
+	call := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// Warm the route cache before changing anything
+	admin("GET", "", "")
+
+	w := admin("POST", "/maintenance/enable", `{"body":"<h1>Back soon</h1>","content_type":"text/html","retry_after":600}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	before := testutil.ToFloat64(m.MaintenanceResponses.WithLabelValues(path))
+	w = call()
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "<h1>Back soon</h1>" {
+		t.Errorf("Expected the maintenance response, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "text/html" || w.Header().Get("Retry-After") != "600" {
+		t.Errorf("Expected the configured headers, got %v", w.Header())
+	}
+	if hits.Load() != 0 {
+		t.Error("Expected the upstream not to be called during maintenance")
+	}
+	if got := testutil.ToFloat64(m.MaintenanceResponses.WithLabelValues(path)); got != before+1 {
+		t.Errorf("Expected the maintenance response to be counted, got %v", got-before)
+	}
+
+	// The cached route must not hide the change
+	var got struct {
+		Data database.Route `json:"data"`
+	}
+	json.Unmarshal(admin("GET", "", "").Body.Bytes(), &got)
+	if !got.Data.MaintenanceEnabled {
+		t.Error("Expected the route to report maintenance after the cache was invalidated")
+	}
+
+	if w := admin("POST", "/maintenance/disable", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if w := call(); w.Code != http.StatusOK || w.Body.String() != "upstream" {
+		t.Errorf("Expected proxying to resume immediately, got %d %q", w.Code, w.Body.String())
+	}
+
+	t.Run("DefaultResponse", func(t *testing.T) {
+		if w := admin("POST", "/maintenance/enable", `{"body":"","status":502,"retry_after":0}`); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		defer admin("POST", "/maintenance/disable", "")
+
+		w := call()
+		var resp response.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusBadGateway || resp.Code != response.CodeMaintenance || w.Header().Get("Retry-After") != "" {
+			t.Errorf("Expected a 502 %s envelope, got %d %q", response.CodeMaintenance, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		for _, body := range []string{`{"status":99}`, `{"retry_after":-1}`, `{"status":`} {
+			if w := admin("POST", "/maintenance/enable", body); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+			}
+		}
+	})
+}
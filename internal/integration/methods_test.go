@@ -0,0 +1,158 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/matcher"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestMatchMethod tests picking a path's route by request method
+func TestMatchMethod(t *testing.T) {
+	m := matcher.New([]database.Route{
+		{ID: 1, Path: "/users", Method: "GET", Enabled: true},
+		{ID: 2, Path: "/users", Method: "POST", Enabled: true},
+		{ID: 3, Path: "/any", Method: database.MethodAny, Enabled: true},
+		{ID: 4, Path: "/mixed", Method: "GET", Enabled: true},
+		{ID: 5, Path: "/mixed", Method: database.MethodAny, Enabled: true},
+		{ID: 6, Path: "/head", Method: "HEAD", Enabled: true},
+		{ID: 7, Path: "/head", Method: "GET", Enabled: true},
+	})
+
+	tests := []struct {
+		method, path string
+		id           int
+	}{
+		{"GET", "/users", 1},
+		{"POST", "/users", 2},
+		{"HEAD", "/users", 1},
+		{"DELETE", "/users", 0},
+		{"DELETE", "/any", 3},
+		{"HEAD", "/any", 3},
+		{"GET", "/mixed", 4},
+		{"HEAD", "/mixed", 4},
+		{"PUT", "/mixed", 5},
+		{"HEAD", "/head", 6},
+		{"GET", "/missing", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+tt.path, func(t *testing.T) {
+			route, ok := m.Match(tt.method, "", tt.path)
+			switch {
+			case tt.id == 0 && ok:
+				t.Errorf("Expected no route, got %d", route.ID)
+			case tt.id != 0 && (!ok || route.ID != tt.id):
+				t.Errorf("Expected route %d, got %+v", tt.id, route)
+			}
+		})
+	}
+
+	t.Run("Allowed", func(t *testing.T) {
+		methods := map[string]*database.Route{"POST": {}, "GET": {}, "DELETE": {}}
+		if got := database.AllowedMethods(methods); !slices.Equal(got, []string{"DELETE", "GET", "HEAD", "POST"}) {
+			t.Errorf("Unexpected allowed methods %v", got)
+		}
+	})
+}
+
+// TestMethodNotAllowed tests that the proxy answers 405 with an Allow header
+// when a path's routes serve other methods, and serves wildcard and HEAD
+// requests from the matching routes
+func TestMethodNotAllowed(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	repo := database.NewRouteRepository(db)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Method", r.Method)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	prefix := fmt.Sprintf("/methods-%d", time.Now().UnixNano())
+	for _, route := range []*database.Route{
+		{Path: prefix + "/users", Method: "GET"},
+		{Path: prefix + "/users", Method: "POST"},
+		{Path: prefix + "/any", Method: database.MethodAny},
+	} {
+		route.TargetURL = upstream.URL
+		route.Enabled = true
+		route.Timeout = 5
+		if err := repo.Create(context.Background(), route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		defer repo.Delete(context.Background(), route.ID)
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	m := testMetrics()
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	t.Run("NotAllowed", func(t *testing.T) {
+		w := do("DELETE", prefix+"/users")
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("Expected 405, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Allow"); got != "GET, HEAD, POST" {
+			t.Errorf("Expected Allow: GET, HEAD, POST, got %q", got)
+		}
+		var body response.Response
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != response.CodeMethodNotAllowed {
+			t.Errorf("Expected a METHOD_NOT_ALLOWED error, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("HeadFallsBackToGet", func(t *testing.T) {
+		w := do("HEAD", prefix+"/users")
+		if w.Code != http.StatusOK || w.Header().Get("X-Upstream-Method") != "HEAD" {
+			t.Errorf("Expected the GET route to forward the HEAD request, got %d %q", w.Code, w.Header().Get("X-Upstream-Method"))
+		}
+	})
+
+	t.Run("Wildcard", func(t *testing.T) {
+		for _, method := range []string{"GET", "PATCH", "DELETE"} {
+			w := do(method, prefix+"/any")
+			if w.Code != http.StatusOK || w.Header().Get("X-Upstream-Method") != method {
+				t.Errorf("Expected the wildcard route to forward %s, got %d %q", method, w.Code, w.Header().Get("X-Upstream-Method"))
+			}
+		}
+	})
+
+	t.Run("UnknownPath", func(t *testing.T) {
+		if w := do("GET", prefix+"/missing"); w.Code != http.StatusNotFound || w.Header().Get("Allow") != "" {
+			t.Errorf("Expected 404 without Allow, got %d %q", w.Code, w.Header().Get("Allow"))
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// testMetrics returns fresh metrics with their own registry
+func testMetrics() *metrics.Metrics {
+	return metrics.New()
+}
+
+// pathLabels returns the distinct path label values recorded for a method
+func pathLabels(t *testing.T, m *metrics.Metrics, method string) map[string]bool {
+	t.Helper()
+
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+
+	paths := make(map[string]bool)
+	for _, family := range families {
+		if family.GetName() != "isekai_http_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["method"] == method {
+				paths[labels["path"]] = true
+			}
+		}
+	}
+	return paths
+}
+
+// TestMetricsPathCardinality tests that request path labels stay bounded
+func TestMetricsPathCardinality(t *testing.T) {
+	m := testMetrics()
+
+	router := chi.NewRouter()
+	router.Use(middleware.MetricsMiddleware(m, 100))
+	router.Delete("/items/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	router.HandleFunc("/*", func(w http.ResponseWriter, r *http.Request) {
+		// Simulate the proxy handler matching a configured route
+		if strings.HasPrefix(r.URL.Path, "/proxied/") {
+			metrics.SetRouteLabel(r.Context(), "/proxied")
+		}
+	})
+
+	serve := func(method, path string) {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, nil))
+	}
+
+	t.Run("ChiPattern", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			serve("DELETE", fmt.Sprintf("/items/%d", i))
+		}
+
+		paths := pathLabels(t, m, "DELETE")
+		if len(paths) != 1 || !paths["/items/{id}"] {
+			t.Errorf("Expected only the route pattern, got %v", paths)
+		}
+	})
+
+	t.Run("ProxiedRoute", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			serve("PUT", fmt.Sprintf("/proxied/user-%d", i))
+		}
+
+		paths := pathLabels(t, m, "PUT")
+		if len(paths) != 1 || !paths["/proxied"] {
+			t.Errorf("Expected only the matched route, got %v", paths)
+		}
+	})
+
+	t.Run("NormalizedIDs", func(t *testing.T) {
+		serve("PATCH", "/users/12345/orders/550e8400-e29b-41d4-a716-446655440000")
+
+		paths := pathLabels(t, m, "PATCH")
+		if !paths["/users/:id/orders/:id"] {
+			t.Errorf("Expected identifiers to be normalized, got %v", paths)
+		}
+	})
+
+	t.Run("Unmatched", func(t *testing.T) {
+		for i := 0; i < 10000; i++ {
+			serve("GET", fmt.Sprintf("/unknown/page-%d", i))
+		}
+
+		paths := pathLabels(t, m, "GET")
+		if len(paths) > 101 {
+			t.Errorf("Expected at most 101 path labels, got %d", len(paths))
+		}
+		if !paths[metrics.OtherPath] {
+			t.Errorf("Expected collapsed paths to be labelled %s", metrics.OtherPath)
+		}
+	})
+}
+
+// TestUpstreamMetrics tests that proxied requests produce upstream series on /metrics
+func TestUpstreamMetrics(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+
+	path := fmt.Sprintf("/upstream-metrics-%d", time.Now().UnixNano())
+	route := &database.Route{Path: path, TargetURL: backend.URL, Method: "GET", Enabled: true, Timeout: 30}
+	repo := database.NewRouteRepository(db)
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+
+	w := httptest.NewRecorder()
+	proxyHandler.Handle(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", w.Code)
+	}
+
+	scrape := httptest.NewRecorder()
+	m.Handler().ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(scrape.Body)
+
+	for _, series := range []string{
+		fmt.Sprintf(`isekai_upstream_request_duration_seconds_count{route="%s",target="%s"} 1`, path, backend.URL),
+		fmt.Sprintf(`isekai_upstream_requests_total{route="%s",status_class="2xx"} 1`, path),
+		fmt.Sprintf(`isekai_upstream_inflight_requests{route="%s"} 0`, path),
+	} {
+		if !strings.Contains(string(body), series) {
+			t.Errorf("Expected series %s in scrape output", series)
+		}
+	}
+}
+
+// TestUpstreamInflightAborted tests that a request aborted by its upstream
+// body failing partway through still leaves the in-flight gauge
+func TestUpstreamInflightAborted(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer backend.Close()
+
+	m := testMetrics()
+	h := egressHandler(t, &config.Load().Proxy, m, nil, egressRoute(1, "/aborted", backend.URL, nil))
+	// The reverse proxy only aborts handlers served by an http.Server
+	gateway := httptest.NewServer(http.HandlerFunc(h.Handle))
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + "/aborted")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Fatal("Expected the response cut short")
+	}
+
+	waitFor(t, func() bool {
+		return testutil.ToFloat64(m.UpstreamInflight.WithLabelValues("/aborted")) == 0
+	})
+}
@@ -0,0 +1,215 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// mirroredRequest is what a mirror target received
+type mirroredRequest struct {
+	method string
+	header http.Header
+	body   string
+}
+
+// mirrorTarget records requests until released
+func mirrorTarget(t *testing.T, release <-chan struct{}) (*httptest.Server, <-chan mirroredRequest) {
+	t.Helper()
+
+	received := make(chan mirroredRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- mirroredRequest{method: r.Method, header: r.Header, body: string(body)}
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+// mirrorConfig returns proxy settings for a small mirror pool
+func mirrorConfig(workers, queue int, maxBody int64) *config.ProxyConfig {
+	cfg := config.Load().Proxy
+	cfg.MirrorWorkers = workers
+	cfg.MirrorQueueSize = queue
+	cfg.MirrorMaxBodyBytes = maxBody
+	cfg.MirrorTimeout = 5 * time.Second
+	return &cfg
+}
+
+// TestMirrorCopiesRequest tests that the mirror and the primary both see the full request
+func TestMirrorCopiesRequest(t *testing.T) {
+	m := testMetrics()
+	release := make(chan struct{})
+	close(release)
+	target, received := mirrorTarget(t, release)
+
+	mirror := proxy.NewMirror(mirrorConfig(1, 10, 1024), logger.Get(), m)
+	defer mirror.Stop()
+
+	before := testutil.ToFloat64(m.MirrorRequests.WithLabelValues("/mirror-copy", "4xx"))
+
+	payload := `{"order":42,"items":["a","b"]}`
+	req := httptest.NewRequest("POST", "/mirror-copy", strings.NewReader(payload))
+	req.Header.Set("X-Request-Id", "abc-123")
+	mirror.Submit("/mirror-copy", target.URL, req)
+
+	// The primary request must still read the whole body
+	primary, _ := io.ReadAll(req.Body)
+	if string(primary) != payload {
+		t.Errorf("Expected primary body %q, got %q", payload, primary)
+	}
+
+	select {
+	case got := <-received:
+		if got.body != payload {
+			t.Errorf("Expected mirrored body %q, got %q", payload, got.body)
+		}
+		if got.method != "POST" || got.header.Get("X-Request-Id") != "abc-123" {
+			t.Errorf("Expected method and headers to be copied, got %s %v", got.method, got.header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for mirrored request")
+	}
+
+	waitFor(t, func() bool {
+		return testutil.ToFloat64(m.MirrorRequests.WithLabelValues("/mirror-copy", "4xx")) == before+1
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		before := testutil.ToFloat64(m.MirrorRequests.WithLabelValues("/mirror-large", proxy.MirrorTooLarge))
+
+		large := strings.Repeat("x", 4096)
+		req := httptest.NewRequest("POST", "/mirror-large", strings.NewReader(large))
+		mirror.Submit("/mirror-large", target.URL, req)
+
+		primary, _ := io.ReadAll(req.Body)
+		if string(primary) != large {
+			t.Errorf("Expected primary to read all %d bytes, got %d", len(large), len(primary))
+		}
+		if got := testutil.ToFloat64(m.MirrorRequests.WithLabelValues("/mirror-large", proxy.MirrorTooLarge)); got != before+1 {
+			t.Errorf("Expected oversized body to be counted, got %v -> %v", before, got)
+		}
+	})
+}
+
+// TestMirrorNeverBlocks tests that a slow mirror target fills the bounded
+// queue and further copies are dropped instead of delaying the caller
+func TestMirrorNeverBlocks(t *testing.T) {
+	m := testMetrics()
+	release := make(chan struct{})
+	defer close(release)
+	target, received := mirrorTarget(t, release)
+
+	mirror := proxy.NewMirror(mirrorConfig(1, 1, 1024), logger.Get(), m)
+	defer mirror.Stop()
+
+	before := testutil.ToFloat64(m.MirrorRequests.WithLabelValues("/mirror-slow", proxy.MirrorDropped))
+
+	// Occupy the only worker
+	mirror.Submit("/mirror-slow", target.URL, httptest.NewRequest("GET", "/mirror-slow", nil))
+	<-received
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		mirror.Submit("/mirror-slow", target.URL, httptest.NewRequest("POST", "/mirror-slow", strings.NewReader("body")))
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected Submit not to wait for the mirror, took %s", elapsed)
+	}
+
+	// One copy fits in the queue, the rest are dropped
+	if got := testutil.ToFloat64(m.MirrorRequests.WithLabelValues("/mirror-slow", proxy.MirrorDropped)); got != before+19 {
+		t.Errorf("Expected 19 dropped copies, got %v", got-before)
+	}
+}
+
+// TestRouteMirror tests that a slow mirror doesn't delay proxied responses
+func TestRouteMirror(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	release := make(chan struct{})
+	defer close(release)
+	target, received := mirrorTarget(t, release)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	path := fmt.Sprintf("/mirror-%d", time.Now().UnixNano())
+	route := &database.Route{
+		Path:          path,
+		TargetURL:     backend.URL,
+		Method:        "POST",
+		Enabled:       true,
+		Timeout:       30,
+		MirrorURL:     target.URL,
+		MirrorPercent: 100,
+	}
+	repo := database.NewRouteRepository(db)
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	mirror := proxy.NewMirror(mirrorConfig(2, 10, 1024), log, testMetrics())
+	defer mirror.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, testMetrics(), nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		mirror,
+		nil,
+		testMetrics(),
+		log,
+	)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	proxyHandler.Handle(w, httptest.NewRequest("POST", path, strings.NewReader("shadow me")))
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusOK || w.Body.String() != "shadow me" {
+		t.Errorf("Expected primary response to be unaffected, got %d %q", w.Code, w.Body.String())
+	}
+	if elapsed > time.Second {
+		t.Errorf("Expected the slow mirror not to delay the client, took %s", elapsed)
+	}
+
+	select {
+	case got := <-received:
+		if got.body != "shadow me" {
+			t.Errorf("Expected mirrored body %q, got %q", "shadow me", got.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for mirrored request")
+	}
+}
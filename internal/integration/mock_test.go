@@ -0,0 +1,300 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/mock"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/redact"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestMockTemplate tests the variables filled into a mock body
+func TestMockTemplate(t *testing.T) {
+	r := httptest.NewRequest("POST", "/users/42?expand=orders&expand=cart&q=a+b", nil)
+	r.Header.Set("X-Tenant", `acme "inc"`)
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        string
+	}{
+		{"Path", "at ${path}", "", "at /users/42"},
+		{"Method", "${method} ${path}", "", "POST /users/42"},
+		{"Query", "${query.q}/${query.expand}", "", "a b/orders"},
+		{"Header", "tenant=${header.X-Tenant}", "", `tenant=acme "inc"`},
+		{"HeaderCase", "${header.x-tenant}", "", `acme "inc"`},
+		{"Missing", "[${query.page}][${header.X-Missing}]", "", "[][]"},
+		{"NoVariables", "plain $path {path} $", "", "plain $path {path} $"},
+		{"JSONEscaped", `{"tenant":"${header.X-Tenant}"}`, "application/json", `{"tenant":"acme \"inc\""}`},
+		{"JSONSuffix", `"${header.X-Tenant}"`, "application/problem+json; charset=utf-8", `"acme \"inc\""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &mock.Response{Body: tt.body}
+			if tt.contentType != "" {
+				m.Headers = map[string]string{"content-type": tt.contentType}
+			}
+			if err := m.Validate(); err != nil {
+				t.Fatalf("Expected a valid mock, got %v", err)
+			}
+			if got := m.Render(r); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestMockValidation tests the mock definitions rejected on a route
+func TestMockValidation(t *testing.T) {
+	for name, m := range map[string]mock.Response{
+		"Status":           {Status: 99},
+		"Header":           {Headers: map[string]string{"Bad Header": "x"}},
+		"HeaderValue":      {Headers: map[string]string{"X-Ok": "a\nb"}},
+		"NegativeLatency":  {LatencyMin: -1},
+		"InvertedLatency":  {LatencyMin: 200, LatencyMax: 100},
+		"ExcessiveLatency": {LatencyMax: int(mock.MaxLatency/time.Millisecond) + 1},
+		"UnknownVariable":  {Body: "${user}"},
+		"EmptyQuery":       {Body: "${query.}"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := m.Validate(); err == nil {
+				t.Error("Expected the mock to be rejected")
+			}
+		})
+	}
+
+	maxed := mock.Response{LatencyMin: 10, LatencyMax: int(mock.MaxLatency / time.Millisecond)}
+	if err := maxed.Validate(); err != nil {
+		t.Errorf("Expected latency up to the maximum to be allowed, got %v", err)
+	}
+}
+
+// TestMockLatency tests that injected latency stays within its bounds
+func TestMockLatency(t *testing.T) {
+	t.Run("Bounds", func(t *testing.T) {
+		m := &mock.Response{LatencyMin: 20, LatencyMax: 30}
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 500; i++ {
+			latency := m.Latency()
+			if latency < 20*time.Millisecond || latency > 30*time.Millisecond {
+				t.Fatalf("Expected latency between 20ms and 30ms, got %s", latency)
+			}
+			seen[latency] = true
+		}
+		if !seen[20*time.Millisecond] || !seen[30*time.Millisecond] || len(seen) < 5 {
+			t.Errorf("Expected latencies across the range including both bounds, got %v", seen)
+		}
+	})
+
+	t.Run("Fixed", func(t *testing.T) {
+		for _, m := range []*mock.Response{{LatencyMin: 15}, {LatencyMin: 15, LatencyMax: 15}} {
+			if got := m.Latency(); got != 15*time.Millisecond {
+				t.Errorf("Expected a fixed 15ms, got %s", got)
+			}
+		}
+		if got := (&mock.Response{}).Latency(); got != 0 {
+			t.Errorf("Expected no latency by default, got %s", got)
+		}
+	})
+
+	t.Run("Serve", func(t *testing.T) {
+		m := &mock.Response{Status: http.StatusCreated, Body: "done", LatencyMin: 30}
+		w := httptest.NewRecorder()
+		start := time.Now()
+		status, err := m.Serve(context.Background(), w, httptest.NewRequest("GET", "/", nil))
+		if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+			t.Errorf("Expected the response to wait 30ms, took %s", elapsed)
+		}
+		if err != nil || status != http.StatusCreated || w.Code != http.StatusCreated || w.Body.String() != "done" {
+			t.Errorf("Unexpected response %d %q (%v)", w.Code, w.Body.String(), err)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		m := &mock.Response{Body: "late", LatencyMin: int(mock.MaxLatency / time.Millisecond)}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		w := httptest.NewRecorder()
+		start := time.Now()
+		if _, err := m.Serve(ctx, w, httptest.NewRequest("GET", "/", nil)); err == nil {
+			t.Error("Expected the wait to end with the request")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected the wait to stop with the request, took %s", elapsed)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("Expected nothing written, got %q", w.Body.String())
+		}
+	})
+}
+
+// TestEcho tests the request reflected by an echo route
+func TestEcho(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/debug?a=1&a=2", strings.NewReader(`{"name":"isekai"}`))
+	r.Header.Set("X-Request-Id", "abc")
+	echo := mock.Echo(r, r.Header)
+	if echo.Method != "PUT" || echo.Path != "/debug" || echo.Body != `{"name":"isekai"}` || echo.BodyEncoding != "" {
+		t.Errorf("Unexpected echo %+v", echo)
+	}
+	if len(echo.Query["a"]) != 2 || echo.Headers["X-Request-Id"][0] != "abc" {
+		t.Errorf("Expected the query and headers, got %+v", echo)
+	}
+
+	binary := mock.Echo(httptest.NewRequest("POST", "/", strings.NewReader("\xff\xfe")), nil)
+	if binary.Body != "//4=" || binary.BodyEncoding != "base64" {
+		t.Errorf("Expected a base64 body, got %+v", binary)
+	}
+
+	large := mock.Echo(httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", mock.EchoMaxBody+10))), nil)
+	if len(large.Body) != mock.EchoMaxBody || !large.BodyTruncated {
+		t.Errorf("Expected the body to be truncated to %d bytes, got %d", mock.EchoMaxBody, len(large.Body))
+	}
+}
+
+// TestMockRouteValidation tests that routes need a target or a mock definition
+func TestMockRouteValidation(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	for name, tt := range map[string]struct {
+		body  string
+		valid bool
+	}{
+		"NoTarget":          {`{"path":"/a"}`, false},
+		"MockWithoutMock":   {`{"path":"/a","type":"mock"}`, false},
+		"MockOnProxy":       {`{"path":"/a","target_url":"http://api/a","mock":{"body":"x"}}`, false},
+		"MockOnEcho":        {`{"path":"/a","type":"echo","mock":{"body":"x"}}`, false},
+		"UnknownType":       {`{"path":"/a","type":"stub","target_url":"http://api/a"}`, false},
+		"MockLoadBalanced":  {`{"path":"/a","type":"mock","mock":{"body":"x"},"load_balanced":true}`, false},
+		"InvalidMock":       {`{"path":"/a","type":"mock","mock":{"body":"${nope}"}}`, false},
+		"Proxy":             {`{"path":"/a","target_url":"http://api/a"}`, true},
+		"Mock":              {`{"path":"/a","type":"mock","mock":{"status":201,"body":"${path}","latency_min":5}}`, true},
+		"Echo":              {`{"path":"/a","type":"echo"}`, true},
+		"MockIgnoresTarget": {`{"path":"/a","type":"mock","target_url":"http://api/a","mock":{"body":"x"}}`, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(tt.body)))
+			rejected := w.Code == http.StatusBadRequest && strings.Contains(w.Body.String(), response.CodeValidationFailed)
+			if rejected == tt.valid {
+				t.Errorf("Expected valid=%v, got %d %s", tt.valid, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestMockRoute tests mock and echo routes served by the proxy handler
+func TestMockRoute(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+	repo := database.NewRouteRepository(db)
+
+	suffix := time.Now().UnixNano()
+	mockRoute := &database.Route{
+		Path:    fmt.Sprintf("/mock-%d", suffix),
+		Method:  "GET",
+		Enabled: true,
+		Timeout: 30,
+		Type:    database.RouteTypeMock,
+		Mock: &mock.Response{
+			Status:     http.StatusAccepted,
+			Headers:    map[string]string{"Content-Type": "application/json", "X-Mock": "yes"},
+			Body:       `{"path":"${path}","id":"${query.id}","user":"${header.X-User}"}`,
+			LatencyMin: 10,
+			LatencyMax: 20,
+		},
+	}
+	echoRoute := &database.Route{
+		Path:    fmt.Sprintf("/echo-%d", suffix),
+		Method:  "POST",
+		Enabled: true,
+		Timeout: 30,
+		Type:    database.RouteTypeEcho,
+	}
+	for _, route := range []*database.Route{mockRoute, echoRoute} {
+		if err := repo.Create(context.Background(), route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		defer repo.Delete(context.Background(), route.ID)
+	}
+
+	stored, err := repo.FindByID(context.Background(), mockRoute.ID)
+	if err != nil || stored.Type != database.RouteTypeMock || stored.Mock == nil || stored.Mock.LatencyMax != 20 {
+		t.Fatalf("Expected the mock to be stored, got %+v (%v)", stored, err)
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	proxyHandler.SetHeaders(redact.NewHeaders(nil, []string{"Authorization"}))
+
+	t.Run("Mock", func(t *testing.T) {
+		r := httptest.NewRequest("GET", mockRoute.Path+"?id=7", nil)
+		r.Header.Set("X-User", "ana")
+		w := httptest.NewRecorder()
+		start := time.Now()
+		proxyHandler.Handle(w, r)
+
+		if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+			t.Errorf("Expected at least 10ms of injected latency, took %s", elapsed)
+		}
+		want := fmt.Sprintf(`{"path":"%s","id":"7","user":"ana"}`, mockRoute.Path)
+		if w.Code != http.StatusAccepted || w.Body.String() != want || w.Header().Get("X-Mock") != "yes" {
+			t.Errorf("Unexpected response %d %q %v", w.Code, w.Body.String(), w.Header())
+		}
+		if got := testutil.ToFloat64(m.MockResponses.WithLabelValues(mockRoute.Path, database.RouteTypeMock)); got != 1 {
+			t.Errorf("Expected the mock response to be counted, got %v", got)
+		}
+	})
+
+	t.Run("Echo", func(t *testing.T) {
+		r := httptest.NewRequest("POST", echoRoute.Path, strings.NewReader("hello"))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, r)
+
+		var resp struct {
+			Data mock.EchoResponse `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Unexpected response %d %s", w.Code, w.Body.String())
+		}
+		if resp.Data.Method != "POST" || resp.Data.Body != "hello" {
+			t.Errorf("Expected the request to be echoed, got %+v", resp.Data)
+		}
+		if got := resp.Data.Headers["Authorization"]; len(got) != 1 || got[0] != redact.Mask {
+			t.Errorf("Expected the Authorization header to be redacted, got %v", got)
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package integration
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zakirkun/isekai/internal/adminui"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// fakeOIDC is an OpenID Connect provider serving discovery, JWKS and a token
+// endpoint that redeems codes registered by the test for ID tokens
+type fakeOIDC struct {
+	*httptest.Server
+	key  *rsa.PrivateKey
+	keys *jwkSet
+
+	mu    sync.Mutex
+	codes map[string]string // Code to signed ID token
+}
+
+func newFakeOIDC(t *testing.T) *fakeOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	p := &fakeOIDC{key: key, keys: &jwkSet{}, codes: make(map[string]string)}
+	p.keys.add("provider", &key.PublicKey)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize?prompt=login",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.Handle("/jwks", p.keys)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "isekai" || secret != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != "https://gateway.example.com/api/auth/oidc/callback" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		p.mu.Lock()
+		idToken, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": idToken})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// issue registers a code redeemed for an ID token with claims, signed by key
+func (p *fakeOIDC) issue(t *testing.T, claims jwt.MapClaims, key *rsa.PrivateKey) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "provider"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign ID token: %v", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code := fmt.Sprintf("code-%d", len(p.codes)+1)
+	p.codes[code] = signed
+	return code
+}
+
+// oidcConfig returns auth configuration pointing at the fake provider
+func (p *fakeOIDC) config() *config.AuthConfig {
+	return &config.AuthConfig{
+		OIDCIssuerURL:    p.URL,
+		OIDCClientID:     "isekai",
+		OIDCClientSecret: "client-secret",
+		OIDCRedirectURL:  "https://gateway.example.com/api/auth/oidc/callback",
+		OIDCScopes:       []string{"openid", "profile"},
+		OIDCRolesClaim:   "groups",
+		OIDCRoleMap:      map[string][]string{"gateway-admins": {"admin"}, "gateway-publishers": {"publisher", "user"}},
+	}
+}
+
+// oidcSignIn starts a sign-in, has the provider issue an ID token with the
+// nonce the gateway sent, changed by edit, and follows the callback
+func oidcSignIn(t *testing.T, h *handlers.OIDCHandler, p *fakeOIDC, next string, edit func(claims jwt.MapClaims) *rsa.PrivateKey) *httptest.ResponseRecorder {
+	t.Helper()
+
+	login := httptest.NewRecorder()
+	h.Login(login, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login?next="+url.QueryEscape(next), nil))
+	if login.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, got %d %s", login.Code, login.Body.String())
+	}
+	location, _ := url.Parse(login.Header().Get("Location"))
+	query := location.Query()
+	if location.Path != "/authorize" || query.Get("prompt") != "login" || query.Get("client_id") != "isekai" || query.Get("scope") != "openid profile" || query.Get("response_type") != "code" {
+		t.Fatalf("Unexpected authorization URL %s", location)
+	}
+
+	claims := jwt.MapClaims{
+		"iss":                p.URL,
+		"aud":                "isekai",
+		"sub":                "248289761001",
+		"preferred_username": "jane",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              query.Get("nonce"),
+		"groups":             []string{"gateway-admins", "staff"},
+	}
+	key := p.key
+	if edit != nil {
+		if other := edit(claims); other != nil {
+			key = other
+		}
+	}
+	code := p.issue(t, claims, key)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?code="+code+"&state="+query.Get("state"), nil)
+	for _, cookie := range login.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	h.Callback(rec, req)
+	return rec
+}
+
+// TestOIDCLogin tests the code flow against a fake provider, issuing gateway
+// tokens with the mapped roles and refusing ID tokens that don't verify
+func TestOIDCLogin(t *testing.T) {
+	p := newFakeOIDC(t)
+	log := logger.Get()
+	authService := auth.NewAuthService("oidc-test-secret", log)
+	h := handlers.NewOIDCHandler(auth.NewOIDC(p.config(), log), authService, time.Hour, log)
+
+	t.Run("Token", func(t *testing.T) {
+		rec := oidcSignIn(t, h, p, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected a token, got %d %s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Data struct {
+				Token string `json:"token"`
+			} `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		claims, err := authService.ValidateToken(resp.Data.Token)
+		if err != nil {
+			t.Fatalf("Expected a valid gateway token: %v", err)
+		}
+		if claims.UserID != "oidc:248289761001" || claims.Username != "jane" || !slices.Equal(claims.Roles, []string{"admin"}) {
+			t.Errorf("Expected jane with only the mapped admin role, got %+v", claims)
+		}
+	})
+
+	t.Run("AdminUI", func(t *testing.T) {
+		rec := oidcSignIn(t, h, p, "/admin/routes", func(claims jwt.MapClaims) *rsa.PrivateKey {
+			claims["groups"] = []string{"gateway-publishers", "gateway-admins", "gateway-publishers"}
+			return nil
+		})
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/admin/routes" {
+			t.Fatalf("Expected a redirect back to the admin UI, got %d %q", rec.Code, rec.Header().Get("Location"))
+		}
+		var token string
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == adminui.TokenCookie {
+				token = cookie.Value
+			}
+		}
+		claims, err := authService.ValidateToken(token)
+		if err != nil {
+			t.Fatalf("Expected the admin UI token cookie set: %v", err)
+		}
+		if !slices.Equal(claims.Roles, []string{"publisher", "user", "admin"}) {
+			t.Errorf("Expected each mapped role once, got %v", claims.Roles)
+		}
+	})
+
+	t.Run("ForeignNext", func(t *testing.T) {
+		rec := oidcSignIn(t, h, p, "https://evil.example.com/admin", nil)
+		if rec.Header().Get("Location") != adminui.Prefix {
+			t.Errorf("Expected a foreign return path replaced by the admin UI, got %q", rec.Header().Get("Location"))
+		}
+	})
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rejected := map[string]func(jwt.MapClaims) *rsa.PrivateKey{
+		"audience":  func(c jwt.MapClaims) *rsa.PrivateKey { c["aud"] = "another-client"; return nil },
+		"issuer":    func(c jwt.MapClaims) *rsa.PrivateKey { c["iss"] = "https://idp.example.com"; return nil },
+		"expired":   func(c jwt.MapClaims) *rsa.PrivateKey { c["exp"] = time.Now().Add(-time.Minute).Unix(); return nil },
+		"nonce":     func(c jwt.MapClaims) *rsa.PrivateKey { c["nonce"] = "replayed"; return nil },
+		"subject":   func(c jwt.MapClaims) *rsa.PrivateKey { delete(c, "sub"); return nil },
+		"signature": func(c jwt.MapClaims) *rsa.PrivateKey { return other },
+	}
+	for name, edit := range rejected {
+		t.Run("Rejects/"+name, func(t *testing.T) {
+			if rec := oidcSignIn(t, h, p, "", edit); rec.Code != http.StatusUnauthorized {
+				t.Errorf("Expected 401, got %d %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("State", func(t *testing.T) {
+		login := httptest.NewRecorder()
+		h.Login(login, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+		location, _ := url.Parse(login.Header().Get("Location"))
+		code := p.issue(t, jwt.MapClaims{"iss": p.URL, "aud": "isekai", "sub": "1", "exp": time.Now().Add(time.Hour).Unix(), "nonce": location.Query().Get("nonce")}, p.key)
+
+		for name, state := range map[string]string{"forged": "forged", "missing": ""} {
+			req := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?code="+code+"&state="+state, nil)
+			for _, cookie := range login.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			rec := httptest.NewRecorder()
+			h.Callback(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("Expected a %s state refused, got %d", name, rec.Code)
+			}
+		}
+
+		// Without the cookie the state can't be checked
+		rec := httptest.NewRecorder()
+		h.Callback(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?code="+code+"&state="+location.Query().Get("state"), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected a callback without the state cookie refused, got %d", rec.Code)
+		}
+	})
+
+	t.Run("ProviderError", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.Callback(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?error=access_denied", nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected the provider's refusal passed on as 401, got %d", rec.Code)
+		}
+	})
+}
+
+// TestOIDCRolesClaim tests a nested roles claim used as roles without a map
+func TestOIDCRolesClaim(t *testing.T) {
+	p := newFakeOIDC(t)
+	cfg := p.config()
+	cfg.OIDCRolesClaim, cfg.OIDCRoleMap = "realm_access.roles", nil
+	log := logger.Get()
+	authService := auth.NewAuthService("oidc-test-secret", log)
+	h := handlers.NewOIDCHandler(auth.NewOIDC(cfg, log), authService, time.Hour, log)
+
+	rec := oidcSignIn(t, h, p, "", func(claims jwt.MapClaims) *rsa.PrivateKey {
+		claims["realm_access"] = map[string]interface{}{"roles": []string{"admin", "user"}}
+		delete(claims, "preferred_username")
+		claims["email"] = "jane@example.com"
+		return nil
+	})
+	var resp struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	claims, err := authService.ValidateToken(resp.Data.Token)
+	if err != nil {
+		t.Fatalf("Expected a valid gateway token, got %d: %v", rec.Code, err)
+	}
+	if !slices.Equal(claims.Roles, []string{"admin", "user"}) || claims.Username != "jane@example.com" {
+		t.Errorf("Expected the nested roles and the email as username, got %+v", claims)
+	}
+}
+
+// TestOIDCUnavailable tests sign-in failing cleanly while the provider is down
+func TestOIDCUnavailable(t *testing.T) {
+	p := newFakeOIDC(t)
+	cfg := p.config()
+	p.Close()
+
+	log := logger.Get()
+	h := handlers.NewOIDCHandler(auth.NewOIDC(cfg, log), auth.NewAuthService("oidc-test-secret", log), time.Hour, log)
+	rec := httptest.NewRecorder()
+	h.Login(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 while the provider is down, got %d", rec.Code)
+	}
+}
+
+// TestOIDCConfig tests the OIDC settings checked at startup
+func TestOIDCConfig(t *testing.T) {
+	t.Setenv("AUTH_OIDC_ISSUER_URL", "https://idp.example.com")
+	if err := config.Load().Validate(); err == nil {
+		t.Error("Expected OIDC without a client ID and redirect URL refused")
+	}
+
+	t.Setenv("AUTH_OIDC_CLIENT_ID", "isekai")
+	t.Setenv("AUTH_OIDC_REDIRECT_URL", "https://gateway.example.com/api/auth/oidc/callback")
+	t.Setenv("AUTH_OIDC_ROLE_MAP", "gateway-admins=admin,gateway-ops=operator|user")
+	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected valid OIDC configuration, got %v", err)
+	}
+	if !slices.Equal(cfg.Auth.OIDCRoleMap["gateway-ops"], []string{"operator", "user"}) {
+		t.Errorf("Expected the role map parsed, got %v", cfg.Auth.OIDCRoleMap)
+	}
+
+	t.Setenv("AUTH_OIDC_SCOPES", "profile,email")
+	if err := config.Load().Validate(); err == nil {
+		t.Error("Expected scopes without openid refused")
+	}
+}
@@ -0,0 +1,118 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/panics"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// explodeOrder panics like a handler indexing past its data
+func explodeOrder(id string) {
+	panic(fmt.Sprintf("order %s not loaded", id))
+}
+
+// TestPanicReports tests that a recovered panic is logged with its stack and
+// request, counted, posted to the webhook at its rate, and answered with the
+// request ID
+func TestPanicReports(t *testing.T) {
+	reports := make(chan map[string]interface{}, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&report)
+		reports <- report
+	}))
+	defer webhook.Close()
+
+	var logs bytes.Buffer
+	log := logger.New(&logs)
+	m := testMetrics()
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID, middleware.Recovery(log, m, panics.New(webhook.URL, 2, log)))
+	router.Get("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		explodeOrder(chi.URLParam(r, "id"))
+	})
+	router.With(middleware.Timeout(5*time.Second)).Get("/reports", func(w http.ResponseWriter, r *http.Request) {
+		explodeOrder("in a report")
+	})
+
+	call := func(path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		t.Helper()
+		logs.Reset()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var body map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode the error response: %v", err)
+		}
+		return w, body
+	}
+
+	w, body := call("/orders/7")
+	requestID := w.Header().Get("X-Request-ID")
+	if w.Code != http.StatusInternalServerError || requestID == "" || body["request_id"] != requestID {
+		t.Fatalf("Expected a 500 carrying the request ID %q, got %d %v", requestID, w.Code, body)
+	}
+	logged := logs.String()
+	for _, want := range []string{"Panic recovered: order 7 not loaded GET /orders/7", "handler /orders/{id}", "request " + requestID, "integration.explodeOrder", "panic_test.go"} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("Expected the log to contain %q, got %s", want, logged)
+		}
+	}
+
+	var report map[string]interface{}
+	select {
+	case report = <-reports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the panic report")
+	}
+	fingerprint, _ := report["fingerprint"].(string)
+	if len(fingerprint) != 16 || !strings.Contains(logged, "fingerprint "+fingerprint) {
+		t.Errorf("Expected the logged fingerprint reported, got %q", fingerprint)
+	}
+	if report["request_id"] != requestID || report["method"] != "GET" || report["path"] != "/orders/7" ||
+		report["handler"] != "/orders/{id}" || report["message"] != "order 7 not loaded" || report["type"] != "string" {
+		t.Errorf("Unexpected report %v", report)
+	}
+	if stack, _ := report["stack"].(string); !strings.Contains(stack, "integration.explodeOrder") {
+		t.Errorf("Expected the report to carry the stack, got %q", stack)
+	}
+
+	// The same panic about another order groups with the first
+	call("/orders/8")
+	if !strings.Contains(logs.String(), "fingerprint "+fingerprint) {
+		t.Errorf("Expected the same fingerprint for the same panic, got %s", logs.String())
+	}
+	if got := testutil.ToFloat64(m.Panics.WithLabelValues("/orders/{id}")); got != 2 {
+		t.Errorf("Expected 2 panics counted for the handler, got %v", got)
+	}
+
+	// A panic in the timeout's goroutine keeps the stack of where it happened
+	call("/reports")
+	logged = logs.String()
+	if !strings.Contains(logged, "integration.explodeOrder") || !strings.Contains(logged, "handler /reports") || strings.Contains(logged, "fingerprint "+fingerprint) {
+		t.Errorf("Expected the report's own stack and fingerprint, got %s", logged)
+	}
+
+	// Only 2 reports a minute are posted
+	for i := 0; i < 3; i++ {
+		call("/orders/9")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := len(reports); got != 1 {
+		t.Errorf("Expected 1 more report within the rate, got %d", got)
+	}
+	if got := testutil.ToFloat64(m.Panics.WithLabelValues("/orders/{id}")); got != 5 {
+		t.Errorf("Expected every panic counted, got %v", got)
+	}
+}
@@ -0,0 +1,411 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/plugin"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// traceRecorder records the plugins a request passes through
+type traceRecorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (tr *traceRecorder) record(name string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.calls = append(tr.calls, name)
+}
+
+func (tr *traceRecorder) take() []string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	calls := tr.calls
+	tr.calls = nil
+	return calls
+}
+
+// closingPlugin is a tracing plugin that counts how often it is closed
+type closingPlugin struct {
+	plugin.Func
+	closed *atomic.Int32
+}
+
+func (p closingPlugin) Close() error {
+	p.closed.Add(1)
+	return nil
+}
+
+// tracingRegistry registers plugins a, b and c, which record their name and
+// then call the next handler
+func tracingRegistry(tr *traceRecorder, closed *atomic.Int32) *plugin.Registry {
+	reg := plugin.NewRegistry()
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		reg.Register(name, func(config json.RawMessage) (plugin.Plugin, error) {
+			var cfg struct {
+				Stop bool `json:"stop"`
+			}
+			if err := plugin.Decode(config, &cfg); err != nil {
+				return nil, err
+			}
+			return closingPlugin{closed: closed, Func: func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					tr.record(name)
+					if cfg.Stop {
+						w.WriteHeader(http.StatusTeapot)
+						return
+					}
+					next.ServeHTTP(w, r)
+				})
+			}}, nil
+		})
+	}
+	return reg
+}
+
+// builtinRegistry registers the built-in plugins over fresh services
+func builtinRegistry(t *testing.T) *plugin.Registry {
+	t.Helper()
+
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	t.Cleanup(cacheInstance.Stop)
+
+	reg := plugin.NewRegistry()
+	plugin.RegisterBuiltins(reg, &plugin.Deps{
+		Auth:    auth.NewAuthService("test-secret", log),
+		Cache:   cacheInstance,
+		Proxy:   proxy.New(5*time.Second, &config.Load().Proxy, log),
+		Metrics: testMetrics(),
+		Log:     log,
+	})
+	return reg
+}
+
+// buildChain builds specs given as JSON around next
+func buildChain(t *testing.T, reg *plugin.Registry, specs string, next http.Handler) *plugin.Chain {
+	t.Helper()
+
+	var parsed []plugin.Spec
+	if err := json.Unmarshal([]byte(specs), &parsed); err != nil {
+		t.Fatalf("Failed to parse specs: %v", err)
+	}
+	chain, err := reg.Build(parsed, next)
+	if err != nil {
+		t.Fatalf("Failed to build chain: %v", err)
+	}
+	t.Cleanup(chain.Close)
+	return chain
+}
+
+// TestPluginChainOrder tests that plugins run in the order routes list them
+func TestPluginChainOrder(t *testing.T) {
+	tr := &traceRecorder{}
+	var closed atomic.Int32
+	reg := tracingRegistry(tr, &closed)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.record("upstream")
+	})
+
+	tests := []struct {
+		name   string
+		specs  string
+		want   []string
+		status int
+	}{
+		{"Empty", `[]`, []string{"upstream"}, http.StatusOK},
+		{"ABC", `[{"name":"a"},{"name":"b"},{"name":"c"}]`, []string{"a", "b", "c", "upstream"}, http.StatusOK},
+		{"CA", `[{"name":"c"},{"name":"a"}]`, []string{"c", "a", "upstream"}, http.StatusOK},
+		{"Repeated", `[{"name":"b"},{"name":"b"}]`, []string{"b", "b", "upstream"}, http.StatusOK},
+		{"ShortCircuit", `[{"name":"a"},{"name":"b","config":{"stop":true}},{"name":"c"}]`, []string{"a", "b"}, http.StatusTeapot},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := buildChain(t, reg, tt.specs, upstream)
+
+			w := httptest.NewRecorder()
+			chain.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+			if got := tr.take(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+
+	t.Run("Close", func(t *testing.T) {
+		closed.Store(0)
+		chain, err := reg.Build([]plugin.Spec{{Name: "a"}, {Name: "b"}}, upstream)
+		if err != nil {
+			t.Fatalf("Failed to build chain: %v", err)
+		}
+		chain.Close()
+		if closed.Load() != 2 {
+			t.Errorf("Expected both plugins to be closed, got %d", closed.Load())
+		}
+	})
+}
+
+// TestPluginValidation tests that unknown plugins and bad configuration are rejected
+func TestPluginValidation(t *testing.T) {
+	reg := builtinRegistry(t)
+
+	for name, specs := range map[string][]plugin.Spec{
+		"Unknown":           {{Name: "gzip"}},
+		"UnknownAfterValid": {{Name: plugin.IPACL}, {Name: "gzip"}},
+		"UnknownField":      {{Name: plugin.RateLimit, Config: json.RawMessage(`{"requests_per_second":5,"burst":2}`)}},
+		"ZeroRate":          {{Name: plugin.RateLimit}},
+		"BadTTL":            {{Name: plugin.Cache, Config: json.RawMessage(`{"ttl":"soon"}`)}},
+		"BadCIDR":           {{Name: plugin.IPACL, Config: json.RawMessage(`{"allow":["10.0.0.0/33"]}`)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := reg.Validate(specs); err == nil {
+				t.Error("Expected validation to fail")
+			}
+		})
+	}
+
+	valid := []plugin.Spec{
+		{Name: plugin.IPACL, Config: json.RawMessage(`{"deny":["192.0.2.0/24"]}`)},
+		{Name: plugin.Auth, Config: json.RawMessage(`{"roles":["admin"]}`)},
+		{Name: plugin.RateLimit, Config: json.RawMessage(`{"requests_per_second":5}`)},
+		{Name: plugin.Cache, Config: json.RawMessage(`{"ttl":"30s"}`)},
+		{Name: plugin.Transform, Config: json.RawMessage(`{"request":{"rename":{"a":"b"}}}`)},
+	}
+	if err := reg.Validate(valid); err != nil {
+		t.Errorf("Expected built-in plugins to validate, got %v", err)
+	}
+
+	t.Run("RouteHandler", func(t *testing.T) {
+		log := logger.Get()
+		cacheInstance := cache.New(&config.Load().Cache, log, nil)
+		defer cacheInstance.Stop()
+		routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+		routeHandler.SetPlugins(reg)
+
+		for name, body := range map[string]string{
+			"Unknown":   `{"path":"/a","target_url":"http://api/a","plugins":[{"name":"gzip"}]}`,
+			"BadConfig": `{"path":"/a","target_url":"http://api/a","plugins":[{"name":"ratelimit","config":{"requests_per_second":0}}]}`,
+			"Transform": `{"path":"/a","target_url":"http://api/a","transform":{"request":{"delete":["a"]}},"plugins":[{"name":"transform","config":{"request":{"delete":["b"]}}}]}`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(body)))
+				if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), response.CodeValidationFailed) {
+					t.Errorf("Expected 400 %s, got %d %s", response.CodeValidationFailed, w.Code, w.Body.String())
+				}
+			})
+		}
+	})
+}
+
+// TestBuiltinPlugins tests the built-in plugins and that chains don't share state
+func TestBuiltinPlugins(t *testing.T) {
+	reg := builtinRegistry(t)
+
+	var upstreamCalls atomic.Int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := upstreamCalls.Add(1)
+		fmt.Fprintf(w, "response %d", n)
+	})
+
+	get := func(h http.Handler, remoteAddr, header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/items?page=1", nil)
+		req.RemoteAddr = remoteAddr
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("RateLimitIsolation", func(t *testing.T) {
+		specs := `[{"name":"ratelimit","config":{"requests_per_second":1}}]`
+		routeA := buildChain(t, reg, specs, upstream)
+		routeB := buildChain(t, reg, specs, upstream)
+
+		if w := get(routeA, "192.0.2.1:1000", ""); w.Code != http.StatusOK {
+			t.Fatalf("Expected first request on route A to pass, got %d", w.Code)
+		}
+		if w := get(routeA, "192.0.2.1:1000", ""); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected second request on route A to be limited, got %d", w.Code)
+		}
+		if w := get(routeB, "192.0.2.1:1000", ""); w.Code != http.StatusOK {
+			t.Errorf("Expected route B to have its own limit, got %d", w.Code)
+		}
+	})
+
+	t.Run("CacheIsolation", func(t *testing.T) {
+		specs := `[{"name":"cache","config":{"ttl":"1m"}}]`
+		routeA := buildChain(t, reg, specs, upstream)
+		routeB := buildChain(t, reg, specs, upstream)
+
+		first := get(routeA, "192.0.2.1:1000", "")
+		second := get(routeA, "192.0.2.1:1000", "")
+		if first.Header().Get(plugin.CacheHeader) != "MISS" || second.Header().Get(plugin.CacheHeader) != "HIT" {
+			t.Errorf("Expected MISS then HIT, got %q then %q", first.Header().Get(plugin.CacheHeader), second.Header().Get(plugin.CacheHeader))
+		}
+		if second.Body.String() != first.Body.String() {
+			t.Errorf("Expected cached body %q, got %q", first.Body.String(), second.Body.String())
+		}
+
+		if w := get(routeB, "192.0.2.1:1000", ""); w.Header().Get(plugin.CacheHeader) != "MISS" {
+			t.Errorf("Expected route B to miss route A's entry, got %q", w.Header().Get(plugin.CacheHeader))
+		}
+		if w := get(routeA, "192.0.2.1:1000", "Bearer other"); w.Header().Get(plugin.CacheHeader) != "MISS" {
+			t.Errorf("Expected a different Authorization header to miss, got %q", w.Header().Get(plugin.CacheHeader))
+		}
+	})
+
+	t.Run("IPACL", func(t *testing.T) {
+		chain := buildChain(t, reg, `[{"name":"ipacl","config":{"allow":["192.0.2.0/24"]}}]`, upstream)
+
+		if w := get(chain, "192.0.2.1:1000", ""); w.Code != http.StatusOK {
+			t.Errorf("Expected allowed client to pass, got %d", w.Code)
+		}
+		w := get(chain, "203.0.113.1:1000", "")
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), response.CodeAccessDenied) {
+			t.Errorf("Expected 403 %s, got %d %s", response.CodeAccessDenied, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Auth", func(t *testing.T) {
+		chain := buildChain(t, reg, `[{"name":"auth","config":{"roles":["admin"]}}]`, upstream)
+		authService := auth.NewAuthService("test-secret", logger.Get())
+
+		if w := get(chain, "192.0.2.1:1000", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 without a token, got %d", w.Code)
+		}
+
+		user, err := authService.GenerateToken("user-1", "alice", []string{"user"}, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		if w := get(chain, "192.0.2.1:1000", "Bearer "+user); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 without the role, got %d", w.Code)
+		}
+
+		admin, err := authService.GenerateToken("user-2", "bob", []string{"admin"}, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		if w := get(chain, "192.0.2.1:1000", "Bearer "+admin); w.Code != http.StatusOK {
+			t.Errorf("Expected 200 with the role, got %d", w.Code)
+		}
+	})
+}
+
+// TestRoutePlugins tests plugin chains run by the proxy handler and rebuilt
+// when the route changes
+func TestRoutePlugins(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	var upstreamCalls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+	}))
+	defer backend.Close()
+
+	tr := &traceRecorder{}
+	var closed atomic.Int32
+	reg := tracingRegistry(tr, &closed)
+
+	repo := database.NewRouteRepository(db)
+	newRoute := func(specs ...plugin.Spec) *database.Route {
+		route := &database.Route{
+			Path:      fmt.Sprintf("/plugins-%d", time.Now().UnixNano()),
+			TargetURL: backend.URL,
+			Method:    "GET",
+			Enabled:   true,
+			Timeout:   30,
+			Plugins:   specs,
+		}
+		if err := repo.Create(context.Background(), route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		t.Cleanup(func() { repo.Delete(context.Background(), route.ID) })
+		return route
+	}
+	routeA := newRoute(plugin.Spec{Name: "a"}, plugin.Spec{Name: "b"})
+	routeB := newRoute(plugin.Spec{Name: "c"})
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, testMetrics(), nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		testMetrics(),
+		log,
+	)
+	proxyHandler.SetPlugins(reg)
+
+	request := func(route *database.Route) int {
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", route.Path, nil))
+		return w.Code
+	}
+
+	for route, want := range map[*database.Route]string{routeA: "a,b", routeB: "c"} {
+		for i := 0; i < 2; i++ {
+			if status := request(route); status != http.StatusOK {
+				t.Errorf("%s: expected status 200, got %d", route.Path, status)
+			}
+			if got := strings.Join(tr.take(), ","); got != want {
+				t.Errorf("%s: expected plugins %s, got %s", route.Path, want, got)
+			}
+		}
+	}
+	if upstreamCalls.Load() != 4 {
+		t.Errorf("Expected 4 forwarded requests, got %d", upstreamCalls.Load())
+	}
+
+	routeA.Plugins = []plugin.Spec{{Name: "c"}, {Name: "a", Config: json.RawMessage(`{"stop":true}`)}}
+	if err := repo.Update(context.Background(), routeA); err != nil {
+		t.Fatalf("Failed to update route: %v", err)
+	}
+	if status := request(routeA); status != http.StatusTeapot {
+		t.Errorf("Expected the rebuilt chain to answer 418, got %d", status)
+	}
+	if got := strings.Join(tr.take(), ","); got != "c,a" {
+		t.Errorf("Expected plugins c,a after the update, got %s", got)
+	}
+	if closed.Load() != 2 {
+		t.Errorf("Expected the old chain's 2 plugins to be closed, got %d", closed.Load())
+	}
+	if upstreamCalls.Load() != 4 {
+		t.Errorf("Expected the short-circuited request not to be forwarded, got %d calls", upstreamCalls.Load())
+	}
+}
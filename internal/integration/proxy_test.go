@@ -0,0 +1,244 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestProxyTransportStats tests that connection reuse is reported
+func TestProxyTransportStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		if _, err := p.ForwardAndCopy(context.Background(), w, httptest.NewRequest("GET", "/", nil), backend.URL); err != nil {
+			t.Fatalf("Failed to forward: %v", err)
+		}
+	}
+
+	stats := p.Stats()
+	if stats.Requests != 5 {
+		t.Errorf("Expected 5 requests, got %d", stats.Requests)
+	}
+	if stats.ConnsCreated != 1 || stats.ConnsReused != 4 {
+		t.Errorf("Expected 1 new and 4 reused connections, got %d and %d", stats.ConnsCreated, stats.ConnsReused)
+	}
+
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		authService := auth.NewAuthService("test-secret", logger.Get())
+		handler := testRouter(t, authService, func(cfg *config.Config) {
+			cfg.Auth.Enabled = true
+			cfg.Gateway.RateLimitEnabled = false
+		})
+		stats := func(roles ...string) int {
+			req := httptest.NewRequest("GET", "/api/proxy/stats", nil)
+			if len(roles) > 0 {
+				token, err := authService.GenerateToken("user-1", "alice", roles, time.Hour)
+				if err != nil {
+					t.Fatalf("Failed to generate token: %v", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w.Code
+		}
+		if code := stats(); code != http.StatusUnauthorized {
+			t.Errorf("Expected the endpoint to require authentication, got %d", code)
+		}
+		if code := stats("user"); code != http.StatusForbidden {
+			t.Errorf("Expected the endpoint to require the admin role, got %d", code)
+		}
+		if code := stats("admin"); code != http.StatusOK {
+			t.Errorf("Expected admins to get the stats, got %d", code)
+		}
+	})
+}
+
+// BenchmarkProxyTransport compares throughput to a single backend with the
+// previous implicit transport defaults and the tuned transport
+func BenchmarkProxyTransport(b *testing.B) {
+	// A little upstream latency keeps many connections busy at once
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	tuned := config.Load().Proxy
+
+	// http.DefaultTransport keeps only two idle connections per host
+	defaults := tuned
+	defaults.MaxIdleConns = 100
+	defaults.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+
+	for _, bc := range []struct {
+		name string
+		cfg  config.ProxyConfig
+	}{
+		{"Defaults", defaults},
+		{"Tuned", tuned},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			p := proxy.New(5*time.Second, &bc.cfg, logger.Get())
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					w := httptest.NewRecorder()
+					p.ForwardAndCopy(context.Background(), w, httptest.NewRequest("GET", "/", nil), backend.URL)
+				}
+			})
+			b.StopTimer()
+
+			b.ReportMetric(p.Stats().ReuseRatio, "reuse")
+		})
+	}
+}
+
+// startProxy serves every request through the proxy to a backend
+func startProxy(t *testing.T, p *proxy.Proxy, backend http.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	upstream := httptest.NewServer(backend)
+	t.Cleanup(upstream.Close)
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ForwardAndCopy(r.Context(), w, r, upstream.URL)
+	}))
+	t.Cleanup(gateway.Close)
+
+	return gateway
+}
+
+// TestProxyReverseProxySemantics tests HTTP semantics the proxy must preserve
+func TestProxyReverseProxySemantics(t *testing.T) {
+	p := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+
+	t.Run("Trailers", func(t *testing.T) {
+		gateway := startProxy(t, p, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte("payload"))
+			w.Header().Set("X-Checksum", "abc123")
+		})
+
+		resp, err := http.Get(gateway.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		io.ReadAll(resp.Body)
+
+		if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+			t.Errorf("Expected trailer abc123, got %q", got)
+		}
+	})
+
+	t.Run("NotModified", func(t *testing.T) {
+		gateway := startProxy(t, p, func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("fresh"))
+		})
+
+		req, _ := http.NewRequest("GET", gateway.URL, nil)
+		req.Header.Set("If-None-Match", `"v1"`)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+			t.Errorf("Expected empty 304, got %d with %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		gateway := startProxy(t, p, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodHead {
+				t.Errorf("Expected HEAD upstream, got %s", r.Method)
+			}
+			w.Header().Set("Content-Length", "42")
+		})
+
+		resp, err := http.Head(gateway.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusOK || resp.ContentLength != 42 || len(body) != 0 {
+			t.Errorf("Unexpected HEAD response: %d, length %d, body %q", resp.StatusCode, resp.ContentLength, body)
+		}
+	})
+
+	t.Run("ForwardedHeaders", func(t *testing.T) {
+		gateway := startProxy(t, p, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Header.Get("X-Forwarded-For") + "|" + r.Header.Get("X-Forwarded-Host")))
+		})
+
+		resp, err := http.Get(gateway.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		if want := "127.0.0.1|" + strings.TrimPrefix(gateway.URL, "http://"); string(body) != want {
+			t.Errorf("Expected %q, got %q", want, body)
+		}
+	})
+
+	t.Run("ResponseHook", func(t *testing.T) {
+		hooked := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+		hooked.OnResponse(func(resp *http.Response) error {
+			resp.Header.Set("X-Gateway", "isekai")
+			return nil
+		})
+		gateway := startProxy(t, hooked, func(w http.ResponseWriter, r *http.Request) {})
+
+		resp, err := http.Get(gateway.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if got := resp.Header.Get("X-Gateway"); got != "isekai" {
+			t.Errorf("Expected hook header, got %q", got)
+		}
+	})
+
+	t.Run("UpstreamDown", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		status, err := p.ForwardAndCopy(context.Background(), w, httptest.NewRequest("GET", "/", nil), "http://127.0.0.1:1")
+
+		var upstreamErr *proxy.UpstreamError
+		if !errors.As(err, &upstreamErr) || status != http.StatusBadGateway {
+			t.Fatalf("Expected upstream error with 502, got %d / %v", status, err)
+		}
+		if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), `"success":false`) {
+			t.Errorf("Expected JSON 502 response, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
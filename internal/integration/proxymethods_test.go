@@ -0,0 +1,227 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/mock"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// methodsProxyHandler returns a proxy handler over db for the method tests
+func methodsProxyHandler(t *testing.T, db *database.Database) *handlers.ProxyHandler {
+	t.Helper()
+
+	log := logger.Get()
+	m := testMetrics()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	t.Cleanup(cacheInstance.Stop)
+	return handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+}
+
+// TestCORSPassthrough tests that OPTIONS requests for passthrough routes
+// reach the next handler while the others are answered locally
+func TestCORSPassthrough(t *testing.T) {
+	var reached []string
+	handler := middleware.CORSPassthrough([]string{"https://app.example.com"}, func(r *http.Request) bool {
+		return r.URL.Path == "/upstream"
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = append(reached, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example.com")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Local", func(t *testing.T) {
+		reached = nil
+		w := serve(http.MethodOptions, "/local")
+		if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+			t.Errorf("Expected the preflight answered locally, got %d %v", w.Code, w.Header())
+		}
+		if len(reached) != 0 {
+			t.Errorf("Expected the preflight not forwarded, got %v", reached)
+		}
+	})
+
+	t.Run("Passthrough", func(t *testing.T) {
+		reached = nil
+		w := serve(http.MethodOptions, "/upstream")
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected the upstream's answer, got %d", w.Code)
+		}
+		if got := w.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://upstream.example.com" {
+			t.Errorf("Expected only the upstream's CORS headers, got %v", got)
+		}
+		if w.Header().Get("Access-Control-Max-Age") != "" {
+			t.Errorf("Expected no local CORS headers, got %v", w.Header())
+		}
+	})
+
+	t.Run("OtherMethods", func(t *testing.T) {
+		reached = nil
+		w := serve(http.MethodGet, "/upstream")
+		if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || len(reached) != 1 {
+			t.Errorf("Expected other methods handled as before, got %v reaching %v", w.Header(), reached)
+		}
+	})
+}
+
+// TestTraceRejected tests that TRACE is refused before any route is looked
+// up unless it is allowed
+func TestTraceRejected(t *testing.T) {
+	proxyHandler := methodsProxyHandler(t, database.NewDisconnected(closedDatabaseConfig(t), logger.Get(), nil))
+
+	w := httptest.NewRecorder()
+	proxyHandler.Handle(w, httptest.NewRequest(http.MethodTrace, "/orders", nil))
+	if w.Code != http.StatusMethodNotAllowed || !strings.Contains(w.Body.String(), response.CodeMethodNotAllowed) {
+		t.Errorf("Expected 405, got %d %s", w.Code, w.Body.String())
+	}
+	if allow := w.Header().Get("Allow"); allow == "" || strings.Contains(allow, http.MethodTrace) {
+		t.Errorf("Expected an Allow header without TRACE, got %q", allow)
+	}
+
+	// Allowed, TRACE is looked up like any method, here without a database
+	proxyHandler.SetAllowTrace(true)
+	w = httptest.NewRecorder()
+	proxyHandler.Handle(w, httptest.NewRequest(http.MethodTrace, "/orders", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the route lookup to be attempted, got %d", w.Code)
+	}
+}
+
+// TestPassthroughOptionsValidation tests that passthrough_options is only
+// accepted on routes serving OPTIONS
+func TestPassthroughOptionsValidation(t *testing.T) {
+	log := logger.Get()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), nil, nil, log)
+
+	for method, valid := range map[string]bool{"GET": false, "": false, "OPTIONS": true, "*": true} {
+		body := fmt.Sprintf(`{"path":"/cors","target_url":"http://api","method":%q,"passthrough_options":true}`, method)
+		w := httptest.NewRecorder()
+		routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(body)))
+		rejected := w.Code == http.StatusBadRequest && strings.Contains(w.Body.String(), response.CodeValidationFailed)
+		if rejected == valid {
+			t.Errorf("Expected method %q valid=%v, got %d %s", method, valid, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestHeadResponses tests that HEAD responses carry the length of the body a
+// GET receives, without the body
+func TestHeadResponses(t *testing.T) {
+	db := testDatabase(t)
+	repo := database.NewRouteRepository(db)
+
+	var methods []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Write([]byte("upstream body"))
+	}))
+	defer upstream.Close()
+
+	suffix := time.Now().UnixNano()
+	proxied := &database.Route{Path: fmt.Sprintf("/head-proxy-%d", suffix), TargetURL: upstream.URL, Method: "GET", Enabled: true, Timeout: 30}
+	mocked := &database.Route{Path: fmt.Sprintf("/head-mock-%d", suffix), Method: "GET", Enabled: true, Timeout: 30,
+		Type: database.RouteTypeMock, Mock: &mock.Response{Status: http.StatusOK, Body: `{"mocked":true}`}}
+	for _, route := range []*database.Route{proxied, mocked} {
+		if err := repo.Create(context.Background(), route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		defer repo.Delete(context.Background(), route.ID)
+	}
+
+	proxyHandler := methodsProxyHandler(t, db)
+	for name, path := range map[string]string{"Proxied": proxied.Path, "Mocked": mocked.Path} {
+		t.Run(name, func(t *testing.T) {
+			get := httptest.NewRecorder()
+			proxyHandler.Handle(get, httptest.NewRequest(http.MethodGet, path, nil))
+			head := httptest.NewRecorder()
+			proxyHandler.Handle(head, httptest.NewRequest(http.MethodHead, path, nil))
+
+			if head.Code != get.Code || head.Body.Len() != 0 {
+				t.Errorf("Expected %d without a body, got %d with %q", get.Code, head.Code, head.Body.String())
+			}
+			if want := strconv.Itoa(get.Body.Len()); head.Header().Get("Content-Length") != want {
+				t.Errorf("Expected Content-Length %s, got %q", want, head.Header().Get("Content-Length"))
+			}
+		})
+	}
+	if len(methods) != 2 || methods[1] != http.MethodHead {
+		t.Errorf("Expected the upstream to get GET then HEAD, got %v", methods)
+	}
+}
+
+// TestOptionsPassthrough tests OPTIONS requests reaching the upstream of a
+// passthrough route while other routes' preflights are answered locally
+func TestOptionsPassthrough(t *testing.T) {
+	db := testDatabase(t)
+	repo := database.NewRouteRepository(db)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example.com")
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	suffix := time.Now().UnixNano()
+	passthrough := &database.Route{Path: fmt.Sprintf("/options-%d", suffix), TargetURL: upstream.URL, Method: "*", Enabled: true, Timeout: 30, PassthroughOptions: true}
+	local := &database.Route{Path: fmt.Sprintf("/local-%d", suffix), TargetURL: upstream.URL, Method: "*", Enabled: true, Timeout: 30}
+	for _, route := range []*database.Route{passthrough, local} {
+		if err := repo.Create(context.Background(), route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		defer repo.Delete(context.Background(), route.ID)
+	}
+
+	handler := middleware.CORSPassthrough([]string{"*"}, handlers.OptionsPassthrough(db))(http.HandlerFunc(methodsProxyHandler(t, db).Handle))
+	preflight := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, path, nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := preflight(passthrough.Path); w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://upstream.example.com" {
+		t.Errorf("Expected the upstream's answer, got %d %v", w.Code, w.Header())
+	}
+	if w := preflight(local.Path); w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Expected the preflight answered locally, got %d %v", w.Code, w.Header())
+	}
+}
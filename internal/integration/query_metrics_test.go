@@ -0,0 +1,89 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// queryCount returns how many durations were observed for a query type
+func queryCount(t *testing.T, m *metrics.Metrics, name string) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+	if err := m.DatabaseQueries.WithLabelValues(name).(prometheus.Histogram).Write(&metric); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// TestQueryMetricsDisconnected tests that failed queries are timed too
+func TestQueryMetricsDisconnected(t *testing.T) {
+	m := testMetrics()
+	db := database.NewDisconnected(closedDatabaseConfig(t), logger.Get(), m)
+	ctx := context.Background()
+
+	before := queryCount(t, m, "route_find_by_path")
+	if _, err := database.NewRouteRepository(db).FindByPath(ctx, "", "/users", "GET"); !database.IsUnavailable(err) {
+		t.Fatalf("Expected unavailable error, got %v", err)
+	}
+	if got := queryCount(t, m, "route_find_by_path"); got != before+1 {
+		t.Errorf("Expected one observation, got %d", got-before)
+	}
+}
+
+// TestQueryMetrics tests that repository calls record query durations
+func TestQueryMetrics(t *testing.T) {
+	db := testDatabase(t)
+	m := testMetrics()
+	ctx := context.Background()
+
+	routes := database.NewRouteRepository(db)
+	logs := database.NewRequestLogRepository(db)
+
+	queries := []string{
+		"route_create", "route_find_by_id", "route_find_by_path", "route_find_all",
+		"route_update", "route_delete", "request_log_create", "request_log_find_by_route",
+		"request_log_find_by_filter",
+	}
+	before := make(map[string]uint64)
+	for _, name := range queries {
+		before[name] = queryCount(t, m, name)
+	}
+
+	route := &database.Route{
+		Path:      fmt.Sprintf("/query-metrics-%d", time.Now().UnixNano()),
+		TargetURL: "http://localhost:3000",
+		Method:    "GET",
+		Enabled:   true,
+		Timeout:   30,
+	}
+	if err := routes.Create(ctx, route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	routes.FindByID(ctx, route.ID)
+	routes.FindByPath(ctx, route.Host, route.Path, route.Method)
+	routes.FindAll(ctx)
+	routes.Update(ctx, route)
+
+	logs.Create(ctx, &database.RequestLog{RouteID: &route.ID, Method: "GET", Path: route.Path, StatusCode: 200})
+	logs.FindByRouteID(ctx, route.ID, 10)
+	logs.FindByFilter(ctx, database.RequestLogFilter{RouteID: &route.ID, Limit: 10})
+
+	if err := routes.Delete(ctx, route.ID); err != nil {
+		t.Fatalf("Failed to delete route: %v", err)
+	}
+
+	for _, name := range queries {
+		if got := queryCount(t, m, name); got <= before[name] {
+			t.Errorf("Expected %s to be observed", name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// timedDatabase connects with the given query timeout, skipping the test
+// without a database
+func timedDatabase(t *testing.T, timeout time.Duration, m *metrics.Metrics) *database.Database {
+	t.Helper()
+
+	cfg := config.Load()
+	cfg.Database.ConnectRetries = 0
+	cfg.Database.QueryTimeout = timeout
+	db, err := database.New(&cfg.Database, logger.Get(), m)
+	if err != nil {
+		t.Skipf("Skipping integration test - database not available: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	if err := db.InitSchema(context.Background()); err != nil {
+		t.Fatalf("Failed to initialize schema: %v", err)
+	}
+	return db
+}
+
+// sleep runs pg_sleep for d through the gateway's query path
+func sleep(ctx context.Context, db *database.Database, d time.Duration) error {
+	return db.WithTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "SELECT pg_sleep($1)", d.Seconds())
+		return err
+	})
+}
+
+// TestQueryErrorClassification tests telling cancelled requests and timed
+// out queries apart from failed ones
+func TestQueryErrorClassification(t *testing.T) {
+	for name, tt := range map[string]struct {
+		err                   error
+		canceled, unavailable bool
+	}{
+		"Canceled":    {fmt.Errorf("%w: %w", database.ErrCanceled, errors.New("conn closed")), true, false},
+		"Context":     {fmt.Errorf("scan: %w", context.Canceled), true, false},
+		"Timeout":     {fmt.Errorf("%w after 5s: %w", database.ErrQueryTimeout, context.DeadlineExceeded), false, true},
+		"Unavailable": {database.ErrUnavailable, false, true},
+		"Failed":      {errors.New("syntax error"), false, false},
+	} {
+		if database.IsCanceled(tt.err) != tt.canceled || database.IsUnavailable(tt.err) != tt.unavailable {
+			t.Errorf("%s: expected canceled=%v unavailable=%v for %v", name, tt.canceled, tt.unavailable, tt.err)
+		}
+	}
+}
+
+// TestQueryTimeout tests that a stalled query fails with ErrQueryTimeout
+// once DB_QUERY_TIMEOUT passes instead of holding the caller
+func TestQueryTimeout(t *testing.T) {
+	m := testMetrics()
+	db := timedDatabase(t, 200*time.Millisecond, m)
+
+	start := time.Now()
+	err := sleep(context.Background(), db, 5*time.Second)
+	if !errors.Is(err, database.ErrQueryTimeout) || !database.IsUnavailable(err) || database.IsCanceled(err) {
+		t.Fatalf("Expected a query timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the query abandoned after the timeout, took %s", elapsed)
+	}
+	if got := testutil.ToFloat64(m.DatabaseQueryErrors.WithLabelValues(database.QueryErrorTimeout)); got != 1 {
+		t.Errorf("Expected 1 timed out query counted, got %v", got)
+	}
+
+	// The pool is still usable afterwards
+	if _, err := database.NewRouteRepository(db).FindAll(context.Background()); err != nil {
+		t.Errorf("Expected queries to work after a timeout, got %v", err)
+	}
+}
+
+// TestQueryTimeoutMinimum tests that a tiny DB_QUERY_TIMEOUT is raised to a
+// usable minimum
+func TestQueryTimeoutMinimum(t *testing.T) {
+	db := timedDatabase(t, time.Millisecond, testMetrics())
+
+	if err := sleep(context.Background(), db, 20*time.Millisecond); err != nil {
+		t.Errorf("Expected a 20ms query to fit the minimum timeout, got %v", err)
+	}
+}
+
+// TestQueryClientCancellation tests that a query cancelled with its request
+// is reported as cancelled, not as a database failure
+func TestQueryClientCancellation(t *testing.T) {
+	m := testMetrics()
+	db := timedDatabase(t, 5*time.Second, m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err := sleep(ctx, db, 5*time.Second)
+	if !database.IsCanceled(err) || database.IsUnavailable(err) {
+		t.Fatalf("Expected a cancelled query, got %v", err)
+	}
+	if got := testutil.ToFloat64(m.DatabaseQueryErrors.WithLabelValues(database.QueryErrorCanceled)); got != 1 {
+		t.Errorf("Expected 1 cancelled query counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.DatabaseQueryErrors.WithLabelValues(database.QueryErrorFailed)); got != 0 {
+		t.Errorf("Expected no failed queries counted, got %v", got)
+	}
+
+	t.Run("RouteLookup", func(t *testing.T) {
+		log := logger.Get()
+		cacheInstance := cache.New(&config.Load().Cache, log, nil)
+		defer cacheInstance.Stop()
+		proxyHandler := handlers.NewProxyHandler(
+			db,
+			proxy.New(5*time.Second, &config.Load().Proxy, log),
+			cacheInstance,
+			circuitbreaker.New(log, m, nil),
+			loadbalancer.New(loadbalancer.RoundRobin, nil),
+			nil,
+			nil,
+			m,
+			log,
+		)
+
+		// The client is gone before the route is looked up
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", "/gone", nil).WithContext(ctx))
+		if w.Body.Len() != 0 {
+			t.Errorf("Expected nothing answered to a gone client, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestTieredRateLimit tests limits by API key, user and client IP at the rate of the caller's tier
+func TestTieredRateLimit(t *testing.T) {
+	log := logger.Get()
+	authService := auth.NewAuthService("test-secret", log)
+
+	rl := middleware.NewRateLimiter(2, log)
+	defer rl.Stop()
+	tiers := middleware.NewRateLimitTiers(map[string]int{"partner": 20})
+	handler := middleware.TieredRateLimit(rl, tiers, authService)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Every request comes from the same client IP
+	call := func(claims *auth.Claims) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.10:4000"
+		if claims != nil {
+			token, err := authService.IssueToken(*claims, time.Minute)
+			if err != nil {
+				t.Fatalf("Failed to issue token: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(t *testing.T, w *httptest.ResponseRecorder, status int, tier string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get(middleware.RateLimitTierHeader) != tier {
+			t.Errorf("Expected %d on tier %q, got %d on %q", status, tier, w.Code, w.Header().Get(middleware.RateLimitTierHeader))
+		}
+	}
+
+	t.Run("TierOverAnonymousLimit", func(t *testing.T) {
+		partner := &auth.Claims{UserID: "partner-user", Tier: "partner"}
+		for i := 0; i < 10; i++ {
+			expect(t, call(partner), http.StatusOK, "partner")
+		}
+
+		// The user's requests didn't use the client IP's budget
+		expect(t, call(nil), http.StatusOK, middleware.DefaultRateLimitTier)
+		expect(t, call(nil), http.StatusOK, middleware.DefaultRateLimitTier)
+		w := call(nil)
+		expect(t, w, http.StatusTooManyRequests, middleware.DefaultRateLimitTier)
+		if !strings.Contains(w.Body.String(), response.CodeRateLimited) {
+			t.Errorf("Expected %s, got %s", response.CodeRateLimited, w.Body.String())
+		}
+	})
+
+	t.Run("SeparateKeySpaces", func(t *testing.T) {
+		// A user ID or API key ID equal to the exhausted client IP has its own budget
+		expect(t, call(&auth.Claims{UserID: "192.0.2.10"}), http.StatusOK, middleware.DefaultRateLimitTier)
+		expect(t, call(&auth.Claims{APIKeyID: "192.0.2.10"}), http.StatusOK, middleware.DefaultRateLimitTier)
+	})
+
+	t.Run("APIKeyPreferred", func(t *testing.T) {
+		tiers.Replace([]middleware.RateLimitTier{{Name: "keys", RequestsPerSecond: 5, Subjects: []string{middleware.SubjectAPIKey + "partner-key"}}})
+		defer tiers.Replace(nil)
+
+		claims := &auth.Claims{UserID: "key-owner", APIKeyID: "partner-key"}
+		for i := 0; i < 5; i++ {
+			expect(t, call(claims), http.StatusOK, "keys")
+		}
+		expect(t, call(claims), http.StatusTooManyRequests, "keys")
+
+		// The key's owner is limited separately when calling without the key
+		expect(t, call(&auth.Claims{UserID: "key-owner"}), http.StatusOK, middleware.DefaultRateLimitTier)
+	})
+
+	t.Run("UnknownClaimedTier", func(t *testing.T) {
+		expect(t, call(&auth.Claims{UserID: "unknown-tier", Tier: "platinum"}), http.StatusOK, middleware.DefaultRateLimitTier)
+	})
+
+	t.Run("TierChangeWithoutRestart", func(t *testing.T) {
+		user := &auth.Claims{UserID: "42"}
+		expect(t, call(user), http.StatusOK, middleware.DefaultRateLimitTier)
+		expect(t, call(user), http.StatusOK, middleware.DefaultRateLimitTier)
+		expect(t, call(user), http.StatusTooManyRequests, middleware.DefaultRateLimitTier)
+
+		tiers.Replace([]middleware.RateLimitTier{{Name: "gold", RequestsPerSecond: 10, Subjects: []string{middleware.SubjectUser + "42"}}})
+		expect(t, call(user), http.StatusOK, "gold")
+
+		// Raising a configured tier's limit applies to the next request
+		tiers.Replace([]middleware.RateLimitTier{
+			{Name: "gold", RequestsPerSecond: 10, Subjects: []string{middleware.SubjectUser + "42"}},
+			{Name: "partner", RequestsPerSecond: 1000},
+		})
+		partner := &auth.Claims{UserID: "bulk", Tier: "partner"}
+		for i := 0; i < 100; i++ {
+			if w := call(partner); w.Code != http.StatusOK {
+				t.Fatalf("Expected the raised partner limit to apply, got %d on request %d", w.Code, i+1)
+			}
+		}
+
+		tiers.Replace(nil)
+		expect(t, call(user), http.StatusTooManyRequests, middleware.DefaultRateLimitTier)
+	})
+}
+
+// TestRateLimitTierAdmin tests that tiers changed through the admin API apply without a restart
+func TestRateLimitTierAdmin(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	tiers := middleware.NewRateLimitTiers(nil)
+	tierHandler := handlers.NewRateLimitHandler(db, tiers, log)
+
+	router := chi.NewRouter()
+	router.Get("/api/admin/rate-limit-tiers", tierHandler.List)
+	router.Put("/api/admin/rate-limit-tiers/{name}", tierHandler.Put)
+	router.Delete("/api/admin/rate-limit-tiers/{name}", tierHandler.Delete)
+
+	admin := func(method, name, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/api/admin/rate-limit-tiers/"+name, strings.NewReader(body)))
+		return w
+	}
+
+	name := fmt.Sprintf("tier-%d", time.Now().UnixNano())
+	subject := middleware.SubjectUser + name
+	defer admin("DELETE", name, "")
+
+	w := admin("PUT", name, fmt.Sprintf(`{"requests_per_second":50,"subjects":[%q]}`, subject))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if tier, limit, ok := tiers.Resolve(subject, ""); !ok || tier != name || limit != 50 {
+		t.Errorf("Expected the new tier to apply, got %q %d %v", tier, limit, ok)
+	}
+
+	admin("PUT", name, fmt.Sprintf(`{"requests_per_second":75,"subjects":[%q]}`, subject))
+	if _, limit, _ := tiers.Resolve(subject, ""); limit != 75 {
+		t.Errorf("Expected the updated limit, got %d", limit)
+	}
+
+	// A second instance picks the tier up on reload
+	other := middleware.NewRateLimitTiers(nil)
+	if err := handlers.NewRateLimitHandler(db, other, log).Reload(context.Background()); err != nil {
+		t.Fatalf("Failed to reload tiers: %v", err)
+	}
+	if tier, _, ok := other.Resolve(subject, ""); !ok || tier != name {
+		t.Errorf("Expected the reloaded tier, got %q %v", tier, ok)
+	}
+
+	for body, reason := range map[string]string{
+		`{"requests_per_second":0}`:                                       "zero rate",
+		`{"requests_per_second":5,"subjects":["alice"]}`:                  "unprefixed subject",
+		`{"requests_per_second":5,"subjects":["ip:bad"]}`:                 "invalid IP",
+		fmt.Sprintf(`{"requests_per_second":5,"subjects":[%q]}`, subject): "subject on another tier",
+	} {
+		if w := admin("PUT", name+"-other", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", reason, w.Code)
+		}
+	}
+	if w := admin("PUT", middleware.DefaultRateLimitTier, `{"requests_per_second":5}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the default tier name to be reserved, got %d", w.Code)
+	}
+
+	if w := admin("DELETE", name, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if _, _, ok := tiers.Resolve(subject, ""); ok {
+		t.Error("Expected the deleted tier to stop applying")
+	}
+	if w := admin("DELETE", name, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+// TestRateLimitHeaders tests the draft and legacy rate limit headers on
+// allowed and limited responses as requests leave the window, and the 429 envelope
+func TestRateLimitHeaders(t *testing.T) {
+	rl := middleware.NewRateLimiter(3, logger.Get())
+	defer rl.Stop()
+	handler := middleware.RateLimit(rl)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	call := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.20:4000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(t *testing.T, w *httptest.ResponseRecorder, status int, remaining string) {
+		t.Helper()
+		if w.Code != status {
+			t.Fatalf("Expected status %d, got %d", status, w.Code)
+		}
+		for name, want := range map[string]string{
+			"RateLimit-Limit":       "3",
+			"RateLimit-Remaining":   remaining,
+			"RateLimit-Reset":       "1",
+			"X-RateLimit-Limit":     "3",
+			"X-RateLimit-Remaining": remaining,
+		} {
+			if got := w.Header().Get(name); got != want {
+				t.Errorf("Expected %s: %s, got %q", name, want, got)
+			}
+		}
+		reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+		if now := time.Now().Unix(); err != nil || reset < now || reset > now+1 {
+			t.Errorf("Expected X-RateLimit-Reset within a second of now as a Unix time, got %q", w.Header().Get("X-RateLimit-Reset"))
+		}
+	}
+
+	start := time.Now()
+	expect(t, call(), http.StatusOK, "2")
+	time.Sleep(500 * time.Millisecond)
+	expect(t, call(), http.StatusOK, "1")
+	expect(t, call(), http.StatusOK, "0")
+
+	limited := call()
+	expect(t, limited, http.StatusTooManyRequests, "0")
+	if limited.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After: 1, got %q", limited.Header().Get("Retry-After"))
+	}
+	var resp struct {
+		Code string                      `json:"code"`
+		Data middleware.RateLimitDetails `json:"data"`
+	}
+	if err := json.NewDecoder(limited.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode the 429: %v", err)
+	}
+	if resp.Code != response.CodeRateLimited || resp.Data.Limit != 3 || resp.Data.Reset != 1 || resp.Data.ResetAt.Before(start) {
+		t.Errorf("Expected the envelope to carry the limit and reset, got %+v", resp)
+	}
+
+	// The first request leaving the window frees one slot, the next two
+	// are still counted
+	time.Sleep(time.Until(start.Add(1100 * time.Millisecond)))
+	expect(t, call(), http.StatusOK, "0")
+	expect(t, call(), http.StatusTooManyRequests, "0")
+
+	// Then the two sent half a second in free theirs
+	time.Sleep(time.Until(start.Add(1600 * time.Millisecond)))
+	expect(t, call(), http.StatusOK, "1")
+
+	t.Run("Families", func(t *testing.T) {
+		for families, want := range map[string][2]bool{
+			"draft":        {true, false},
+			"legacy":       {false, true},
+			"":             {false, false},
+			"draft,legacy": {true, true},
+		} {
+			rl := middleware.NewRateLimiter(1, logger.Get())
+			rl.SetHeaders(middleware.NewRateLimitHeaders(strings.Split(families, ",")))
+			handler := middleware.RateLimit(rl)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+				if draft, legacy := w.Header().Get("RateLimit-Remaining") != "", w.Header().Get("X-RateLimit-Remaining") != ""; draft != want[0] || legacy != want[1] {
+					t.Errorf("Expected %q to send draft %v and legacy %v headers, got %v and %v", families, want[0], want[1], draft, legacy)
+				}
+				if i == 1 && w.Header().Get("Retry-After") != "1" {
+					t.Errorf("Expected Retry-After whatever the families, got %q", w.Header().Get("Retry-After"))
+				}
+			}
+			rl.Stop()
+		}
+	})
+}
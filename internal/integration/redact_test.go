@@ -0,0 +1,269 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/accesslog"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/redact"
+)
+
+// Secrets sent in the redaction tests, none of which may show up in a sink
+const (
+	secretToken  = "Bearer secret-token"
+	secretCookie = "session=secret-cookie"
+	secretAPIKey = "secret-api-key"
+	secretTenant = "secret-tenant"
+)
+
+// assertRedacted fails when any of the test secrets appear in s
+func assertRedacted(t *testing.T, sink, s string) {
+	t.Helper()
+	for _, secret := range []string{"secret-token", "secret-cookie", secretAPIKey, secretTenant} {
+		if strings.Contains(s, secret) {
+			t.Errorf("%s leaked %q: %s", sink, secret, s)
+		}
+	}
+}
+
+// secretRequest builds a request carrying every test secret
+func secretRequest(method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", secretToken)
+	req.Header.Set("Cookie", secretCookie)
+	req.Header.Set("X-Api-Key", secretAPIKey)
+	req.Header.Set("X-Tenant-Secret", secretTenant)
+	req.Header.Set("X-Request-Source", "redaction-test")
+	return req
+}
+
+// TestRedactHeaders tests selecting and masking headers
+func TestRedactHeaders(t *testing.T) {
+	header := secretRequest("GET", "/").Header
+
+	t.Run("Selected", func(t *testing.T) {
+		headers := redact.NewHeaders([]string{"authorization", "X-Request-Source", "X-Missing"}, redact.DefaultHeaders)
+		recorded := headers.Record(header)
+		if len(recorded) != 2 || recorded["Authorization"] != redact.Mask || recorded["X-Request-Source"] != "redaction-test" {
+			t.Errorf("Expected the masked Authorization and X-Request-Source, got %v", recorded)
+		}
+	})
+
+	t.Run("All", func(t *testing.T) {
+		headers := redact.NewHeaders([]string{"*"}, redact.DefaultHeaders)
+		recorded := headers.Record(header)
+		if len(recorded) != len(header) {
+			t.Errorf("Expected every header to be recorded, got %v", recorded)
+		}
+		for _, name := range []string{"Authorization", "Cookie", "X-Api-Key"} {
+			if recorded[name] != redact.Mask {
+				t.Errorf("Expected %s to be masked, got %q", name, recorded[name])
+			}
+		}
+		if recorded["X-Tenant-Secret"] != secretTenant {
+			t.Errorf("Expected X-Tenant-Secret to be kept without a route addition, got %q", recorded["X-Tenant-Secret"])
+		}
+
+		route := headers.With([]string{"x-tenant-secret"})
+		data, _ := json.Marshal(route.Record(header))
+		assertRedacted(t, "Record", string(data))
+		if got := headers.Record(header)["X-Tenant-Secret"]; got != secretTenant {
+			t.Errorf("Expected a route addition not to change the gateway's headers, got %q", got)
+		}
+	})
+
+	t.Run("None", func(t *testing.T) {
+		if recorded := redact.NewHeaders(nil, redact.DefaultHeaders).Record(header); recorded != nil {
+			t.Errorf("Expected no headers to be recorded, got %v", recorded)
+		}
+	})
+
+	t.Run("Dump", func(t *testing.T) {
+		all := redact.NewHeaders(nil, []string{"Authorization", "Cookie", "X-API-Key", "X-Tenant-Secret"}).All(header)
+		data, _ := json.Marshal(all)
+		assertRedacted(t, "All", string(data))
+		if got := all["X-Request-Source"]; len(got) != 1 || got[0] != "redaction-test" {
+			t.Errorf("Expected other headers to be kept, got %v", got)
+		}
+		if header.Get("Authorization") != secretToken {
+			t.Error("Expected the request's headers to be left alone")
+		}
+	})
+}
+
+// TestAccessLogRedaction tests that recorded request and response headers
+// are masked in the access log, including a route's own sensitive headers
+func TestAccessLogRedaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, err := accesslog.New(&config.AccessLogConfig{Path: path, Format: accesslog.FormatJSON, QueueSize: 16}, nil, logger.Get())
+	if err != nil {
+		t.Fatalf("Failed to open access log: %v", err)
+	}
+
+	headers := redact.NewHeaders([]string{"*"}, redact.DefaultHeaders)
+	handler := middleware.Logger(logger.Get(), w, headers)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		accesslog.SetSensitiveHeaders(r.Context(), []string{"X-Tenant-Secret"})
+		rw.Header().Set("Set-Cookie", secretCookie)
+		rw.Header().Set("X-Served-By", "redaction-test")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), secretRequest("GET", "/redacted"))
+	w.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read access log: %v", err)
+	}
+	assertRedacted(t, "Access log", string(data))
+
+	var entry struct {
+		RequestHeaders  map[string]string `json:"request_headers"`
+		ResponseHeaders map[string]string `json:"response_headers"`
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("Failed to decode access log entry: %v", err)
+	}
+	if entry.RequestHeaders["Authorization"] != redact.Mask || entry.RequestHeaders["X-Tenant-Secret"] != redact.Mask {
+		t.Errorf("Expected masked request headers, got %v", entry.RequestHeaders)
+	}
+	if entry.RequestHeaders["X-Request-Source"] != "redaction-test" {
+		t.Errorf("Expected other request headers to be recorded, got %v", entry.RequestHeaders)
+	}
+	if entry.ResponseHeaders["Set-Cookie"] != redact.Mask || entry.ResponseHeaders["X-Served-By"] != "redaction-test" {
+		t.Errorf("Expected a masked Set-Cookie among the response headers, got %v", entry.ResponseHeaders)
+	}
+}
+
+// TestDebugRequestRedaction tests that the request dump endpoint masks
+// sensitive headers
+func TestDebugRequestRedaction(t *testing.T) {
+	handler := testRouter(t, auth.NewAuthService("test-secret", logger.Get()), func(cfg *config.Config) {
+		cfg.Auth.Enabled = false
+		cfg.Gateway.SensitiveHeaders = []string{"Authorization", "Cookie", "X-API-Key", "X-Tenant-Secret"}
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, secretRequest("GET", "/api/admin/debug/request"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	assertRedacted(t, "Debug endpoint", w.Body.String())
+
+	var resp struct {
+		Data struct {
+			Method  string              `json:"method"`
+			Headers map[string][]string `json:"headers"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Data.Method != "GET" || resp.Data.Headers["Authorization"][0] != redact.Mask || resp.Data.Headers["X-Request-Source"][0] != "redaction-test" {
+		t.Errorf("Unexpected dump %+v", resp.Data)
+	}
+}
+
+// TestProxyRedaction tests that request logs and spans record headers with
+// the gateway's and the route's sensitive headers masked
+func TestProxyRedaction(t *testing.T) {
+	db := testDatabase(t)
+	recorder := testSpans()
+	log := logger.Get()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	repo := database.NewRouteRepository(db)
+	route := &database.Route{
+		Path:             fmt.Sprintf("/redact-%d", time.Now().UnixNano()),
+		TargetURL:        backend.URL,
+		Method:           "GET",
+		Enabled:          true,
+		Timeout:          30,
+		SensitiveHeaders: []string{"X-Tenant-Secret"},
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, testMetrics(), nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		testMetrics(),
+		log,
+	)
+	proxyHandler.SetHeaders(redact.NewHeaders([]string{"*"}, redact.DefaultHeaders))
+
+	const traceID = "5bf92f3577b34da6a3ce929d0e0e4736"
+	req := secretRequest("GET", route.Path)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	middleware.TraceContext(http.HandlerFunc(proxyHandler.Handle)).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	t.Run("Span", func(t *testing.T) {
+		span := endedSpan(recorder, "handler.ProxyHandler.Handle", traceID)
+		if span == nil {
+			t.Fatal("Expected the handler span to be recorded")
+		}
+		var attrs []string
+		for _, kv := range span.Attributes() {
+			attrs = append(attrs, string(kv.Key)+"="+kv.Value.Emit())
+		}
+		assertRedacted(t, "Span", strings.Join(attrs, " "))
+
+		for key, want := range map[string]string{
+			"http.request.header.authorization":    redact.Mask,
+			"http.request.header.x-tenant-secret":  redact.Mask,
+			"http.request.header.x-request-source": "redaction-test",
+		} {
+			value, ok := spanAttribute(span, key)
+			if !ok || len(value.AsStringSlice()) != 1 || value.AsStringSlice()[0] != want {
+				t.Errorf("Expected %s to be %q, got %v", key, want, value.Emit())
+			}
+		}
+	})
+
+	t.Run("RequestLog", func(t *testing.T) {
+		logs := database.NewRequestLogRepository(db)
+		var entries []database.RequestLog
+		waitFor(t, func() bool {
+			entries, _ = logs.FindByRouteID(context.Background(), route.ID, 1)
+			return len(entries) == 1
+		})
+
+		data, _ := json.Marshal(entries[0].Headers)
+		assertRedacted(t, "Request log", string(data))
+		if entries[0].Headers["Cookie"] != redact.Mask || entries[0].Headers["X-Request-Source"] != "redaction-test" {
+			t.Errorf("Expected masked headers in the request log, got %v", entries[0].Headers)
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package integration
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// usageReport requests a usage report from h, decoding it unless CSV was
+// accepted
+func usageReport(h *handlers.ReportHandler, query, accept string) (*httptest.ResponseRecorder, database.UsageReport) {
+	req := httptest.NewRequest("GET", "/api/reports/usage?"+query, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	h.Usage(w, req)
+
+	var resp struct {
+		Data database.UsageReport `json:"data"`
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+		json.Unmarshal(w.Body.Bytes(), &resp)
+	}
+	return w, resp.Data
+}
+
+// TestUsageReportValidation tests the groupings and months a usage report
+// accepts, and a report without a database
+func TestUsageReportValidation(t *testing.T) {
+	h := handlers.NewReportHandler(database.NewDisconnected(closedDatabaseConfig(t), logger.Get(), nil), logger.Get())
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		code   string
+	}{
+		{"MissingGroup", "month=2024-06", http.StatusBadRequest, response.CodeValidationFailed},
+		{"UnknownGroup", "group_by=route&month=2024-06", http.StatusBadRequest, response.CodeValidationFailed},
+		{"InvalidMonth", "group_by=owner&month=2024-13", http.StatusBadRequest, ""},
+		{"DatabaseDown", "group_by=tag&month=2024-06", http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _ := usageReport(h, tt.query, "")
+			var resp response.Response
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if w.Code != tt.status || (tt.code != "" && resp.Code != tt.code) {
+				t.Errorf("Expected %d %s, got %d %s", tt.status, tt.code, w.Code, resp.Code)
+			}
+		})
+	}
+}
+
+// TestUsageReport tests a month's usage totalled from seeded rollups by
+// owner, tag and tenant, its CSV encoding, and the boundary of a month not
+// rolled up yet
+func TestUsageReport(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	suffix := time.Now().UnixNano()
+
+	tenants := database.NewTenantRepository(db)
+	tenant := &database.Tenant{ID: fmt.Sprintf("usage-%d", suffix), Name: "Usage"}
+	if err := tenants.Upsert(ctx, tenant); err != nil {
+		t.Fatalf("Failed to create tenant: %v", err)
+	}
+	defer tenants.Delete(ctx, tenant.ID)
+
+	owner := func(name string) string { return fmt.Sprintf("%s-%d", name, suffix) }
+	tag := func(name string) string { return fmt.Sprintf("%s-%d", name, suffix) }
+	routes := database.NewRouteRepository(db)
+	newRoute := func(name, owner, tenantID string, tags ...string) *database.Route {
+		route := &database.Route{
+			Path: fmt.Sprintf("/usage-%s-%d", name, suffix), TargetURL: "http://localhost:1", Method: "GET", Enabled: true, Timeout: 30,
+			Owner: owner, TenantID: tenantID, Tags: tags,
+		}
+		if err := routes.Create(ctx, route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		t.Cleanup(func() { routes.Delete(context.Background(), route.ID) })
+		return route
+	}
+	orders := newRoute("orders", owner("payments"), tenant.ID, tag("billing"), tag("public"))
+	refunds := newRoute("refunds", owner("payments"), "", tag("billing"))
+	search := newRoute("search", owner("discovery"), "")
+
+	// Logs over two hours of last month, the first of them with a 5xx
+	// response, each with the same sizes and response time
+	month := time.Now().UTC().AddDate(0, -1, 0)
+	month = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	logs := database.NewRequestLogRepository(db)
+	seed := func(route *database.Route, hour, count, ms int) {
+		for i := 0; i < count; i++ {
+			status := 200
+			if i == 0 {
+				status = 503
+			}
+			err := logs.Create(ctx, &database.RequestLog{
+				RouteID: &route.ID, Method: "GET", Path: route.Path, StatusCode: status, ResponseTime: ms,
+				RequestSize: 10, ResponseSize: 100, CreatedAt: month.Add(time.Duration(hour)*time.Hour + time.Duration(i)*time.Minute),
+			})
+			if err != nil {
+				t.Fatalf("Failed to create request log: %v", err)
+			}
+		}
+	}
+	seed(orders, 1, 4, 20)
+	seed(orders, 2, 2, 80)
+	seed(refunds, 1, 3, 50)
+	seed(search, 2, 5, 10)
+
+	if err := db.RollupHours(ctx, month, month.Add(3*time.Hour)); err != nil {
+		t.Fatalf("Failed to roll up request logs: %v", err)
+	}
+	if _, locked, err := db.RollupRequestLogs(ctx); err != nil || !locked {
+		t.Fatalf("Failed to bring the rollups up to date: %v", err)
+	}
+
+	h := handlers.NewReportHandler(db, logger.Get())
+	query := func(groupBy string) string {
+		return fmt.Sprintf("group_by=%s&month=%s", groupBy, month.Format("2006-01"))
+	}
+	rows := func(report database.UsageReport) map[string]database.UsageRow {
+		byKey := make(map[string]database.UsageRow)
+		for _, row := range report.Rows {
+			byKey[row.Key] = row
+		}
+		return byKey
+	}
+	check := func(t *testing.T, got database.UsageRow, routes int, requests, errors int64, p95 float64) {
+		t.Helper()
+		if got.Routes != routes || got.Requests != requests || got.Errors != errors {
+			t.Errorf("Expected %d routes, %d requests and %d errors, got %+v", routes, requests, errors, got)
+		}
+		if got.RequestBytes != 10*requests || got.ResponseBytes != 100*requests || got.TotalBytes != 110*requests {
+			t.Errorf("Expected %d request and %d response bytes, got %+v", 10*requests, 100*requests, got)
+		}
+		if math.Abs(got.P95-p95) > 1e-6 {
+			t.Errorf("Expected p95 %v, got %v", p95, got.P95)
+		}
+	}
+
+	t.Run("Owner", func(t *testing.T) {
+		w, report := usageReport(h, query("owner"), "")
+		if w.Code != http.StatusOK || !report.Complete || !report.To.Equal(month.AddDate(0, 1, 0)) {
+			t.Fatalf("Expected a complete report, got %d %+v", w.Code, report)
+		}
+		byOwner := rows(report)
+		// Hours of orders at 20 and 80ms and refunds at 50ms, weighted by requests
+		check(t, byOwner[owner("payments")], 2, 9, 3, (4*20+2*80+3*50)/9.0)
+		check(t, byOwner[owner("discovery")], 1, 5, 1, 10)
+	})
+
+	t.Run("Tag", func(t *testing.T) {
+		_, report := usageReport(h, query("tag"), "")
+		byTag := rows(report)
+		check(t, byTag[tag("billing")], 2, 9, 3, (4*20+2*80+3*50)/9.0)
+		check(t, byTag[tag("public")], 1, 6, 2, (4*20+2*80)/6.0)
+	})
+
+	t.Run("Tenant", func(t *testing.T) {
+		_, report := usageReport(h, query("tenant"), "")
+		check(t, rows(report)[tenant.ID], 1, 6, 2, (4*20+2*80)/6.0)
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		w, _ := usageReport(h, query("owner"), "text/csv")
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+			t.Fatalf("Expected CSV, got %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("X-Report-Complete") != "true" || w.Header().Get("X-Report-To") != month.AddDate(0, 1, 0).Format(time.RFC3339) {
+			t.Errorf("Unexpected boundary %s complete %s", w.Header().Get("X-Report-To"), w.Header().Get("X-Report-Complete"))
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("Failed to read CSV: %v", err)
+		}
+		if strings.Join(records[0], ",") != "key,routes,requests,errors,request_bytes,response_bytes,total_bytes,p95_response_time" {
+			t.Errorf("Unexpected header %v", records[0])
+		}
+		want := []string{owner("discovery"), "1", "5", "1", "50", "500", "550", "10.00"}
+		found := false
+		for _, record := range records[1:] {
+			if record[0] == want[0] {
+				found = true
+				if strings.Join(record, ",") != strings.Join(want, ",") {
+					t.Errorf("Expected row %v, got %v", want, record)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("Expected a row for %s in %v", want[0], records)
+		}
+	})
+
+	t.Run("CurrentMonth", func(t *testing.T) {
+		_, report := usageReport(h, "group_by=owner", "")
+		if report.Complete || report.RolledUntil == nil || !report.To.Equal(*report.RolledUntil) {
+			t.Errorf("Expected the current month to stop at the last rolled up hour, got %+v", report)
+		}
+	})
+
+	t.Run("FutureMonth", func(t *testing.T) {
+		next := time.Now().UTC().AddDate(0, 2, 0).Format("2006-01")
+		_, report := usageReport(h, "group_by=owner&month="+next, "")
+		if report.Complete || !report.To.Equal(report.From) || len(report.Rows) != 0 {
+			t.Errorf("Expected nothing covered, got %+v", report)
+		}
+	})
+}
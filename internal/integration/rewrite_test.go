@@ -0,0 +1,238 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/rewrite"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestRewriteRule tests prefix and regex path rewrites, including capture
+// group substitution
+func TestRewriteRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule rewrite.Rule
+		path string
+		want string
+	}{
+		{"Prefix", rewrite.Rule{Prefix: "/v1", Replacement: "/api/v2"}, "/v1/users/7", "/api/v2/users/7"},
+		{"PrefixStripped", rewrite.Rule{Prefix: "/public"}, "/public/logo.png", "/logo.png"},
+		{"PrefixNoMatch", rewrite.Rule{Prefix: "/v1", Replacement: "/v2"}, "/v3/users", "/v3/users"},
+		{"Groups", rewrite.Rule{Regex: `^/users/(\d+)/orders/(\d+)$`, Replacement: "/orders/$2?user=$1"}, "/users/7/orders/42", "/orders/42?user=7"},
+		{"NamedGroups", rewrite.Rule{Regex: `^/shop/(?P<sku>[a-z0-9-]+)$`, Replacement: "/catalog/items/${sku}"}, "/shop/red-hat", "/catalog/items/red-hat"},
+		{"FirstMatchOnly", rewrite.Rule{Regex: `/old`, Replacement: "/new"}, "/old/old", "/new/old"},
+		{"RegexNoMatch", rewrite.Rule{Regex: `^/users/(\d+)$`, Replacement: "/u/$1"}, "/users/me", "/users/me"},
+		{"LeadingSlash", rewrite.Rule{Regex: `^/api/(.*)$`, Replacement: "$1"}, "/api/health", "/health"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Path(tt.path); got != tt.want {
+				t.Errorf("Expected %s rewritten to %q, got %q", tt.path, tt.want, got)
+			}
+		})
+	}
+
+	t.Run("Target", func(t *testing.T) {
+		rule := rewrite.Rule{Regex: `^/legacy/(\w+)$`, Replacement: "/$1"}
+		requestURL, _ := url.Parse("/legacy/users?page=2")
+		if got := rule.Target("http://users:3000/api/", requestURL); got != "http://users:3000/api/users?page=2" {
+			t.Errorf("Expected the rewritten path under the target with the request query, got %s", got)
+		}
+		if got := rule.Target("http://users:3000?fixed=1", requestURL); got != "http://users:3000/users?fixed=1" {
+			t.Errorf("Expected the target's own query kept, got %s", got)
+		}
+	})
+}
+
+// TestRewriteValidation tests that rules need one of prefix and regex and
+// that invalid or overly complex regexes are refused at save time
+func TestRewriteValidation(t *testing.T) {
+	for name, tt := range map[string]struct {
+		rule  rewrite.Rule
+		valid bool
+	}{
+		"Prefix":          {rewrite.Rule{Prefix: "/v1", Replacement: "/v2"}, true},
+		"Regex":           {rewrite.Rule{Regex: `^/a/(\d+)$`, Replacement: "/b/$1"}, true},
+		"Neither":         {rewrite.Rule{Replacement: "/b"}, false},
+		"Both":            {rewrite.Rule{Prefix: "/a", Regex: "^/a$"}, false},
+		"RelativePrefix":  {rewrite.Rule{Prefix: "a"}, false},
+		"Invalid":         {rewrite.Rule{Regex: `^/a/(\d+$`}, false},
+		"TooLong":         {rewrite.Rule{Regex: "^/" + strings.Repeat("a", rewrite.MaxPatternLength) + "$"}, false},
+		"NestedRepeats":   {rewrite.Rule{Regex: `^/(a{100}){100}$`}, false},
+		"LargeCharRepeat": {rewrite.Rule{Regex: `^/([a-z0-9]{1,1000})$`}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.rule.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Expected valid=%v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+// TestRedirect tests redirect locations, statuses and query preservation
+func TestRedirect(t *testing.T) {
+	r := httptest.NewRequest("GET", "/old/page?utm=mail&id=3", nil)
+	r.Host = "shop.example.com"
+
+	tests := []struct {
+		name     string
+		redirect rewrite.Redirect
+		status   int
+		want     string
+	}{
+		{"Default", rewrite.Redirect{URL: "https://example.com/new"}, http.StatusMovedPermanently, "https://example.com/new"},
+		{"PreserveQuery", rewrite.Redirect{URL: "https://example.com/new", Status: http.StatusPermanentRedirect, PreserveQuery: true}, http.StatusPermanentRedirect, "https://example.com/new?utm=mail&id=3"},
+		{"PreserveQueryAppends", rewrite.Redirect{URL: "/new?lang=en", PreserveQuery: true}, http.StatusMovedPermanently, "/new?lang=en&utm=mail&id=3"},
+		{"Template", rewrite.Redirect{URL: "https://${host}/v2${path}", Status: http.StatusFound}, http.StatusFound, "https://shop.example.com/v2/old/page"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.redirect.Validate(); err != nil {
+				t.Fatalf("Expected a valid redirect, got %v", err)
+			}
+			if tt.redirect.StatusCode() != tt.status || tt.redirect.Location(r) != tt.want {
+				t.Errorf("Expected %d %s, got %d %s", tt.status, tt.want, tt.redirect.StatusCode(), tt.redirect.Location(r))
+			}
+		})
+	}
+
+	for name, redirect := range map[string]rewrite.Redirect{
+		"Status":       {URL: "/new", Status: http.StatusOK},
+		"Relative":     {URL: "new"},
+		"SchemeLess":   {URL: "//evil.example.com/"},
+		"Scheme":       {URL: "ftp://example.com/"},
+		"Variable":     {URL: "/new/${query.id}"},
+		"Empty":        {},
+		"HostAsPrefix": {URL: "${host}/new"},
+	} {
+		if err := redirect.Validate(); err == nil {
+			t.Errorf("Expected the %s redirect refused", name)
+		}
+	}
+}
+
+// TestRedirectRewriteValidation tests that redirect and rewrite routes need
+// their definitions and that they only go on their own route types
+func TestRedirectRewriteValidation(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	for name, tt := range map[string]struct {
+		body  string
+		valid bool
+	}{
+		"RedirectWithout":     {`{"path":"/a","type":"redirect"}`, false},
+		"RedirectOnProxy":     {`{"path":"/a","target_url":"http://api/a","redirect":{"url":"/b"}}`, false},
+		"RedirectBadStatus":   {`{"path":"/a","type":"redirect","redirect":{"url":"/b","status":200}}`, false},
+		"RedirectLoadBalance": {`{"path":"/a","type":"redirect","redirect":{"url":"/b"},"load_balanced":true}`, false},
+		"RewriteWithout":      {`{"path":"/a","type":"rewrite","target_url":"http://api"}`, false},
+		"RewriteNoTarget":     {`{"path":"/a","type":"rewrite","rewrite":{"prefix":"/a"}}`, false},
+		"RewriteOnProxy":      {`{"path":"/a","target_url":"http://api","rewrite":{"prefix":"/a"}}`, false},
+		"RewriteComplex":      {`{"path":"/a","type":"rewrite","target_url":"http://api","rewrite":{"regex":"(a{100}){100}"}}`, false},
+		"Redirect":            {`{"path":"/a","type":"redirect","redirect":{"url":"https://example.com${path}","status":308,"preserve_query":true}}`, true},
+		"Rewrite":             {`{"path":"/a","type":"rewrite","target_url":"http://api","rewrite":{"regex":"^/a$","replacement":"/b"}}`, true},
+		"RewriteLoadBalanced": {`{"path":"/a","type":"rewrite","target_url":"http://api","rewrite":{"prefix":"/a"},"load_balanced":true}`, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(tt.body)))
+			rejected := w.Code == http.StatusBadRequest && strings.Contains(w.Body.String(), response.CodeValidationFailed)
+			if rejected == tt.valid {
+				t.Errorf("Expected valid=%v, got %d %s", tt.valid, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestRedirectRewriteRoutes tests redirect routes answered without an
+// upstream and rewrite routes forwarding the rewritten path
+func TestRedirectRewriteRoutes(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+	repo := database.NewRouteRepository(db)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	suffix := time.Now().UnixNano()
+	redirectRoute := &database.Route{
+		Path:     fmt.Sprintf("/moved-%d", suffix),
+		Method:   "GET",
+		Enabled:  true,
+		Timeout:  30,
+		Type:     database.RouteTypeRedirect,
+		Redirect: &rewrite.Redirect{URL: "https://new.example.com${path}", Status: http.StatusPermanentRedirect, PreserveQuery: true},
+	}
+	rewriteRoute := &database.Route{
+		Path:      fmt.Sprintf("/legacy/users/%d", suffix),
+		TargetURL: backend.URL + "/api",
+		Method:    "GET",
+		Enabled:   true,
+		Timeout:   30,
+		Type:      database.RouteTypeRewrite,
+		Rewrite:   &rewrite.Rule{Regex: `^/legacy/users/(\d+)$`, Replacement: "/users/$1/profile"},
+	}
+	for _, route := range []*database.Route{redirectRoute, rewriteRoute} {
+		if err := repo.Create(context.Background(), route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		defer repo.Delete(context.Background(), route.ID)
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+
+	t.Run("Redirect", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", redirectRoute.Path+"?ref=mail", nil))
+		want := "https://new.example.com" + redirectRoute.Path + "?ref=mail"
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != want {
+			t.Errorf("Expected 308 to %s, got %d %s", want, w.Code, w.Header().Get("Location"))
+		}
+		if got := testutil.ToFloat64(m.Redirects.WithLabelValues(redirectRoute.Path, "308")); got != 1 {
+			t.Errorf("Expected the redirect to be counted, got %v", got)
+		}
+	})
+
+	t.Run("Rewrite", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", rewriteRoute.Path+"?fields=name", nil))
+		want := fmt.Sprintf("/api/users/%d/profile?fields=name", suffix)
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("Expected the upstream to get %s, got %d %s", want, w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+)
+
+// percentile interpolates the pth percentile of values the way Postgres'
+// percentile_cont does
+func percentile(values []int, p float64) float64 {
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	pos := p * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	if lower+1 >= len(sorted) {
+		return float64(sorted[lower])
+	}
+	frac := pos - float64(lower)
+	return float64(sorted[lower]) + frac*float64(sorted[lower+1]-sorted[lower])
+}
+
+// TestRequestRollups tests that hourly rollups reproduce the totals computed
+// from the raw request logs, and that rerunning them changes nothing
+func TestRequestRollups(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+
+	routes := database.NewRouteRepository(db)
+	route := &database.Route{Path: fmt.Sprintf("/rollup-%d", time.Now().UnixNano()), TargetURL: "http://localhost:1", Method: "GET", Enabled: true, Timeout: 30}
+	if err := routes.Create(ctx, route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer routes.Delete(ctx, route.ID)
+
+	// Three past hours of logs with known response times, statuses and sizes
+	logs := database.NewRequestLogRepository(db)
+	base := time.Now().UTC().Truncate(time.Hour).Add(-4 * time.Hour)
+	hourly := [][]int{
+		{12, 40, 7, 250, 33, 18},
+		{90, 5, 61},
+		{3, 8, 120, 44, 15, 27, 1000, 9},
+	}
+	var want database.RouteTraffic
+	var p50, p95, p99, totalTime float64
+	for hour, times := range hourly {
+		for i, ms := range times {
+			status := 200
+			if i%4 == 3 {
+				status = 502
+				want.Errors++
+			}
+			entry := &database.RequestLog{
+				RouteID:      &route.ID,
+				Method:       "GET",
+				Path:         route.Path,
+				StatusCode:   status,
+				ResponseTime: ms,
+				RequestSize:  int64(10 * (i + 1)),
+				ResponseSize: int64(100 * (i + 1)),
+				CreatedAt:    base.Add(time.Duration(hour)*time.Hour + time.Duration(i)*time.Minute),
+			}
+			if err := logs.Create(ctx, entry); err != nil {
+				t.Fatalf("Failed to create request log: %v", err)
+			}
+			want.Requests++
+			want.RequestBytes += entry.RequestSize
+			want.ResponseBytes += entry.ResponseSize
+			totalTime += float64(ms)
+		}
+		n := float64(len(times))
+		p50 += percentile(times, 0.5) * n
+		p95 += percentile(times, 0.95) * n
+		p99 += percentile(times, 0.99) * n
+	}
+
+	// One log in the current hour, read from the raw logs
+	current := &database.RequestLog{RouteID: &route.ID, Method: "GET", Path: route.Path, StatusCode: 200, ResponseTime: 70, RequestSize: 1, ResponseSize: 2}
+	if err := logs.Create(ctx, current); err != nil {
+		t.Fatalf("Failed to create request log: %v", err)
+	}
+	want.Requests++
+	want.RequestBytes++
+	want.ResponseBytes += 2
+	totalTime += 70
+	p50, p95, p99 = p50+70, p95+70, p99+70
+
+	n := float64(want.Requests)
+	want.AvgResponseTime = totalTime / n
+	want.P50, want.P95, want.P99 = p50/n, p95/n, p99/n
+
+	check := func(t *testing.T, got *database.RouteTraffic) {
+		t.Helper()
+		if got.Requests != want.Requests || got.Errors != want.Errors || got.RequestBytes != want.RequestBytes || got.ResponseBytes != want.ResponseBytes {
+			t.Errorf("Expected totals %+v, got %+v", want, *got)
+		}
+		for name, pair := range map[string][2]float64{
+			"avg": {want.AvgResponseTime, got.AvgResponseTime},
+			"p50": {want.P50, got.P50},
+			"p95": {want.P95, got.P95},
+			"p99": {want.P99, got.P99},
+		} {
+			if math.Abs(pair[0]-pair[1]) > 1e-6 {
+				t.Errorf("Expected %s %v, got %v", name, pair[0], pair[1])
+			}
+		}
+	}
+
+	// Roll up the fixture's hours, then bring the rollups up to date so the
+	// totals read them
+	end := base.Add(time.Duration(len(hourly)) * time.Hour)
+	if err := db.RollupHours(ctx, base, end); err != nil {
+		t.Fatalf("Failed to roll up request logs: %v", err)
+	}
+	if _, locked, err := db.RollupRequestLogs(ctx); err != nil || !locked {
+		t.Fatalf("Failed to roll up request logs: %v (locked %v)", err, locked)
+	}
+
+	t.Run("MatchesRawLogs", func(t *testing.T) {
+		got, err := logs.TrafficByRouteID(ctx, route.ID, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to total request logs: %v", err)
+		}
+		check(t, got)
+	})
+
+	t.Run("Rerun", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if err := db.RollupHours(ctx, base, end); err != nil {
+				t.Fatalf("Failed to roll up request logs: %v", err)
+			}
+		}
+		got, err := logs.TrafficByRouteID(ctx, route.ID, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to total request logs: %v", err)
+		}
+		check(t, got)
+	})
+
+	t.Run("PartialHours", func(t *testing.T) {
+		// A range starting mid-hour reads that hour's raw logs: the last two
+		// logs of the first hour plus the whole second hour
+		from := base.Add(4 * time.Minute)
+		got, err := logs.TrafficByRouteID(ctx, route.ID, from, base.Add(2*time.Hour))
+		if err != nil {
+			t.Fatalf("Failed to total request logs: %v", err)
+		}
+		if got.Requests != 2+3 || got.RequestBytes != 50+60+10+20+30 {
+			t.Errorf("Unexpected totals %+v", *got)
+		}
+	})
+
+	t.Run("Lock", func(t *testing.T) {
+		results := make(chan bool, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				_, locked, err := db.RollupRequestLogs(ctx)
+				results <- locked && err == nil
+			}()
+		}
+		if !<-results && !<-results {
+			t.Error("Expected at least one replica to roll up")
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/etag"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/timewindow"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// utc parses an RFC 3339 time for the schedule tests
+func utc(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("Invalid time %q: %v", value, err)
+	}
+	return parsed
+}
+
+// TestTimeWindowSchedule tests weekly schedules read in their timezone,
+// across day boundaries between it and UTC and across DST changes
+func TestTimeWindowSchedule(t *testing.T) {
+	tests := []struct {
+		name       string
+		schedule   timewindow.Schedule
+		now        string
+		wantActive bool
+		wantNext   string
+	}{
+		// Tokyo is UTC+9, so its Monday morning is Sunday night in UTC
+		{"tokyo sunday night utc", timewindow.Schedule{Expression: "Mon-Fri 09:00-18:00", Timezone: "Asia/Tokyo"}, "2026-10-18T23:30:00Z", false, "2026-10-19T00:00:00Z"},
+		{"tokyo opening", timewindow.Schedule{Expression: "Mon-Fri 09:00-18:00", Timezone: "Asia/Tokyo"}, "2026-10-19T00:00:00Z", true, "2026-10-19T09:00:00Z"},
+		{"tokyo friday close", timewindow.Schedule{Expression: "Mon-Fri 09:00-18:00", Timezone: "Asia/Tokyo"}, "2026-10-23T08:59:00Z", true, "2026-10-23T09:00:00Z"},
+		{"tokyo weekend", timewindow.Schedule{Expression: "Mon-Fri 09:00-18:00", Timezone: "Asia/Tokyo"}, "2026-10-23T09:00:00Z", false, "2026-10-26T00:00:00Z"},
+
+		// New York springs forward at 02:00 on 2026-03-08, from UTC-5 to UTC-4
+		{"before spring forward", timewindow.Schedule{Expression: "* 09:00-17:00", Timezone: "America/New_York"}, "2026-03-07T13:30:00Z", false, "2026-03-07T14:00:00Z"},
+		{"after spring forward", timewindow.Schedule{Expression: "* 09:00-17:00", Timezone: "America/New_York"}, "2026-03-08T13:30:00Z", true, "2026-03-08T21:00:00Z"},
+		{"range losing an hour", timewindow.Schedule{Expression: "Sun 01:00-03:00", Timezone: "America/New_York"}, "2026-03-08T06:30:00Z", true, "2026-03-08T07:00:00Z"},
+
+		// and falls back at 02:00 on 2026-11-01
+		{"range gaining an hour", timewindow.Schedule{Expression: "Sun 00:30-03:00", Timezone: "America/New_York"}, "2026-11-01T04:30:00Z", true, "2026-11-01T08:00:00Z"},
+		{"after fall back", timewindow.Schedule{Expression: "* 09:00-17:00", Timezone: "America/New_York"}, "2026-11-01T13:30:00Z", false, "2026-11-01T14:00:00Z"},
+
+		// Ranges past midnight, touching ranges and the whole day
+		{"past midnight", timewindow.Schedule{Expression: "Fri 22:00-02:00"}, "2026-10-17T01:00:00Z", true, "2026-10-17T02:00:00Z"},
+		{"touching ranges merged", timewindow.Schedule{Expression: "Mon 09:00-12:00; Mon 12:00-17:00"}, "2026-10-19T10:00:00Z", true, "2026-10-19T17:00:00Z"},
+		{"day ranges wrapping the week", timewindow.Schedule{Expression: "Sat-Mon 10:00-11:00"}, "2026-10-20T10:30:00Z", false, "2026-10-24T10:00:00Z"},
+		{"several ranges a day", timewindow.Schedule{Expression: "mon 08:00-12:00,13:00-17:00"}, "2026-10-19T12:30:00Z", false, "2026-10-19T13:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, err := timewindow.New(nil, nil, &tt.schedule)
+			if err != nil {
+				t.Fatalf("Failed to compile %q: %v", tt.schedule.Expression, err)
+			}
+			active, next := window.State(utc(t, tt.now))
+			if active != tt.wantActive || !next.Equal(utc(t, tt.wantNext)) {
+				t.Errorf("Expected active %v until %s, got %v until %s", tt.wantActive, tt.wantNext, active, next.UTC().Format(time.RFC3339))
+			}
+		})
+	}
+
+	always, _ := timewindow.New(nil, nil, &timewindow.Schedule{Expression: "* 00:00-24:00", Timezone: "Europe/Berlin"})
+	if active, next := always.State(utc(t, "2026-10-25T01:30:00Z")); !active || next.IsZero() {
+		t.Errorf("Expected a schedule open around the clock to be active with a recheck, got %v %v", active, next)
+	}
+}
+
+// TestTimeWindowBounds tests active_from and active_until around the weekly
+// schedule
+func TestTimeWindowBounds(t *testing.T) {
+	from, until := utc(t, "2026-11-27T00:00:00Z"), utc(t, "2026-12-01T00:00:00Z")
+
+	bounded, err := timewindow.New(&from, &until, nil)
+	if err != nil {
+		t.Fatalf("Failed to create the window: %v", err)
+	}
+	if active, next := bounded.State(utc(t, "2026-11-26T12:00:00Z")); active || !next.Equal(from) {
+		t.Errorf("Expected inactive until active_from, got %v until %v", active, next)
+	}
+	if active, next := bounded.State(from); !active || !next.Equal(until) {
+		t.Errorf("Expected active from active_from until active_until, got %v until %v", active, next)
+	}
+	if active, next := bounded.State(until); active || !next.IsZero() {
+		t.Errorf("Expected inactive for good at active_until, got %v until %v", active, next)
+	}
+
+	// active_until cuts the schedule's range short
+	scheduled, _ := timewindow.New(nil, &until, &timewindow.Schedule{Expression: "Mon 22:00-02:00"})
+	if active, next := scheduled.State(utc(t, "2026-11-30T23:00:00Z")); !active || !next.Equal(until) {
+		t.Errorf("Expected active until active_until, got %v until %v", active, next)
+	}
+
+	unbounded, _ := timewindow.New(&from, nil, nil)
+	if active, next := unbounded.State(utc(t, "2030-01-01T00:00:00Z")); !active || !next.IsZero() {
+		t.Errorf("Expected active for good after active_from, got %v until %v", active, next)
+	}
+
+	invalid := map[string]*timewindow.Schedule{
+		"unknown day":      {Expression: "Funday 09:00-17:00"},
+		"open day range":   {Expression: "Mon- 09:00-17:00"},
+		"bad time":         {Expression: "Mon 9:00-17:00"},
+		"past 24:00":       {Expression: "Mon 09:00-24:30"},
+		"empty range":      {Expression: "Mon 09:00-09:00"},
+		"no ranges":        {Expression: " ; "},
+		"extra fields":     {Expression: "Mon 09:00-12:00 13:00-17:00"},
+		"unknown timezone": {Expression: "Mon 09:00-17:00", Timezone: "Mars/Olympus"},
+	}
+	for name, schedule := range invalid {
+		if err := schedule.Validate(); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+	if _, err := timewindow.New(&until, &from, nil); err == nil {
+		t.Errorf("Expected active_until before active_from to be rejected")
+	}
+}
+
+// TestRouteSchedule tests requests to routes outside their window answered
+// like disabled routes, with the maintenance response when there is one,
+// and the route list reporting which routes serve now
+func TestRouteSchedule(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("campaign"))
+	}))
+	defer upstream.Close()
+
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+
+	open := egressRoute(1, "/open", upstream.URL, nil)
+	open.ActiveFrom, open.ActiveUntil = &past, &future
+	ended := egressRoute(2, "/ended", upstream.URL, nil)
+	ended.ActiveUntil = &past
+	upcoming := egressRoute(3, "/upcoming", upstream.URL, nil)
+	upcoming.ActiveFrom = &future
+	upcoming.MaintenanceStatus, upcoming.MaintenanceBody, upcoming.MaintenanceContentType = http.StatusNotFound, "<h1>Coming soon</h1>", "text/html"
+	aroundTheClock := egressRoute(4, "/daily", upstream.URL, nil)
+	aroundTheClock.Schedule = &timewindow.Schedule{Expression: "* 00:00-24:00", Timezone: "Pacific/Auckland"}
+
+	h := egressHandler(t, &config.Load().Proxy, testMetrics(), nil, open, ended, upcoming, aroundTheClock)
+
+	for _, path := range []string{"/open", "/daily"} {
+		if rec := conditionalGet(h.Handle, path, nil); rec.Code != http.StatusOK || rec.Body.String() != "campaign" {
+			t.Errorf("Expected %s proxied within its window, got %d %q", path, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := conditionalGet(h.Handle, "/ended", nil)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"ROUTE_INACTIVE"`) {
+		t.Errorf("Expected a 503 ROUTE_INACTIVE after the window, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = conditionalGet(h.Handle, "/upcoming", nil)
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "<h1>Coming soon</h1>" || rec.Header().Get("Content-Type") != "text/html" {
+		t.Errorf("Expected the maintenance response before the window, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// The list reports each route's state, tagged apart from the stored list
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	disabled := open
+	disabled.ID, disabled.Path, disabled.Enabled = 5, "/disabled", false
+	entry, _ := etag.New([]database.Route{open, ended, upcoming, aroundTheClock, disabled})
+	cacheInstance.Set("routes:all", entry)
+
+	list := conditionalGet(routeHandler.List, "/api/routes", nil)
+	var body struct {
+		Data []database.Route `json:"data"`
+	}
+	if err := json.Unmarshal(list.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode the list: %v", err)
+	}
+	want := map[int]bool{1: true, 2: false, 3: false, 4: true, 5: false}
+	for _, route := range body.Data {
+		if route.CurrentlyActive != want[route.ID] {
+			t.Errorf("Expected route %d currently_active %v, got %v", route.ID, want[route.ID], route.CurrentlyActive)
+		}
+	}
+	if len(body.Data) != len(want) {
+		t.Errorf("Expected %d routes, got %d", len(want), len(body.Data))
+	}
+	tag := list.Header().Get("ETag")
+	if tag == "" || tag == entry.ETag {
+		t.Errorf("Expected the list's ETag to cover the routes' states, got %q", tag)
+	}
+	expectNotModified(t, conditionalGet(routeHandler.List, "/api/routes", http.Header{"If-None-Match": {tag}}), tag)
+
+	stored := entry.Value.([]database.Route)
+	if stored[0].CurrentlyActive {
+		t.Errorf("Expected the cached list left unchanged")
+	}
+}
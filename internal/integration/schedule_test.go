@@ -0,0 +1,137 @@
+package integration
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/schedule"
+)
+
+// fakeClock is a manually advanced clock
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// TestScheduleJitter tests that jittered intervals stay within bounds and spread out
+func TestScheduleJitter(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := schedule.New(schedule.Policy{
+		Interval:    10 * time.Second,
+		Jitter:      0.2,
+		MaxInterval: time.Minute,
+	}, clock)
+
+	const samples = 2000
+	var total time.Duration
+	seen := make(map[time.Duration]bool)
+
+	for i := 0; i < samples; i++ {
+		d := s.Next()
+		if d < 8*time.Second || d > 12*time.Second {
+			t.Fatalf("Interval %v outside jitter bounds", d)
+		}
+		total += d
+		seen[d] = true
+	}
+
+	mean := total / samples
+	if mean < 9700*time.Millisecond || mean > 10300*time.Millisecond {
+		t.Errorf("Expected mean interval near 10s, got %v", mean)
+	}
+	if len(seen) < samples/2 {
+		t.Errorf("Expected intervals to be spread out, got %d distinct values", len(seen))
+	}
+}
+
+// TestScheduleJitterWithoutMax tests that jitter spreads runs both earlier
+// and later than the interval when no upper bound is set
+func TestScheduleJitterWithoutMax(t *testing.T) {
+	s := schedule.New(schedule.Policy{Interval: 10 * time.Second, Jitter: 0.2}, &fakeClock{now: time.Unix(0, 0)})
+
+	const samples = 2000
+	var early, late int
+	var total time.Duration
+	for i := 0; i < samples; i++ {
+		d := s.Next()
+		if d < 8*time.Second || d > 12*time.Second {
+			t.Fatalf("Interval %v outside jitter bounds", d)
+		}
+		switch {
+		case d < 10*time.Second:
+			early++
+		case d > 10*time.Second:
+			late++
+		}
+		total += d
+	}
+
+	// Each side gets about half of the runs
+	if early < samples*2/5 || late < samples*2/5 {
+		t.Errorf("Expected runs spread both ways, got %d early and %d late", early, late)
+	}
+	if mean := total / samples; mean < 9700*time.Millisecond || mean > 10300*time.Millisecond {
+		t.Errorf("Expected mean interval near 10s, got %v", mean)
+	}
+}
+
+// TestScheduleBackoff tests backoff growth, the upper bound, and reset on recovery
+func TestScheduleBackoff(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := schedule.New(schedule.Policy{
+		Interval:    10 * time.Second,
+		Multiplier:  2,
+		MaxInterval: 60 * time.Second,
+	}, clock)
+
+	expected := []time.Duration{10, 20, 40, 60, 60}
+	for i, want := range expected {
+		<-s.After()
+		state := s.State()
+		if state.Interval != want*time.Second {
+			t.Errorf("Run %d: expected interval %v, got %v", i, want*time.Second, state.Interval)
+		}
+		if state.Failures != i {
+			t.Errorf("Run %d: expected %d failures, got %d", i, i, state.Failures)
+		}
+		s.Report(errors.New("probe failed"))
+	}
+
+	s.Report(nil)
+	if d := s.Next(); d != 10*time.Second {
+		t.Errorf("Expected interval to reset to 10s after recovery, got %v", d)
+	}
+	if next := s.State().NextRun; !next.Equal(clock.Now().Add(10 * time.Second)) {
+		t.Errorf("Unexpected next run time %v", next)
+	}
+}
+
+// TestScheduleObserve tests that observers get the state of every run
+// scheduled, including its backoff
+func TestScheduleObserve(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := schedule.New(schedule.Policy{Interval: 10 * time.Second, Multiplier: 2, MaxInterval: time.Minute}, clock)
+
+	var observed []schedule.State
+	s.Observe(func(state schedule.State) { observed = append(observed, state) })
+
+	<-s.After()
+	s.Report(errors.New("probe failed"))
+	<-s.After()
+
+	if len(observed) != 2 {
+		t.Fatalf("Expected 2 states observed, got %d", len(observed))
+	}
+	if observed[1].Interval != 20*time.Second || observed[1].Failures != 1 || !observed[1].NextRun.Equal(clock.Now()) {
+		t.Errorf("Unexpected state %+v", observed[1])
+	}
+}
@@ -0,0 +1,124 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/version"
+)
+
+// TestSecurityHeadersLocal tests the headers on responses the gateway
+// answers itself, HSTS only over TLS and the admin UI's frame options and
+// content security policy
+func TestSecurityHeadersLocal(t *testing.T) {
+	handler := testRouter(t, auth.NewAuthService("test-secret", logger.Get()), func(cfg *config.Config) {
+		cfg.Auth.Enabled = false
+		cfg.AdminUI.Enabled = true
+	})
+
+	live := adminUIGet(handler, "/health/live", nil)
+	if got := live.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("Expected nosniff on a health check, got %q", got)
+	}
+	for _, name := range []string{"Strict-Transport-Security", "X-Frame-Options", "Content-Security-Policy", "X-Gateway", "Via"} {
+		if got := live.Header().Get(name); got != "" {
+			t.Errorf("Expected no %s on a plain HTTP health check, got %q", name, got)
+		}
+	}
+
+	ready := adminUIGet(handler, "https://isekai.test/health/ready", nil)
+	if ready.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected readiness to fail with the database down, got %d", ready.Code)
+	}
+	if got := ready.Header().Get("Strict-Transport-Security"); !strings.HasPrefix(got, "max-age=") {
+		t.Errorf("Expected HSTS on an error over TLS, got %q", got)
+	}
+
+	admin := adminUIGet(handler, "/admin/login", nil)
+	if admin.Header().Get("X-Frame-Options") != "DENY" || !strings.Contains(admin.Header().Get("Content-Security-Policy"), "frame-ancestors 'none'") {
+		t.Errorf("Expected the admin UI framing denied, got %v", admin.Header())
+	}
+}
+
+// TestSecurityHeadersProxied tests the headers on proxied responses
+// replacing the upstream's, the Server header stripped, the gateway
+// identified and a route opting out
+func TestSecurityHeadersProxied(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.25.3")
+		w.Header().Set("X-Content-Type-Options", "upstream")
+		w.Header().Set("Via", "1.1 upstream-cache")
+		w.Write([]byte("proxied"))
+	}))
+	defer upstream.Close()
+
+	h := egressHandler(t, &config.Load().Proxy, testMetrics(), nil,
+		egressRoute(1, "/covered", upstream.URL, nil),
+		database.Route{ID: 2, Path: "/raw", TargetURL: upstream.URL, Method: "GET", Enabled: true, Type: database.RouteTypeProxy, SkipSecurityHeaders: true},
+	)
+	cfg := config.Load().SecurityHeaders
+	cfg.Via = true
+	cfg.GatewayHeader = true
+	handler := middleware.SecurityHeaders(&cfg, nil)(http.HandlerFunc(h.Handle))
+
+	covered := adminUIGet(handler, "https://isekai.test/covered", nil)
+	if covered.Code != http.StatusOK || covered.Body.String() != "proxied" {
+		t.Fatalf("Expected the upstream response, got %d %q", covered.Code, covered.Body.String())
+	}
+	want := map[string]string{
+		"Server":                 "",
+		"X-Content-Type-Options": "nosniff",
+		"X-Gateway":              "isekai/" + version.Version,
+	}
+	for name, value := range want {
+		if got := covered.Header().Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+	if got := covered.Header().Values("Via"); len(got) != 2 || got[1] != "1.1 isekai" {
+		t.Errorf("Expected the gateway added to Via, got %q", got)
+	}
+	if got := covered.Header().Get("Strict-Transport-Security"); got == "" {
+		t.Errorf("Expected HSTS on a proxied response over TLS")
+	}
+
+	raw := adminUIGet(handler, "https://isekai.test/raw", nil)
+	if raw.Code != http.StatusOK {
+		t.Fatalf("Expected the upstream response, got %d", raw.Code)
+	}
+	if raw.Header().Get("Server") != "nginx/1.25.3" || raw.Header().Get("X-Content-Type-Options") != "upstream" {
+		t.Errorf("Expected the opted-out route's headers left alone, got %v", raw.Header())
+	}
+	for _, name := range []string{"Strict-Transport-Security", "X-Gateway"} {
+		if got := raw.Header().Get(name); got != "" {
+			t.Errorf("Expected no %s on the opted-out route, got %q", name, got)
+		}
+	}
+}
+
+// TestSecurityHeadersConfig tests turning headers off and the defaults
+func TestSecurityHeadersConfig(t *testing.T) {
+	t.Setenv("SECURITY_HEADERS_HSTS", "off")
+	t.Setenv("SECURITY_HEADERS_STRIP", "Server, X-Powered-By")
+	t.Setenv("SECURITY_HEADERS_FRAME_OPTIONS", "SAMEORIGIN")
+
+	cfg := config.Load().SecurityHeaders
+	if !cfg.Enabled || cfg.HSTS != "" || cfg.ContentTypeOptions != "nosniff" || cfg.FrameOptions != "SAMEORIGIN" {
+		t.Errorf("Unexpected security headers config %+v", cfg)
+	}
+	if len(cfg.Strip) != 2 || cfg.Strip[1] != "X-Powered-By" {
+		t.Errorf("Expected two headers stripped, got %q", cfg.Strip)
+	}
+
+	t.Setenv("SECURITY_HEADERS_STRIP", "off")
+	if strip := config.Load().SecurityHeaders.Strip; len(strip) != 0 {
+		t.Errorf("Expected nothing stripped, got %q", strip)
+	}
+}
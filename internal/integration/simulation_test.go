@@ -0,0 +1,85 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/matcher"
+	"github.com/zakirkun/isekai/internal/simulation"
+)
+
+// TestRouteSimulation tests replaying a traffic sample against a proposed route table
+func TestRouteSimulation(t *testing.T) {
+	current := matcher.New([]database.Route{
+		{ID: 1, Path: "/users", Method: "GET", TargetURL: "http://users-v1", Enabled: true},
+		{ID: 2, Path: "/orders", Method: "GET", TargetURL: "http://orders", Enabled: true},
+		{ID: 3, Path: "/legacy", Method: "GET", TargetURL: "http://legacy", Enabled: true},
+		{ID: 4, Path: "/disabled", Method: "GET", TargetURL: "http://disabled", Enabled: false},
+	})
+
+	proposed := matcher.New([]database.Route{
+		{Path: "/users", Method: "GET", TargetURL: "http://users-v2", Enabled: true},
+		{Path: "/orders", Method: "GET", TargetURL: "http://orders", Enabled: true},
+		{Path: "/disabled", Method: "GET", TargetURL: "http://disabled", Enabled: true},
+	})
+
+	// Synthetic log sample
+	sample := []simulation.Request{
+		{Method: "GET", Path: "/users"},
+		{Method: "GET", Path: "/users"},
+		{Method: "GET", Path: "/orders"},
+		{Method: "GET", Path: "/legacy"},
+		{Method: "GET", Path: "/legacy"},
+		{Method: "GET", Path: "/legacy"},
+		{Method: "GET", Path: "/disabled"},
+		{Method: "POST", Path: "/orders"},
+	}
+
+	t.Run("Summary", func(t *testing.T) {
+		report := simulation.Run(current, proposed, sample, false)
+
+		if report.Total != len(sample) {
+			t.Errorf("Expected total %d, got %d", len(sample), report.Total)
+		}
+		if report.Current.Matched != 6 || report.Current.Unmatched != 2 {
+			t.Errorf("Unexpected current summary: %+v", report.Current)
+		}
+		if report.Proposed.Matched != 4 || report.Proposed.Unmatched != 4 {
+			t.Errorf("Unexpected proposed summary: %+v", report.Proposed)
+		}
+
+		// Two /users requests change target, three /legacy lose their route, one /disabled gains one
+		if report.Changed != 6 {
+			t.Errorf("Expected 6 changed requests, got %d", report.Changed)
+		}
+		if report.Diffs != nil {
+			t.Error("Expected no diffs unless requested")
+		}
+
+		if len(report.LostTraffic) != 1 || report.LostTraffic[0].Path != "/legacy" || report.LostTraffic[0].Delta != -3 {
+			t.Errorf("Unexpected lost traffic: %+v", report.LostTraffic)
+		}
+		if len(report.GainedTraffic) != 1 || report.GainedTraffic[0].Path != "/disabled" || report.GainedTraffic[0].Delta != 1 {
+			t.Errorf("Unexpected gained traffic: %+v", report.GainedTraffic)
+		}
+	})
+
+	t.Run("Diffs", func(t *testing.T) {
+		report := simulation.Run(current, proposed, sample, true)
+
+		if len(report.Diffs) != report.Changed {
+			t.Fatalf("Expected %d diffs, got %d", report.Changed, len(report.Diffs))
+		}
+
+		first := report.Diffs[0]
+		if first.Request.Path != "/users" {
+			t.Fatalf("Expected first diff for /users, got %s", first.Request.Path)
+		}
+		if first.Current == nil || first.Current.TargetURL != "http://users-v1" {
+			t.Errorf("Unexpected current route: %+v", first.Current)
+		}
+		if first.Proposed == nil || first.Proposed.TargetURL != "http://users-v2" {
+			t.Errorf("Unexpected proposed route: %+v", first.Proposed)
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// histogramTotals returns the sample count and sum of a histogram
+func histogramTotals(t *testing.T, o prometheus.Observer) (count uint64, sum float64) {
+	t.Helper()
+
+	var metric dto.Metric
+	if err := o.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatalf("Failed to read metric: %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+}
+
+// TestTransferSizes tests that request logs, metrics and route analytics
+// record the body bytes exchanged with clients
+func TestTransferSizes(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+	repo := database.NewRouteRepository(db)
+	logRepo := database.NewRequestLogRepository(db)
+
+	received := make(chan int64, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Case") {
+		case "partial-request":
+			// Report the first chunk, then read until the client is gone
+			buf := make([]byte, 4096)
+			n, _ := io.ReadFull(r.Body, buf)
+			received <- int64(n)
+			io.Copy(io.Discard, r.Body)
+		case "partial-response":
+			// Send one flushed chunk and hold the response open
+			w.Write(bytes.Repeat([]byte("r"), 65536))
+			http.NewResponseController(w).Flush()
+			<-r.Context().Done()
+		default:
+			io.Copy(io.Discard, r.Body)
+			w.Write(bytes.Repeat([]byte("r"), 25000))
+		}
+	}))
+	defer upstream.Close()
+
+	route := &database.Route{
+		Path:      fmt.Sprintf("/sizes-%d", time.Now().UnixNano()),
+		TargetURL: upstream.URL,
+		Method:    "POST",
+		Enabled:   true,
+		Timeout:   30,
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(proxyHandler.Handle))
+	defer gateway.Close()
+
+	// latestLog waits for the route's nth request log and returns it
+	latestLog := func(t *testing.T, n int) database.RequestLog {
+		t.Helper()
+		var logs []database.RequestLog
+		waitFor(t, func() bool {
+			logs, _ = logRepo.FindByRouteID(context.Background(), route.ID, 100)
+			return len(logs) >= n
+		})
+		return logs[0]
+	}
+
+	t.Run("Chunked", func(t *testing.T) {
+		// A reader of unknown length is sent chunked
+		body := io.MultiReader(strings.NewReader(strings.Repeat("q", 6000)), strings.NewReader(strings.Repeat("q", 4000)))
+		req, _ := http.NewRequest("POST", gateway.URL+route.Path, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if req.ContentLength != 0 || len(req.TransferEncoding) != 0 || len(got) != 25000 {
+			t.Fatalf("Expected a chunked request and a 25000 byte response, got %d %v %d", req.ContentLength, req.TransferEncoding, len(got))
+		}
+
+		entry := latestLog(t, 1)
+		if entry.RequestSize != 10000 || entry.ResponseSize != 25000 {
+			t.Errorf("Expected 10000 and 25000 bytes, got %d and %d", entry.RequestSize, entry.ResponseSize)
+		}
+		if count, sum := histogramTotals(t, m.RequestSize.WithLabelValues(route.Path)); count != 1 || sum != 10000 {
+			t.Errorf("Expected one 10000 byte request observed, got %d totalling %v", count, sum)
+		}
+		if count, sum := histogramTotals(t, m.ResponseSize.WithLabelValues(route.Path)); count != 1 || sum != 25000 {
+			t.Errorf("Expected one 25000 byte response observed, got %d totalling %v", count, sum)
+		}
+	})
+
+	t.Run("ClientLeavesDuringRequest", func(t *testing.T) {
+		conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: gateway\r\nX-Case: partial-request\r\nTransfer-Encoding: chunked\r\n\r\n1000\r\n%s\r\n", route.Path, strings.Repeat("p", 4096))
+		select {
+		case n := <-received:
+			if n != 4096 {
+				t.Fatalf("Expected the upstream to receive 4096 bytes, got %d", n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the upstream")
+		}
+		conn.Close()
+
+		if entry := latestLog(t, 2); entry.RequestSize != 4096 {
+			t.Errorf("Expected the 4096 bytes sent before leaving, got %d", entry.RequestSize)
+		}
+	})
+
+	t.Run("ClientLeavesDuringResponse", func(t *testing.T) {
+		conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: gateway\r\nX-Case: partial-response\r\nContent-Length: 5\r\n\r\nhello", route.Path)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Failed to read the response: %v", err)
+		}
+		if n, _ := io.ReadFull(resp.Body, make([]byte, 65536)); n != 65536 {
+			t.Fatalf("Expected the first 65536 bytes, got %d", n)
+		}
+		conn.Close()
+
+		entry := latestLog(t, 3)
+		if entry.RequestSize != 5 || entry.ResponseSize != 65536 {
+			t.Errorf("Expected 5 and 65536 bytes, got %d and %d", entry.RequestSize, entry.ResponseSize)
+		}
+	})
+
+	t.Run("Analytics", func(t *testing.T) {
+		traffic, err := logRepo.TrafficByRouteID(context.Background(), route.ID, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to total request logs: %v", err)
+		}
+		if traffic.Requests != 3 || traffic.RequestBytes != 10000+4096+5 || traffic.ResponseBytes != 25000+65536 {
+			t.Errorf("Unexpected totals %+v", traffic)
+		}
+
+		future, err := logRepo.TrafficByRouteID(context.Background(), route.ID, time.Now().Add(time.Hour), time.Time{})
+		if err != nil || future.Requests != 0 || future.ResponseBytes != 0 {
+			t.Errorf("Expected nothing in the future, got %+v (%v)", future, err)
+		}
+	})
+}
+
+// TestRouteAnalyticsValidation tests the route analytics parameters rejected
+func TestRouteAnalyticsValidation(t *testing.T) {
+	handler := testRouter(t, nil, func(cfg *config.Config) {})
+	for name, path := range map[string]string{
+		"InvalidID":   "/api/routes/abc/analytics",
+		"InvalidFrom": "/api/routes/1/analytics?from=yesterday",
+		"InvalidTo":   "/api/routes/1/analytics?to=2024-13-01",
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400, got %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
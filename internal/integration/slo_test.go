@@ -0,0 +1,272 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/slo"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestSLOValidate tests the objective, latency threshold and window bounds
+func TestSLOValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		slo   slo.Config
+		valid bool
+	}{
+		{"Availability", slo.Config{Objective: 99.9}, true},
+		{"Latency", slo.Config{Objective: 99.5, LatencyMS: 250, WindowDays: 28}, true},
+		{"ZeroObjective", slo.Config{Objective: 0}, false},
+		{"NegativeObjective", slo.Config{Objective: -1}, false},
+		{"FullObjective", slo.Config{Objective: 100}, false},
+		{"OverObjective", slo.Config{Objective: 150}, false},
+		{"NaNObjective", slo.Config{Objective: math.NaN()}, false},
+		{"NegativeLatency", slo.Config{Objective: 99, LatencyMS: -5}, false},
+		{"LatencyOffBucket", slo.Config{Objective: 99, LatencyMS: 300}, false},
+		{"ShortWindow", slo.Config{Objective: 99, WindowDays: 1}, false},
+		{"LongWindow", slo.Config{Objective: 99, WindowDays: 365}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.slo.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Expected valid=%v, got %v", tt.valid, err)
+			}
+		})
+	}
+
+	t.Run("RouteTimeout", func(t *testing.T) {
+		log := logger.Get()
+		routeHandler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), nil, nil, log)
+		body := `{"path":"/slow","target_url":"http://api","method":"GET","timeout":1,"slo":{"objective":99,"latency_ms":2500}}`
+		w := httptest.NewRecorder()
+		routeHandler.Create(w, httptest.NewRequest("POST", "/api/routes", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "route timeout") {
+			t.Errorf("Expected a threshold past the timeout rejected, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// TestSLOCompliance tests the compliance and error budget math
+func TestSLOCompliance(t *testing.T) {
+	objective := &slo.Config{Objective: 99.5}
+	tests := []struct {
+		name                 string
+		requests, bad        int64
+		compliance           float64
+		met                  bool
+		budget, budgetRemain float64
+	}{
+		{"NoTraffic", 0, 0, 100, true, 0, 100},
+		{"Perfect", 1000, 0, 100, true, 5, 100},
+		{"HalfBudget", 1000, 2, 99.8, true, 5, 60},
+		{"BudgetSpent", 1000, 5, 99.5, true, 5, 0},
+		{"Overspent", 1000, 10, 99, false, 5, -100},
+		{"AllBad", 200, 200, 0, false, 1, -19900},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := slo.Evaluate(objective, tt.requests, tt.bad)
+			if got.Compliance != tt.compliance || got.Met != tt.met || got.ErrorBudget != tt.budget || got.BudgetRemaining != tt.budgetRemain {
+				t.Errorf("Expected compliance %v met=%v budget %v remaining %v, got %+v", tt.compliance, tt.met, tt.budget, tt.budgetRemain, got)
+			}
+			if got.WindowDays != slo.DefaultWindowDays {
+				t.Errorf("Expected the default window, got %d", got.WindowDays)
+			}
+		})
+	}
+}
+
+// TestSLORules tests that the generated rule file parses with the Prometheus
+// rules parser and reads the gateway's metrics
+func TestSLORules(t *testing.T) {
+	out, err := slo.Rules([]slo.Target{
+		{RouteID: 1, Route: "/users", SLO: &slo.Config{Objective: 99.9}},
+		{RouteID: 2, Route: `/search/"q"`, SLO: &slo.Config{Objective: 99.5, LatencyMS: 250, WindowDays: 7}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate rules: %v", err)
+	}
+
+	groups, errs := rulefmt.Parse(out)
+	if len(errs) > 0 {
+		t.Fatalf("Expected valid Prometheus rules, got %v\n%s", errs, out)
+	}
+	if len(groups.Groups) != 2 {
+		t.Fatalf("Expected a group per SLO, got %d", len(groups.Groups))
+	}
+
+	availability, latency := groups.Groups[0], groups.Groups[1]
+	if availability.Name != "isekai-slo-route-1" || len(availability.Rules) != 9 {
+		t.Errorf("Expected 7 recording rules and 2 alerts for route 1, got %s with %d rules", availability.Name, len(availability.Rules))
+	}
+
+	records, alerts := map[string]string{}, map[string]rulefmt.RuleNode{}
+	for _, rule := range availability.Rules {
+		if rule.Record.Value != "" {
+			records[rule.Record.Value] = rule.Expr.Value
+		} else {
+			alerts[rule.Alert.Value] = rule
+		}
+	}
+	if expr := records["isekai:slo_errors:ratio_rate5m"]; !strings.Contains(expr, `isekai_upstream_requests_total{route="/users",status_class="5xx"}[5m]`) {
+		t.Errorf("Expected the 5m error ratio read from the upstream requests, got %q", expr)
+	}
+	fast, ok := alerts["IsekaiSLOErrorBudgetBurnFast"]
+	if !ok || fast.Labels["severity"] != "page" || fast.Labels["route_id"] != "1" {
+		t.Fatalf("Expected a paging fast burn alert, got %+v", fast)
+	}
+	// 2% of a 30 day budget within an hour is a burn rate of 14.4
+	if !strings.Contains(fast.Expr.Value, "(14.4 * 0.001)") || !strings.Contains(fast.Expr.Value, `isekai:slo_errors:ratio_rate5m{route_id="1"}`) {
+		t.Errorf("Expected a 14.4x burn over 1h and 5m, got %q", fast.Expr.Value)
+	}
+
+	for _, rule := range latency.Rules {
+		switch {
+		case rule.Record.Value == "isekai:slo_errors:ratio_rate1h" && !strings.Contains(rule.Expr.Value, `isekai_upstream_request_duration_seconds_bucket{route="/search/\"q\"",le="0.25"}[1h]`):
+			t.Errorf("Expected the latency ratio read from the 0.25s bucket, got %q", rule.Expr.Value)
+		case rule.Alert.Value == "IsekaiSLOErrorBudgetBurnFast" && !strings.Contains(rule.Expr.Value, "(3.36 * 0.005)"):
+			// The same 2% of a 7 day budget
+			t.Errorf("Expected a 3.36x burn for a 7 day window, got %q", rule.Expr.Value)
+		}
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		out, err := slo.Rules(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate rules: %v", err)
+		}
+		if groups, errs := rulefmt.Parse(out); len(errs) > 0 || len(groups.Groups) != 0 {
+			t.Errorf("Expected an empty rule file, got %v %s", errs, out)
+		}
+	})
+}
+
+// TestSLOEndpoints tests reporting a route's compliance from its request logs
+// and generating rules for the routes with an SLO
+func TestSLOEndpoints(t *testing.T) {
+	db := testDatabase(t)
+	repo := database.NewRouteRepository(db)
+	logRepo := database.NewRequestLogRepository(db)
+
+	suffix := time.Now().UnixNano()
+	latency := &database.Route{Path: fmt.Sprintf("/slo-latency-%d", suffix), TargetURL: "http://api", Method: "GET", Enabled: true, Timeout: 30,
+		SLO: &slo.Config{Objective: 75, LatencyMS: 250}}
+	availability := &database.Route{Path: fmt.Sprintf("/slo-availability-%d", suffix), TargetURL: "http://api", Method: "GET", Enabled: true, Timeout: 30,
+		SLO: &slo.Config{Objective: 99, WindowDays: 7}}
+	plain := &database.Route{Path: fmt.Sprintf("/slo-none-%d", suffix), TargetURL: "http://api", Method: "GET", Enabled: true, Timeout: 30}
+	for _, route := range []*database.Route{latency, availability, plain} {
+		if err := repo.Create(context.Background(), route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		defer repo.Delete(context.Background(), route.ID)
+	}
+
+	// Fixtures: two of four recent requests are slow, and a slow request
+	// from before the window doesn't count
+	now := time.Now()
+	for _, entry := range []struct {
+		route   *database.Route
+		status  int
+		ms      int
+		created time.Time
+	}{
+		{latency, 200, 100, now.Add(-time.Hour)},
+		{latency, 200, 250, now.Add(-time.Hour)},
+		{latency, 200, 300, now.Add(-2 * time.Hour)},
+		{latency, 500, 900, now.Add(-3 * time.Hour)},
+		{latency, 200, 900, now.Add(-40 * 24 * time.Hour)},
+		{availability, 200, 10, now.Add(-time.Hour)},
+		{availability, 503, 10, now.Add(-time.Hour)},
+		{availability, 503, 10, now.Add(-10 * 24 * time.Hour)},
+	} {
+		log := &database.RequestLog{RouteID: &entry.route.ID, Method: "GET", Path: entry.route.Path, StatusCode: entry.status, ResponseTime: entry.ms, CreatedAt: entry.created}
+		if err := logRepo.Create(context.Background(), log); err != nil {
+			t.Fatalf("Failed to create request log: %v", err)
+		}
+	}
+
+	sloHandler := handlers.NewSLOHandler(db, logger.Get())
+	router := chi.NewRouter()
+	router.Get("/api/routes/{id}/slo", sloHandler.Compliance)
+	router.Get("/api/slo/rules", sloHandler.Rules)
+
+	compliance := func(route *database.Route) (*httptest.ResponseRecorder, slo.Compliance) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/api/routes/%d/slo", route.ID), nil))
+		var body struct {
+			Data slo.Compliance `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body.Data
+	}
+
+	t.Run("Latency", func(t *testing.T) {
+		w, got := compliance(latency)
+		if w.Code != http.StatusOK || got.Requests != 4 || got.BadRequests != 2 || got.Compliance != 50 || got.Met {
+			t.Errorf("Expected 2 of 4 requests slow, got %d %+v", w.Code, got)
+		}
+	})
+
+	t.Run("Availability", func(t *testing.T) {
+		w, got := compliance(availability)
+		if w.Code != http.StatusOK || got.Requests != 2 || got.BadRequests != 1 || got.WindowDays != 7 {
+			t.Errorf("Expected 1 of 2 requests failing within 7 days, got %d %+v", w.Code, got)
+		}
+	})
+
+	t.Run("NoSLO", func(t *testing.T) {
+		w, _ := compliance(plain)
+		var body response.Response
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusNotFound || body.Code != response.CodeNotFound {
+			t.Errorf("Expected 404 for a route without an SLO, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Rules", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/slo/rules", nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/yaml" {
+			t.Fatalf("Expected a YAML rule file, got %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		groups, errs := rulefmt.Parse(w.Body.Bytes())
+		if len(errs) > 0 {
+			t.Fatalf("Expected valid Prometheus rules, got %v", errs)
+		}
+		names := map[string]bool{}
+		for _, group := range groups.Groups {
+			names[group.Name] = true
+		}
+		for _, route := range []*database.Route{latency, availability} {
+			if !names[fmt.Sprintf("isekai-slo-route-%d", route.ID)] {
+				t.Errorf("Expected rules for route %d, got %v", route.ID, names)
+			}
+		}
+		if names[fmt.Sprintf("isekai-slo-route-%d", plain.ID)] {
+			t.Error("Expected no rules for a route without an SLO")
+		}
+	})
+}
+
+// TestSLORulesAdminOnly tests that generating rules needs an admin when
+// authentication is enabled
+func TestSLORulesAdminOnly(t *testing.T) {
+	handler := testRouter(t, nil, func(cfg *config.Config) { cfg.Auth.Enabled = true })
+	if w := adminUIGet(handler, "/api/slo/rules", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d %s", w.Code, w.Body.String())
+	}
+}
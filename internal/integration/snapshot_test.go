@@ -0,0 +1,193 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestSnapshotRestoreValidation tests restore requests rejected before the
+// database is touched
+func TestSnapshotRestoreValidation(t *testing.T) {
+	handler := testRouter(t, auth.NewAuthService("test-secret", logger.Get()), func(cfg *config.Config) {
+		cfg.Auth.Enabled = false
+	})
+
+	for _, target := range []string{"/api/snapshots/abc/restore", "/api/snapshots/1/restore?mode=overwrite"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", target, w.Code)
+		}
+	}
+}
+
+// TestSnapshotRestore tests that restoring a snapshot brings back the
+// routes exactly as captured
+func TestSnapshotRestore(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	ctx := context.Background()
+	repo := database.NewRouteRepository(db)
+
+	suffix := time.Now().UnixNano()
+	newRoute := func(name string) *database.Route {
+		route := &database.Route{
+			Path:           fmt.Sprintf("/snapshot-%s-%d", name, suffix),
+			TargetURL:      "http://localhost:9001",
+			Method:         "GET",
+			Enabled:        true,
+			Timeout:        30,
+			IPAllow:        []string{"10.0.0.0/8"},
+			MaxConcurrency: 5,
+		}
+		if err := repo.Create(ctx, route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		t.Cleanup(func() { repo.Delete(context.Background(), route.ID) })
+		return route
+	}
+	kept, removed := newRoute("kept"), newRoute("removed")
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	bus := events.NewBus()
+	var restored []events.Event
+	var mu sync.Mutex
+	bus.Subscribe(func(event events.Event) {
+		if event.Type == events.SnapshotRestored {
+			mu.Lock()
+			restored = append(restored, event)
+			mu.Unlock()
+		}
+	})
+
+	snapshotHandler := handlers.NewSnapshotHandler(db, cacheInstance, bus, 5, log)
+	router := chi.NewRouter()
+	router.Post("/api/snapshots", snapshotHandler.Create)
+	router.Get("/api/snapshots", snapshotHandler.List)
+	router.Post("/api/snapshots/{id}/restore", snapshotHandler.Restore)
+
+	send := func(method, target, body string) map[string]interface{} {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Fatalf("%s %s: unexpected status %d: %s", method, target, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Data
+	}
+	allRoutes := func() []byte {
+		t.Helper()
+		routes, err := repo.FindAll(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read routes: %v", err)
+		}
+		data, _ := json.Marshal(routes)
+		return data
+	}
+
+	original := allRoutes()
+	snapshot := send("POST", "/api/snapshots", `{"note": "before the mutation"}`)
+	snapshotID := int(snapshot["id"].(float64))
+	if snapshot["note"] != "before the mutation" || snapshot["payload"] != nil {
+		t.Errorf("Unexpected snapshot %v", snapshot)
+	}
+
+	// Mutate: change one route, delete another and add a third
+	kept.TargetURL = "http://localhost:9999"
+	kept.Enabled = false
+	if err := repo.Update(ctx, kept); err != nil {
+		t.Fatalf("Failed to update route: %v", err)
+	}
+	if err := repo.Delete(ctx, removed.ID); err != nil {
+		t.Fatalf("Failed to delete route: %v", err)
+	}
+	added := newRoute("added")
+	mutated := allRoutes()
+
+	t.Run("Replace", func(t *testing.T) {
+		result := send("POST", fmt.Sprintf("/api/snapshots/%d/restore", snapshotID), "")
+		if got := allRoutes(); !bytes.Equal(got, original) {
+			t.Fatalf("Expected the routes to be restored exactly\nwant %s\ngot  %s", original, got)
+		}
+		if result["created"] != 1.0 || result["updated"] != 1.0 || result["deleted"] != 1.0 {
+			t.Errorf("Expected one route created, updated and deleted, got %v", result)
+		}
+
+		entries, _, err := database.NewAuditRepository(db).FindByRouteID(ctx, kept.ID, 1, 0)
+		if err != nil || len(entries) != 1 || entries[0].Action != database.AuditActionRestore {
+			t.Errorf("Expected a restore audit entry, got %+v (%v)", entries, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(restored) != 1 {
+			t.Errorf("Expected a snapshot.restored event, got %d", len(restored))
+		}
+	})
+
+	t.Run("Undo", func(t *testing.T) {
+		mu.Lock()
+		pre := restored[0].Payload.(handlers.RestoreResult).PreRestoreSnapshotID
+		mu.Unlock()
+
+		send("POST", fmt.Sprintf("/api/snapshots/%d/restore", pre), "")
+		if got := allRoutes(); !bytes.Equal(got, mutated) {
+			t.Fatalf("Expected the pre-restore snapshot to bring back the mutated routes\nwant %s\ngot  %s", mutated, got)
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		result := send("POST", fmt.Sprintf("/api/snapshots/%d/restore?mode=merge", snapshotID), "")
+		if result["deleted"] != 0.0 {
+			t.Errorf("Expected merge to keep routes outside the snapshot, got %v", result)
+		}
+		if _, err := repo.FindByID(ctx, added.ID); err != nil {
+			t.Errorf("Expected the added route to be kept: %v", err)
+		}
+		restoredKept, err := repo.FindByID(ctx, kept.ID)
+		if err != nil || restoredKept.TargetURL != "http://localhost:9001" || !restoredKept.Enabled {
+			t.Errorf("Expected the snapshot's version of the route, got %+v (%v)", restoredKept, err)
+		}
+
+		// New routes must not collide with restored IDs
+		next := newRoute("next")
+		if next.ID <= removed.ID {
+			t.Errorf("Expected a new route ID after the restored ones, got %d", next.ID)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		page := send("GET", "/api/snapshots", "")
+		snapshots := page["snapshots"].([]interface{})
+		if len(snapshots) < 4 {
+			t.Fatalf("Expected the snapshot and three pre-restore snapshots, got %d", len(snapshots))
+		}
+		newest := snapshots[0].(map[string]interface{})
+		if newest["automatic"] != true || newest["payload"] != nil {
+			t.Errorf("Expected the newest snapshot to be an automatic one without payload, got %v", newest)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package integration
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/stream"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestServerSentEvents tests that event streams outlive the gateway's
+// timeouts and reach the client as each event is sent
+func TestServerSentEvents(t *testing.T) {
+	const (
+		timeout  = 500 * time.Millisecond
+		interval = 250 * time.Millisecond
+		events   = 44 // 11 seconds of events
+	)
+
+	log := logger.Get()
+	p := proxy.New(timeout, &config.Load().Proxy, log)
+
+	acceptEncoding := make(chan string, 1)
+	producer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(3 * timeout)
+			return
+		}
+
+		acceptEncoding <- r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		rc := http.NewResponseController(w)
+		for i := 0; i < events; i++ {
+			// Each event carries the time it was sent
+			if _, err := w.Write([]byte("id: " + strconv.Itoa(i) + "\ndata: " + strconv.FormatInt(time.Now().UnixNano(), 10) + "\n\n")); err != nil {
+				return
+			}
+			rc.Flush()
+
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer producer.Close()
+
+	handler := middleware.Logger(log, nil, nil)(middleware.Timeout(timeout)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ForwardAndCopy(r.Context(), w, r, producer.URL+r.URL.Path)
+	})))
+	gateway := httptest.NewUnstartedServer(handler)
+	gateway.Config.WriteTimeout = 3 * timeout
+	gateway.Start()
+	defer gateway.Close()
+
+	t.Run("Stream", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", gateway.URL+"/events", nil)
+		req.Header.Set("Accept", stream.ContentType)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to open the stream: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if !stream.IsEventStream(resp.Header) || resp.Header.Get("X-Accel-Buffering") != "no" {
+			t.Errorf("Expected an unbuffered event stream, got %v", resp.Header)
+		}
+		if enc := <-acceptEncoding; enc != "identity" {
+			t.Errorf("Expected the stream to be requested uncompressed, got %q", enc)
+		}
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("Expected an uncompressed stream, got %q", enc)
+		}
+
+		received := 0
+		var worst time.Duration
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			sent, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			nanos, err := strconv.ParseInt(sent, 10, 64)
+			if err != nil {
+				t.Fatalf("Unexpected event data %q", sent)
+			}
+			if latency := time.Since(time.Unix(0, nanos)); latency > worst {
+				worst = latency
+			}
+			received++
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatalf("Stream broke after %d events and %v: %v", received, time.Since(start), err)
+		}
+
+		if received != events {
+			t.Errorf("Expected %d events, got %d", events, received)
+		}
+		if elapsed := time.Since(start); elapsed < 10*time.Second {
+			t.Errorf("Expected a stream of over 10 seconds, took %v", elapsed)
+		}
+		if worst > 100*time.Millisecond {
+			t.Errorf("Expected every event to arrive within 100ms, worst was %v", worst)
+		}
+	})
+
+	t.Run("OtherRequestsTimeOut", func(t *testing.T) {
+		resp, err := http.Get(gateway.URL + "/slow")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("Expected status 504, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/drain"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/router"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/version"
+)
+
+// injectVersion stands in for build information injected with -ldflags
+func injectVersion(t *testing.T) {
+	v, c, d := version.Version, version.Commit, version.BuildDate
+	t.Cleanup(func() { version.Version, version.Commit, version.BuildDate = v, c, d })
+	version.Version, version.Commit, version.BuildDate = "1.2.3-test", "abc1234", "2026-01-02T03:04:05Z"
+}
+
+// TestStatusEndpoint tests that /api/status reports build information,
+// uptime, runtime, database, circuit breaker and load balancer summaries
+func TestStatusEndpoint(t *testing.T) {
+	log := logger.Get()
+	cfg := config.Load()
+	cfg.Auth.Enabled = false
+	cfg.Gateway.RateLimitEnabled = false
+
+	injectVersion(t)
+
+	cb := circuitbreaker.New(log, testMetrics(), nil)
+	cb.GetBreaker(circuitbreaker.Key{Backend: "status-test-target"}, nil)
+	cb.GetBreaker(circuitbreaker.RouteKey(7, "/orders", "http://orders:8080/v1/orders", nil), nil)
+
+	bus := events.NewBus()
+	cacheInstance := cache.New(&cfg.Cache, log, bus)
+	defer cacheInstance.Stop()
+
+	lb := loadbalancer.New(loadbalancer.RoundRobin, bus)
+	lb.AddBackend("http://127.0.0.1:1")
+	lb.AddBackend("http://127.0.0.1:2")
+	lb.MarkHealthy("http://127.0.0.1:2", false)
+
+	r := router.NewV2(
+		database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		cacheInstance,
+		proxy.New(5*time.Second, &cfg.Proxy, log),
+		cfg,
+		log,
+		auth.NewAuthService("test-secret", log),
+		nil,
+		cb,
+		lb,
+		websocket.NewHub(&cfg.WebSocket, log, nil),
+		bus,
+		drain.New(),
+	)
+	defer r.Shutdown()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/status", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	for _, key := range []string{"version", "build", "uptime", "runtime", "features", "database", "circuit_breakers", "load_balancer", "cache", "websocket", "drain"} {
+		if _, ok := resp.Data[key]; !ok {
+			t.Errorf("Expected %q in the status", key)
+		}
+	}
+
+	var build version.Info
+	json.Unmarshal(resp.Data["build"], &build)
+	if build.Version != "1.2.3-test" || build.Commit != "abc1234" || build.BuildDate != "2026-01-02T03:04:05Z" || build.GoVersion == "" {
+		t.Errorf("Expected the injected build information, got %+v", build)
+	}
+
+	var runtimeStats map[string]float64
+	json.Unmarshal(resp.Data["runtime"], &runtimeStats)
+	for _, key := range []string{"goroutines", "heap_alloc_bytes", "heap_objects", "gc_runs", "gc_pause_total_ms", "gc_pause_last_ms"} {
+		if _, ok := runtimeStats[key]; !ok {
+			t.Errorf("Expected runtime %q, got %v", key, runtimeStats)
+		}
+	}
+	if runtimeStats["goroutines"] < 1 || runtimeStats["heap_alloc_bytes"] <= 0 {
+		t.Errorf("Expected live runtime stats, got %v", runtimeStats)
+	}
+
+	var uptime struct {
+		StartedAt time.Time `json:"started_at"`
+		Seconds   int64     `json:"seconds"`
+	}
+	json.Unmarshal(resp.Data["uptime"], &uptime)
+	if uptime.StartedAt.IsZero() || uptime.Seconds < 0 {
+		t.Errorf("Expected an uptime, got %+v", uptime)
+	}
+
+	var db map[string]interface{}
+	json.Unmarshal(resp.Data["database"], &db)
+	if db["connected"] != false {
+		t.Errorf("Expected a disconnected database, got %v", db)
+	}
+	if _, ok := db["pool"]; ok {
+		t.Errorf("Expected no pool stats while disconnected, got %v", db)
+	}
+
+	var breakers map[string]int
+	json.Unmarshal(resp.Data["circuit_breakers"], &breakers)
+	if breakers["total"] < 1 || breakers["open"] != 0 {
+		t.Errorf("Expected a closed breaker, got %v", breakers)
+	}
+
+	var backends map[string]int
+	json.Unmarshal(resp.Data["load_balancer"], &backends)
+	if backends["backends"] != 2 || backends["healthy"] != 1 {
+		t.Errorf("Expected 1 of 2 backends healthy, got %v", backends)
+	}
+
+	w = httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/circuit-breaker/status", nil))
+	var status struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode breaker status: %v", err)
+	}
+	want := []map[string]interface{}{
+		{"route_id": float64(7), "route": "/orders", "backend": "http://orders:8080", "state": "closed"},
+		{"backend": "status-test-target", "state": "closed"},
+	}
+	if !reflect.DeepEqual(status.Data, want) {
+		t.Errorf("Expected breakers keyed by route and backend, got %v", status.Data)
+	}
+}
+
+// TestBuildInfoMetric tests that the injected build information is exported as a gauge
+func TestBuildInfoMetric(t *testing.T) {
+	injectVersion(t)
+	m := testMetrics()
+	info := version.Get()
+
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "isekai_build_info" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["version"] == info.Version && labels["commit"] == info.Commit &&
+				labels["build_date"] == info.BuildDate && labels["go_version"] == info.GoVersion && metric.GetGauge().GetValue() == 1 {
+				return
+			}
+		}
+	}
+	t.Errorf("Expected isekai_build_info for %+v", info)
+}
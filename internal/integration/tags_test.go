@@ -0,0 +1,269 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/etag"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// listRouteIDs lists routes through the handler and returns their IDs
+func listRouteIDs(t *testing.T, handler *handlers.RouteHandler, target string, claims *auth.Claims) []int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if claims != nil {
+		req = req.WithContext(auth.WithClaims(req.Context(), claims))
+	}
+	w := httptest.NewRecorder()
+	handler.List(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 listing %s, got %d", target, w.Code)
+	}
+
+	var resp struct {
+		Data []database.Route `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode routes: %v", err)
+	}
+	ids := make([]int, 0, len(resp.Data))
+	for _, route := range resp.Data {
+		ids = append(ids, route.ID)
+	}
+	return ids
+}
+
+// TestRouteTagFilter tests listing routes by tag, exact and within the
+// caller's tenant
+func TestRouteTagFilter(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	handler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	entry, err := etag.New([]database.Route{
+		{ID: 1, Path: "/pay", Tags: []string{"payments", "public"}},
+		{ID: 2, Path: "/refund", Tags: []string{"payments"}, TenantID: "acme"},
+		{ID: 3, Path: "/users", Tags: []string{"public"}},
+		{ID: 4, Path: "/pay-legacy", Tags: []string{"payments-v1"}},
+		{ID: 5, Path: "/health"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to tag routes: %v", err)
+	}
+	cacheInstance.Set("routes:all", entry)
+
+	cases := []struct {
+		target string
+		claims *auth.Claims
+		want   []int
+	}{
+		{"/api/routes", nil, []int{1, 2, 3, 4, 5}},
+		{"/api/routes?tag=payments", nil, []int{1, 2}},
+		{"/api/routes?tag=public", nil, []int{1, 3}},
+		{"/api/routes?tag=pay", nil, []int{}},
+		{"/api/routes?tag=payments", &auth.Claims{UserID: "7", Roles: []string{"user"}, TenantID: "acme"}, []int{2}},
+	}
+	for _, c := range cases {
+		if got := listRouteIDs(t, handler, c.target, c.claims); !slices.Equal(got, c.want) {
+			t.Errorf("Expected %s to list %v, got %v", c.target, c.want, got)
+		}
+	}
+}
+
+// TestRouteTagValidation tests the limits on tags and the metrics tag
+func TestRouteTagValidation(t *testing.T) {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	handler := handlers.NewRouteHandler(database.NewDisconnected(closedDatabaseConfig(t), log, nil), cacheInstance, nil, log)
+
+	tooMany := make([]string, 17)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("tag-%d", i)
+	}
+	cases := map[string]database.Route{
+		"too many tags":       {Tags: tooMany},
+		"too long":            {Tags: []string{strings.Repeat("a", 65)}},
+		"uppercase":           {Tags: []string{"Payments"}},
+		"space":               {Tags: []string{"team payments"}},
+		"duplicate":           {Tags: []string{"payments", "payments"}},
+		"foreign metrics tag": {Tags: []string{"payments"}, MetricsTag: "public"},
+	}
+	for name, route := range cases {
+		route.Path, route.TargetURL, route.Method = "/tagged", "http://example.com", "GET"
+		body, _ := json.Marshal(route)
+		w := httptest.NewRecorder()
+		handler.Create(w, httptest.NewRequest(http.MethodPost, "/api/routes", bytes.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", name, w.Code)
+		}
+	}
+}
+
+// TestRouteTagMetrics tests requests counted under the metrics tag, or the
+// first tag without one
+func TestRouteTagMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	first := egressRoute(1, "/first", upstream.URL, nil)
+	first.Tags = []string{"payments", "public"}
+	explicit := egressRoute(2, "/explicit", upstream.URL, nil)
+	explicit.Tags, explicit.MetricsTag = []string{"payments", "public"}, "public"
+	untagged := egressRoute(3, "/untagged", upstream.URL, nil)
+
+	m := testMetrics()
+	h := egressHandler(t, &config.Load().Proxy, m, nil, first, explicit, untagged)
+	for _, path := range []string{"/first", "/explicit", "/explicit", "/untagged"} {
+		rec := httptest.NewRecorder()
+		h.Handle(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected %s proxied, got %d", path, rec.Code)
+		}
+	}
+
+	if got := testutil.ToFloat64(m.TagRequests.WithLabelValues("payments", "2xx")); got != 1 {
+		t.Errorf("Expected one request counted under payments, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.TagRequests.WithLabelValues("public", "2xx")); got != 2 {
+		t.Errorf("Expected two requests counted under public, got %v", got)
+	}
+	if got := testutil.CollectAndCount(m.TagRequests); got != 2 {
+		t.Errorf("Expected only the two tags labelled, got %d series", got)
+	}
+}
+
+// TestRouteBulk tests a dry run listing exactly the routes the action then
+// changes, and the changes applied to them alone
+func TestRouteBulk(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	handler := handlers.NewRouteHandler(db, cacheInstance, nil, log)
+	repo := database.NewRouteRepository(db)
+	ctx := context.Background()
+
+	suffix := time.Now().UnixNano()
+	tag := fmt.Sprintf("bulk-%d", suffix)
+	create := func(name string, enabled bool, tags ...string) database.Route {
+		route := database.Route{Path: fmt.Sprintf("/%s-%d", name, suffix), TargetURL: "http://example.com", Method: "GET", Enabled: enabled, Tags: tags}
+		if err := repo.Create(ctx, &route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		t.Cleanup(func() { repo.Delete(ctx, route.ID) })
+		return route
+	}
+	enabled := create("bulk-enabled", true, tag, "other")
+	disabled := create("bulk-disabled", false, tag)
+	outside := create("bulk-outside", true, "other")
+
+	bulk := func(req handlers.BulkRequest) (int, handlers.BulkResult) {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		handler.Bulk(w, httptest.NewRequest(http.MethodPost, "/api/routes/bulk", bytes.NewReader(body)))
+		var resp struct {
+			Data handlers.BulkResult `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Data
+	}
+	ids := func(result handlers.BulkResult) []int {
+		ids := make([]int, 0, len(result.Routes))
+		for _, route := range result.Routes {
+			ids = append(ids, route.ID)
+		}
+		return ids
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, req := range []handlers.BulkRequest{
+			{Action: handlers.BulkEnable},
+			{Tag: tag, Action: "archive"},
+			{Tag: tag, Action: handlers.BulkSetRateLimit},
+		} {
+			if code, _ := bulk(req); code != http.StatusBadRequest {
+				t.Errorf("Expected %+v refused, got %d", req, code)
+			}
+		}
+	})
+
+	t.Run("DisableDryRun", func(t *testing.T) {
+		code, dry := bulk(handlers.BulkRequest{Tag: tag, Action: handlers.BulkDisable, DryRun: true})
+		if code != http.StatusOK || !dry.DryRun || dry.Count != 1 || !slices.Equal(ids(dry), []int{enabled.ID}) {
+			t.Fatalf("Expected the dry run to list only the enabled route, got %d %+v", code, dry)
+		}
+		if stored, _ := repo.FindByID(ctx, enabled.ID); !stored.Enabled {
+			t.Fatalf("Expected the dry run to leave the route enabled")
+		}
+
+		code, applied := bulk(handlers.BulkRequest{Tag: tag, Action: handlers.BulkDisable})
+		if code != http.StatusOK || !slices.Equal(ids(applied), ids(dry)) {
+			t.Fatalf("Expected the run to change what the dry run listed, got %d %v", code, ids(applied))
+		}
+		if stored, _ := repo.FindByID(ctx, enabled.ID); stored.Enabled {
+			t.Errorf("Expected the tagged route disabled")
+		}
+		if stored, _ := repo.FindByID(ctx, outside.ID); !stored.Enabled {
+			t.Errorf("Expected the untagged route left enabled")
+		}
+	})
+
+	t.Run("RateLimitDryRun", func(t *testing.T) {
+		rateLimit := 42
+		_, dry := bulk(handlers.BulkRequest{Tag: tag, Action: handlers.BulkSetRateLimit, RateLimit: &rateLimit, DryRun: true})
+		if !slices.Equal(ids(dry), []int{enabled.ID, disabled.ID}) {
+			t.Fatalf("Expected both tagged routes listed, got %v", ids(dry))
+		}
+		for _, route := range dry.Routes {
+			if route.RateLimit != rateLimit {
+				t.Errorf("Expected route %d shown with the new rate limit, got %d", route.ID, route.RateLimit)
+			}
+			if stored, _ := repo.FindByID(ctx, route.ID); stored.RateLimit == rateLimit {
+				t.Errorf("Expected the dry run to leave route %d's rate limit", route.ID)
+			}
+		}
+
+		_, applied := bulk(handlers.BulkRequest{Tag: tag, Action: handlers.BulkSetRateLimit, RateLimit: &rateLimit})
+		if !slices.Equal(ids(applied), ids(dry)) {
+			t.Fatalf("Expected the run to change what the dry run listed, got %v", ids(applied))
+		}
+		if _, again := bulk(handlers.BulkRequest{Tag: tag, Action: handlers.BulkSetRateLimit, RateLimit: &rateLimit, DryRun: true}); again.Count != 0 {
+			t.Errorf("Expected nothing left to change, got %v", ids(again))
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		_, dry := bulk(handlers.BulkRequest{Tag: tag, Action: handlers.BulkDelete, DryRun: true})
+		_, applied := bulk(handlers.BulkRequest{Tag: tag, Action: handlers.BulkDelete})
+		if !slices.Equal(ids(applied), ids(dry)) || applied.Count != 2 {
+			t.Fatalf("Expected both tagged routes deleted as listed, got %v and %v", ids(dry), ids(applied))
+		}
+		if remaining, err := repo.FindByTag(ctx, tag); err != nil || len(remaining) != 0 {
+			t.Errorf("Expected no routes left with the tag, got %d, %v", len(remaining), err)
+		}
+		if _, err := repo.FindByID(ctx, outside.ID); err != nil {
+			t.Errorf("Expected the untagged route kept, got %v", err)
+		}
+	})
+}
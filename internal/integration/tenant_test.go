@@ -0,0 +1,306 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// sendAs sends a request with a JSON body to handler with a token for claims
+func sendAs(t *testing.T, handler http.Handler, authService *auth.AuthService, claims auth.Claims, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	token, err := authService.IssueToken(claims, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// TestTenantRouteAuthorization tests who may write routes when auth is
+// enabled, before anything reaches the database
+func TestTenantRouteAuthorization(t *testing.T) {
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	handler := testRouter(t, authService, func(cfg *config.Config) {
+		cfg.Auth.Enabled = true
+	})
+
+	t.Run("NoTenant", func(t *testing.T) {
+		w := sendAs(t, handler, authService, auth.Claims{UserID: "2", Roles: []string{"user"}}, "POST", "/api/routes", `{}`)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected a user without a tenant refused, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("ForeignTenant", func(t *testing.T) {
+		body := `{"path":"/orders","target_url":"http://orders","method":"GET","tenant_id":"globex"}`
+		w := sendAs(t, handler, authService, auth.Claims{UserID: "3", TenantID: "acme"}, "POST", "/api/routes", body)
+		var resp response.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusForbidden || resp.Code != response.CodeForbidden {
+			t.Errorf("Expected a route for another tenant refused, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("TenantUser", func(t *testing.T) {
+		w := sendAs(t, handler, authService, auth.Claims{UserID: "3", TenantID: "acme"}, "POST", "/api/routes", `{`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected a tenant user let through to validation, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("TenantsAdminOnly", func(t *testing.T) {
+		w := sendAs(t, handler, authService, auth.Claims{UserID: "3", TenantID: "acme"}, "GET", "/api/tenants", "")
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected the tenant API refused to tenant users, got %d", w.Code)
+		}
+	})
+}
+
+// TestTenantRateLimit tests that callers without a tier get their tenant's rate
+func TestTenantRateLimit(t *testing.T) {
+	log := logger.Get()
+	authService := auth.NewAuthService("test-secret", log)
+
+	rl := middleware.NewRateLimiter(1, log)
+	defer rl.Stop()
+	tiers := middleware.NewRateLimitTiers(map[string]int{"gold": 10})
+	tiers.ReplaceTenants(map[string]int{"acme": 3, "globex": 0})
+	handler := middleware.TieredRateLimit(rl, tiers, authService)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	expect := func(t *testing.T, claims auth.Claims, status int, tier string) {
+		t.Helper()
+		w := sendAs(t, handler, authService, claims, "GET", "/", "")
+		if w.Code != status || w.Header().Get(middleware.RateLimitTierHeader) != tier {
+			t.Errorf("Expected %d on tier %q, got %d on %q", status, tier, w.Code, w.Header().Get(middleware.RateLimitTierHeader))
+		}
+	}
+
+	acme := auth.Claims{UserID: "acme-user", TenantID: "acme"}
+	for i := 0; i < 3; i++ {
+		expect(t, acme, http.StatusOK, "tenant:acme")
+	}
+	expect(t, acme, http.StatusTooManyRequests, "tenant:acme")
+
+	// A tier of the caller's own wins over the tenant's rate
+	expect(t, auth.Claims{UserID: "acme-gold", TenantID: "acme", Tier: "gold"}, http.StatusOK, "gold")
+
+	// A tenant without a rate leaves its callers on the default
+	expect(t, auth.Claims{UserID: "globex-user", TenantID: "globex"}, http.StatusOK, middleware.DefaultRateLimitTier)
+}
+
+// tenantRouteRouter serves route management the way the gateway does with
+// auth enabled
+func tenantRouteRouter(t *testing.T, db *database.Database, authService *auth.AuthService) http.Handler {
+	log := logger.Get()
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	t.Cleanup(cacheInstance.Stop)
+	routeHandler := handlers.NewRouteHandler(db, cacheInstance, events.NewBus(), log)
+
+	router := chi.NewRouter()
+	router.Use(authService.Middleware())
+	router.Get("/api/routes", routeHandler.List)
+	router.Post("/api/routes", routeHandler.Create)
+	router.Group(func(owned chi.Router) {
+		owned.Use(routeHandler.RequireTenant)
+		owned.Get("/api/routes/{id}", routeHandler.Get)
+		owned.Put("/api/routes/{id}", routeHandler.Update)
+		owned.Patch("/api/routes/{id}", routeHandler.Patch)
+		owned.Delete("/api/routes/{id}", routeHandler.Delete)
+	})
+	return router
+}
+
+// createTenants stores tenants for a test, removing them afterwards
+func createTenants(t *testing.T, db *database.Database, ids ...string) {
+	t.Helper()
+
+	repo := database.NewTenantRepository(db)
+	for _, id := range ids {
+		if err := repo.Upsert(context.Background(), &database.Tenant{ID: id}); err != nil {
+			t.Fatalf("Failed to create tenant: %v", err)
+		}
+		t.Cleanup(func() { repo.Delete(context.Background(), id) })
+	}
+}
+
+// TestTenantIsolation tests that tenant users can't see or change another
+// tenant's routes, while admins cross tenants
+func TestTenantIsolation(t *testing.T) {
+	db := testDatabase(t)
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	router := tenantRouteRouter(t, db, authService)
+
+	suffix := time.Now().UnixNano()
+	acmeID, globexID := fmt.Sprintf("acme-%d", suffix), fmt.Sprintf("globex-%d", suffix)
+	createTenants(t, db, acmeID, globexID)
+
+	routes := database.NewRouteRepository(db)
+	globexRoute := &database.Route{Path: fmt.Sprintf("/globex-%d", suffix), TargetURL: "http://globex", Method: "GET", Enabled: true, Timeout: 30, TenantID: globexID}
+	if err := routes.Create(context.Background(), globexRoute); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer routes.Delete(context.Background(), globexRoute.ID)
+
+	acme := auth.Claims{UserID: "acme-user", TenantID: acmeID}
+	admin := auth.Claims{UserID: "admin", Roles: []string{database.RoleAdmin}}
+
+	// The tenant's route is created under its tenant without naming it
+	w := sendAs(t, router, authService, acme, "POST", "/api/routes",
+		fmt.Sprintf(`{"path":"/acme-%d","target_url":"http://acme","method":"GET","enabled":true,"timeout":30}`, suffix))
+	var created struct {
+		Data database.Route `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if w.Code != http.StatusCreated || created.Data.TenantID != acmeID {
+		t.Fatalf("Expected the route created under %s, got %d %s", acmeID, w.Code, w.Body.String())
+	}
+	defer routes.Delete(context.Background(), created.Data.ID)
+
+	globexPath := fmt.Sprintf("/api/routes/%d", globexRoute.ID)
+
+	t.Run("List", func(t *testing.T) {
+		var list struct {
+			Data []database.Route `json:"data"`
+		}
+		json.Unmarshal(sendAs(t, router, authService, acme, "GET", "/api/routes", "").Body.Bytes(), &list)
+		for _, route := range list.Data {
+			if route.TenantID != acmeID {
+				t.Errorf("Expected only %s's routes, got %s's %s", acmeID, route.TenantID, route.Path)
+			}
+		}
+	})
+
+	t.Run("CrossTenantDenied", func(t *testing.T) {
+		for _, req := range []struct{ method, body string }{
+			{"GET", ""},
+			{"PUT", `{"path":"/stolen","target_url":"http://acme","method":"GET"}`},
+			{"PATCH", `{"target_url":"http://acme"}`},
+			{"DELETE", ""},
+		} {
+			w := sendAs(t, router, authService, acme, req.method, globexPath, req.body)
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected %s of another tenant's route answered 404, got %d", req.method, w.Code)
+			}
+		}
+
+		stored, err := routes.FindByID(context.Background(), globexRoute.ID)
+		if err != nil || stored.TargetURL != "http://globex" {
+			t.Errorf("Expected the route unchanged, got %+v %v", stored, err)
+		}
+	})
+
+	t.Run("NoHandOver", func(t *testing.T) {
+		w := sendAs(t, router, authService, acme, "PATCH", fmt.Sprintf("/api/routes/%d", created.Data.ID), fmt.Sprintf(`{"tenant_id":%q}`, globexID))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected moving a route to another tenant refused, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("PathCollision", func(t *testing.T) {
+		w := sendAs(t, router, authService, acme, "POST", "/api/routes",
+			fmt.Sprintf(`{"path":%q,"target_url":"http://acme","method":"GET"}`, globexRoute.Path))
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected a path held by another tenant refused, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("AdminCrossesTenants", func(t *testing.T) {
+		if w := sendAs(t, router, authService, admin, "GET", globexPath, ""); w.Code != http.StatusOK {
+			t.Errorf("Expected the admin to read any route, got %d", w.Code)
+		}
+		w := sendAs(t, router, authService, admin, "POST", "/api/routes",
+			fmt.Sprintf(`{"path":"/unknown-%d","target_url":"http://x","method":"GET","tenant_id":"no-such-tenant"}`, suffix))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected an unknown tenant refused, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// TestTenantMetrics tests that requests to a tenant's routes are counted and
+// logged under the tenant
+func TestTenantMetrics(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	tenantID := fmt.Sprintf("metrics-%d", time.Now().UnixNano())
+	createTenants(t, db, tenantID)
+
+	repo := database.NewRouteRepository(db)
+	route := &database.Route{Path: "/" + tenantID, TargetURL: backend.URL, Method: "POST", Enabled: true, Timeout: 30, TenantID: tenantID}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+
+	w := httptest.NewRecorder()
+	proxyHandler.Handle(w, httptest.NewRequest("POST", route.Path, strings.NewReader("ping")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	if got := testutil.ToFloat64(m.TenantRequests.WithLabelValues(tenantID, "200")); got != 1 {
+		t.Errorf("Expected 1 request counted for the tenant, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.TenantTransferBytes.WithLabelValues(tenantID, "request")); got != 4 {
+		t.Errorf("Expected 4 request bytes counted for the tenant, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.TenantTransferBytes.WithLabelValues(tenantID, "response")); got != 5 {
+		t.Errorf("Expected 5 response bytes counted for the tenant, got %v", got)
+	}
+
+	logs := database.NewRequestLogRepository(db)
+	waitFor(t, func() bool {
+		found, err := logs.FindByFilter(context.Background(), database.RequestLogFilter{TenantID: tenantID})
+		return err == nil && len(found) == 1
+	})
+	usage, err := logs.TrafficByTenant(context.Background(), tenantID, time.Time{}, time.Time{})
+	if err != nil || usage.Requests != 1 || usage.ResponseBytes != 5 {
+		t.Errorf("Expected the tenant's usage totalled from its logs, got %+v %v", usage, err)
+	}
+}
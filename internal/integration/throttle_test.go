@@ -0,0 +1,200 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/throttle"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// TestThrottle tests that requests over the rate queue for their token, and
+// are turned away once the queue is full or the token would come too late
+func TestThrottle(t *testing.T) {
+	var depth atomic.Int64
+	th := throttle.New(10, 1, 1, 150*time.Millisecond, func(delta int) { depth.Add(int64(delta)) })
+
+	if err := th.Wait(context.Background()); err != nil {
+		t.Fatalf("Expected the burst to pass at once, got %v", err)
+	}
+
+	// The next token comes after 100ms, within the queue timeout
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- th.Wait(context.Background()) }()
+	waitFor(t, func() bool { return th.Queued() == 1 })
+	if depth.Load() != 1 {
+		t.Errorf("Expected the queue callback to see 1 waiting, got %d", depth.Load())
+	}
+
+	if err := th.Wait(context.Background()); !errors.Is(err, throttle.ErrQueueFull) || throttle.Reason(err) != "queue_full" {
+		t.Errorf("Expected the full queue to turn the request away, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected the queued request to get its token, got %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Expected the queued request to wait for its token, waited %v", waited)
+	}
+
+	// Two tokens ahead would take 200ms, over the queue timeout
+	th = throttle.New(10, 1, 10, 150*time.Millisecond, nil)
+	th.Wait(context.Background())
+	go th.Wait(context.Background())
+	waitFor(t, func() bool { return th.Queued() == 1 })
+	start = time.Now()
+	if err := th.Wait(context.Background()); !errors.Is(err, throttle.ErrQueueTimeout) {
+		t.Errorf("Expected a token past the queue timeout to be refused, got %v", err)
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Errorf("Expected a token past the queue timeout to be refused at once, waited %v", waited)
+	}
+	if depth.Load() != 0 {
+		t.Errorf("Expected the queue to drain, got %d", depth.Load())
+	}
+
+	t.Run("Canceled", func(t *testing.T) {
+		th := throttle.New(1, 1, 1, time.Minute, nil)
+		th.Wait(context.Background())
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := th.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the wait to end with its context, got %v", err)
+		}
+	})
+}
+
+// TestThrottleLoad sends a burst of concurrent requests through a throttle
+// and checks the upstream never sees more than the configured rate
+func TestThrottleLoad(t *testing.T) {
+	const perSecond, burst, requests = 40, 2, 100
+
+	var mu sync.Mutex
+	var arrivals []time.Time
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+	}))
+	defer upstream.Close()
+
+	th := throttle.New(perSecond, burst, requests, 5*time.Second, nil)
+	var wg sync.WaitGroup
+	var rejected atomic.Int64
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := th.Wait(context.Background()); err != nil {
+				rejected.Add(1)
+				return
+			}
+			resp, err := http.Get(upstream.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if rejected.Load() != 0 || len(arrivals) != requests {
+		t.Fatalf("Expected all %d requests queued and sent, got %d sent and %d rejected", requests, len(arrivals), rejected.Load())
+	}
+
+	// Any second holds at most the rate plus the burst; allow one request
+	// of slack for scheduling jitter between the token and the upstream
+	for i, start := range arrivals {
+		in := 0
+		for _, at := range arrivals[i:] {
+			if at.Sub(start) < time.Second {
+				in++
+			}
+		}
+		if in > perSecond+burst+1 {
+			t.Fatalf("Expected at most %d requests per second at the upstream, got %d", perSecond+burst, in)
+		}
+	}
+}
+
+// TestRouteUpstreamRateLimit tests that requests over a route's upstream rate
+// are answered by the gateway without reaching the upstream
+func TestRouteUpstreamRateLimit(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer backend.Close()
+
+	repo := database.NewRouteRepository(db)
+	route := &database.Route{
+		Path:              fmt.Sprintf("/throttled-%d", time.Now().UnixNano()),
+		TargetURL:         backend.URL,
+		Method:            "GET",
+		Enabled:           true,
+		Timeout:           30,
+		UpstreamRateLimit: 1,
+	}
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	proxyHandler.SetThrottleQueue(0, 0)
+
+	do := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest("GET", route.Path, nil))
+		return w
+	}
+
+	if w := do(); w.Code != http.StatusOK {
+		t.Fatalf("Expected the first request through, got %d", w.Code)
+	}
+	w := do()
+	var body response.Response
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusServiceUnavailable || body.Code != response.CodeUpstreamThrottled || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 %s with Retry-After, got %d %s", response.CodeUpstreamThrottled, w.Code, w.Body.String())
+	}
+	if hits.Load() != 1 {
+		t.Errorf("Expected the upstream to see 1 request, got %d", hits.Load())
+	}
+	if got := testutil.ToFloat64(m.UpstreamThrottled.WithLabelValues(route.Path, "queue_full")); got != 1 {
+		t.Errorf("Expected the throttled request to be counted, got %v", got)
+	}
+}
@@ -0,0 +1,214 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// topicMessage is a hub message with its payload left encoded
+type topicMessage struct {
+	Type    string          `json:"type"`
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// sendControl writes a subscribe or unsubscribe message for topics
+func sendControl(t *testing.T, conn *gorilla.Conn, messageType string, topics ...string) {
+	t.Helper()
+	err := conn.WriteJSON(websocket.Message{Type: messageType, Payload: websocket.Subscription{Topics: topics}})
+	if err != nil {
+		t.Fatalf("Failed to send %s: %v", messageType, err)
+	}
+}
+
+// readMessage reads the next hub message
+func readMessage(t *testing.T, conn *gorilla.Conn) topicMessage {
+	t.Helper()
+	var msg topicMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	return msg
+}
+
+// expectTopic reads the next message and checks it was published to topic
+// with payload
+func expectTopic(t *testing.T, conn *gorilla.Conn, topic, payload string) {
+	t.Helper()
+	msg := readMessage(t, conn)
+	if msg.Type != websocket.MessageTopic || msg.Topic != topic || string(msg.Payload) != payload {
+		t.Errorf("Expected %s on %s, got %s %s %s", payload, topic, msg.Type, msg.Topic, msg.Payload)
+	}
+}
+
+// TestWebSocketTopics tests that published messages only reach the topic's
+// subscribers and that subscriptions are cleaned up
+func TestWebSocketTopics(t *testing.T) {
+	cfg := config.Load().WebSocket
+	cfg.MaxTopicsPerClient = 2
+	hub, server := startHub(t, &cfg)
+
+	orders := dialHub(t, server, "?user=orders")
+	both := dialHub(t, server, "?user=both")
+	users := dialHub(t, server, "?user=users")
+
+	sendControl(t, orders, websocket.MessageSubscribe, "orders")
+	sendControl(t, both, websocket.MessageSubscribe, "orders", "users")
+	sendControl(t, users, websocket.MessageSubscribe, "users")
+	for _, conn := range []*gorilla.Conn{orders, both, users} {
+		if msg := readMessage(t, conn); msg.Type != websocket.MessageSubscribed {
+			t.Fatalf("Expected a subscription confirmation, got %+v", msg)
+		}
+	}
+	if hub.SubscriberCount("orders") != 2 || hub.SubscriberCount("users") != 2 {
+		t.Fatalf("Unexpected subscribers %v", hub.GetTopicCounts())
+	}
+
+	t.Run("Isolation", func(t *testing.T) {
+		if n := hub.Publish("orders", json.RawMessage(`{"id":1}`)); n != 2 {
+			t.Errorf("Expected delivery to 2 clients, got %d", n)
+		}
+		if n := hub.Publish("users", json.RawMessage(`{"id":2}`)); n != 2 {
+			t.Errorf("Expected delivery to 2 clients, got %d", n)
+		}
+		if n := hub.Publish("nobody", json.RawMessage(`{"id":3}`)); n != 0 {
+			t.Errorf("Expected no delivery, got %d", n)
+		}
+		hub.Publish("orders", json.RawMessage(`{"id":4}`))
+
+		// Each client's next messages are only those of its own topics
+		expectTopic(t, orders, "orders", `{"id":1}`)
+		expectTopic(t, orders, "orders", `{"id":4}`)
+		expectTopic(t, both, "orders", `{"id":1}`)
+		expectTopic(t, both, "users", `{"id":2}`)
+		expectTopic(t, both, "orders", `{"id":4}`)
+		expectTopic(t, users, "users", `{"id":2}`)
+	})
+
+	t.Run("Unsubscribe", func(t *testing.T) {
+		sendControl(t, both, websocket.MessageUnsubscribe, "orders")
+		msg := readMessage(t, both)
+		var sub websocket.Subscription
+		json.Unmarshal(msg.Payload, &sub)
+		if msg.Type != websocket.MessageSubscribed || !slices.Equal(sub.Topics, []string{"users"}) {
+			t.Errorf("Expected to remain on users, got %s %s", msg.Type, msg.Payload)
+		}
+		if n := hub.SubscriberCount("orders"); n != 1 {
+			t.Errorf("Expected 1 orders subscriber, got %d", n)
+		}
+	})
+
+	t.Run("TopicLimit", func(t *testing.T) {
+		greedy := dialHub(t, server, "?user=greedy")
+		sendControl(t, greedy, websocket.MessageSubscribe, "a", "b", "c", strings.Repeat("x", websocket.MaxTopicLength+1))
+
+		msg := readMessage(t, greedy)
+		var refused websocket.ControlError
+		json.Unmarshal(msg.Payload, &refused)
+		if msg.Type != websocket.MessageError || len(refused.Topics) != 2 || refused.Topics[0] != "c" {
+			t.Errorf("Expected the topics over the limit refused, got %s %s", msg.Type, msg.Payload)
+		}
+		if msg := readMessage(t, greedy); msg.Type != websocket.MessageSubscribed {
+			t.Errorf("Expected a subscription confirmation, got %+v", msg)
+		}
+		if hub.SubscriberCount("a") != 1 || hub.SubscriberCount("b") != 1 || hub.SubscriberCount("c") != 0 {
+			t.Errorf("Expected only the first 2 topics joined, got %v", hub.GetTopicCounts())
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		orders.Close()
+		users.Close()
+		waitFor(t, func() bool {
+			_, exists := hub.GetTopicCounts()["orders"]
+			return !exists && hub.SubscriberCount("users") == 1
+		})
+	})
+}
+
+// TestWebSocketPublishEndpoint tests publishing to a topic over the API
+func TestWebSocketPublishEndpoint(t *testing.T) {
+	authService := auth.NewAuthService("test-secret", logger.Get())
+	handler := testRouter(t, authService, func(cfg *config.Config) {
+		cfg.Auth.Enabled = true
+		cfg.Gateway.RateLimitEnabled = false
+	})
+
+	token := func(roles ...string) string {
+		t.Helper()
+		token, err := authService.GenerateToken("service-1", "orders-service", roles, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		return token
+	}
+	publish := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/websocket/publish", bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+	}{
+		{"Unauthenticated", "", `{"topic": "orders", "payload": {}}`, http.StatusUnauthorized},
+		{"WrongRole", token("user"), `{"topic": "orders", "payload": {}}`, http.StatusForbidden},
+		{"Publisher", token("publisher"), `{"topic": "orders", "payload": {"id": 1}}`, http.StatusOK},
+		{"MissingTopic", token("admin"), `{"payload": {}}`, http.StatusBadRequest},
+		{"InvalidBody", token("admin"), `{"topic":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := publish(tt.token, tt.body); w.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Stats", func(t *testing.T) {
+		stats := func(token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/api/websocket/stats", nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+		// Stats list connected users, so they are for admins only
+		if w := stats(""); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 without a token, got %d", w.Code)
+		}
+		if w := stats(token("publisher")); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for a publisher, got %d", w.Code)
+		}
+
+		w := stats(token("admin"))
+		var body struct {
+			Data map[string]json.RawMessage `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if string(body.Data["topics"]) != "{}" {
+			t.Errorf("Expected an empty topic list, got %s", w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/tracing"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testSpans installs a recording tracer provider once, since tracers
+// obtained before the first provider is set keep delegating to it
+var testSpans = sync.OnceValue(func() *tracetest.SpanRecorder {
+	sampler, _ := tracing.Sampler(tracing.SamplerParent, 1)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSampler(sampler), sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(tracing.Propagator())
+	return recorder
+})
+
+// TestTracePropagation tests that the gateway joins the caller's trace and
+// passes the trace context on to the upstream
+func TestTracePropagation(t *testing.T) {
+	recorder := testSpans()
+	log := logger.Get()
+	p := proxy.New(5*time.Second, &config.Load().Proxy, log)
+
+	upstreamHeaders := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders <- r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	handler := middleware.TraceContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ForwardAndCopy(r.Context(), w, r, backend.URL)
+	}))
+
+	call := func(headers map[string]string) http.Header {
+		req := httptest.NewRequest("GET", "/traced", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return <-upstreamHeaders
+	}
+
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		callerSpanID = "00f067aa0ba902b7"
+	)
+
+	t.Run("NewTrace", func(t *testing.T) {
+		parts := strings.Split(call(nil).Get("traceparent"), "-")
+		if len(parts) != 4 || len(parts[1]) != 32 || parts[3] != "01" {
+			t.Errorf("Expected a sampled traceparent upstream, got %q", strings.Join(parts, "-"))
+		}
+	})
+
+	t.Run("CallerTrace", func(t *testing.T) {
+		headers := call(map[string]string{
+			"traceparent": "00-" + traceID + "-" + callerSpanID + "-01",
+			"baggage":     "tenant=acme",
+		})
+
+		parts := strings.Split(headers.Get("traceparent"), "-")
+		if len(parts) != 4 || parts[1] != traceID || parts[2] == callerSpanID {
+			t.Errorf("Expected the caller's trace with the gateway's span upstream, got %q", headers.Get("traceparent"))
+		}
+		if headers.Get("baggage") != "tenant=acme" {
+			t.Errorf("Expected the baggage upstream, got %q", headers.Get("baggage"))
+		}
+
+		var span sdktrace.ReadOnlySpan
+		for _, ended := range recorder.Ended() {
+			if ended.Name() == "proxy.ForwardAndCopy" && ended.SpanContext().TraceID().String() == traceID {
+				span = ended
+			}
+		}
+		if span == nil {
+			t.Fatal("Expected the gateway span in the caller's trace")
+		}
+		if parent := span.Parent(); parent.SpanID().String() != callerSpanID || !parent.IsRemote() {
+			t.Errorf("Expected the caller's span as the remote parent, got %v", parent.SpanID())
+		}
+		if parts[2] != span.SpanContext().SpanID().String() {
+			t.Errorf("Expected the gateway span %s as the upstream's parent, got %s", span.SpanContext().SpanID(), parts[2])
+		}
+	})
+
+	t.Run("CallerNotSampled", func(t *testing.T) {
+		before := len(recorder.Ended())
+		headers := call(map[string]string{"traceparent": "00-" + traceID + "-" + callerSpanID + "-00"})
+
+		if parts := strings.Split(headers.Get("traceparent"), "-"); len(parts) != 4 || parts[1] != traceID || parts[3] != "00" {
+			t.Errorf("Expected the unsampled decision upstream, got %q", headers.Get("traceparent"))
+		}
+		if len(recorder.Ended()) != before {
+			t.Error("Expected no spans to be recorded for an unsampled trace")
+		}
+	})
+}
+
+// endedSpan returns the ended span named name in the trace traceID
+func endedSpan(recorder *tracetest.SpanRecorder, name, traceID string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name && span.SpanContext().TraceID().String() == traceID {
+			return span
+		}
+	}
+	return nil
+}
+
+// spanAttribute returns the value of the span attribute key
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+// TestUpstreamSpanStatus tests that only 5xx upstream responses mark the
+// proxy span as failed, while every status is recorded as an attribute
+func TestUpstreamSpanStatus(t *testing.T) {
+	recorder := testSpans()
+	log := logger.Get()
+	p := proxy.New(5*time.Second, &config.Load().Proxy, log)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(status)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	handler := middleware.TraceContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ForwardAndCopy(r.Context(), w, r, backend.URL+r.URL.Path)
+	}))
+
+	tests := []struct {
+		status int
+		code   codes.Code
+	}{
+		{http.StatusOK, codes.Unset},
+		{http.StatusNotFound, codes.Unset},
+		{http.StatusTooManyRequests, codes.Unset},
+		{http.StatusServiceUnavailable, codes.Error},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			traceID := fmt.Sprintf("%032x", 0x1089000+i)
+			req := httptest.NewRequest("GET", fmt.Sprintf("/%d", tt.status), nil)
+			req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d from the upstream, got %d", tt.status, rec.Code)
+			}
+
+			span := endedSpan(recorder, "proxy.ForwardAndCopy", traceID)
+			if span == nil {
+				t.Fatal("Expected the proxy span to be recorded")
+			}
+			if span.Status().Code != tt.code {
+				t.Errorf("Expected span status %v, got %v (%s)", tt.code, span.Status().Code, span.Status().Description)
+			}
+			if span.SpanKind() != trace.SpanKindClient {
+				t.Errorf("Expected a client span, got %v", span.SpanKind())
+			}
+
+			if v, _ := spanAttribute(span, "http.response.status_code"); v.AsInt64() != int64(tt.status) {
+				t.Errorf("Expected http.response.status_code %d, got %v", tt.status, v.Emit())
+			}
+			if v, _ := spanAttribute(span, "http.request.method"); v.AsString() != "GET" {
+				t.Errorf("Expected http.request.method GET, got %q", v.Emit())
+			}
+			if v, _ := spanAttribute(span, "server.address"); v.AsString() != backendURL.Hostname() {
+				t.Errorf("Expected server.address %s, got %q", backendURL.Hostname(), v.Emit())
+			}
+			if v, _ := spanAttribute(span, "server.port"); strconv.FormatInt(v.AsInt64(), 10) != backendURL.Port() {
+				t.Errorf("Expected server.port %s, got %v", backendURL.Port(), v.Emit())
+			}
+			if v, _ := spanAttribute(span, "network.peer.address"); v.AsString() != backendURL.Hostname() {
+				t.Errorf("Expected network.peer.address %s, got %q", backendURL.Hostname(), v.Emit())
+			}
+
+			errorType, ok := spanAttribute(span, "error.type")
+			if tt.code == codes.Error && errorType.AsString() != strconv.Itoa(tt.status) {
+				t.Errorf("Expected error.type %d, got %q", tt.status, errorType.Emit())
+			}
+			if tt.code != codes.Error && ok {
+				t.Errorf("Expected no error.type, got %q", errorType.Emit())
+			}
+		})
+	}
+}
+
+// TestSamplers tests the sampler names accepted in TRACING_SAMPLER
+func TestSamplers(t *testing.T) {
+	for _, name := range []string{tracing.SamplerAlways, tracing.SamplerNever, tracing.SamplerRatio, tracing.SamplerParent} {
+		if _, err := tracing.Sampler(name, 0.5); err != nil {
+			t.Errorf("Expected sampler %q, got %v", name, err)
+		}
+	}
+	if _, err := tracing.Sampler("sometimes", 0.5); err == nil {
+		t.Error("Expected an unknown sampler to be rejected")
+	}
+	if _, err := tracing.Sampler(tracing.SamplerRatio, 1.5); err == nil {
+		t.Error("Expected a ratio above 1 to be rejected")
+	}
+}
@@ -0,0 +1,321 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/transform"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// assertJSON fails unless got and want hold the same JSON value
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("Expected JSON, got %q", got)
+	}
+	json.Unmarshal([]byte(want), &wantValue)
+	gotJSON, _ := json.Marshal(gotValue)
+	wantJSON, _ := json.Marshal(wantValue)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("Expected %s, got %s", wantJSON, gotJSON)
+	}
+}
+
+// TestTransformOps tests each transform operation on a JSON body
+func TestTransformOps(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  transform.Ops
+		body string
+		want string
+	}{
+		{
+			"Rename",
+			transform.Ops{Rename: map[string]string{"user_name": "username", "profile.mail": "email"}},
+			`{"user_name":"ann","profile":{"mail":"ann@example.com","age":30}}`,
+			`{"username":"ann","email":"ann@example.com","profile":{"age":30}}`,
+		},
+		{
+			"Delete",
+			transform.Ops{Delete: []string{"password", "meta.internal", "missing.field"}},
+			`{"name":"ann","password":"secret","meta":{"internal":true,"public":1}}`,
+			`{"name":"ann","meta":{"public":1}}`,
+		},
+		{
+			"Set",
+			transform.Ops{Set: map[string]interface{}{"version": 2.0, "source.name": "isekai", "name": "override"}},
+			`{"name":"ann"}`,
+			`{"name":"override","version":2,"source":{"name":"isekai"}}`,
+		},
+		{
+			"Nest",
+			transform.Ops{Nest: map[string][]string{"address": {"street", "city", "zip"}}},
+			`{"name":"ann","street":"Main St","city":"Springfield"}`,
+			`{"name":"ann","address":{"street":"Main St","city":"Springfield"}}`,
+		},
+		{
+			"Unnest",
+			transform.Ops{Unnest: []string{"data", "data.inner"}},
+			`{"data":{"id":1,"inner":{"deep":true}},"ok":true}`,
+			`{"id":1,"inner":{"deep":true},"ok":true}`,
+		},
+		{
+			"UnnestNested",
+			transform.Ops{Unnest: []string{"user.profile"}},
+			`{"user":{"id":1,"profile":{"name":"ann"}}}`,
+			`{"user":{"id":1,"name":"ann"}}`,
+		},
+		{
+			"Array",
+			transform.Ops{Rename: map[string]string{"id": "ID"}, Delete: []string{"secret"}},
+			`[{"id":1,"secret":"x"},{"id":2},"scalar"]`,
+			`[{"ID":1},{"ID":2},"scalar"]`,
+		},
+		{
+			"Combined",
+			transform.Ops{
+				Rename: map[string]string{"first": "name.first"},
+				Nest:   map[string][]string{"name": {"last"}},
+				Delete: []string{"token"},
+				Set:    map[string]interface{}{"kind": "person"},
+			},
+			`{"first":"Ann","last":"Lee","token":"t"}`,
+			`{"name":{"first":"Ann","last":"Lee"},"kind":"person"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.ops.Apply([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("Apply failed: %v", err)
+			}
+			assertJSON(t, got, tt.want)
+		})
+	}
+
+	t.Run("Conflict", func(t *testing.T) {
+		ops := transform.Ops{Set: map[string]interface{}{"name.first": "Ann"}}
+		if _, err := ops.Apply([]byte(`{"name":"Ann Lee"}`)); err == nil {
+			t.Error("Expected an error setting a field under a non-object")
+		}
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		for _, path := range []string{"", ".name", "name.", "a..b"} {
+			rules := transform.Rules{Request: &transform.Ops{Delete: []string{path}}}
+			if err := rules.Validate(); err == nil {
+				t.Errorf("Expected path %q to be rejected", path)
+			}
+		}
+		rules := transform.Rules{Response: &transform.Ops{Rename: map[string]string{"a.b": "c"}}}
+		if err := rules.Validate(); err != nil {
+			t.Errorf("Expected valid rules, got %v", err)
+		}
+	})
+}
+
+// TestTransformPassThrough tests that bodies the rules can't apply to are forwarded unchanged
+func TestTransformPassThrough(t *testing.T) {
+	rules := &transform.Rules{Request: &transform.Ops{Delete: []string{"secret"}}}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"NotJSONContentType", "text/plain", `{"secret":"x"}`},
+		{"InvalidJSON", "application/json", `{"secret":`},
+		{"TooLarge", "application/json", `{"secret":"` + strings.Repeat("x", 64) + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+
+			if err := rules.TransformRequest(req, 32); err != nil {
+				t.Fatalf("Expected pass-through, got %v", err)
+			}
+			if body, _ := io.ReadAll(req.Body); string(body) != tt.body {
+				t.Errorf("Expected the body unchanged, got %q", body)
+			}
+		})
+	}
+
+	t.Run("JSONSuffix", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"secret":"x","keep":1}`))
+		req.Header.Set("Content-Type", "application/merge-patch+json; charset=utf-8")
+
+		if err := rules.TransformRequest(req, 1024); err != nil {
+			t.Fatalf("TransformRequest failed: %v", err)
+		}
+		body, _ := io.ReadAll(req.Body)
+		assertJSON(t, body, `{"keep":1}`)
+		if req.ContentLength != int64(len(body)) {
+			t.Errorf("Expected Content-Length %d, got %d", len(body), req.ContentLength)
+		}
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		strict := &transform.Rules{Request: rules.Request, Strict: true}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`not json`))
+		req.Header.Set("Content-Type", "application/json")
+
+		if err := strict.TransformRequest(req, 1024); err == nil {
+			t.Error("Expected strict mode to reject an invalid body")
+		}
+	})
+}
+
+// TestTransformProxy tests request and response rewriting through the proxy
+func TestTransformProxy(t *testing.T) {
+	rules := &transform.Rules{
+		Request:  &transform.Ops{Rename: map[string]string{"userName": "user_name"}},
+		Response: &transform.Ops{Unnest: []string{"data"}, Set: map[string]interface{}{"gateway": "isekai"}},
+	}
+
+	var received string
+	upstream := func(body, contentType string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			received = string(b)
+			w.Header().Set("Content-Type", contentType)
+			io.WriteString(w, body)
+		}
+	}
+
+	send := func(p *proxy.Proxy, rules *transform.Rules, backend http.HandlerFunc) *httptest.ResponseRecorder {
+		server := httptest.NewServer(backend)
+		defer server.Close()
+
+		req := httptest.NewRequest("POST", "/users", strings.NewReader(`{"userName":"ann"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		if err := p.TransformRequest(req, rules); err != nil {
+			t.Fatalf("TransformRequest failed: %v", err)
+		}
+		p.ForwardAndCopy(proxy.WithTransform(req.Context(), rules), w, req, server.URL)
+		return w
+	}
+
+	p := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+
+	w := send(p, rules, upstream(`{"data":{"id":7},"ok":true}`, "application/json"))
+	assertJSON(t, []byte(received), `{"user_name":"ann"}`)
+	assertJSON(t, w.Body.Bytes(), `{"id":7,"ok":true,"gateway":"isekai"}`)
+	if got := w.Header().Get("Content-Length"); got != fmt.Sprint(w.Body.Len()) {
+		t.Errorf("Expected Content-Length %d, got %q", w.Body.Len(), got)
+	}
+
+	t.Run("NonJSONResponse", func(t *testing.T) {
+		w := send(p, rules, upstream(`{"data":{"id":7}}`, "text/plain"))
+		if w.Body.String() != `{"data":{"id":7}}` {
+			t.Errorf("Expected a non-JSON response unchanged, got %q", w.Body.String())
+		}
+	})
+
+	t.Run("InvalidResponse", func(t *testing.T) {
+		w := send(p, rules, upstream(`<html>`, "application/json"))
+		if w.Code != http.StatusOK || w.Body.String() != `<html>` {
+			t.Errorf("Expected an invalid response passed through, got %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("StrictInvalidResponse", func(t *testing.T) {
+		strict := &transform.Rules{Response: rules.Response, Strict: true}
+		w := send(p, strict, upstream(`<html>`, "application/json"))
+
+		var resp response.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusBadGateway || resp.Code != response.CodeTransformFailed {
+			t.Errorf("Expected 502 %s, got %d %q", response.CodeTransformFailed, w.Code, resp.Code)
+		}
+	})
+}
+
+// TestRouteTransform tests a stored transform and the dry-run endpoint
+func TestRouteTransform(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+
+	route := &database.Route{
+		Path:      fmt.Sprintf("/transform-%d", time.Now().UnixNano()),
+		TargetURL: "http://example.com",
+		Method:    "POST",
+		Enabled:   true,
+		Timeout:   30,
+		Transform: &transform.Rules{Request: &transform.Ops{Delete: []string{"password"}}},
+	}
+	repo := database.NewRouteRepository(db)
+	if err := repo.Create(context.Background(), route); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	defer repo.Delete(context.Background(), route.ID)
+
+	stored, err := repo.FindByID(context.Background(), route.ID)
+	if err != nil || stored.Transform == nil || stored.Transform.Request == nil || len(stored.Transform.Request.Delete) != 1 {
+		t.Fatalf("Expected the transform to round-trip, got %+v (%v)", stored, err)
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	routeHandler := handlers.NewRouteHandler(db, cacheInstance, nil, log)
+
+	router := chi.NewRouter()
+	router.Post("/api/routes/{id}/transform/test", routeHandler.TestTransform)
+
+	dryRun := func(body string) (int, response.Response) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/api/routes/%d/transform/test", route.ID), strings.NewReader(body)))
+		var resp response.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	result := func(resp response.Response) []byte {
+		data, _ := json.Marshal(resp.Data.(map[string]interface{})["body"])
+		return data
+	}
+
+	status, resp := dryRun(`{"body":{"user":"ann","password":"secret"}}`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	assertJSON(t, result(resp), `{"user":"ann"}`)
+
+	// Unsaved rules can be tried before they're stored
+	status, resp = dryRun(`{"direction":"response","body":{"a":1},"transform":{"response":{"rename":{"a":"b"}}}}`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	assertJSON(t, result(resp), `{"b":1}`)
+
+	// The saved rules have no response operations
+	_, resp = dryRun(`{"direction":"response","body":{"password":"secret"}}`)
+	assertJSON(t, result(resp), `{"password":"secret"}`)
+
+	if status, resp := dryRun(`{"direction":"sideways","body":{}}`); status != http.StatusBadRequest || resp.Code != response.CodeValidationFailed {
+		t.Errorf("Expected 400 %s for a bad direction, got %d %q", response.CodeValidationFailed, status, resp.Code)
+	}
+	if status, resp := dryRun(`{"transform":{"request":{"delete":["a..b"]}},"body":{}}`); status != http.StatusBadRequest || resp.Code != response.CodeValidationFailed {
+		t.Errorf("Expected 400 %s for invalid rules, got %d %q", response.CodeValidationFailed, status, resp.Code)
+	}
+}
@@ -0,0 +1,180 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/seal"
+	"github.com/zakirkun/isekai/internal/upstreamauth"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestUpstreamAuth tests that each mode's credentials reach the upstream and
+// verify there
+func TestUpstreamAuth(t *testing.T) {
+	seal.SetKey("test-seal-key")
+	defer seal.SetKey("")
+
+	// The upstream records the last request it received with its body
+	var received *http.Request
+	var receivedBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedBody, _ = io.ReadAll(r.Body)
+		received = r
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	cfg := config.Load().Proxy
+	cfg.SignMaxBody = 16
+	p := proxy.New(5*time.Second, &cfg, logger.Get())
+
+	send := func(t *testing.T, profile *upstreamauth.Profile, req *http.Request) {
+		t.Helper()
+		if err := profile.Seal(); err != nil {
+			t.Fatalf("Failed to seal profile: %v", err)
+		}
+		w := httptest.NewRecorder()
+		p.ForwardAndCopy(proxy.WithUpstreamAuth(req.Context(), profile), w, req, upstream.URL)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	t.Run("HMAC", func(t *testing.T) {
+		send(t, &upstreamauth.Profile{Mode: upstreamauth.ModeHMAC, Secret: "shared"},
+			httptest.NewRequest("POST", "/orders?id=1", strings.NewReader(`{"id":1}`)))
+
+		if err := upstreamauth.Verify(received, receivedBody, "shared", time.Minute); err != nil {
+			t.Errorf("Expected a verifiable signature, got %v", err)
+		}
+		if err := upstreamauth.Verify(received, receivedBody, "other", time.Minute); err == nil {
+			t.Error("Expected the signature to fail with another secret")
+		}
+		if err := upstreamauth.Verify(received, []byte(`{"id":2}`), "shared", time.Minute); err == nil {
+			t.Error("Expected the signature to fail with another body")
+		}
+	})
+
+	t.Run("UnsignedPayload", func(t *testing.T) {
+		body := strings.Repeat("x", 32)
+		send(t, &upstreamauth.Profile{Mode: upstreamauth.ModeHMAC, Secret: "shared"},
+			httptest.NewRequest("POST", "/upload", strings.NewReader(body)))
+
+		if got := received.Header.Get(upstreamauth.ContentSHA256Header); got != upstreamauth.UnsignedPayload {
+			t.Errorf("Expected a body over the cap left unsigned, got %q", got)
+		}
+		if string(receivedBody) != body {
+			t.Errorf("Expected the whole body forwarded, got %d bytes", len(receivedBody))
+		}
+		if err := upstreamauth.Verify(received, receivedBody, "shared", time.Minute); err != nil {
+			t.Errorf("Expected the method, path and timestamp signed, got %v", err)
+		}
+	})
+
+	t.Run("JWT", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/profile", nil)
+		caller := &auth.Claims{UserID: "user-1", Username: "alice", Roles: []string{"admin"}, Tier: "gold"}
+		req = req.WithContext(auth.WithClaims(req.Context(), caller))
+		send(t, &upstreamauth.Profile{Mode: upstreamauth.ModeJWT, Secret: "minting-key", Audience: "orders"}, req)
+
+		bearer := strings.TrimPrefix(received.Header.Get("Authorization"), "Bearer ")
+		claims := &auth.Claims{}
+		_, err := jwt.ParseWithClaims(bearer, claims, func(*jwt.Token) (interface{}, error) {
+			return []byte("minting-key"), nil
+		}, jwt.WithIssuer(upstreamauth.Issuer), jwt.WithAudience("orders"), jwt.WithValidMethods([]string{"HS256"}))
+		if err != nil {
+			t.Fatalf("Expected a verifiable token, got %v", err)
+		}
+		if claims.UserID != "user-1" || claims.Username != "alice" || claims.Tier != "gold" || len(claims.Roles) != 1 || claims.Subject != "user-1" {
+			t.Errorf("Expected the caller's claims, got %+v", claims)
+		}
+		if ttl := claims.ExpiresAt.Sub(claims.IssuedAt.Time); ttl != 60*time.Second {
+			t.Errorf("Expected a 60s token, got %v", ttl)
+		}
+	})
+
+	t.Run("JWTHeader", func(t *testing.T) {
+		send(t, &upstreamauth.Profile{Mode: upstreamauth.ModeJWT, Secret: "minting-key", Header: "X-Gateway-Token"},
+			httptest.NewRequest("GET", "/", nil))
+		if received.Header.Get("X-Gateway-Token") == "" || received.Header.Get("Authorization") != "" {
+			t.Errorf("Expected the token in X-Gateway-Token, got %v", received.Header)
+		}
+	})
+
+	t.Run("Basic", func(t *testing.T) {
+		send(t, &upstreamauth.Profile{Mode: upstreamauth.ModeBasic, Username: "gateway", Password: "hunter2"},
+			httptest.NewRequest("GET", "/", nil))
+		if username, password, ok := received.BasicAuth(); !ok || username != "gateway" || password != "hunter2" {
+			t.Errorf("Expected basic credentials, got %q %q", username, password)
+		}
+	})
+
+	t.Run("Bearer", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer caller-token")
+		send(t, &upstreamauth.Profile{Mode: upstreamauth.ModeBearer, Token: "static-token"}, req)
+		if got := received.Header.Get("Authorization"); got != "Bearer static-token" {
+			t.Errorf("Expected the static token to replace the caller's, got %q", got)
+		}
+	})
+}
+
+// TestUpstreamAuthProfile tests validating and sealing profiles
+func TestUpstreamAuthProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile upstreamauth.Profile
+		valid   bool
+	}{
+		{"HMAC", upstreamauth.Profile{Mode: "hmac", Secret: "s"}, true},
+		{"HMACWithoutSecret", upstreamauth.Profile{Mode: "hmac"}, false},
+		{"JWTNegativeTTL", upstreamauth.Profile{Mode: "jwt", Secret: "s", TTL: -1}, false},
+		{"BasicWithoutPassword", upstreamauth.Profile{Mode: "basic", Username: "u"}, false},
+		{"Bearer", upstreamauth.Profile{Mode: "bearer", Token: "t"}, true},
+		{"UnknownMode", upstreamauth.Profile{Mode: "digest"}, false},
+	}
+
+	t.Run("NoSealKey", func(t *testing.T) {
+		profile := upstreamauth.Profile{Mode: "bearer", Token: "t"}
+		if err := profile.Validate(); err == nil {
+			t.Error("Expected credentials to require a seal key")
+		}
+	})
+
+	seal.SetKey("test-seal-key")
+	defer seal.SetKey("")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.profile.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Expected valid %v, got %v", tt.valid, err)
+			}
+		})
+	}
+
+	t.Run("Seal", func(t *testing.T) {
+		profile := upstreamauth.Profile{Mode: "basic", Username: "u", Password: "hunter2"}
+		if err := profile.Seal(); err != nil {
+			t.Fatalf("Failed to seal: %v", err)
+		}
+		if strings.Contains(profile.Password, "hunter2") || !seal.Sealed(profile.Password) {
+			t.Errorf("Expected the password sealed, got %q", profile.Password)
+		}
+		sealed := profile.Password
+		if err := profile.Seal(); err != nil || profile.Password != sealed {
+			t.Error("Expected sealing to be idempotent")
+		}
+		if err := profile.Validate(); err != nil {
+			t.Errorf("Expected the sealed profile valid, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,364 @@
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/seal"
+	"github.com/zakirkun/isekai/internal/upstreamtls"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// testCA is a certificate authority for issuing client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA creates a self-signed certificate authority
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "isekai test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a PEM client certificate and key signed by the CA
+func (ca *testCA) issue(t *testing.T, name string) (string, string) {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(certPEM), string(keyPEM)
+}
+
+// writeCert issues a certificate from ca and writes it and its key to files in dir
+func writeCert(t *testing.T, dir string, ca *testCA, name string) (string, string) {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, name)
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, []byte(certPEM), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, []byte(keyPEM), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// TestUpstreamMTLS tests per-route client certificates against an upstream requiring them
+func TestUpstreamMTLS(t *testing.T) {
+	ca := newTestCA(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	serverCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}))
+
+	cfg := config.Load().Proxy
+	cfg.TLSReloadInterval = 0
+	p := proxy.New(5*time.Second, &cfg, logger.Get())
+
+	send := func(profile *upstreamtls.Profile) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		p.ForwardAndCopy(proxy.WithTLS(req.Context(), profile), w, req, upstream.URL)
+		return w
+	}
+	expectCode := func(t *testing.T, w *httptest.ResponseRecorder, code string) {
+		t.Helper()
+		var resp response.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusBadGateway || resp.Code != code {
+			t.Errorf("Expected 502 %s, got %d %q", code, w.Code, w.Body.String())
+		}
+	}
+	expectBadGateway := func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		expectCode(t, w, response.CodeBadGateway)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, ca, "billing")
+	profile := &upstreamtls.Profile{CertFile: certFile, KeyFile: keyFile, CAPEM: serverCA}
+
+	w := send(profile)
+	if w.Code != http.StatusOK || w.Body.String() != "hello billing" {
+		t.Fatalf("Expected the client certificate to be accepted, got %d %q", w.Code, w.Body.String())
+	}
+
+	// The pooled transport keeps its connection for the next request
+	reused := p.Stats().ConnsReused
+	if w := send(profile); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if p.Stats().ConnsReused != reused+1 {
+		t.Error("Expected the second request to reuse the connection")
+	}
+
+	t.Run("NoClientCertificate", func(t *testing.T) {
+		expectBadGateway(t, send(&upstreamtls.Profile{CAPEM: serverCA}))
+	})
+
+	t.Run("UntrustedClientCertificate", func(t *testing.T) {
+		certFile, keyFile := writeCert(t, t.TempDir(), newTestCA(t), "intruder")
+		expectBadGateway(t, send(&upstreamtls.Profile{CertFile: certFile, KeyFile: keyFile, CAPEM: serverCA}))
+	})
+
+	t.Run("UntrustedServer", func(t *testing.T) {
+		expectCode(t, send(&upstreamtls.Profile{CertFile: certFile, KeyFile: keyFile}), response.CodeUpstreamTLS)
+	})
+
+	t.Run("ServerNameOverride", func(t *testing.T) {
+		// The test server's certificate is valid for example.com
+		override := &upstreamtls.Profile{CertFile: certFile, KeyFile: keyFile, CAPEM: serverCA, ServerName: "example.com"}
+		if w := send(override); w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d %q", w.Code, w.Body.String())
+		}
+		expectCode(t, send(&upstreamtls.Profile{CertFile: certFile, KeyFile: keyFile, CAPEM: serverCA, ServerName: "other.test"}), response.CodeUpstreamTLS)
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := writeCert(t, dir, newTestCA(t), "stale")
+		rotating := &upstreamtls.Profile{CertFile: certFile, KeyFile: keyFile, CAPEM: serverCA}
+		expectBadGateway(t, send(rotating))
+
+		// Rotate the files in place without restarting the proxy
+		writeCert(t, dir, ca, "rotated")
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, later, later)
+		os.Chtimes(keyFile, later, later)
+
+		if w := send(rotating); w.Code != http.StatusOK || w.Body.String() != "hello rotated" {
+			t.Errorf("Expected the rotated certificate to be used, got %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("SealedPEM", func(t *testing.T) {
+		seal.SetKey("test-seal-key")
+		defer seal.SetKey("")
+
+		certPEM, keyPEM := ca.issue(t, "inline")
+		inline := &upstreamtls.Profile{CertPEM: certPEM, KeyPEM: keyPEM, CAPEM: serverCA}
+		if err := inline.Seal(); err != nil {
+			t.Fatalf("Seal failed: %v", err)
+		}
+		if !strings.HasPrefix(inline.KeyPEM, "sealed:") || strings.Contains(inline.KeyPEM, "PRIVATE KEY") {
+			t.Fatalf("Expected the private key to be encrypted, got %q", inline.KeyPEM)
+		}
+		if err := inline.Validate(); err != nil {
+			t.Fatalf("Expected the sealed profile to validate, got %v", err)
+		}
+
+		if w := send(inline); w.Code != http.StatusOK || w.Body.String() != "hello inline" {
+			t.Errorf("Expected the inline certificate to be accepted, got %d %q", w.Code, w.Body.String())
+		}
+
+		seal.SetKey("another-key")
+		if err := inline.Validate(); err == nil {
+			t.Error("Expected a key sealed with another secret to be rejected")
+		}
+	})
+}
+
+// TestUpstreamTLSValidation tests that incomplete TLS profiles are rejected
+func TestUpstreamTLSValidation(t *testing.T) {
+	certPEM, keyPEM := newTestCA(t).issue(t, "client")
+
+	tests := []struct {
+		name    string
+		profile upstreamtls.Profile
+		valid   bool
+	}{
+		{"CertFileOnly", upstreamtls.Profile{CertFile: "client.crt"}, false},
+		{"KeyFileOnly", upstreamtls.Profile{KeyFile: "client.key"}, false},
+		{"CertPEMOnly", upstreamtls.Profile{CertPEM: certPEM}, false},
+		{"FilesAndPEM", upstreamtls.Profile{CertFile: "client.crt", KeyFile: "client.key", CertPEM: certPEM, KeyPEM: keyPEM}, false},
+		{"BadCA", upstreamtls.Profile{CAPEM: "not a certificate"}, false},
+		{"InlineWithoutSealKey", upstreamtls.Profile{CertPEM: certPEM, KeyPEM: keyPEM}, false},
+		{"Files", upstreamtls.Profile{CertFile: "client.crt", KeyFile: "client.key"}, true},
+		{"ServerNameOnly", upstreamtls.Profile{ServerName: "api.internal"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.profile.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Expected valid=%v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+// proxyErrors returns the proxy errors counted by type
+func proxyErrors(t *testing.T, m *metrics.Metrics) map[string]float64 {
+	t.Helper()
+
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	counts := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "isekai_proxy_errors_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "error_type" {
+					counts[label.GetValue()] += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// TestGlobalUpstreamTLS tests trusting an internal CA for every upstream,
+// certificate verification failures reported apart from other errors, the
+// minimum TLS version and skipping verification
+func TestGlobalUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "internal")
+	}))
+	upstream.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// The test server's certificate is its own CA
+	caFile := filepath.Join(t.TempDir(), "internal-ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+
+	send := func(t *testing.T, configure func(cfg *config.ProxyConfig)) (*httptest.ResponseRecorder, *metrics.Metrics) {
+		t.Helper()
+		cfg := config.Load().Proxy
+		configure(&cfg)
+		m := testMetrics()
+		h := egressHandler(t, &cfg, m, nil, egressRoute(1, "/internal", upstream.URL, nil))
+		w := httptest.NewRecorder()
+		h.Handle(w, httptest.NewRequest("GET", "/internal", nil))
+		return w, m
+	}
+
+	t.Run("Untrusted", func(t *testing.T) {
+		w, m := send(t, func(*config.ProxyConfig) {})
+		var resp response.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusBadGateway || resp.Code != response.CodeUpstreamTLS {
+			t.Errorf("Expected 502 %s, got %d %q", response.CodeUpstreamTLS, w.Code, w.Body.String())
+		}
+		if errs := proxyErrors(t, m); errs["tls_verify"] != 1 || errs["upstream"] != 0 {
+			t.Errorf("Expected one tls_verify error, got %v", errs)
+		}
+	})
+
+	t.Run("CAFile", func(t *testing.T) {
+		w, m := send(t, func(cfg *config.ProxyConfig) { cfg.CAFiles = []string{caFile} })
+		if w.Code != http.StatusOK || w.Body.String() != "internal" {
+			t.Errorf("Expected the internal CA trusted, got %d %q", w.Code, w.Body.String())
+		}
+		if errs := proxyErrors(t, m); len(errs) != 0 {
+			t.Errorf("Expected no proxy errors, got %v", errs)
+		}
+	})
+
+	t.Run("MinVersion", func(t *testing.T) {
+		// Refusing TLS 1.2 isn't a certificate problem
+		w, m := send(t, func(cfg *config.ProxyConfig) {
+			cfg.CAFiles = []string{caFile}
+			cfg.TLSMinVersion = "1.3"
+		})
+		var resp response.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusBadGateway || resp.Code != response.CodeBadGateway {
+			t.Errorf("Expected 502 %s below the minimum version, got %d %q", response.CodeBadGateway, w.Code, w.Body.String())
+		}
+		if errs := proxyErrors(t, m); errs["upstream"] != 1 {
+			t.Errorf("Expected one upstream error, got %v", errs)
+		}
+	})
+
+	t.Run("InsecureSkipVerify", func(t *testing.T) {
+		if w, _ := send(t, func(cfg *config.ProxyConfig) { cfg.InsecureSkipVerify = true }); w.Code != http.StatusOK {
+			t.Errorf("Expected verification skipped, got %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		notCA := filepath.Join(t.TempDir(), "not-ca.pem")
+		os.WriteFile(notCA, []byte("not a certificate"), 0o600)
+		for name, configure := range map[string]func(cfg *config.ProxyConfig){
+			"MissingCA": func(cfg *config.ProxyConfig) { cfg.CAFiles = []string{filepath.Join(t.TempDir(), "missing.pem")} },
+			"NotCA":     func(cfg *config.ProxyConfig) { cfg.CAFiles = []string{notCA} },
+			"Version":   func(cfg *config.ProxyConfig) { cfg.TLSMinVersion = "1.4" },
+		} {
+			cfg := config.Load()
+			configure(&cfg.Proxy)
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "PROXY_") {
+				t.Errorf("Expected %s refused, got %v", name, err)
+			}
+		}
+		cfg := config.Load()
+		cfg.Proxy.CAFiles = []string{caFile}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Expected the CA bundle accepted, got %v", err)
+		}
+	})
+}
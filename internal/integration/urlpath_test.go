@@ -0,0 +1,193 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/matcher"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/rewrite"
+	"github.com/zakirkun/isekai/internal/urlpath"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestCleanPath tests each normalization applied to escaped request paths
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		name, path, want string
+	}{
+		{"Root", "/", "/"},
+		{"Empty", "", ""},
+		{"DuplicateSlashes", "//users///1", "/users/1"},
+		{"RootSlashes", "//", "/"},
+		{"TrailingSlash", "/users/1/", "/users/1"},
+		{"Unreserved", "/%7Euser/%41%62c-%5F%2E", "/~user/Abc-_."},
+		{"EscapedSlashKept", "/a%2fb", "/a%2Fb"},
+		{"ReservedUpperCased", "/caf%c3%a9?", "/caf%C3%A9?"},
+		{"InvalidEscape", "/bad%zz", "/bad%zz"},
+		{"TruncatedEscape", "/100%", "/100%"},
+		{"Clean", "/users/1", "/users/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := urlpath.Clean(tt.path); got != tt.want {
+				t.Errorf("Expected %q cleaned to %q, got %q", tt.path, tt.want, got)
+			}
+		})
+	}
+}
+
+// TestNormalizeURL tests that normalizing a request URL keeps its query and
+// escaped slashes and leaves clean URLs alone
+func TestNormalizeURL(t *testing.T) {
+	u, _ := url.ParseRequestURI("//users//%7E1/?page=2")
+	normalized := urlpath.Normalize(u)
+	if normalized.Path != "/users/~1" || normalized.RawQuery != "page=2" {
+		t.Errorf("Expected /users/~1?page=2, got %s", normalized)
+	}
+	if u.Path != "//users//~1/" {
+		t.Errorf("Expected the original URL untouched, got %s", u.Path)
+	}
+
+	u, _ = url.Parse("/files/a%2Fb/")
+	if normalized := urlpath.Normalize(u); normalized.Path != "/files/a/b" || normalized.EscapedPath() != "/files/a%2Fb" {
+		t.Errorf("Expected the escaped slash kept, got %s (%s)", normalized.EscapedPath(), normalized.Path)
+	}
+
+	u, _ = url.Parse("/users/1?page=2")
+	if urlpath.Normalize(u) != u {
+		t.Error("Expected a clean URL returned as is")
+	}
+
+	if got := urlpath.CleanPath("/users//1/"); got != "/users/1" {
+		t.Errorf("Expected a route path cleaned to /users/1, got %q", got)
+	}
+}
+
+// TestMatchNormalizedPath tests that path variants match the same route
+func TestMatchNormalizedPath(t *testing.T) {
+	m := matcher.New([]database.Route{
+		{ID: 1, Path: "/users/~me", Method: "GET", Enabled: true},
+		{ID: 2, Path: "/orders/", Method: "GET", Enabled: true},
+	})
+
+	for path, id := range map[string]int{
+		"/users/~me":        1,
+		"//users//%7eme/":   1,
+		"/users/%7Eme":      1,
+		"/orders":           2,
+		"/orders//":         2,
+		"/users/%2Fme":      0,
+		"/users/~me/orders": 0,
+	} {
+		escaped, _ := url.ParseRequestURI(path)
+		route, _ := m.Match("GET", "", urlpath.Normalize(escaped).Path)
+		switch {
+		case id == 0 && route != nil:
+			t.Errorf("Expected no route for %s, got %d", path, route.ID)
+		case id != 0 && (route == nil || route.ID != id):
+			t.Errorf("Expected route %d for %s, got %+v", id, path, route)
+		}
+	}
+}
+
+// TestNormalizedPathLabels tests that path variants share one metrics label
+func TestNormalizedPathLabels(t *testing.T) {
+	m := testMetrics()
+
+	router := chi.NewRouter()
+	router.Use(middleware.MetricsMiddleware(m, 100))
+	router.HandleFunc("/*", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, path := range []string{"/catalog/shoes", "/catalog/shoes/", "//catalog//shoes", "/catalog/%73hoes"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	paths := pathLabels(t, m, "GET")
+	if len(paths) != 1 || !paths["/catalog/shoes"] {
+		t.Errorf("Expected one normalized label, got %v", paths)
+	}
+}
+
+// TestPreservePath tests that rewrite routes forward the normalized path
+// unless they opt out
+func TestPreservePath(t *testing.T) {
+	db := testDatabase(t)
+	log := logger.Get()
+	m := testMetrics()
+	repo := database.NewRouteRepository(db)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	suffix := time.Now().UnixNano()
+	normalized := &database.Route{
+		Path:      fmt.Sprintf("/normalized-%d", suffix),
+		TargetURL: backend.URL,
+		Method:    "GET",
+		Enabled:   true,
+		Timeout:   30,
+		Type:      database.RouteTypeRewrite,
+		Rewrite:   &rewrite.Rule{Regex: `^/normalized-\d+(.*)$`, Replacement: "/v2$1"},
+	}
+	preserved := &database.Route{
+		Path:         fmt.Sprintf("/preserved-%d", suffix),
+		TargetURL:    backend.URL,
+		Method:       "GET",
+		Enabled:      true,
+		Timeout:      30,
+		Type:         database.RouteTypeRewrite,
+		Rewrite:      &rewrite.Rule{Regex: `^/preserved-\d+(.*)$`, Replacement: "/v2$1"},
+		PreservePath: true,
+	}
+	for _, route := range []*database.Route{normalized, preserved} {
+		if err := repo.Create(context.Background(), route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		defer repo.Delete(context.Background(), route.ID)
+	}
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	proxyHandler := handlers.NewProxyHandler(
+		db,
+		proxy.New(5*time.Second, &config.Load().Proxy, log),
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+
+	for name, tt := range map[string]struct {
+		path, want string
+	}{
+		"Normalized": {normalized.Path + "//?q=1", "/v2?q=1"},
+		"Preserved":  {preserved.Path + "//?q=1", "/v2//?q=1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			proxyHandler.Handle(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Errorf("Expected the upstream to get %s, got %d %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
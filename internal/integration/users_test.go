@@ -0,0 +1,175 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// userRouter serves the user management endpoints
+func userRouter(db *database.Database, minLength int) http.Handler {
+	userHandler := handlers.NewUserHandler(db, minLength, logger.Get())
+
+	router := chi.NewRouter()
+	router.Get("/api/users", userHandler.List)
+	router.Post("/api/users", userHandler.Create)
+	router.Put("/api/users/{id}", userHandler.Update)
+	router.Delete("/api/users/{id}", userHandler.Delete)
+	return router
+}
+
+// sendJSON sends a request with a JSON body to a handler
+func sendJSON(h http.Handler, method, target string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewReader(data)))
+	return w
+}
+
+// TestPasswordPolicy tests that weak passwords are rejected before reaching the database
+func TestPasswordPolicy(t *testing.T) {
+	if err := auth.ValidatePassword("short", 12); !errors.Is(err, auth.ErrPasswordTooShort) {
+		t.Errorf("Expected ErrPasswordTooShort, got %v", err)
+	}
+	if err := auth.ValidatePassword(strings.Repeat("x", 73), 12); !errors.Is(err, auth.ErrPasswordTooLong) {
+		t.Errorf("Expected ErrPasswordTooLong, got %v", err)
+	}
+	if err := auth.ValidatePassword("correct horse battery", 12); err != nil {
+		t.Errorf("Expected password to be accepted, got %v", err)
+	}
+
+	// Rejections must not need a database
+	db := database.NewDisconnected(closedDatabaseConfig(t), logger.Get(), nil)
+	router := userRouter(db, 12)
+
+	t.Run("Create", func(t *testing.T) {
+		w := sendJSON(router, "POST", "/api/users", map[string]interface{}{"username": "bob", "password": "hunter2"})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too short") {
+			t.Errorf("Expected policy rejection, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		w := sendJSON(router, "PUT", "/api/users/1", map[string]interface{}{"password": "hunter2"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("ChangePassword", func(t *testing.T) {
+		authHandler := handlers.NewAuthHandler(auth.NewAuthService("test-secret", logger.Get()), db, 12, logger.Get())
+
+		data, _ := json.Marshal(map[string]string{"old_password": "correct horse battery", "new_password": "hunter2"})
+		req := httptest.NewRequest("POST", "/api/auth/password", bytes.NewReader(data))
+		req = req.WithContext(auth.WithClaims(req.Context(), &auth.Claims{UserID: "1"}))
+
+		w := httptest.NewRecorder()
+		authHandler.ChangePassword(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("HashNeverSerialized", func(t *testing.T) {
+		data, _ := json.Marshal(database.User{Username: "bob", PasswordHash: "$2a$10$secret"})
+		if strings.Contains(string(data), "secret") || strings.Contains(string(data), "password") {
+			t.Errorf("Expected no password hash in %s", data)
+		}
+	})
+}
+
+// TestUserLastAdminGuard tests that the last enabled admin can't be removed
+func TestUserLastAdminGuard(t *testing.T) {
+	db := testDatabase(t)
+	repo := database.NewUserRepository(db)
+	ctx := context.Background()
+
+	// Start from an empty users table so the admin count is known
+	existing, err := repo.FindAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list users: %v", err)
+	}
+	for _, user := range existing {
+		repo.Delete(ctx, user.ID)
+	}
+
+	router := userRouter(db, 12)
+	password := "correct horse battery"
+	suffix := time.Now().UnixNano()
+
+	create := func(name string) int {
+		t.Helper()
+
+		w := sendJSON(router, "POST", "/api/users", map[string]interface{}{
+			"username": fmt.Sprintf("%s-%d", name, suffix),
+			"password": password,
+			"roles":    []string{"admin"},
+		})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Failed to create user: %d %s", w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "password") {
+			t.Errorf("Expected no password in response: %s", w.Body.String())
+		}
+
+		var resp struct {
+			Data database.User `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		t.Cleanup(func() { repo.Delete(ctx, resp.Data.ID) })
+		return resp.Data.ID
+	}
+
+	first := create("first-admin")
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		body   interface{}
+	}{
+		{"Delete", "DELETE", nil},
+		{"Demote", "PUT", map[string]interface{}{"roles": []string{"viewer"}}},
+		{"Disable", "PUT", map[string]interface{}{"enabled": false}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := sendJSON(router, tt.method, fmt.Sprintf("/api/users/%d", first), tt.body)
+			if w.Code != http.StatusConflict {
+				t.Errorf("Expected status 409, got %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("DemoteWithAnotherAdmin", func(t *testing.T) {
+		second := create("second-admin")
+
+		w := sendJSON(router, "PUT", fmt.Sprintf("/api/users/%d", first), map[string]interface{}{"roles": []string{"viewer"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d %s", w.Code, w.Body.String())
+		}
+
+		// The second admin is now the last one
+		if w := sendJSON(router, "DELETE", fmt.Sprintf("/api/users/%d", second), nil); w.Code != http.StatusConflict {
+			t.Errorf("Expected status 409, got %d", w.Code)
+		}
+	})
+
+	t.Run("ListHidesHashes", func(t *testing.T) {
+		w := sendJSON(router, "GET", "/api/users", nil)
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "password") {
+			t.Errorf("Expected users without password hashes, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
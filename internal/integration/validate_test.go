@@ -0,0 +1,153 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zakirkun/isekai/internal/core"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestValidateBrokenConfig tests that each broken setting is reported as a
+// problem, without anything being started
+func TestValidateBrokenConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		problem string
+	}{
+		{"Listen", map[string]string{"SERVER_LISTEN": "ftp://:21"}, "invalid SERVER_LISTEN"},
+		{"HalfTLS", map[string]string{"SERVER_TLS_CERT_FILE": "cert.pem"}, "SERVER_TLS_CERT_FILE and SERVER_TLS_KEY_FILE must be set together"},
+		{"IPAllow", map[string]string{"GATEWAY_IP_ALLOW": "10.0.0.0/33"}, "invalid gateway IP access list"},
+		{"StickyKey", map[string]string{"LB_STICKY_COOKIE": "backend"}, "LB_STICKY_KEY is required"},
+		{"DefaultSecret", map[string]string{"AUTH_ENABLED": "true", "JWT_SECRET": config.DefaultJWTSecret}, "JWT_SECRET must be changed"},
+		{"Sampler", map[string]string{"TRACING_ENABLED": "true", "TRACING_SAMPLER": "sometimes"}, "invalid TRACING_SAMPLER"},
+		{"ErrorPages", map[string]string{"GATEWAY_ERROR_PAGES_DIR": filepath.Join(t.TempDir(), "missing")}, "failed to load error pages"},
+		{"Discovery", map[string]string{"LB_DISCOVERY_TYPE": "kubernetes", "LB_DISCOVERY_SERVICE": "api", "KUBERNETES_SERVICE_HOST": ""}, "failed to initialize service discovery"},
+		{"AuthKeys", map[string]string{"AUTH_ENABLED": "true", "AUTH_ALG": "RS256"}, "failed to initialize auth"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			summary := core.Validate(context.Background(), config.Load(), false)
+			if summary.Valid {
+				t.Fatal("Expected the configuration to be invalid")
+			}
+			if len(summary.Problems) != 1 || !strings.Contains(summary.Problems[0], tt.problem) {
+				t.Errorf("Expected one problem containing %q, got %q", tt.problem, summary.Problems)
+			}
+		})
+	}
+
+	t.Run("AllProblems", func(t *testing.T) {
+		t.Setenv("SERVER_LISTEN", "ftp://:21, tcp://:9090")
+		t.Setenv("LB_STICKY_COOKIE", "backend")
+		t.Setenv("GATEWAY_MAX_CONCURRENT_REQUESTS", "-1")
+
+		summary := core.Validate(context.Background(), config.Load(), false)
+		if len(summary.Problems) != 3 {
+			t.Errorf("Expected 3 problems, got %q", summary.Problems)
+		}
+		if len(summary.Listeners) != 1 || summary.Listeners[0] != "tcp://:9090" {
+			t.Errorf("Expected the valid listener kept, got %v", summary.Listeners)
+		}
+	})
+
+	t.Run("NewV2", func(t *testing.T) {
+		t.Setenv("SERVER_LISTEN", "ftp://:21")
+		t.Setenv("LB_STICKY_COOKIE", "backend")
+
+		_, err := core.NewV2()
+		if err == nil || !strings.Contains(err.Error(), "invalid SERVER_LISTEN") || !strings.Contains(err.Error(), "LB_STICKY_KEY") {
+			t.Errorf("Expected NewV2 to refuse both problems, got %v", err)
+		}
+	})
+}
+
+// TestValidateSummary tests the summary of a valid configuration
+func TestValidateSummary(t *testing.T) {
+	t.Setenv("SERVER_LISTEN", "tcp://:9090, unix:///tmp/isekai.sock?admin=false")
+	t.Setenv("LB_BACKENDS", "http://a:80,http://b:80")
+	t.Setenv("AUTH_ENABLED", "false")
+	t.Setenv("COMPRESSION_ENABLED", "true")
+
+	summary := core.Validate(context.Background(), config.Load(), false)
+	if !summary.Valid || len(summary.Problems) != 0 {
+		t.Fatalf("Expected a valid configuration, got %q", summary.Problems)
+	}
+	if strings.Join(summary.Listeners, " ") != "tcp://:9090 unix:///tmp/isekai.sock?admin=false" {
+		t.Errorf("Unexpected listeners %v", summary.Listeners)
+	}
+	if summary.Backends != 2 || summary.Routes != nil || summary.Database != nil {
+		t.Errorf("Expected 2 backends and no routes or database checked, got %d %v %v", summary.Backends, summary.Routes, summary.Database)
+	}
+	if summary.Features["auth"] || !summary.Features["compression"] {
+		t.Errorf("Unexpected features %v", summary.Features)
+	}
+
+	// Unchecked routes are null rather than 0, and problems an empty list
+	encoded, _ := json.Marshal(summary)
+	for _, want := range []string{`"routes":null`, `"problems":[]`, `"valid":true`} {
+		if !strings.Contains(string(encoded), want) {
+			t.Errorf("Expected %s in %s", want, encoded)
+		}
+	}
+}
+
+// TestValidateDatabase tests the read-only database check against an
+// unreachable database and, when one is available, a migrated one
+func TestValidateDatabase(t *testing.T) {
+	t.Run("Unreachable", func(t *testing.T) {
+		t.Setenv("DB_HOST", "127.0.0.1")
+		t.Setenv("DB_PORT", closedDatabaseConfig(t).Port)
+
+		summary := core.Validate(context.Background(), config.Load(), true)
+		if summary.Valid || summary.Database == nil || summary.Database.Connected {
+			t.Fatalf("Expected the database reported unreachable, got %+v", summary.Database)
+		}
+		if len(summary.Problems) != 1 || !strings.Contains(summary.Problems[0], "failed to connect to the database") {
+			t.Errorf("Unexpected problems %q", summary.Problems)
+		}
+	})
+
+	cfg := config.Load()
+	cfg.Database.ConnectRetries = 0
+	db, err := database.New(&cfg.Database, logger.Get(), testMetrics())
+	if err != nil {
+		t.Skipf("Skipping integration test - database not available: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("Failed to initialize schema: %v", err)
+	}
+	routes, err := database.NewRouteRepository(db).FindAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to load routes: %v", err)
+	}
+
+	readOnly, err := database.NewReadOnly(&cfg.Database, logger.Get(), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect read-only: %v", err)
+	}
+	defer readOnly.Close()
+	if err := readOnly.InitSchema(ctx); err == nil {
+		t.Error("Expected a read-only connection to refuse changing the schema")
+	}
+	if pending, err := readOnly.CheckSchema(ctx); err != nil || len(pending) != 0 {
+		t.Errorf("Expected a migrated schema current, got %v %v", pending, err)
+	}
+
+	summary := core.Validate(ctx, cfg, true)
+	if !summary.Database.Connected || summary.Routes == nil || *summary.Routes != len(routes) {
+		t.Errorf("Expected %d routes checked, got %+v %v", len(routes), summary.Database, summary.Routes)
+	}
+}
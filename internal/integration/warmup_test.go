@@ -0,0 +1,184 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/loadbalancer"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/warmup"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// countingUpstream returns an upstream counting the connections opened to it
+func countingUpstream(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	conns := &atomic.Int64{}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("warm"))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream, conns
+}
+
+// TestWarmupRouteTable tests that the first request after warm-up is matched
+// in the in-memory route table and sent over a connection warm-up opened,
+// with the database down
+func TestWarmupRouteTable(t *testing.T) {
+	log := logger.Get()
+	upstream, conns := countingUpstream(t)
+
+	cacheInstance := cache.New(&config.Load().Cache, log, nil)
+	defer cacheInstance.Stop()
+	m := testMetrics()
+	p := proxy.New(5*time.Second, &config.Load().Proxy, log)
+	proxyHandler := handlers.NewProxyHandler(
+		database.NewDisconnected(closedDatabaseConfig(t), log, nil),
+		p,
+		cacheInstance,
+		circuitbreaker.New(log, m, nil),
+		loadbalancer.New(loadbalancer.RoundRobin, nil),
+		nil,
+		nil,
+		m,
+		log,
+	)
+	lookups := func(source string) float64 {
+		return testutil.ToFloat64(m.RouteLookups.WithLabelValues(source))
+	}
+
+	route := database.Route{ID: 1, Path: "/warm", TargetURL: upstream.URL, Method: "GET", Enabled: true, Type: database.RouteTypeProxy}
+	proxyHandler.SetRoutes([]database.Route{route}, time.Minute)
+	opened, err := p.Prewarm(context.Background(), upstream.URL+"/warm", 2, nil, false)
+	if err != nil || opened != 2 || conns.Load() != 2 {
+		t.Fatalf("Expected 2 connections opened, got %d (%d at the upstream), %v", opened, conns.Load(), err)
+	}
+
+	w := httptest.NewRecorder()
+	proxyHandler.Handle(w, httptest.NewRequest("GET", "/warm", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "warm" {
+		t.Fatalf("Expected the route served from the table, got %d %q", w.Code, w.Body.String())
+	}
+	if lookups("table") != 1 || lookups("database") != 0 {
+		t.Errorf("Expected one table lookup, got %v table and %v database", lookups("table"), lookups("database"))
+	}
+	if stats := p.Stats(); stats.ConnsCreated != 0 || stats.IdleConnsTaken != 1 || conns.Load() != 2 {
+		t.Errorf("Expected a warmed-up connection reused, got %+v and %d connections", stats, conns.Load())
+	}
+
+	for method, path := range map[string]string{"POST": "/warm", "GET": "/cold"} {
+		want := http.StatusNotFound
+		if method == "POST" {
+			want = http.StatusMethodNotAllowed
+		}
+		w := httptest.NewRecorder()
+		proxyHandler.Handle(w, httptest.NewRequest(method, path, nil))
+		if w.Code != want {
+			t.Errorf("Expected %d for %s %s, got %d", want, method, path, w.Code)
+		}
+	}
+
+	// Without the table lookups go back to the unavailable database
+	proxyHandler.InvalidateRoutes()
+	w = httptest.NewRecorder()
+	proxyHandler.Handle(w, httptest.NewRequest("GET", "/warm", nil))
+	if w.Code != http.StatusServiceUnavailable || lookups("database") != 1 {
+		t.Errorf("Expected a database lookup after invalidation, got %d and %v lookups", w.Code, lookups("database"))
+	}
+
+	proxyHandler.SetRoutes([]database.Route{route}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	w = httptest.NewRecorder()
+	proxyHandler.Handle(w, httptest.NewRequest("GET", "/warm", nil))
+	if w.Code != http.StatusServiceUnavailable || lookups("database") != 2 {
+		t.Errorf("Expected a database lookup once the table expired, got %d and %v lookups", w.Code, lookups("database"))
+	}
+
+	if _, err := proxyHandler.LoadRoutes(context.Background(), time.Minute); err == nil {
+		t.Errorf("Expected loading routes to fail with the database down")
+	}
+}
+
+// TestWarmupPrewarmUnreachable tests warming up an upstream nothing listens on
+func TestWarmupPrewarmUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	p := proxy.New(5*time.Second, &config.Load().Proxy, logger.Get())
+	if opened, err := p.Prewarm(context.Background(), "http://"+addr, 2, nil, false); err == nil || opened != 0 {
+		t.Errorf("Expected no connections to a closed port, got %d, %v", opened, err)
+	}
+}
+
+// TestWarmupRun tests that failing steps are recorded without stopping the
+// warm-up, and that a blocking warm-up holds readiness until it ends
+func TestWarmupRun(t *testing.T) {
+	m := testMetrics()
+	w := warmup.New(true)
+	if err := w.Check(context.Background()); !errors.Is(err, warmup.ErrWarmingUp) {
+		t.Fatalf("Expected readiness held while warming up, got %v", err)
+	}
+
+	ran := 0
+	results := w.Run(context.Background(), logger.Get(), m, []warmup.Step{
+		{Name: "routes", Run: func(context.Context) (int, error) {
+			ran++
+			return 0, errors.New("database unavailable")
+		}},
+		{Name: "connections", Run: func(context.Context) (int, error) {
+			ran++
+			return 2, nil
+		}},
+		{Name: "breakers", Run: func(context.Context) (int, error) {
+			ran++
+			return 0, nil
+		}},
+	})
+	if ran != 3 || len(results) != 3 || results[0].Err == nil || results[0].Failures != 1 {
+		t.Fatalf("Expected every step run despite the first failing, got %d runs and %+v", ran, results)
+	}
+	if err := w.Check(context.Background()); err != nil {
+		t.Errorf("Expected readiness once warmed up, got %v", err)
+	}
+	select {
+	case <-w.Done():
+	default:
+		t.Errorf("Expected the warm-up marked done")
+	}
+
+	for step, want := range map[string]float64{"routes": 1, "connections": 2, "breakers": 0} {
+		if got := testutil.ToFloat64(m.WarmupFailures.WithLabelValues(step)); got != want {
+			t.Errorf("Expected %v failures for %s, got %v", want, step, got)
+		}
+	}
+	if testutil.ToFloat64(m.WarmupDuration.WithLabelValues("total")) <= 0 {
+		t.Errorf("Expected the warm-up duration recorded")
+	}
+
+	if err := warmup.New(false).Check(context.Background()); err != nil {
+		t.Errorf("Expected a non-blocking warm-up not to hold readiness, got %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// startHub runs a hub and serves connections for the user named in the user query parameter
+func startHub(t *testing.T, cfg *config.WebSocketConfig) (*websocket.Hub, *httptest.Server) {
+	t.Helper()
+
+	hub := websocket.NewHub(cfg, logger.Get(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		websocket.ServeWS(hub, w, r, r.URL.Query().Get("user"))
+	}))
+	t.Cleanup(server.Close)
+
+	return hub, server
+}
+
+// dialHub opens a WebSocket connection to a test server
+func dialHub(t *testing.T, server *httptest.Server, query string) *gorilla.Conn {
+	t.Helper()
+
+	conn, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+query, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	return conn
+}
+
+// waitFor polls until cond holds or the test times out
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestWebSocketAuthentication tests token extraction and validation on upgrade
+func TestWebSocketAuthentication(t *testing.T) {
+	authService := auth.NewAuthService("test-secret", logger.Get())
+
+	valid, err := authService.GenerateToken("user-1", "alice", []string{"user"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	expired, err := authService.GenerateToken("user-1", "alice", []string{"user"}, -time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		wantErr error
+	}{
+		{"AuthorizationHeader", func() *http.Request {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.Header.Set("Authorization", "Bearer "+valid)
+			return r
+		}, nil},
+		{"Subprotocol", func() *http.Request {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.Header.Set("Sec-WebSocket-Protocol", auth.WebSocketProtocol+", "+valid)
+			return r
+		}, nil},
+		{"QueryParam", func() *http.Request {
+			return httptest.NewRequest("GET", "/ws?token="+valid, nil)
+		}, nil},
+		{"Missing", func() *http.Request {
+			return httptest.NewRequest("GET", "/ws", nil)
+		}, auth.ErrMissingToken},
+		{"Expired", func() *http.Request {
+			return httptest.NewRequest("GET", "/ws?token="+expired, nil)
+		}, auth.ErrExpiredToken},
+		{"Malformed", func() *http.Request {
+			return httptest.NewRequest("GET", "/ws?token=not-a-jwt", nil)
+		}, auth.ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := authService.AuthenticateWebSocket(tt.request())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr == nil && claims.UserID != "user-1" {
+				t.Errorf("Expected user-1, got %s", claims.UserID)
+			}
+		})
+	}
+}
+
+// TestWebSocketUserConnections tests multiple connections per user
+func TestWebSocketUserConnections(t *testing.T) {
+	hub, server := startHub(t, &config.Load().WebSocket)
+
+	first := dialHub(t, server, "?user=alice")
+	second := dialHub(t, server, "?user=alice")
+	dialHub(t, server, "?user=bob")
+
+	waitFor(t, func() bool { return hub.GetClientCount() == 3 })
+
+	counts := hub.GetUserConnectionCounts()
+	if counts["alice"] != 2 || counts["bob"] != 1 {
+		t.Errorf("Unexpected per-user counts: %v", counts)
+	}
+
+	delivered := hub.SendToUser("alice", websocket.Message{Type: "notice", Payload: "hello"})
+	if delivered != 2 {
+		t.Fatalf("Expected delivery to 2 connections, got %d", delivered)
+	}
+
+	for _, conn := range []*gorilla.Conn{first, second} {
+		var msg websocket.Message
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != "notice" {
+			t.Errorf("Expected notice, got %+v (%v)", msg, err)
+		}
+	}
+
+	// Closing one connection leaves the other registered
+	first.Close()
+	waitFor(t, func() bool { return hub.GetUserConnectionCounts()["alice"] == 1 })
+}
+
+// TestWebSocketOverflowPolicy tests how a client that stops reading is handled
+func TestWebSocketOverflowPolicy(t *testing.T) {
+	// Large payloads fill the socket buffers quickly so the write pump blocks
+	payload := strings.Repeat("x", 64*1024)
+	flood := func(hub *websocket.Hub) {
+		for i := 0; i < 300; i++ {
+			hub.Broadcast(websocket.Message{Type: "flood", Payload: payload})
+		}
+		hub.Broadcast(websocket.Message{Type: "last"})
+	}
+
+	t.Run("Disconnect", func(t *testing.T) {
+		hub, server := startHub(t, &config.WebSocketConfig{SendBufferSize: 1, OverflowPolicy: websocket.PolicyDisconnect})
+		dialHub(t, server, "?user=slow")
+		waitFor(t, func() bool { return hub.GetClientCount() == 1 })
+
+		flood(hub)
+		waitFor(t, func() bool { return hub.GetClientCount() == 0 })
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		hub, server := startHub(t, &config.WebSocketConfig{SendBufferSize: 1, OverflowPolicy: websocket.PolicyDropOldest})
+		conn := dialHub(t, server, "?user=slow")
+		waitFor(t, func() bool { return hub.GetClientCount() == 1 })
+
+		flood(hub)
+
+		// The newest message survives while older ones are dropped
+		conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+		for {
+			var msg websocket.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("Connection closed before the last message: %v", err)
+			}
+			if msg.Type == "last" {
+				break
+			}
+		}
+		if hub.GetClientCount() != 1 {
+			t.Error("Expected the slow client to stay connected")
+		}
+	})
+}
+
+// TestWebSocketChurn stresses registration and broadcast with clients coming and going
+func TestWebSocketChurn(t *testing.T) {
+	hub, server := startHub(t, &config.WebSocketConfig{SendBufferSize: 4, OverflowPolicy: websocket.PolicyDisconnect})
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(100 * time.Microsecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				hub.Broadcast(websocket.Message{Type: "tick"})
+				hub.SendToUser("user", websocket.Message{Type: "direct"})
+			}
+		}
+	}()
+	defer close(done)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, _, err := gorilla.DefaultDialer.Dial(url+"?user=user", nil)
+			if err != nil {
+				t.Errorf("Failed to connect: %v", err)
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			conn.ReadMessage()
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, func() bool { return hub.GetClientCount() == 0 })
+}
+
+// TestWebSocketLimits tests origin checks, frame size limits and per-IP connection limits
+func TestWebSocketLimits(t *testing.T) {
+	cfg := config.Load().WebSocket
+	cfg.AllowedOrigins = []string{"https://dashboard.example.com"}
+	cfg.ReadLimit = 1024
+	cfg.MaxConnectionsPerIP = 2
+
+	hub, server := startHub(t, &cfg)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	t.Run("DisallowedOrigin", func(t *testing.T) {
+		header := http.Header{"Origin": []string{"https://evil.example.com"}}
+		_, resp, err := gorilla.DefaultDialer.Dial(url, header)
+		if err == nil {
+			t.Fatal("Expected the upgrade to be rejected")
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %v", resp)
+		}
+	})
+
+	t.Run("AllowedOrigin", func(t *testing.T) {
+		header := http.Header{"Origin": []string{"https://Dashboard.example.com"}}
+		conn, _, err := gorilla.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatalf("Expected the upgrade to succeed: %v", err)
+		}
+		conn.Close()
+		waitFor(t, func() bool { return hub.GetClientCount() == 0 })
+	})
+
+	t.Run("OversizedFrame", func(t *testing.T) {
+		conn := dialHub(t, server, "")
+		err := conn.WriteJSON(websocket.Message{Type: "big", Payload: strings.Repeat("x", 4096)})
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+
+		_, _, err = conn.ReadMessage()
+		if !gorilla.IsCloseError(err, gorilla.CloseMessageTooBig) {
+			t.Errorf("Expected close code %d, got %v", gorilla.CloseMessageTooBig, err)
+		}
+		waitFor(t, func() bool { return hub.GetClientCount() == 0 })
+	})
+
+	t.Run("ConnectionsPerIP", func(t *testing.T) {
+		dialHub(t, server, "")
+		dialHub(t, server, "")
+
+		_, resp, err := gorilla.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			t.Fatal("Expected the third connection to be rejected")
+		}
+		if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("Expected status 429, got %v", resp)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package integration
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/schedule"
+	"github.com/zakirkun/isekai/internal/worker"
+)
+
+// TestWorkerGroupStop tests that Stop returns within the timeout with every worker exited
+func TestWorkerGroupStop(t *testing.T) {
+	group := worker.NewGroup()
+
+	var running, ticks atomic.Int64
+	for i := 0; i < 3; i++ {
+		running.Add(1)
+		s := schedule.New(schedule.Policy{Interval: time.Millisecond}, nil)
+
+		group.Go(func(ctx context.Context) {
+			defer running.Add(-1)
+			for {
+				select {
+				case <-s.After():
+					ticks.Add(1)
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	waitFor(t, func() bool { return ticks.Load() >= 3 })
+
+	start := time.Now()
+	if err := group.Stop(time.Second); err != nil {
+		t.Fatalf("Expected workers to stop, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected Stop to return before the timeout, took %s", elapsed)
+	}
+
+	// Every worker must have exited by the time Stop returns
+	if n := running.Load(); n != 0 {
+		t.Errorf("Expected all workers to have exited, %d still running", n)
+	}
+
+	t.Run("StuckWorker", func(t *testing.T) {
+		group := worker.NewGroup()
+		release := make(chan struct{})
+		defer close(release)
+
+		group.Go(func(ctx context.Context) { <-release })
+
+		start := time.Now()
+		if err := group.Stop(50 * time.Millisecond); err != worker.ErrStopTimeout {
+			t.Errorf("Expected ErrStopTimeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected Stop to give up after the timeout, took %s", elapsed)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/zakirkun/isekai/internal/websocket"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// TestWebSocketShutdown tests that shutdown tells clients when to reconnect,
+// closes them with a going away frame and refuses new connections
+func TestWebSocketShutdown(t *testing.T) {
+	cfg := config.Load().WebSocket
+	cfg.ReconnectDelay = 3 * time.Second
+	hub, server := startHub(t, &cfg)
+
+	conns := []*gorilla.Conn{dialHub(t, server, "?user=a"), dialHub(t, server, "?user=b")}
+	waitFor(t, func() bool { return hub.GetClientCount() == 2 })
+
+	done := make(chan struct{})
+	go func() {
+		hub.Shutdown(context.Background())
+		close(done)
+	}()
+
+	for _, conn := range conns {
+		msg := readMessage(t, conn)
+		var notice websocket.ShutdownNotice
+		json.Unmarshal(msg.Payload, &notice)
+		if msg.Type != websocket.MessageShutdown || notice.RetryAfter != 3 {
+			t.Errorf("Expected a shutdown notice with a retry hint, got %s %s", msg.Type, msg.Payload)
+		}
+
+		// Reading the close frame answers it, which acknowledges the close
+		_, _, err := conn.ReadMessage()
+		var closeErr *gorilla.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != gorilla.CloseGoingAway || closeErr.Text != websocket.ShutdownReason {
+			t.Errorf("Expected a going away close, got %v", err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(cfg.CloseTimeout):
+		t.Fatal("Expected shutdown to finish once clients acknowledged the close")
+	}
+	if n := hub.GetClientCount(); n != 0 {
+		t.Errorf("Expected no clients left, got %d", n)
+	}
+
+	_, resp, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?user=late", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected new connections refused with 503, got %v", err)
+	}
+}
+
+// TestWebSocketShutdownTimeout tests that shutdown drops clients that never
+// acknowledge the close once the close timeout passes
+func TestWebSocketShutdownTimeout(t *testing.T) {
+	cfg := config.Load().WebSocket
+	cfg.CloseTimeout = 200 * time.Millisecond
+	hub, server := startHub(t, &cfg)
+
+	// The client never reads, so it never answers the close frame
+	dialHub(t, server, "?user=silent")
+	waitFor(t, func() bool { return hub.GetClientCount() == 1 })
+
+	start := time.Now()
+	hub.Shutdown(context.Background())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected shutdown to give up after the close timeout, took %v", elapsed)
+	}
+	waitFor(t, func() bool { return hub.GetClientCount() == 0 })
+}
+
+// TestWebSocketUpgradeAfterHubStopped tests that an upgrade reaching a hub
+// that stopped running is closed as going away instead of waiting forever
+func TestWebSocketUpgradeAfterHubStopped(t *testing.T) {
+	cfg := config.Load().WebSocket
+	cfg.MaxConnectionsPerIP = 1
+	hub := websocket.NewHub(&cfg, logger.Get(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		hub.Run(ctx)
+		close(stopped)
+	}()
+	cancel()
+	<-stopped
+
+	served := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		websocket.ServeWS(hub, w, r, "late")
+		served <- struct{}{}
+	}))
+	defer server.Close()
+
+	// Both connections are taken and closed, so the IP's slot is given back
+	for i := 0; i < 2; i++ {
+		conn := dialHub(t, server, "")
+		_, _, err := conn.ReadMessage()
+		var closeErr *gorilla.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != gorilla.CloseGoingAway {
+			t.Errorf("Expected a going away close, got %v", err)
+		}
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the upgrade handler to return")
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Listener address schemes
+const (
+	SchemeTCP     = "tcp"
+	SchemeUnix    = "unix"
+	SchemeSystemd = "systemd"
+)
+
+// DefaultSocketMode is the permission of unix sockets that don't set one
+const DefaultSocketMode fs.FileMode = 0o660
+
+// ErrNotActivated is returned for systemd addresses when the process wasn't
+// started by socket activation
+var ErrNotActivated = errors.New("no sockets passed by systemd (LISTEN_FDS)")
+
+// Address is a parsed SERVER_LISTEN entry
+type Address struct {
+	Scheme string      // tcp, unix or systemd
+	Addr   string      // Host and port, socket path, or systemd socket name, empty for all of them
+	Mode   fs.FileMode // Permissions of a unix socket
+	Admin  bool        // Serves the management API and admin UI, not just proxied traffic
+}
+
+// String returns the address as it is configured
+func (a Address) String() string {
+	s := a.Scheme + "://" + a.Addr
+	if a.Scheme == SchemeUnix && a.Mode != DefaultSocketMode {
+		s += "?mode=" + strconv.FormatUint(uint64(a.Mode), 8)
+	}
+	if !a.Admin {
+		if strings.Contains(s, "?") {
+			s += "&admin=false"
+		} else {
+			s += "?admin=false"
+		}
+	}
+	return s
+}
+
+// Parse parses a listener address: tcp://host:port or a bare host:port,
+// unix:///path/to.sock with an optional octal ?mode=, or systemd:// for every
+// socket systemd passed and systemd://name for those named name. Any of them
+// may add ?admin=false to serve proxied traffic only.
+func Parse(s string) (Address, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "://") {
+		s = SchemeTCP + "://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return Address{}, fmt.Errorf("invalid listen address %q: %w", s, err)
+	}
+
+	addr := Address{Scheme: u.Scheme, Admin: true}
+	query := u.Query()
+	for key := range query {
+		if key != "admin" && !(key == "mode" && u.Scheme == SchemeUnix) {
+			return Address{}, fmt.Errorf("invalid listen address %q: unknown option %s", s, key)
+		}
+	}
+	if value := query.Get("admin"); value != "" {
+		if addr.Admin, err = strconv.ParseBool(value); err != nil {
+			return Address{}, fmt.Errorf("invalid listen address %q: admin must be true or false", s)
+		}
+	}
+
+	switch u.Scheme {
+	case SchemeTCP:
+		if u.Host == "" || u.Path != "" {
+			return Address{}, fmt.Errorf("invalid listen address %q: expected tcp://host:port", s)
+		}
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return Address{}, fmt.Errorf("invalid listen address %q: %w", s, err)
+		}
+		addr.Addr = u.Host
+	case SchemeUnix:
+		// unix://relative.sock parses the file as the host
+		addr.Addr = u.Host + u.Path
+		if addr.Addr == "" {
+			return Address{}, fmt.Errorf("invalid listen address %q: expected unix:///path/to.sock", s)
+		}
+		addr.Mode = DefaultSocketMode
+		if value := query.Get("mode"); value != "" {
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0o777 {
+				return Address{}, fmt.Errorf("invalid listen address %q: mode must be octal permissions such as 0660", s)
+			}
+			addr.Mode = fs.FileMode(mode)
+		}
+	case SchemeSystemd:
+		if u.Path != "" && u.Path != "/" {
+			return Address{}, fmt.Errorf("invalid listen address %q: expected systemd:// or systemd://name", s)
+		}
+		addr.Addr = u.Host
+	default:
+		return Address{}, fmt.Errorf("invalid listen address %q: scheme must be tcp, unix or systemd", s)
+	}
+	return addr, nil
+}
+
+// Listen opens the listeners of addr. A systemd address may return several
+// sockets.
+func Listen(addr Address) ([]net.Listener, error) {
+	switch addr.Scheme {
+	case SchemeUnix:
+		l, err := listenUnix(addr.Addr, addr.Mode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	case SchemeSystemd:
+		return activated(addr.Addr)
+	default:
+		l, err := net.Listen("tcp", addr.Addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+}
+
+// listenUnix listens on a unix socket at path with mode, first removing a
+// socket file left behind by a gateway that didn't shut down cleanly. The
+// socket file is removed again when the listener is closed.
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set permissions of %s: %w", path, err)
+	}
+	return &unixListener{Listener: l}, nil
+}
+
+// removeStale removes the socket file at path when nothing accepts
+// connections on it. Any other file, or a socket in use, is left alone.
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.MkdirAll(filepath.Dir(path), 0o755)
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to check socket %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// unixListener reports the peers of a unix socket as the loopback address,
+// which they are, so client IP checks, limits and logs treat them as local
+// clients rather than as having no address
+type unixListener struct {
+	net.Listener
+}
+
+var loopback = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &localConn{Conn: conn}, nil
+}
+
+type localConn struct {
+	net.Conn
+}
+
+func (c *localConn) RemoteAddr() net.Addr {
+	return loopback
+}
@@ -0,0 +1,104 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor systemd passes
+const listenFDsStart = 3
+
+// inheritedSocket is a socket passed by systemd, taken by at most one address
+type inheritedSocket struct {
+	name  string
+	file  *os.File
+	taken bool
+}
+
+var (
+	inheritOnce sync.Once
+	inheritMu   sync.Mutex
+	inherited   []*inheritedSocket
+)
+
+// inherit reads the sockets systemd passed through LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES, once, unsetting the variables so child processes don't
+// take them too
+func inherit() {
+	inheritOnce.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+
+		if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+			return
+		}
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count < 1 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+		for i := range count {
+			fd := listenFDsStart + i
+			syscall.CloseOnExec(fd)
+			name := "unknown"
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			inherited = append(inherited, &inheritedSocket{name: name, file: os.NewFile(uintptr(fd), name)})
+		}
+	})
+}
+
+// activated returns the listeners of the sockets systemd passed that are
+// named name, or all those not yet taken when name is empty
+func activated(name string) ([]net.Listener, error) {
+	inherit()
+
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	if len(inherited) == 0 {
+		return nil, ErrNotActivated
+	}
+
+	var listeners []net.Listener
+	for _, socket := range inherited {
+		if socket.taken || (name != "" && socket.name != name) {
+			continue
+		}
+		l, err := net.FileListener(socket.file)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %s isn't a stream socket: %w", socket.name, err)
+		}
+		if l.Addr().Network() == "unix" {
+			l = &unixListener{Listener: l}
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		if name == "" {
+			return nil, fmt.Errorf("every socket passed by systemd is already in use")
+		}
+		return nil, fmt.Errorf("no socket named %s passed by systemd (LISTEN_FDNAMES)", name)
+	}
+
+	for _, socket := range inherited {
+		if !socket.taken && (name == "" || socket.name == name) {
+			// The listener holds a duplicate of the descriptor
+			socket.taken = true
+			socket.file.Close()
+		}
+	}
+	return listeners, nil
+}
@@ -2,8 +2,13 @@ package loadbalancer
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/metrics"
 )
 
 // Strategy represents load balancing strategy
@@ -20,7 +25,10 @@ type Backend struct {
 	URL         string
 	Healthy     bool
 	Connections int32
+	Priority    int  // Tier of the backend; lower tiers take all traffic while any of their backends is available
+	draining    bool // Set while in-flight requests finish before removal
 	mu          sync.RWMutex
+	outlier     outlierState
 }
 
 // LoadBalancer manages backend servers
@@ -29,21 +37,36 @@ type LoadBalancer struct {
 	current  uint32
 	strategy Strategy
 	mu       sync.RWMutex
+	bus      *events.Bus
+	sticky   *StickyCookie
+	outlier  *OutlierPolicy
+	metrics  *metrics.Metrics
+	onRemove func(url string) // Called once a backend has left the pool
 }
 
 // New creates a new load balancer
-func New(strategy Strategy) *LoadBalancer {
+func New(strategy Strategy, bus *events.Bus) *LoadBalancer {
 	return &LoadBalancer{
 		backends: make([]*Backend, 0),
 		strategy: strategy,
+		bus:      bus,
 	}
 }
 
-// AddBackend adds a backend server
+// AddBackend adds a backend server. Adding a draining backend again keeps it.
 func (lb *LoadBalancer) AddBackend(url string) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
+	for _, backend := range lb.backends {
+		if backend.URL == url && backend.isDraining() {
+			backend.mu.Lock()
+			backend.draining = false
+			backend.mu.Unlock()
+			return
+		}
+	}
+
 	backend := &Backend{
 		URL:     url,
 		Healthy: true,
@@ -51,20 +74,125 @@ func (lb *LoadBalancer) AddBackend(url string) {
 	lb.backends = append(lb.backends, backend)
 }
 
-// RemoveBackend removes a backend server
-func (lb *LoadBalancer) RemoveBackend(url string) {
+// SetRemoveHook sets a function called with the URL of each backend once it
+// has left the pool, whether removed at once or after draining
+func (lb *LoadBalancer) SetRemoveHook(fn func(url string)) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
+	lb.onRemove = fn
+}
+
+// removed calls the remove hook for a backend that has left the pool
+func (lb *LoadBalancer) removed(url string) {
+	lb.mu.RLock()
+	onRemove := lb.onRemove
+	lb.mu.RUnlock()
+
+	if onRemove != nil {
+		onRemove(url)
+	}
+}
 
+// RemoveBackend removes a backend server at once, returning how many
+// requests were still in flight to it. Their results are no longer counted
+// against the backend. ok is false when the backend isn't in the pool.
+func (lb *LoadBalancer) RemoveBackend(url string) (inflight int32, ok bool) {
+	lb.mu.Lock()
 	for i, backend := range lb.backends {
 		if backend.URL == url {
 			lb.backends = append(lb.backends[:i], lb.backends[i+1:]...)
-			return
+			lb.mu.Unlock()
+			lb.removed(url)
+			return atomic.LoadInt32(&backend.Connections), true
 		}
 	}
+	lb.mu.Unlock()
+	return 0, false
 }
 
-// GetBackend returns the next backend based on strategy
+// DrainResult is how draining a backend ended
+type DrainResult struct {
+	Removed  bool  // False when the backend was added back while draining
+	Inflight int32 // Requests still in flight when it was removed, 0 unless the timeout passed
+}
+
+// DrainBackend stops sending new requests to a backend and removes it once
+// its in-flight requests have finished or timeout has passed. The result is
+// sent on the returned channel when the drain ends; the channel is nil when
+// the backend isn't in the pool.
+func (lb *LoadBalancer) DrainBackend(url string, timeout time.Duration) <-chan DrainResult {
+	lb.mu.RLock()
+	var target *Backend
+	for _, backend := range lb.backends {
+		if backend.URL == url {
+			target = backend
+			break
+		}
+	}
+	lb.mu.RUnlock()
+
+	if target == nil {
+		return nil
+	}
+	target.mu.Lock()
+	target.draining = true
+	target.mu.Unlock()
+
+	done := make(chan DrainResult, 1)
+	go func() {
+		deadline := time.Now().Add(timeout)
+		for atomic.LoadInt32(&target.Connections) > 0 && time.Now().Before(deadline) {
+			time.Sleep(drainPollInterval)
+		}
+		result := lb.removeDrained(target)
+		if result.Removed {
+			lb.removed(target.URL)
+		}
+		done <- result
+	}()
+	return done
+}
+
+// drainPollInterval is how often a draining backend's connections are checked
+const drainPollInterval = 100 * time.Millisecond
+
+// removeDrained removes backend unless it was added back while draining
+func (lb *LoadBalancer) removeDrained(target *Backend) DrainResult {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	target.mu.RLock()
+	draining := target.draining
+	target.mu.RUnlock()
+	if !draining {
+		return DrainResult{}
+	}
+
+	for i, backend := range lb.backends {
+		if backend == target {
+			lb.backends = append(lb.backends[:i], lb.backends[i+1:]...)
+			break
+		}
+	}
+	return DrainResult{Removed: true, Inflight: atomic.LoadInt32(&target.Connections)}
+}
+
+// Backends returns the URLs of the backends taking new requests
+func (lb *LoadBalancer) Backends() []string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	urls := make([]string, 0, len(lb.backends))
+	for _, backend := range lb.backends {
+		if !backend.isDraining() {
+			urls = append(urls, backend.URL)
+		}
+	}
+	return urls
+}
+
+// GetBackend returns the next backend based on strategy. Only the available
+// backends in the lowest priority tier that has any are considered.
 func (lb *LoadBalancer) GetBackend() (*Backend, error) {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
@@ -73,59 +201,155 @@ func (lb *LoadBalancer) GetBackend() (*Backend, error) {
 		return nil, fmt.Errorf("no backends available")
 	}
 
+	tier, ok := lb.activeTier(minPriority)
+	if !ok {
+		// Return first backend if none are healthy
+		return lb.backends[0], nil
+	}
+
+	var backend *Backend
 	switch lb.strategy {
-	case RoundRobin:
-		return lb.roundRobin(), nil
 	case LeastConn:
-		return lb.leastConn(), nil
+		backend = lb.leastConn(tier)
 	default:
-		return lb.roundRobin(), nil
+		backend = lb.roundRobin(tier, nil)
 	}
+	if backend == nil {
+		// The tier's last backend went down while choosing
+		return lb.backends[0], nil
+	}
+	return backend, nil
 }
 
-// roundRobin implements round-robin load balancing
-func (lb *LoadBalancer) roundRobin() *Backend {
-	// Find next healthy backend
+// minPriority is below every backend priority
+const minPriority = -1 << 31
+
+// activeTier returns the lowest priority above after that has an available backend
+func (lb *LoadBalancer) activeTier(after int) (int, bool) {
+	tier, found := 0, false
+	for _, backend := range lb.backends {
+		if backend.Priority > after && (!found || backend.Priority < tier) && backend.available() {
+			tier, found = backend.Priority, true
+		}
+	}
+	return tier, found
+}
+
+// roundRobin implements round-robin load balancing over the available
+// backends in tier other than exclude
+func (lb *LoadBalancer) roundRobin(tier int, exclude *Backend) *Backend {
 	attempts := len(lb.backends)
 	for i := 0; i < attempts; i++ {
 		idx := atomic.AddUint32(&lb.current, 1) % uint32(len(lb.backends))
 		backend := lb.backends[idx]
 
-		backend.mu.RLock()
-		healthy := backend.Healthy
-		backend.mu.RUnlock()
-
-		if healthy {
+		if backend != exclude && backend.Priority == tier && backend.available() {
 			return backend
 		}
 	}
-
-	// Return first backend if none are healthy
-	return lb.backends[0]
+	return nil
 }
 
-// leastConn implements least connections load balancing
-func (lb *LoadBalancer) leastConn() *Backend {
+// leastConn implements least connections load balancing over the available
+// backends in tier
+func (lb *LoadBalancer) leastConn(tier int) *Backend {
 	var selected *Backend
 	minConn := int32(1<<31 - 1)
 
 	for _, backend := range lb.backends {
-		backend.mu.RLock()
-		healthy := backend.Healthy
 		conn := atomic.LoadInt32(&backend.Connections)
-		backend.mu.RUnlock()
-
-		if healthy && conn < minConn {
+		if backend.Priority == tier && backend.available() && conn < minConn {
 			selected = backend
 			minConn = conn
 		}
 	}
 
-	if selected == nil {
-		return lb.backends[0]
+	return selected
+}
+
+// Alternate returns a healthy backend other than exclude, or nil when there
+// is none. Backends in lower priority tiers are preferred.
+func (lb *LoadBalancer) Alternate(exclude *Backend) *Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	for after := minPriority; ; {
+		tier, ok := lb.activeTier(after)
+		if !ok {
+			return nil
+		}
+		if backend := lb.roundRobin(tier, exclude); backend != nil {
+			return backend
+		}
+		after = tier
 	}
+}
 
-	return selected
+// Failover returns an available backend in the next priority tier after
+// failed's, or nil when no higher tier has one
+func (lb *LoadBalancer) Failover(failed *Backend) *Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	tier, ok := lb.activeTier(failed.Priority)
+	if !ok {
+		return nil
+	}
+	return lb.roundRobin(tier, nil)
+}
+
+// SetPriority moves a backend to another priority tier, taking effect for the
+// next request. It reports false when no backend has url.
+func (lb *LoadBalancer) SetPriority(url string, priority int) bool {
+	lb.mu.Lock()
+	var changed, found bool
+	for _, backend := range lb.backends {
+		if backend.URL == url {
+			changed, found = backend.Priority != priority, true
+			backend.Priority = priority
+			break
+		}
+	}
+	lb.mu.Unlock()
+
+	if changed {
+		lb.bus.Publish(events.BackendPriority, map[string]interface{}{"url": url, "priority": priority})
+	}
+	return found
+}
+
+// Tiers summarises the backends by priority, lowest first. The active tier
+// is the one taking new requests.
+func (lb *LoadBalancer) Tiers() []map[string]interface{} {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	active, ok := lb.activeTier(minPriority)
+	counts := make(map[int][2]int)
+	priorities := make([]int, 0)
+	for _, backend := range lb.backends {
+		count, seen := counts[backend.Priority]
+		if !seen {
+			priorities = append(priorities, backend.Priority)
+		}
+		count[1]++
+		if backend.available() {
+			count[0]++
+		}
+		counts[backend.Priority] = count
+	}
+	sort.Ints(priorities)
+
+	result := make([]map[string]interface{}, 0, len(priorities))
+	for _, priority := range priorities {
+		result = append(result, map[string]interface{}{
+			"priority": priority,
+			"healthy":  counts[priority][0],
+			"backends": counts[priority][1],
+			"active":   ok && priority == active,
+		})
+	}
+	return result
 }
 
 // MarkHealthy marks a backend as healthy
@@ -136,13 +360,50 @@ func (lb *LoadBalancer) MarkHealthy(url string, healthy bool) {
 	for _, backend := range lb.backends {
 		if backend.URL == url {
 			backend.mu.Lock()
+			changed := backend.Healthy != healthy
 			backend.Healthy = healthy
 			backend.mu.Unlock()
+
+			if changed {
+				eventType := events.BackendUnhealthy
+				if healthy {
+					eventType = events.BackendHealthy
+				}
+				lb.bus.Publish(eventType, map[string]string{"url": url})
+			}
 			return
 		}
 	}
 }
 
+// HealthyCount returns the number of healthy backends and the total number of backends
+func (lb *LoadBalancer) HealthyCount() (healthy, total int) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	for _, backend := range lb.backends {
+		if backend.available() {
+			healthy++
+		}
+	}
+
+	return healthy, len(lb.backends)
+}
+
+// available reports whether the backend is healthy and not draining
+func (b *Backend) available() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Healthy && !b.draining
+}
+
+// isDraining reports whether the backend is being drained
+func (b *Backend) isDraining() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.draining
+}
+
 // IncrementConnections increments connection count for a backend
 func (b *Backend) IncrementConnections() {
 	atomic.AddInt32(&b.Connections, 1)
@@ -158,14 +419,23 @@ func (lb *LoadBalancer) GetAllBackends() []map[string]interface{} {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 
+	now := time.Now()
 	result := make([]map[string]interface{}, 0, len(lb.backends))
 	for _, backend := range lb.backends {
 		backend.mu.RLock()
-		result = append(result, map[string]interface{}{
+		status := map[string]interface{}{
 			"url":         backend.URL,
 			"healthy":     backend.Healthy,
 			"connections": atomic.LoadInt32(&backend.Connections),
-		})
+			"ejections":   backend.outlier.ejections,
+			"ejected":     now.Before(backend.outlier.ejectedUntil),
+			"draining":    backend.draining,
+			"priority":    backend.Priority,
+		}
+		if now.Before(backend.outlier.ejectedUntil) {
+			status["ejected_until"] = backend.outlier.ejectedUntil
+		}
+		result = append(result, status)
 		backend.mu.RUnlock()
 	}
 
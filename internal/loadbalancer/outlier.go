@@ -0,0 +1,137 @@
+package loadbalancer
+
+import (
+	"time"
+
+	"github.com/zakirkun/isekai/internal/metrics"
+)
+
+// Outcome is the result of a proxied attempt against a backend
+type Outcome string
+
+const (
+	OutcomeSuccess      Outcome = "success"
+	OutcomeConnectError Outcome = "connect_error"
+	OutcomeServerError  Outcome = "5xx"
+	OutcomeTimeout      Outcome = "timeout"
+)
+
+// OutlierPolicy configures passive outlier detection. A backend is ejected
+// after ConsecutiveFailures failures in a row, or when at least FailurePercent
+// of MinRequests or more attempts within Window fail. A zero threshold
+// disables that check. Each ejection in a row doubles the cooldown, starting
+// at BaseEjection and capped at MaxEjection.
+type OutlierPolicy struct {
+	ConsecutiveFailures int
+	FailurePercent      int
+	MinRequests         int
+	Window              time.Duration
+	BaseEjection        time.Duration
+	MaxEjection         time.Duration
+}
+
+// outlierState tracks a backend's recent outcomes, guarded by the backend's mutex
+type outlierState struct {
+	consecutive  int
+	windowStart  time.Time
+	total        int
+	failures     int
+	streak       int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// SetOutlierDetection enables passive outlier detection. Nil disables it.
+func (lb *LoadBalancer) SetOutlierDetection(policy *OutlierPolicy, m *metrics.Metrics) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.outlier = policy
+	lb.metrics = m
+}
+
+// ReportResult records the outcome of an attempt against backend and ejects
+// the backend when it crosses the outlier thresholds. Ejected backends are
+// re-admitted automatically once their cooldown ends.
+func (lb *LoadBalancer) ReportResult(backend *Backend, outcome Outcome) {
+	lb.mu.RLock()
+	policy, m := lb.outlier, lb.metrics
+	lb.mu.RUnlock()
+
+	if policy == nil || backend == nil {
+		return
+	}
+
+	now := time.Now()
+	cooldown, eject := backend.record(policy, outcome, now)
+	if !eject {
+		return
+	}
+
+	if m != nil {
+		m.BackendEjections.WithLabelValues(backend.URL).Inc()
+	}
+	lb.MarkHealthy(backend.URL, false)
+
+	time.AfterFunc(cooldown, func() {
+		if backend.readmit(time.Now()) {
+			lb.MarkHealthy(backend.URL, true)
+		}
+	})
+}
+
+// record updates the outlier state with an outcome and reports whether the
+// backend must be ejected, and for how long
+func (b *Backend) record(policy *OutlierPolicy, outcome Outcome, now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &b.outlier
+	if now.Before(s.ejectedUntil) {
+		// Stragglers from before the ejection don't count
+		return 0, false
+	}
+
+	if policy.Window > 0 && now.Sub(s.windowStart) > policy.Window {
+		s.windowStart, s.total, s.failures = now, 0, 0
+	}
+	s.total++
+
+	if outcome == OutcomeSuccess {
+		s.consecutive = 0
+		return 0, false
+	}
+	s.consecutive++
+	s.failures++
+
+	tripped := policy.ConsecutiveFailures > 0 && s.consecutive >= policy.ConsecutiveFailures
+	if policy.FailurePercent > 0 && s.total >= policy.MinRequests && s.failures*100 >= policy.FailurePercent*s.total {
+		tripped = true
+	}
+	if !tripped {
+		return 0, false
+	}
+
+	// The cooldown keeps growing while the backend is ejected again soon after
+	// re-admission, and starts over once it has stayed healthy for MaxEjection
+	if !s.ejectedUntil.IsZero() && now.Sub(s.ejectedUntil) > policy.MaxEjection {
+		s.streak = 0
+	}
+	cooldown := policy.BaseEjection << s.streak
+	if cooldown > policy.MaxEjection || cooldown <= 0 {
+		cooldown = policy.MaxEjection
+	} else {
+		s.streak++
+	}
+
+	s.ejections++
+	s.ejectedUntil = now.Add(cooldown)
+	s.consecutive, s.windowStart, s.total, s.failures = 0, now, 0, 0
+	return cooldown, true
+}
+
+// readmit reports whether the backend's ejection has ended
+func (b *Backend) readmit(now time.Time) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return !now.Before(b.outlier.ejectedUntil)
+}
@@ -0,0 +1,133 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StickyCookie configures cookie-based session affinity. The cookie names the
+// chosen backend and is signed with Key so clients can't pick their own.
+type StickyCookie struct {
+	Name string
+	TTL  time.Duration
+	Key  []byte
+}
+
+// SetStickyCookie enables session affinity. Nil disables it.
+func (lb *LoadBalancer) SetStickyCookie(sticky *StickyCookie) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.sticky = sticky
+}
+
+// Select returns the backend for a request. A request carrying a valid sticky
+// cookie goes to its pinned backend while that backend is healthy and in the
+// active priority tier; otherwise the strategy picks one. pinned reports
+// whether the cookie was honoured.
+func (lb *LoadBalancer) Select(r *http.Request) (backend *Backend, pinned bool, err error) {
+	if backend := lb.pinnedBackend(r); backend != nil {
+		return backend, true, nil
+	}
+
+	backend, err = lb.GetBackend()
+	return backend, false, err
+}
+
+// Pin sets the sticky cookie for backend on the response. It does nothing
+// when session affinity is disabled.
+func (lb *LoadBalancer) Pin(w http.ResponseWriter, backend *Backend) {
+	lb.mu.RLock()
+	sticky := lb.sticky
+	lb.mu.RUnlock()
+
+	if sticky == nil {
+		return
+	}
+
+	expires := time.Now().Add(sticky.TTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sticky.Name,
+		Value:    sticky.sign(backend.URL, expires),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(sticky.TTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// pinnedBackend returns the healthy backend in the active tier named by a
+// valid sticky cookie
+func (lb *LoadBalancer) pinnedBackend(r *http.Request) *Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	if lb.sticky == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(lb.sticky.Name)
+	if err != nil {
+		return nil
+	}
+	url, ok := lb.sticky.verify(cookie.Value, time.Now())
+	if !ok {
+		return nil
+	}
+
+	for _, backend := range lb.backends {
+		if backend.URL != url {
+			continue
+		}
+
+		// Clients pinned to a fallback tier move back once a lower tier recovers
+		if tier, ok := lb.activeTier(minPriority); ok && backend.Priority == tier && backend.available() {
+			return backend
+		}
+		return nil
+	}
+	return nil
+}
+
+// sign encodes the backend URL and expiry with their signature
+func (s *StickyCookie) sign(url string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(url)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + s.signature(payload)
+}
+
+// verify returns the backend URL of an unexpired cookie value with a valid signature
+func (s *StickyCookie) verify(value string, now time.Time) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.signature(payload))) {
+		return "", false
+	}
+
+	encoded, expiry, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.Unix() >= unix {
+		return "", false
+	}
+	url, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(url), true
+}
+
+// signature returns the HMAC-SHA256 of payload
+func (s *StickyCookie) signature(payload string) string {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
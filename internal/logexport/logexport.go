@@ -0,0 +1,301 @@
+package logexport
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/stream"
+	"golang.org/x/time/rate"
+)
+
+// Format is an export's encoding
+type Format string
+
+// Export formats
+const (
+	CSV    Format = "csv"
+	NDJSON Format = "ndjson"
+)
+
+// ErrFormat is returned for formats other than CSV and NDJSON
+var ErrFormat = errors.New("format must be csv or ndjson")
+
+// Trailers set once the export ends
+const (
+	TrailerRows      = "X-Export-Rows"
+	TrailerTruncated = "X-Export-Truncated"
+)
+
+// flushRows and flushInterval bound how long exported rows sit in the buffer
+const (
+	flushRows     = 1000
+	flushInterval = time.Second
+	bufferSize    = 32 << 10
+)
+
+// columns are the CSV columns, in order. Recorded headers are only in NDJSON.
+var columns = []string{
+	"id", "created_at", "route_id", "method", "path", "status_code", "response_time",
+	"client_ip", "user_agent", "request_size", "response_size", "tenant_id", "country", "fault",
+}
+
+// Negotiate picks the format of an export: format, such as from ?format=,
+// when set, otherwise the first of CSV or NDJSON accept lists, CSV when it
+// lists neither
+func Negotiate(format, accept string) (Format, error) {
+	switch strings.ToLower(format) {
+	case "":
+	case "csv":
+		return CSV, nil
+	case "ndjson", "jsonl":
+		return NDJSON, nil
+	default:
+		return "", ErrFormat
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/csv":
+			return CSV, nil
+		case "application/x-ndjson", "application/ndjson", "application/jsonl":
+			return NDJSON, nil
+		}
+	}
+	return CSV, nil
+}
+
+// ContentType returns the media type of the format
+func (f Format) ContentType() string {
+	if f == NDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// Filename names an export of the logs from from until to, either of which
+// may be zero for an open range
+func Filename(f Format, from, to time.Time) string {
+	stamp := func(t time.Time, open string) string {
+		if t.IsZero() {
+			return open
+		}
+		return t.UTC().Format("20060102T150405Z")
+	}
+	return fmt.Sprintf("request-logs_%s_%s.%s", stamp(from, "start"), stamp(to, "now"), f)
+}
+
+// Writer encodes request logs in a format
+type Writer struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+// NewWriter creates a writer encoding logs to w. CSV exports start with a
+// header row.
+func NewWriter(w io.Writer, f Format) (*Writer, error) {
+	if f == NDJSON {
+		return &Writer{json: json.NewEncoder(w)}, nil
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return nil, err
+	}
+	return &Writer{csv: cw}, nil
+}
+
+// Write encodes log
+func (w *Writer) Write(log *database.RequestLog) error {
+	if w.json != nil {
+		return w.json.Encode(log)
+	}
+
+	routeID := ""
+	if log.RouteID != nil {
+		routeID = strconv.Itoa(*log.RouteID)
+	}
+	return w.csv.Write([]string{
+		strconv.Itoa(log.ID),
+		log.CreatedAt.UTC().Format(time.RFC3339Nano),
+		routeID,
+		log.Method,
+		log.Path,
+		strconv.Itoa(log.StatusCode),
+		strconv.Itoa(log.ResponseTime),
+		log.ClientIP,
+		log.UserAgent,
+		strconv.FormatInt(log.RequestSize, 10),
+		strconv.FormatInt(log.ResponseSize, 10),
+		log.TenantID,
+		log.Country,
+		log.Fault,
+	})
+}
+
+// Flush writes out the rows the CSV encoder buffers
+func (w *Writer) Flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		return w.csv.Error()
+	}
+	return nil
+}
+
+// Source calls fn with each log to export, in order, until fn fails
+type Source func(ctx context.Context, fn func(*database.RequestLog) error) error
+
+// Options configure an export
+type Options struct {
+	Format   Format
+	Filename string
+	MaxRows  int // Rows exported at most. The source should yield one more so the export knows it was cut short.
+	Rate     int // Bytes per second, 0 for no limit
+}
+
+// errTruncated stops the source once MaxRows are exported
+var errTruncated = errors.New("export reached its row cap")
+
+// Export streams the logs of source to w as they arrive, flushing them at
+// least every flushRows rows or flushInterval, so the export is never held in
+// memory and the client gets its first rows while the rest are still being
+// read. The row count and whether MaxRows cut the export short are sent as
+// trailers. It returns the rows exported and whether the response started,
+// after which a failure can only abort it.
+func Export(ctx context.Context, w http.ResponseWriter, source Source, opts Options) (int, bool, error) {
+	header := w.Header()
+	header.Set("Content-Type", opts.Format.ContentType())
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": opts.Filename}))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "no-store")
+	header.Set("Trailer", TrailerRows+", "+TrailerTruncated)
+
+	// An export runs as long as the client keeps reading, past the
+	// request timeout and the server's write timeout
+	stream.Lift(ctx)
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	out := &startWriter{w: w}
+	var throttledOut io.Writer = out
+	if opts.Rate > 0 {
+		throttledOut = newThrottled(ctx, out, opts.Rate)
+	}
+	buf := bufio.NewWriterSize(throttledOut, bufferSize)
+	flush := func() error {
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	fail := func(rows int, err error) (int, bool, error) {
+		if !out.started {
+			// Leave the response to the caller's error
+			for _, key := range []string{"Content-Type", "Content-Disposition", "X-Content-Type-Options", "Cache-Control", "Trailer"} {
+				header.Del(key)
+			}
+		}
+		return rows, out.started, err
+	}
+
+	// The CSV header row is held back with the first row, so a source
+	// failing before it can still be answered with an error
+	enc, err := NewWriter(buf, opts.Format)
+	if err != nil {
+		return fail(0, err)
+	}
+
+	rows, truncated := 0, false
+	lastFlush := time.Now()
+	err = source(ctx, func(log *database.RequestLog) error {
+		if rows == opts.MaxRows {
+			truncated = true
+			return errTruncated
+		}
+		if err := enc.Write(log); err != nil {
+			return err
+		}
+		rows++
+		if rows == 1 || rows%flushRows == 0 || time.Since(lastFlush) >= flushInterval {
+			lastFlush = time.Now()
+			if err := enc.Flush(); err != nil {
+				return err
+			}
+			return flush()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errTruncated) {
+		return fail(rows, err)
+	}
+	if err := enc.Flush(); err != nil {
+		return fail(rows, err)
+	}
+	if err := buf.Flush(); err != nil {
+		return fail(rows, err)
+	}
+	if !out.started {
+		// Nothing matched an NDJSON export: send the empty body
+		if err := rc.Flush(); err != nil {
+			return fail(rows, err)
+		}
+	}
+
+	header.Set(TrailerRows, strconv.Itoa(rows))
+	header.Set(TrailerTruncated, strconv.FormatBool(truncated))
+	return rows, true, nil
+}
+
+// startWriter records whether the response started
+type startWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
+
+// throttled caps the bytes per second written to w
+type throttled struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func newThrottled(ctx context.Context, w io.Writer, perSecond int) *throttled {
+	return &throttled{ctx: ctx, w: w, limiter: rate.NewLimiter(rate.Limit(perSecond), min(perSecond, bufferSize))}
+}
+
+// Write writes p in pieces no larger than the limiter's burst, waiting for
+// each
+func (t *throttled) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), t.limiter.Burst())
+		if err := t.limiter.WaitN(t.ctx, n); err != nil {
+			return written, err
+		}
+		n, err := t.w.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,232 @@
+package matcher
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/urlpath"
+)
+
+// How a route's path, host or method matches requests
+const (
+	MatchExact    = "exact"     // The same value
+	MatchWildcard = "wildcard"  // A *.example.com host covering subdomains
+	MatchAny      = "any"       // No host, or the * method
+	MatchCatchAll = "catch_all" // The same path, and paths under it no route matches
+)
+
+// Entry is a route in the compiled table with how each part of it matches
+type Entry struct {
+	ID          int    `json:"id"`
+	Method      string `json:"method"`
+	Host        string `json:"host"`
+	Path        string `json:"path"`
+	Enabled     bool   `json:"enabled"`
+	Type        string `json:"type"`
+	TargetURL   string `json:"target_url"`
+	PathMatch   string `json:"path_match"`
+	HostMatch   string `json:"host_match"`
+	MethodMatch string `json:"method_match"`
+}
+
+// Candidate is a route for the request's path and why it was picked or not
+type Candidate struct {
+	Entry
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason"`
+}
+
+// Explanation is the outcome of matching a request with the routes
+// considered on the way
+type Explanation struct {
+	Route      *database.Route `json:"route,omitempty"`
+	Status     int             `json:"status"`              // 200 when a route matched, otherwise 404 or 405
+	Allowed    []string        `json:"allowed,omitempty"`   // Methods served at the host and path when 405
+	CatchAll   string          `json:"catch_all,omitempty"` // Prefix whose catch-all routes answered, when the path had no route
+	Candidates []Candidate     `json:"candidates"`
+}
+
+// newEntry describes route's match types
+func newEntry(route *database.Route) Entry {
+	host := database.NormalizeHost(route.Host)
+	entry := Entry{
+		ID:          route.ID,
+		Method:      route.Method,
+		Host:        host,
+		Path:        route.Path,
+		Enabled:     route.Enabled,
+		Type:        route.Type,
+		TargetURL:   route.TargetURL,
+		PathMatch:   MatchExact,
+		HostMatch:   MatchExact,
+		MethodMatch: MatchExact,
+	}
+	if entry.Type == "" {
+		entry.Type = database.RouteTypeProxy
+	}
+	switch {
+	case host == "":
+		entry.HostMatch = MatchAny
+	case strings.HasPrefix(host, "*."):
+		entry.HostMatch = MatchWildcard
+	}
+	if route.Method == database.MethodAny {
+		entry.MethodMatch = MatchAny
+	}
+	if route.CatchAll {
+		entry.PathMatch = MatchCatchAll
+	}
+	return entry
+}
+
+// compare orders entries by path, host, method and ID
+func compare(a, b Entry) int {
+	return cmp.Or(
+		cmp.Compare(a.Path, b.Path),
+		cmp.Compare(a.Host, b.Host),
+		cmp.Compare(a.Method, b.Method),
+		cmp.Compare(a.ID, b.ID),
+	)
+}
+
+// Table lists every route, disabled ones included, sorted by path, host and
+// method
+func (m *Matcher) Table() []Entry {
+	entries := make([]Entry, 0, len(m.all))
+	for i := range m.all {
+		entries = append(entries, newEntry(&m.all[i]))
+	}
+	slices.SortFunc(entries, compare)
+	return entries
+}
+
+// Explain matches a request like Match does and says why each route for the
+// path, and each catch-all route for a prefix it is under, was picked or
+// passed over
+func (m *Matcher) Explain(method, host, path string) *Explanation {
+	path = urlpath.CleanPath(path)
+	hosts := m.routes[path]
+	pattern, _ := database.MatchHostPattern(hosts, host)
+	methods := hosts[pattern]
+	matched, ok := database.MatchMethod(methods, method)
+
+	explanation := &Explanation{Status: http.StatusNotFound, Candidates: []Candidate{}}
+	switch {
+	case ok:
+		explanation.Route = matched
+		explanation.Status = http.StatusOK
+	case len(methods) > 0:
+		explanation.Status = http.StatusMethodNotAllowed
+		explanation.Allowed = database.AllowedMethods(methods)
+	}
+
+	// Without a route for the path, the longest prefix with catch-all routes
+	// for the host answers
+	pathAnswered := explanation.Status != http.StatusNotFound
+	var catchAll *database.Route
+	var catchAllPattern string
+	if !pathAnswered {
+		route, prefix, err := database.MatchCatchAll(m.catchAlls, host, path, method)
+		var notAllowed *database.MethodNotAllowedError
+		switch {
+		case err == nil:
+			catchAll = route
+			explanation.Route = route
+			explanation.Status = http.StatusOK
+		case errors.As(err, &notAllowed):
+			explanation.Status = http.StatusMethodNotAllowed
+			explanation.Allowed = notAllowed.Allowed
+		}
+		explanation.CatchAll = prefix
+		catchAllPattern, _ = database.MatchHostPattern(m.catchAlls[prefix], host)
+	}
+
+	parents := urlpath.Parents(path)
+	for i := range m.all {
+		route := &m.all[i]
+		routePath := urlpath.CleanPath(route.Path)
+		candidate := Candidate{Entry: newEntry(route)}
+		switch {
+		case routePath == path:
+			candidate.Matched = route == matched
+			candidate.Reason = reason(candidate.Entry, candidate.Matched, matched, method, host, pattern)
+		case route.CatchAll && slices.Contains(parents, routePath):
+			candidate.Matched = route == catchAll
+			candidate.Reason = catchAllReason(candidate.Entry, candidate.Matched, catchAll, method, host, path, explanation.CatchAll, catchAllPattern, pathAnswered)
+		default:
+			continue
+		}
+		explanation.Candidates = append(explanation.Candidates, candidate)
+	}
+	slices.SortFunc(explanation.Candidates, func(a, b Candidate) int {
+		return compare(a.Entry, b.Entry)
+	})
+
+	return explanation
+}
+
+// reason says why entry was picked for a request or passed over. pattern is
+// the host of the routes the request's host resolved to.
+func reason(entry Entry, picked bool, matched *database.Route, method, host, pattern string) string {
+	if picked {
+		return fmt.Sprintf("matched: %s path, %s host, %s method", MatchExact, entry.HostMatch, methodMatch(entry, method))
+	}
+
+	switch {
+	case !entry.Enabled:
+		return "route is disabled"
+	case !database.HostCovers(entry.Host, host):
+		return fmt.Sprintf("host %s does not match %q", displayHost(entry.Host), host)
+	case entry.Host != pattern:
+		return fmt.Sprintf("host %q is matched more specifically by %s", host, displayHost(pattern))
+	case entry.Method != method && entry.Method != database.MethodAny && !(entry.Method == http.MethodGet && method == http.MethodHead):
+		return fmt.Sprintf("method %s does not match %s", entry.Method, method)
+	case matched != nil:
+		return fmt.Sprintf("method %s is matched more specifically by route %d (%s)", method, matched.ID, matched.Method)
+	}
+	return "not matched"
+}
+
+// catchAllReason says why the catch-all entry for a prefix of path was
+// picked or passed over. prefix is the one whose catch-all routes the
+// request resolved to, and pattern the host of those routes. They are only
+// considered when the path's own routes didn't answer.
+func catchAllReason(entry Entry, picked bool, matched *database.Route, method, host, path, prefix, pattern string, pathAnswered bool) string {
+	if picked {
+		return fmt.Sprintf("matched: catch-all for %s, no route for %s, %s host, %s method", entry.Path, path, entry.HostMatch, methodMatch(entry, method))
+	}
+
+	switch {
+	case !entry.Enabled:
+		return "route is disabled"
+	case pathAnswered:
+		return fmt.Sprintf("path %s has its own routes", path)
+	case !database.HostCovers(entry.Host, host):
+		return fmt.Sprintf("host %s does not match %q", displayHost(entry.Host), host)
+	case urlpath.CleanPath(entry.Path) != prefix:
+		return fmt.Sprintf("catch-all for %s is more specific", prefix)
+	}
+	return reason(entry, false, matched, method, host, pattern)
+}
+
+// methodMatch describes how a picked entry's method matched the request's
+func methodMatch(entry Entry, method string) string {
+	if entry.Method == http.MethodGet && method == http.MethodHead {
+		return "GET serving HEAD"
+	}
+	return entry.MethodMatch
+}
+
+// displayHost names the empty host pattern in reasons
+func displayHost(host string) string {
+	if host == "" {
+		return "any host"
+	}
+	return strconv.Quote(host)
+}
@@ -0,0 +1,100 @@
+package matcher
+
+import (
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/urlpath"
+)
+
+// Matcher resolves requests against an in-memory route table using the
+// same rules as RouteRepository.FindByPath
+type Matcher struct {
+	routes    map[string]map[string]map[string]*database.Route // Path, then host, then method
+	catchAlls map[string]map[string]map[string]*database.Route // Catch-all routes, the same way
+	all       []database.Route                                 // Every route, disabled ones included, for explanations
+}
+
+// New creates a matcher from a set of routes. Disabled routes are ignored.
+func New(routes []database.Route) *Matcher {
+	m := &Matcher{
+		routes:    make(map[string]map[string]map[string]*database.Route),
+		catchAlls: make(map[string]map[string]map[string]*database.Route),
+		all:       routes,
+	}
+
+	for i := range routes {
+		route := &routes[i]
+		if !route.Enabled {
+			continue
+		}
+
+		add(m.routes, route)
+		if route.CatchAll {
+			add(m.catchAlls, route)
+		}
+	}
+
+	return m
+}
+
+// add puts route in a table by its path, host and method
+func add(table map[string]map[string]map[string]*database.Route, route *database.Route) {
+	path := urlpath.CleanPath(route.Path)
+	hosts, exists := table[path]
+	if !exists {
+		hosts = make(map[string]map[string]*database.Route)
+		table[path] = hosts
+	}
+	host := database.NormalizeHost(route.Host)
+	methods, exists := hosts[host]
+	if !exists {
+		methods = make(map[string]*database.Route)
+		hosts[host] = methods
+	}
+	methods[route.Method] = route
+}
+
+// Match returns the route serving the given method and path for the request
+// host, normalizing the path as the proxy does
+func (m *Matcher) Match(method, host, path string) (*database.Route, bool) {
+	route, _, err := m.lookup(method, host, path)
+	return route, err == nil
+}
+
+// Find is Match with the errors of RouteRepository.FindByPath:
+// pgx.ErrNoRows when no route has the path, a *database.MethodNotAllowedError
+// when none of its routes serves the method. The route is a copy the caller
+// may change.
+func (m *Matcher) Find(method, host, path string) (*database.Route, error) {
+	route, _, err := m.lookup(method, host, path)
+	if err != nil {
+		return nil, err
+	}
+	found := *route
+	return &found, nil
+}
+
+// lookup matches a request by its path, then when the path has no route for
+// the host by the catch-all routes of the prefixes it is under, returning
+// the prefix of the catch-all that answered
+func (m *Matcher) lookup(method, host, path string) (*database.Route, string, error) {
+	path = urlpath.CleanPath(path)
+	methods, _ := database.MatchHost(m.routes[path], host)
+	if route, ok := database.MatchMethod(methods, method); ok {
+		return route, "", nil
+	}
+	if len(methods) > 0 {
+		return nil, "", &database.MethodNotAllowedError{Allowed: database.AllowedMethods(methods)}
+	}
+	return database.MatchCatchAll(m.catchAlls, host, path, method)
+}
+
+// Size returns the number of routes in the table
+func (m *Matcher) Size() int {
+	count := 0
+	for _, hosts := range m.routes {
+		for _, methods := range hosts {
+			count += len(methods)
+		}
+	}
+	return count
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PoolStats is a snapshot of the database connection pool
+type PoolStats struct {
+	AcquiredConns        int32         `json:"acquired_conns"`
+	IdleConns            int32         `json:"idle_conns"`
+	TotalConns           int32         `json:"total_conns"`
+	MaxConns             int32         `json:"max_conns"`
+	ConstructingConns    int32         `json:"constructing_conns"`
+	NewConns             int64         `json:"new_conns"`
+	AcquireCount         int64         `json:"acquire_count"`
+	EmptyAcquireCount    int64         `json:"empty_acquire_count"`
+	CanceledAcquireCount int64         `json:"canceled_acquire_count"`
+	AcquireDuration      time.Duration `json:"acquire_duration_ns"`
+}
+
+// CacheStats is a snapshot of the in-memory cache
+type CacheStats struct {
+	Size      int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64         // Items removed to make room
+	Expired   uint64         // Items removed after their TTL
+	Patterns  map[string]int // Items by key pattern, e.g. route for route:42
+}
+
+// Collector periodically exports the statistics that components keep
+// themselves. Their cumulative counts are turned into counter increments.
+type Collector struct {
+	m        *Metrics
+	interval time.Duration
+	pool     func() (PoolStats, bool)
+	cache    func() CacheStats
+
+	mu        sync.Mutex
+	lastPool  PoolStats
+	lastCache CacheStats
+}
+
+// NewCollector creates a collector exporting to m every interval
+func NewCollector(m *Metrics, interval time.Duration) *Collector {
+	return &Collector{m: m, interval: interval}
+}
+
+// WatchPool exports the database pool statistics returned by fn, which
+// reports false while there is no pool
+func (c *Collector) WatchPool(fn func() (PoolStats, bool)) {
+	c.pool = fn
+}
+
+// WatchCache exports the cache statistics returned by fn
+func (c *Collector) WatchCache(fn func() CacheStats) {
+	c.cache = fn
+}
+
+// Run collects every interval until ctx is done. A zero interval disables it.
+func (c *Collector) Run(ctx context.Context) {
+	if c.interval <= 0 {
+		return
+	}
+	c.Collect()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Collect()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Collect exports the current statistics once
+func (c *Collector) Collect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pool != nil {
+		if stats, ok := c.pool(); ok {
+			c.recordPool(stats)
+		}
+	}
+	if c.cache != nil {
+		c.recordCache(c.cache())
+	}
+}
+
+// recordPool sets the pool gauges and advances the pool counters
+func (c *Collector) recordPool(stats PoolStats) {
+	c.m.DBPoolAcquired.Set(float64(stats.AcquiredConns))
+	c.m.DBPoolIdle.Set(float64(stats.IdleConns))
+	c.m.DBPoolTotal.Set(float64(stats.TotalConns))
+	c.m.DBPoolMax.Set(float64(stats.MaxConns))
+	c.m.DBPoolConstructing.Set(float64(stats.ConstructingConns))
+
+	last := c.lastPool
+	c.m.DBPoolNewConns.Add(delta(stats.NewConns, last.NewConns))
+	c.m.DBPoolAcquires.Add(delta(stats.AcquireCount, last.AcquireCount))
+	c.m.DBPoolEmptyAcquires.Add(delta(stats.EmptyAcquireCount, last.EmptyAcquireCount))
+	c.m.DBPoolCanceledAcquires.Add(delta(stats.CanceledAcquireCount, last.CanceledAcquireCount))
+	c.m.DBPoolAcquireDuration.Add(time.Duration(delta(int64(stats.AcquireDuration), int64(last.AcquireDuration))).Seconds())
+	c.lastPool = stats
+}
+
+// recordCache sets the cache size and advances the cache counters
+func (c *Collector) recordCache(stats CacheStats) {
+	c.m.CacheSize.Set(float64(stats.Size))
+
+	last := c.lastCache
+	c.m.CacheHits.Add(delta(stats.Hits, last.Hits))
+	c.m.CacheMisses.Add(delta(stats.Misses, last.Misses))
+	c.m.CacheEvictions.WithLabelValues("capacity").Add(delta(stats.Evictions, last.Evictions))
+	c.m.CacheEvictions.WithLabelValues("expired").Add(delta(stats.Expired, last.Expired))
+
+	for pattern, count := range stats.Patterns {
+		c.m.CacheKeys.WithLabelValues(pattern).Set(float64(count))
+	}
+	for pattern := range last.Patterns {
+		if _, ok := stats.Patterns[pattern]; !ok {
+			c.m.CacheKeys.WithLabelValues(pattern).Set(0)
+		}
+	}
+	c.lastCache = stats
+}
+
+// delta returns the increase of a cumulative count since the last
+// collection. A count below the last one was reset, e.g. by a reconnect.
+func delta[T int64 | uint64](current, last T) float64 {
+	if current < last {
+		return float64(current)
+	}
+	return float64(current - last)
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OtherPath is the label used once the distinct path limit is reached
+const OtherPath = "/other"
+
+type routeLabelKey struct{}
+
+// routeLabel is a mutable holder so handlers deep in the chain can report the
+// route they matched, and any fault injected into the request, back to the
+// metrics middleware
+type routeLabel struct {
+	mu    sync.Mutex
+	path  string
+	fault string
+}
+
+// WithRouteLabel returns a context that can carry the matched route path
+func WithRouteLabel(ctx context.Context) context.Context {
+	return context.WithValue(ctx, routeLabelKey{}, &routeLabel{})
+}
+
+// SetRouteLabel records the matched route path for the current request. It is
+// a no-op when the context was not prepared with WithRouteLabel.
+func SetRouteLabel(ctx context.Context, path string) {
+	if label, ok := ctx.Value(routeLabelKey{}).(*routeLabel); ok {
+		label.mu.Lock()
+		label.path = path
+		label.mu.Unlock()
+	}
+}
+
+// RouteLabel returns the route path recorded for the current request
+func RouteLabel(ctx context.Context) string {
+	if label, ok := ctx.Value(routeLabelKey{}).(*routeLabel); ok {
+		label.mu.Lock()
+		defer label.mu.Unlock()
+		return label.path
+	}
+	return ""
+}
+
+// SetFaultLabel records the fault injected into the current request so it can
+// be told apart from real traffic
+func SetFaultLabel(ctx context.Context, fault string) {
+	if label, ok := ctx.Value(routeLabelKey{}).(*routeLabel); ok {
+		label.mu.Lock()
+		label.fault = fault
+		label.mu.Unlock()
+	}
+}
+
+// FaultLabel returns the fault recorded for the current request, empty for none
+func FaultLabel(ctx context.Context) string {
+	if label, ok := ctx.Value(routeLabelKey{}).(*routeLabel); ok {
+		label.mu.Lock()
+		defer label.mu.Unlock()
+		return label.fault
+	}
+	return ""
+}
+
+// PathGuard bounds the number of distinct path label values
+type PathGuard struct {
+	mu        sync.Mutex
+	seen      map[string]struct{}
+	max       int
+	other     string
+	collapsed prometheus.Counter
+}
+
+// NewPathGuard creates a guard allowing at most max distinct paths. Paths seen
+// after the limit is reached are collapsed to OtherPath and counted.
+func NewPathGuard(max int, collapsed prometheus.Counter) *PathGuard {
+	return NewLabelGuard(max, OtherPath, collapsed)
+}
+
+// NewLabelGuard creates a guard allowing at most max distinct values of any
+// label, collapsing the rest to other
+func NewLabelGuard(max int, other string, collapsed prometheus.Counter) *PathGuard {
+	return &PathGuard{
+		seen:      make(map[string]struct{}),
+		max:       max,
+		other:     other,
+		collapsed: collapsed,
+	}
+}
+
+// Label returns the label value to use for a path
+func (g *PathGuard) Label(path string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.seen[path]; ok {
+		return path
+	}
+	if len(g.seen) < g.max {
+		g.seen[path] = struct{}{}
+		return path
+	}
+
+	if g.collapsed != nil {
+		g.collapsed.Inc()
+	}
+	return g.other
+}
+
+// NormalizePath replaces path segments that look like identifiers (numbers,
+// UUIDs and long hex strings) with ":id"
+func NormalizePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isIdentifier(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isIdentifier reports whether a path segment looks like a generated identifier
+func isIdentifier(segment string) bool {
+	if segment == "" {
+		return false
+	}
+
+	digits := true
+	for _, c := range segment {
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F', c == '-':
+			digits = false
+		default:
+			return false
+		}
+	}
+
+	return digits || len(segment) >= 16
+}
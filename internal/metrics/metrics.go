@@ -1,66 +1,164 @@
 package metrics
 
 import (
+	"net/http"
+	"strconv"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zakirkun/isekai/pkg/version"
 )
 
+// sizeBuckets spans body sizes from 64 bytes to 64 MiB
+var sizeBuckets = prometheus.ExponentialBuckets(64, 4, 11)
+
 // Metrics holds all Prometheus metrics
 type Metrics struct {
-	RequestsTotal       *prometheus.CounterVec
-	RequestDuration     *prometheus.HistogramVec
-	ActiveConnections   prometheus.Gauge
-	CacheHits           prometheus.Counter
-	CacheMisses         prometheus.Counter
-	ProxyErrors         *prometheus.CounterVec
-	DatabaseQueries     *prometheus.HistogramVec
-	CircuitBreakerState *prometheus.GaugeVec
+	RequestsTotal        *prometheus.CounterVec
+	RequestDuration      *prometheus.HistogramVec
+	RequestSize          *prometheus.HistogramVec
+	ResponseSize         *prometheus.HistogramVec
+	ActiveConnections    prometheus.Gauge
+	CacheHits            prometheus.Counter
+	CacheMisses          prometheus.Counter
+	ProxyErrors          *prometheus.CounterVec
+	DatabaseQueries      *prometheus.HistogramVec
+	DatabaseQueryErrors  *prometheus.CounterVec
+	CircuitBreakerState  *prometheus.GaugeVec
+	WorkerInterval       *prometheus.GaugeVec
+	WorkerFailures       *prometheus.GaugeVec
+	WebSocketDropped     *prometheus.CounterVec
+	WebSocketRejected    *prometheus.CounterVec
+	CollapsedPaths       prometheus.Counter
+	UpstreamDuration     *prometheus.HistogramVec
+	UpstreamRequests     *prometheus.CounterVec
+	UpstreamInflight     *prometheus.GaugeVec
+	ACLBlocked           *prometheus.CounterVec
+	MirrorRequests       *prometheus.CounterVec
+	MirrorDuration       *prometheus.HistogramVec
+	CanaryRequests       *prometheus.CounterVec
+	BackendEjections     *prometheus.CounterVec
+	MaintenanceResponses *prometheus.CounterVec
+	MockResponses        *prometheus.CounterVec
+	Redirects            *prometheus.CounterVec
+	CountryRequests      *prometheus.CounterVec
+	ChaosFaults          *prometheus.CounterVec
+	IdempotentRequests   *prometheus.CounterVec
+	DedupRequests        *prometheus.CounterVec
+	HedgedRequests       *prometheus.CounterVec
+	Failovers            *prometheus.CounterVec
+	DNSLookupDuration    *prometheus.HistogramVec
+	DNSLookupFailures    *prometheus.CounterVec
+	DNSCacheResults      *prometheus.CounterVec
+	RequestQueueDepth    *prometheus.GaugeVec
+	ConcurrencyRejected  *prometheus.CounterVec
+	UpstreamQueueDepth   *prometheus.GaugeVec
+	UpstreamThrottled    *prometheus.CounterVec
+	DeadlineRejected     *prometheus.CounterVec
+	TenantRequests       *prometheus.CounterVec
+	TenantTransferBytes  *prometheus.CounterVec
+	TagRequests          *prometheus.CounterVec
+	TagRequestDuration   *prometheus.HistogramVec
+	AccessLogDropped     prometheus.Counter
+	BuildInfo            *prometheus.GaugeVec
+	RouteLookups         *prometheus.CounterVec
+	WarmupDuration       *prometheus.GaugeVec
+	WarmupFailures       *prometheus.GaugeVec
+	Panics               *prometheus.CounterVec
+	BufferedBytes        prometheus.Gauge
+	BufferingSkipped     *prometheus.CounterVec
+
+	// Exported by the Collector from the pool's and cache's own statistics
+	DBPoolAcquired         prometheus.Gauge
+	DBPoolIdle             prometheus.Gauge
+	DBPoolTotal            prometheus.Gauge
+	DBPoolMax              prometheus.Gauge
+	DBPoolConstructing     prometheus.Gauge
+	DBPoolNewConns         prometheus.Counter
+	DBPoolAcquires         prometheus.Counter
+	DBPoolEmptyAcquires    prometheus.Counter
+	DBPoolCanceledAcquires prometheus.Counter
+	DBPoolAcquireDuration  prometheus.Counter
+	CacheSize              prometheus.Gauge
+	CacheEvictions         *prometheus.CounterVec
+	CacheKeys              *prometheus.GaugeVec
+
+	registry *prometheus.Registry
+	handler  http.Handler
 }
 
-// New creates a new metrics instance
+// New creates a new metrics instance with its own registry
 func New() *Metrics {
-	return &Metrics{
-		RequestsTotal: promauto.NewCounterVec(
+	return NewWithRegistry(prometheus.NewRegistry())
+}
+
+// NewWithRegistry creates a new metrics instance registered with reg. Each
+// registry can hold one instance.
+func NewWithRegistry(reg *prometheus.Registry) *Metrics {
+	factory := promauto.With(reg)
+	m := &Metrics{
+		registry: reg,
+		handler:  promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{})),
+
+		RequestsTotal: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "isekai_http_requests_total",
-				Help: "Total number of HTTP requests",
+				Help: "Total number of HTTP requests, with the injected fault if any",
 			},
-			[]string{"method", "path", "status"},
+			[]string{"method", "path", "status", "fault"},
 		),
-		RequestDuration: promauto.NewHistogramVec(
+		RequestDuration: factory.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Name:    "isekai_http_request_duration_seconds",
-				Help:    "HTTP request duration in seconds",
+				Help:    "HTTP request duration in seconds, with the injected fault if any",
 				Buckets: prometheus.DefBuckets,
 			},
-			[]string{"method", "path"},
+			[]string{"method", "path", "fault"},
+		),
+		RequestSize: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "isekai_http_request_size_bytes",
+				Help:    "Request body bytes read from clients of a route",
+				Buckets: sizeBuckets,
+			},
+			[]string{"route"},
+		),
+		ResponseSize: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "isekai_http_response_size_bytes",
+				Help:    "Response body bytes written to clients of a route",
+				Buckets: sizeBuckets,
+			},
+			[]string{"route"},
 		),
-		ActiveConnections: promauto.NewGauge(
+		ActiveConnections: factory.NewGauge(
 			prometheus.GaugeOpts{
 				Name: "isekai_active_connections",
 				Help: "Number of active connections",
 			},
 		),
-		CacheHits: promauto.NewCounter(
+		CacheHits: factory.NewCounter(
 			prometheus.CounterOpts{
 				Name: "isekai_cache_hits_total",
 				Help: "Total number of cache hits",
 			},
 		),
-		CacheMisses: promauto.NewCounter(
+		CacheMisses: factory.NewCounter(
 			prometheus.CounterOpts{
 				Name: "isekai_cache_misses_total",
 				Help: "Total number of cache misses",
 			},
 		),
-		ProxyErrors: promauto.NewCounterVec(
+		ProxyErrors: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "isekai_proxy_errors_total",
 				Help: "Total number of proxy errors",
 			},
 			[]string{"target", "error_type"},
 		),
-		DatabaseQueries: promauto.NewHistogramVec(
+		DatabaseQueries: factory.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Name:    "isekai_database_query_duration_seconds",
 				Help:    "Database query duration in seconds",
@@ -68,12 +166,424 @@ func New() *Metrics {
 			},
 			[]string{"query_type"},
 		),
-		CircuitBreakerState: promauto.NewGaugeVec(
+		DatabaseQueryErrors: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_database_query_errors_total",
+				Help: "Total number of failed database queries by reason (canceled, timeout or error)",
+			},
+			[]string{"reason"},
+		),
+		CircuitBreakerState: factory.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "isekai_circuit_breaker_state",
 				Help: "Circuit breaker state (0=closed, 1=half-open, 2=open)",
 			},
-			[]string{"target"},
+			[]string{"route", "backend"},
+		),
+		WorkerInterval: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "isekai_worker_interval_seconds",
+				Help: "Current interval of a background worker including jitter and backoff",
+			},
+			[]string{"worker"},
+		),
+		WorkerFailures: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "isekai_worker_consecutive_failures",
+				Help: "Consecutive failures of a background worker driving its backoff",
+			},
+			[]string{"worker"},
+		),
+		WebSocketDropped: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_websocket_dropped_messages_total",
+				Help: "Total number of WebSocket messages dropped because a client's buffer was full",
+			},
+			[]string{"policy"},
+		),
+		WebSocketRejected: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_websocket_rejections_total",
+				Help: "Total number of WebSocket connections, frames or topic subscriptions rejected by limits and origin checks",
+			},
+			[]string{"reason"},
+		),
+		CollapsedPaths: factory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "isekai_metrics_collapsed_paths_total",
+				Help: "Total number of requests whose path label was collapsed to /other by the cardinality guard",
+			},
+		),
+		UpstreamDuration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "isekai_upstream_request_duration_seconds",
+				Help:    "Upstream request duration in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"route", "target"},
+		),
+		UpstreamRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_upstream_requests_total",
+				Help: "Total number of proxied upstream requests",
+			},
+			[]string{"route", "status_class"},
+		),
+		UpstreamInflight: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "isekai_upstream_inflight_requests",
+				Help: "Number of upstream requests currently in flight",
+			},
+			[]string{"route"},
+		),
+		ACLBlocked: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_acl_blocked_requests_total",
+				Help: "Total number of requests blocked by IP allow and deny lists",
+			},
+			[]string{"scope", "reason"},
+		),
+		MirrorRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_mirror_requests_total",
+				Help: "Total number of mirrored requests by route and result (status class, error, dropped or too_large)",
+			},
+			[]string{"route", "result"},
+		),
+		MirrorDuration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "isekai_mirror_request_duration_seconds",
+				Help:    "Mirror target request duration in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"route"},
 		),
+		CanaryRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_canary_requests_total",
+				Help: "Total number of requests on canary routes by variant and status class",
+			},
+			[]string{"route", "variant", "status"},
+		),
+		BackendEjections: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_backend_ejections_total",
+				Help: "Total number of times a load balancer backend was ejected by outlier detection",
+			},
+			[]string{"backend"},
+		),
+		MaintenanceResponses: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_maintenance_responses_total",
+				Help: "Total number of requests answered by a route's maintenance response instead of its upstream",
+			},
+			[]string{"route"},
+		),
+		MockResponses: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_mock_responses_total",
+				Help: "Total number of requests answered by a mock or echo route, by route and type",
+			},
+			[]string{"route", "type"},
+		),
+		Redirects: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_redirects_total",
+				Help: "Total number of requests answered by a redirect route, by route and status",
+			},
+			[]string{"route", "status"},
+		),
+		CountryRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_country_requests_total",
+				Help: "Total number of requests by client country, when GeoIP metrics labels are enabled",
+			},
+			[]string{"country"},
+		),
+		ChaosFaults: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_chaos_faults_total",
+				Help: "Total number of faults injected into requests, by route and fault",
+			},
+			[]string{"route", "fault"},
+		),
+		IdempotentRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_idempotent_requests_total",
+				Help: "Total number of requests carrying an Idempotency-Key on idempotent routes by result",
+			},
+			[]string{"route", "result"},
+		),
+		DedupRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_dedup_requests_total",
+				Help: "Total number of requests on routes with deduplication by result",
+			},
+			[]string{"route", "result"},
+		),
+		HedgedRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_hedged_requests_total",
+				Help: "Total number of hedged requests by the attempt that answered, or capped when the hedge was skipped",
+			},
+			[]string{"route", "result"},
+		),
+		Failovers: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_failovers_total",
+				Help: "Total number of requests sent on to a higher priority tier after the backend tried failed",
+			},
+			[]string{"route"},
+		),
+		DNSLookupDuration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "isekai_dns_lookup_duration_seconds",
+				Help:    "Upstream hostname lookup duration in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"host"},
+		),
+		DNSLookupFailures: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_dns_lookup_failures_total",
+				Help: "Total number of failed upstream hostname lookups",
+			},
+			[]string{"host"},
+		),
+		DNSCacheResults: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_dns_cache_results_total",
+				Help: "Total number of upstream hostname resolutions through the DNS cache by result",
+			},
+			[]string{"result"},
+		),
+		RequestQueueDepth: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "isekai_request_queue_depth",
+				Help: "Number of requests waiting for a concurrency slot, by gateway or route",
+			},
+			[]string{"scope"},
+		),
+		ConcurrencyRejected: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_concurrency_rejected_total",
+				Help: "Total number of requests turned away by a concurrency limit, by gateway or route and reason",
+			},
+			[]string{"scope", "reason"},
+		),
+		UpstreamQueueDepth: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "isekai_upstream_queue_depth",
+				Help: "Number of requests waiting for a route's upstream rate limit",
+			},
+			[]string{"route"},
+		),
+		UpstreamThrottled: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_upstream_throttled_total",
+				Help: "Total number of upstream attempts held back by a route's upstream rate limit, by reason",
+			},
+			[]string{"route", "reason"},
+		),
+		DeadlineRejected: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_deadline_rejected_total",
+				Help: "Total number of requests refused for having less latency budget left than PROXY_DEADLINE_FLOOR",
+			},
+			[]string{"route"},
+		),
+		TenantRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_tenant_requests_total",
+				Help: "Total number of requests to a tenant's routes, by status",
+			},
+			[]string{"tenant", "status"},
+		),
+		TenantTransferBytes: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_tenant_transfer_bytes_total",
+				Help: "Total body bytes read from and written to clients of a tenant's routes, by direction",
+			},
+			[]string{"tenant", "direction"},
+		),
+		TagRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_tag_requests_total",
+				Help: "Total number of requests to routes by their metrics tag, by status class",
+			},
+			[]string{"tag", "status"},
+		),
+		TagRequestDuration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "isekai_tag_request_duration_seconds",
+				Help:    "Duration in seconds of requests to routes by their metrics tag",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"tag"},
+		),
+		AccessLogDropped: factory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "isekai_access_log_dropped_total",
+				Help: "Total number of access log entries dropped because the write queue was full",
+			},
+		),
+		BuildInfo: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "isekai_build_info",
+				Help: "Build information of the running gateway, always 1",
+			},
+			[]string{"version", "commit", "build_date", "go_version"},
+		),
+		RouteLookups: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_route_lookups_total",
+				Help: "Total number of proxied requests' route lookups by source: the in-memory route table or the database",
+			},
+			[]string{"source"},
+		),
+		WarmupDuration: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "isekai_warmup_duration_seconds",
+				Help: "Time each step of the startup warm-up took, and the whole warm-up as step total",
+			},
+			[]string{"step"},
+		),
+		WarmupFailures: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "isekai_warmup_failures",
+				Help: "Failures of each step of the startup warm-up, such as backends that couldn't be connected to",
+			},
+			[]string{"step"},
+		),
+		Panics: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_panics_total",
+				Help: "Total number of panics recovered while serving requests, by the route pattern of the handler",
+			},
+			[]string{"handler"},
+		),
+		BufferedBytes: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "isekai_buffered_bytes",
+				Help: "Bytes of request and response bodies currently buffered whole by the transform, cache and mirror features",
+			},
+		),
+		BufferingSkipped: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_buffering_skipped_total",
+				Help: "Total number of bodies passed through without a feature buffering them, by feature and reason (too_large or watermark)",
+			},
+			[]string{"feature", "reason"},
+		),
+		DBPoolAcquired: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "isekai_db_pool_acquired_connections",
+				Help: "Database connections currently in use",
+			},
+		),
+		DBPoolIdle: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "isekai_db_pool_idle_connections",
+				Help: "Idle database connections in the pool",
+			},
+		),
+		DBPoolTotal: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "isekai_db_pool_total_connections",
+				Help: "Database connections in the pool, including ones being established",
+			},
+		),
+		DBPoolMax: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "isekai_db_pool_max_connections",
+				Help: "Maximum size of the database connection pool",
+			},
+		),
+		DBPoolConstructing: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "isekai_db_pool_constructing_connections",
+				Help: "Database connections currently being established",
+			},
+		),
+		DBPoolNewConns: factory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "isekai_db_pool_new_connections_total",
+				Help: "Total number of database connections opened by the pool",
+			},
+		),
+		DBPoolAcquires: factory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "isekai_db_pool_acquires_total",
+				Help: "Total number of connections acquired from the pool",
+			},
+		),
+		DBPoolEmptyAcquires: factory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "isekai_db_pool_empty_acquires_total",
+				Help: "Total number of acquires that waited because no idle connection was available",
+			},
+		),
+		DBPoolCanceledAcquires: factory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "isekai_db_pool_canceled_acquires_total",
+				Help: "Total number of acquires cancelled before a connection was available",
+			},
+		),
+		DBPoolAcquireDuration: factory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "isekai_db_pool_acquire_duration_seconds_total",
+				Help: "Total time spent acquiring connections from the pool",
+			},
+		),
+		CacheSize: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "isekai_cache_size",
+				Help: "Number of items in the cache",
+			},
+		),
+		CacheEvictions: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "isekai_cache_evictions_total",
+				Help: "Total number of cache items removed to make room (capacity) or after their TTL (expired)",
+			},
+			[]string{"reason"},
+		),
+		CacheKeys: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "isekai_cache_keys",
+				Help: "Number of cache items by key pattern, the part of the key before its first colon",
+			},
+			[]string{"pattern"},
+		),
+	}
+
+	info := version.Get()
+	m.BuildInfo.WithLabelValues(info.Version, info.Commit, info.BuildDate, info.GoVersion).Set(1)
+	return m
+}
+
+// RegisterRuntimeCollectors also exports the Go runtime and process metrics
+func (m *Metrics) RegisterRuntimeCollectors() {
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Registry returns the registry the metrics are registered with
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the registered metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return m.handler
+}
+
+// StatusClass returns the status class label ("2xx", "5xx", ...) for a status code
+func StatusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "unknown"
 	}
+	return strconv.Itoa(statusCode/100) + "xx"
 }
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// IPFilter middleware rejects clients outside the allow list or inside the deny list
+func IPFilter(list *acl.List, m *metrics.Metrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if allowed, reason := list.CheckRequest(r); !allowed {
+				if m != nil {
+					m.ACLBlocked.WithLabelValues("global", reason).Inc()
+				}
+				response.ErrorFor(w, r, http.StatusForbidden, response.CodeAccessDenied, "Access denied")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zakirkun/isekai/internal/compress"
+	"github.com/zakirkun/isekai/internal/etag"
+	"github.com/zakirkun/isekai/pkg/config"
+)
+
+// Compress compresses responses with the first of cfg.Encodings the client
+// accepts at its highest q-value. Responses already encoded, by the upstream
+// or a handler, are passed through as they are, as are those of other media
+// types, smaller than cfg.MinSize or marked no-transform. Compressible
+// responses vary on Accept-Encoding whether or not they were compressed.
+// Upgrades, event streams and HEAD requests aren't wrapped.
+func Compress(cfg *config.CompressionConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				cfg:            cfg,
+				encoding:       compress.Negotiate(r.Header.Get("Accept-Encoding"), cfg.Encodings),
+			}
+			defer cw.finish()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressWriter holds the response header back until the body shows
+// whether to compress it, buffering up to the minimum size
+type compressWriter struct {
+	http.ResponseWriter
+	cfg      *config.CompressionConfig
+	encoding string // Negotiated with the client, empty when it accepts none
+
+	status  int  // Final status the handler wrote, 0 until it does
+	decided bool // The header has been written, compressed or not
+	buf     []byte
+	enc     compress.Writer // nil unless compressing
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	// Informational responses go out as they come; 101 hands the
+	// connection over uncompressed
+	if code < http.StatusOK {
+		cw.decided = code == http.StatusSwitchingProtocols
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	cw.status = code
+	// Without a Content-Type the body is sniffed first, as net/http would
+	if cw.Header().Get("Content-Type") == "" {
+		return
+	}
+	eligible := cw.eligible()
+	switch {
+	case !eligible || cw.encoding == "":
+		cw.start(false, eligible)
+	case cw.knownLength() >= cw.cfg.MinSize:
+		cw.start(true, eligible)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 && !cw.decided {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) >= cw.cfg.MinSize {
+			cw.decide(true)
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// FlushError sends what was written so far. A response flushed before it
+// reaches the minimum size is streamed, and compressed if eligible.
+func (cw *compressWriter) FlushError() error {
+	if cw.status == 0 && !cw.decided {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer for deadlines and connection upgrades
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// finish writes a response still held back and ends the compressed stream
+func (cw *compressWriter) finish() {
+	if !cw.decided && cw.status != 0 {
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+	}
+}
+
+// decide writes the header held back, compressing when the response is
+// eligible and either large enough or streamed
+func (cw *compressWriter) decide(streaming bool) {
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	eligible := cw.eligible()
+	cw.start(eligible && cw.encoding != "" && (streaming || (len(cw.buf) > 0 && len(cw.buf) >= cw.cfg.MinSize)), eligible)
+}
+
+// start writes the header, compressed or not, followed by the buffered body.
+// Eligible responses vary on Accept-Encoding either way.
+func (cw *compressWriter) start(compressed, eligible bool) {
+	cw.decided = true
+	h := cw.Header()
+	if eligible {
+		addVary(h, "Accept-Encoding")
+	}
+	if compressed {
+		enc, err := compress.NewWriter(cw.encoding, cw.ResponseWriter)
+		if err == nil {
+			cw.enc = enc
+			h.Set("Content-Encoding", cw.encoding)
+			h.Del("Content-Length")
+			// Ranges of the unencoded body don't apply to the encoded one
+			h.Del("Accept-Ranges")
+			// The encoded body differs byte for byte from the one tagged
+			if tag := h.Get("ETag"); tag != "" {
+				h.Set("ETag", etag.Weak(tag))
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if len(cw.buf) > 0 {
+		buf := cw.buf
+		cw.buf = nil
+		if cw.enc != nil {
+			cw.enc.Write(buf)
+		} else {
+			cw.ResponseWriter.Write(buf)
+		}
+	}
+}
+
+// eligible reports whether the status and headers allow compressing the
+// response, leaving its size aside
+func (cw *compressWriter) eligible() bool {
+	h := cw.Header()
+	switch cw.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if length := cw.knownLength(); length >= 0 && length < cw.cfg.MinSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	for _, t := range cw.cfg.ContentTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownLength returns the Content-Length the handler set, or -1
+func (cw *compressWriter) knownLength() int {
+	length, err := strconv.Atoi(cw.Header().Get("Content-Length"))
+	if err != nil {
+		return -1
+	}
+	return length
+}
+
+// addVary adds name to the Vary header unless it is already listed
+func addVary(h http.Header, name string) {
+	for _, value := range h.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			if listed = strings.TrimSpace(listed); listed == "*" || strings.EqualFold(listed, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/zakirkun/isekai/internal/concurrency"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// ConcurrencyScopeGateway labels the gateway-wide limit in metrics
+const ConcurrencyScopeGateway = "gateway"
+
+// ConcurrencyRetryAfter is the Retry-After, in seconds, sent to requests
+// turned away by a concurrency limit
+const ConcurrencyRetryAfter = "1"
+
+// ConcurrencyLimit middleware caps the requests in flight with l. Requests to
+// the exempt paths and paths below them always go through, so a saturated
+// gateway can still be observed.
+func ConcurrencyLimit(l *concurrency.Limiter, m *metrics.Metrics, exempt []string) func(http.Handler) http.Handler {
+	paths := NewPathMatcher(exempt)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if paths.Match(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			release, err := l.Acquire(r.Context())
+			if err != nil {
+				RejectConcurrency(w, r, m, ConcurrencyScopeGateway, err)
+				return
+			}
+			defer release()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RejectConcurrency answers a request turned away by the concurrency limit
+// of scope with 503 and counts it
+func RejectConcurrency(w http.ResponseWriter, r *http.Request, m *metrics.Metrics, scope string, err error) {
+	if m != nil {
+		m.ConcurrencyRejected.WithLabelValues(scope, concurrency.Reason(err)).Inc()
+	}
+	w.Header().Set("Retry-After", ConcurrencyRetryAfter)
+	response.ErrorFor(w, r, http.StatusServiceUnavailable, response.CodeOverloaded, "Too many concurrent requests")
+}
+
+// QueueGauge returns a limiter queue callback keeping the queue depth metric
+// of scope, or nil without metrics
+func QueueGauge(m *metrics.Metrics, scope string) func(delta int) {
+	if m == nil {
+		return nil
+	}
+	gauge := m.RequestQueueDepth.WithLabelValues(scope)
+	return func(delta int) {
+		gauge.Add(float64(delta))
+	}
+}
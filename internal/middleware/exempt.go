@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// PathMatcher matches request paths against a list of path prefixes. A
+// prefix matches itself and the paths below it, so "/health" matches
+// "/health/live" but not "/healthz".
+type PathMatcher struct {
+	prefixes []string
+}
+
+// NewPathMatcher creates a matcher for prefixes, ignoring empty ones and
+// trailing slashes
+func NewPathMatcher(prefixes []string) *PathMatcher {
+	m := &PathMatcher{}
+	for _, prefix := range prefixes {
+		prefix = strings.TrimRight(strings.TrimSpace(prefix), "/")
+		if prefix == "" {
+			continue
+		}
+		if !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+		m.prefixes = append(m.prefixes, prefix)
+	}
+	return m
+}
+
+// Match reports whether path is one of the prefixes or below one. A nil
+// matcher matches nothing.
+func (m *PathMatcher) Match(path string) bool {
+	if m == nil {
+		return false
+	}
+	for _, prefix := range m.prefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Exempt skips mw for requests whose path matches exempt, so a global
+// middleware such as rate limiting or authentication can leave health checks
+// and metrics scrapes alone
+func Exempt(exempt *PathMatcher, mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exempt.Match(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
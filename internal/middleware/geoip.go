@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/geoip"
+	"github.com/zakirkun/isekai/internal/metrics"
+)
+
+// UnknownCountry labels requests from addresses not in the GeoIP database
+const UnknownCountry = "unknown"
+
+// GeoIP middleware resolves the client IP to its country code and stores it
+// in the request context for request logs and route country lists. With
+// guard set, requests are also counted by country, the guard bounding the
+// distinct countries labelled.
+func GeoIP(db *geoip.DB, m *metrics.Metrics, guard *metrics.PathGuard) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var country string
+			if addr, ok := acl.ClientIP(r); ok {
+				country = db.Country(addr)
+			}
+
+			if m != nil && guard != nil {
+				label := UnknownCountry
+				if country != "" {
+					label = guard.Label(country)
+				}
+				m.CountryRequests.WithLabelValues(label).Inc()
+			}
+
+			next.ServeHTTP(w, r.WithContext(geoip.WithCountry(r.Context(), country)))
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/inflight"
+	"github.com/zakirkun/isekai/internal/urlpath"
+)
+
+// InFlight middleware tracks each request in registry while it is served, so
+// requests held up by a hanging upstream can be listed and cancelled. It
+// must run after RequestID.
+func InFlight(registry *inflight.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := RequestIDFromContext(r.Context())
+			req := inflight.Request{
+				ID:        id,
+				RequestID: id,
+				Method:    r.Method,
+				Path:      urlpath.Normalize(r.URL).Path,
+				ClientIP:  r.RemoteAddr,
+				Started:   time.Now(),
+			}
+			if addr, ok := acl.ClientIP(r); ok {
+				req.ClientIP = addr.String()
+			}
+
+			ctx, done := registry.Register(r.Context(), req)
+			defer done()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -1,21 +1,33 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/urlpath"
+	"github.com/zakirkun/isekai/pkg/response"
 )
 
-// MetricsMiddleware tracks HTTP metrics
-func MetricsMiddleware(m *metrics.Metrics) func(http.Handler) http.Handler {
+// MetricsMiddleware tracks HTTP metrics. The path label is the chi route
+// pattern or the matched proxy route, falling back to the normalized request
+// path with at most maxPaths distinct values.
+func MetricsMiddleware(m *metrics.Metrics, maxPaths int) func(http.Handler) http.Handler {
+	guard := metrics.NewPathGuard(maxPaths, m.CollapsedPaths)
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 			m.ActiveConnections.Inc()
 			defer m.ActiveConnections.Dec()
 
+			// Let the proxy handler report the route it matched
+			r = r.WithContext(metrics.WithRouteLabel(r.Context()))
+
 			// Wrap response writer to capture status code
 			wrapped := &metricsResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
@@ -23,14 +35,67 @@ func MetricsMiddleware(m *metrics.Metrics) func(http.Handler) http.Handler {
 
 			duration := time.Since(start).Seconds()
 			status := strconv.Itoa(wrapped.statusCode)
+			path := pathLabel(r, guard)
+			fault := metrics.FaultLabel(r.Context())
 
 			// Record metrics
-			m.RequestsTotal.WithLabelValues(r.Method, r.URL.Path, status).Inc()
-			m.RequestDuration.WithLabelValues(r.Method, r.URL.Path).Observe(duration)
+			m.RequestsTotal.WithLabelValues(r.Method, path, status, fault).Inc()
+			m.RequestDuration.WithLabelValues(r.Method, path, fault).Observe(duration)
+		})
+	}
+}
+
+// MetricsAuth protects the metrics endpoint with token, presented as a Bearer
+// token or as the password of HTTP basic auth with any username, so scrapers
+// don't need a gateway JWT. An empty token leaves the endpoint open.
+func MetricsAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if token == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented, ok := metricsCredential(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+				response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthMissing, "Metrics token required")
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				response.ErrorCode(w, http.StatusUnauthorized, response.CodeAuthInvalid, "Invalid metrics token")
+				return
+			}
+			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+// metricsCredential returns the Bearer token or basic auth password sent
+func metricsCredential(r *http.Request) (string, bool) {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password, true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token, true
+	}
+	return "", false
+}
+
+// pathLabel picks a bounded label value for the request path
+func pathLabel(r *http.Request, guard *metrics.PathGuard) string {
+	if route := metrics.RouteLabel(r.Context()); route != "" {
+		return route
+	}
+
+	// The catch-all proxy pattern carries no information
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" && pattern != "/*" {
+			return pattern
+		}
+	}
+
+	return guard.Label(metrics.NormalizePath(urlpath.Normalize(r.URL).Path))
+}
+
 type metricsResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -40,3 +105,8 @@ func (rw *metricsResponseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap exposes the underlying writer so streamed responses can be flushed
+func (rw *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -2,41 +2,145 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/zakirkun/isekai/internal/accesslog"
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/inflight"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/panics"
+	"github.com/zakirkun/isekai/internal/stream"
+	"github.com/zakirkun/isekai/internal/urlpath"
+	"github.com/zakirkun/isekai/pkg/config"
 	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/redact"
 	"github.com/zakirkun/isekai/pkg/response"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
-// Logger middleware logs incoming requests
-func Logger(log *logger.Logger) func(http.Handler) http.Handler {
+// maxRequestIDLength bounds client-supplied request IDs
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID middleware assigns each request an ID, reusing a well-formed
+// X-Request-ID from the client. The ID is set on the response, forwarded
+// upstream and included in error responses.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(response.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(response.RequestIDHeader, id)
+		}
+
+		w.Header().Set(response.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFromContext returns the request ID assigned by RequestID
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether a client-supplied ID is short printable ASCII
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 16-character hex ID
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// TraceContext middleware continues the caller's trace from its traceparent
+// and baggage headers, so the gateway's spans join it
+func TraceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Logger middleware logs incoming requests, and writes them to the access log
+// when access is set, including the headers selects
+func Logger(log *logger.Logger, access *accesslog.Writer, headers *redact.Headers) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
+			if access != nil {
+				r = r.WithContext(accesslog.WithAnnotations(r.Context()))
+			}
 
 			// Create a response writer wrapper to capture status code
 			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
 			next.ServeHTTP(wrapped, r)
 
+			// Log the normalized path, as the proxy matches it and metrics label it
 			duration := time.Since(start)
-			log.Infof("%s %s - %d (%v) - %s",
+			log.Infof("%s %s - %d (%v) - %s - %s",
 				r.Method,
-				r.URL.Path,
+				urlpath.Normalize(r.URL).Path,
 				wrapped.statusCode,
 				duration,
 				r.RemoteAddr,
+				RequestIDFromContext(r.Context()),
 			)
+
+			if access != nil {
+				entry := accesslog.Entry{
+					Time:      start,
+					RequestID: RequestIDFromContext(r.Context()),
+					ClientIP:  r.RemoteAddr,
+					Method:    r.Method,
+					URI:       r.RequestURI,
+					Proto:     r.Proto,
+					Status:    wrapped.statusCode,
+					Bytes:     wrapped.bytes,
+					Latency:   duration,
+					Referer:   r.Referer(),
+					UserAgent: r.UserAgent(),
+				}
+				if addr, ok := acl.ClientIP(r); ok {
+					entry.ClientIP = addr.String()
+				}
+				accesslog.Annotate(r.Context(), &entry)
+				if headers != nil {
+					routeHeaders := headers.With(accesslog.SensitiveHeaders(r.Context()))
+					entry.RequestHeaders = routeHeaders.Record(r.Header)
+					entry.ResponseHeaders = routeHeaders.Record(wrapped.Header())
+				}
+				access.Write(entry)
+			}
 		})
 	}
 }
 
-// responseWriter wraps http.ResponseWriter to capture status code
+// responseWriter wraps http.ResponseWriter to capture status code and body size
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -44,13 +148,44 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// CORS middleware adds CORS headers
-func CORS() func(http.Handler) http.Handler {
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying writer so streamed responses can be flushed
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// CORS middleware adds CORS headers for the allowed origins
+func CORS(allowedOrigins []string) func(http.Handler) http.Handler {
+	return CORSPassthrough(allowedOrigins, nil)
+}
+
+// CORSPassthrough is CORS leaving the OPTIONS requests passthrough reports
+// to the next handler untouched, so the upstream answers them. passthrough
+// may be nil.
+func CORSPassthrough(allowedOrigins []string, passthrough func(r *http.Request) bool) func(http.Handler) http.Handler {
+	allowAll := slices.Contains(allowedOrigins, "*")
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
+			if r.Method == http.MethodOptions && passthrough != nil && passthrough(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if allowAll {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else if origin := r.Header.Get("Origin"); origin != "" && config.OriginAllowed(allowedOrigins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, X-Request-ID")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset")
 			w.Header().Set("Access-Control-Max-Age", "3600")
 
 			if r.Method == "OPTIONS" {
@@ -63,14 +198,30 @@ func CORS() func(http.Handler) http.Handler {
 	}
 }
 
-// Recovery middleware recovers from panics
-func Recovery(log *logger.Logger) func(http.Handler) http.Handler {
+// Recovery middleware recovers from panics, logging them with their stack
+// and request and answering 500 with the request ID. Panics are counted in
+// m and posted to reporter when they are set.
+func Recovery(log *logger.Logger, m *metrics.Metrics, reporter *panics.Reporter) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if err := recover(); err != nil {
-					log.Errorf("Panic recovered: %v", err)
-					response.InternalServerError(w, "Internal server error")
+					if err == http.ErrAbortHandler {
+						// The handler dropped the connection on purpose
+						panic(err)
+					}
+
+					value, stack := panics.Unwrap(err)
+					report := panics.NewReport(value, stack, r, panicHandler(r), RequestIDFromContext(r.Context()))
+					log.Errorf("Panic recovered: %s %s %s (handler %s, request %s, fingerprint %s)\n%s",
+						report.Message, report.Method, report.Path, report.Handler, report.RequestID, report.Fingerprint, report.Stack)
+					if m != nil {
+						m.Panics.WithLabelValues(report.Handler).Inc()
+					}
+					if reporter != nil {
+						reporter.Send(report)
+					}
+					response.ErrorFor(w, r, http.StatusInternalServerError, response.CodeInternal, "Internal server error")
 				}
 			}()
 
@@ -79,23 +230,47 @@ func Recovery(log *logger.Logger) func(http.Handler) http.Handler {
 	}
 }
 
+// panicHandler labels the handler that panicked with its route pattern, as
+// chi matched it so far
+func panicHandler(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+	return "unmatched"
+}
+
 // RateLimiter represents a simple rate limiter
 type RateLimiter struct {
 	mu          sync.Mutex
 	requests    map[string][]time.Time
 	limit       int
 	window      time.Duration
+	headers     RateLimitHeaders
 	cleanupTick *time.Ticker
+	stop        chan struct{}
+	stopOnce    sync.Once
 	log         *logger.Logger
 }
 
-// NewRateLimiter creates a new rate limiter
+// RateLimitResult is the outcome of counting a request against a limit
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int           // Requests left in the window after this one
+	Reset     time.Duration // Until the oldest request counted leaves the window and frees a slot
+}
+
+// NewRateLimiter creates a new rate limiter sending both rate limit header families
 func NewRateLimiter(requestsPerSecond int, log *logger.Logger) *RateLimiter {
 	rl := &RateLimiter{
 		requests:    make(map[string][]time.Time),
 		limit:       requestsPerSecond,
 		window:      time.Second,
+		headers:     RateLimitHeaders{Draft: true, Legacy: true},
 		cleanupTick: time.NewTicker(time.Minute),
+		stop:        make(chan struct{}),
 		log:         log,
 	}
 
@@ -105,9 +280,20 @@ func NewRateLimiter(requestsPerSecond int, log *logger.Logger) *RateLimiter {
 	return rl
 }
 
+// SetHeaders sets the rate limit header families sent with responses
+func (rl *RateLimiter) SetHeaders(headers RateLimitHeaders) {
+	rl.headers = headers
+}
+
 // cleanup removes old entries from the rate limiter
 func (rl *RateLimiter) cleanup() {
-	for range rl.cleanupTick.C {
+	for {
+		select {
+		case <-rl.cleanupTick.C:
+		case <-rl.stop:
+			return
+		}
+
 		rl.mu.Lock()
 		now := time.Now()
 		for key, times := range rl.requests {
@@ -129,84 +315,200 @@ func (rl *RateLimiter) cleanup() {
 	}
 }
 
-// Allow checks if a request is allowed
-func (rl *RateLimiter) Allow(clientIP string) bool {
+// Allow checks if a request from key is allowed at the default rate
+func (rl *RateLimiter) Allow(key string) bool {
+	return rl.AllowLimit(key, rl.limit)
+}
+
+// AllowLimit checks if a request from key is allowed at limit requests per second
+func (rl *RateLimiter) AllowLimit(key string, limit int) bool {
+	return rl.Take(key, limit).Allowed
+}
+
+// Take counts a request from key against limit requests per second and
+// reports whether it is allowed, with what is left of the window
+func (rl *RateLimiter) Take(key string, limit int) RateLimitResult {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
 	now := time.Now()
 	cutoff := now.Add(-rl.window)
 
-	// Get requests for this client
-	times, exists := rl.requests[clientIP]
-	if !exists {
-		rl.requests[clientIP] = []time.Time{now}
-		return true
-	}
-
 	// Filter out old requests
-	valid := make([]time.Time, 0)
+	times := rl.requests[key]
+	valid := make([]time.Time, 0, len(times)+1)
 	for _, t := range times {
 		if t.After(cutoff) {
 			valid = append(valid, t)
 		}
 	}
 
-	// Check if limit exceeded
-	if len(valid) >= rl.limit {
-		rl.requests[clientIP] = valid
-		return false
+	result := RateLimitResult{Allowed: len(valid) < limit, Limit: limit}
+	if result.Allowed {
+		valid = append(valid, now)
 	}
-
-	// Add new request
-	valid = append(valid, now)
-	rl.requests[clientIP] = valid
-	return true
+	if len(valid) > 0 {
+		rl.requests[key] = valid
+		result.Reset = valid[0].Add(rl.window).Sub(now)
+	} else {
+		// Nothing counted, as with a limit of 0, frees up
+		result.Reset = rl.window
+	}
+	result.Remaining = max(limit-len(valid), 0)
+	return result
 }
 
 // Stop stops the rate limiter cleanup
 func (rl *RateLimiter) Stop() {
-	rl.cleanupTick.Stop()
+	rl.stopOnce.Do(func() {
+		rl.cleanupTick.Stop()
+		close(rl.stop)
+	})
 }
 
-// RateLimit middleware limits requests per client
+// RateLimit middleware limits requests per client IP
 func RateLimit(rl *RateLimiter) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			clientIP := r.RemoteAddr
-
-			if !rl.Allow(clientIP) {
-				response.Error(w, http.StatusTooManyRequests, "Rate limit exceeded")
-				return
-			}
-
-			next.ServeHTTP(w, r)
-		})
-	}
+	return TieredRateLimit(rl, nil, nil)
 }
 
-// Timeout middleware adds a timeout to requests
+// Timeout middleware adds a timeout to requests. Event streams lift it once
+// their response starts. Requests cancelled through the in-flight registry
+// are answered at once, like timed out ones.
 func Timeout(timeout time.Duration) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx, cancel := context.WithTimeout(r.Context(), timeout)
-			defer cancel()
+			ctx, deadline := stream.WithDeadline(r.Context(), timeout)
+			defer deadline.Stop()
 
 			r = r.WithContext(ctx)
+			tw := &timeoutWriter{ResponseWriter: w, header: make(http.Header)}
 
 			done := make(chan struct{})
+			var panicked interface{}
 			go func() {
-				next.ServeHTTP(w, r)
-				close(done)
+				defer close(done)
+				defer func() {
+					// Handed to the serving goroutine so Recovery and the
+					// server see it, with the stack of where it happened
+					panicked = panics.Wrap(recover())
+				}()
+				next.ServeHTTP(tw, r)
 			}()
 
 			select {
 			case <-done:
+				if panicked != nil {
+					panic(panicked)
+				}
 				return
 			case <-ctx.Done():
-				response.Error(w, http.StatusGatewayTimeout, "Request timeout")
+				cancelled := inflight.Cancelled(ctx)
+				if !stream.TimedOut(ctx) && !cancelled {
+					// The client went away; let the handler wind down
+					<-done
+					if panicked != nil {
+						panic(panicked)
+					}
+					return
+				}
+				if !tw.timeout() {
+					// The response already started and is cut short
+					return
+				}
+				if cancelled {
+					response.ErrorFor(w, r, http.StatusServiceUnavailable, response.CodeRequestCancelled, "Request cancelled")
+					return
+				}
+				response.ErrorFor(w, r, http.StatusGatewayTimeout, response.CodeRequestTimeout, "Request timeout")
 				return
 			}
 		})
 	}
 }
+
+// timeoutWriter keeps a handler that outlived its timeout from writing to the
+// response alongside the 504. Headers are buffered until the status is
+// written so the two never share a header map.
+type timeoutWriter struct {
+	http.ResponseWriter
+	mu          sync.Mutex
+	header      http.Header
+	wroteHeader bool
+	timedOut    bool
+}
+
+// timeout stops the handler's writes and reports whether the 504 can still be written
+func (tw *timeoutWriter) timeout() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.timedOut = true
+	return !tw.wroteHeader
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader {
+		// Trailers are set once the body is written
+		return tw.ResponseWriter.Header()
+	}
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(code)
+}
+
+func (tw *timeoutWriter) writeHeader(code int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+
+	dst := tw.ResponseWriter.Header()
+	for key, values := range tw.header {
+		dst[key] = values
+	}
+	tw.ResponseWriter.WriteHeader(code)
+
+	if code >= http.StatusOK {
+		tw.wroteHeader = true
+		return
+	}
+	// Informational headers don't carry over to the final response
+	for key := range tw.header {
+		delete(dst, key)
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeader(http.StatusOK)
+	return tw.ResponseWriter.Write(b)
+}
+
+// FlushError flushes the response unless the request timed out
+func (tw *timeoutWriter) FlushError() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return http.ErrHandlerTimeout
+	}
+	tw.writeHeader(http.StatusOK)
+	return http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+// SetWriteDeadline lets event streams clear the server's write timeout
+func (tw *timeoutWriter) SetWriteDeadline(deadline time.Time) error {
+	return http.NewResponseController(tw.ResponseWriter).SetWriteDeadline(deadline)
+}
+
+// Unwrap exposes the underlying writer for connection upgrades
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// Rate limit header families, as named in GATEWAY_RATE_LIMIT_HEADERS
+const (
+	RateLimitHeadersDraft  = "draft"
+	RateLimitHeadersLegacy = "legacy"
+)
+
+// RateLimitHeaders selects the header families describing the caller's rate
+// limit on every limited response. Draft sends the IETF RateLimit fields with
+// the reset in seconds; legacy sends X-RateLimit-* with the reset as a Unix time.
+type RateLimitHeaders struct {
+	Draft  bool
+	Legacy bool
+}
+
+// NewRateLimitHeaders selects the header families named in families
+func NewRateLimitHeaders(families []string) RateLimitHeaders {
+	return RateLimitHeaders{
+		Draft:  slices.Contains(families, RateLimitHeadersDraft),
+		Legacy: slices.Contains(families, RateLimitHeadersLegacy),
+	}
+}
+
+// RateLimitDetails is the data of a 429 response's error envelope
+type RateLimitDetails struct {
+	Limit   int       `json:"limit"`
+	Reset   int       `json:"reset"` // Seconds until a request is allowed again
+	ResetAt time.Time `json:"reset_at"`
+}
+
+// resetSeconds rounds a reset up to whole seconds, so clients waiting for
+// it never retry early
+func resetSeconds(reset time.Duration) int {
+	return int(math.Ceil(reset.Seconds()))
+}
+
+// write sets the selected headers for result
+func (h RateLimitHeaders) write(w http.ResponseWriter, result RateLimitResult, now time.Time) {
+	reset := resetSeconds(result.Reset)
+	if h.Draft {
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(reset))
+	}
+	if h.Legacy {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(now.Unix()+int64(reset), 10))
+	}
+}
+
+// rejectRateLimited answers a request over its limit with 429, Retry-After
+// and the reset in the error envelope
+func rejectRateLimited(w http.ResponseWriter, r *http.Request, result RateLimitResult, now time.Time) {
+	reset := resetSeconds(result.Reset)
+	w.Header().Set("Retry-After", strconv.Itoa(reset))
+	response.ErrorDataFor(w, r, http.StatusTooManyRequests, response.CodeRateLimited, "Rate limit exceeded", RateLimitDetails{
+		Limit:   result.Limit,
+		Reset:   reset,
+		ResetAt: now.Add(time.Duration(reset) * time.Second).UTC().Truncate(time.Second),
+	})
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/version"
+)
+
+type securityHeadersKey struct{}
+
+// SkipSecurityHeaders leaves the current response as the upstream or handler
+// wrote it, for routes whose responses must not be modified. It is a no-op
+// outside the SecurityHeaders middleware.
+func SkipSecurityHeaders(ctx context.Context) {
+	if skip, ok := ctx.Value(securityHeadersKey{}).(*atomic.Bool); ok {
+		skip.Store(true)
+	}
+}
+
+// SecurityHeaders sets the configured security and identification headers on
+// every response, gateway-generated and proxied alike, and removes the
+// headers in cfg.Strip that upstreams send. Responses under admin also get
+// the frame options and content security policy. Headers are applied when
+// the response is written, so they replace the upstream's.
+func SecurityHeaders(cfg *config.SecurityHeadersConfig, admin *PathMatcher) func(http.Handler) http.Handler {
+	gateway := "isekai/" + version.Version
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			skip := &atomic.Bool{}
+			sw := &securityWriter{ResponseWriter: w, skip: skip, apply: func(h http.Header) {
+				for _, name := range cfg.Strip {
+					h.Del(name)
+				}
+				if cfg.HSTS != "" && r.TLS != nil {
+					h.Set("Strict-Transport-Security", cfg.HSTS)
+				}
+				if cfg.ContentTypeOptions != "" {
+					h.Set("X-Content-Type-Options", cfg.ContentTypeOptions)
+				}
+				if admin.Match(r.URL.Path) {
+					if cfg.FrameOptions != "" {
+						h.Set("X-Frame-Options", cfg.FrameOptions)
+					}
+					if cfg.AdminCSP != "" {
+						h.Set("Content-Security-Policy", cfg.AdminCSP)
+					}
+				}
+				if cfg.Via {
+					h.Add("Via", fmt.Sprintf("%d.%d isekai", r.ProtoMajor, r.ProtoMinor))
+				}
+				if cfg.GatewayHeader {
+					h.Set("X-Gateway", gateway)
+				}
+			}}
+			next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), securityHeadersKey{}, skip)))
+		})
+	}
+}
+
+// securityWriter applies the security headers just before the response
+// header is written
+type securityWriter struct {
+	http.ResponseWriter
+	skip    *atomic.Bool
+	apply   func(http.Header)
+	applied bool
+}
+
+func (sw *securityWriter) writeHeaders() {
+	if sw.applied {
+		return
+	}
+	sw.applied = true
+	if !sw.skip.Load() {
+		sw.apply(sw.ResponseWriter.Header())
+	}
+}
+
+func (sw *securityWriter) WriteHeader(code int) {
+	// Informational responses go out before the final headers are known
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		sw.writeHeaders()
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *securityWriter) Write(b []byte) (int, error) {
+	sw.writeHeaders()
+	return sw.ResponseWriter.Write(b)
+}
+
+// FlushError applies the headers before a response is flushed without a body
+func (sw *securityWriter) FlushError() error {
+	sw.writeHeaders()
+	return http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer so streamed responses can be flushed
+// and WebSocket connections hijacked
+func (sw *securityWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/auth"
+)
+
+// RateLimitTierHeader names the tier whose limit applied to the request
+const RateLimitTierHeader = "X-RateLimit-Tier"
+
+// DefaultRateLimitTier applies the limiter's own rate to callers without a tier
+const DefaultRateLimitTier = "default"
+
+// TenantRateLimitTier prefixes the tier header of callers limited at their
+// tenant's rate
+const TenantRateLimitTier = "tenant:"
+
+// Rate limit subject prefixes keep API keys, users and client IPs from
+// sharing a budget
+const (
+	SubjectAPIKey = "key:"
+	SubjectUser   = "user:"
+	SubjectIP     = "ip:"
+)
+
+// RateLimitTier is a named rate limit and the callers assigned to it
+type RateLimitTier struct {
+	Name              string
+	RequestsPerSecond int
+	Subjects          []string // Prefixed subjects such as "key:partner-1" or "user:42"
+}
+
+// RateLimitTiers resolves the tier of a caller. Tiers from the configuration
+// can be extended or overridden at runtime with Replace, and callers without
+// a tier get their tenant's rate set with ReplaceTenants.
+type RateLimitTiers struct {
+	mu       sync.RWMutex
+	static   map[string]int
+	limits   map[string]int
+	subjects map[string]string
+	tenants  map[string]int
+}
+
+// NewRateLimitTiers creates tiers with the configured limits by name
+func NewRateLimitTiers(static map[string]int) *RateLimitTiers {
+	t := &RateLimitTiers{static: static}
+	t.Replace(nil)
+	return t
+}
+
+// Replace swaps the runtime tiers, which take precedence over configured
+// tiers of the same name
+func (t *RateLimitTiers) Replace(tiers []RateLimitTier) {
+	limits := maps.Clone(t.static)
+	if limits == nil {
+		limits = make(map[string]int)
+	}
+	subjects := make(map[string]string)
+	for _, tier := range tiers {
+		limits[tier.Name] = tier.RequestsPerSecond
+		for _, subject := range tier.Subjects {
+			subjects[subject] = tier.Name
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits, t.subjects = limits, subjects
+}
+
+// ReplaceTenants swaps the tenants' rates by tenant ID
+func (t *RateLimitTiers) ReplaceTenants(limits map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tenants = limits
+}
+
+// TenantLimit returns the rate of a tenant that has one
+func (t *RateLimitTiers) TenantLimit(tenantID string) (int, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	limit, ok := t.tenants[tenantID]
+	return limit, ok && limit > 0
+}
+
+// Resolve returns the tier and limit for subject. A known tier named in the
+// caller's claims comes first, then the tier subject is assigned to.
+func (t *RateLimitTiers) Resolve(subject, claimed string) (string, int, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if limit, ok := t.limits[claimed]; ok && claimed != "" {
+		return claimed, limit, true
+	}
+	if name, ok := t.subjects[subject]; ok {
+		if limit, ok := t.limits[name]; ok {
+			return name, limit, true
+		}
+	}
+	return "", 0, false
+}
+
+// TieredRateLimit middleware limits requests per API key, user or client IP,
+// in that order of preference, at the rate of the caller's tier, or of their
+// tenant when they have none. Callers are
+// identified from a valid Bearer token when authService is set; tiers may be
+// nil to apply the default rate to everyone.
+func TieredRateLimit(rl *RateLimiter, tiers *RateLimitTiers, authService *auth.AuthService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var claims *auth.Claims
+			if authService != nil {
+				claims, _ = authService.Identify(r)
+			}
+
+			subject := Subject(r, claims)
+			tier, limit := DefaultRateLimitTier, rl.limit
+			if tiers != nil {
+				claimed := ""
+				if claims != nil {
+					claimed = claims.Tier
+				}
+				if name, tierLimit, ok := tiers.Resolve(subject, claimed); ok {
+					tier, limit = name, tierLimit
+				} else if claims != nil && claims.TenantID != "" {
+					if tenantLimit, ok := tiers.TenantLimit(claims.TenantID); ok {
+						tier, limit = TenantRateLimitTier+claims.TenantID, tenantLimit
+					}
+				}
+			}
+
+			w.Header().Set(RateLimitTierHeader, tier)
+			result, now := rl.Take(subject, limit), time.Now()
+			rl.headers.write(w, result, now)
+			if !result.Allowed {
+				rejectRateLimited(w, r, result, now)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Subject returns the prefixed key identifying the caller: its API key, its
+// user or, without claims, its client IP
+func Subject(r *http.Request, claims *auth.Claims) string {
+	switch {
+	case claims != nil && claims.APIKeyID != "":
+		return SubjectAPIKey + claims.APIKeyID
+	case claims != nil && claims.UserID != "":
+		return SubjectUser + claims.UserID
+	}
+
+	if addr, ok := acl.ClientIP(r); ok {
+		return SubjectIP + addr.String()
+	}
+	return SubjectIP + r.RemoteAddr
+}
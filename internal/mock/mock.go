@@ -0,0 +1,200 @@
+package mock
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// MaxLatency is the longest latency a mock response may inject
+const MaxLatency = 60 * time.Second
+
+// EchoMaxBody is the most of the request body an echo response reflects
+const EchoMaxBody = 1 << 20
+
+// Response is a stubbed response served in place of an upstream. Its body
+// may reference the request with ${path}, ${method}, ${query.<name>} and
+// ${header.<name>}.
+type Response struct {
+	Status     int               `json:"status"` // Defaults to 200
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body"`
+	LatencyMin int               `json:"latency_min,omitempty"` // Milliseconds waited before responding
+	LatencyMax int               `json:"latency_max,omitempty"` // A random wait up to this when above latency_min
+}
+
+// variable matches a template variable
+var variable = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// Validate checks the status, headers, latency bounds and template variables
+func (m *Response) Validate() error {
+	if m.Status != 0 && (m.Status < 200 || m.Status > 599) {
+		return errors.New("mock status must be between 200 and 599")
+	}
+	for name, value := range m.Headers {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid mock header %q", name)
+		}
+	}
+	if m.LatencyMin < 0 || m.LatencyMax < 0 {
+		return errors.New("mock latency can't be negative")
+	}
+	if m.LatencyMax != 0 && m.LatencyMax < m.LatencyMin {
+		return errors.New("mock latency_max can't be below latency_min")
+	}
+	if time.Duration(max(m.LatencyMin, m.LatencyMax))*time.Millisecond > MaxLatency {
+		return fmt.Errorf("mock latency can't exceed %s", MaxLatency)
+	}
+	for _, match := range variable.FindAllStringSubmatch(m.Body, -1) {
+		if !knownVariable(match[1]) {
+			return fmt.Errorf("unknown mock variable ${%s}", match[1])
+		}
+	}
+	return nil
+}
+
+// knownVariable reports whether name is a template variable Render fills in
+func knownVariable(name string) bool {
+	switch {
+	case name == "path", name == "method":
+		return true
+	case strings.HasPrefix(name, "query."):
+		return len(name) > len("query.")
+	case strings.HasPrefix(name, "header."):
+		return httpguts.ValidHeaderFieldName(strings.TrimPrefix(name, "header."))
+	}
+	return false
+}
+
+// Render fills in the body's variables from r. Missing query parameters and
+// headers render empty. Values are escaped for a JSON string when the
+// response is JSON.
+func (m *Response) Render(r *http.Request) string {
+	escape := isJSON(m.contentType())
+	return variable.ReplaceAllStringFunc(m.Body, func(match string) string {
+		name := match[2 : len(match)-1]
+		var value string
+		switch {
+		case name == "path":
+			value = r.URL.Path
+		case name == "method":
+			value = r.Method
+		case strings.HasPrefix(name, "query."):
+			value = r.URL.Query().Get(strings.TrimPrefix(name, "query."))
+		case strings.HasPrefix(name, "header."):
+			value = r.Header.Get(strings.TrimPrefix(name, "header."))
+		default:
+			return match
+		}
+		if escape {
+			quoted, _ := json.Marshal(value)
+			value = string(quoted[1 : len(quoted)-1])
+		}
+		return value
+	})
+}
+
+// Latency returns how long to wait before responding: latency_min, or a
+// random duration between latency_min and latency_max
+func (m *Response) Latency() time.Duration {
+	latency := m.LatencyMin
+	if m.LatencyMax > m.LatencyMin {
+		latency += rand.Intn(m.LatencyMax - m.LatencyMin + 1)
+	}
+	return time.Duration(latency) * time.Millisecond
+}
+
+// Serve waits out the injected latency and writes the response. It returns
+// the status written, or ctx's error if the request ended while waiting.
+func (m *Response) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if latency := m.Latency(); latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	status := m.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := m.Render(r)
+
+	for name, value := range m.Headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Content-Type", m.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, body)
+	}
+	return status, nil
+}
+
+// contentType returns the configured Content-Type, plain text by default
+func (m *Response) contentType() string {
+	for name, value := range m.Headers {
+		if strings.EqualFold(name, "Content-Type") {
+			return value
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// isJSON reports whether contentType is JSON
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// EchoResponse is the request as reflected by an echo route
+type EchoResponse struct {
+	Method        string              `json:"method"`
+	Path          string              `json:"path"`
+	Query         map[string][]string `json:"query"`
+	Host          string              `json:"host"`
+	Proto         string              `json:"proto"`
+	Headers       map[string][]string `json:"headers"`
+	Body          string              `json:"body"`
+	BodyEncoding  string              `json:"body_encoding,omitempty"` // base64 when the body isn't UTF-8
+	BodyTruncated bool                `json:"body_truncated,omitempty"`
+}
+
+// Echo reads r and returns it for an echo response, with headers as given
+func Echo(r *http.Request, headers map[string][]string) EchoResponse {
+	body, _ := io.ReadAll(io.LimitReader(r.Body, EchoMaxBody+1))
+	echo := EchoResponse{
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Query:   r.URL.Query(),
+		Host:    r.Host,
+		Proto:   r.Proto,
+		Headers: headers,
+	}
+	if len(body) > EchoMaxBody {
+		body, echo.BodyTruncated = body[:EchoMaxBody], true
+	}
+	if utf8.Valid(body) {
+		echo.Body = string(body)
+	} else {
+		echo.Body, echo.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return echo
+}
@@ -0,0 +1,189 @@
+package panics
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zakirkun/isekai/pkg/logger"
+	"golang.org/x/time/rate"
+)
+
+// webhookTimeout bounds sending one report
+const webhookTimeout = 5 * time.Second
+
+// fingerprintFrames is how many frames from where a panic was raised its
+// fingerprint covers. The frames below are the middleware and server that
+// led to the handler, which differ between the ways of reaching it.
+const fingerprintFrames = 5
+
+// Recovered is a panic recovered in another goroutine and raised again in
+// the one serving the request, with the stack of where it first happened
+type Recovered struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Wrap captures the stack of a panic recovered off the serving goroutine so
+// raising v again there doesn't lose it. http.ErrAbortHandler, and values
+// already wrapped, are returned as they are.
+func Wrap(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, *Recovered:
+		return v
+	}
+	if v == http.ErrAbortHandler {
+		return v
+	}
+	return &Recovered{Value: v, Stack: debug.Stack()}
+}
+
+// Unwrap returns the panic value and the stack it happened at: the one
+// captured by Wrap, otherwise the current goroutine's
+func Unwrap(v interface{}) (interface{}, []byte) {
+	if recovered, ok := v.(*Recovered); ok {
+		return recovered.Value, recovered.Stack
+	}
+	return v, debug.Stack()
+}
+
+// Report describes a panic while serving a request
+type Report struct {
+	Time        time.Time `json:"time"`
+	Fingerprint string    `json:"fingerprint"` // The same for panics of the same type at the same place
+	Message     string    `json:"message"`
+	Type        string    `json:"type"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Handler     string    `json:"handler"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Stack       string    `json:"stack"`
+}
+
+// NewReport describes the panic value recovered at stack
+func NewReport(value interface{}, stack []byte, r *http.Request, handler, requestID string) *Report {
+	return &Report{
+		Time:        time.Now(),
+		Fingerprint: Fingerprint(value, stack),
+		Message:     fmt.Sprint(value),
+		Type:        fmt.Sprintf("%T", value),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Handler:     handler,
+		RequestID:   requestID,
+		Stack:       string(stack),
+	}
+}
+
+// Fingerprint hashes the panic value's type and the functions and lines of
+// the top frames of the stack from where it was raised. Goroutine IDs,
+// arguments and the message, which often carries an index or an ID, are left
+// out so repeated panics group together.
+func Fingerprint(value interface{}, stack []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%T\n", value)
+	top := frames(stack)
+	if len(top) > fingerprintFrames {
+		top = top[:fingerprintFrames]
+	}
+	for _, frame := range top {
+		hash.Write([]byte(frame))
+		hash.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// frames returns each frame of a stack from debug.Stack as its function
+// and file:line, starting below the runtime's panic call when there is one
+func frames(stack []byte) []string {
+	var all []string
+	start := 0
+	function := ""
+	for _, line := range strings.Split(string(stack), "\n") {
+		switch {
+		case line == "", strings.HasPrefix(line, "goroutine "):
+			continue
+		case strings.HasPrefix(line, "\t"):
+			// File and line, without the program counter offset
+			location, _, _ := strings.Cut(strings.TrimSpace(line), " +0x")
+			if function == "panic" {
+				start = len(all) + 1
+			}
+			all = append(all, function+" "+location)
+		default:
+			// Function, without its arguments
+			function = line
+			if i := strings.LastIndex(line, "("); i > 0 {
+				function = line[:i]
+			}
+		}
+	}
+	return all[start:]
+}
+
+// Reporter posts panic reports to a webhook, a limited number a minute so a
+// storm of panics doesn't flood it or the gateway
+type Reporter struct {
+	url     string
+	client  *http.Client
+	limiter *rate.Limiter
+	dropped atomic.Int64
+	log     *logger.Logger
+}
+
+// New creates a reporter posting to url at most perMinute reports a minute
+func New(url string, perMinute int, log *logger.Logger) *Reporter {
+	return &Reporter{
+		url:     url,
+		client:  &http.Client{Timeout: webhookTimeout},
+		limiter: rate.NewLimiter(rate.Limit(float64(perMinute)/60), perMinute),
+		log:     log,
+	}
+}
+
+// Send posts report in the background. Reports over the rate are dropped,
+// and counted in the next one sent.
+func (rp *Reporter) Send(report *Report) {
+	if !rp.limiter.Allow() {
+		rp.dropped.Add(1)
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		*Report
+		Dropped int64 `json:"dropped,omitempty"` // Reports dropped by the rate limit since the last one sent
+	}{report, rp.dropped.Swap(0)})
+	if err != nil {
+		rp.log.Errorf("Failed to encode panic report %s: %v", report.Fingerprint, err)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, rp.url, bytes.NewReader(body))
+		if err != nil {
+			rp.log.Errorf("Failed to send panic report %s: %v", report.Fingerprint, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := rp.client.Do(req)
+		if err != nil {
+			rp.log.Errorf("Failed to send panic report %s: %v", report.Fingerprint, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			rp.log.Errorf("Panic webhook answered report %s with %d", report.Fingerprint, resp.StatusCode)
+		}
+	}()
+}
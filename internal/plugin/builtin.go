@@ -0,0 +1,357 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/buffering"
+	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/transform"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// Built-in plugin names
+const (
+	Auth      = "auth"
+	RateLimit = "ratelimit"
+	Cache     = "cache"
+	Transform = "transform"
+	IPACL     = "ipacl"
+)
+
+// CacheHeader tells whether the cache plugin answered from the cache
+const CacheHeader = "X-Cache"
+
+// defaultCacheMaxBody bounds the responses kept by the cache plugin
+const defaultCacheMaxBody = 1 << 20
+
+// Deps are the gateway services used by the built-in plugins
+type Deps struct {
+	Auth    *auth.AuthService // nil makes the auth plugin unavailable
+	Cache   *cache.Cache
+	Proxy   *proxy.Proxy
+	Metrics *metrics.Metrics
+	Log     *logger.Logger
+
+	RateLimitHeaders middleware.RateLimitHeaders // Header families the ratelimit plugin sends
+}
+
+// RegisterBuiltins registers the auth, ratelimit, cache, transform and ipacl plugins
+func RegisterBuiltins(reg *Registry, deps *Deps) {
+	reg.Register(Auth, deps.auth)
+	reg.Register(RateLimit, deps.rateLimit)
+	reg.Register(Cache, deps.cache)
+	reg.Register(Transform, deps.transform)
+	reg.Register(IPACL, deps.ipACL)
+}
+
+// auth requires a valid token, and one of roles when any are given
+func (d *Deps) auth(config json.RawMessage) (Plugin, error) {
+	var cfg struct {
+		Roles []string `json:"roles"`
+	}
+	if err := Decode(config, &cfg); err != nil {
+		return nil, err
+	}
+	if d.Auth == nil {
+		return nil, errors.New("authentication is not configured")
+	}
+
+	authenticate := d.Auth.Middleware()
+	if len(cfg.Roles) == 0 {
+		return Func(authenticate), nil
+	}
+	authorize := auth.RequireAnyRole(cfg.Roles...)
+	return Func(func(next http.Handler) http.Handler {
+		return authenticate(authorize(next))
+	}), nil
+}
+
+// rateLimiter limits each client IP on one route
+type rateLimiter struct {
+	rl *middleware.RateLimiter
+}
+
+func (p *rateLimiter) Wrap(next http.Handler) http.Handler {
+	return middleware.RateLimit(p.rl)(next)
+}
+
+func (p *rateLimiter) Close() error {
+	p.rl.Stop()
+	return nil
+}
+
+// rateLimit limits requests per second from each client IP
+func (d *Deps) rateLimit(config json.RawMessage) (Plugin, error) {
+	var cfg struct {
+		RequestsPerSecond int `json:"requests_per_second"`
+	}
+	if err := Decode(config, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.RequestsPerSecond <= 0 {
+		return nil, errors.New("requests_per_second must be positive")
+	}
+
+	rl := middleware.NewRateLimiter(cfg.RequestsPerSecond, d.Log)
+	rl.SetHeaders(d.RateLimitHeaders)
+	return &rateLimiter{rl: rl}, nil
+}
+
+// errNotCacheable is the cache plugin's load result for responses it may not
+// keep, which requests waiting on the load then fetch themselves
+var errNotCacheable = errors.New("response not cacheable")
+
+// cacheInstances keeps the entries of different cache plugins apart
+var cacheInstances atomic.Uint64
+
+// cachedResponse is a response kept by the cache plugin
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Size approximates the response's size in bytes
+func (resp *cachedResponse) Size() int {
+	n := len(resp.body)
+	for name, values := range resp.header {
+		n += len(name)
+		for _, value := range values {
+			n += len(value)
+		}
+	}
+	return n
+}
+
+// MarshalJSON encodes the response for cache inspection
+func (resp *cachedResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Status int         `json:"status"`
+		Header http.Header `json:"header"`
+		Body   []byte      `json:"body"`
+	}{resp.status, resp.header, resp.body})
+}
+
+// cache answers GET requests from responses kept in the gateway cache.
+// Requests with different Authorization headers are cached separately, and
+// responses setting cookies or marked no-store or private are not kept.
+// Concurrent misses for a response wait for the first request's response
+// rather than all going upstream.
+func (d *Deps) cache(config json.RawMessage) (Plugin, error) {
+	var cfg struct {
+		TTL          string `json:"ttl"`
+		MaxBodyBytes int64  `json:"max_body_bytes"`
+	}
+	if err := Decode(config, &cfg); err != nil {
+		return nil, err
+	}
+
+	var ttl time.Duration
+	if cfg.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(cfg.TTL); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("ttl must be a positive duration such as 30s")
+		}
+	}
+	maxBody := cfg.MaxBodyBytes
+	if maxBody <= 0 {
+		maxBody = defaultCacheMaxBody
+	}
+	if d.Cache == nil {
+		return nil, errors.New("the cache is not available")
+	}
+	if ttl <= 0 {
+		ttl = d.Cache.DefaultTTL()
+	}
+	var buffers *buffering.Guard
+	if d.Proxy != nil {
+		buffers = d.Proxy.Buffers()
+	}
+
+	prefix := fmt.Sprintf("plugin:cache:%d:", cacheInstances.Add(1))
+	return Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := sha256.New()
+			io.WriteString(h, r.URL.RequestURI()+"\n"+r.Header.Get("Authorization"))
+			key := prefix + hex.EncodeToString(h.Sum(nil))
+
+			// The request making the load streams its response to the
+			// client as it records it, while refreshes only record it
+			served := false
+			cached, hit, err := d.Cache.GetOrLoad(r.Context(), key, ttl, func(ctx context.Context) (interface{}, error) {
+				out, req := http.ResponseWriter(w), r
+				if cache.Refreshing(ctx) {
+					out, req = &discardWriter{header: make(http.Header)}, r.Clone(ctx)
+				} else {
+					served = true
+					w.Header().Set(CacheHeader, "MISS")
+				}
+				// The response is passed through uncached while buffered
+				// bodies exceed the watermark
+				hold, err := buffers.Acquire(buffering.FeatureCache, -1)
+				rec := &cacheRecorder{ResponseWriter: out, maxBody: maxBody, hold: hold, overflow: err != nil}
+				defer hold.Release()
+				next.ServeHTTP(rec, req)
+				if resp := rec.response(); resp != nil {
+					return resp, nil
+				}
+				return nil, errNotCacheable
+			})
+			if served {
+				return
+			}
+			if err != nil {
+				w.Header().Set(CacheHeader, "MISS")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			resp := cached.(*cachedResponse)
+			for name, values := range resp.header {
+				w.Header()[name] = append([]string(nil), values...)
+			}
+			if hit {
+				w.Header().Set(CacheHeader, "HIT")
+			} else {
+				w.Header().Set(CacheHeader, "MISS")
+			}
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+		})
+	}), nil
+}
+
+// cacheRecorder passes a response through while keeping a copy of it
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	maxBody  int64
+	hold     *buffering.Hold // The body's share of the buffering watermark
+	overflow bool
+}
+
+func (rec *cacheRecorder) WriteHeader(code int) {
+	if rec.status == 0 && code >= http.StatusOK {
+		rec.status = code
+		rec.header = rec.Header().Clone()
+		rec.header.Del(CacheHeader)
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.maxBody || rec.hold.Grow(int64(len(b))) != nil {
+			rec.overflow = true
+			rec.body.Reset()
+			rec.hold.Release()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer so streamed responses can be flushed
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// discardWriter is the response writer of background refreshes
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// response returns the recorded response if it may be cached
+func (rec *cacheRecorder) response() *cachedResponse {
+	if rec.status != http.StatusOK || rec.overflow || rec.header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	control := strings.ToLower(rec.header.Get("Cache-Control"))
+	if strings.Contains(control, "no-store") || strings.Contains(control, "private") {
+		return nil
+	}
+	return &cachedResponse{status: rec.status, header: rec.header, body: bytes.Clone(rec.body.Bytes())}
+}
+
+// transform rewrites JSON request and response bodies with the rules in its
+// configuration
+func (d *Deps) transform(config json.RawMessage) (Plugin, error) {
+	var rules transform.Rules
+	if err := Decode(config, &rules); err != nil {
+		return nil, err
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+
+	return Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := d.Proxy.TransformRequest(r, &rules); err != nil {
+				d.Log.Warnf("Request transform plugin failed for %s: %v", r.URL.Path, err)
+				response.ErrorFor(w, r, http.StatusBadGateway, response.CodeTransformFailed, "Request body could not be transformed")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(proxy.WithTransform(r.Context(), &rules)))
+		})
+	}), nil
+}
+
+// ipACL rejects clients outside its allow list or inside its deny list
+func (d *Deps) ipACL(config json.RawMessage) (Plugin, error) {
+	var cfg struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+	if err := Decode(config, &cfg); err != nil {
+		return nil, err
+	}
+	list, err := acl.Parse(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if allowed, reason := list.CheckRequest(r); !allowed {
+				if d.Metrics != nil {
+					d.Metrics.ACLBlocked.WithLabelValues("plugin", reason).Inc()
+				}
+				response.ErrorFor(w, r, http.StatusForbidden, response.CodeAccessDenied, "Access denied")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}), nil
+}
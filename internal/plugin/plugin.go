@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Spec enables a plugin on a route with its configuration
+type Spec struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// Plugin wraps the handler that forwards a route's requests. Plugins holding
+// resources also implement io.Closer and are closed when their chain is
+// replaced.
+type Plugin interface {
+	Wrap(next http.Handler) http.Handler
+}
+
+// Func adapts a middleware function to a Plugin
+type Func func(http.Handler) http.Handler
+
+// Wrap calls f(next)
+func (f Func) Wrap(next http.Handler) http.Handler {
+	return f(next)
+}
+
+// Factory creates a plugin from its configuration, which is empty when the
+// route gives none
+type Factory func(config json.RawMessage) (Plugin, error)
+
+// Registry maps plugin names to their factories
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[string]Factory
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]Factory)}
+}
+
+// Register adds a plugin, replacing any registered under the same name
+func (reg *Registry) Register(name string, factory Factory) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.factories[name] = factory
+}
+
+// Names returns the registered plugin names in order
+func (reg *Registry) Names() []string {
+	if reg == nil {
+		return nil
+	}
+
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	names := make([]string, 0, len(reg.factories))
+	for name := range reg.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// factory returns the factory registered as name. A nil registry has none.
+func (reg *Registry) factory(name string) (Factory, bool) {
+	if reg == nil {
+		return nil, false
+	}
+
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	factory, ok := reg.factories[name]
+	return factory, ok
+}
+
+// Validate checks that every plugin in specs is registered and accepts its
+// configuration
+func (reg *Registry) Validate(specs []Spec) error {
+	chain, err := reg.Build(specs, http.NotFoundHandler())
+	if err != nil {
+		return err
+	}
+	chain.Close()
+	return nil
+}
+
+// Build creates the plugins in specs and composes them around next. The
+// first plugin sees the request first.
+func (reg *Registry) Build(specs []Spec, next http.Handler) (*Chain, error) {
+	chain := &Chain{handler: next}
+	for _, spec := range specs {
+		factory, ok := reg.factory(spec.Name)
+		if !ok {
+			chain.Close()
+			return nil, fmt.Errorf("unknown plugin %q", spec.Name)
+		}
+		p, err := factory(spec.Config)
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("plugin %s: %w", spec.Name, err)
+		}
+		chain.plugins = append(chain.plugins, p)
+	}
+
+	for i := len(chain.plugins) - 1; i >= 0; i-- {
+		chain.handler = chain.plugins[i].Wrap(chain.handler)
+	}
+	return chain, nil
+}
+
+// Chain is a route's plugins composed around the handler forwarding its
+// requests
+type Chain struct {
+	handler http.Handler
+	plugins []Plugin
+}
+
+// ServeHTTP runs the request through the plugins
+func (c *Chain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.handler.ServeHTTP(w, r)
+}
+
+// Close releases the resources held by the chain's plugins
+func (c *Chain) Close() {
+	for _, p := range c.plugins {
+		if closer, ok := p.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// Decode parses a plugin's configuration into v, rejecting unknown fields.
+// An empty configuration leaves v unchanged.
+func Decode(config json.RawMessage, v interface{}) error {
+	if len(bytes.TrimSpace(config)) == 0 || bytes.Equal(bytes.TrimSpace(config), []byte("null")) {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	return nil
+}
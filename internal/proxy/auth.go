@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+
+	"github.com/zakirkun/isekai/internal/upstreamauth"
+)
+
+type upstreamAuthKey struct{}
+
+// WithUpstreamAuth returns a context whose forwarded request carries the
+// profile's credentials
+func WithUpstreamAuth(ctx context.Context, profile *upstreamauth.Profile) context.Context {
+	return context.WithValue(ctx, upstreamAuthKey{}, profile)
+}
+
+// bodyHash returns the hex SHA-256 of the request body, leaving the body
+// readable, or UnsignedPayload when it is over the size cap
+func (p *Proxy) bodyHash(r *http.Request) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+
+	original := r.Body
+	buf, err := io.ReadAll(io.LimitReader(original, p.signMaxBody+1))
+	if err != nil || int64(len(buf)) > p.signMaxBody {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), original), original}
+		return upstreamauth.UnsignedPayload
+	}
+	r.Body = readCloser{bytes.NewReader(buf), original}
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
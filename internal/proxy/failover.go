@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// FailoverResult is the outcome of a request sent through Failover
+type FailoverResult struct {
+	Status   int
+	Err      error
+	Attempts int // Number of attempts sent, 1 when the first answered the client
+}
+
+// FailoverStatus reports whether an upstream status moves a request on to
+// the next attempt
+func FailoverStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// Failover sends first and, while an attempt fails, the attempt returned by
+// next. An attempt fails when it answers 502, 503 or 504, including the
+// proxy's own errors for unreachable upstreams, or returns an error without
+// writing a response, as when its circuit breaker is open. next is asked for
+// the following attempt before each one is sent and returns nil when there is
+// none; the last attempt always answers the client.
+func (p *Proxy) Failover(ctx context.Context, w http.ResponseWriter, first Attempt, next func() Attempt) FailoverResult {
+	var result FailoverResult
+	for current := first; ; {
+		result.Attempts++
+		following := next()
+		if following == nil {
+			result.Status, result.Err = current(ctx, w)
+			return result
+		}
+
+		fw := &failoverWriter{w: w, header: make(http.Header)}
+		result.Status, result.Err = current(ctx, fw)
+		if fw.committed || (!fw.failed && result.Err == nil) || ctx.Err() != nil {
+			if fw.failed {
+				// Cancelled while failing over: answer with the held error
+				fw.flush()
+			}
+			return result
+		}
+		current = following
+	}
+}
+
+// failoverWriter holds back an attempt's failed response so the next
+// attempt can answer instead
+type failoverWriter struct {
+	w         http.ResponseWriter
+	header    http.Header
+	committed bool
+	failed    bool
+	status    int
+	body      []byte
+}
+
+func (f *failoverWriter) Header() http.Header {
+	if f.committed {
+		return f.w.Header()
+	}
+	return f.header
+}
+
+func (f *failoverWriter) WriteHeader(code int) {
+	// Informational responses aren't held
+	if f.committed || f.failed || code < http.StatusOK {
+		return
+	}
+	if FailoverStatus(code) {
+		f.failed, f.status = true, code
+		return
+	}
+	f.committed = true
+	dst := f.w.Header()
+	for key, values := range f.header {
+		dst[key] = values
+	}
+	f.w.WriteHeader(code)
+}
+
+func (f *failoverWriter) Write(b []byte) (int, error) {
+	if !f.committed && !f.failed {
+		f.WriteHeader(http.StatusOK)
+	}
+	if f.failed {
+		f.body = append(f.body, b...)
+		return len(b), nil
+	}
+	return f.w.Write(b)
+}
+
+// flush writes the held failed response to the client
+func (f *failoverWriter) flush() {
+	dst := f.w.Header()
+	for key, values := range f.header {
+		dst[key] = values
+	}
+	f.w.WriteHeader(f.status)
+	f.w.Write(f.body)
+}
+
+// FlushError flushes the committed response so streamed responses keep flowing
+func (f *failoverWriter) FlushError() error {
+	if !f.committed {
+		return nil
+	}
+	return http.NewResponseController(f.w).Flush()
+}
+
+// SetWriteDeadline sets the committed response's write deadline so event
+// streams can clear it
+func (f *failoverWriter) SetWriteDeadline(deadline time.Time) error {
+	if !f.committed {
+		return nil
+	}
+	return http.NewResponseController(f.w).SetWriteDeadline(deadline)
+}
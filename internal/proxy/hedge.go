@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/panics"
+)
+
+// Attempt forwards one of the requests raced by Hedge, writing its response to w
+type Attempt func(ctx context.Context, w http.ResponseWriter) (int, error)
+
+// HedgeResult is the outcome of a hedged request
+type HedgeResult struct {
+	Status int
+	Err    error
+	Hedged bool // A second attempt was sent
+	Capped bool // The second attempt was skipped because the route had too many in flight
+	Winner int  // 0 when the primary attempt answered the client, 1 for the hedge
+}
+
+// Hedge sends primary and, when it hasn't received a response after delay,
+// the attempt returned by hedge as well. The first attempt to receive a
+// response has it copied to w and the other is cancelled, so the client gets
+// exactly one response. hedge may return nil to skip the second attempt, and
+// is also skipped while route has the configured maximum of hedges in flight.
+//
+// A failed attempt only answers the client when no other attempt is left.
+func (p *Proxy) Hedge(ctx context.Context, w http.ResponseWriter, route string, delay time.Duration, primary Attempt, hedge func() Attempt) HedgeResult {
+	rc := &race{w: w, done: make(chan *attempt, 2)}
+	rc.start(ctx, primary)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var result HedgeResult
+	var last, failed *attempt
+	for pending := 1; pending > 0; {
+		select {
+		case a := <-rc.done:
+			pending--
+			last = a
+			if a.failure != nil {
+				failed = a
+			}
+		case <-timer.C:
+			if !rc.open() {
+				continue
+			}
+			if !p.hedges.acquire(route) {
+				result.Capped = true
+				continue
+			}
+			next := hedge()
+			if next == nil || !rc.start(ctx, func(ctx context.Context, w http.ResponseWriter) (int, error) {
+				defer p.hedges.release(route)
+				return next(ctx, w)
+			}) {
+				p.hedges.release(route)
+				continue
+			}
+			result.Hedged = true
+			pending++
+		}
+	}
+
+	answered := rc.winner
+	if answered == nil && failed != nil {
+		// Every attempt failed: answer with the last upstream error
+		failed.failure(w)
+		answered = failed
+	}
+	if answered == nil {
+		answered = last
+	}
+	for _, a := range rc.attempts {
+		if a.panicked != nil && (a == answered || a.panicked != http.ErrAbortHandler) {
+			panic(a.panicked)
+		}
+	}
+
+	result.Status, result.Err, result.Winner = answered.status, answered.err, answered.index
+	return result
+}
+
+// hedgeLimiter counts the hedges in flight per route
+type hedgeLimiter struct {
+	max      int
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+func newHedgeLimiter(max int) *hedgeLimiter {
+	return &hedgeLimiter{max: max, inflight: make(map[string]int)}
+}
+
+func (l *hedgeLimiter) acquire(route string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.inflight[route] >= l.max {
+		return false
+	}
+	l.inflight[route]++
+	return true
+}
+
+func (l *hedgeLimiter) release(route string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inflight[route]--; l.inflight[route] <= 0 {
+		delete(l.inflight, route)
+	}
+}
+
+// race lets concurrent attempts compete to write one response
+type race struct {
+	w        http.ResponseWriter
+	done     chan *attempt
+	mu       sync.Mutex
+	winner   *attempt
+	attempts []*attempt
+}
+
+// start runs fn in its own goroutine unless a response was already committed
+func (rc *race) start(ctx context.Context, fn Attempt) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.winner != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	a := &attempt{race: rc, index: len(rc.attempts), header: make(http.Header), cancel: cancel}
+	rc.attempts = append(rc.attempts, a)
+
+	go func() {
+		defer func() {
+			// The reverse proxy aborts with a panic when copying the body
+			// fails; hand it to the handler goroutine instead of crashing
+			if v := recover(); v != nil {
+				a.panicked = panics.Wrap(v)
+			}
+			cancel()
+			rc.done <- a
+		}()
+		a.status, a.err = fn(ctx, a)
+	}()
+	return true
+}
+
+// open reports whether no attempt has committed a response yet
+func (rc *race) open() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.winner == nil
+}
+
+// commit makes a the winner if no other attempt got there first, cancelling the rest
+func (rc *race) commit(a *attempt) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.winner != nil {
+		return false
+	}
+	rc.winner = a
+	for _, other := range rc.attempts {
+		if other != a {
+			other.cancel()
+		}
+	}
+	return true
+}
+
+// attempt is the response writer of one raced request. Its response goes to
+// the client only if it arrives first; otherwise it is discarded.
+type attempt struct {
+	race     *race
+	index    int
+	header   http.Header
+	cancel   context.CancelFunc
+	decided  bool
+	won      bool
+	status   int
+	err      error
+	failure  func(http.ResponseWriter) // Writes the attempt's upstream error
+	panicked interface{}
+}
+
+// fail keeps the attempt's error response for when no other attempt answers
+func (a *attempt) fail(write func(http.ResponseWriter)) {
+	a.failure = write
+}
+
+func (a *attempt) Header() http.Header {
+	if a.won {
+		return a.race.w.Header()
+	}
+	return a.header
+}
+
+func (a *attempt) WriteHeader(code int) {
+	// Informational responses aren't raced
+	if a.decided || code < http.StatusOK {
+		return
+	}
+	a.decided = true
+	if a.won = a.race.commit(a); a.won {
+		dst := a.race.w.Header()
+		for key, values := range a.header {
+			dst[key] = values
+		}
+		a.race.w.WriteHeader(code)
+	}
+}
+
+func (a *attempt) Write(b []byte) (int, error) {
+	if !a.decided {
+		a.WriteHeader(http.StatusOK)
+	}
+	if !a.won {
+		return len(b), nil
+	}
+	return a.race.w.Write(b)
+}
+
+// FlushError flushes the winner's response so streamed responses keep flowing
+func (a *attempt) FlushError() error {
+	if !a.won {
+		return nil
+	}
+	return http.NewResponseController(a.race.w).Flush()
+}
+
+// SetWriteDeadline sets the winner's write deadline so event streams can clear it
+func (a *attempt) SetWriteDeadline(deadline time.Time) error {
+	if !a.won {
+		return nil
+	}
+	return http.NewResponseController(a.race.w).SetWriteDeadline(deadline)
+}
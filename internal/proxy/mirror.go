@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/buffering"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/internal/resolver"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// Mirror results recorded besides the response status class
+const (
+	MirrorError    = "error"
+	MirrorDropped  = "dropped"
+	MirrorTooLarge = "too_large"
+)
+
+// maxMirrorDrain bounds how much of a mirror response is read to reuse the connection
+const maxMirrorDrain = 64 << 10
+
+// mirrorJob is a copy of a client request to replay against a mirror target
+type mirrorJob struct {
+	route  string
+	target string
+	method string
+	header http.Header
+	body   []byte
+	hold   *buffering.Hold // The body's share of the buffering watermark
+}
+
+// Mirror replays copies of proxied requests to secondary targets on a bounded
+// worker pool. Mirror responses are discarded and never affect the client.
+type Mirror struct {
+	client   *http.Client
+	jobs     chan mirrorJob
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	maxBody  int64
+	dialer   *dialer
+	buffers  *buffering.Guard
+	metrics  *metrics.Metrics
+	log      *logger.Logger
+}
+
+// NewMirror creates a mirror and starts its workers. Mirror traffic uses its
+// own transport so a slow mirror can't exhaust the primary connection pool.
+func NewMirror(cfg *config.ProxyConfig, log *logger.Logger, m *metrics.Metrics) *Mirror {
+	workers := cfg.MirrorWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	dialer := newDialer(cfg)
+	mirror := &Mirror{
+		client: &http.Client{
+			Transport: newTransport(cfg, dialer, baseTLS(cfg, log)),
+			Timeout:   cfg.MirrorTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		jobs:    make(chan mirrorJob, cfg.MirrorQueueSize),
+		done:    make(chan struct{}),
+		maxBody: cfg.MirrorMaxBodyBytes,
+		dialer:  dialer,
+		metrics: m,
+		log:     log,
+	}
+
+	for i := 0; i < workers; i++ {
+		mirror.wg.Add(1)
+		go mirror.worker()
+	}
+
+	return mirror
+}
+
+// Sampled reports whether a request should be mirrored at the given percentage
+func Sampled(percent int) bool {
+	return percent >= 100 || (percent > 0 && rand.Intn(100) < percent)
+}
+
+// SetResolver resolves mirror target hostnames through r
+func (m *Mirror) SetResolver(r *resolver.Cache) {
+	m.dialer.resolver.Store(r)
+}
+
+// SetBuffers bounds the request bodies buffered for mirroring with g
+func (m *Mirror) SetBuffers(g *buffering.Guard) {
+	m.buffers = g
+}
+
+// Submit queues a copy of r for the mirror target. The body is buffered up to
+// the size cap and r.Body is replaced so the primary request still reads all
+// of it. Submit never blocks: the copy is dropped when the queue is full, or
+// when buffered bodies exceed the watermark.
+func (m *Mirror) Submit(route, target string, r *http.Request) {
+	body, hold, err := m.captureBody(r)
+	if err != nil {
+		result := MirrorTooLarge
+		if errors.Is(err, buffering.ErrWatermark) {
+			result = MirrorDropped
+		}
+		m.record(route, result)
+		return
+	}
+
+	job := mirrorJob{
+		route:  route,
+		target: target,
+		method: r.Method,
+		header: r.Header.Clone(),
+		body:   body,
+		hold:   hold,
+	}
+
+	select {
+	case <-m.done:
+		hold.Release()
+		return
+	default:
+	}
+
+	select {
+	case m.jobs <- job:
+	default:
+		hold.Release()
+		m.record(route, MirrorDropped)
+	}
+}
+
+// Stop stops the workers, abandoning queued copies
+func (m *Mirror) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.done)
+	})
+	m.wg.Wait()
+}
+
+// captureBody reads the request body up to the size cap and re-wraps it for
+// the primary request, returning it with the memory it holds until the copy
+// is sent. It fails when the body can't be mirrored: buffering.ErrWatermark
+// when buffered bodies take too much memory, otherwise because it is too
+// large or couldn't be read.
+func (m *Mirror) captureBody(r *http.Request) ([]byte, *buffering.Hold, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil, nil
+	}
+
+	hold, err := m.buffers.Acquire(buffering.FeatureMirror, r.ContentLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	original := r.Body
+	counted := hold.Reader(original)
+	limit := m.buffers.Limit(m.maxBody)
+	buf, err := io.ReadAll(io.LimitReader(counted, limit+1))
+	counted.Stop()
+	if err == nil && int64(len(buf)) > limit {
+		err = buffering.ErrTooLarge
+	}
+	if err != nil {
+		// Hand the primary what was read followed by the rest of the stream
+		hold.Release()
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), original), original}
+		return nil, nil, err
+	}
+
+	r.Body = readCloser{bytes.NewReader(buf), original}
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return buf, hold, nil
+}
+
+// worker replays queued copies until the mirror stops
+func (m *Mirror) worker() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case job := <-m.jobs:
+			m.replay(job)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// replay sends a copy to the mirror target and records its status and latency
+func (m *Mirror) replay(job mirrorJob) {
+	defer job.hold.Release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Abort in-flight copies on shutdown
+	go func() {
+		select {
+		case <-m.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, job.method, job.target, bytes.NewReader(job.body))
+	if err != nil {
+		m.log.Warnf("Invalid mirror request for %s: %v", job.route, err)
+		m.record(job.route, MirrorError)
+		return
+	}
+	req.Header = job.header
+
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	if m.metrics != nil {
+		m.metrics.MirrorDuration.WithLabelValues(job.route).Observe(time.Since(start).Seconds())
+	}
+	if err != nil {
+		m.log.Debugf("Mirror request to %s failed: %v", job.target, err)
+		m.record(job.route, MirrorError)
+		return
+	}
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxMirrorDrain))
+	resp.Body.Close()
+	m.record(job.route, metrics.StatusClass(resp.StatusCode))
+}
+
+// record counts a mirror result
+func (m *Mirror) record(route, result string) {
+	if m.metrics != nil {
+		m.metrics.MirrorRequests.WithLabelValues(route, result).Inc()
+	}
+}
+
+// readCloser reads from a replacement reader and closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -2,165 +2,578 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	stdlog "log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/buffering"
+	"github.com/zakirkun/isekai/internal/deadline"
+	"github.com/zakirkun/isekai/internal/egress"
+	"github.com/zakirkun/isekai/internal/etag"
+	"github.com/zakirkun/isekai/internal/inflight"
+	"github.com/zakirkun/isekai/internal/resolver"
+	"github.com/zakirkun/isekai/internal/stream"
+	"github.com/zakirkun/isekai/internal/transform"
+	"github.com/zakirkun/isekai/internal/upstreamauth"
+	"github.com/zakirkun/isekai/internal/upstreamtls"
+	"github.com/zakirkun/isekai/pkg/config"
 	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
 var tracer = otel.Tracer("isekai-proxy")
 
+// ResponseHook inspects or modifies an upstream response before it is copied
+// to the client. Returning an error aborts the response with a 502.
+type ResponseHook func(*http.Response) error
+
+// UpstreamError is returned when the upstream could not be reached or its
+// response was rejected. The JSON error response has already been written.
+type UpstreamError struct {
+	Status int
+	Err    error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream request failed (%d): %v", e.Status, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// StatusClientClosed is recorded for requests whose client went away before
+// the response was complete, following nginx's 499
+const StatusClientClosed = 499
+
+// ErrClientClosed is returned when the client went away during a forwarded
+// request. It wraps context.Canceled, so the circuit breaker and outlier
+// detection don't hold it against the upstream.
+var ErrClientClosed = fmt.Errorf("client closed request: %w", context.Canceled)
+
+// clientGone reports whether the client's request context was cancelled for
+// any reason but the request timeout or an administrator cancelling it
+func clientGone(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled) && !stream.TimedOut(ctx) && !inflight.Cancelled(ctx)
+}
+
 // Proxy handles request forwarding
 type Proxy struct {
-	client  *http.Client
-	log     *logger.Logger
-	timeout time.Duration
-}
-
-// New creates a new proxy instance
-func New(timeout time.Duration, log *logger.Logger) *Proxy {
-	return &Proxy{
-		client: &http.Client{
-			Timeout: timeout,
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				if len(via) >= 10 {
-					return fmt.Errorf("too many redirects")
-				}
-				return nil
-			},
-		},
-		log:     log,
-		timeout: timeout,
-	}
-}
-
-// Forward forwards a request to the target URL
-func (p *Proxy) Forward(ctx context.Context, targetURL string, r *http.Request) (*http.Response, error) {
-	// Start tracing span
-	ctx, span := tracer.Start(ctx, "proxy.Forward",
-		trace.WithAttributes(
-			attribute.String("http.method", r.Method),
-			attribute.String("http.url", r.URL.String()),
-			attribute.String("target.url", targetURL),
-			attribute.String("client.ip", r.RemoteAddr),
-		),
-	)
-	defer span.End()
+	reverseProxy     *httputil.ReverseProxy
+	log              *logger.Logger
+	timeout          time.Duration
+	transformMaxBody int64
+	signMaxBody      int64
+	stats            transportStats
+	hooksMu          sync.RWMutex
+	hooks            []ResponseHook
+	hedges           *hedgeLimiter
+	dialer           *dialer
+	deadlineHeader   string
+	deadlineGRPC     bool
+	buffers          *buffering.Guard
+}
 
-	// Create a new request with context
-	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, r.Body)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "failed to create request")
-		return nil, fmt.Errorf("failed to create request: %w", err)
+type forwardKey struct{}
+
+type transformKey struct{}
+
+type preserveHostKey struct{}
+
+// forward carries per-request state between ForwardAndCopy and the reverse proxy hooks
+type forward struct {
+	target    *url.URL
+	span      trace.Span
+	transform *transform.Rules
+	tls       *upstreamtls.Profile
+	egress    *egress.Profile
+	h2c       bool
+	preserve  bool // Keeps the client's Host header
+	auth      *upstreamauth.Profile
+	bodyHash  string          // Signed in hmac mode
+	authErr   error           // Failing to apply auth fails the round trip
+	attempt   *attempt        // Set when the request is one of a hedged pair
+	client    context.Context // The client's request context
+	err       *UpstreamError
+}
+
+// New creates a new proxy instance with a transport tuned from cfg
+func New(timeout time.Duration, cfg *config.ProxyConfig, log *logger.Logger) *Proxy {
+	p := &Proxy{
+		log:              log,
+		timeout:          timeout,
+		transformMaxBody: cfg.TransformMaxBody,
+		signMaxBody:      cfg.SignMaxBody,
+		hedges:           newHedgeLimiter(cfg.HedgeMaxInflight),
+		dialer:           newDialer(cfg),
+		deadlineHeader:   cfg.DeadlineHeader,
+		deadlineGRPC:     cfg.DeadlineGRPC,
+	}
+
+	if cfg.InsecureSkipVerify {
+		log.Warnf("PROXY_INSECURE_SKIP_VERIFY is set: upstream TLS certificates are NOT verified, so any upstream can be impersonated. Never use it in production.")
+	}
+	base := baseTLS(cfg, log)
+
+	p.reverseProxy = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      &routeTransport{shared: newTransport(cfg, p.dialer, base), h2c: newH2CTransport(p.dialer), pool: newTLSPool(cfg, base, p.dialer, log)},
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.handleError,
+		ErrorLog:       stdlog.New(io.Discard, "", 0),
+	}
+	// Copy bodies with pooled buffers rather than a new one per response
+	if cfg.CopyBufferSize > 0 {
+		p.reverseProxy.BufferPool = buffering.NewPool(cfg.CopyBufferSize)
+	}
+
+	return p
+}
+
+// OnResponse registers a hook run on every upstream response, in registration order
+func (p *Proxy) OnResponse(hook ResponseHook) {
+	p.hooksMu.Lock()
+	defer p.hooksMu.Unlock()
+	p.hooks = append(p.hooks, hook)
+}
+
+// SetResolver resolves upstream hostnames through r instead of on every new
+// connection
+func (p *Proxy) SetResolver(r *resolver.Cache) {
+	p.dialer.resolver.Store(r)
+}
+
+// Resolver returns the DNS cache set with SetResolver, if any
+func (p *Proxy) Resolver() *resolver.Cache {
+	return p.dialer.resolver.Load()
+}
+
+// SetBuffers bounds the response bodies buffered for transforms with g,
+// shared with the other features buffering whole bodies
+func (p *Proxy) SetBuffers(g *buffering.Guard) {
+	p.buffers = g
+}
+
+// Buffers returns the guard set with SetBuffers, if any
+func (p *Proxy) Buffers() *buffering.Guard {
+	return p.buffers
+}
+
+// WithTransform returns a context whose forwarded response body is rewritten by rules
+func WithTransform(ctx context.Context, rules *transform.Rules) context.Context {
+	return context.WithValue(ctx, transformKey{}, rules)
+}
+
+// WithPreserveHost returns a context whose forwarded request keeps the
+// client's Host header instead of the target's
+func WithPreserveHost(ctx context.Context) context.Context {
+	return context.WithValue(ctx, preserveHostKey{}, true)
+}
+
+// TransformRequest rewrites the request body with rules, up to the configured size cap
+func (p *Proxy) TransformRequest(r *http.Request, rules *transform.Rules) error {
+	return rules.TransformRequest(r, p.transformMaxBody)
+}
+
+// rewrite points the outbound request at the route target, sets the
+// X-Forwarded headers and propagates the trace context
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	f := pr.In.Context().Value(forwardKey{}).(*forward)
+
+	target := *f.target
+	pr.Out.URL = &target
+	pr.Out.Host = ""
+	if f.preserve {
+		pr.Out.Host = pr.In.Host
 	}
+	pr.SetXForwarded()
 
-	// Copy headers from original request
-	req.Header = r.Header.Clone()
+	// Compressed event streams are buffered by the encoder; ask for them plain
+	if stream.Accepts(pr.In) {
+		pr.Out.Header.Set("Accept-Encoding", "identity")
+	}
+
+	// Tell the upstream how long it has, replacing what the client sent
+	p.setDeadline(pr)
 
 	// Inject trace context into headers for propagation
-	otel.GetTextMapPropagator().Inject(ctx, NewHeaderCarrier(req.Header))
+	otel.GetTextMapPropagator().Inject(pr.Out.Context(), NewHeaderCarrier(pr.Out.Header))
 
-	// Set X-Forwarded headers
-	req.Header.Set("X-Forwarded-For", r.RemoteAddr)
-	req.Header.Set("X-Forwarded-Proto", "http")
-	if r.TLS != nil {
-		req.Header.Set("X-Forwarded-Proto", "https")
+	// Prove to the upstream that the request came through the gateway
+	if f.auth != nil {
+		claims, _ := auth.ClaimsFromContext(pr.In.Context())
+		if err := f.auth.Apply(pr.Out, f.bodyHash, claims, time.Now()); err != nil {
+			f.authErr = fmt.Errorf("failed to apply upstream auth: %w", err)
+		}
 	}
-	req.Header.Set("X-Forwarded-Host", r.Host)
 
-	// Execute the request
-	startTime := time.Now()
-	resp, err := p.client.Do(req)
-	duration := time.Since(startTime)
+	// Record connection reuse for the transport stats and the peer on the span
+	ctx := httptrace.WithClientTrace(pr.Out.Context(), p.stats.trace())
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{GotConn: f.gotConn})
+	pr.Out = pr.Out.WithContext(ctx)
+}
 
-	// Record response metrics in span
-	span.SetAttributes(
-		attribute.Int64("http.response_time_ms", duration.Milliseconds()),
-	)
+// setDeadline sets the remaining latency budget of the request on the
+// outbound request, in the deadline header and in grpc-timeout for gRPC
+// requests. Values the client sent are always removed: a route trusting them
+// has already folded them into the request's deadline.
+func (p *Proxy) setDeadline(pr *httputil.ProxyRequest) {
+	grpc := p.deadlineGRPC && deadline.IsGRPC(pr.Out.Header)
+	if p.deadlineHeader != "" {
+		pr.Out.Header.Del(p.deadlineHeader)
+	}
+	if grpc {
+		pr.Out.Header.Del(deadline.GRPCHeader)
+	}
+
+	remaining, ok := stream.Remaining(pr.In.Context())
+	if !ok {
+		return
+	}
+	remaining = max(remaining, 0)
+	if p.deadlineHeader != "" {
+		pr.Out.Header.Set(p.deadlineHeader, deadline.FormatMillis(remaining))
+	}
+	if grpc {
+		pr.Out.Header.Set(deadline.GRPCHeader, deadline.FormatGRPC(remaining))
+	}
+}
 
+// gotConn records the address of the upstream connection on the span
+func (f *forward) gotConn(info httptrace.GotConnInfo) {
+	host, port, err := net.SplitHostPort(info.Conn.RemoteAddr().String())
 	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "failed to forward request")
-		p.log.Errorf("Failed to forward request to %s: %v (took %v)", targetURL, err, duration)
-		return nil, fmt.Errorf("failed to forward request: %w", err)
+		return
+	}
+	f.span.SetAttributes(semconv.NetworkPeerAddress(host))
+	if n, err := strconv.Atoi(port); err == nil {
+		f.span.SetAttributes(semconv.NetworkPeerPort(n))
 	}
+}
 
-	// Record status code
-	span.SetAttributes(
-		attribute.Int("http.status_code", resp.StatusCode),
-	)
+// modifyResponse records the upstream status, runs the registered hooks and
+// applies the route's response transform. Conditional requests and the
+// upstream's validators otherwise pass through untouched.
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	f, ok := resp.Request.Context().Value(forwardKey{}).(*forward)
+	if ok {
+		f.span.SetAttributes(
+			semconv.HTTPResponseStatusCode(resp.StatusCode),
+			semconv.NetworkProtocolVersion(fmt.Sprintf("%d.%d", resp.ProtoMajor, resp.ProtoMinor)),
+		)
+		SetSpanStatus(f.span, resp.StatusCode)
+	}
 
-	if resp.StatusCode >= 500 {
-		span.SetStatus(codes.Error, fmt.Sprintf("server error: %d", resp.StatusCode))
-	} else if resp.StatusCode >= 400 {
-		span.SetStatus(codes.Error, fmt.Sprintf("client error: %d", resp.StatusCode))
-	} else {
-		span.SetStatus(codes.Ok, "success")
+	// Event streams run for as long as the upstream keeps them open
+	if stream.IsEventStream(resp.Header) {
+		stream.Lift(resp.Request.Context())
+		if ok {
+			f.span.SetAttributes(attribute.Bool("http.event_stream", true))
+		}
 	}
 
-	p.log.Debugf("Forwarded %s %s to %s - Status: %d (took %v)",
-		r.Method, r.URL.Path, targetURL, resp.StatusCode, duration)
+	p.hooksMu.RLock()
+	defer p.hooksMu.RUnlock()
 
-	return resp, nil
-}
+	for _, hook := range p.hooks {
+		if err := hook(resp); err != nil {
+			return err
+		}
+	}
 
-// CopyResponse copies the response to the response writer
-func (p *Proxy) CopyResponse(w http.ResponseWriter, resp *http.Response) error {
-	// Copy headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+	if ok && f.transform != nil {
+		// The rewritten body no longer matches the upstream's byte for byte,
+		// so its entity tag can only be weak; 304s get the same tag so
+		// clients keep matching it
+		if f.transform.Response != nil {
+			if tag := resp.Header.Get("ETag"); tag != "" {
+				resp.Header.Set("ETag", etag.Weak(tag))
+			}
 		}
+		return p.transformResponse(f.transform, resp)
 	}
+	return nil
+}
 
-	// Write status code
-	w.WriteHeader(resp.StatusCode)
+// transformResponse rewrites the response body with rules while the gateway
+// can buffer it, counting the bytes read into memory until the client has
+// been sent the body. Bodies over the limit, or arriving while buffered
+// bodies exceed the watermark, pass through like bodies too large for the
+// transform.
+func (p *Proxy) transformResponse(rules *transform.Rules, resp *http.Response) error {
+	if rules.Response == nil || !transform.IsJSON(resp.Header.Get("Content-Type")) || resp.Body == nil {
+		return nil
+	}
 
-	// Copy body
-	_, err := io.Copy(w, resp.Body)
+	hold, err := p.buffers.Acquire(buffering.FeatureTransform, resp.ContentLength)
 	if err != nil {
-		return fmt.Errorf("failed to copy response body: %w", err)
+		return rules.Skip(transform.DirectionResponse, err)
 	}
+	body := hold.Reader(resp.Body)
+	resp.Body = body
+	err = rules.TransformResponse(resp, p.buffers.Limit(p.transformMaxBody))
+	body.Stop()
+	resp.Body = hold.Body(resp.Body)
+	return err
+}
 
-	return nil
+// handleError writes the JSON error response and records the failure so the
+// circuit breaker sees it
+func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	code := response.CodeBadGateway
+	message := "Bad gateway"
+	var transformErr *transform.Error
+	// The request deadline cancels the context rather than expiring it
+	if !errors.Is(err, context.DeadlineExceeded) && stream.TimedOut(r.Context()) {
+		err = context.DeadlineExceeded
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+		code = response.CodeUpstreamTimeout
+		message = "Upstream timed out"
+	} else if inflight.Cancelled(r.Context()) {
+		status = http.StatusServiceUnavailable
+		code = response.CodeRequestCancelled
+		message = "Request cancelled"
+	} else if errors.As(err, &transformErr) {
+		code = response.CodeTransformFailed
+		message = "Response body could not be transformed"
+	} else if TLSVerifyFailed(err) {
+		code = response.CodeUpstreamTLS
+		message = "Upstream certificate could not be verified"
+	}
+
+	target := r.URL.String()
+	f, ok := r.Context().Value(forwardKey{}).(*forward)
+
+	// Nobody is left to answer when the client went away
+	if ok && clientGone(f.client) {
+		f.err = &UpstreamError{Status: StatusClientClosed, Err: ErrClientClosed}
+		f.span.SetStatus(codes.Error, "client closed request")
+		p.log.Debugf("Request to %s cancelled by the client: %v", f.target, err)
+		if f.attempt != nil {
+			f.attempt.fail(func(http.ResponseWriter) {})
+		}
+		return
+	}
+
+	if ok {
+		target = f.target.String()
+		f.err = &UpstreamError{Status: status, Err: err}
+		f.span.RecordError(err)
+		f.span.SetStatus(codes.Error, "failed to forward request")
+	}
+
+	// Requests cancelled by the client or a faster hedge aren't upstream faults
+	if errors.Is(err, context.Canceled) {
+		p.log.Debugf("Request to %s cancelled: %v", target, err)
+	} else if code == response.CodeUpstreamTLS {
+		p.log.Errorf("Failed to forward request to %s: tls_verify: %v", target, err)
+	} else {
+		p.log.Errorf("Failed to forward request to %s: %v", target, err)
+	}
+
+	// A hedged attempt's error only reaches the client if the other fails too
+	if ok && f.attempt != nil {
+		f.attempt.fail(func(w http.ResponseWriter) {
+			response.ErrorFor(w, r, status, code, message)
+		})
+		return
+	}
+	response.ErrorFor(w, r, status, code, message)
 }
 
-// ForwardAndCopy forwards a request and copies the response
-func (p *Proxy) ForwardAndCopy(ctx context.Context, w http.ResponseWriter, r *http.Request, targetURL string) error {
+// ForwardAndCopy forwards a request, copies the response and returns the upstream status code
+func (p *Proxy) ForwardAndCopy(ctx context.Context, w http.ResponseWriter, r *http.Request, targetURL string) (int, error) {
 	// Start tracing span for combined operation
 	ctx, span := tracer.Start(ctx, "proxy.ForwardAndCopy",
+		trace.WithSpanKind(trace.SpanKindClient),
 		trace.WithAttributes(
-			attribute.String("http.method", r.Method),
-			attribute.String("http.url", r.URL.String()),
-			attribute.String("target.url", targetURL),
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLFull(targetURL),
 		),
 	)
 	defer span.End()
 
-	resp, err := p.Forward(ctx, targetURL, r)
+	target, err := url.Parse(targetURL)
 	if err != nil {
 		span.RecordError(err)
-		span.SetStatus(codes.Error, "forward failed")
-		return err
+		span.SetStatus(codes.Error, "invalid target url")
+		return 0, fmt.Errorf("invalid target url: %w", err)
 	}
-	defer resp.Body.Close()
+	span.SetAttributes(serverAttributes(target)...)
+	inflight.SetUpstream(ctx, targetURL)
 
-	err = p.CopyResponse(w, resp)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "copy response failed")
-	} else {
-		span.SetStatus(codes.Ok, "success")
+	if p.timeout > 0 {
+		var deadline *stream.Deadline
+		ctx, deadline = stream.WithDeadline(ctx, p.timeout)
+		defer deadline.Stop()
 	}
 
-	return err
+	rules, _ := ctx.Value(transformKey{}).(*transform.Rules)
+	profile, _ := ctx.Value(tlsKey{}).(*upstreamtls.Profile)
+	h2c, _ := ctx.Value(h2cKey{}).(bool)
+	f := &forward{target: target, span: span, transform: rules, tls: profile, egress: egressProfile(ctx), h2c: h2c, client: r.Context()}
+	if f.auth, _ = ctx.Value(upstreamAuthKey{}).(*upstreamauth.Profile); f.auth != nil && f.auth.Mode == upstreamauth.ModeHMAC {
+		f.bodyHash = p.bodyHash(r)
+	}
+	f.preserve, _ = ctx.Value(preserveHostKey{}).(bool)
+	f.attempt, _ = w.(*attempt)
+	ctx = context.WithValue(ctx, forwardKey{}, f)
+
+	// Failing to write to the client cancels the upstream request
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	startTime := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, abort: cancel}
+	aborted := p.serve(recorder, r.WithContext(ctx))
+	duration := time.Since(startTime)
+
+	// A response cut short because the client went away isn't an upstream
+	// failure; any other aborted response is passed on to the server
+	if aborted || recorder.writeErr != nil {
+		if clientGone(r.Context()) || (recorder.writeErr != nil && !stream.TimedOut(r.Context()) && !inflight.Cancelled(r.Context())) {
+			f.err = &UpstreamError{Status: StatusClientClosed, Err: ErrClientClosed}
+			span.SetStatus(codes.Error, "client closed request")
+			p.log.Debugf("Client went away during %s %s from %s", r.Method, r.URL.Path, targetURL)
+		} else if aborted {
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if f.err != nil {
+		span.SetAttributes(semconv.ErrorTypeKey.String(errorType(f.err)))
+		return f.err.Status, f.err
+	}
+
+	p.log.Debugf("Forwarded %s %s to %s - Status: %d (took %v)",
+		r.Method, r.URL.Path, targetURL, recorder.status, duration)
+
+	return recorder.status, nil
+}
+
+// SetSpanStatus marks span as failed for a 5xx response. Following the OTel
+// HTTP conventions a 4xx is the caller's problem, not the span's: it is
+// recorded only in the status code attribute.
+func SetSpanStatus(span trace.Span, status int) {
+	if status >= 500 {
+		span.SetAttributes(semconv.ErrorTypeKey.String(strconv.Itoa(status)))
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// serverAttributes describes the upstream a request is sent to
+func serverAttributes(target *url.URL) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{semconv.ServerAddress(target.Hostname()), semconv.URLScheme(target.Scheme)}
+
+	port := target.Port()
+	if port == "" {
+		switch target.Scheme {
+		case "http", "ws":
+			port = "80"
+		case "https", "wss":
+			port = "443"
+		}
+	}
+	if n, err := strconv.Atoi(port); err == nil {
+		attrs = append(attrs, semconv.ServerPort(n))
+	}
+	return attrs
+}
+
+// errorType names a failed forward for the error.type attribute
+func errorType(err *UpstreamError) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	if TLSVerifyFailed(err) {
+		return "tls_verify"
+	}
+	return fmt.Sprintf("%T", errors.Unwrap(err))
+}
+
+// Stats returns transport-level statistics for proxied requests
+func (p *Proxy) Stats() Stats {
+	return p.stats.snapshot()
+}
+
+// serve runs the reverse proxy and reports whether it aborted a response
+// that had already started
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request) (aborted bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				panic(err)
+			}
+			aborted = true
+		}
+	}()
+	p.reverseProxy.ServeHTTP(w, r)
+	return false
+}
+
+// statusRecorder captures the final status code written to the client and
+// the first error writing to it
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	writeErr error
+	abort    context.CancelFunc // Cancels the upstream request
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	// 1xx informational responses are followed by the final status
+	streaming := false
+	if r.status == 0 && code >= 200 {
+		r.status = code
+		if streaming = stream.IsEventStream(r.Header()); streaming {
+			// Ask proxies in front of the gateway not to buffer the stream
+			r.Header().Set("X-Accel-Buffering", "no")
+		}
+	}
+	r.ResponseWriter.WriteHeader(code)
+
+	// Event streams outlive the server's write timeout
+	if streaming {
+		http.NewResponseController(r.ResponseWriter).SetWriteDeadline(time.Time{})
+	}
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	if err != nil && r.writeErr == nil {
+		r.writeErr = err
+		r.abort()
+	}
+	return n, err
+}
+
+// Unwrap exposes the underlying writer for flushing and connection upgrades
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
 }
 
 // HeaderCarrier adapts http.Header to satisfy the TextMapCarrier interface
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/egress"
+	"github.com/zakirkun/isekai/internal/upstreamtls"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// maxTLSTransports bounds the transports kept for upstream TLS profiles
+const maxTLSTransports = 64
+
+type tlsKey struct{}
+
+type h2cKey struct{}
+
+// WithH2C returns a context whose forwarded request uses HTTP/2 without TLS
+func WithH2C(ctx context.Context) context.Context {
+	return context.WithValue(ctx, h2cKey{}, true)
+}
+
+// WithTLS returns a context whose forwarded request connects with the TLS profile
+func WithTLS(ctx context.Context, profile *upstreamtls.Profile) context.Context {
+	return context.WithValue(ctx, tlsKey{}, profile)
+}
+
+type egressKey struct{}
+
+// WithEgress returns a context whose forwarded request connects through the
+// egress profile's proxy instead of the global one
+func WithEgress(ctx context.Context, profile *egress.Profile) context.Context {
+	return context.WithValue(ctx, egressKey{}, profile)
+}
+
+// egressProfile returns the egress profile set with WithEgress, if any
+func egressProfile(ctx context.Context) *egress.Profile {
+	profile, _ := ctx.Value(egressKey{}).(*egress.Profile)
+	return profile
+}
+
+// tlsPool keeps one transport per upstream TLS and egress profile so
+// connections are still reused, and rebuilds a transport when its
+// certificate files change
+type tlsPool struct {
+	cfg        *config.ProxyConfig
+	base       *tls.Config
+	dialer     *dialer
+	log        *logger.Logger
+	mu         sync.Mutex
+	transports map[string]*tlsTransport
+}
+
+// tlsTransport is a pooled transport and the file state it was built from
+type tlsTransport struct {
+	transport *http.Transport
+	stamp     string
+	checked   time.Time
+}
+
+func newTLSPool(cfg *config.ProxyConfig, base *tls.Config, dialer *dialer, log *logger.Logger) *tlsPool {
+	return &tlsPool{
+		cfg:        cfg,
+		base:       base,
+		dialer:     dialer,
+		log:        log,
+		transports: make(map[string]*tlsTransport),
+	}
+}
+
+// get returns the transport for a TLS profile, an egress profile or both,
+// either of which may be nil. A TLS profile whose files changed since the
+// last check gets a new transport; if the new files can't be loaded the
+// previous transport stays in use.
+func (p *tlsPool) get(profile *upstreamtls.Profile, egressProfile *egress.Profile) (*http.Transport, error) {
+	var key, stamp string
+	if profile != nil {
+		key = profile.Key()
+	}
+	if egressProfile != nil {
+		key += "|" + egressProfile.Key()
+	}
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry := p.transports[key]
+	if entry != nil && now.Sub(entry.checked) < p.cfg.TLSReloadInterval {
+		return entry.transport, nil
+	}
+
+	if profile != nil {
+		stamp = profile.FileStamp()
+	}
+	if entry != nil && stamp == entry.stamp {
+		entry.checked = now
+		return entry.transport, nil
+	}
+
+	transport := newTransport(p.cfg, p.dialer, p.base)
+	if profile != nil {
+		tlsConfig, err := profile.ClientConfig(p.base)
+		if err != nil {
+			if entry == nil {
+				return nil, err
+			}
+			p.log.Warnf("Keeping previous upstream TLS configuration: %v", err)
+			entry.checked = now
+			return entry.transport, nil
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if egressProfile != nil {
+		proxy, err := egressProfile.ProxyFunc()
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = proxy
+	}
+
+	if entry != nil {
+		p.log.Infof("Reloaded upstream TLS configuration")
+		entry.transport.CloseIdleConnections()
+	} else if len(p.transports) >= maxTLSTransports {
+		p.evictOldest()
+	}
+	p.transports[key] = &tlsTransport{transport: transport, stamp: stamp, checked: now}
+
+	return transport, nil
+}
+
+// evictOldest drops the transport checked longest ago
+func (p *tlsPool) evictOldest() {
+	var oldestKey string
+	var oldest *tlsTransport
+	for key, entry := range p.transports {
+		if oldest == nil || entry.checked.Before(oldest.checked) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if oldest != nil {
+		oldest.transport.CloseIdleConnections()
+		delete(p.transports, oldestKey)
+	}
+}
+
+// routeTransport sends requests through the h2c transport or the transport
+// of their route's TLS and egress profiles, or the shared transport when the
+// route has none of them
+type routeTransport struct {
+	shared http.RoundTripper
+	h2c    http.RoundTripper
+	pool   *tlsPool
+}
+
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, ok := req.Context().Value(forwardKey{}).(*forward)
+	if ok && f.authErr != nil {
+		return nil, f.authErr
+	}
+	if ok && f.h2c {
+		return t.h2c.RoundTrip(req)
+	}
+	if ok && (f.tls != nil || f.egress != nil) {
+		transport, err := t.pool.get(f.tls, f.egress)
+		if err != nil {
+			return nil, err
+		}
+		return transport.RoundTrip(req)
+	}
+	return t.shared.RoundTrip(req)
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/egress"
+	"github.com/zakirkun/isekai/internal/resolver"
+	"github.com/zakirkun/isekai/internal/upstreamtls"
+	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/logger"
+	"golang.org/x/net/http2"
+)
+
+// Stats holds transport-level counters collected from request traces
+type Stats struct {
+	Requests       int64   `json:"requests"`
+	ConnsCreated   int64   `json:"conns_created"`
+	ConnsReused    int64   `json:"conns_reused"`
+	IdleConnsTaken int64   `json:"idle_conns_taken"`
+	DNSLookups     int64   `json:"dns_lookups"`
+	DialErrors     int64   `json:"dial_errors"`
+	TLSHandshakes  int64   `json:"tls_handshakes"`
+	TLSErrors      int64   `json:"tls_errors"`
+	ReuseRatio     float64 `json:"reuse_ratio"`
+}
+
+// transportStats counts connection events across all proxied requests
+type transportStats struct {
+	requests       atomic.Int64
+	connsCreated   atomic.Int64
+	connsReused    atomic.Int64
+	idleConnsTaken atomic.Int64
+	dnsLookups     atomic.Int64
+	dialErrors     atomic.Int64
+	tlsHandshakes  atomic.Int64
+	tlsErrors      atomic.Int64
+}
+
+// dialer connects to upstreams, resolving their hostnames through the DNS
+// cache once one is set
+type dialer struct {
+	net.Dialer
+	resolver atomic.Pointer[resolver.Cache]
+}
+
+func newDialer(cfg *config.ProxyConfig) *dialer {
+	return &dialer{Dialer: net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}}
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if r := d.resolver.Load(); r != nil {
+		return r.Dial(ctx, &d.Dialer, network, addr)
+	}
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+// newTransport builds an HTTP transport tuned from the proxy configuration,
+// connecting to TLS upstreams with base
+func newTransport(cfg *config.ProxyConfig, dialer *dialer, base *tls.Config) *http.Transport {
+	transport := &http.Transport{
+		Proxy:                  defaultProxy(cfg),
+		OnProxyConnectResponse: egress.CheckConnect,
+		DialContext:            dialer.DialContext,
+		MaxIdleConns:           cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:    cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:        cfg.MaxConnsPerHost,
+		IdleConnTimeout:        cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:    cfg.TLSHandshakeTimeout,
+		DisableKeepAlives:      cfg.DisableKeepAlives,
+		ForceAttemptHTTP2:      cfg.EnableHTTP2,
+		ExpectContinueTimeout:  1 * time.Second,
+		TLSClientConfig:        base.Clone(),
+	}
+
+	return transport
+}
+
+// baseTLS returns the TLS configuration of upstream connections from the
+// proxy configuration. CA bundles that can't be loaded, which the
+// configuration was validated against at load, are left out.
+func baseTLS(cfg *config.ProxyConfig, log *logger.Logger) *tls.Config {
+	base, err := upstreamtls.Base(cfg.CAFiles, cfg.TLSMinVersion, cfg.InsecureSkipVerify)
+	if err != nil {
+		log.Errorf("Failed to load upstream TLS configuration, using the system roots: %v", err)
+		version, _ := upstreamtls.ParseVersion(cfg.TLSMinVersion)
+		base = &tls.Config{MinVersion: max(version, tls.VersionTLS12), InsecureSkipVerify: cfg.InsecureSkipVerify}
+	}
+	return base
+}
+
+// TLSVerifyFailed reports whether err is an upstream's certificate failing
+// verification, as opposed to the connection or handshake failing
+func TLSVerifyFailed(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &verifyErr) || errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// defaultProxy returns the egress proxy of upstream connections: the one in
+// PROXY_EGRESS_URL, or those in HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+func defaultProxy(cfg *config.ProxyConfig) func(*http.Request) (*url.URL, error) {
+	if cfg.EgressURL == "" {
+		return http.ProxyFromEnvironment
+	}
+	profile := &egress.Profile{
+		URL:      cfg.EgressURL,
+		Username: cfg.EgressUsername,
+		Password: cfg.EgressPassword,
+		NoProxy:  cfg.EgressNoProxy,
+	}
+	proxy, err := profile.ProxyFunc()
+	if err != nil {
+		// The configuration was validated at load
+		return http.ProxyFromEnvironment
+	}
+	return proxy
+}
+
+// newH2CTransport builds a transport for plaintext upstreams that speak
+// HTTP/2 with prior knowledge, as gRPC servers without TLS do
+func newH2CTransport(dialer *dialer) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// trace returns a client trace that records connection events
+func (s *transportStats) trace() *httptrace.ClientTrace {
+	s.requests.Add(1)
+
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				s.connsReused.Add(1)
+			} else {
+				s.connsCreated.Add(1)
+			}
+			if info.WasIdle {
+				s.idleConnsTaken.Add(1)
+			}
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			s.dnsLookups.Add(1)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				s.dialErrors.Add(1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			s.tlsHandshakes.Add(1)
+			if err != nil {
+				s.tlsErrors.Add(1)
+			}
+		},
+	}
+}
+
+// snapshot returns the current counter values
+func (s *transportStats) snapshot() Stats {
+	stats := Stats{
+		Requests:       s.requests.Load(),
+		ConnsCreated:   s.connsCreated.Load(),
+		ConnsReused:    s.connsReused.Load(),
+		IdleConnsTaken: s.idleConnsTaken.Load(),
+		DNSLookups:     s.dnsLookups.Load(),
+		DialErrors:     s.dialErrors.Load(),
+		TLSHandshakes:  s.tlsHandshakes.Load(),
+		TLSErrors:      s.tlsErrors.Load(),
+	}
+
+	if total := stats.ConnsCreated + stats.ConnsReused; total > 0 {
+		stats.ReuseRatio = float64(stats.ConnsReused) / float64(total)
+	}
+
+	return stats
+}
+
+// Prewarm opens n connections to the origin of target and leaves them idle in
+// the pool the route's requests are sent over, by sending n HEAD requests to
+// it at once. Any response counts: only failing to connect is an error. It
+// returns the connections that answered. A context from WithEgress opens them
+// through the route's egress proxy.
+func (p *Proxy) Prewarm(ctx context.Context, target string, n int, profile *upstreamtls.Profile, h2c bool) (int, error) {
+	origin, err := url.Parse(target)
+	if err != nil {
+		return 0, fmt.Errorf("invalid target url: %w", err)
+	}
+	origin = &url.URL{Scheme: origin.Scheme, Host: origin.Host, Path: "/"}
+	ctx = context.WithValue(ctx, forwardKey{}, &forward{target: origin, tls: profile, h2c: h2c, egress: egressProfile(ctx)})
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		warmed   int
+		firstErr error
+	)
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, origin.String(), nil)
+			if err == nil {
+				var resp *http.Response
+				if resp, err = p.reverseProxy.Transport.RoundTrip(req); err == nil {
+					// Draining the body returns the connection to the pool
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			warmed++
+		}()
+	}
+	wg.Wait()
+	return warmed, firstErr
+}
@@ -0,0 +1,268 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/metrics"
+)
+
+// Results recorded for each lookup through the cache
+const (
+	ResultHit      = "hit"      // Fresh cached addresses
+	ResultMiss     = "miss"     // Looked up
+	ResultStale    = "stale"    // Expired addresses served because the lookup failed
+	ResultNegative = "negative" // A cached failure
+	ResultPinned   = "pinned"   // Addresses pinned in the configuration
+	ResultError    = "error"    // The lookup failed with nothing to fall back on
+)
+
+// Lookuper resolves hostnames. *net.Resolver satisfies it.
+type Lookuper interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// Options configures a Cache
+type Options struct {
+	TTL          time.Duration           // How long resolved addresses are used, 0 to look up every time
+	NegativeTTL  time.Duration           // How long a failed lookup is answered from the cache
+	RefreshAhead time.Duration           // Addresses used this close to expiry are looked up again in the background
+	MaxStale     time.Duration           // How long past expiry addresses are served when lookups fail
+	Timeout      time.Duration           // Bound on each lookup, 0 for none
+	Hosts        map[string][]netip.Addr // Hostnames pinned to addresses, never looked up
+}
+
+// Cache resolves upstream hostnames, keeping answers and failures for their
+// TTLs and serving expired answers for a while when lookups fail
+type Cache struct {
+	opts    Options
+	lookup  Lookuper
+	metrics *metrics.Metrics
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// entry is the cached state of one hostname
+type entry struct {
+	addrs    []netip.Addr // Last resolved addresses
+	resolved time.Time
+	err      error // Last lookup failure, cleared by a success
+	failed   time.Time
+	inflight *call
+}
+
+// call is a lookup shared by everyone asking for a hostname meanwhile
+type call struct {
+	done  chan struct{}
+	addrs []netip.Addr
+	err   error
+}
+
+// New creates a cache resolving through lookup, net.DefaultResolver when nil
+func New(opts Options, lookup Lookuper, m *metrics.Metrics) *Cache {
+	if lookup == nil {
+		lookup = net.DefaultResolver
+	}
+	hosts := make(map[string][]netip.Addr, len(opts.Hosts))
+	for host, addrs := range opts.Hosts {
+		hosts[normalize(host)] = addrs
+	}
+	opts.Hosts = hosts
+
+	return &Cache{
+		opts:    opts,
+		lookup:  lookup,
+		metrics: m,
+		entries: make(map[string]*entry),
+	}
+}
+
+// ParseHosts parses pinned addresses by hostname, as in PROXY_DNS_HOSTS
+func ParseHosts(hosts map[string][]string) (map[string][]netip.Addr, error) {
+	parsed := make(map[string][]netip.Addr, len(hosts))
+	var errs []error
+	for host, values := range hosts {
+		for _, value := range values {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			parsed[host] = append(parsed[host], addr.Unmap())
+		}
+	}
+	return parsed, errors.Join(errs...)
+}
+
+// normalize folds a hostname for lookups and pins
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Lookup returns the addresses of host. IP literals are returned as is.
+func (c *Cache) Lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	host = normalize(host)
+	if addrs, ok := c.opts.Hosts[host]; ok {
+		c.record(ResultPinned)
+		return addrs, nil
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	e := c.entries[host]
+	if e == nil {
+		e = &entry{}
+		c.entries[host] = e
+	}
+
+	if e.addrs != nil && now.Before(e.resolved.Add(c.opts.TTL)) {
+		if c.opts.RefreshAhead > 0 && !now.Before(e.resolved.Add(c.opts.TTL-c.opts.RefreshAhead)) && e.inflight == nil {
+			c.start(host, e)
+		}
+		addrs := e.addrs
+		c.mu.Unlock()
+		c.record(ResultHit)
+		return addrs, nil
+	}
+	if e.err != nil && now.Before(e.failed.Add(c.opts.NegativeTTL)) {
+		addrs, stale := c.stale(e, now)
+		err := e.err
+		c.mu.Unlock()
+		if stale {
+			c.record(ResultStale)
+			return addrs, nil
+		}
+		c.record(ResultNegative)
+		return nil, err
+	}
+
+	pending := e.inflight
+	if pending == nil {
+		pending = c.start(host, e)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-pending.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if pending.err == nil {
+		c.record(ResultMiss)
+		return pending.addrs, nil
+	}
+
+	c.mu.Lock()
+	addrs, stale := c.stale(e, time.Now())
+	c.mu.Unlock()
+	if stale {
+		c.record(ResultStale)
+		return addrs, nil
+	}
+	c.record(ResultError)
+	return nil, pending.err
+}
+
+// stale returns the expired addresses of e while they are within MaxStale.
+// c.mu must be held.
+func (c *Cache) stale(e *entry, now time.Time) ([]netip.Addr, bool) {
+	if e.addrs == nil || !now.Before(e.resolved.Add(c.opts.TTL+c.opts.MaxStale)) {
+		return nil, false
+	}
+	return e.addrs, true
+}
+
+// start looks host up in the background, detached from any one caller so a
+// client going away doesn't fail the lookup for the others. c.mu must be held.
+func (c *Cache) start(host string, e *entry) *call {
+	pending := &call{done: make(chan struct{})}
+	e.inflight = pending
+	go c.resolve(host, e, pending)
+	return pending
+}
+
+// resolve runs a lookup and stores its result
+func (c *Cache) resolve(host string, e *entry, pending *call) {
+	ctx := context.Background()
+	if c.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	addrs, err := c.lookup.LookupNetIP(ctx, "ip", host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if c.metrics != nil {
+		c.metrics.DNSLookupDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+		if err != nil {
+			c.metrics.DNSLookupFailures.WithLabelValues(host).Inc()
+		}
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+
+	c.mu.Lock()
+	e.inflight = nil
+	if err == nil {
+		e.addrs, e.resolved, e.err = addrs, time.Now(), nil
+	} else {
+		e.err, e.failed = err, time.Now()
+	}
+	c.mu.Unlock()
+
+	pending.addrs, pending.err = addrs, err
+	close(pending.done)
+}
+
+// record counts a lookup result
+func (c *Cache) record(result string) {
+	if c.metrics != nil {
+		c.metrics.DNSCacheResults.WithLabelValues(result).Inc()
+	}
+}
+
+// Dial connects to addr through d, resolving its host through the cache and
+// trying each address in turn until one accepts the connection
+func (c *Cache) Dial(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	addrs, err := c.Lookup(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var firstErr error
+	for _, ip := range addrs {
+		if (network == "tcp4" && !ip.Is4()) || (network == "tcp6" && !ip.Is6()) {
+			continue
+		}
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "no suitable address", Addr: host}}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,189 @@
+package rewrite
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// MaxPatternLength is the longest regex a rewrite rule may use
+const MaxPatternLength = 256
+
+// MaxPatternSize caps the instructions a compiled rewrite regex may have,
+// which bounds the work matching it does per request. Counted repeats such
+// as (a{100}){100} blow up here long before they reach the length cap.
+const MaxPatternSize = 2000
+
+// Rule rewrites the request path before the upstream URL is built, by
+// replacing a prefix or the first match of a regex
+type Rule struct {
+	Prefix      string `json:"prefix,omitempty"`
+	Regex       string `json:"regex,omitempty"`
+	Replacement string `json:"replacement"` // May reference regex groups as $1 or ${name}
+}
+
+// Validate checks that the rule has one of prefix and regex, and that the
+// regex compiles within the length and complexity caps
+func (r *Rule) Validate() error {
+	if (r.Prefix == "") == (r.Regex == "") {
+		return errors.New("rewrite needs exactly one of prefix and regex")
+	}
+	if r.Prefix != "" {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return errors.New("rewrite prefix must start with /")
+		}
+		return nil
+	}
+	_, err := compile(r.Regex)
+	return err
+}
+
+// compile compiles a rewrite regex, refusing ones over the length or
+// complexity caps
+func compile(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > MaxPatternLength {
+		return nil, fmt.Errorf("rewrite regex can't be longer than %d characters", MaxPatternLength)
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite regex: %w", err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite regex: %w", err)
+	}
+	if len(prog.Inst) > MaxPatternSize {
+		return nil, errors.New("rewrite regex is too complex")
+	}
+	return regexp.Compile(pattern)
+}
+
+// Path returns path rewritten by the rule. Paths the rule doesn't match are
+// returned unchanged.
+func (r *Rule) Path(path string) string {
+	var rewritten string
+	if r.Prefix != "" {
+		if !strings.HasPrefix(path, r.Prefix) {
+			return path
+		}
+		rewritten = r.Replacement + strings.TrimPrefix(path, r.Prefix)
+	} else {
+		re, err := compile(r.Regex)
+		if err != nil {
+			return path
+		}
+		match := re.FindStringSubmatchIndex(path)
+		if match == nil {
+			return path
+		}
+		rewritten = path[:match[0]] + string(re.ExpandString(nil, r.Replacement, path, match)) + path[match[1]:]
+	}
+
+	if !strings.HasPrefix(rewritten, "/") {
+		rewritten = "/" + rewritten
+	}
+	return rewritten
+}
+
+// Target returns the upstream URL for a request: target's scheme, host and
+// base path followed by the rewritten request path. The request's query is
+// kept unless target has one of its own.
+func (r *Rule) Target(target string, requestURL *url.URL) string {
+	t, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	t.Path = strings.TrimSuffix(t.Path, "/") + r.Path(requestURL.Path)
+	t.RawPath = ""
+	if t.RawQuery == "" {
+		t.RawQuery = requestURL.RawQuery
+	}
+	return t.String()
+}
+
+// Redirect statuses a redirect route may answer with
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// variable matches a redirect URL template variable
+var variable = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// Redirect answers a route's requests with a redirect instead of proxying
+// them. Its URL may reference the request with ${path} and ${host}.
+type Redirect struct {
+	URL           string `json:"url"`            // Absolute http or https URL, or a path on the gateway
+	Status        int    `json:"status"`         // 301, 302, 303, 307 or 308, defaults to 301
+	PreserveQuery bool   `json:"preserve_query"` // Appends the request's query to the URL
+}
+
+// Validate checks the status and that the URL renders to an absolute http
+// or https URL or to a path
+func (r *Redirect) Validate() error {
+	if r.Status != 0 && !redirectStatuses[r.Status] {
+		return errors.New("redirect status must be 301, 302, 303, 307 or 308")
+	}
+	for _, match := range variable.FindAllStringSubmatch(r.URL, -1) {
+		if match[1] != "path" && match[1] != "host" {
+			return fmt.Errorf("unknown redirect variable ${%s}", match[1])
+		}
+	}
+
+	sample := variable.ReplaceAllStringFunc(r.URL, func(match string) string {
+		if match == "${host}" {
+			return "example.com"
+		}
+		return "/path"
+	})
+	u, err := url.Parse(sample)
+	switch {
+	case err != nil || sample == "":
+		return errors.New("redirect url must be an absolute http or https URL or a path")
+	case u.IsAbs():
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("redirect url must be an absolute http or https URL or a path")
+		}
+	case !strings.HasPrefix(sample, "/") || strings.HasPrefix(sample, "//"):
+		return errors.New("redirect url must be an absolute http or https URL or a path")
+	}
+	return nil
+}
+
+// StatusCode returns the redirect status, 301 by default
+func (r *Redirect) StatusCode() int {
+	if r.Status == 0 {
+		return http.StatusMovedPermanently
+	}
+	return r.Status
+}
+
+// Location renders the redirect URL for req, with its query appended when
+// the redirect preserves it
+func (r *Redirect) Location(req *http.Request) string {
+	location := variable.ReplaceAllStringFunc(r.URL, func(match string) string {
+		switch match {
+		case "${path}":
+			return req.URL.EscapedPath()
+		case "${host}":
+			return req.Host
+		}
+		return match
+	})
+
+	if r.PreserveQuery && req.URL.RawQuery != "" {
+		separator := "?"
+		if strings.Contains(location, "?") {
+			separator = "&"
+		}
+		location += separator + req.URL.RawQuery
+	}
+	return location
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/concurrency"
 	"github.com/zakirkun/isekai/internal/database"
 	"github.com/zakirkun/isekai/internal/middleware"
 	"github.com/zakirkun/isekai/internal/proxy"
@@ -38,6 +39,7 @@ func New(db *database.Database, cache *cache.Cache, proxy *proxy.Proxy, cfg *con
 	// Initialize rate limiter if enabled
 	if cfg.Gateway.RateLimitEnabled {
 		r.rl = middleware.NewRateLimiter(cfg.Gateway.RateLimitPerSecond, log)
+		r.rl.SetHeaders(middleware.NewRateLimitHeaders(cfg.Gateway.RateLimitHeaders))
 	}
 
 	r.setupMiddleware()
@@ -48,18 +50,27 @@ func New(db *database.Database, cache *cache.Cache, proxy *proxy.Proxy, cfg *con
 
 // setupMiddleware sets up global middleware
 func (r *Router) setupMiddleware() {
-	// Recovery middleware (should be first)
-	r.chi.Use(middleware.Recovery(r.log))
+	// Assign request IDs first so every response, including panics, carries one
+	r.chi.Use(middleware.RequestID)
+
+	// Recovery middleware
+	r.chi.Use(middleware.Recovery(r.log, nil, nil))
 
 	// CORS middleware
-	r.chi.Use(middleware.CORS())
+	r.chi.Use(middleware.CORS(r.cfg.Server.AllowedOrigins))
 
 	// Logger middleware
-	r.chi.Use(middleware.Logger(r.log))
+	r.chi.Use(middleware.Logger(r.log, nil, nil))
 
 	// Rate limiting middleware
 	if r.cfg.Gateway.RateLimitEnabled && r.rl != nil {
-		r.chi.Use(middleware.RateLimit(r.rl))
+		r.chi.Use(middleware.Exempt(middleware.NewPathMatcher(r.cfg.Gateway.RateLimitExemptPaths), middleware.RateLimit(r.rl)))
+	}
+
+	// Cap requests in flight, leaving health checks reachable
+	if max := r.cfg.Gateway.MaxConcurrentRequests; max > 0 {
+		limiter := concurrency.New(max, r.cfg.Gateway.ConcurrencyQueueSize, r.cfg.Gateway.ConcurrencyQueueWait, nil)
+		r.chi.Use(middleware.ConcurrencyLimit(limiter, nil, r.cfg.Gateway.ExemptPaths))
 	}
 
 	// Timeout middleware
@@ -165,5 +176,5 @@ func (r *Router) deleteRouteHandler(w http.ResponseWriter, req *http.Request) {
 
 func (r *Router) proxyHandler(w http.ResponseWriter, req *http.Request) {
 	// This is a placeholder - will be implemented with actual routing logic
-	response.NotFound(w, "Route not found")
+	response.ErrorCode(w, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
 }
@@ -1,42 +1,82 @@
 package router
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sony/gobreaker"
 	httpSwagger "github.com/swaggo/http-swagger/v2"
 
+	"github.com/zakirkun/isekai/internal/accesslog"
+	"github.com/zakirkun/isekai/internal/acl"
+	"github.com/zakirkun/isekai/internal/adminui"
 	"github.com/zakirkun/isekai/internal/auth"
 	"github.com/zakirkun/isekai/internal/cache"
+	"github.com/zakirkun/isekai/internal/chaos"
 	"github.com/zakirkun/isekai/internal/circuitbreaker"
+	"github.com/zakirkun/isekai/internal/concurrency"
 	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/dedup"
+	"github.com/zakirkun/isekai/internal/discovery"
+	"github.com/zakirkun/isekai/internal/drain"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/geoip"
 	"github.com/zakirkun/isekai/internal/handlers"
+	"github.com/zakirkun/isekai/internal/health"
+	"github.com/zakirkun/isekai/internal/idempotency"
+	"github.com/zakirkun/isekai/internal/inflight"
 	"github.com/zakirkun/isekai/internal/loadbalancer"
 	"github.com/zakirkun/isekai/internal/metrics"
 	"github.com/zakirkun/isekai/internal/middleware"
+	"github.com/zakirkun/isekai/internal/panics"
+	"github.com/zakirkun/isekai/internal/plugin"
 	"github.com/zakirkun/isekai/internal/proxy"
+	"github.com/zakirkun/isekai/internal/urlpath"
+	"github.com/zakirkun/isekai/internal/warmup"
 	"github.com/zakirkun/isekai/internal/websocket"
 	"github.com/zakirkun/isekai/pkg/config"
+	"github.com/zakirkun/isekai/pkg/httpjson"
 	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/redact"
 	"github.com/zakirkun/isekai/pkg/response"
+	"github.com/zakirkun/isekai/pkg/version"
 )
 
 // RouterV2 represents the enhanced HTTP router with all features
 type RouterV2 struct {
-	chi         *chi.Mux
-	db          *database.Database
-	cache       *cache.Cache
-	proxy       *proxy.Proxy
-	cfg         *config.Config
-	log         *logger.Logger
-	rl          *middleware.RateLimiter
-	authService *auth.AuthService
-	metrics     *metrics.Metrics
-	cb          *circuitbreaker.CircuitBreaker
-	lb          *loadbalancer.LoadBalancer
-	wsHub       *websocket.Hub
+	chi          *chi.Mux
+	db           *database.Database
+	cache        *cache.Cache
+	proxy        *proxy.Proxy
+	cfg          *config.Config
+	log          *logger.Logger
+	rl           *middleware.RateLimiter
+	tiers        *handlers.RateLimitHandler
+	mirror       *proxy.Mirror
+	authService  *auth.AuthService
+	metrics      *metrics.Metrics
+	cb           *circuitbreaker.CircuitBreaker
+	lb           *loadbalancer.LoadBalancer
+	discovery    *discovery.Discovery
+	wsHub        *websocket.Hub
+	bus          *events.Bus
+	drainer      *drain.Drainer
+	access       *accesslog.Writer
+	geo          *geoip.DB // Nil when no GeoIP database is configured
+	headers      *redact.Headers
+	chaos        *chaos.Registry
+	inflight     *inflight.Registry // Nil when in-flight tracking is disabled
+	proxyHandler *handlers.ProxyHandler
+	warmup       *warmup.Warmup
+	unsubscribe  func() // Stops dropping the route table on route changes
+	started      time.Time
 }
 
 // NewV2 creates a new enhanced router instance with all features
@@ -51,6 +91,8 @@ func NewV2(
 	cb *circuitbreaker.CircuitBreaker,
 	lb *loadbalancer.LoadBalancer,
 	wsHub *websocket.Hub,
+	bus *events.Bus,
+	drainer *drain.Drainer,
 ) *RouterV2 {
 	r := &RouterV2{
 		chi:         chi.NewRouter(),
@@ -64,11 +106,49 @@ func NewV2(
 		cb:          cb,
 		lb:          lb,
 		wsHub:       wsHub,
+		bus:         bus,
+		drainer:     drainer,
+		headers:     redact.NewHeaders(cfg.Gateway.LogHeaders, cfg.Gateway.SensitiveHeaders),
+		warmup:      warmup.New(cfg.Warmup.Enabled && cfg.Warmup.Blocking),
+		started:     time.Now(),
 	}
 
-	// Initialize rate limiter if enabled
+	// Initialize rate limiter if enabled, with tiers kept in sync with the database
 	if cfg.Gateway.RateLimitEnabled {
 		r.rl = middleware.NewRateLimiter(cfg.Gateway.RateLimitPerSecond, log)
+		r.rl.SetHeaders(middleware.NewRateLimitHeaders(cfg.Gateway.RateLimitHeaders))
+		r.tiers = handlers.NewRateLimitHandler(db, middleware.NewRateLimitTiers(cfg.Gateway.RateLimitTiers), log)
+		r.tiers.Start(cfg.Gateway.RateLimitTierRefresh)
+	}
+
+	// Keep per-route faults for chaos testing if enabled
+	if cfg.Chaos.Enabled {
+		r.chaos = chaos.NewRegistry()
+		log.Warnf("Chaos fault injection is enabled in %s", cfg.Environment)
+	}
+
+	// Track requests in flight so stuck ones can be found and cancelled
+	if cfg.Gateway.InflightMax > 0 {
+		r.inflight = inflight.New(cfg.Gateway.InflightMax)
+	}
+
+	// Look up client countries if a GeoIP database is configured
+	if cfg.GeoIP.DatabasePath != "" {
+		geo, err := geoip.Open(cfg.GeoIP.DatabasePath, log)
+		if err != nil {
+			log.Fatalf("Invalid GeoIP configuration: %v", err)
+		}
+		geo.Start(cfg.GeoIP.ReloadInterval)
+		r.geo = geo
+	}
+
+	// Open the access log file if configured
+	if cfg.AccessLog.Path != "" {
+		access, err := accesslog.New(&cfg.AccessLog, metricsInstance, log)
+		if err != nil {
+			log.Fatalf("Invalid access log configuration: %v", err)
+		}
+		r.access = access
 	}
 
 	r.setupMiddleware()
@@ -79,23 +159,84 @@ func NewV2(
 
 // setupMiddleware sets up global middleware
 func (r *RouterV2) setupMiddleware() {
-	// Recovery middleware (should be first)
-	r.chi.Use(middleware.Recovery(r.log))
+	// Assign request IDs first so every response, including panics, carries one
+	r.chi.Use(middleware.RequestID)
+
+	// Security headers wrap everything below, so error responses and
+	// proxied ones carry them too
+	if r.cfg.SecurityHeaders.Enabled {
+		var admin *middleware.PathMatcher
+		if r.cfg.AdminUI.Enabled {
+			admin = middleware.NewPathMatcher([]string{adminui.Prefix})
+		}
+		r.chi.Use(middleware.SecurityHeaders(&r.cfg.SecurityHeaders, admin))
+	}
+
+	// Join the caller's trace before any spans are started
+	r.chi.Use(middleware.TraceContext)
 
-	// CORS middleware
-	r.chi.Use(middleware.CORS())
+	// Recovery middleware, posting panic reports when a webhook is set
+	var reporter *panics.Reporter
+	if r.cfg.Gateway.PanicWebhookURL != "" {
+		reporter = panics.New(r.cfg.Gateway.PanicWebhookURL, r.cfg.Gateway.PanicWebhookRate, r.log)
+	}
+	r.chi.Use(middleware.Recovery(r.log, r.metrics, reporter))
+
+	// Compress responses for clients that accept it, proxied ones included
+	// unless the upstream already encoded them
+	if r.cfg.Compression.Enabled {
+		r.chi.Use(middleware.Compress(&r.cfg.Compression))
+	}
+
+	// Count in-flight requests so draining can wait for them
+	r.chi.Use(r.drainer.Middleware)
+
+	// Track requests in flight, ahead of the timeout so cancelling one is
+	// answered like a timeout
+	if r.inflight != nil {
+		r.chi.Use(middleware.InFlight(r.inflight))
+	}
+
+	// CORS middleware, leaving OPTIONS to routes that forward it
+	r.chi.Use(middleware.CORSPassthrough(r.cfg.Server.AllowedOrigins, handlers.OptionsPassthrough(r.db)))
 
 	// Metrics middleware
 	if r.metrics != nil {
-		r.chi.Use(middleware.MetricsMiddleware(r.metrics))
+		r.chi.Use(middleware.MetricsMiddleware(r.metrics, r.cfg.Gateway.MetricsMaxPaths))
 	}
 
 	// Logger middleware
-	r.chi.Use(middleware.Logger(r.log))
+	r.chi.Use(middleware.Logger(r.log, r.access, r.headers))
+
+	// IP allow/deny lists. The engine validates them at startup.
+	ipACL, err := acl.Parse(r.cfg.Gateway.IPAllow, r.cfg.Gateway.IPDeny)
+	if err != nil {
+		r.log.Fatalf("Invalid gateway IP access list: %v", err)
+	}
+	if !ipACL.Empty() {
+		r.chi.Use(middleware.IPFilter(ipACL, r.metrics))
+	}
+
+	// Resolve client countries, counting requests by country when asked to
+	if r.geo != nil {
+		var guard *metrics.PathGuard
+		if r.cfg.GeoIP.MetricsLabel {
+			guard = metrics.NewLabelGuard(r.cfg.GeoIP.MetricsMax, "other", nil)
+		}
+		r.chi.Use(middleware.GeoIP(r.geo, r.metrics, guard))
+	}
 
-	// Rate limiting middleware
+	// Rate limiting middleware, leaving uptime monitors and scrapers alone
 	if r.cfg.Gateway.RateLimitEnabled && r.rl != nil {
-		r.chi.Use(middleware.RateLimit(r.rl))
+		r.chi.Use(middleware.Exempt(middleware.NewPathMatcher(r.cfg.Gateway.RateLimitExemptPaths),
+			middleware.TieredRateLimit(r.rl, r.tiers.Tiers(), r.authService)))
+	}
+
+	// Cap requests in flight, leaving health checks and metrics reachable
+	if max := r.cfg.Gateway.MaxConcurrentRequests; max > 0 {
+		limiter := concurrency.New(max, r.cfg.Gateway.ConcurrencyQueueSize, r.cfg.Gateway.ConcurrencyQueueWait,
+			middleware.QueueGauge(r.metrics, middleware.ConcurrencyScopeGateway))
+		r.chi.Use(middleware.ConcurrencyLimit(limiter, r.metrics, r.cfg.Gateway.ExemptPaths))
 	}
 
 	// Timeout middleware
@@ -104,11 +245,16 @@ func (r *RouterV2) setupMiddleware() {
 
 // setupRoutes sets up all routes
 func (r *RouterV2) setupRoutes() {
-	// Health check endpoint
-	r.chi.Get("/health", r.healthHandler)
+	// Health check endpoints
+	healthHandler := handlers.NewHealthHandler(r.healthChecker(), r.readinessChecker())
+	r.chi.Get("/health", healthHandler.Health)
+	r.chi.Get("/health/live", healthHandler.Live)
+	r.chi.Get("/health/ready", healthHandler.Ready)
 
-	// Metrics endpoint (Prometheus)
-	r.chi.Handle("/metrics", promhttp.Handler())
+	// Metrics endpoint (Prometheus), optionally behind its own token
+	if r.metrics != nil {
+		r.chi.With(middleware.MetricsAuth(r.cfg.Gateway.MetricsAuthToken)).Handle("/metrics", r.metrics.Handler())
+	}
 
 	// Swagger documentation
 	r.chi.Get("/swagger/*", httpSwagger.Handler(
@@ -118,38 +264,253 @@ func (r *RouterV2) setupRoutes() {
 	// WebSocket endpoint
 	r.chi.Get("/ws", r.websocketHandler)
 
+	// Admin UI, registered ahead of the proxy so it can't be shadowed by routes
+	if r.cfg.AdminUI.Enabled {
+		r.setupAdminUI()
+	}
+
+	// Plugins routes can enable, shared by route validation and the proxy
+	plugins := plugin.NewRegistry()
+	plugin.RegisterBuiltins(plugins, &plugin.Deps{
+		Auth:    r.authService,
+		Cache:   r.cache,
+		Proxy:   r.proxy,
+		Metrics: r.metrics,
+		Log:     r.log,
+
+		RateLimitHeaders: middleware.NewRateLimitHeaders(r.cfg.Gateway.RateLimitHeaders),
+	})
+
 	// API routes
 	r.chi.Route("/api", func(api chi.Router) {
 		// Public endpoints
 		api.Get("/status", r.statusHandler)
 
 		// Auth endpoints
-		authHandler := handlers.NewAuthHandler(r.authService, r.log)
-		api.Post("/auth/login", authHandler.Login)
+		authHandler := handlers.NewAuthHandler(r.authService, r.db, r.cfg.Auth.PasswordMinLength, r.log)
+		if r.passwordLogin() {
+			api.Post("/auth/login", authHandler.Login)
+		}
+
+		// Single sign-on, issuing the same tokens as the password login
+		if r.cfg.Auth.OIDCIssuerURL != "" {
+			oidcHandler := handlers.NewOIDCHandler(auth.NewOIDC(&r.cfg.Auth, r.log), r.authService, r.cfg.Auth.TokenDuration, r.log)
+			api.Get("/auth/oidc/login", oidcHandler.Login)
+			api.Get("/auth/oidc/callback", oidcHandler.Callback)
+		}
+
+		// Self-service password change, token details and logout always
+		// need the caller's identity
+		api.With(r.authService.Middleware()).Post("/auth/password", authHandler.ChangePassword)
+		api.With(r.authService.Middleware()).Get("/auth/me", authHandler.Me)
+		api.With(r.authService.Middleware()).Post("/auth/logout", authHandler.Logout)
+
+		// Introspecting other tokens is for admins and services
+		api.With(r.authService.Middleware(), auth.RequireAnyRole(database.RoleAdmin, "service")).Post("/auth/introspect", authHandler.Introspect)
+
+		// Route change audit and SLO handlers, shared by the route endpoints
+		// and their own
+		auditHandler := handlers.NewAuditHandler(r.db, r.log)
+		sloHandler := handlers.NewSLOHandler(r.db, r.log)
 
 		// Protected route management endpoints
 		api.Route("/routes", func(routes chi.Router) {
-			routeHandler := handlers.NewRouteHandler(r.db, r.cache, r.log)
-
-			// Public read endpoints
-			routes.Get("/", routeHandler.List)
-			routes.Get("/{id}", routeHandler.Get)
+			routeHandler := handlers.NewRouteHandler(r.db, r.cache, r.bus, r.log)
+			routeHandler.SetPlugins(plugins)
 
-			// Protected write endpoints (require auth)
 			if r.cfg.Auth.Enabled {
+				// Public read endpoints; a token confines them to its tenant
+				routes.Group(func(public chi.Router) {
+					public.Use(r.authService.Middleware(auth.Optional()))
+
+					public.Get("/", routeHandler.List)
+					public.With(routeHandler.RequireTenant).Get("/{id}", routeHandler.Get)
+				})
+
+				// Protected write endpoints (require auth). Admins manage every
+				// route, other users only their tenant's.
 				routes.Group(func(protected chi.Router) {
-					protected.Use(r.authService.Middleware())
-					protected.Use(auth.RequireRole("admin"))
+					protected.Use(r.requireTenantOrAdmin())
 
 					protected.Post("/", routeHandler.Create)
-					protected.Put("/{id}", routeHandler.Update)
-					protected.Delete("/{id}", routeHandler.Delete)
+					protected.Post("/bulk", routeHandler.Bulk)
+					protected.Group(func(owned chi.Router) {
+						owned.Use(routeHandler.RequireTenant)
+
+						owned.Put("/{id}", routeHandler.Update)
+						owned.Patch("/{id}", routeHandler.Patch)
+						owned.Delete("/{id}", routeHandler.Delete)
+						owned.Get("/{id}/audit", auditHandler.ListByRoute)
+						owned.Get("/{id}/analytics", routeHandler.Analytics)
+						owned.Get("/{id}/slo", sloHandler.Compliance)
+						owned.Post("/{id}/transform/test", routeHandler.TestTransform)
+						owned.Post("/{id}/maintenance/enable", routeHandler.EnableMaintenance)
+						owned.Post("/{id}/maintenance/disable", routeHandler.DisableMaintenance)
+						owned.Post("/{id}/switch", routeHandler.Switch)
+					})
 				})
 			} else {
+				routes.Get("/", routeHandler.List)
+				routes.Get("/{id}", routeHandler.Get)
 				routes.Post("/", routeHandler.Create)
+				routes.Post("/bulk", routeHandler.Bulk)
 				routes.Put("/{id}", routeHandler.Update)
+				routes.Patch("/{id}", routeHandler.Patch)
 				routes.Delete("/{id}", routeHandler.Delete)
+				routes.Get("/{id}/audit", auditHandler.ListByRoute)
+				routes.Get("/{id}/analytics", routeHandler.Analytics)
+				routes.Get("/{id}/slo", sloHandler.Compliance)
+				routes.Post("/{id}/transform/test", routeHandler.TestTransform)
+				routes.Post("/{id}/maintenance/enable", routeHandler.EnableMaintenance)
+				routes.Post("/{id}/maintenance/disable", routeHandler.DisableMaintenance)
+				routes.Post("/{id}/switch", routeHandler.Switch)
+			}
+		})
+
+		// Route change audit log
+		api.Group(func(audit chi.Router) {
+			if r.cfg.Auth.Enabled {
+				audit.Use(r.requireAdmin())
+			}
+
+			audit.Get("/audit", auditHandler.List)
+		})
+
+		// Prometheus rules generated from route SLOs
+		api.Group(func(rules chi.Router) {
+			if r.cfg.Auth.Enabled {
+				rules.Use(r.requireAdmin())
+			}
+
+			rules.Get("/slo/rules", sloHandler.Rules)
+		})
+
+		// Request log exports
+		api.Route("/logs", func(logs chi.Router) {
+			logHandler := handlers.NewLogHandler(r.db, r.cfg.Gateway.LogExportMaxRows, r.cfg.Gateway.LogExportRate, r.log)
+
+			if r.cfg.Auth.Enabled {
+				logs.Use(r.requireAdmin())
 			}
+
+			logs.Get("/export", logHandler.Export)
+		})
+
+		// Configuration snapshots and rollback
+		api.Route("/snapshots", func(snapshots chi.Router) {
+			snapshotHandler := handlers.NewSnapshotHandler(r.db, r.cache, r.bus, r.cfg.Gateway.SnapshotRetention, r.log)
+
+			if r.cfg.Auth.Enabled {
+				snapshots.Use(r.requireAdmin())
+			}
+
+			snapshots.Get("/", snapshotHandler.List)
+			snapshots.Post("/", snapshotHandler.Create)
+			snapshots.Get("/{id}", snapshotHandler.Get)
+			snapshots.Post("/{id}/restore", snapshotHandler.Restore)
+		})
+
+		// User management
+		api.Route("/users", func(users chi.Router) {
+			userHandler := handlers.NewUserHandler(r.db, r.cfg.Auth.PasswordMinLength, r.log)
+
+			if r.cfg.Auth.Enabled {
+				users.Use(r.requireAdmin())
+			}
+
+			users.Get("/", userHandler.List)
+			users.Post("/", userHandler.Create)
+			users.Get("/{id}", userHandler.Get)
+			users.Put("/{id}", userHandler.Update)
+			users.Delete("/{id}", userHandler.Delete)
+		})
+
+		// Tenants and their usage, for admins that cross tenants
+		api.Route("/tenants", func(tenants chi.Router) {
+			tenantHandler := handlers.NewTenantHandler(r.db, r.tiers, r.log)
+
+			if r.cfg.Auth.Enabled {
+				tenants.Use(r.requireAdmin())
+			}
+
+			tenants.Get("/", tenantHandler.List)
+			tenants.Put("/{id}", tenantHandler.Put)
+			tenants.Delete("/{id}", tenantHandler.Delete)
+			tenants.Get("/{id}/usage", tenantHandler.Usage)
+		})
+
+		// Usage reports for chargeback
+		api.Route("/reports", func(reports chi.Router) {
+			reportHandler := handlers.NewReportHandler(r.db, r.log)
+
+			if r.cfg.Auth.Enabled {
+				reports.Use(r.requireAdmin())
+			}
+
+			reports.Get("/usage", reportHandler.Usage)
+		})
+
+		// Admin endpoints
+		api.Route("/admin", func(admin chi.Router) {
+			simulationHandler := handlers.NewSimulationHandler(r.db, r.log)
+
+			if r.cfg.Auth.Enabled {
+				admin.Use(r.requireAdmin())
+			}
+
+			admin.Post("/simulate", simulationHandler.Simulate)
+			admin.Post("/drain", handlers.NewDrainHandler(r.drainer, r.wsHub, r.log).Drain)
+			admin.Get("/config", r.configHandler)
+			admin.Get("/debug/request", r.debugRequest)
+			backendHandler := handlers.NewBackendHandler(r.lb, r.cfg.LoadBalancer.DrainTimeout, r.log)
+			admin.Put("/backends/priority", backendHandler.SetPriority)
+			admin.Delete("/backends", backendHandler.Remove)
+
+			if r.tiers != nil {
+				admin.Get("/rate-limit-tiers", r.tiers.List)
+				admin.Put("/rate-limit-tiers/{name}", r.tiers.Put)
+				admin.Delete("/rate-limit-tiers/{name}", r.tiers.Delete)
+			}
+
+			if r.chaos != nil {
+				chaosHandler := handlers.NewChaosHandler(r.db, r.chaos, r.log)
+				admin.Get("/chaos", chaosHandler.List)
+				admin.Delete("/chaos", chaosHandler.Reset)
+				admin.Put("/chaos/routes/{id}", chaosHandler.Set)
+				admin.Delete("/chaos/routes/{id}", chaosHandler.Clear)
+			}
+		})
+
+		// Route matching explained without forwarding anything, and the
+		// requests in flight
+		api.Route("/debug", func(debug chi.Router) {
+			debugHandler := handlers.NewDebugHandler(r.db, r.chi, r.log)
+
+			if r.cfg.Auth.Enabled {
+				debug.Use(r.requireAdmin())
+			}
+
+			debug.Get("/match", debugHandler.Match)
+			debug.Get("/routes", debugHandler.Routes)
+
+			if r.inflight != nil {
+				inflightHandler := handlers.NewInFlightHandler(r.inflight, r.log)
+				debug.Get("/inflight", inflightHandler.List)
+				debug.Post("/inflight/{id}/cancel", inflightHandler.Cancel)
+			}
+		})
+
+		// Cache inspection
+		api.Route("/cache", func(cacheRoutes chi.Router) {
+			cacheHandler := handlers.NewCacheHandler(r.cache, r.headers, r.log)
+
+			if r.cfg.Auth.Enabled {
+				cacheRoutes.Use(r.requireAdmin())
+			}
+
+			cacheRoutes.Get("/keys", cacheHandler.ListKeys)
+			cacheRoutes.Get("/keys/*", cacheHandler.GetKey)
+			cacheRoutes.Delete("/keys/*", cacheHandler.DeleteKey)
 		})
 
 		// Circuit breaker status
@@ -158,13 +519,124 @@ func (r *RouterV2) setupRoutes() {
 		// Load balancer status
 		api.Get("/load-balancer/status", r.loadBalancerStatus)
 
-		// WebSocket stats
-		api.Get("/websocket/stats", r.websocketStats)
+		// Upstream transport statistics, which describe every backend
+		api.Group(func(proxyRoutes chi.Router) {
+			if r.cfg.Auth.Enabled {
+				proxyRoutes.Use(r.requireAdmin())
+			}
+			proxyRoutes.Get("/proxy/stats", r.proxyStats)
+		})
+
+		// WebSocket stats, which list connected users and their topics
+		api.Group(func(ws chi.Router) {
+			if r.cfg.Auth.Enabled {
+				ws.Use(r.requireAdmin())
+			}
+			ws.Get("/websocket/stats", r.websocketStats)
+		})
+
+		// Push messages from backend services to WebSocket topics
+		api.Group(func(ws chi.Router) {
+			if r.cfg.Auth.Enabled {
+				ws.Use(r.requireAnyRole("admin", "publisher"))
+			}
+			ws.Post("/websocket/publish", r.websocketPublish)
+		})
 	})
 
-	// Proxy all other requests
-	proxyHandler := handlers.NewProxyHandler(r.db, r.proxy, r.cache, r.cb, r.lb, r.metrics, r.log)
+	// Proxy all other requests, replaying mirrored requests on a worker pool
+	// and keeping responses to idempotent requests and delivered event IDs in
+	// the cache
+	r.mirror = proxy.NewMirror(&r.cfg.Proxy, r.log, r.metrics)
+	r.mirror.SetResolver(r.proxy.Resolver())
+	r.mirror.SetBuffers(r.proxy.Buffers())
+	idem := idempotency.New(r.cache, &r.cfg.Proxy)
+	proxyHandler := handlers.NewProxyHandler(r.db, r.proxy, r.cache, r.cb, r.lb, r.mirror, idem, r.metrics, r.log)
+	r.proxyHandler = proxyHandler
+	proxyHandler.SetPlugins(plugins)
+	proxyHandler.SetHeaders(r.headers)
+	proxyHandler.SetConcurrencyQueue(r.cfg.Gateway.ConcurrencyQueueSize, r.cfg.Gateway.ConcurrencyQueueWait)
+	proxyHandler.SetThrottleQueue(r.cfg.Gateway.UpstreamQueueSize, r.cfg.Gateway.UpstreamQueueWait)
+	proxyHandler.SetChaos(r.chaos)
+	proxyHandler.SetDedup(dedup.New(r.cache, r.cfg.Proxy.DedupMaxBody))
+	proxyHandler.SetAllowTrace(r.cfg.Proxy.AllowTrace)
+	proxyHandler.SetDeadline(r.cfg.Proxy.DeadlineHeader, r.cfg.Proxy.DeadlineGRPC, r.cfg.Proxy.DeadlineFloor)
+	proxyHandler.SetBus(r.bus)
 	r.chi.HandleFunc("/*", proxyHandler.Handle)
+
+	// Route changes made here drop the warmed-up route table at once, and
+	// the breakers of changed and deleted routes
+	if r.bus != nil {
+		r.unsubscribe = r.bus.Subscribe(func(event events.Event) {
+			if events.Match("route.*", event.Type) || event.Type == events.SnapshotRestored {
+				proxyHandler.InvalidateRoutes()
+			}
+			switch event.Type {
+			case events.RouteUpdated, events.RouteDeleted, events.RouteSwitched:
+				if id, ok := routeEventID(event); ok {
+					r.cb.RemoveRoute(id)
+				}
+			case events.SnapshotRestored:
+				r.cb.RemoveRoutes()
+			}
+		})
+	}
+}
+
+// routeEventID returns the ID of the route a route event is about
+func routeEventID(event events.Event) (int, bool) {
+	switch payload := event.Payload.(type) {
+	case database.Route:
+		return payload.ID, true
+	case *database.Route:
+		return payload.ID, true
+	case handlers.SwitchEvent:
+		return payload.RouteID, true
+	case map[string]int:
+		id, ok := payload["id"]
+		return id, ok
+	}
+	return 0, false
+}
+
+// Warmup returns the startup warm-up, which holds readiness until it ends
+// when WARMUP_BLOCKING is set
+func (r *RouterV2) Warmup() *warmup.Warmup {
+	return r.warmup
+}
+
+// LoadRoutes loads the routes into the proxy's in-memory route table for
+// WARMUP_ROUTE_TABLE_TTL, returning them
+func (r *RouterV2) LoadRoutes(ctx context.Context) ([]database.Route, error) {
+	return r.proxyHandler.LoadRoutes(ctx, r.cfg.Warmup.RouteTableTTL)
+}
+
+// requireAdmin requires an admin token, except on the paths exempted from
+// authentication
+func (r *RouterV2) requireAdmin() func(http.Handler) http.Handler {
+	return r.requireAnyRole("admin")
+}
+
+// requireAnyRole requires a token with one of roles, except on the paths
+// exempted from authentication
+func (r *RouterV2) requireAnyRole(roles ...string) func(http.Handler) http.Handler {
+	return r.requireClaims(auth.RequireAnyRole(roles...))
+}
+
+// requireTenantOrAdmin requires an admin token or one scoped to a tenant,
+// except on the paths exempted from authentication
+func (r *RouterV2) requireTenantOrAdmin() func(http.Handler) http.Handler {
+	return r.requireClaims(auth.RequireClaims(func(claims *auth.Claims) bool {
+		return claims.HasRole(database.RoleAdmin) || claims.TenantID != ""
+	}))
+}
+
+// requireClaims requires a token passing check, except on the paths exempted
+// from authentication
+func (r *RouterV2) requireClaims(check func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return middleware.Exempt(middleware.NewPathMatcher(r.cfg.Gateway.AuthExemptPaths), func(next http.Handler) http.Handler {
+		return chi.Chain(r.authService.Middleware(), check).Handler(next)
+	})
 }
 
 // Handler returns the chi router
@@ -172,46 +644,131 @@ func (r *RouterV2) Handler() http.Handler {
 	return r.chi
 }
 
+// PublicHandler returns the handler of listeners serving proxied traffic
+// only: the management API, admin UI and API docs answer as if no route
+// matched
+func (r *RouterV2) PublicHandler() http.Handler {
+	prefixes := []string{"/api", "/swagger"}
+	if r.cfg.AdminUI.Enabled {
+		prefixes = append(prefixes, adminui.Prefix)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := urlpath.CleanPath(req.URL.Path)
+		for _, prefix := range prefixes {
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				response.ErrorFor(w, req, http.StatusNotFound, response.CodeRouteNotFound, "Route not found")
+				return
+			}
+		}
+		r.chi.ServeHTTP(w, req)
+	})
+}
+
 // Shutdown performs cleanup
 func (r *RouterV2) Shutdown() {
+	if r.unsubscribe != nil {
+		r.unsubscribe()
+	}
 	if r.rl != nil {
 		r.rl.Stop()
+		r.tiers.Stop()
+	}
+	r.mirror.Stop()
+	if r.geo != nil {
+		r.geo.Stop()
+	}
+	if r.access != nil {
+		r.access.Close()
 	}
 }
 
-// healthHandler handles health check requests
-func (r *RouterV2) healthHandler(w http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
-
-	health := map[string]interface{}{
-		"status": "ok",
-		"checks": map[string]string{},
+// ReopenAccessLog reopens the access log file after it was moved by logrotate
+func (r *RouterV2) ReopenAccessLog() {
+	if r.access == nil {
+		return
 	}
-
-	// Check database
-	if err := r.db.Health(ctx); err != nil {
-		health["checks"].(map[string]string)["database"] = "unhealthy"
-		health["status"] = "degraded"
-	} else {
-		health["checks"].(map[string]string)["database"] = "healthy"
+	if err := r.access.Reopen(); err != nil {
+		r.log.Errorf("Failed to reopen access log: %v", err)
+		return
 	}
+	r.log.Info("Access log reopened")
+}
 
-	// Check cache
-	if err := r.cache.Health(ctx); err != nil {
-		health["checks"].(map[string]string)["cache"] = "unhealthy"
-		health["status"] = "degraded"
-	} else {
-		health["checks"].(map[string]string)["cache"] = "healthy"
-	}
+// healthChecker checks the database and cache
+func (r *RouterV2) healthChecker() *health.Checker {
+	checker := health.New(r.cfg.Gateway.HealthCacheTTL, 5*time.Second)
+	checker.Register("database", r.db.Health)
+	checker.Register("cache", r.cache.Health)
+	return checker
+}
 
-	response.Success(w, "Health check completed", health)
+// readinessChecker extends the health checks with backend availability when
+// load balancer backends are configured, and of every critical route
+func (r *RouterV2) readinessChecker() *health.Checker {
+	checker := r.healthChecker()
+	checker.Register("backends", func(ctx context.Context) error {
+		if healthy, total := r.lb.HealthyCount(); total > 0 && healthy == 0 {
+			return errors.New("no healthy backends")
+		}
+		return nil
+	})
+	checker.Register("critical_routes", func(ctx context.Context) error {
+		return r.proxyHandler.CheckCriticalRoutes(ctx)
+	})
+	checker.Register("drain", r.drainer.Check)
+	checker.Register("warmup", r.warmup.Check)
+	return checker
 }
 
 // statusHandler returns the gateway status
 func (r *RouterV2) statusHandler(w http.ResponseWriter, req *http.Request) {
+	build := version.Get()
+	uptime := time.Since(r.started)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var lastPause time.Duration
+	if mem.NumGC > 0 {
+		lastPause = time.Duration(mem.PauseNs[(mem.NumGC+255)%256])
+	}
+
+	dbStatus := map[string]interface{}{
+		"connected": r.db.Connected(),
+	}
+	if pool, ok := r.db.PoolStats(); ok {
+		dbStatus["pool"] = pool
+	}
+
+	breakers := map[string]int{"total": 0, "open": 0, "half_open": 0}
+	for _, state := range r.cb.GetAllStates() {
+		breakers["total"]++
+		switch state.State {
+		case gobreaker.StateOpen:
+			breakers["open"]++
+		case gobreaker.StateHalfOpen:
+			breakers["half_open"]++
+		}
+	}
+
+	healthy, total := r.lb.HealthyCount()
+
 	status := map[string]interface{}{
 		"service": "Isekai API Gateway",
-		"version": "2.0.0",
+		"version": build.Version,
+		"build":   build,
+		"uptime": map[string]interface{}{
+			"started_at": r.started.UTC(),
+			"seconds":    int64(uptime.Seconds()),
+			"human":      uptime.Round(time.Second).String(),
+		},
+		"runtime": map[string]interface{}{
+			"goroutines":        runtime.NumGoroutine(),
+			"heap_alloc_bytes":  mem.HeapAlloc,
+			"heap_objects":      mem.HeapObjects,
+			"gc_runs":           mem.NumGC,
+			"gc_pause_total_ms": float64(mem.PauseTotalNs) / float64(time.Millisecond),
+			"gc_pause_last_ms":  float64(lastPause) / float64(time.Millisecond),
+		},
 		"features": map[string]bool{
 			"authentication":  r.cfg.Auth.Enabled,
 			"tracing":         r.cfg.Tracing.Enabled,
@@ -222,47 +779,205 @@ func (r *RouterV2) statusHandler(w http.ResponseWriter, req *http.Request) {
 			"metrics":         true,
 			"swagger":         true,
 		},
+		"database":         dbStatus,
+		"circuit_breakers": breakers,
+		"load_balancer": map[string]int{
+			"backends": total,
+			"healthy":  healthy,
+		},
 		"cache": map[string]interface{}{
 			"size": r.cache.Size(),
 		},
 		"websocket": map[string]interface{}{
 			"connected_clients": r.wsHub.GetClientCount(),
 		},
+		"drain": r.drainer.Status(),
 	}
 
 	response.Success(w, "Status retrieved", status)
 }
 
+// breakerStatus is a circuit breaker's key and state
+type breakerStatus struct {
+	circuitbreaker.Key
+	State string `json:"state"`
+}
+
 // circuitBreakerStatus returns circuit breaker status
 func (r *RouterV2) circuitBreakerStatus(w http.ResponseWriter, req *http.Request) {
 	states := r.cb.GetAllStates()
 
-	stateStrings := make(map[string]string)
-	for name, state := range states {
-		stateStrings[name] = state.String()
+	statuses := make([]breakerStatus, len(states))
+	for i, state := range states {
+		statuses[i] = breakerStatus{Key: state.Key, State: state.State.String()}
 	}
 
-	response.Success(w, "Circuit breaker status", stateStrings)
+	response.Success(w, "Circuit breaker status", statuses)
 }
 
-// loadBalancerStatus returns load balancer status
+// setupAdminUI serves the embedded admin UI under /admin. The login page,
+// assets and config.js are public; the app itself is for admins when auth
+// is enabled.
+func (r *RouterV2) setupAdminUI() {
+	ui, err := adminui.New(r.adminUIConfig)
+	if err != nil {
+		r.log.Fatalf("Failed to load admin UI: %v", err)
+	}
+
+	r.chi.Route(adminui.Prefix, func(admin chi.Router) {
+		admin.Get("/login", ui.Login)
+		admin.Get("/config.js", ui.ConfigJS)
+		admin.Get("/assets/*", ui.ServeHTTP)
+
+		admin.Group(func(app chi.Router) {
+			if r.cfg.Auth.Enabled {
+				app.Use(adminui.Gate(r.authService))
+			}
+
+			app.Get("/", ui.ServeHTTP)
+			app.Get("/*", ui.ServeHTTP)
+		})
+	})
+}
+
+// adminUIConfig returns the API location and features for the admin UI
+func (r *RouterV2) adminUIConfig() adminui.ClientConfig {
+	return adminui.ClientConfig{
+		APIBase: r.cfg.AdminUI.APIBase,
+		WSURL:   "/ws",
+		Version: version.Get().Version,
+		Features: map[string]bool{
+			"authentication":   r.cfg.Auth.Enabled,
+			"oidc":             r.cfg.Auth.OIDCIssuerURL != "",
+			"password_login":   r.passwordLogin(),
+			"tracing":          r.cfg.Tracing.Enabled,
+			"rate_limiting":    r.cfg.Gateway.RateLimitEnabled,
+			"rate_limit_tiers": r.tiers != nil,
+			"chaos":            r.chaos != nil,
+			"discovery":        r.discovery != nil,
+			"metrics":          r.metrics != nil,
+			"websocket":        r.wsHub != nil,
+		},
+	}
+}
+
+// passwordLogin reports whether username/password login is offered, always
+// without OIDC and next to it only when configured to be
+func (r *RouterV2) passwordLogin() bool {
+	return r.cfg.Auth.OIDCIssuerURL == "" || r.cfg.Auth.OIDCPasswordLogin
+}
+
+// GeoIP returns the GeoIP database clients are looked up in, nil when none
+// is configured
+func (r *RouterV2) GeoIP() *geoip.DB {
+	return r.geo
+}
+
+// SetDiscovery sets the service discovery reported by the load balancer status
+func (r *RouterV2) SetDiscovery(d *discovery.Discovery) {
+	r.discovery = d
+}
+
+// loadBalancerStatus returns the backends, their priority tiers and, when
+// enabled, the service discovery status
 func (r *RouterV2) loadBalancerStatus(w http.ResponseWriter, req *http.Request) {
-	backends := r.lb.GetAllBackends()
-	response.Success(w, "Load balancer status", backends)
+	status := map[string]interface{}{
+		"backends": r.lb.GetAllBackends(),
+		"tiers":    r.lb.Tiers(),
+	}
+	if r.discovery != nil {
+		status["discovery"] = r.discovery.Status()
+	}
+	response.Success(w, "Load balancer status", status)
+}
+
+// proxyStats returns upstream transport statistics
+func (r *RouterV2) proxyStats(w http.ResponseWriter, req *http.Request) {
+	response.Success(w, "Proxy stats", r.proxy.Stats())
+}
+
+// configHandler returns the effective configuration with secrets masked
+func (r *RouterV2) configHandler(w http.ResponseWriter, req *http.Request) {
+	response.Success(w, "Configuration retrieved", r.cfg.Redacted())
+}
+
+// debugRequest echoes the request as the gateway received it, with
+// sensitive headers masked, to debug what clients and proxies in front send
+func (r *RouterV2) debugRequest(w http.ResponseWriter, req *http.Request) {
+	dump := map[string]interface{}{
+		"method":      req.Method,
+		"uri":         req.RequestURI,
+		"proto":       req.Proto,
+		"host":        req.Host,
+		"remote_addr": req.RemoteAddr,
+		"headers":     r.headers.All(req.Header),
+	}
+	if addr, ok := acl.ClientIP(req); ok {
+		dump["client_ip"] = addr.String()
+	}
+	response.Success(w, "Request received", dump)
 }
 
 // websocketStats returns WebSocket statistics
 func (r *RouterV2) websocketStats(w http.ResponseWriter, req *http.Request) {
 	stats := map[string]interface{}{
-		"connected_clients": r.wsHub.GetClientCount(),
+		"connected_clients":    r.wsHub.GetClientCount(),
+		"connections_per_user": r.wsHub.GetUserConnectionCounts(),
+		"topics":               r.wsHub.GetTopicCounts(),
 	}
 	response.Success(w, "WebSocket stats", stats)
 }
 
-// websocketHandler handles WebSocket connections
+// websocketPublishRequest is the body of a publish request
+type websocketPublishRequest struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// websocketPublish sends a payload to the clients subscribed to a topic
+// @Summary Publish to a WebSocket topic
+// @Description Send a JSON payload to every WebSocket client subscribed to the topic, as a message of type "topic". Requires the admin or publisher role when authentication is enabled.
+// @Tags websocket
+// @Accept json
+// @Produce json
+// @Param message body websocketPublishRequest true "Topic and payload"
+// @Success 200 {object} response.Response
+// @Failure 400 {object} response.Response
+// @Security BearerAuth
+// @Router /api/websocket/publish [post]
+func (r *RouterV2) websocketPublish(w http.ResponseWriter, req *http.Request) {
+	var body websocketPublishRequest
+	if err := httpjson.Decode(w, req, &body); err != nil {
+		httpjson.WriteError(w, err)
+		return
+	}
+	if body.Topic == "" || len(body.Topic) > websocket.MaxTopicLength {
+		response.ErrorCode(w, http.StatusBadRequest, response.CodeValidationFailed,
+			fmt.Sprintf("topic must be 1 to %d characters", websocket.MaxTopicLength))
+		return
+	}
+	if len(body.Payload) == 0 {
+		body.Payload = json.RawMessage("null")
+	}
+
+	delivered := r.wsHub.Publish(body.Topic, body.Payload)
+	response.Success(w, "Message published", map[string]interface{}{
+		"topic":     body.Topic,
+		"delivered": delivered,
+	})
+}
+
+// websocketHandler handles WebSocket connections, authenticating the upgrade when auth is enabled
 func (r *RouterV2) websocketHandler(w http.ResponseWriter, req *http.Request) {
-	// Generate client ID (you might want to use user ID from auth)
-	clientID := fmt.Sprintf("client-%d", r.wsHub.GetClientCount()+1)
+	userID := websocket.AnonymousUser
+	if r.cfg.Auth.Enabled {
+		claims, err := r.authService.AuthenticateWebSocket(req)
+		if err != nil {
+			response.ErrorCode(w, http.StatusUnauthorized, auth.ErrorCode(err), err.Error())
+			return
+		}
+		userID = claims.UserID
+	}
 
-	websocket.ServeWS(r.wsHub, w, req, clientID)
+	websocket.ServeWS(r.wsHub, w, req, userID)
 }
@@ -0,0 +1,161 @@
+package schedule
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock abstracts time so schedules can be driven deterministically
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock backed by the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock returns the real wall clock
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// Policy describes how often a periodic task runs
+type Policy struct {
+	Interval    time.Duration // Base interval between runs
+	Jitter      float64       // Random spread as a fraction of the interval (0.1 = ±10%)
+	Multiplier  float64       // Backoff growth factor applied per consecutive failure
+	MaxInterval time.Duration // Upper bound for any interval, including jitter; Interval plus its jitter when unset
+}
+
+// State is a snapshot of a schedule
+type State struct {
+	Interval time.Duration `json:"interval"`
+	Failures int           `json:"failures"`
+	NextRun  time.Time     `json:"next_run"`
+}
+
+// Schedule computes jittered intervals with exponential backoff on failures
+type Schedule struct {
+	mu       sync.Mutex
+	policy   Policy
+	clock    Clock
+	rnd      *rand.Rand
+	failures int
+	interval time.Duration
+	nextRun  time.Time
+
+	observers []func(State)
+}
+
+// New creates a new schedule. A nil clock uses the system clock.
+func New(policy Policy, clock Clock) *Schedule {
+	if clock == nil {
+		clock = SystemClock()
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 1
+	}
+	if policy.Jitter < 0 {
+		policy.Jitter = 0
+	}
+	// Leave room for jitter above the interval, so runs spread both ways
+	if policy.MaxInterval <= 0 {
+		policy.MaxInterval = time.Duration(float64(policy.Interval) * (1 + policy.Jitter))
+	}
+
+	return &Schedule{
+		policy: policy,
+		clock:  clock,
+		rnd:    rand.New(rand.NewSource(clock.Now().UnixNano())),
+	}
+}
+
+// Next returns the delay until the next run and records it in the state,
+// which it passes to the observers
+func (s *Schedule) Next() time.Duration {
+	s.mu.Lock()
+	interval := s.next()
+	state := State{Interval: s.interval, Failures: s.failures, NextRun: s.nextRun}
+	observers := s.observers
+	s.mu.Unlock()
+
+	for _, observe := range observers {
+		observe(state)
+	}
+	return interval
+}
+
+// next picks the next interval. The caller must hold the lock.
+func (s *Schedule) next() time.Duration {
+	base := float64(s.policy.Interval) * math.Pow(s.policy.Multiplier, float64(s.failures))
+	if base > float64(s.policy.MaxInterval) {
+		base = float64(s.policy.MaxInterval)
+	}
+
+	// Spread the interval uniformly within ±Jitter
+	spread := s.policy.Jitter * (2*s.rnd.Float64() - 1)
+	interval := time.Duration(base * (1 + spread))
+	if interval > s.policy.MaxInterval {
+		interval = s.policy.MaxInterval
+	}
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+
+	s.interval = interval
+	s.nextRun = s.clock.Now().Add(interval)
+	return interval
+}
+
+// Observe calls fn with the state each time the next run is scheduled, such
+// as to export it as metrics
+func (s *Schedule) Observe(fn func(State)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers = append(s.observers, fn)
+}
+
+// After returns a channel that fires when the next run is due
+func (s *Schedule) After() <-chan time.Time {
+	return s.clock.After(s.Next())
+}
+
+// Success resets the backoff after a successful run
+func (s *Schedule) Success() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = 0
+}
+
+// Failure records a failed run, growing the next interval
+func (s *Schedule) Failure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+}
+
+// Report records the outcome of a run
+func (s *Schedule) Report(err error) {
+	if err != nil {
+		s.Failure()
+		return
+	}
+	s.Success()
+}
+
+// State returns the current schedule state
+func (s *Schedule) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return State{
+		Interval: s.interval,
+		Failures: s.failures,
+		NextRun:  s.nextRun,
+	}
+}
@@ -0,0 +1,100 @@
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// prefix marks values encrypted with the seal key
+const prefix = "sealed:"
+
+// ErrNoKey is returned when a value can't be sealed or opened without a key
+var ErrNoKey = errors.New("sealing secrets requires PROXY_TLS_SEAL_KEY")
+
+// ErrWrongKey is returned for a value sealed with a different key
+var ErrWrongKey = errors.New("value was sealed with a different key")
+
+var sealKey atomic.Pointer[[32]byte]
+
+// SetKey sets the secret values are encrypted with. An empty secret disables
+// sealing.
+func SetKey(secret string) {
+	if secret == "" {
+		sealKey.Store(nil)
+		return
+	}
+	key := sha256.Sum256([]byte(secret))
+	sealKey.Store(&key)
+}
+
+// Enabled reports whether a seal key is set
+func Enabled() bool {
+	return sealKey.Load() != nil
+}
+
+// Sealed reports whether value is in its sealed form
+func Sealed(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Seal encrypts value, leaving it as is when empty or already sealed
+func Seal(value string) (string, error) {
+	if value == "" || Sealed(value) {
+		return value, nil
+	}
+
+	gcm, err := sealCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a sealed value. A value that isn't sealed is returned as is,
+// as long as a key is set to seal it when it is stored.
+func Open(value string) (string, error) {
+	if !Sealed(value) {
+		if !Enabled() {
+			return "", ErrNoKey
+		}
+		return value, nil
+	}
+
+	gcm, err := sealCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed sealed value")
+	}
+	opened, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", ErrWrongKey
+	}
+	return string(opened), nil
+}
+
+// sealCipher returns the AES-GCM cipher for the seal key
+func sealCipher() (cipher.AEAD, error) {
+	key := sealKey.Load()
+	if key == nil {
+		return nil, ErrNoKey
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,189 @@
+package simulation
+
+import (
+	"sort"
+
+	"github.com/zakirkun/isekai/internal/database"
+	"github.com/zakirkun/isekai/internal/matcher"
+)
+
+// Request describes a single request replayed during a simulation
+type Request struct {
+	Method string `json:"method"`
+	Host   string `json:"host,omitempty"` // Host header sent, empty to match only routes without a host
+	Path   string `json:"path"`
+}
+
+// RouteRef identifies the route a request was matched to
+type RouteRef struct {
+	ID        int    `json:"id,omitempty"`
+	Method    string `json:"method"`
+	Host      string `json:"host,omitempty"`
+	Path      string `json:"path"`
+	TargetURL string `json:"target_url"`
+}
+
+// Summary holds match counts for one route table
+type Summary struct {
+	Matched   int `json:"matched"`
+	Unmatched int `json:"unmatched"`
+}
+
+// RouteChange describes how much traffic a route gains or loses
+type RouteChange struct {
+	Method   string `json:"method"`
+	Host     string `json:"host,omitempty"`
+	Path     string `json:"path"`
+	Current  int    `json:"current"`
+	Proposed int    `json:"proposed"`
+	Delta    int    `json:"delta"`
+}
+
+// Diff describes a request that is routed differently under the proposed table
+type Diff struct {
+	Request  Request   `json:"request"`
+	Current  *RouteRef `json:"current"`
+	Proposed *RouteRef `json:"proposed"`
+}
+
+// Report summarizes a simulation run
+type Report struct {
+	Total         int           `json:"total"`
+	Current       Summary       `json:"current"`
+	Proposed      Summary       `json:"proposed"`
+	Changed       int           `json:"changed"`
+	GainedTraffic []RouteChange `json:"gained_traffic"`
+	LostTraffic   []RouteChange `json:"lost_traffic"`
+	Diffs         []Diff        `json:"diffs,omitempty"`
+}
+
+// Run matches every request against both route tables without forwarding anything
+func Run(current, proposed *matcher.Matcher, requests []Request, includeDiffs bool) *Report {
+	report := &Report{
+		Total:         len(requests),
+		GainedTraffic: []RouteChange{},
+		LostTraffic:   []RouteChange{},
+	}
+
+	currentCounts := make(map[routeKey]int)
+	proposedCounts := make(map[routeKey]int)
+
+	for _, req := range requests {
+		currentRoute, currentFound := current.Match(req.Method, req.Host, req.Path)
+		proposedRoute, proposedFound := proposed.Match(req.Method, req.Host, req.Path)
+
+		if currentFound {
+			report.Current.Matched++
+			currentCounts[keyOf(currentRoute)]++
+		} else {
+			report.Current.Unmatched++
+		}
+
+		if proposedFound {
+			report.Proposed.Matched++
+			proposedCounts[keyOf(proposedRoute)]++
+		} else {
+			report.Proposed.Unmatched++
+		}
+
+		if sameDestination(currentRoute, proposedRoute) {
+			continue
+		}
+
+		report.Changed++
+		if includeDiffs {
+			report.Diffs = append(report.Diffs, Diff{
+				Request:  req,
+				Current:  refOf(currentRoute),
+				Proposed: refOf(proposedRoute),
+			})
+		}
+	}
+
+	keys := make(map[routeKey]struct{})
+	for key := range currentCounts {
+		keys[key] = struct{}{}
+	}
+	for key := range proposedCounts {
+		keys[key] = struct{}{}
+	}
+
+	for key := range keys {
+		change := RouteChange{
+			Method:   key.method,
+			Host:     key.host,
+			Path:     key.path,
+			Current:  currentCounts[key],
+			Proposed: proposedCounts[key],
+		}
+		change.Delta = change.Proposed - change.Current
+
+		switch {
+		case change.Delta > 0:
+			report.GainedTraffic = append(report.GainedTraffic, change)
+		case change.Delta < 0:
+			report.LostTraffic = append(report.LostTraffic, change)
+		}
+	}
+
+	sortChanges(report.GainedTraffic)
+	sortChanges(report.LostTraffic)
+
+	return report
+}
+
+// routeKey identifies a route across tables, since proposed routes have no IDs yet
+type routeKey struct {
+	method string
+	host   string
+	path   string
+}
+
+func keyOf(route *database.Route) routeKey {
+	return routeKey{method: route.Method, host: route.Host, path: route.Path}
+}
+
+func refOf(route *database.Route) *RouteRef {
+	if route == nil {
+		return nil
+	}
+	return &RouteRef{
+		ID:        route.ID,
+		Method:    route.Method,
+		Host:      route.Host,
+		Path:      route.Path,
+		TargetURL: route.TargetURL,
+	}
+}
+
+// sameDestination reports whether both routes would send the request to the same place
+func sameDestination(a, b *database.Route) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return keyOf(a) == keyOf(b) && a.TargetURL == b.TargetURL
+}
+
+// sortChanges orders changes by the size of the shift, largest first
+func sortChanges(changes []RouteChange) {
+	sort.Slice(changes, func(i, j int) bool {
+		di, dj := abs(changes[i].Delta), abs(changes[j].Delta)
+		if di != dj {
+			return di > dj
+		}
+		if changes[i].Path != changes[j].Path {
+			return changes[i].Path < changes[j].Path
+		}
+		if changes[i].Host != changes[j].Host {
+			return changes[i].Host < changes[j].Host
+		}
+		return changes[i].Method < changes[j].Method
+	})
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
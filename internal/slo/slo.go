@@ -0,0 +1,262 @@
+package slo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultWindowDays is the compliance window of SLOs that don't set one
+const DefaultWindowDays = 30
+
+// Bounds of an SLO's compliance window. The slowest burn rate alert looks
+// back three days, so shorter windows would alert on more than they cover.
+const (
+	MinWindowDays = 7
+	MaxWindowDays = 90
+)
+
+// Metrics the generated rules read, labelled by route path
+const (
+	requestsMetric = "isekai_upstream_requests_total"
+	durationMetric = "isekai_upstream_request_duration_seconds"
+)
+
+// LatencyBuckets are the latency thresholds an SLO may use, in milliseconds:
+// the buckets of isekai_upstream_request_duration_seconds, so the generated
+// rules count requests under the threshold exactly
+var LatencyBuckets = func() []int {
+	buckets := make([]int, len(prometheus.DefBuckets))
+	for i, b := range prometheus.DefBuckets {
+		buckets[i] = int(math.Round(b * 1000))
+	}
+	return buckets
+}()
+
+// Config is a route's service level objective: the percent of its requests
+// over a window that must succeed, or finish within a latency threshold
+type Config struct {
+	Objective  float64 `json:"objective"`             // Percent of good requests, such as 99.5
+	LatencyMS  int     `json:"latency_ms,omitempty"`  // Slower requests are bad; 0 counts 5xx responses as bad instead
+	WindowDays int     `json:"window_days,omitempty"` // Compliance window, DefaultWindowDays when 0
+}
+
+// Validate checks that the objective is a percentage short of 100, that the
+// latency threshold is one of LatencyBuckets and that the window is within
+// bounds
+func (c *Config) Validate() error {
+	if !(c.Objective > 0 && c.Objective < 100) {
+		return fmt.Errorf("slo objective must be above 0 and below 100, got %v", c.Objective)
+	}
+	if c.LatencyMS < 0 {
+		return errors.New("slo latency_ms can't be negative")
+	}
+	if c.LatencyMS > 0 && !slices.Contains(LatencyBuckets, c.LatencyMS) {
+		return fmt.Errorf("slo latency_ms must be one of %s to match a histogram bucket, got %d", joinInts(LatencyBuckets), c.LatencyMS)
+	}
+	if c.WindowDays != 0 && (c.WindowDays < MinWindowDays || c.WindowDays > MaxWindowDays) {
+		return fmt.Errorf("slo window_days must be between %d and %d", MinWindowDays, MaxWindowDays)
+	}
+	return nil
+}
+
+// Window returns the compliance window in days
+func (c *Config) Window() int {
+	if c.WindowDays == 0 {
+		return DefaultWindowDays
+	}
+	return c.WindowDays
+}
+
+// ErrorBudget returns the fraction of requests that may be bad
+func (c *Config) ErrorBudget() float64 {
+	return round((100 - c.Objective) / 100)
+}
+
+// Compliance is how an SLO stands over its window
+type Compliance struct {
+	Objective       float64 `json:"objective"`
+	LatencyMS       int     `json:"latency_ms,omitempty"`
+	WindowDays      int     `json:"window_days"`
+	Requests        int64   `json:"requests"`
+	BadRequests     int64   `json:"bad_requests"`
+	Compliance      float64 `json:"compliance"`       // Percent of good requests, 100 without traffic
+	Met             bool    `json:"met"`              // Compliance reaches the objective
+	ErrorBudget     float64 `json:"error_budget"`     // Bad requests the window's traffic allows
+	BudgetRemaining float64 `json:"budget_remaining"` // Percent of the error budget left, negative once overspent
+}
+
+// Evaluate computes the compliance of requests, bad of which were bad
+func Evaluate(c *Config, requests, bad int64) Compliance {
+	result := Compliance{
+		Objective:       c.Objective,
+		LatencyMS:       c.LatencyMS,
+		WindowDays:      c.Window(),
+		Requests:        requests,
+		BadRequests:     bad,
+		Compliance:      100,
+		Met:             true,
+		BudgetRemaining: 100,
+	}
+	if requests == 0 {
+		return result
+	}
+
+	result.Compliance = round(100 * float64(requests-bad) / float64(requests))
+	result.Met = result.Compliance >= c.Objective
+	result.ErrorBudget = round(float64(requests) * c.ErrorBudget())
+	if result.ErrorBudget > 0 {
+		result.BudgetRemaining = round(100 * (1 - float64(bad)/result.ErrorBudget))
+	} else if bad > 0 {
+		result.BudgetRemaining = -100
+	}
+	return result
+}
+
+// Target is a route's SLO to generate rules for
+type Target struct {
+	RouteID int
+	Route   string // The route label of the upstream metrics: the route's path
+	SLO     *Config
+}
+
+// ruleWindows are the windows error ratios are recorded over
+var ruleWindows = []string{"5m", "30m", "1h", "2h", "6h", "1d", "3d"}
+
+// windowHours is the length of each rule window in hours
+var windowHours = map[string]float64{"5m": 5.0 / 60, "30m": 0.5, "1h": 1, "2h": 2, "6h": 6, "1d": 24, "3d": 72}
+
+// burnAlert fires when the error budget burns fast enough, over both a long
+// and a short window, to spend the given share of the budget
+type burnAlert struct {
+	long, short string
+	spent       float64
+}
+
+// alerts are the multiwindow burn rate alerts: pages for budgets spent within
+// hours, tickets for budgets spent within days
+var alerts = []struct {
+	name, severity, pending, summary string
+	windows                          []burnAlert
+}{
+	{"IsekaiSLOErrorBudgetBurnFast", "page", "2m", "burning its error budget fast", []burnAlert{{"1h", "5m", 0.02}, {"6h", "30m", 0.05}}},
+	{"IsekaiSLOErrorBudgetBurnSlow", "ticket", "15m", "steadily burning its error budget", []burnAlert{{"1d", "2h", 0.10}, {"3d", "6h", 0.10}}},
+}
+
+// ruleFile, ruleGroup and rule follow the Prometheus rule file format
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Rules generates a Prometheus rule file with a group per target: its error
+// ratio recorded over each window, and alerts on the rate its error budget
+// burns
+func Rules(targets []Target) ([]byte, error) {
+	file := ruleFile{Groups: []ruleGroup{}}
+	for _, target := range targets {
+		file.Groups = append(file.Groups, group(target))
+	}
+	return yaml.Marshal(file)
+}
+
+// group returns the rules of one target
+func group(target Target) ruleGroup {
+	labels := map[string]string{"route": target.Route, "route_id": strconv.Itoa(target.RouteID)}
+	selector := fmt.Sprintf(`{route_id=%q}`, labels["route_id"])
+
+	g := ruleGroup{Name: fmt.Sprintf("isekai-slo-route-%d", target.RouteID)}
+	for _, window := range ruleWindows {
+		g.Rules = append(g.Rules, rule{
+			Record: recordName(window),
+			Expr:   errorRatio(target, window),
+			Labels: labels,
+		})
+	}
+
+	budget := target.SLO.ErrorBudget()
+	kind := "requests failing with a 5xx"
+	if target.SLO.LatencyMS > 0 {
+		kind = fmt.Sprintf("requests slower than %dms", target.SLO.LatencyMS)
+	}
+	for _, alert := range alerts {
+		var conditions []string
+		for _, w := range alert.windows {
+			burn := formatFloat(round(w.spent * float64(target.SLO.Window()) * 24 / windowHours[w.long]))
+			threshold := fmt.Sprintf("(%s * %s)", burn, formatFloat(budget))
+			conditions = append(conditions, fmt.Sprintf("(%s%s > %s and %s%s > %s)",
+				recordName(w.long), selector, threshold, recordName(w.short), selector, threshold))
+		}
+
+		alertLabels := map[string]string{"severity": alert.severity}
+		for name, value := range labels {
+			alertLabels[name] = value
+		}
+		g.Rules = append(g.Rules, rule{
+			Alert:  alert.name,
+			Expr:   strings.Join(conditions, " or "),
+			For:    alert.pending,
+			Labels: alertLabels,
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("Route %s is %s", target.Route, alert.summary),
+				"description": fmt.Sprintf("Route %d (%s) has an objective of %s%% over %d days, counting %s as bad. Bad requests are at {{ $value | humanizePercentage }}.",
+					target.RouteID, target.Route, formatFloat(target.SLO.Objective), target.SLO.Window(), kind),
+			},
+		})
+	}
+	return g
+}
+
+// recordName returns the name of the error ratio recorded over window
+func recordName(window string) string {
+	return "isekai:slo_errors:ratio_rate" + window
+}
+
+// errorRatio returns the expression for the share of the target's requests
+// that were bad over window
+func errorRatio(target Target, window string) string {
+	route := strconv.Quote(target.Route)
+	if target.SLO.LatencyMS == 0 {
+		return fmt.Sprintf(`sum(rate(%s{route=%s,status_class="5xx"}[%s])) / sum(rate(%s{route=%s}[%s]))`,
+			requestsMetric, route, window, requestsMetric, route, window)
+	}
+	le := strconv.Quote(strconv.FormatFloat(float64(target.SLO.LatencyMS)/1000, 'g', -1, 64))
+	return fmt.Sprintf(`1 - (sum(rate(%s_bucket{route=%s,le=%s}[%s])) / sum(rate(%s_count{route=%s}[%s])))`,
+		durationMetric, route, le, window, durationMetric, route, window)
+}
+
+// round rounds away floating point noise
+func round(f float64) float64 {
+	return math.Round(f*1e9) / 1e9
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, ", ")
+}
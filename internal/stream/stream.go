@@ -0,0 +1,94 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ContentType is the media type of Server-Sent Events responses
+const ContentType = "text/event-stream"
+
+// IsEventStream reports whether h declares a Server-Sent Events body
+func IsEventStream(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == ContentType
+}
+
+// Accepts reports whether r asks for an event stream
+func Accepts(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		if strings.Contains(value, ContentType) {
+			return true
+		}
+	}
+	return false
+}
+
+type deadlinesKey struct{}
+
+// Deadline cancels a request's context when its timeout elapses, unless a
+// streaming response lifted it first
+type Deadline struct {
+	timer   *time.Timer
+	cancel  context.CancelCauseFunc
+	expires time.Time
+	lifted  atomic.Bool
+}
+
+// WithDeadline returns a context cancelled after timeout with
+// context.DeadlineExceeded as its cause. Unlike context.WithTimeout, the
+// deadline can be lifted by Lift once an event stream starts.
+func WithDeadline(parent context.Context, timeout time.Duration) (context.Context, *Deadline) {
+	ctx, cancel := context.WithCancelCause(parent)
+	d := &Deadline{cancel: cancel, expires: time.Now().Add(timeout)}
+	d.timer = time.AfterFunc(timeout, func() { cancel(context.DeadlineExceeded) })
+
+	deadlines, _ := parent.Value(deadlinesKey{}).([]*Deadline)
+	deadlines = append(deadlines[:len(deadlines):len(deadlines)], d)
+	return context.WithValue(ctx, deadlinesKey{}, deadlines), d
+}
+
+// Stop releases the deadline, cancelling its context
+func (d *Deadline) Stop() {
+	d.timer.Stop()
+	d.cancel(context.Canceled)
+}
+
+// Lift stops every deadline of ctx that hasn't elapsed, so a streaming
+// response runs until either side closes it
+func Lift(ctx context.Context) {
+	deadlines, _ := ctx.Value(deadlinesKey{}).([]*Deadline)
+	for _, d := range deadlines {
+		d.lifted.Store(true)
+		d.timer.Stop()
+	}
+}
+
+// Remaining returns the time left before the nearest deadline of ctx, set by
+// WithDeadline and not lifted or by the context itself. ok is false when ctx
+// has no deadline.
+func Remaining(ctx context.Context) (remaining time.Duration, ok bool) {
+	if expires, set := ctx.Deadline(); set {
+		remaining, ok = time.Until(expires), true
+	}
+	deadlines, _ := ctx.Value(deadlinesKey{}).([]*Deadline)
+	for _, d := range deadlines {
+		if d.lifted.Load() {
+			continue
+		}
+		if left := time.Until(d.expires); !ok || left < remaining {
+			remaining, ok = left, true
+		}
+	}
+	return remaining, ok
+}
+
+// TimedOut reports whether ctx was cancelled by a deadline
+func TimedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), context.DeadlineExceeded)
+}
@@ -0,0 +1,110 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Reasons a request is held back from the upstream
+var (
+	ErrQueueFull    = errors.New("upstream rate limit reached")
+	ErrQueueTimeout = errors.New("timed out waiting for an upstream rate limit token")
+)
+
+// Throttle is a token bucket capping the requests sent to an upstream per
+// second. Requests over the rate wait in a queue of bounded size for their
+// token, and are turned away at once when it wouldn't come within the queue
+// timeout.
+type Throttle struct {
+	limiter *rate.Limiter
+	queue   int64
+	timeout time.Duration
+	queued  atomic.Int64
+	onQueue func(delta int) // Called as requests enter and leave the queue, may be nil
+}
+
+// New creates a throttle allowing perSecond requests with bursts of burst,
+// queueing up to queue more for up to timeout. onQueue may be nil.
+func New(perSecond float64, burst, queue int, timeout time.Duration, onQueue func(delta int)) *Throttle {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Throttle{
+		limiter: rate.NewLimiter(rate.Limit(perSecond), burst),
+		queue:   int64(queue),
+		timeout: timeout,
+		onQueue: onQueue,
+	}
+}
+
+// Rate returns the requests allowed per second
+func (t *Throttle) Rate() float64 {
+	return float64(t.limiter.Limit())
+}
+
+// Burst returns the requests allowed at once
+func (t *Throttle) Burst() int {
+	return t.limiter.Burst()
+}
+
+// Queued returns the number of requests waiting for a token
+func (t *Throttle) Queued() int {
+	return int(t.queued.Load())
+}
+
+// Wait takes a token, waiting in the queue if there is room
+func (t *Throttle) Wait(ctx context.Context) error {
+	if t.limiter.Allow() {
+		return nil
+	}
+
+	if t.queued.Add(1) > t.queue {
+		t.queued.Add(-1)
+		return ErrQueueFull
+	}
+	t.changeQueue(1)
+	defer func() {
+		t.queued.Add(-1)
+		t.changeQueue(-1)
+	}()
+
+	// Reserve the next token, giving it back when it comes too late
+	reservation := t.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay > t.timeout {
+		reservation.Cancel()
+		return ErrQueueTimeout
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
+
+func (t *Throttle) changeQueue(delta int) {
+	if t.onQueue != nil {
+		t.onQueue(delta)
+	}
+}
+
+// Reason returns a metric label for an error returned by Wait
+func Reason(err error) string {
+	switch {
+	case errors.Is(err, ErrQueueFull):
+		return "queue_full"
+	case errors.Is(err, ErrQueueTimeout):
+		return "queue_timeout"
+	default:
+		return "canceled"
+	}
+}
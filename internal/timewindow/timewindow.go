@@ -0,0 +1,272 @@
+package timewindow
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxExpressionLength is the longest schedule expression a route may use
+const MaxExpressionLength = 512
+
+// days are the weekday names an expression may use, Sunday first like
+// time.Weekday
+var days = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Schedule repeats a route's active time every week, as weekday and time of
+// day ranges read in a timezone. The expression lists ranges separated by
+// semicolons, each optionally preceded by the days it applies to:
+//
+//	Mon-Fri 09:00-17:00; Sat 10:00-14:00
+//	Fri,Sat 22:00-02:00
+//	* 08:00-12:00,13:00-18:00
+//
+// A range ending before it starts runs past midnight into the next day.
+type Schedule struct {
+	Expression string `json:"expression"`
+	Timezone   string `json:"timezone,omitempty"` // IANA name such as Europe/Berlin, defaults to UTC
+}
+
+// Validate checks that the expression parses and the timezone is known
+func (s *Schedule) Validate() error {
+	_, err := s.compile()
+	return err
+}
+
+// span is a time of day range on the weekdays set in days, in minutes after
+// midnight. end is up to 24 hours past midnight of the next day.
+type span struct {
+	days       [7]bool
+	start, end int
+}
+
+// weekly is a compiled schedule
+type weekly struct {
+	loc   *time.Location
+	spans []span
+}
+
+// compile parses the expression and loads the timezone
+func (s *Schedule) compile() (*weekly, error) {
+	if len(s.Expression) > MaxExpressionLength {
+		return nil, fmt.Errorf("schedule expression can't be longer than %d characters", MaxExpressionLength)
+	}
+	loc := time.UTC
+	if s.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return nil, fmt.Errorf("unknown schedule timezone %q", s.Timezone)
+		}
+	}
+
+	w := &weekly{loc: loc}
+	for _, entry := range strings.Split(s.Expression, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid schedule entry %q, expected days and time ranges", strings.TrimSpace(entry))
+		}
+
+		var set [7]bool
+		if len(fields) == 1 {
+			set = [7]bool{true, true, true, true, true, true, true}
+		} else {
+			var err error
+			if set, err = parseDays(fields[0]); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, r := range strings.Split(fields[len(fields)-1], ",") {
+			start, end, err := parseRange(r)
+			if err != nil {
+				return nil, err
+			}
+			w.spans = append(w.spans, span{days: set, start: start, end: end})
+		}
+	}
+	if len(w.spans) == 0 {
+		return nil, errors.New("schedule expression has no time ranges")
+	}
+	return w, nil
+}
+
+// parseDays parses * or a comma separated list of days and day ranges such
+// as Mon-Fri. A range may wrap around the week, as Fri-Mon does.
+func parseDays(s string) ([7]bool, error) {
+	var set [7]bool
+	if s == "*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		first, ok := parseDay(from)
+		last := first
+		if isRange {
+			var lastOK bool
+			last, lastOK = parseDay(to)
+			ok = ok && lastOK
+		}
+		if !ok {
+			return set, fmt.Errorf("invalid schedule days %q, expected names such as Mon or Mon-Fri", item)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			set[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return set, nil
+}
+
+// parseDay parses a weekday's three letter name
+func parseDay(s string) (int, bool) {
+	i := slices.Index(days, strings.ToLower(s))
+	return i, i >= 0
+}
+
+// parseRange parses HH:MM-HH:MM into minutes after midnight, moving an end
+// at or before the start to the next day
+func parseRange(s string) (start, end int, err error) {
+	from, to, ok := strings.Cut(s, "-")
+	if ok {
+		start, ok = parseClock(from)
+	}
+	if ok {
+		end, ok = parseClock(to)
+	}
+	if !ok || start == 24*60 {
+		return 0, 0, fmt.Errorf("invalid schedule time range %q, expected HH:MM-HH:MM", s)
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("schedule time range %q is empty", s)
+	}
+	if end < start {
+		end += 24 * 60
+	}
+	return start, end, nil
+}
+
+// parseClock parses HH:MM into minutes after midnight, up to 24:00
+func parseClock(s string) (int, bool) {
+	hh, mm, ok := strings.Cut(s, ":")
+	if !ok || len(hh) != 2 || len(mm) != 2 {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+// interval is an absolute span of active time
+type interval struct {
+	start, end time.Time
+}
+
+// intervals returns the schedule's active time from the day before now to
+// a week after it, merged where ranges overlap or touch. Times of day are
+// placed with time.Date, so a range spanning a DST change is an hour shorter
+// or longer, and one starting in a skipped hour starts at the time.Date
+// normalizes it to.
+func (w *weekly) intervals(now time.Time) []interval {
+	local := now.In(w.loc)
+	year, month, day := local.Date()
+
+	var list []interval
+	for offset := -1; offset <= 8; offset++ {
+		midnight := time.Date(year, month, day+offset, 0, 0, 0, 0, w.loc)
+		weekday := midnight.Weekday()
+		for _, s := range w.spans {
+			if !s.days[weekday] {
+				continue
+			}
+			list = append(list, interval{
+				start: time.Date(year, month, day+offset, 0, s.start, 0, 0, w.loc),
+				end:   time.Date(year, month, day+offset, 0, s.end, 0, 0, w.loc),
+			})
+		}
+	}
+	slices.SortFunc(list, func(a, b interval) int { return a.start.Compare(b.start) })
+
+	merged := list[:0]
+	for _, in := range list {
+		if n := len(merged); n > 0 && !in.start.After(merged[n-1].end) {
+			if in.end.After(merged[n-1].end) {
+				merged[n-1].end = in.end
+			}
+			continue
+		}
+		merged = append(merged, in)
+	}
+	return merged
+}
+
+// state reports whether the schedule is active at now and when that next
+// changes
+func (w *weekly) state(now time.Time) (bool, time.Time) {
+	list := w.intervals(now)
+	for _, in := range list {
+		if now.Before(in.start) {
+			return false, in.start
+		}
+		if now.Before(in.end) {
+			return true, in.end
+		}
+	}
+	// Every day active around the clock: look again at the end of the
+	// computed time
+	return len(list) > 0, list[len(list)-1].end
+}
+
+// Window is when a route is active: between From and Until, both optional,
+// and within the weekly schedule when it has one
+type Window struct {
+	from, until *time.Time
+	weekly      *weekly
+}
+
+// New compiles a route's window. schedule may be nil for a route active
+// the whole time between from and until.
+func New(from, until *time.Time, schedule *Schedule) (*Window, error) {
+	if from != nil && until != nil && !until.After(*from) {
+		return nil, errors.New("active_until must be after active_from")
+	}
+	w := &Window{from: from, until: until}
+	if schedule != nil {
+		var err error
+		if w.weekly, err = schedule.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// State reports whether the window is open at now and when that may next
+// change, the zero time when it never will. Checking again before next
+// gives the same answer, so callers cache the result until then.
+func (w *Window) State(now time.Time) (active bool, next time.Time) {
+	if w.until != nil && !now.Before(*w.until) {
+		return false, time.Time{}
+	}
+	if w.from != nil && now.Before(*w.from) {
+		return false, *w.from
+	}
+
+	active = true
+	if w.weekly != nil {
+		active, next = w.weekly.state(now)
+	}
+	if w.until != nil && (next.IsZero() || w.until.Before(next)) {
+		next = *w.until
+	}
+	return active, next
+}
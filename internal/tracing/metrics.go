@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zakirkun/isekai/pkg/config"
+	prombridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// MeterProvider exports metrics over OTLP
+type MeterProvider struct {
+	provider *sdkmetric.MeterProvider
+}
+
+// NewMeterProvider creates a meter provider that pushes the metrics in
+// gatherer to the OTLP HTTP endpoint every cfg.MetricsInterval, alongside the
+// Prometheus endpoint, and installs it as the global one
+func NewMeterProvider(cfg *config.TracingConfig, gatherer prometheus.Gatherer) (*MeterProvider, error) {
+	exporter, err := otlpmetrichttp.New(
+		context.Background(),
+		otlpmetrichttp.WithEndpoint(cfg.OTELEndpoint),
+		otlpmetrichttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+	}
+
+	res, err := serviceResource(cfg.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(cfg.MetricsInterval),
+		sdkmetric.WithProducer(prombridge.NewMetricProducer(prombridge.WithGatherer(gatherer))),
+	)
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetMeterProvider(provider)
+
+	return &MeterProvider{provider: provider}, nil
+}
+
+// Shutdown flushes the last metrics and stops the exporter
+func (mp *MeterProvider) Shutdown(ctx context.Context) error {
+	return mp.provider.Shutdown(ctx)
+}
@@ -4,55 +4,66 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/zakirkun/isekai/pkg/config"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
+// Samplers selectable with TRACING_SAMPLER
+const (
+	SamplerAlways = "always"
+	SamplerNever  = "never"
+	SamplerRatio  = "ratio"
+	SamplerParent = "parent"
+)
+
 // TracerProvider manages distributed tracing
 type TracerProvider struct {
 	provider *sdktrace.TracerProvider
 	tracer   trace.Tracer
 }
 
-// New creates a new tracer provider with OTLP HTTP exporter
-func New(serviceName, endpoint string) (*TracerProvider, error) {
+// New creates a new tracer provider with OTLP HTTP exporter and installs it,
+// along with the W3C trace context and baggage propagator, as the global one
+func New(cfg *config.TracingConfig) (*TracerProvider, error) {
+	sampler, err := Sampler(cfg.Sampler, cfg.SampleRatio)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create OTLP HTTP exporter
 	exporter, err := otlptracehttp.New(
 		context.Background(),
-		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithEndpoint(cfg.OTELEndpoint),
 		otlptracehttp.WithInsecure(), // Use WithTLSClientConfig for secure connections
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
 	}
 
-	// Create resource
-	res, err := resource.New(
-		context.Background(),
-		resource.WithAttributes(
-			semconv.ServiceNameKey.String(serviceName),
-		),
-	)
+	res, err := serviceResource(cfg.ServiceName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create resource: %w", err)
+		return nil, err
 	}
 
 	// Create tracer provider
 	provider := sdktrace.NewTracerProvider(
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSampler(sampler),
 	)
 
-	// Set global tracer provider
+	// Set global tracer provider and propagator
 	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(Propagator())
 
-	tracer := provider.Tracer(serviceName)
+	tracer := provider.Tracer(cfg.ServiceName)
 
 	return &TracerProvider{
 		provider: provider,
@@ -60,6 +71,48 @@ func New(serviceName, endpoint string) (*TracerProvider, error) {
 	}, nil
 }
 
+// Propagator returns the propagator for W3C traceparent, tracestate and
+// baggage headers
+func Propagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+// Sampler returns the named sampler. The ratio sampler keeps ratio of all
+// traces; the parent sampler follows the caller's decision and applies the
+// ratio to traces that start at the gateway.
+func Sampler(name string, ratio float64) (sdktrace.Sampler, error) {
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("sample ratio must be between 0 and 1, got %v", ratio)
+	}
+
+	switch name {
+	case SamplerAlways:
+		return sdktrace.AlwaysSample(), nil
+	case SamplerNever:
+		return sdktrace.NeverSample(), nil
+	case SamplerRatio:
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case SamplerParent:
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	default:
+		return nil, fmt.Errorf("unknown sampler %q, expected always, never, ratio or parent", name)
+	}
+}
+
+// serviceResource describes the gateway to the collector
+func serviceResource(serviceName string) (*resource.Resource, error) {
+	res, err := resource.New(
+		context.Background(),
+		resource.WithAttributes(
+			semconv.ServiceNameKey.String(serviceName),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+	return res, nil
+}
+
 // Tracer returns the tracer
 func (tp *TracerProvider) Tracer() trace.Tracer {
 	return tp.tracer
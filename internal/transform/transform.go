@@ -0,0 +1,365 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zakirkun/isekai/internal/compress"
+)
+
+// Directions a transformation applies to
+const (
+	DirectionRequest  = "request"
+	DirectionResponse = "response"
+)
+
+// Rules is a route's body transformation. Bodies that aren't JSON, are too
+// large or can't be transformed pass through unchanged unless Strict is set.
+type Rules struct {
+	Request  *Ops `json:"request,omitempty"`
+	Response *Ops `json:"response,omitempty"`
+	Strict   bool `json:"strict,omitempty"`
+}
+
+// Ops are the operations applied to a JSON object, in field order. Fields are
+// addressed by dotted paths such as "user.name". A top-level array has the
+// operations applied to each of its objects.
+type Ops struct {
+	Rename map[string]string      `json:"rename,omitempty"` // Moves a field to a new path
+	Nest   map[string][]string    `json:"nest,omitempty"`   // Moves fields into the object at the key
+	Unnest []string               `json:"unnest,omitempty"` // Lifts an object's fields into its parent
+	Delete []string               `json:"delete,omitempty"`
+	Set    map[string]interface{} `json:"set,omitempty"` // Injects constant values
+}
+
+// ErrNotJSON is returned for bodies that aren't valid JSON
+var ErrNotJSON = errors.New("body is not valid JSON")
+
+// ErrTooLarge is returned for bodies over the size cap
+var ErrTooLarge = errors.New("body exceeds the transform size cap")
+
+// Error is returned in strict mode when a body can't be transformed
+type Error struct {
+	Direction string
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s transform failed: %v", e.Direction, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks that every path is well formed
+func (r *Rules) Validate() error {
+	for _, ops := range []*Ops{r.Request, r.Response} {
+		if ops == nil {
+			continue
+		}
+
+		var paths []string
+		for from, to := range ops.Rename {
+			paths = append(paths, from, to)
+		}
+		for target, fields := range ops.Nest {
+			paths = append(paths, target)
+			paths = append(paths, fields...)
+		}
+		paths = append(paths, ops.Unnest...)
+		paths = append(paths, ops.Delete...)
+		for path := range ops.Set {
+			paths = append(paths, path)
+		}
+
+		for _, path := range paths {
+			if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+				return fmt.Errorf("invalid transform path %q", path)
+			}
+		}
+	}
+	return nil
+}
+
+// Ops returns the operations for a direction
+func (r *Rules) Ops(direction string) *Ops {
+	if direction == DirectionResponse {
+		return r.Response
+	}
+	return r.Request
+}
+
+// Apply transforms a JSON body
+func (o *Ops) Apply(body []byte) ([]byte, error) {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, ErrNotJSON
+	}
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if err := o.apply(v); err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		for _, item := range v {
+			if obj, ok := item.(map[string]interface{}); ok {
+				if err := o.apply(obj); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// apply runs the operations on one object
+func (o *Ops) apply(obj map[string]interface{}) error {
+	for _, from := range sortedKeys(o.Rename) {
+		if v, ok := lookup(obj, from); ok {
+			remove(obj, from)
+			if err := assign(obj, o.Rename[from], v); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, target := range sortedKeys(o.Nest) {
+		for _, field := range o.Nest[target] {
+			v, ok := lookup(obj, field)
+			if !ok {
+				continue
+			}
+			remove(obj, field)
+			if err := assign(obj, target+"."+lastSegment(field), v); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, path := range o.Unnest {
+		v, ok := lookup(obj, path)
+		if !ok {
+			continue
+		}
+		nested, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("cannot unnest %q: not an object", path)
+		}
+		remove(obj, path)
+
+		parent := ""
+		if i := strings.LastIndexByte(path, '.'); i >= 0 {
+			parent = path[:i+1]
+		}
+		for _, k := range sortedKeys(nested) {
+			if err := assign(obj, parent+k, nested[k]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, path := range o.Delete {
+		remove(obj, path)
+	}
+
+	for _, path := range sortedKeys(o.Set) {
+		if err := assign(obj, path, o.Set[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransformRequest applies the request operations to a JSON request body.
+// Bodies that can't be transformed are forwarded unchanged, or rejected with
+// an error in strict mode.
+func (r *Rules) TransformRequest(req *http.Request, maxBody int64) error {
+	if r.Request == nil || !IsJSON(req.Header.Get("Content-Type")) || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	encoding := compress.Normalize(req.Header.Get("Content-Encoding"))
+	if encoding != "" && !compress.Supported(encoding) {
+		return r.fail(DirectionRequest, fmt.Errorf("cannot transform %s encoded body", encoding))
+	}
+
+	body, err := r.transformBody(DirectionRequest, &req.Body, encoding, maxBody)
+	if err != nil || body == nil {
+		return err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+// TransformResponse applies the response operations to a JSON upstream response
+func (r *Rules) TransformResponse(resp *http.Response, maxBody int64) error {
+	if r.Response == nil || !IsJSON(resp.Header.Get("Content-Type")) || resp.Body == nil {
+		return nil
+	}
+	encoding := compress.Normalize(resp.Header.Get("Content-Encoding"))
+	if encoding != "" && !compress.Supported(encoding) {
+		return r.fail(DirectionResponse, fmt.Errorf("cannot transform %s encoded body", encoding))
+	}
+
+	body, err := r.transformBody(DirectionResponse, &resp.Body, encoding, maxBody)
+	if err != nil || body == nil {
+		return err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// transformBody reads *body up to maxBody and transforms it. A body encoded
+// with encoding is decoded, within maxBody too, and the result encoded the
+// same way. When the body is left unchanged *body is replaced so it still
+// reads in full, and nil is returned with an error only in strict mode.
+func (r *Rules) transformBody(direction string, body *io.ReadCloser, encoding string, maxBody int64) ([]byte, error) {
+	original := *body
+	buf, err := io.ReadAll(io.LimitReader(original, maxBody+1))
+	if err != nil {
+		*body = readCloser{io.MultiReader(bytes.NewReader(buf), original), original}
+		return nil, r.fail(direction, err)
+	}
+	if int64(len(buf)) > maxBody {
+		*body = readCloser{io.MultiReader(bytes.NewReader(buf), original), original}
+		return nil, r.fail(direction, ErrTooLarge)
+	}
+	original.Close()
+
+	// Empty bodies, such as those of 204 responses, have nothing to transform
+	if len(buf) == 0 {
+		*body = http.NoBody
+		return nil, nil
+	}
+
+	plain := buf
+	if encoding != "" {
+		if plain, err = compress.Decode(encoding, buf, maxBody); err != nil {
+			if errors.Is(err, compress.ErrTooLarge) {
+				err = ErrTooLarge
+			}
+			*body = io.NopCloser(bytes.NewReader(buf))
+			return nil, r.fail(direction, err)
+		}
+	}
+
+	transformed, err := r.Ops(direction).Apply(plain)
+	if err == nil && encoding != "" {
+		transformed, err = compress.Encode(encoding, transformed)
+	}
+	if err != nil {
+		*body = io.NopCloser(bytes.NewReader(buf))
+		return nil, r.fail(direction, err)
+	}
+	return transformed, nil
+}
+
+// fail returns err in strict mode and nil otherwise
+func (r *Rules) fail(direction string, err error) error {
+	if r.Strict {
+		return &Error{Direction: direction, Err: err}
+	}
+	return nil
+}
+
+// Skip leaves a body untransformed for err, such as the gateway having no
+// memory to buffer it, failing in strict mode like any body that can't be
+// transformed
+func (r *Rules) Skip(direction string, err error) error {
+	return r.fail(direction, err)
+}
+
+// IsJSON reports whether a Content-Type is JSON
+func IsJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// lookup returns the value at a dotted path
+func lookup(obj map[string]interface{}, path string) (interface{}, bool) {
+	segments := strings.Split(path, ".")
+	for _, key := range segments[:len(segments)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		obj = next
+	}
+	v, ok := obj[segments[len(segments)-1]]
+	return v, ok
+}
+
+// remove deletes the value at a dotted path
+func remove(obj map[string]interface{}, path string) {
+	segments := strings.Split(path, ".")
+	for _, key := range segments[:len(segments)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		obj = next
+	}
+	delete(obj, segments[len(segments)-1])
+}
+
+// assign sets the value at a dotted path, creating intermediate objects
+func assign(obj map[string]interface{}, path string, v interface{}) error {
+	segments := strings.Split(path, ".")
+	for _, key := range segments[:len(segments)-1] {
+		existing, found := obj[key]
+		if !found {
+			next := make(map[string]interface{})
+			obj[key] = next
+			obj = next
+			continue
+		}
+		next, ok := existing.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("cannot set %q: %q is not an object", path, key)
+		}
+		obj = next
+	}
+	obj[segments[len(segments)-1]] = v
+	return nil
+}
+
+// lastSegment returns the final key of a dotted path
+func lastSegment(path string) string {
+	return path[strings.LastIndexByte(path, '.')+1:]
+}
+
+// sortedKeys returns a map's keys in order so operations apply deterministically
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readCloser reads from a replacement reader and closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,235 @@
+package upstreamauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/seal"
+)
+
+// Modes of proving to an upstream that a request came through the gateway
+const (
+	ModeHMAC   = "hmac"   // Signs the request with a shared secret
+	ModeJWT    = "jwt"    // Sends a short-lived token carrying the caller's claims
+	ModeBasic  = "basic"  // Sends static basic auth credentials
+	ModeBearer = "bearer" // Sends a static bearer token
+)
+
+// Headers set in hmac mode
+const (
+	SignatureHeader     = "X-Isekai-Signature"
+	TimestampHeader     = "X-Isekai-Timestamp"
+	ContentSHA256Header = "X-Isekai-Content-SHA256"
+)
+
+// UnsignedPayload is the content hash of bodies too large to sign, which
+// upstreams may choose to reject
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Issuer is the issuer of tokens minted in jwt mode
+const Issuer = "isekai"
+
+// defaultTokenTTL is the lifetime of tokens minted in jwt mode
+const defaultTokenTTL = 60
+
+// Profile is a route's credentials for its upstream. Secrets are sealed
+// before they are stored.
+type Profile struct {
+	Mode     string `json:"mode"`
+	Secret   string `json:"secret,omitempty"`   // HMAC key or JWT signing key, sealed
+	Header   string `json:"header,omitempty"`   // Overrides the signature header, or the header carrying the token
+	Audience string `json:"audience,omitempty"` // aud of minted tokens
+	TTL      int    `json:"ttl,omitempty"`      // Seconds minted tokens are valid, defaults to 60
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"` // Sealed
+	Token    string `json:"token,omitempty"`    // Sealed
+}
+
+// Validate checks that the mode has the credentials it needs and that sealed
+// values open
+func (p *Profile) Validate() error {
+	switch p.Mode {
+	case ModeHMAC, ModeJWT:
+		if p.Secret == "" {
+			return fmt.Errorf("upstream_auth mode %s requires a secret", p.Mode)
+		}
+	case ModeBasic:
+		if p.Username == "" || p.Password == "" {
+			return errors.New("upstream_auth mode basic requires a username and password")
+		}
+	case ModeBearer:
+		if p.Token == "" {
+			return errors.New("upstream_auth mode bearer requires a token")
+		}
+	default:
+		return fmt.Errorf("upstream_auth mode must be hmac, jwt, basic or bearer, got %q", p.Mode)
+	}
+	if p.TTL < 0 {
+		return errors.New("upstream_auth ttl can't be negative")
+	}
+
+	for _, value := range []string{p.Secret, p.Password, p.Token} {
+		if value == "" {
+			continue
+		}
+		if _, err := seal.Open(value); err != nil {
+			return fmt.Errorf("upstream_auth: %w", err)
+		}
+	}
+	return nil
+}
+
+// Seal encrypts the secrets that aren't sealed yet
+func (p *Profile) Seal() error {
+	if p == nil {
+		return nil
+	}
+	for _, value := range []*string{&p.Secret, &p.Password, &p.Token} {
+		sealed, err := seal.Seal(*value)
+		if err != nil {
+			return err
+		}
+		*value = sealed
+	}
+	return nil
+}
+
+// Apply adds the profile's credentials to an outbound request. bodyHash is
+// the hex SHA-256 of the body, or UnsignedPayload, and claims those of the
+// caller, if any.
+func (p *Profile) Apply(r *http.Request, bodyHash string, claims *auth.Claims, now time.Time) error {
+	switch p.Mode {
+	case ModeHMAC:
+		secret, err := seal.Open(p.Secret)
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		r.Header.Set(TimestampHeader, timestamp)
+		r.Header.Set(ContentSHA256Header, bodyHash)
+		r.Header.Set(p.header(SignatureHeader), Sign(secret, r.Method, requestPath(r), bodyHash, timestamp))
+
+	case ModeJWT:
+		secret, err := seal.Open(p.Secret)
+		if err != nil {
+			return err
+		}
+		token, err := p.mint(secret, claims, now)
+		if err != nil {
+			return err
+		}
+		if p.Header == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			r.Header.Set(p.Header, token)
+		}
+
+	case ModeBasic:
+		password, err := seal.Open(p.Password)
+		if err != nil {
+			return err
+		}
+		r.SetBasicAuth(p.Username, password)
+
+	case ModeBearer:
+		token, err := seal.Open(p.Token)
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// header returns the header set by the profile, or fallback
+func (p *Profile) header(fallback string) string {
+	if p.Header != "" {
+		return p.Header
+	}
+	return fallback
+}
+
+// mint signs a token carrying the caller's claims
+func (p *Profile) mint(secret string, caller *auth.Claims, now time.Time) (string, error) {
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = defaultTokenTTL
+	}
+
+	var claims auth.Claims
+	if caller != nil {
+		claims = auth.Claims{
+			UserID:   caller.UserID,
+			Username: caller.Username,
+			Roles:    caller.Roles,
+			APIKeyID: caller.APIKeyID,
+			Tier:     caller.Tier,
+			TenantID: caller.TenantID,
+		}
+	}
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    Issuer,
+		Subject:   claims.UserID,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(ttl) * time.Second)),
+	}
+	if p.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{p.Audience}
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+}
+
+// requestPath returns the path a request is sent with, which is / when the
+// URL has none
+func requestPath(r *http.Request) string {
+	if path := r.URL.EscapedPath(); path != "" {
+		return path
+	}
+	return "/"
+}
+
+// Sign returns the hex HMAC-SHA256 of a request's method, path, body hash
+// and timestamp, one per line
+func Sign(secret, method, path, bodyHash, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + bodyHash + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a request signed in hmac mode against secret, as an upstream
+// would. body is the request body, and maxSkew bounds the age of the
+// signature.
+func Verify(r *http.Request, body []byte, secret string, maxSkew time.Duration) error {
+	timestamp := r.Header.Get(TimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid signature timestamp")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > maxSkew || age < -maxSkew {
+		return errors.New("signature timestamp outside the allowed skew")
+	}
+
+	bodyHash := r.Header.Get(ContentSHA256Header)
+	if bodyHash != UnsignedPayload {
+		sum := sha256.Sum256(body)
+		if bodyHash != hex.EncodeToString(sum[:]) {
+			return errors.New("body doesn't match its signed hash")
+		}
+	}
+
+	expected := Sign(secret, r.Method, requestPath(r), bodyHash, timestamp)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(SignatureHeader))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package upstreamtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zakirkun/isekai/internal/seal"
+)
+
+// Profile is a route's TLS settings for connecting to its upstream. The
+// client certificate comes from files, which are reloaded when they change,
+// or from inline PEM whose private key is stored encrypted.
+type Profile struct {
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	CertPEM            string `json:"cert_pem,omitempty"`
+	KeyPEM             string `json:"key_pem,omitempty"` // Sealed before it is stored
+	CAFile             string `json:"ca_file,omitempty"` // Replaces the system roots for verifying the upstream
+	CAPEM              string `json:"ca_pem,omitempty"`
+	ServerName         string `json:"server_name,omitempty"` // Overrides the name verified and sent in SNI
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// ErrNoSealKey is returned when an inline private key can't be sealed or opened
+var ErrNoSealKey = errors.New("inline private keys require PROXY_TLS_SEAL_KEY")
+
+// Validate checks that the certificate and key are configured together and
+// that inline PEM parses
+func (p *Profile) Validate() error {
+	if (p.CertFile == "") != (p.KeyFile == "") {
+		return errors.New("tls cert_file and key_file must be set together")
+	}
+	if (p.CertPEM == "") != (p.KeyPEM == "") {
+		return errors.New("tls cert_pem and key_pem must be set together")
+	}
+	if p.CertFile != "" && p.CertPEM != "" {
+		return errors.New("tls client certificate must come from files or PEM, not both")
+	}
+	if p.CAFile != "" && p.CAPEM != "" {
+		return errors.New("tls ca_file and ca_pem can't both be set")
+	}
+
+	if p.CertPEM != "" {
+		key, err := p.privateKey()
+		if err != nil {
+			return err
+		}
+		if _, err := tls.X509KeyPair([]byte(p.CertPEM), key); err != nil {
+			return fmt.Errorf("invalid tls cert_pem or key_pem: %w", err)
+		}
+	}
+	if p.CAPEM != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(p.CAPEM)) {
+		return errors.New("tls ca_pem contains no certificates")
+	}
+	return nil
+}
+
+// Seal encrypts an inline private key that isn't sealed yet
+func (p *Profile) Seal() error {
+	if p == nil || p.KeyPEM == "" || seal.Sealed(p.KeyPEM) {
+		return nil
+	}
+	if !seal.Enabled() {
+		return ErrNoSealKey
+	}
+
+	sealed, err := seal.Seal(p.KeyPEM)
+	if err != nil {
+		return err
+	}
+	p.KeyPEM = sealed
+	return nil
+}
+
+// privateKey returns the inline private key, opening it if it is sealed
+func (p *Profile) privateKey() ([]byte, error) {
+	key, err := seal.Open(p.KeyPEM)
+	switch {
+	case errors.Is(err, seal.ErrNoKey):
+		return nil, ErrNoSealKey
+	case errors.Is(err, seal.ErrWrongKey):
+		return nil, errors.New("tls key_pem was sealed with a different key")
+	case err != nil:
+		return nil, fmt.Errorf("tls key_pem: %w", err)
+	}
+	return []byte(key), nil
+}
+
+// versions are the TLS versions upstream connections can be held to
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion parses a TLS version such as "1.2"
+func ParseVersion(version string) (uint16, error) {
+	v, ok := versions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, want 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return v, nil
+}
+
+// Base builds the TLS configuration every upstream connection starts from:
+// the system roots with the certificates of caFiles added, the minimum
+// version, TLS 1.2 when empty, and, for development only, skipping
+// verification
+func Base(caFiles []string, minVersion string, insecureSkipVerify bool) (*tls.Config, error) {
+	version := uint16(tls.VersionTLS12)
+	if minVersion != "" {
+		var err error
+		if version, err = ParseVersion(minVersion); err != nil {
+			return nil, err
+		}
+	}
+	cfg := &tls.Config{MinVersion: version, InsecureSkipVerify: insecureSkipVerify}
+
+	if len(caFiles) > 0 {
+		var err error
+		if cfg.RootCAs, err = x509.SystemCertPool(); err != nil {
+			cfg.RootCAs = x509.NewCertPool()
+		}
+		for _, name := range caFiles {
+			ca, err := os.ReadFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("CA bundle %s contains no certificates", name)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// ClientConfig builds the TLS client configuration from base, reading any
+// files. A CA bundle of the profile replaces base's roots, and either of
+// them skipping verification skips it.
+func (p *Profile) ClientConfig(base *tls.Config) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	cfg.ServerName = p.ServerName
+	cfg.InsecureSkipVerify = cfg.InsecureSkipVerify || p.InsecureSkipVerify
+
+	switch {
+	case p.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case p.CertPEM != "":
+		key, err := p.privateKey()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair([]byte(p.CertPEM), key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	ca := []byte(p.CAPEM)
+	if p.CAFile != "" {
+		var err error
+		if ca, err = os.ReadFile(p.CAFile); err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+	}
+	if len(ca) > 0 {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("CA bundle contains no certificates")
+		}
+	}
+
+	return cfg, nil
+}
+
+// Key identifies the profile for sharing a transport between routes
+func (p *Profile) Key() string {
+	key, _ := json.Marshal(p)
+	return string(key)
+}
+
+// FileStamp summarises the modification times and sizes of the profile's
+// files, so a change shows which configuration needs reloading
+func (p *Profile) FileStamp() string {
+	var stamp strings.Builder
+	for _, name := range []string{p.CertFile, p.KeyFile, p.CAFile} {
+		if name == "" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&stamp, "%s:%d:%d;", name, info.ModTime().UnixNano(), info.Size())
+		} else {
+			fmt.Fprintf(&stamp, "%s:missing;", name)
+		}
+	}
+	return stamp.String()
+}
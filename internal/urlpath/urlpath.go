@@ -0,0 +1,106 @@
+package urlpath
+
+import (
+	"net/url"
+	"strings"
+)
+
+// upperHex spells percent-escapes
+const upperHex = "0123456789ABCDEF"
+
+// Clean normalizes an escaped URL path: runs of slashes collapse into one, a
+// trailing slash is dropped except on the root, and percent-escapes of
+// unreserved characters are decoded. Other escapes are kept, in upper case,
+// so an escaped slash still isn't a separator.
+func Clean(escaped string) string {
+	var b strings.Builder
+	b.Grow(len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		c := escaped[i]
+		switch {
+		case c == '/' && b.Len() > 0 && strings.HasSuffix(b.String(), "/"):
+			continue
+		case c == '%' && i+2 < len(escaped) && isHex(escaped[i+1]) && isHex(escaped[i+2]):
+			decoded := unhex(escaped[i+1])<<4 | unhex(escaped[i+2])
+			if unreserved(decoded) {
+				b.WriteByte(decoded)
+			} else {
+				b.WriteByte('%')
+				b.WriteByte(upperHex[decoded>>4])
+				b.WriteByte(upperHex[decoded&15])
+			}
+			i += 2
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	cleaned := b.String()
+	if len(cleaned) > 1 && strings.HasSuffix(cleaned, "/") {
+		cleaned = cleaned[:len(cleaned)-1]
+	}
+	return cleaned
+}
+
+// Normalize returns u with its path cleaned, as a copy when that changes it
+func Normalize(u *url.URL) *url.URL {
+	escaped := u.EscapedPath()
+	cleaned := Clean(escaped)
+	if cleaned == escaped {
+		return u
+	}
+	path, err := url.PathUnescape(cleaned)
+	if err != nil {
+		return u
+	}
+
+	normalized := *u
+	normalized.Path, normalized.RawPath = path, ""
+	if normalized.EscapedPath() != cleaned {
+		normalized.RawPath = cleaned
+	}
+	return &normalized
+}
+
+// CleanPath cleans a path that isn't escaped, such as a route's, the way
+// Normalize cleans the same path in a request
+func CleanPath(path string) string {
+	return Normalize(&url.URL{Path: path}).Path
+}
+
+// Parents returns the prefixes a cleaned path is under, longest first and
+// ending with the root: /a/b/c gives /a/b, /a and /
+func Parents(path string) []string {
+	var parents []string
+	for path != "/" && path != "" {
+		i := strings.LastIndexByte(path, '/')
+		if i <= 0 {
+			path = "/"
+		} else {
+			path = path[:i]
+		}
+		parents = append(parents, path)
+	}
+	return parents
+}
+
+// unreserved reports whether c is an unreserved character of RFC 3986, which
+// means the same escaped or not
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
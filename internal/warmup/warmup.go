@@ -0,0 +1,111 @@
+package warmup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/pkg/logger"
+)
+
+// ErrWarmingUp is reported by readiness checks until a blocking warm-up ends
+var ErrWarmingUp = errors.New("warming up")
+
+// Step is one part of the warm-up
+type Step struct {
+	Name string
+	// Run warms up part of the gateway, returning how many of its items,
+	// such as backends, failed to. An error fails the whole step.
+	Run func(ctx context.Context) (failures int, err error)
+}
+
+// Result is the outcome of a step
+type Result struct {
+	Step     string
+	Duration time.Duration
+	Failures int
+	Err      error
+}
+
+// Warmup runs the startup warm-up once. A blocking warm-up holds readiness
+// until it ends; otherwise the gateway is ready while it runs.
+type Warmup struct {
+	blocking bool
+	once     sync.Once
+	done     chan struct{}
+}
+
+// New creates a warm-up, holding readiness until it ends when blocking
+func New(blocking bool) *Warmup {
+	return &Warmup{
+		blocking: blocking,
+		done:     make(chan struct{}),
+	}
+}
+
+// Check reports ErrWarmingUp while a blocking warm-up hasn't ended
+func (w *Warmup) Check(ctx context.Context) error {
+	if !w.blocking {
+		return nil
+	}
+	select {
+	case <-w.done:
+		return nil
+	default:
+		return ErrWarmingUp
+	}
+}
+
+// Done is closed once the warm-up ends
+func (w *Warmup) Done() <-chan struct{} {
+	return w.done
+}
+
+// Run runs steps in order, timing each. A failing step is logged and the
+// warm-up goes on: warming up only saves the first requests some latency, so
+// it never stops the gateway from starting. The timings and failures are
+// logged together once it ends and exported as metrics.
+func (w *Warmup) Run(ctx context.Context, log *logger.Logger, m *metrics.Metrics, steps []Step) []Result {
+	results := make([]Result, 0, len(steps))
+	w.once.Do(func() {
+		defer close(w.done)
+
+		start := time.Now()
+		for _, step := range steps {
+			stepStart := time.Now()
+			failures, err := step.Run(ctx)
+			if err != nil {
+				failures = max(failures, 1)
+				log.Warnf("Warm-up step %s failed: %v", step.Name, err)
+			}
+			results = append(results, Result{Step: step.Name, Duration: time.Since(stepStart), Failures: failures, Err: err})
+		}
+		total := time.Since(start)
+
+		timings := make([]string, 0, len(results))
+		for _, result := range results {
+			timings = append(timings, result.Step+"="+result.Duration.Round(time.Millisecond).String())
+			if m != nil {
+				m.WarmupDuration.WithLabelValues(result.Step).Set(result.Duration.Seconds())
+				m.WarmupFailures.WithLabelValues(result.Step).Set(float64(result.Failures))
+			}
+		}
+		if m != nil {
+			m.WarmupDuration.WithLabelValues("total").Set(total.Seconds())
+		}
+		log.Infof("Warm-up complete in %s with %d failures (%s)", total.Round(time.Millisecond), failureCount(results), strings.Join(timings, ", "))
+	})
+	return results
+}
+
+// failureCount sums the failures of results
+func failureCount(results []Result) int {
+	count := 0
+	for _, result := range results {
+		count += result.Failures
+	}
+	return count
+}
@@ -2,93 +2,265 @@ package websocket
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/zakirkun/isekai/internal/auth"
+	"github.com/zakirkun/isekai/internal/events"
+	"github.com/zakirkun/isekai/internal/metrics"
+	"github.com/zakirkun/isekai/pkg/config"
 	"github.com/zakirkun/isekai/pkg/logger"
+	"github.com/zakirkun/isekai/pkg/response"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins in development
-	},
-}
+// Overflow policies applied when a client's send buffer is full
+const (
+	// PolicyDisconnect drops the message and disconnects the slow client
+	PolicyDisconnect = "disconnect"
+	// PolicyDropOldest discards the oldest buffered message to make room
+	PolicyDropOldest = "drop_oldest"
+)
+
+// Reasons recorded when a connection or frame is rejected
+const (
+	RejectOrigin    = "origin"
+	RejectReadLimit = "read_limit"
+	RejectIPLimit   = "ip_limit"
+	RejectDraining  = "draining"
+	RejectTopics    = "topic_limit"
+	RejectReserved  = "reserved_type"
+)
+
+// AnonymousUser identifies connections made while authentication is disabled
+const AnonymousUser = "anonymous"
 
 // Message represents a WebSocket message
 type Message struct {
 	Type    string      `json:"type"`
+	Topic   string      `json:"topic,omitempty"` // Set on messages published to a topic
 	Payload interface{} `json:"payload"`
 }
 
+// Control message types sent by clients to select the events they receive
+const (
+	MessageSubscribe   = "subscribe"
+	MessageUnsubscribe = "unsubscribe"
+	MessageSubscribed  = "subscribed"
+)
+
+// Message types sent by the hub for topics
+const (
+	// MessageTopic carries a payload published to one of the client's topics
+	MessageTopic = "topic"
+	// MessageError reports a control message the hub refused
+	MessageError = "error"
+	// MessageShutdown tells clients the gateway is shutting down, ahead of
+	// a going away close frame
+	MessageShutdown = "shutdown"
+)
+
+// ShutdownReason is the reason sent in the close frame on shutdown
+const ShutdownReason = "Server shutting down"
+
+// ShutdownNotice is the payload of shutdown messages
+type ShutdownNotice struct {
+	RetryAfter int `json:"retry_after,omitempty"` // Seconds to wait before reconnecting
+}
+
+// MaxTopicLength is the longest topic name clients may subscribe to
+const MaxTopicLength = 200
+
+// Subscription is the payload of subscribe and unsubscribe messages. Events
+// select gateway events; topics join or leave topics published to with
+// Hub.Publish.
+type Subscription struct {
+	Events []string `json:"events"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+// ControlError is the payload of error messages
+type ControlError struct {
+	Error  string   `json:"error"`
+	Topics []string `json:"topics,omitempty"` // Topics the request was refused for
+}
+
+// inboundMessage is a client message whose payload is decoded by type
+type inboundMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
 // Client represents a WebSocket client
 type Client struct {
-	ID   string
-	Conn *websocket.Conn
-	Send chan Message
-	Hub  *Hub
-	mu   sync.Mutex
+	ID     string
+	UserID string
+	IP     string
+	Conn   *websocket.Conn
+	Send   chan Message
+	Hub    *Hub
+	mu     sync.Mutex
+
+	// subscriptions holds event patterns; an empty set receives everything
+	subscriptions map[string]bool
+
+	// topics holds the topics the client joined, guarded by the hub's lock
+	topics map[string]bool
+
+	// goingAway is closed to make the write pump close the connection
+	goingAway  chan struct{}
+	goAwayOnce sync.Once
 }
 
 // Hub maintains active WebSocket connections
 type Hub struct {
-	clients    map[string]*Client
-	broadcast  chan Message
-	register   chan *Client
-	unregister chan *Client
-	mu         sync.RWMutex
-	log        *logger.Logger
+	clients       map[string]*Client
+	broadcast     chan Message
+	register      chan *Client
+	unregister    chan *Client
+	mu            sync.RWMutex
+	ipConnections map[string]int
+	topics        map[string]map[string]*Client // Subscribers by topic and client ID
+	cfg           config.WebSocketConfig
+	upgrader      websocket.Upgrader
+	log           *logger.Logger
+	metrics       *metrics.Metrics
+	draining      atomic.Bool
+	done          chan struct{} // Closed when Run returns
 }
 
 // NewHub creates a new WebSocket hub
-func NewHub(log *logger.Logger) *Hub {
-	return &Hub{
-		clients:    make(map[string]*Client),
-		broadcast:  make(chan Message, 256),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		log:        log,
+func NewHub(cfg *config.WebSocketConfig, log *logger.Logger, metrics *metrics.Metrics) *Hub {
+	h := &Hub{
+		clients:       make(map[string]*Client),
+		broadcast:     make(chan Message, 256),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		ipConnections: make(map[string]int),
+		topics:        make(map[string]map[string]*Client),
+		done:          make(chan struct{}),
+		cfg:           *cfg,
+		log:           log,
+		metrics:       metrics,
+	}
+
+	// Fall back to defaults for unset values
+	if h.cfg.SendBufferSize <= 0 {
+		h.cfg.SendBufferSize = 256
+	}
+	if h.cfg.OverflowPolicy != PolicyDropOldest {
+		h.cfg.OverflowPolicy = PolicyDisconnect
+	}
+	if h.cfg.PongWait <= 0 {
+		h.cfg.PongWait = 60 * time.Second
+	}
+	if h.cfg.PingInterval <= 0 || h.cfg.PingInterval >= h.cfg.PongWait {
+		h.cfg.PingInterval = h.cfg.PongWait * 9 / 10
+	}
+	if h.cfg.WriteWait <= 0 {
+		h.cfg.WriteWait = 10 * time.Second
+	}
+	if h.cfg.MaxTopicsPerClient <= 0 {
+		h.cfg.MaxTopicsPerClient = 20
 	}
+	if h.cfg.CloseTimeout <= 0 {
+		h.cfg.CloseTimeout = 5 * time.Second
+	}
+
+	h.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     h.checkOrigin,
+		// Echo the token-carrying subprotocol so browsers accept the upgrade
+		Subprotocols: []string{auth.WebSocketProtocol},
+	}
+
+	return h
+}
+
+// checkOrigin allows requests without an Origin header (non-browser clients)
+// and browser origins in the configured allow list
+func (h *Hub) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || config.OriginAllowed(h.cfg.AllowedOrigins, origin) {
+		return true
+	}
+
+	h.log.Warnf("WebSocket connection from disallowed origin rejected: %s", origin)
+	h.reject(RejectOrigin)
+	return false
+}
+
+// reject counts a rejected connection or frame
+func (h *Hub) reject(reason string) {
+	if h.metrics != nil {
+		h.metrics.WebSocketRejected.WithLabelValues(reason).Inc()
+	}
+}
+
+// acquireIP reserves a connection slot for an IP
+func (h *Hub) acquireIP(ip string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.cfg.MaxConnectionsPerIP > 0 && h.ipConnections[ip] >= h.cfg.MaxConnectionsPerIP {
+		return false
+	}
+	h.ipConnections[ip]++
+	return true
+}
+
+// releaseIP frees a connection slot. Callers must hold the write lock.
+func (h *Hub) releaseIP(ip string) {
+	if h.ipConnections[ip] <= 1 {
+		delete(h.ipConnections, ip)
+		return
+	}
+	h.ipConnections[ip]--
 }
 
 // Run starts the hub
 func (h *Hub) Run(ctx context.Context) {
+	defer close(h.done)
 	for {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client.ID] = client
 			h.mu.Unlock()
-			h.log.Infof("WebSocket client registered: %s", client.ID)
+			h.log.Infof("WebSocket client registered: %s (user %s)", client.ID, client.UserID)
 
 		case client := <-h.unregister:
 			h.mu.Lock()
 			if _, ok := h.clients[client.ID]; ok {
 				delete(h.clients, client.ID)
+				h.releaseIP(client.IP)
 				close(client.Send)
 			}
+			h.leaveTopics(client)
 			h.mu.Unlock()
 			h.log.Infof("WebSocket client unregistered: %s", client.ID)
 
 		case message := <-h.broadcast:
+			// Collect slow clients during iteration and remove them afterwards
+			var slow []*Client
 			h.mu.RLock()
 			for _, client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					h.mu.RUnlock()
-					h.mu.Lock()
-					delete(h.clients, client.ID)
-					close(client.Send)
-					h.mu.Unlock()
-					h.mu.RLock()
+				if client.wants(message.Type) && !h.deliver(client, message) {
+					slow = append(slow, client)
 				}
 			}
 			h.mu.RUnlock()
 
+			h.removeClients(slow)
+
 		case <-ctx.Done():
 			h.log.Info("WebSocket hub shutting down")
 			return
@@ -101,22 +273,295 @@ func (h *Hub) Broadcast(message Message) {
 	h.broadcast <- message
 }
 
+// PublishEvent forwards a gateway event to subscribed clients. It is meant to be
+// registered on an events.Bus and drops the event rather than block the publisher.
+func (h *Hub) PublishEvent(event events.Event) {
+	select {
+	case h.broadcast <- Message{Type: string(event.Type), Payload: event}:
+	default:
+		h.log.Warnf("WebSocket broadcast queue full, dropping event: %s", event.Type)
+	}
+}
+
+// relay forwards a client's message to the connected clients, dropping it
+// rather than block the client's read pump behind the hub
+func (h *Hub) relay(message Message) {
+	select {
+	case h.broadcast <- message:
+	default:
+		h.log.Warnf("WebSocket broadcast queue full, dropping client message: %s", message.Type)
+	}
+}
+
+// reserved reports whether a message type belongs to the gateway: a gateway
+// event or a message the hub sends
+func reserved(messageType string) bool {
+	switch messageType {
+	case MessageSubscribed, MessageTopic, MessageError, MessageShutdown:
+		return true
+	}
+	return events.IsGateway(messageType)
+}
+
 // SendToClient sends a message to a specific client
 func (h *Hub) SendToClient(clientID string, message Message) bool {
 	h.mu.RLock()
 	client, exists := h.clients[clientID]
-	h.mu.RUnlock()
-
 	if !exists {
+		h.mu.RUnlock()
 		return false
 	}
+	delivered := h.deliver(client, message)
+	h.mu.RUnlock()
+
+	if !delivered {
+		h.removeClients([]*Client{client})
+	}
+	return delivered
+}
+
+// SendToUser sends a message to every connection of a user and returns the
+// number of connections it was delivered to
+func (h *Hub) SendToUser(userID string, message Message) int {
+	var slow []*Client
+	delivered := 0
+
+	h.mu.RLock()
+	for _, client := range h.clients {
+		if client.UserID != userID {
+			continue
+		}
+
+		if h.deliver(client, message) {
+			delivered++
+		} else {
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	h.removeClients(slow)
+	return delivered
+}
 
+// deliver queues a message on a client's send buffer, applying the overflow
+// policy when the buffer is full. It returns false if the client should be
+// disconnected. Callers must hold at least the read lock so Send is not closed.
+func (h *Hub) deliver(client *Client, message Message) bool {
 	select {
 	case client.Send <- message:
 		return true
 	default:
+	}
+
+	if h.metrics != nil {
+		h.metrics.WebSocketDropped.WithLabelValues(h.cfg.OverflowPolicy).Inc()
+	}
+
+	if h.cfg.OverflowPolicy != PolicyDropOldest {
 		return false
 	}
+
+	// Make room by discarding the oldest message; the write pump may drain the
+	// buffer concurrently, so both steps are non-blocking
+	select {
+	case <-client.Send:
+	default:
+	}
+	select {
+	case client.Send <- message:
+	default:
+	}
+	return true
+}
+
+// removeClients disconnects clients that are still registered
+func (h *Hub) removeClients(clients []*Client) {
+	if len(clients) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, client := range clients {
+		if _, ok := h.clients[client.ID]; ok {
+			delete(h.clients, client.ID)
+			h.releaseIP(client.IP)
+			close(client.Send)
+			h.leaveTopics(client)
+			h.log.Warnf("WebSocket client disconnected for falling behind: %s", client.ID)
+		}
+	}
+}
+
+// Publish sends a payload to every client subscribed to topic and returns
+// the number of clients it was delivered to
+func (h *Hub) Publish(topic string, payload interface{}) int {
+	message := Message{Type: MessageTopic, Topic: topic, Payload: payload}
+	var slow []*Client
+	delivered := 0
+
+	h.mu.RLock()
+	for id, client := range h.topics[topic] {
+		// Skip clients that subscribed before registering or after removal
+		if h.clients[id] != client {
+			continue
+		}
+		if h.deliver(client, message) {
+			delivered++
+		} else {
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	h.removeClients(slow)
+	return delivered
+}
+
+// SubscriberCount returns the number of clients subscribed to topic
+func (h *Hub) SubscriberCount(topic string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.topics[topic])
+}
+
+// GetTopicCounts returns the number of subscribers per topic
+func (h *Hub) GetTopicCounts() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	counts := make(map[string]int, len(h.topics))
+	for topic, subscribers := range h.topics {
+		counts[topic] = len(subscribers)
+	}
+	return counts
+}
+
+// joinTopics subscribes a client to topics up to the per-client limit and
+// returns the topics refused for being invalid or over the limit
+func (h *Hub) joinTopics(client *Client, topics []string) (refused []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, topic := range topics {
+		if client.topics[topic] {
+			continue
+		}
+		if topic == "" || len(topic) > MaxTopicLength || len(client.topics) >= h.cfg.MaxTopicsPerClient {
+			refused = append(refused, topic)
+			continue
+		}
+
+		if client.topics == nil {
+			client.topics = make(map[string]bool)
+		}
+		client.topics[topic] = true
+		subscribers, exists := h.topics[topic]
+		if !exists {
+			subscribers = make(map[string]*Client)
+			h.topics[topic] = subscribers
+		}
+		subscribers[client.ID] = client
+	}
+	return refused
+}
+
+// leaveTopic unsubscribes a client from a topic, dropping the topic once it
+// has no subscribers. Callers must hold the write lock.
+func (h *Hub) leaveTopic(client *Client, topic string) {
+	delete(client.topics, topic)
+	if subscribers, ok := h.topics[topic]; ok {
+		delete(subscribers, client.ID)
+		if len(subscribers) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+}
+
+// leaveTopics unsubscribes a client from all its topics. Callers must hold
+// the write lock.
+func (h *Hub) leaveTopics(client *Client) {
+	for topic := range client.topics {
+		h.leaveTopic(client, topic)
+	}
+}
+
+// clientTopics returns the topics a client joined
+func (h *Hub) clientTopics(client *Client) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	topics := make([]string, 0, len(client.topics))
+	for topic := range client.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// GetUserConnectionCounts returns the number of connected clients per user
+func (h *Hub) GetUserConnectionCounts() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, client := range h.clients {
+		counts[client.UserID]++
+	}
+	return counts
+}
+
+// StopAccepting rejects new connections while the gateway drains. Existing
+// connections stay open until shutdown.
+func (h *Hub) StopAccepting() {
+	h.draining.Store(true)
+}
+
+// Shutdown stops accepting connections and closes every connection with a
+// going away frame, after sending clients a shutdown message with the
+// reconnect delay. It waits for clients to acknowledge the close until ctx is
+// done or the close timeout passes, then drops the connections left. The hub
+// must still be running.
+func (h *Hub) Shutdown(ctx context.Context) {
+	h.StopAccepting()
+
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.CloseTimeout)
+	defer cancel()
+
+	notice := Message{Type: MessageShutdown, Payload: ShutdownNotice{RetryAfter: int(h.cfg.ReconnectDelay / time.Second)}}
+	h.log.Infof("Closing %d WebSocket connections", h.GetClientCount())
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// Clients that registered since the last pass are closed too
+		h.mu.RLock()
+		remaining := len(h.clients)
+		for _, client := range h.clients {
+			client.goAwayOnce.Do(func() {
+				h.deliver(client, notice)
+				close(client.goingAway)
+			})
+		}
+		h.mu.RUnlock()
+
+		if remaining == 0 {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			h.log.Warnf("%d WebSocket clients didn't acknowledge the close, dropping them", remaining)
+			h.mu.RLock()
+			for _, client := range h.clients {
+				client.Conn.Close()
+			}
+			h.mu.RUnlock()
+			return
+		}
+	}
 }
 
 // GetClientCount returns the number of connected clients
@@ -129,34 +574,120 @@ func (h *Hub) GetClientCount() int {
 // readPump pumps messages from the WebSocket connection to the hub
 func (c *Client) readPump() {
 	defer func() {
-		c.Hub.unregister <- c
+		select {
+		case c.Hub.unregister <- c:
+		case <-c.Hub.done:
+		}
 		c.Conn.Close()
 	}()
 
-	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	// Frames over the limit close the connection with CloseMessageTooBig
+	if c.Hub.cfg.ReadLimit > 0 {
+		c.Conn.SetReadLimit(c.Hub.cfg.ReadLimit)
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(c.Hub.cfg.PongWait))
 	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.Conn.SetReadDeadline(time.Now().Add(c.Hub.cfg.PongWait))
 		return nil
 	})
 
 	for {
-		var msg Message
+		var msg inboundMessage
 		err := c.Conn.ReadJSON(&msg)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				c.Hub.log.Warnf("WebSocket client %s exceeded the read limit", c.ID)
+				c.Hub.reject(RejectReadLimit)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				c.Hub.log.Errorf("WebSocket error: %v", err)
 			}
 			break
 		}
 
-		// Handle received message (echo for now)
-		c.Hub.Broadcast(msg)
+		switch msg.Type {
+		case MessageSubscribe, MessageUnsubscribe:
+			var sub Subscription
+			if err := json.Unmarshal(msg.Payload, &sub); err != nil {
+				c.Hub.log.Warnf("Invalid %s message from %s: %v", msg.Type, c.ID, err)
+				continue
+			}
+			c.updateSubscriptions(msg.Type == MessageSubscribe, sub)
+
+		default:
+			// Gateway events and hub messages can't be sent by clients
+			if reserved(msg.Type) {
+				c.Hub.log.Warnf("WebSocket client %s sent reserved message type %q", c.ID, msg.Type)
+				c.Hub.reject(RejectReserved)
+				c.Hub.SendToClient(c.ID, Message{Type: MessageError, Payload: ControlError{
+					Error: fmt.Sprintf("Message type %q is reserved for the gateway", msg.Type),
+				}})
+				continue
+			}
+			c.Hub.relay(Message{Type: msg.Type, Payload: msg.Payload})
+		}
+	}
+}
+
+// updateSubscriptions adds or removes event patterns and topics and confirms
+// the resulting sets, reporting topics refused over the per-client limit
+func (c *Client) updateSubscriptions(subscribe bool, sub Subscription) {
+	if subscribe {
+		if refused := c.Hub.joinTopics(c, sub.Topics); len(refused) > 0 {
+			c.Hub.log.Warnf("WebSocket client %s refused %d topics", c.ID, len(refused))
+			c.Hub.reject(RejectTopics)
+			c.Hub.SendToClient(c.ID, Message{Type: MessageError, Payload: ControlError{
+				Error:  fmt.Sprintf("Topics must be 1 to %d characters, at most %d per connection", MaxTopicLength, c.Hub.cfg.MaxTopicsPerClient),
+				Topics: refused,
+			}})
+		}
+	} else if len(sub.Topics) > 0 {
+		c.Hub.mu.Lock()
+		for _, topic := range sub.Topics {
+			c.Hub.leaveTopic(c, topic)
+		}
+		c.Hub.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]bool)
+	}
+	for _, pattern := range sub.Events {
+		if subscribe {
+			c.subscriptions[pattern] = true
+		} else {
+			delete(c.subscriptions, pattern)
+		}
+	}
+
+	current := make([]string, 0, len(c.subscriptions))
+	for pattern := range c.subscriptions {
+		current = append(current, pattern)
+	}
+	c.mu.Unlock()
+
+	c.Hub.SendToClient(c.ID, Message{Type: MessageSubscribed, Payload: Subscription{Events: current, Topics: c.Hub.clientTopics(c)}})
+}
+
+// wants reports whether the client is subscribed to a message type
+func (c *Client) wants(messageType string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.subscriptions) == 0 {
+		return true
 	}
+	for pattern := range c.subscriptions {
+		if events.Match(pattern, events.Type(messageType)) {
+			return true
+		}
+	}
+	return false
 }
 
 // writePump pumps messages from the hub to the WebSocket connection
 func (c *Client) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
+	ticker := time.NewTicker(c.Hub.cfg.PingInterval)
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
@@ -165,7 +696,7 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.Conn.SetWriteDeadline(time.Now().Add(c.Hub.cfg.WriteWait))
 			if !ok {
 				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
@@ -176,8 +707,12 @@ func (c *Client) writePump() {
 				return
 			}
 
+		case <-c.goingAway:
+			c.closeGoingAway()
+			return
+
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.Conn.SetWriteDeadline(time.Now().Add(c.Hub.cfg.WriteWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -185,22 +720,85 @@ func (c *Client) writePump() {
 	}
 }
 
-// ServeWS handles WebSocket requests
-func ServeWS(hub *Hub, w http.ResponseWriter, r *http.Request, clientID string) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// closeGoingAway writes the messages already queued, then a going away close
+// frame, and waits for the client's close to be read, which unregisters the
+// client and closes Send
+func (c *Client) closeGoingAway() {
+	for flushed := false; !flushed; {
+		select {
+		case message, ok := <-c.Send:
+			if !ok {
+				return
+			}
+			c.Conn.SetWriteDeadline(time.Now().Add(c.Hub.cfg.WriteWait))
+			if err := c.Conn.WriteJSON(message); err != nil {
+				return
+			}
+		default:
+			flushed = true
+		}
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Hub.cfg.WriteWait))
+	if err := c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ShutdownReason)); err != nil {
+		return
+	}
+	for range c.Send {
+	}
+}
+
+// ServeWS handles WebSocket requests for an authenticated user. Each connection
+// gets a unique client ID so a user may hold several connections at once.
+func ServeWS(hub *Hub, w http.ResponseWriter, r *http.Request, userID string) {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	if hub.draining.Load() {
+		hub.reject(RejectDraining)
+		response.ErrorCode(w, http.StatusServiceUnavailable, response.CodeDraining, "Gateway is draining")
+		return
+	}
+
+	if !hub.acquireIP(ip) {
+		hub.log.Warnf("WebSocket connection limit reached for %s", ip)
+		hub.reject(RejectIPLimit)
+		response.ErrorCode(w, http.StatusTooManyRequests, response.CodeRateLimited, "Too many WebSocket connections")
+		return
+	}
+
+	conn, err := hub.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		hub.mu.Lock()
+		hub.releaseIP(ip)
+		hub.mu.Unlock()
 		hub.log.Errorf("WebSocket upgrade error: %v", err)
 		return
 	}
 
 	client := &Client{
-		ID:   clientID,
-		Conn: conn,
-		Send: make(chan Message, 256),
-		Hub:  hub,
+		ID:     userID + "-" + uuid.NewString(),
+		UserID: userID,
+		IP:     ip,
+		Conn:   conn,
+		Send:   make(chan Message, hub.cfg.SendBufferSize),
+		Hub:    hub,
+
+		goingAway: make(chan struct{}),
 	}
 
-	hub.register <- client
+	// A hub that stopped running during shutdown can't take the client
+	select {
+	case hub.register <- client:
+	case <-hub.done:
+		hub.mu.Lock()
+		hub.releaseIP(ip)
+		hub.mu.Unlock()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ShutdownReason), time.Now().Add(hub.cfg.WriteWait))
+		conn.Close()
+		return
+	}
 
 	// Start read and write pumps
 	go client.writePump()
@@ -1,118 +1,720 @@
 package config
 
 import (
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/zakirkun/isekai/pkg/redact"
 )
 
 // Config holds all application configuration
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Cache    CacheConfig
-	Gateway  GatewayConfig
-	Auth     AuthConfig
-	Tracing  TracingConfig
+	Server          ServerConfig          `json:"server"`
+	Database        DatabaseConfig        `json:"database"`
+	Cache           CacheConfig           `json:"cache"`
+	Gateway         GatewayConfig         `json:"gateway"`
+	Auth            AuthConfig            `json:"auth"`
+	Tracing         TracingConfig         `json:"tracing"`
+	WebSocket       WebSocketConfig       `json:"websocket"`
+	Proxy           ProxyConfig           `json:"proxy"`
+	LoadBalancer    LoadBalancerConfig    `json:"load_balancer"`
+	AccessLog       AccessLogConfig       `json:"access_log"`
+	AdminUI         AdminUIConfig         `json:"admin_ui"`
+	Chaos           ChaosConfig           `json:"chaos"`
+	GeoIP           GeoIPConfig           `json:"geoip"`
+	Warmup          WarmupConfig          `json:"warmup"`
+	SecurityHeaders SecurityHeadersConfig `json:"security_headers"`
+	Compression     CompressionConfig     `json:"compression"`
+	Environment     string                `json:"environment"` // Deployment environment; production refuses fault injection
+
+	errs []error // Secret files that could not be read
 }
 
+// DefaultJWTSecret is the placeholder JWT secret used when none is configured
+const DefaultJWTSecret = "your-secret-key-change-in-production"
+
 // ServerConfig holds server-related configuration
 type ServerConfig struct {
-	Port            string
-	ReadTimeout     time.Duration
-	WriteTimeout    time.Duration
-	ShutdownTimeout time.Duration
-	MaxHeaderBytes  int
+	Port            string        `json:"port"`
+	ReadTimeout     time.Duration `json:"read_timeout"`
+	WriteTimeout    time.Duration `json:"write_timeout"`
+	ShutdownTimeout time.Duration `json:"shutdown_timeout"`
+	DrainPeriod     time.Duration `json:"drain_period"`
+	DrainOnSigterm  time.Duration `json:"drain_on_sigterm"`
+	MaxHeaderBytes  int           `json:"max_header_bytes"`
+	AllowedOrigins  []string      `json:"allowed_origins"`
+	TLSCertFile     string        `json:"tls_cert_file"`
+	TLSKeyFile      string        `json:"tls_key_file"`
+	Listen          []string      `json:"listen"` // Addresses served, tcp://, unix:// or systemd://; empty for SERVER_PORT
 }
 
 // DatabaseConfig holds database-related configuration
 type DatabaseConfig struct {
-	Host            string
-	Port            string
-	User            string
-	Password        string
-	DBName          string
-	SSLMode         string
-	MaxOpenConns    int
-	MaxIdleConns    int
-	ConnMaxLifetime time.Duration
+	Host               string        `json:"host"`
+	Port               string        `json:"port"`
+	User               string        `json:"user"`
+	Password           string        `json:"password"`
+	DBName             string        `json:"db_name"`
+	SSLMode            string        `json:"ssl_mode"`
+	MaxOpenConns       int           `json:"max_open_conns"`
+	MaxIdleConns       int           `json:"max_idle_conns"`
+	ConnMaxLifetime    time.Duration `json:"conn_max_lifetime"`
+	ConnectRetries     int           `json:"connect_retries"`
+	ConnectBackoff     time.Duration `json:"connect_backoff"`
+	Required           bool          `json:"required"`
+	SlowQueryThreshold time.Duration `json:"slow_query_threshold"`
+	QueryTimeout       time.Duration `json:"query_timeout"`   // Longest a repository call or transaction may take, at least 100ms
+	RollupInterval     time.Duration `json:"rollup_interval"` // How often request logs are aggregated into hourly stats, 0 to disable
 }
 
 // CacheConfig holds cache-related configuration
 type CacheConfig struct {
-	Enabled         bool
-	TTL             time.Duration
-	CleanupInterval time.Duration
-	MaxSize         int64
+	Enabled         bool          `json:"enabled"`
+	TTL             time.Duration `json:"ttl"`
+	CleanupInterval time.Duration `json:"cleanup_interval"`
+	MaxSize         int64         `json:"max_size"`
+	MaxStale        time.Duration `json:"max_stale"` // How long expired items may be served while they are refreshed
 }
 
 // GatewayConfig holds gateway-specific configuration
 type GatewayConfig struct {
-	MaxConcurrentRequests int
-	RequestTimeout        time.Duration
-	RateLimitEnabled      bool
-	RateLimitPerSecond    int
+	MaxConcurrentRequests  int            `json:"max_concurrent_requests"` // 0 for no limit
+	ConcurrencyQueueSize   int            `json:"concurrency_queue_size"`  // Requests that may wait for a slot
+	ConcurrencyQueueWait   time.Duration  `json:"concurrency_queue_wait"`  // How long they may wait
+	UpstreamQueueSize      int            `json:"upstream_queue_size"`     // Requests that may wait for a route's upstream rate limit
+	UpstreamQueueWait      time.Duration  `json:"upstream_queue_wait"`     // How long they may wait
+	RequestTimeout         time.Duration  `json:"request_timeout"`
+	RateLimitEnabled       bool           `json:"rate_limit_enabled"`
+	RateLimitPerSecond     int            `json:"rate_limit_per_second"`
+	RateLimitTiers         map[string]int `json:"rate_limit_tiers"` // Requests per second by tier name
+	RateLimitTierRefresh   time.Duration  `json:"rate_limit_tier_refresh"`
+	RateLimitHeaders       []string       `json:"rate_limit_headers"` // Header families sent by rate limiters: draft, legacy
+	MetricsMaxPaths        int            `json:"metrics_max_paths"`
+	MetricsCollectInterval time.Duration  `json:"metrics_collect_interval"`
+	HealthCacheTTL         time.Duration  `json:"health_cache_ttl"`
+	IPAllow                []string       `json:"ip_allow"`
+	IPDeny                 []string       `json:"ip_deny"`
+	ErrorPagesDir          string         `json:"error_pages_dir"`
+	LogHeaders             []string       `json:"log_headers"`        // Request headers recorded in logs and spans, "*" for all
+	SensitiveHeaders       []string       `json:"sensitive_headers"`  // Headers masked wherever headers are recorded
+	SnapshotRetention      int            `json:"snapshot_retention"` // Automatic configuration snapshots kept, 0 for all
+	ExemptPaths            []string       `json:"exempt_paths"`       // Path prefixes global middlewares let through
+	RateLimitExemptPaths   []string       `json:"rate_limit_exempt_paths"`
+	AuthExemptPaths        []string       `json:"auth_exempt_paths"`
+	MetricsAuthToken       string         `json:"metrics_auth_token"`  // Bearer token or basic auth password for /metrics
+	InflightMax            int            `json:"inflight_max"`        // Requests tracked for /api/debug/inflight, 0 to disable
+	LogExportMaxRows       int            `json:"log_export_max_rows"` // Most request logs one export may return
+	LogExportRate          int            `json:"log_export_rate"`     // Bytes per second an export is sent at, 0 for no limit
+	PanicWebhookURL        string         `json:"panic_webhook_url"`   // Where panic reports are posted, empty to only log them
+	PanicWebhookRate       int            `json:"panic_webhook_rate"`  // Most panic reports posted a minute
 }
 
 // AuthConfig holds authentication configuration
 type AuthConfig struct {
-	JWTSecret     string
-	TokenDuration time.Duration
-	Enabled       bool
+	JWTSecret           string        `json:"jwt_secret"`
+	TokenDuration       time.Duration `json:"token_duration"`
+	Enabled             bool          `json:"enabled"`
+	Algorithm           string        `json:"algorithm"`
+	PublicKeyFile       string        `json:"public_key_file"`
+	PrivateKeyFile      string        `json:"private_key_file"`
+	JWKSURL             string        `json:"jwksurl"`
+	JWKSRefreshInterval time.Duration `json:"jwks_refresh_interval"`
+	PasswordMinLength   int           `json:"password_min_length"`
+
+	// OpenID Connect sign-in, enabled by setting the issuer
+	OIDCIssuerURL     string              `json:"oidc_issuer_url"`
+	OIDCClientID      string              `json:"oidc_client_id"`
+	OIDCClientSecret  string              `json:"oidc_client_secret"`
+	OIDCRedirectURL   string              `json:"oidc_redirect_url"`
+	OIDCScopes        []string            `json:"oidc_scopes"`
+	OIDCRolesClaim    string              `json:"oidc_roles_claim"`    // ID token claim holding the caller's groups or roles, dotted for nested claims
+	OIDCRoleMap       map[string][]string `json:"oidc_role_map"`       // Claim values to gateway roles; without it values are used as roles
+	OIDCPasswordLogin bool                `json:"oidc_password_login"` // Keep username/password login available next to OIDC
 }
 
 // TracingConfig holds tracing configuration
 type TracingConfig struct {
-	Enabled      bool
-	OTELEndpoint string
-	ServiceName  string
+	Enabled      bool    `json:"enabled"`
+	OTELEndpoint string  `json:"otel_endpoint"`
+	ServiceName  string  `json:"service_name"`
+	Sampler      string  `json:"sampler"`      // always, never, ratio or parent
+	SampleRatio  float64 `json:"sample_ratio"` // Fraction of new traces sampled by the ratio and parent samplers
+
+	MetricsEnabled  bool          `json:"metrics_enabled"` // Also export the gateway metrics over OTLP
+	MetricsInterval time.Duration `json:"metrics_interval"`
+}
+
+// WebSocketConfig holds WebSocket hub configuration
+type WebSocketConfig struct {
+	SendBufferSize      int           `json:"send_buffer_size"`
+	OverflowPolicy      string        `json:"overflow_policy"`
+	AllowedOrigins      []string      `json:"allowed_origins"`
+	ReadLimit           int64         `json:"read_limit"`
+	PongWait            time.Duration `json:"pong_wait"`
+	PingInterval        time.Duration `json:"ping_interval"`
+	WriteWait           time.Duration `json:"write_wait"`
+	MaxConnectionsPerIP int           `json:"max_connections_per_ip"`
+	MaxTopicsPerClient  int           `json:"max_topics_per_client"`
+	CloseTimeout        time.Duration `json:"close_timeout"`   // How long shutdown waits for clients to acknowledge the close
+	ReconnectDelay      time.Duration `json:"reconnect_delay"` // Hint sent to clients on shutdown, 0 for none
+}
+
+// ProxyConfig holds upstream HTTP transport configuration
+type ProxyConfig struct {
+	MaxIdleConns        int                 `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int                 `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int                 `json:"max_conns_per_host"`
+	IdleConnTimeout     time.Duration       `json:"idle_conn_timeout"`
+	TLSHandshakeTimeout time.Duration       `json:"tls_handshake_timeout"`
+	DialTimeout         time.Duration       `json:"dial_timeout"`
+	DisableKeepAlives   bool                `json:"disable_keep_alives"`
+	InsecureSkipVerify  bool                `json:"insecure_skip_verify"`
+	CAFiles             []string            `json:"ca_files"`        // CA bundles trusted for upstreams besides the system roots
+	TLSMinVersion       string              `json:"tls_min_version"` // Oldest TLS version upstreams may use
+	EnableHTTP2         bool                `json:"enable_http2"`
+	MirrorWorkers       int                 `json:"mirror_workers"`
+	MirrorQueueSize     int                 `json:"mirror_queue_size"`
+	MirrorMaxBodyBytes  int64               `json:"mirror_max_body_bytes"`
+	MirrorTimeout       time.Duration       `json:"mirror_timeout"`
+	TransformMaxBody    int64               `json:"transform_max_body"`
+	SignMaxBody         int64               `json:"sign_max_body"`    // Larger bodies are sent with an unsigned payload hash
+	BufferMaxBody       int64               `json:"buffer_max_body"`  // Largest body any feature buffers whole
+	BufferWatermark     int64               `json:"buffer_watermark"` // Bytes of buffered bodies past which features pass bodies through, 0 for no limit
+	CopyBufferSize      int                 `json:"copy_buffer_size"` // Size of the pooled buffers bodies are copied with, 0 for a new buffer per copy
+	TLSSealKey          string              `json:"tls_seal_key"`
+	TLSReloadInterval   time.Duration       `json:"tls_reload_interval"`
+	IdempotencyTTL      time.Duration       `json:"idempotency_ttl"`
+	IdempotencyMaxBody  int64               `json:"idempotency_max_body"`
+	DedupMaxBody        int64               `json:"dedup_max_body"`
+	HedgeMaxInflight    int                 `json:"hedge_max_inflight"`
+	AllowTrace          bool                `json:"allow_trace"` // Route TRACE requests instead of rejecting them with 405
+	DNSCache            bool                `json:"dns_cache"`
+	DNSTTL              time.Duration       `json:"dns_ttl"`
+	DNSNegativeTTL      time.Duration       `json:"dns_negative_ttl"`
+	DNSRefreshAhead     time.Duration       `json:"dns_refresh_ahead"`
+	DNSMaxStale         time.Duration       `json:"dns_max_stale"`       // How long expired addresses are served when lookups fail
+	DNSHosts            map[string][]string `json:"dns_hosts,omitempty"` // Hostnames pinned to addresses
+	EgressURL           string              `json:"egress_url"`          // Proxy upstream connections go through; HTTP_PROXY and HTTPS_PROXY when empty
+	EgressUsername      string              `json:"egress_username"`
+	EgressPassword      string              `json:"egress_password"`
+	EgressNoProxy       []string            `json:"egress_no_proxy"` // Hosts reached directly, replacing NO_PROXY when EgressURL is set
+	DeadlineHeader      string              `json:"deadline_header"` // Carries the remaining latency budget in milliseconds; none when empty
+	DeadlineGRPC        bool                `json:"deadline_grpc"`   // Sets grpc-timeout on gRPC requests
+	DeadlineFloor       time.Duration       `json:"deadline_floor"`  // Requests with less budget left are refused with 504
+}
+
+// LoadBalancerConfig holds the backend pool and session affinity configuration
+type LoadBalancerConfig struct {
+	Backends     []string       `json:"backends"`
+	Priorities   map[string]int `json:"priorities"` // Priority tier by backend URL, 0 when not listed
+	StickyCookie string         `json:"sticky_cookie"`
+	StickyTTL    time.Duration  `json:"sticky_ttl"`
+	StickyKey    string         `json:"sticky_key"`
+
+	OutlierConsecutiveFailures int           `json:"outlier_consecutive_failures"`
+	OutlierFailurePercent      int           `json:"outlier_failure_percent"`
+	OutlierMinRequests         int           `json:"outlier_min_requests"`
+	OutlierWindow              time.Duration `json:"outlier_window"`
+	OutlierBaseEjection        time.Duration `json:"outlier_base_ejection"`
+	OutlierMaxEjection         time.Duration `json:"outlier_max_ejection"`
+
+	DrainTimeout time.Duration `json:"drain_timeout"` // How long a backend removed through the API may finish its requests
+
+	Discovery DiscoveryConfig `json:"discovery"`
+}
+
+// DiscoveryConfig holds the service discovery that keeps the backend pool up
+// to date alongside LB_BACKENDS
+type DiscoveryConfig struct {
+	Type          string        `json:"type"`    // dns, consul or kubernetes; empty disables discovery
+	Service       string        `json:"service"` // Consul service name, DNS SRV record name or Kubernetes services
+	Interval      time.Duration `json:"interval"`
+	DrainTimeout  time.Duration `json:"drain_timeout"` // How long removed backends may finish their requests
+	Scheme        string        `json:"scheme"`        // Scheme of the discovered backend URLs
+	ConsulAddress string        `json:"consul_address"`
+	ConsulToken   string        `json:"consul_token"`
+	DNSServer     string        `json:"dns_server"`     // host:port; empty uses the system resolver
+	KubeNamespace string        `json:"kube_namespace"` // For services given without one; empty uses the gateway's
+	KubePort      string        `json:"kube_port"`      // Endpoint port name; empty uses the first port
+	Kubeconfig    string        `json:"kubeconfig"`     // Empty uses the in-cluster configuration
+}
+
+// AccessLogConfig holds the access log file configuration
+type AccessLogConfig struct {
+	Path       string        `json:"path"`   // Empty disables the access log
+	Format     string        `json:"format"` // json or combined
+	MaxBytes   int64         `json:"max_bytes"`
+	MaxAge     time.Duration `json:"max_age"`
+	MaxBackups int           `json:"max_backups"`
+	QueueSize  int           `json:"queue_size"`
+}
+
+// AdminUIConfig holds the embedded admin UI configuration
+type AdminUIConfig struct {
+	Enabled bool   `json:"enabled"`
+	APIBase string `json:"api_base"` // Base URL of the management API the UI calls
+}
+
+// ChaosConfig holds the per-route fault injection used for resilience testing
+type ChaosConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// GeoIPConfig holds the client country lookup used for request logs,
+// metrics and per-route country lists
+type GeoIPConfig struct {
+	DatabasePath   string        `json:"database_path"`   // MaxMind mmdb file, empty disables lookups
+	ReloadInterval time.Duration `json:"reload_interval"` // How often the file is checked for changes, 0 to never reload
+	MetricsLabel   bool          `json:"metrics_label"`   // Counts requests by country in isekai_country_requests_total
+	MetricsMax     int           `json:"metrics_max"`     // Distinct countries labelled before the rest count as "other"
+}
+
+// WarmupConfig holds the startup warm-up: routes loaded into memory, upstream
+// connections opened and circuit breakers created before the first requests
+type WarmupConfig struct {
+	Enabled       bool          `json:"enabled"`
+	Blocking      bool          `json:"blocking"`        // Warm up before listening, so readiness waits for it
+	Connections   int           `json:"connections"`     // Idle connections opened to each upstream
+	Timeout       time.Duration `json:"timeout"`         // Longest the whole warm-up may take
+	RouteTableTTL time.Duration `json:"route_table_ttl"` // How long proxied requests match routes in memory, 0 to always query the database
+}
+
+// SecurityHeadersConfig holds the headers set on every response and those
+// removed from upstream responses. Empty values leave a header out.
+type SecurityHeadersConfig struct {
+	Enabled            bool     `json:"enabled"`
+	HSTS               string   `json:"hsts"`                 // Strict-Transport-Security, sent over TLS only
+	ContentTypeOptions string   `json:"content_type_options"` // X-Content-Type-Options
+	FrameOptions       string   `json:"frame_options"`        // X-Frame-Options of the admin UI
+	AdminCSP           string   `json:"admin_csp"`            // Content-Security-Policy of the admin UI
+	Via                bool     `json:"via"`                  // Adds the gateway to Via
+	GatewayHeader      bool     `json:"gateway_header"`       // Sends X-Gateway with the gateway version
+	Strip              []string `json:"strip"`                // Upstream response headers removed
+}
+
+// CompressionConfig holds the compression of responses to clients that
+// accept it
+type CompressionConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Encodings    []string `json:"encodings"`     // br and gzip, most preferred first
+	MinSize      int      `json:"min_size"`      // Bytes a response needs to be compressed
+	ContentTypes []string `json:"content_types"` // Media types compressed, a trailing / matching the whole type
 }
 
 // Load loads configuration from environment variables
 func Load() *Config {
-	return &Config{
+	// Browser origins are shared by CORS and the WebSocket upgrade check
+	allowedOrigins := getSliceEnv("CORS_ALLOWED_ORIGINS", []string{"*"})
+
+	// Paths every global middleware lets through unless overridden for one
+	exemptPaths := getSliceEnv("GATEWAY_EXEMPT_PATHS", []string{"/health", "/metrics"})
+
+	var errs []error
+	secret := func(key, defaultValue string) string {
+		value, err := getSecretEnv(key, defaultValue)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return value
+	}
+
+	cfg := &Config{
 		Server: ServerConfig{
 			Port:            getEnv("SERVER_PORT", "8080"),
 			ReadTimeout:     getDurationEnv("SERVER_READ_TIMEOUT", 15*time.Second),
 			WriteTimeout:    getDurationEnv("SERVER_WRITE_TIMEOUT", 15*time.Second),
 			ShutdownTimeout: getDurationEnv("SERVER_SHUTDOWN_TIMEOUT", 30*time.Second),
+			DrainPeriod:     getDurationEnv("DRAIN_PERIOD", 15*time.Second),
+			DrainOnSigterm:  getDurationEnv("DRAIN_ON_SIGTERM", 0),
 			MaxHeaderBytes:  getIntEnv("SERVER_MAX_HEADER_BYTES", 1<<20),
+			AllowedOrigins:  allowedOrigins,
+			TLSCertFile:     getEnv("SERVER_TLS_CERT_FILE", ""),
+			TLSKeyFile:      getEnv("SERVER_TLS_KEY_FILE", ""),
+			Listen:          getSliceEnv("SERVER_LISTEN", nil),
 		},
 		Database: DatabaseConfig{
-			Host:            getEnv("DB_HOST", "localhost"),
-			Port:            getEnv("DB_PORT", "5432"),
-			User:            getEnv("DB_USER", "postgres"),
-			Password:        getEnv("DB_PASSWORD", "postgres"),
-			DBName:          getEnv("DB_NAME", "isekai_gateway"),
-			SSLMode:         getEnv("DB_SSL_MODE", "disable"),
-			MaxOpenConns:    getIntEnv("DB_MAX_OPEN_CONNS", 25),
-			MaxIdleConns:    getIntEnv("DB_MAX_IDLE_CONNS", 5),
-			ConnMaxLifetime: getDurationEnv("DB_CONN_MAX_LIFETIME", 5*time.Minute),
+			Host:               getEnv("DB_HOST", "localhost"),
+			Port:               getEnv("DB_PORT", "5432"),
+			User:               getEnv("DB_USER", "postgres"),
+			Password:           secret("DB_PASSWORD", "postgres"),
+			DBName:             getEnv("DB_NAME", "isekai_gateway"),
+			SSLMode:            getEnv("DB_SSL_MODE", "disable"),
+			MaxOpenConns:       getIntEnv("DB_MAX_OPEN_CONNS", 25),
+			MaxIdleConns:       getIntEnv("DB_MAX_IDLE_CONNS", 5),
+			ConnMaxLifetime:    getDurationEnv("DB_CONN_MAX_LIFETIME", 5*time.Minute),
+			ConnectRetries:     getIntEnv("DB_CONNECT_RETRIES", 5),
+			ConnectBackoff:     getDurationEnv("DB_CONNECT_BACKOFF", 1*time.Second),
+			Required:           getBoolEnv("DB_REQUIRED", true),
+			SlowQueryThreshold: getDurationEnv("DB_SLOW_QUERY_THRESHOLD", 200*time.Millisecond),
+			QueryTimeout:       getDurationEnv("DB_QUERY_TIMEOUT", 5*time.Second),
+			RollupInterval:     getDurationEnv("DB_ROLLUP_INTERVAL", time.Hour),
 		},
 		Cache: CacheConfig{
 			Enabled:         getBoolEnv("CACHE_ENABLED", true),
 			TTL:             getDurationEnv("CACHE_TTL", 5*time.Minute),
 			CleanupInterval: getDurationEnv("CACHE_CLEANUP_INTERVAL", 10*time.Minute),
 			MaxSize:         getInt64Env("CACHE_MAX_SIZE", 1000),
+			MaxStale:        getDurationEnv("CACHE_MAX_STALE", 0),
 		},
 		Gateway: GatewayConfig{
-			MaxConcurrentRequests: getIntEnv("GATEWAY_MAX_CONCURRENT_REQUESTS", 1000),
-			RequestTimeout:        getDurationEnv("GATEWAY_REQUEST_TIMEOUT", 30*time.Second),
-			RateLimitEnabled:      getBoolEnv("GATEWAY_RATE_LIMIT_ENABLED", true),
-			RateLimitPerSecond:    getIntEnv("GATEWAY_RATE_LIMIT_PER_SECOND", 100),
+			MaxConcurrentRequests:  getIntEnv("GATEWAY_MAX_CONCURRENT_REQUESTS", 1000),
+			ConcurrencyQueueSize:   getIntEnv("GATEWAY_CONCURRENCY_QUEUE_SIZE", 0),
+			ConcurrencyQueueWait:   getDurationEnv("GATEWAY_CONCURRENCY_QUEUE_TIMEOUT", 500*time.Millisecond),
+			UpstreamQueueSize:      getIntEnv("GATEWAY_UPSTREAM_QUEUE_SIZE", 100),
+			UpstreamQueueWait:      getDurationEnv("GATEWAY_UPSTREAM_QUEUE_TIMEOUT", time.Second),
+			RequestTimeout:         getDurationEnv("GATEWAY_REQUEST_TIMEOUT", 30*time.Second),
+			RateLimitEnabled:       getBoolEnv("GATEWAY_RATE_LIMIT_ENABLED", true),
+			RateLimitPerSecond:     getIntEnv("GATEWAY_RATE_LIMIT_PER_SECOND", 100),
+			RateLimitTiers:         getIntMapEnv("GATEWAY_RATE_LIMIT_TIERS"),
+			RateLimitTierRefresh:   getDurationEnv("GATEWAY_RATE_LIMIT_TIER_REFRESH", 30*time.Second),
+			RateLimitHeaders:       getOptionalSliceEnv("GATEWAY_RATE_LIMIT_HEADERS", []string{"draft", "legacy"}),
+			MetricsMaxPaths:        getIntEnv("GATEWAY_METRICS_MAX_PATHS", 500),
+			MetricsCollectInterval: getDurationEnv("GATEWAY_METRICS_COLLECT_INTERVAL", 15*time.Second),
+			HealthCacheTTL:         getDurationEnv("GATEWAY_HEALTH_CACHE_TTL", 2*time.Second),
+			IPAllow:                getSliceEnv("GATEWAY_IP_ALLOW", nil),
+			IPDeny:                 getSliceEnv("GATEWAY_IP_DENY", nil),
+			ErrorPagesDir:          getEnv("GATEWAY_ERROR_PAGES_DIR", ""),
+			LogHeaders:             getSliceEnv("GATEWAY_LOG_HEADERS", nil),
+			SensitiveHeaders:       getSliceEnv("GATEWAY_SENSITIVE_HEADERS", append([]string(nil), redact.DefaultHeaders...)),
+			SnapshotRetention:      getIntEnv("GATEWAY_SNAPSHOT_RETENTION", 20),
+			ExemptPaths:            exemptPaths,
+			RateLimitExemptPaths:   getSliceEnv("GATEWAY_RATE_LIMIT_EXEMPT_PATHS", exemptPaths),
+			AuthExemptPaths:        getSliceEnv("GATEWAY_AUTH_EXEMPT_PATHS", exemptPaths),
+			MetricsAuthToken:       secret("METRICS_AUTH_TOKEN", ""),
+			InflightMax:            getIntEnv("GATEWAY_INFLIGHT_MAX", 10000),
+			LogExportMaxRows:       getIntEnv("GATEWAY_LOG_EXPORT_MAX_ROWS", 1000000),
+			LogExportRate:          getIntEnv("GATEWAY_LOG_EXPORT_RATE", 10<<20),
+			PanicWebhookURL:        secret("GATEWAY_PANIC_WEBHOOK_URL", ""),
+			PanicWebhookRate:       getIntEnv("GATEWAY_PANIC_WEBHOOK_RATE", 10),
 		},
 		Auth: AuthConfig{
-			JWTSecret:     getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
-			TokenDuration: getDurationEnv("JWT_TOKEN_DURATION", 24*time.Hour),
-			Enabled:       getBoolEnv("AUTH_ENABLED", false),
+			JWTSecret:           secret("JWT_SECRET", DefaultJWTSecret),
+			TokenDuration:       getDurationEnv("JWT_TOKEN_DURATION", 24*time.Hour),
+			Enabled:             getBoolEnv("AUTH_ENABLED", false),
+			Algorithm:           getEnv("AUTH_ALG", "HS256"),
+			PublicKeyFile:       getEnv("AUTH_PUBLIC_KEY_FILE", ""),
+			PrivateKeyFile:      getEnv("AUTH_PRIVATE_KEY_FILE", ""),
+			JWKSURL:             getEnv("AUTH_JWKS_URL", ""),
+			JWKSRefreshInterval: getDurationEnv("AUTH_JWKS_REFRESH_INTERVAL", 15*time.Minute),
+			PasswordMinLength:   getIntEnv("AUTH_PASSWORD_MIN_LENGTH", 12),
+			OIDCIssuerURL:       getEnv("AUTH_OIDC_ISSUER_URL", ""),
+			OIDCClientID:        getEnv("AUTH_OIDC_CLIENT_ID", ""),
+			OIDCClientSecret:    secret("AUTH_OIDC_CLIENT_SECRET", ""),
+			OIDCRedirectURL:     getEnv("AUTH_OIDC_REDIRECT_URL", ""),
+			OIDCScopes:          getSliceEnv("AUTH_OIDC_SCOPES", []string{"openid", "profile", "email"}),
+			OIDCRolesClaim:      getEnv("AUTH_OIDC_ROLES_CLAIM", "groups"),
+			OIDCRoleMap:         getListMapEnv("AUTH_OIDC_ROLE_MAP"),
+			OIDCPasswordLogin:   getBoolEnv("AUTH_OIDC_PASSWORD_LOGIN", false),
 		},
 		Tracing: TracingConfig{
 			Enabled:      getBoolEnv("TRACING_ENABLED", false),
 			OTELEndpoint: getEnv("OTEL_ENDPOINT", "localhost:4318"),
 			ServiceName:  getEnv("SERVICE_NAME", "isekai-gateway"),
+			Sampler:      getEnv("TRACING_SAMPLER", "parent"),
+			SampleRatio:  getFloatEnv("TRACING_SAMPLE_RATIO", 1),
+
+			MetricsEnabled:  getBoolEnv("OTEL_METRICS_ENABLED", false),
+			MetricsInterval: getDurationEnv("OTEL_METRICS_INTERVAL", 30*time.Second),
+		},
+		WebSocket: WebSocketConfig{
+			SendBufferSize:      getIntEnv("WS_SEND_BUFFER_SIZE", 256),
+			OverflowPolicy:      getEnv("WS_OVERFLOW_POLICY", "disconnect"),
+			AllowedOrigins:      allowedOrigins,
+			ReadLimit:           getInt64Env("WS_READ_LIMIT", 64*1024),
+			PongWait:            getDurationEnv("WS_PONG_WAIT", 60*time.Second),
+			PingInterval:        getDurationEnv("WS_PING_INTERVAL", 54*time.Second),
+			WriteWait:           getDurationEnv("WS_WRITE_WAIT", 10*time.Second),
+			MaxConnectionsPerIP: getIntEnv("WS_MAX_CONNECTIONS_PER_IP", 50),
+			MaxTopicsPerClient:  getIntEnv("WS_MAX_TOPICS_PER_CLIENT", 20),
+			CloseTimeout:        getDurationEnv("WS_CLOSE_TIMEOUT", 5*time.Second),
+			ReconnectDelay:      getDurationEnv("WS_RECONNECT_DELAY", 5*time.Second),
+		},
+		Proxy: ProxyConfig{
+			MaxIdleConns:        getIntEnv("PROXY_MAX_IDLE_CONNS", 512),
+			MaxIdleConnsPerHost: getIntEnv("PROXY_MAX_IDLE_CONNS_PER_HOST", 64),
+			MaxConnsPerHost:     getIntEnv("PROXY_MAX_CONNS_PER_HOST", 0),
+			IdleConnTimeout:     getDurationEnv("PROXY_IDLE_CONN_TIMEOUT", 90*time.Second),
+			TLSHandshakeTimeout: getDurationEnv("PROXY_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+			DialTimeout:         getDurationEnv("PROXY_DIAL_TIMEOUT", 5*time.Second),
+			DisableKeepAlives:   getBoolEnv("PROXY_DISABLE_KEEP_ALIVES", false),
+			InsecureSkipVerify:  getBoolEnv("PROXY_INSECURE_SKIP_VERIFY", false),
+			CAFiles:             getSliceEnv("PROXY_CA_FILES", nil),
+			TLSMinVersion:       getEnv("PROXY_TLS_MIN_VERSION", "1.2"),
+			EnableHTTP2:         getBoolEnv("PROXY_ENABLE_HTTP2", true),
+			MirrorWorkers:       getIntEnv("PROXY_MIRROR_WORKERS", 4),
+			MirrorQueueSize:     getIntEnv("PROXY_MIRROR_QUEUE_SIZE", 100),
+			MirrorMaxBodyBytes:  getInt64Env("PROXY_MIRROR_MAX_BODY_BYTES", 1<<20),
+			MirrorTimeout:       getDurationEnv("PROXY_MIRROR_TIMEOUT", 5*time.Second),
+			TransformMaxBody:    getInt64Env("PROXY_TRANSFORM_MAX_BODY_BYTES", 1<<20),
+			SignMaxBody:         getInt64Env("PROXY_SIGN_MAX_BODY_BYTES", 10<<20),
+			BufferMaxBody:       getInt64Env("PROXY_BUFFER_MAX_BODY_BYTES", 10<<20),
+			BufferWatermark:     getInt64Env("PROXY_BUFFER_WATERMARK_BYTES", 256<<20),
+			CopyBufferSize:      getIntEnv("PROXY_COPY_BUFFER_SIZE", 32<<10),
+			TLSSealKey:          secret("PROXY_TLS_SEAL_KEY", ""),
+			TLSReloadInterval:   getDurationEnv("PROXY_TLS_RELOAD_INTERVAL", 10*time.Second),
+			IdempotencyTTL:      getDurationEnv("PROXY_IDEMPOTENCY_TTL", 24*time.Hour),
+			IdempotencyMaxBody:  getInt64Env("PROXY_IDEMPOTENCY_MAX_BODY_BYTES", 1<<20),
+			DedupMaxBody:        getInt64Env("PROXY_DEDUP_MAX_BODY_BYTES", 1<<20),
+			HedgeMaxInflight:    getIntEnv("PROXY_HEDGE_MAX_INFLIGHT", 10),
+			AllowTrace:          getBoolEnv("PROXY_ALLOW_TRACE", false),
+			DNSCache:            getBoolEnv("PROXY_DNS_CACHE", false),
+			DNSTTL:              getDurationEnv("PROXY_DNS_TTL", 30*time.Second),
+			DNSNegativeTTL:      getDurationEnv("PROXY_DNS_NEGATIVE_TTL", 5*time.Second),
+			DNSRefreshAhead:     getDurationEnv("PROXY_DNS_REFRESH_AHEAD", 5*time.Second),
+			DNSMaxStale:         getDurationEnv("PROXY_DNS_MAX_STALE", 5*time.Minute),
+			DNSHosts:            getListMapEnv("PROXY_DNS_HOSTS"),
+			EgressURL:           getEnv("PROXY_EGRESS_URL", ""),
+			EgressUsername:      getEnv("PROXY_EGRESS_USERNAME", ""),
+			EgressPassword:      secret("PROXY_EGRESS_PASSWORD", ""),
+			EgressNoProxy:       getSliceEnv("PROXY_EGRESS_NO_PROXY", nil),
+			DeadlineHeader:      getOptionalEnv("PROXY_DEADLINE_HEADER", "X-Deadline-Ms"),
+			DeadlineGRPC:        getBoolEnv("PROXY_DEADLINE_GRPC", true),
+			DeadlineFloor:       getDurationEnv("PROXY_DEADLINE_FLOOR", 0),
+		},
+		LoadBalancer: LoadBalancerConfig{
+			Backends:     getSliceEnv("LB_BACKENDS", nil),
+			Priorities:   getIntMapEnv("LB_BACKEND_PRIORITIES"),
+			StickyCookie: getEnv("LB_STICKY_COOKIE", ""),
+			StickyTTL:    getDurationEnv("LB_STICKY_TTL", time.Hour),
+			StickyKey:    secret("LB_STICKY_KEY", ""),
+
+			OutlierConsecutiveFailures: getIntEnv("LB_OUTLIER_CONSECUTIVE_FAILURES", 5),
+			OutlierFailurePercent:      getIntEnv("LB_OUTLIER_FAILURE_PERCENT", 50),
+			OutlierMinRequests:         getIntEnv("LB_OUTLIER_MIN_REQUESTS", 20),
+			OutlierWindow:              getDurationEnv("LB_OUTLIER_WINDOW", 30*time.Second),
+			OutlierBaseEjection:        getDurationEnv("LB_OUTLIER_BASE_EJECTION", 30*time.Second),
+			OutlierMaxEjection:         getDurationEnv("LB_OUTLIER_MAX_EJECTION", 5*time.Minute),
+
+			DrainTimeout: getDurationEnv("LB_DRAIN_TIMEOUT", 30*time.Second),
+
+			Discovery: DiscoveryConfig{
+				Type:          getEnv("LB_DISCOVERY_TYPE", ""),
+				Service:       getEnv("LB_DISCOVERY_SERVICE", ""),
+				Interval:      getDurationEnv("LB_DISCOVERY_INTERVAL", 30*time.Second),
+				DrainTimeout:  getDurationEnv("LB_DISCOVERY_DRAIN_TIMEOUT", 30*time.Second),
+				Scheme:        getEnv("LB_DISCOVERY_SCHEME", "http"),
+				ConsulAddress: getEnv("LB_DISCOVERY_CONSUL_ADDR", "http://127.0.0.1:8500"),
+				ConsulToken:   secret("LB_DISCOVERY_CONSUL_TOKEN", ""),
+				DNSServer:     getEnv("LB_DISCOVERY_DNS_SERVER", ""),
+				KubeNamespace: getEnv("LB_DISCOVERY_K8S_NAMESPACE", ""),
+				KubePort:      getEnv("LB_DISCOVERY_K8S_PORT", ""),
+				Kubeconfig:    getEnv("LB_DISCOVERY_KUBECONFIG", ""),
+			},
+		},
+		AccessLog: AccessLogConfig{
+			Path:       getEnv("ACCESS_LOG_PATH", ""),
+			Format:     getEnv("ACCESS_LOG_FORMAT", "json"),
+			MaxBytes:   getInt64Env("ACCESS_LOG_MAX_BYTES", 100<<20),
+			MaxAge:     getDurationEnv("ACCESS_LOG_MAX_AGE", 24*time.Hour),
+			MaxBackups: getIntEnv("ACCESS_LOG_MAX_BACKUPS", 7),
+			QueueSize:  getIntEnv("ACCESS_LOG_QUEUE_SIZE", 8192),
+		},
+		AdminUI: AdminUIConfig{
+			Enabled: getBoolEnv("ADMIN_UI_ENABLED", true),
+			APIBase: getEnv("ADMIN_UI_API_BASE", "/api"),
+		},
+		Chaos: ChaosConfig{
+			Enabled: getBoolEnv("CHAOS_ENABLED", false),
+		},
+		GeoIP: GeoIPConfig{
+			DatabasePath:   getEnv("GEOIP_DATABASE_PATH", ""),
+			ReloadInterval: getDurationEnv("GEOIP_RELOAD_INTERVAL", time.Minute),
+			MetricsLabel:   getBoolEnv("GEOIP_METRICS_LABEL", false),
+			MetricsMax:     getIntEnv("GEOIP_METRICS_MAX_COUNTRIES", 50),
+		},
+		Warmup: WarmupConfig{
+			Enabled:       getBoolEnv("WARMUP_ENABLED", true),
+			Blocking:      getBoolEnv("WARMUP_BLOCKING", false),
+			Connections:   getIntEnv("WARMUP_CONNECTIONS", 2),
+			Timeout:       getDurationEnv("WARMUP_TIMEOUT", 10*time.Second),
+			RouteTableTTL: getDurationEnv("WARMUP_ROUTE_TABLE_TTL", 30*time.Second),
+		},
+		SecurityHeaders: SecurityHeadersConfig{
+			Enabled:            getBoolEnv("SECURITY_HEADERS_ENABLED", true),
+			HSTS:               getOptionalEnv("SECURITY_HEADERS_HSTS", "max-age=31536000; includeSubDomains"),
+			ContentTypeOptions: getOptionalEnv("SECURITY_HEADERS_CONTENT_TYPE_OPTIONS", "nosniff"),
+			FrameOptions:       getOptionalEnv("SECURITY_HEADERS_FRAME_OPTIONS", "DENY"),
+			AdminCSP:           getOptionalEnv("SECURITY_HEADERS_ADMIN_CSP", "default-src 'self'; connect-src 'self' ws: wss:; frame-ancestors 'none'; base-uri 'self'; form-action 'self'"),
+			Via:                getBoolEnv("SECURITY_HEADERS_VIA", false),
+			GatewayHeader:      getBoolEnv("SECURITY_HEADERS_GATEWAY", false),
+			Strip:              getOptionalSliceEnv("SECURITY_HEADERS_STRIP", []string{"Server"}),
 		},
+		Compression: CompressionConfig{
+			Enabled:      getBoolEnv("COMPRESSION_ENABLED", false),
+			Encodings:    getSliceEnv("COMPRESSION_ENCODINGS", []string{"br", "gzip"}),
+			MinSize:      getIntEnv("COMPRESSION_MIN_SIZE", 1024),
+			ContentTypes: getSliceEnv("COMPRESSION_CONTENT_TYPES", []string{"text/", "application/json", "application/javascript", "application/xml", "application/problem+json", "image/svg+xml"}),
+		},
+		Environment: getEnv("ENVIRONMENT", "production"),
+	}
+	cfg.errs = errs
+	return cfg
+}
+
+// Validate reports secret files that could not be read, refuses the
+// placeholder JWT secret when it would be used to sign tokens and checks the
+// service discovery settings and pinned upstream addresses
+func (c *Config) Validate() error {
+	errs := append([]error(nil), c.errs...)
+	if c.Auth.Enabled && c.Auth.JWTSecret == DefaultJWTSecret && strings.HasPrefix(strings.ToUpper(c.Auth.Algorithm), "HS") {
+		errs = append(errs, errors.New("JWT_SECRET must be changed from the default when AUTH_ENABLED is set"))
+	}
+	if c.Gateway.MaxConcurrentRequests < 0 || c.Gateway.ConcurrencyQueueSize < 0 {
+		errs = append(errs, errors.New("GATEWAY_MAX_CONCURRENT_REQUESTS and GATEWAY_CONCURRENCY_QUEUE_SIZE can't be negative"))
+	}
+	for _, family := range c.Gateway.RateLimitHeaders {
+		if family != "draft" && family != "legacy" {
+			errs = append(errs, fmt.Errorf("GATEWAY_RATE_LIMIT_HEADERS can list draft and legacy, got %q", family))
+		}
+	}
+	if c.Gateway.UpstreamQueueSize < 0 {
+		errs = append(errs, errors.New("GATEWAY_UPSTREAM_QUEUE_SIZE can't be negative"))
+	}
+	if c.Gateway.InflightMax < 0 {
+		errs = append(errs, errors.New("GATEWAY_INFLIGHT_MAX can't be negative"))
+	}
+	if c.Gateway.LogExportMaxRows < 1 {
+		errs = append(errs, errors.New("GATEWAY_LOG_EXPORT_MAX_ROWS must be positive"))
+	}
+	if c.Gateway.LogExportRate < 0 {
+		errs = append(errs, errors.New("GATEWAY_LOG_EXPORT_RATE can't be negative"))
+	}
+	if c.Gateway.PanicWebhookURL != "" {
+		if u, err := url.Parse(c.Gateway.PanicWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("GATEWAY_PANIC_WEBHOOK_URL must be an http or https URL"))
+		}
+		if c.Gateway.PanicWebhookRate < 1 {
+			errs = append(errs, errors.New("GATEWAY_PANIC_WEBHOOK_RATE must be positive"))
+		}
+	}
+	if c.Warmup.Connections < 0 || c.Warmup.Timeout <= 0 || c.Warmup.RouteTableTTL < 0 {
+		errs = append(errs, errors.New("WARMUP_CONNECTIONS and WARMUP_ROUTE_TABLE_TTL can't be negative and WARMUP_TIMEOUT must be positive"))
+	}
+	for _, encoding := range c.Compression.Encodings {
+		if encoding != "br" && encoding != "gzip" {
+			errs = append(errs, fmt.Errorf("COMPRESSION_ENCODINGS can list br and gzip, got %q", encoding))
+		}
+	}
+	if c.Compression.MinSize < 0 {
+		errs = append(errs, errors.New("COMPRESSION_MIN_SIZE can't be negative"))
+	}
+	if c.Chaos.Enabled && c.Production() {
+		errs = append(errs, errors.New("CHAOS_ENABLED can't be set when ENVIRONMENT is production"))
+	}
+	if c.LoadBalancer.DrainTimeout < 0 {
+		errs = append(errs, errors.New("LB_DRAIN_TIMEOUT can't be negative"))
+	}
+	switch d := c.LoadBalancer.Discovery; {
+	case d.Type != "" && d.Type != "dns" && d.Type != "consul" && d.Type != "kubernetes":
+		errs = append(errs, fmt.Errorf("LB_DISCOVERY_TYPE must be dns, consul or kubernetes, got %q", d.Type))
+	case d.Type != "" && d.Service == "":
+		errs = append(errs, errors.New("LB_DISCOVERY_SERVICE is required when LB_DISCOVERY_TYPE is set"))
+	case d.Type != "" && d.Interval <= 0:
+		errs = append(errs, errors.New("LB_DISCOVERY_INTERVAL must be positive"))
+	}
+	for host, addrs := range c.Proxy.DNSHosts {
+		for _, addr := range addrs {
+			if _, err := netip.ParseAddr(addr); err != nil {
+				errs = append(errs, fmt.Errorf("PROXY_DNS_HOSTS pins %s to %q, which is not an IP address", host, addr))
+			}
+		}
+	}
+	switch c.Proxy.TLSMinVersion {
+	case "1.0", "1.1", "1.2", "1.3":
+	default:
+		errs = append(errs, fmt.Errorf("PROXY_TLS_MIN_VERSION must be 1.0, 1.1, 1.2 or 1.3, got %q", c.Proxy.TLSMinVersion))
+	}
+	for _, name := range c.Proxy.CAFiles {
+		if ca, err := os.ReadFile(name); err != nil {
+			errs = append(errs, fmt.Errorf("invalid PROXY_CA_FILES: %w", err))
+		} else if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			errs = append(errs, fmt.Errorf("PROXY_CA_FILES: %s contains no certificates", name))
+		}
+	}
+	if c.Proxy.EgressURL != "" {
+		u, err := url.Parse(c.Proxy.EgressURL)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("invalid PROXY_EGRESS_URL: %w", err))
+		case u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" && u.Scheme != "socks5h":
+			errs = append(errs, fmt.Errorf("PROXY_EGRESS_URL scheme must be http, https, socks5 or socks5h, got %q", u.Scheme))
+		case u.Host == "":
+			errs = append(errs, errors.New("PROXY_EGRESS_URL requires a host"))
+		}
+	}
+	if c.Auth.OIDCIssuerURL != "" {
+		for _, setting := range [][2]string{{"AUTH_OIDC_ISSUER_URL", c.Auth.OIDCIssuerURL}, {"AUTH_OIDC_REDIRECT_URL", c.Auth.OIDCRedirectURL}} {
+			if u, err := url.Parse(setting[1]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("%s must be an absolute http or https URL when OIDC is enabled", setting[0]))
+			}
+		}
+		if c.Auth.OIDCClientID == "" {
+			errs = append(errs, errors.New("AUTH_OIDC_CLIENT_ID is required when AUTH_OIDC_ISSUER_URL is set"))
+		}
+		if !slices.Contains(c.Auth.OIDCScopes, "openid") {
+			errs = append(errs, errors.New("AUTH_OIDC_SCOPES must include openid"))
+		}
+	}
+	if c.Proxy.DeadlineFloor < 0 {
+		errs = append(errs, errors.New("PROXY_DEADLINE_FLOOR must not be negative"))
 	}
+	if c.Proxy.BufferMaxBody <= 0 {
+		errs = append(errs, errors.New("PROXY_BUFFER_MAX_BODY_BYTES must be positive"))
+	}
+	if c.Proxy.BufferWatermark < 0 {
+		errs = append(errs, errors.New("PROXY_BUFFER_WATERMARK_BYTES must not be negative"))
+	} else if c.Proxy.BufferWatermark > 0 && c.Proxy.BufferWatermark < c.Proxy.BufferMaxBody {
+		errs = append(errs, errors.New("PROXY_BUFFER_WATERMARK_BYTES must be at least PROXY_BUFFER_MAX_BODY_BYTES"))
+	}
+	if c.Proxy.CopyBufferSize < 0 {
+		errs = append(errs, errors.New("PROXY_COPY_BUFFER_SIZE must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Production reports whether the gateway runs in production. Anything but an
+// explicit non-production ENVIRONMENT counts.
+func (c *Config) Production() bool {
+	switch strings.ToLower(strings.TrimSpace(c.Environment)) {
+	case "", "prod", "production":
+		return true
+	}
+	return false
+}
+
+// Redacted returns a copy of the configuration with secrets masked, safe to
+// log or expose. Secrets that are not set are left empty.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.errs = nil
+	for _, secret := range []*string{
+		&r.Database.Password,
+		&r.Auth.JWTSecret,
+		&r.Proxy.TLSSealKey,
+		&r.LoadBalancer.StickyKey,
+		&r.LoadBalancer.Discovery.ConsulToken,
+		&r.Gateway.MetricsAuthToken,
+		&r.Proxy.EgressPassword,
+		&r.Auth.OIDCClientSecret,
+		&r.Gateway.PanicWebhookURL, // Webhook URLs often carry their token
+	} {
+		if *secret != "" {
+			*secret = redact.Mask
+		}
+	}
+	// Credentials may be given in the egress proxy URL instead
+	if u, err := url.Parse(r.Proxy.EgressURL); err == nil && u.User != nil {
+		r.Proxy.EgressURL = u.Redacted()
+	}
+	return &r
 }
 
 // GetDSN returns the PostgreSQL connection string
@@ -123,6 +725,17 @@ func (c *DatabaseConfig) GetDSN() string {
 	)
 }
 
+// OriginAllowed reports whether a browser origin is in the allowed list. "*"
+// allows any origin; matching is case-insensitive.
+func OriginAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
 // Helper functions
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -131,6 +744,31 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getSecretEnv reads a secret from the file named by key_FILE, which takes
+// precedence over key itself. Trailing newlines in the file are ignored.
+func getSecretEnv(key, defaultValue string) (string, error) {
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return getEnv(key, defaultValue), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %w", key, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// getOptionalEnv reads a value that can be turned off with "off", since an
+// empty variable means the default
+func getOptionalEnv(key, defaultValue string) string {
+	value := getEnv(key, defaultValue)
+	if strings.EqualFold(value, "off") {
+		return ""
+	}
+	return value
+}
+
 func getIntEnv(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		if intVal, err := strconv.Atoi(value); err == nil {
@@ -149,6 +787,15 @@ func getInt64Env(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+func getFloatEnv(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
 func getBoolEnv(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolVal, err := strconv.ParseBool(value); err == nil {
@@ -166,3 +813,57 @@ func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
 	}
 	return defaultValue
 }
+
+func getSliceEnv(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getOptionalSliceEnv reads a list that can be emptied with "off"
+func getOptionalSliceEnv(key string, defaultValue []string) []string {
+	if strings.EqualFold(os.Getenv(key), "off") {
+		return nil
+	}
+	return getSliceEnv(key, defaultValue)
+}
+
+// getIntMapEnv parses comma-separated name=value pairs, skipping malformed ones
+func getListMapEnv(key string) map[string][]string {
+	values := make(map[string][]string)
+	for _, item := range getSliceEnv(key, nil) {
+		name, list, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		for _, value := range strings.Split(list, "|") {
+			if value = strings.TrimSpace(value); value != "" {
+				values[strings.TrimSpace(name)] = append(values[strings.TrimSpace(name)], value)
+			}
+		}
+	}
+	return values
+}
+
+func getIntMapEnv(key string) map[string]int {
+	values := make(map[string]int)
+	for _, item := range getSliceEnv(key, nil) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		if intVal, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			values[strings.TrimSpace(name)] = intVal
+		}
+	}
+	return values
+}
@@ -0,0 +1,181 @@
+package httpjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/zakirkun/isekai/pkg/response"
+)
+
+// MaxBytes caps the request bodies Decode reads
+const MaxBytes = 1 << 20
+
+// ErrEmpty is returned by Decode for a request without a body
+var ErrEmpty = errors.New("request body is empty")
+
+// Error is a request body that couldn't be decoded, with a message for the
+// client saying what is wrong with it
+type Error struct {
+	Status  int    // 400, or 413 for a body over MaxBytes
+	Code    string // INVALID_BODY or BODY_TOO_LARGE
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Decode reads the JSON document in r's body into v. It refuses bodies over
+// MaxBytes, empty bodies, fields v doesn't have and anything after the
+// document. Errors are *Error.
+func Decode(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return invalid(ErrEmpty)
+	}
+	return decode(http.MaxBytesReader(w, r.Body, MaxBytes), v, false)
+}
+
+// DecodeOptional is Decode for bodies that may be left out, leaving v as it
+// is when the body is empty
+func DecodeOptional(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return nil
+	}
+	return decode(http.MaxBytesReader(w, r.Body, MaxBytes), v, true)
+}
+
+// Unmarshal decodes data into v with the same checks as Decode
+func Unmarshal(data []byte, v interface{}) error {
+	if len(data) > MaxBytes {
+		return tooLarge(&http.MaxBytesError{Limit: MaxBytes})
+	}
+	return decode(bytes.NewReader(data), v, false)
+}
+
+// WriteError answers a request whose body Decode refused with the error
+// envelope
+func WriteError(w http.ResponseWriter, err error) {
+	var decodeErr *Error
+	if !errors.As(err, &decodeErr) {
+		decodeErr = invalid(err)
+	}
+	response.ErrorCode(w, decodeErr.Status, decodeErr.Code, decodeErr.Message)
+}
+
+// decode reads one JSON document from body into v
+func decode(body io.Reader, v interface{}, optional bool) error {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			if optional {
+				return nil
+			}
+			return invalid(ErrEmpty)
+		}
+		return translate(err)
+	}
+
+	// Only whitespace may follow the document
+	end := decoder.InputOffset()
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return tooLarge(maxErr)
+		}
+		return &Error{
+			Status:  http.StatusBadRequest,
+			Code:    response.CodeInvalidBody,
+			Message: fmt.Sprintf("Request body has data after the JSON document ending at byte %d", end),
+			Err:     err,
+		}
+	}
+	return nil
+}
+
+// translate turns a decoding error into a message naming the problem and
+// where it is
+func translate(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxErr):
+		return tooLarge(maxErr)
+	case errors.As(err, &syntaxErr):
+		return invalidf(err, "Malformed JSON at byte %d: %s", syntaxErr.Offset, strings.TrimPrefix(syntaxErr.Error(), "json: "))
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return invalidf(err, "Request body ends in the middle of the JSON document")
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return invalidf(err, "Request body must be %s, got %s", describe(typeErr.Type), typeErr.Value)
+		}
+		return invalidf(err, "Field %q must be %s, got %s at byte %d", typeErr.Field, describe(typeErr.Type), typeErr.Value, typeErr.Offset)
+	}
+
+	// DisallowUnknownFields has no error type of its own
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return invalidf(err, "Unknown field %s", field)
+	}
+	return invalidf(err, "Invalid request body: %s", strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// describe names the JSON type expected for t
+func describe(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return t.String()
+}
+
+// invalid wraps err as an INVALID_BODY error with its own message
+func invalid(err error) *Error {
+	message := err.Error()
+	if message != "" {
+		message = strings.ToUpper(message[:1]) + message[1:]
+	}
+	return &Error{Status: http.StatusBadRequest, Code: response.CodeInvalidBody, Message: message, Err: err}
+}
+
+// invalidf wraps err as an INVALID_BODY error with a formatted message
+func invalidf(err error, format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: response.CodeInvalidBody, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+// tooLarge reports a body over the size cap
+func tooLarge(err *http.MaxBytesError) *Error {
+	return &Error{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    response.CodeBodyTooLarge,
+		Message: fmt.Sprintf("Request body exceeds %d bytes", err.Limit),
+		Err:     err,
+	}
+}
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"io"
 	"log"
 	"os"
 	"sync"
@@ -48,6 +49,18 @@ func Get() *Logger {
 	return instance
 }
 
+// New creates a logger writing every level to w, apart from the shared one
+func New(w io.Writer) *Logger {
+	return &Logger{
+		level: INFO,
+		debug: log.New(w, "[DEBUG] ", log.LstdFlags|log.Lshortfile),
+		info:  log.New(w, "[INFO] ", log.LstdFlags),
+		warn:  log.New(w, "[WARN] ", log.LstdFlags),
+		error: log.New(w, "[ERROR] ", log.LstdFlags|log.Lshortfile),
+		fatal: log.New(w, "[FATAL] ", log.LstdFlags|log.Lshortfile),
+	}
+}
+
 // SetLevel sets the logging level
 func (l *Logger) SetLevel(level Level) {
 	l.mu.Lock()
@@ -0,0 +1,159 @@
+package redact
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Mask replaces redacted values
+const Mask = "[REDACTED]"
+
+// DefaultHeaders are the headers redacted when none are configured
+var DefaultHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-API-Key"}
+
+// Headers decides which headers are recorded when requests are logged or
+// traced, masking the values of sensitive ones. Every place that serializes
+// headers goes through it so a secret can't leak through one that forgot.
+type Headers struct {
+	include   map[string]bool // Recorded headers, nil for none
+	all       bool            // Record every header
+	sensitive map[string]bool
+}
+
+// NewHeaders records the include headers, or all of them for "*", and
+// masks the sensitive ones
+func NewHeaders(include, sensitive []string) *Headers {
+	h := &Headers{sensitive: canonicalSet(sensitive)}
+	for _, name := range include {
+		if strings.TrimSpace(name) == "*" {
+			h.all = true
+		}
+	}
+	if !h.all {
+		h.include = canonicalSet(include)
+	}
+	return h
+}
+
+// With returns headers that also mask extra, for routes adding their own
+func (h *Headers) With(extra []string) *Headers {
+	if len(extra) == 0 {
+		return h
+	}
+
+	with := &Headers{include: h.include, all: h.all, sensitive: canonicalSet(extra)}
+	for name := range h.sensitive {
+		with.sensitive[name] = true
+	}
+	return with
+}
+
+// Sensitive reports whether the value of a header is masked
+func (h *Headers) Sensitive(name string) bool {
+	return h.sensitive[http.CanonicalHeaderKey(strings.TrimSpace(name))]
+}
+
+// Value returns value, or Mask when the header is sensitive
+func (h *Headers) Value(name, value string) string {
+	if h.Sensitive(name) {
+		return Mask
+	}
+	return value
+}
+
+// Record returns the recorded headers of header, or nil when there are none
+func (h *Headers) Record(header http.Header) map[string]string {
+	if h == nil || (!h.all && len(h.include) == 0) {
+		return nil
+	}
+
+	var recorded map[string]string
+	for name, values := range header {
+		if !h.all && !h.include[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		if recorded == nil {
+			recorded = make(map[string]string)
+		}
+		recorded[name] = h.Value(name, strings.Join(values, ", "))
+	}
+	return recorded
+}
+
+// All returns every header of header with sensitive values masked, for
+// endpoints that show a request in full
+func (h *Headers) All(header http.Header) map[string][]string {
+	all := make(map[string][]string, len(header))
+	for name, values := range header {
+		if h.Sensitive(name) {
+			all[name] = []string{Mask}
+			continue
+		}
+		all[name] = append([]string(nil), values...)
+	}
+	return all
+}
+
+// secretFields are parts of field names whose values Fields masks
+var secretFields = []string{"password", "secret", "token", "api_key", "apikey", "private_key", "key_pem"}
+
+// Fields returns a decoded JSON value with the values of fields named like
+// secrets or like sensitive headers masked, for endpoints that show stored
+// data
+func (h *Headers) Fields(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		masked := make(map[string]interface{}, len(v))
+		for name, field := range v {
+			if h.Sensitive(name) || secretField(name) {
+				masked[name] = Mask
+				continue
+			}
+			masked[name] = h.Fields(field)
+		}
+		return masked
+	case []interface{}:
+		masked := make([]interface{}, len(v))
+		for i, item := range v {
+			masked[i] = h.Fields(item)
+		}
+		return masked
+	}
+	return value
+}
+
+// secretField reports whether a field is named like a secret
+func secretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range secretFields {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+type headersKey struct{}
+
+// NewContext returns a copy of ctx carrying the headers to use for the
+// current request
+func NewContext(ctx context.Context, h *Headers) context.Context {
+	return context.WithValue(ctx, headersKey{}, h)
+}
+
+// FromContext returns the headers set with NewContext
+func FromContext(ctx context.Context) (*Headers, bool) {
+	h, ok := ctx.Value(headersKey{}).(*Headers)
+	return h, ok && h != nil
+}
+
+func canonicalSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			set[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,213 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Error formats offered by content negotiation, in order of preference
+const (
+	FormatJSON = "application/json"
+	FormatText = "text/plain"
+	FormatHTML = "text/html"
+)
+
+var offers = []string{FormatJSON, FormatText, FormatHTML}
+
+// defaultErrorPage is used for HTML errors without an operator template
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<p>Request ID: {{.RequestID}}</p>{{end}}
+</body>
+</html>
+`))
+
+// ErrorPage is the data passed to HTML error templates
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+// ErrorPages holds operator-provided HTML error templates by status code
+type ErrorPages struct {
+	templates map[int]*template.Template
+}
+
+var errorPages atomic.Pointer[ErrorPages]
+
+// LoadErrorPages parses the <status>.html templates in dir, e.g. 404.html,
+// 502.html and 503.html. Other files are ignored.
+func LoadErrorPages(dir string) (*ErrorPages, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := &ErrorPages{templates: make(map[int]*template.Template)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".html" {
+			continue
+		}
+		status, err := strconv.Atoi(strings.TrimSuffix(name, ".html"))
+		if err != nil || status < 400 || status > 599 {
+			continue
+		}
+
+		tmpl, err := template.ParseFiles(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("error page %s: %w", name, err)
+		}
+		pages.templates[status] = tmpl
+	}
+	return pages, nil
+}
+
+// SetErrorPages installs the HTML error templates used by ErrorFor. Nil
+// restores the built-in page.
+func SetErrorPages(pages *ErrorPages) {
+	errorPages.Store(pages)
+}
+
+// errorTemplate returns the HTML template for a status
+func errorTemplate(status int) *template.Template {
+	if pages := errorPages.Load(); pages != nil {
+		if tmpl, ok := pages.templates[status]; ok {
+			return tmpl
+		}
+	}
+	return defaultErrorPage
+}
+
+// Negotiate returns the error format preferred by the request's Accept
+// header, FormatJSON when it has no preference
+func Negotiate(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return FormatJSON
+	}
+
+	best, bestQ := FormatJSON, 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q value the Accept header gives a media type,
+// taken from its most specific matching range
+func acceptQuality(accept, offer string) float64 {
+	offerType, _, _ := strings.Cut(offer, "/")
+
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		var s int
+		switch {
+		case mediaType == offer:
+			s = 2
+		case mediaType == offerType+"/*":
+			s = 1
+		case mediaType == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity, q = s, 1
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return q
+}
+
+// ErrorFor sends an error response in the format negotiated from r's Accept
+// header. HEAD requests get the headers without a body.
+func ErrorFor(w http.ResponseWriter, r *http.Request, statusCode int, code, message string) {
+	ErrorDataFor(w, r, statusCode, code, message, nil)
+}
+
+// ErrorDataFor is ErrorFor with details for the data of the JSON envelope,
+// which the text and HTML formats leave out
+func ErrorDataFor(w http.ResponseWriter, r *http.Request, statusCode int, code, message string, data interface{}) {
+	format := Negotiate(r)
+	if format == FormatJSON {
+		resp := errorResponse(w, code, message)
+		resp.Data = data
+		writeJSON(w, r.Method, statusCode, resp)
+		return
+	}
+
+	requestID := w.Header().Get(RequestIDHeader)
+	var body bytes.Buffer
+	switch format {
+	case FormatText:
+		fmt.Fprintf(&body, "%d %s: %s\n", statusCode, http.StatusText(statusCode), message)
+		fmt.Fprintf(&body, "Code: %s\n", code)
+		if requestID != "" {
+			fmt.Fprintf(&body, "Request ID: %s\n", requestID)
+		}
+	case FormatHTML:
+		page := ErrorPage{
+			Status:     statusCode,
+			StatusText: http.StatusText(statusCode),
+			Code:       code,
+			Message:    message,
+			RequestID:  requestID,
+		}
+		if err := errorTemplate(statusCode).Execute(&body, page); err != nil {
+			body.Reset()
+			defaultErrorPage.Execute(&body, page)
+		}
+	}
+
+	write(w, r.Method, statusCode, format+"; charset=utf-8", body.Bytes())
+}
+
+// write sends a body with its Content-Length, omitting it for HEAD requests
+// and statuses that can't carry one
+func write(w http.ResponseWriter, method string, statusCode int, contentType string, body []byte) {
+	if !bodyAllowed(statusCode) {
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(statusCode)
+	if method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// bodyAllowed reports whether a response with the status may have a body
+func bodyAllowed(statusCode int) bool {
+	return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
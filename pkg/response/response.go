@@ -5,19 +5,70 @@ import (
 	"net/http"
 )
 
+// RequestIDHeader carries the request ID, set on the response by the request ID middleware
+const RequestIDHeader = "X-Request-ID"
+
+// Machine-readable error codes
+const (
+	CodeBadRequest         = "BAD_REQUEST"
+	CodeInvalidBody        = "INVALID_BODY"
+	CodeBodyTooLarge       = "BODY_TOO_LARGE"
+	CodeValidationFailed   = "VALIDATION_FAILED"
+	CodeUnauthorized       = "UNAUTHORIZED"
+	CodeAuthMissing        = "AUTH_MISSING"
+	CodeAuthInvalid        = "AUTH_INVALID"
+	CodeAuthExpired        = "AUTH_EXPIRED"
+	CodeForbidden          = "FORBIDDEN"
+	CodeAccessDenied       = "ACCESS_DENIED"
+	CodeNotFound           = "NOT_FOUND"
+	CodeRouteNotFound      = "ROUTE_NOT_FOUND"
+	CodeMethodNotAllowed   = "METHOD_NOT_ALLOWED"
+	CodeConflict           = "CONFLICT"
+	CodeRateLimited        = "RATE_LIMITED"
+	CodeInternal           = "INTERNAL_ERROR"
+	CodeServiceUnavailable = "SERVICE_UNAVAILABLE"
+	CodeRouteDisabled      = "ROUTE_DISABLED"
+	CodeRouteInactive      = "ROUTE_INACTIVE"
+	CodeCircuitOpen        = "CIRCUIT_OPEN"
+	CodeDraining           = "DRAINING"
+	CodeBadGateway         = "BAD_GATEWAY"
+	CodeUpstreamTimeout    = "UPSTREAM_TIMEOUT"
+	CodeUpstreamTLS        = "UPSTREAM_TLS_VERIFY_FAILED"
+	CodeRequestTimeout     = "REQUEST_TIMEOUT"
+	CodeRequestCancelled   = "REQUEST_CANCELLED"
+	CodeTransformFailed    = "TRANSFORM_FAILED"
+	CodeMaintenance        = "MAINTENANCE"
+	CodeKeyInProgress      = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	CodeKeyReused          = "IDEMPOTENCY_KEY_REUSED"
+	CodeOverloaded         = "OVERLOADED"
+	CodeUpstreamThrottled  = "UPSTREAM_THROTTLED"
+	CodeFaultInjected      = "FAULT_INJECTED"
+	CodeDeadlineExceeded   = "DEADLINE_EXCEEDED"
+)
+
 // Response represents a standard API response
 type Response struct {
-	Success bool        `json:"success"`
-	Message string      `json:"message,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
-	Error   string      `json:"error,omitempty"`
+	Success   bool        `json:"success"`
+	Message   string      `json:"message,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Code      string      `json:"code,omitempty" example:"ROUTE_NOT_FOUND"`
+	RequestID string      `json:"request_id,omitempty" example:"4f1c2b7e9a0d3c65"`
 }
 
 // JSON sends a JSON response
 func JSON(w http.ResponseWriter, statusCode int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(data)
+	writeJSON(w, "", statusCode, data)
+}
+
+// writeJSON encodes data and sends it with its Content-Length
+func writeJSON(w http.ResponseWriter, method string, statusCode int, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	write(w, method, statusCode, "application/json", append(body, '\n'))
 }
 
 // Success sends a success response
@@ -29,12 +80,57 @@ func Success(w http.ResponseWriter, message string, data interface{}) {
 	})
 }
 
-// Error sends an error response
+// Error sends an error response with the default code for the status
 func Error(w http.ResponseWriter, statusCode int, message string) {
-	JSON(w, statusCode, Response{
-		Success: false,
-		Error:   message,
-	})
+	ErrorCode(w, statusCode, StatusCode(statusCode), message)
+}
+
+// ErrorCode sends an error response with a machine-readable code and the
+// request ID, if the request ID middleware set one
+func ErrorCode(w http.ResponseWriter, statusCode int, code, message string) {
+	JSON(w, statusCode, errorResponse(w, code, message))
+}
+
+// errorResponse builds the error envelope
+func errorResponse(w http.ResponseWriter, code, message string) Response {
+	return Response{
+		Success:   false,
+		Error:     message,
+		Code:      code,
+		RequestID: w.Header().Get(RequestIDHeader),
+	}
+}
+
+// StatusCode returns the default error code for an HTTP status
+func StatusCode(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeBodyTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusBadGateway:
+		return CodeBadGateway
+	case http.StatusServiceUnavailable:
+		return CodeServiceUnavailable
+	case http.StatusGatewayTimeout:
+		return CodeUpstreamTimeout
+	}
+	if statusCode >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
 }
 
 // BadRequest sends a 400 Bad Request response